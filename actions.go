@@ -0,0 +1,145 @@
+
+package main
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// Actions applied to files that failed the validation, as requested with the
+// option -on-error. A file fails the validation if its analysis fails or, with
+// -fail-on, if it has a diagnostic at least as severe as the threshold given.
+// Errors writing the outputs requested for a file (-o, -spict...) say nothing
+// about the file itself, and never trigger the action.
+
+type onErrorKind int
+const (
+    moveOnError onErrorKind = iota
+    copyOnError
+    deleteOnError
+    renameOnError
+)
+
+type onErrorAction struct {
+    kind            onErrorKind
+    arg             string      // directory for move/copy, suffix for rename
+    failOn          severity    // least severe diagnostic that fails a file
+}
+
+func parseOnError( action string ) (*onErrorAction, error) {
+// -on-error=move:<dir>|copy:<dir>|delete|rename-suffix:<sfx>
+    parts := strings.SplitN( action, ":", 2 )
+    res := &onErrorAction{ failOn: errorSeverity }
+    switch parts[0] {
+    case "move":            res.kind = moveOnError
+    case "copy":            res.kind = copyOnError
+    case "delete":          res.kind = deleteOnError
+    case "rename-suffix":   res.kind = renameOnError
+    default:
+        return nil, fmt.Errorf( "invalid action on error: %s\n", action )
+    }
+    if res.kind == deleteOnError {
+        if len(parts) != 1 {
+            return nil, fmt.Errorf( "action on error delete does not take any" +
+                                    " argument: %s\n", action )
+        }
+        return res, nil
+    }
+    if len(parts) != 2 || parts[1] == "" {
+        return nil, fmt.Errorf( "missing argument for action on error: %s\n",
+                                action )
+    }
+    res.arg = parts[1]
+    if res.kind != renameOnError {
+        info, err := os.Stat( res.arg )
+        if err != nil || ! info.IsDir() {
+            return nil, fmt.Errorf( "action on error: %s is not a directory\n",
+                                    res.arg )
+        }
+    }
+    return res, nil
+}
+
+func copyFile( src, dst string ) (err error) {
+    var in, out *os.File
+    if in, err = os.Open( src ); err != nil {
+        return
+    }
+    defer in.Close()
+    out, err = os.OpenFile( dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644 )
+    if err != nil {
+        return
+    }
+    defer func ( ) {
+        if e := out.Close(); err == nil {
+            err = e
+        }
+    }()
+    _, err = io.Copy( out, in )
+    return
+}
+
+// moveFile renames src as dst, falling back to copying and removing src if
+// both are not on the same file system. It never replaces an existing file.
+func moveFile( src, dst string ) error {
+    if _, err := os.Lstat( dst ); err == nil {
+        return fmt.Errorf( "%s already exists", dst )
+    }
+    if err := os.Rename( src, dst ); err == nil {
+        return nil
+    }
+    if err := copyFile( src, dst ); err != nil {
+        return err
+    }
+    return os.Remove( src )
+}
+
+// applies returns true if the action applies to the file reported in rep,
+// given whether its analysis failed (invalid). Messages about the outputs
+// that could not be written are not taken into account.
+func (a *onErrorAction) applies( rep *fileReport, invalid bool ) bool {
+    switch a.failOn {
+    case errorSeverity:
+        return invalid
+    case fatalSeverity:
+        invalid = false         // only files that could not be analysed
+    }
+    for _, m := range rep.messages {
+        if m.severity >= a.failOn && m.code != codeOutput {
+            return true
+        }
+    }
+    return invalid
+}
+
+// apply performs the action on the file at path, which failed validation.
+func (a *onErrorAction) apply( path string ) (err error) {
+    switch a.kind {
+    case moveOnError:
+        dst := filepath.Join( a.arg, filepath.Base( path ) )
+        if err = moveFile( path, dst ); err == nil {
+            fmt.Printf( "jpegcheck: moved %s to %s\n", path, dst )
+        }
+    case copyOnError:
+        dst := filepath.Join( a.arg, filepath.Base( path ) )
+        if err = copyFile( path, dst ); err == nil {
+            fmt.Printf( "jpegcheck: copied %s to %s\n", path, dst )
+        }
+    case deleteOnError:
+        if err = os.Remove( path ); err == nil {
+            fmt.Printf( "jpegcheck: deleted %s\n", path )
+        }
+    case renameOnError:
+        dst := path + a.arg
+        if err = moveFile( path, dst ); err == nil {
+            fmt.Printf( "jpegcheck: renamed %s as %s\n", path, dst )
+        }
+    }
+    if err != nil {
+        err = fmt.Errorf( "action on error failed for %s: %v\n", path, err )
+    }
+    return
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// testsetFile returns the data of the test set file name, valid or broken
+func testsetFile( t *testing.T, name string ) []byte {
+    t.Helper()
+    for i := range testsetSpecs {
+        spec := &testsetSpecs[i]
+        if spec.name != name {
+            continue
+        }
+        if spec.breaks == nil {
+            return testsetData( t, name )
+        }
+        data, err := spec.breaks( testsetData( t, spec.base ) )
+        if err != nil {
+            t.Fatalf( "%s: %v", name, err )
+        }
+        return data
+    }
+    t.Fatalf( "no test set file %s", name )
+    return nil
+}
+
+func TestOnErrorDelete( t *testing.T ) {
+    tests := []struct {
+        name        string
+        file        string
+        args        []string
+        deleted     bool
+    }{
+        { "valid", "baseline-420.jpg", nil, false },
+        { "invalid", "broken-bad-huffman.jpg", nil, true },
+        { "failed output", "baseline-420.jpg",
+          []string{ "-tidyup", "-o=/nonexistent/dir/out.jpg" }, false },
+        { "invalid and failed output", "broken-restart-order.jpg",
+          []string{ "-o=/nonexistent/dir/out.jpg" }, true },
+        { "warning", "trailing-data-420.jpg", nil, false },
+        { "warning with -fail-on", "trailing-data-420.jpg",
+          []string{ "-fail-on=warning" }, true },
+        { "invalid with -fail-on fatal", "broken-bad-huffman.jpg",
+          []string{ "-fail-on=fatal" }, false },
+    }
+    for _, tc := range tests {
+        t.Run( tc.name, func( t *testing.T ) {
+            path := filepath.Join( t.TempDir(), tc.file )
+            if err := os.WriteFile( path, testsetFile( t, tc.file ),
+                                    0644 ); err != nil {
+                t.Fatal( err )
+            }
+            args := append( []string{ "-q", "-on-error=delete" }, tc.args... )
+            processBatch( checkerArgs( t, append( args, path )... ) )
+            _, err := os.Stat( path )
+            if deleted := os.IsNotExist( err ); deleted != tc.deleted {
+                t.Errorf( "deleted %t, expected %t", deleted, tc.deleted )
+            }
+        } )
+    }
+}
+
+func TestOutputErrorNewline( t *testing.T ) {
+    err := outputError{ os.ErrNotExist, false }
+    if text := err.Error(); text[len(text)-1] != '\n' {
+        t.Errorf( "output error %q without trailing newline", text )
+    }
+    if errorCode( err ) != codeOutput {
+        t.Errorf( "output error code %s, expected %s", errorCode( err ),
+                  codeOutput )
+    }
+}
@@ -0,0 +1,304 @@
+
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "image"
+    "image/draw"
+    stdjpeg "image/jpeg"
+    "io"
+    "os"
+
+    "github.com/jrm-1535/jpeg"
+)
+
+// Adobe APP14 segment and color space: the library assumes that a frame with
+// 3 components is YCbCr, and cannot save a frame with 4 components. The
+// color space is decided here as decoders do (libjpeg): a single component is
+// gray; 3 components are YCbCr if the file has a JFIF segment, otherwise the
+// color transform of an Adobe APP14 segment tells whether they are YCbCr (1)
+// or RGB (0), and without either, component ids 'R', 'G', 'B' mean RGB; 4
+// components are YCCK if the Adobe transform is 2, CMYK otherwise. The color
+// space is printed when it is not the usual one or is decided by an Adobe
+// segment, given in json output, and pictures in RGB, CMYK or YCCK are saved
+// by -spict with the standard decoder, which applies the Adobe conventions
+// (inverted CMYK), either converted to RGB or, for CMYK and YCCK, as CMYK
+// ink amounts. As the library does not keep the Adobe segment in the copy
+// written with -o, which would then be decoded with other colors (or not at
+// all for 4 components), the segment of the original is put back unless it
+// is removed with -rmeta=14.
+
+type adobeSegment struct {
+    version         uint16      // DCTEncode version
+    flags0, flags1  uint16
+    transform       byte        // 0 none (RGB or CMYK), 1 YCbCr, 2 YCCK
+}
+
+var adobeTransforms = [...]string{ "none (RGB or CMYK)", "YCbCr", "YCCK" }
+
+// parseAdobe returns the content of an Adobe APP14 segment payload
+func parseAdobe( d []byte ) (*adobeSegment, bool) {
+    if ! bytes.HasPrefix( d, []byte( "Adobe" ) ) || len(d) < 12 {
+        return nil, false
+    }
+    short := func( i int ) uint16 {
+        return uint16(d[i]) << 8 | uint16(d[i+1])
+    }
+    return &adobeSegment{ version: short( 5 ), flags0: short( 7 ),
+                          flags1: short( 9 ), transform: d[11] }, true
+}
+
+func (as *adobeSegment) transformName( ) string {
+    if int(as.transform) < len(adobeTransforms) {
+        return adobeTransforms[as.transform]
+    }
+    return "invalid"
+}
+
+// findAdobe returns the first Adobe APP14 segment of data before the first
+// scan, or nil, and whether a JFIF segment was found before the first scan
+func findAdobe( data []byte, l *fileLayout ) (adobe *adobeSegment, jfif bool) {
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.marker == markerSOS || s.marker == markerEOI {
+            break
+        }
+        d := s.data( data )
+        switch s.marker {
+        case markerAPP0:
+            jfif = jfif || bytes.HasPrefix( d, []byte( "JFIF\x00" ) )
+        case markerAPP0 + 14:
+            if as, ok := parseAdobe( d ); ok && adobe == nil {
+                adobe = as
+            }
+        }
+    }
+    return
+}
+
+// colorSpace is the interpretation of the components of a frame
+type colorSpace struct {
+    name            string      // enum: gray, YCbCr, RGB, CMYK, YCCK, unknown
+    reason          string
+}
+
+// frameColorSpace returns the color space of a frame with the component ids,
+// given the Adobe segment (nil if none) and the presence of a JFIF segment
+func frameColorSpace( ids []byte, adobe *adobeSegment,
+                      jfif bool ) colorSpace {
+    switch len(ids) {
+    case 1:
+        return colorSpace{ "gray", "single component" }
+    case 3:
+        switch {
+        case jfif:
+            return colorSpace{ "YCbCr", "JFIF segment" }
+        case adobe != nil && adobe.transform == 0:
+            return colorSpace{ "RGB", "Adobe APP14 transform 0" }
+        case adobe != nil:
+            return colorSpace{ "YCbCr",
+                    fmt.Sprintf( "Adobe APP14 transform %d", adobe.transform ) }
+        case bytes.Equal( ids, []byte( "RGB" ) ):
+            return colorSpace{ "RGB", "component ids R, G, B" }
+        }
+        return colorSpace{ "YCbCr", "default for 3 components" }
+    case 4:
+        switch {
+        case adobe != nil && adobe.transform == 2:
+            return colorSpace{ "YCCK", "Adobe APP14 transform 2" }
+        case adobe != nil:
+            return colorSpace{ "CMYK",
+                    fmt.Sprintf( "Adobe APP14 transform %d", adobe.transform ) }
+        }
+        return colorSpace{ "CMYK", "default for 4 components" }
+    }
+    return colorSpace{ "unknown", fmt.Sprintf( "%d components", len(ids) ) }
+}
+
+// fileColorSpace returns the color space of the first frame of data, and
+// false if there is no frame
+func fileColorSpace( data []byte, l *fileLayout ) (colorSpace, bool) {
+    adobe, jfif := findAdobe( data, l )
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.marker == markerEOI {
+            break
+        }
+        if ! isSOF( s.marker ) {
+            continue
+        }
+        fh, err := parseFrameHeader( s, data )
+        if err != nil {
+            break
+        }
+        ids := make( []byte, len(fh.comps) )
+        for i, c := range fh.comps {
+            ids[i] = c.id
+        }
+        return frameColorSpace( ids, adobe, jfif ), true
+    }
+    return colorSpace{ }, false
+}
+
+// formatColorSpace records the color space of the first frame in rep, prints
+// it if it is not gray or YCbCr or if it is given by an Adobe segment, and
+// reports the Adobe transforms that do not match the number of components
+func formatColorSpace( data []byte, l *fileLayout, rep *fileReport ) {
+    cs, ok := fileColorSpace( data, l )
+    if ! ok {
+        return
+    }
+    rep.colorSpace = cs.name
+    adobe, jfif := findAdobe( data, l )
+    if adobe == nil && ( cs.name == "gray" || cs.name == "YCbCr" ) {
+        return
+    }
+    fmt.Printf( "Color space: %s (%s)\n", cs.name, cs.reason )
+    if adobe == nil {
+        return
+    }
+    var text string
+    switch {
+    case adobe.transform > 2:
+        text = fmt.Sprintf( "Adobe APP14: invalid color transform %d",
+                            adobe.transform )
+    case adobe.transform == 2 && cs.name != "YCCK":
+        text = "Adobe APP14: YCCK transform for a frame without 4 components"
+    case jfif && adobe.transform == 0 && cs.name == "YCbCr":
+        text = "Adobe APP14: RGB transform ignored because of the JFIF segment"
+    }
+    if text != "" {
+        fmt.Printf( "  Warning: %s\n", text )
+        rep.addMessage( warningSeverity, codeAdobe, text )
+    }
+}
+
+// formatAdobe prints the Adobe APP14 segment of data, if any
+func formatAdobe( w io.Writer, data []byte ) {
+    l := scanLayout( data )
+    adobe, jfif := findAdobe( data, l )
+    if adobe == nil {
+        return
+    }
+    fmt.Fprintf( w, "------ Adobe APP14 Metadata:\n" )
+    fmt.Fprintf( w, "  DCTEncode version: %d\n", adobe.version )
+    fmt.Fprintf( w, "  Flags0: 0x%04x", adobe.flags0 )
+    if adobe.flags0 & 0x8000 != 0 {
+        fmt.Fprintf( w, " (blend)" )
+    }
+    fmt.Fprintf( w, "\n  Flags1: 0x%04x\n", adobe.flags1 )
+    fmt.Fprintf( w, "  Color transform: %d, %s\n", adobe.transform,
+                 adobe.transformName() )
+    if cs, ok := fileColorSpace( data, l ); ok {
+        fmt.Fprintf( w, "  Frame color space: %s", cs.name )
+        if jfif {
+            fmt.Fprintf( w, " (JFIF segment present)" )
+        }
+        fmt.Fprintf( w, "\n" )
+    }
+}
+
+// adobeCopy puts back the Adobe APP14 segment of the original data orig in
+// the copy at output if it is missing, unless remove is true. The segment is
+// inserted after the JFIF and Exif segments. It returns a description of the
+// change, or "" if nothing was done.
+func adobeCopy( orig []byte, output string, remove bool ) (string, error) {
+    ol := scanLayout( orig )
+    var seg []byte
+    for i := range ol.segments {
+        s := &ol.segments[i]
+        if isImageDataMarker( s.marker ) || s.marker == markerEOI {
+            break
+        }
+        if _, ok := parseAdobe( s.data( orig ) ); ok &&
+           s.marker == markerAPP0 + 14 {
+            seg = orig[s.offset:s.end()]
+            break
+        }
+    }
+    if seg == nil || remove {
+        return "", nil
+    }
+    data, err := os.ReadFile( output )
+    if err != nil {
+        return "", fmt.Errorf( "adobe: %v\n", err )
+    }
+    l := scanLayout( data )
+    if adobe, _ := findAdobe( data, l ); adobe != nil {
+        return "", nil
+    }
+    insertAt := 2                       // after SOI, JFIF and Exif
+    for i := range l.segments {
+        s := &l.segments[i]
+        if isImageDataMarker( s.marker ) || s.marker == markerEOI {
+            break
+        }
+        if s.marker == markerAPP0 || s.marker == markerAPP0 + 1 {
+            insertAt = s.end()
+        }
+    }
+    var b bytes.Buffer
+    b.Write( data[:insertAt] )
+    b.Write( seg )
+    b.Write( data[insertAt:] )
+    if err = writeFile( output, b.Bytes(), 0644 ); err != nil {
+        return "", fmt.Errorf( "adobe: %v\n", err )
+    }
+    return "adobe: APP14 segment of the original put back in the copy", nil
+}
+
+// orientationValue returns the tiff/exif orientation value, from 1 to 8, of
+// o, or 1 if o is nil
+func orientationValue( o *jpeg.Orientation ) int {
+    if o == nil {
+        return 1
+    }
+    name := sideEnum( o.Row0 ).description[:1] +
+            sideEnum( o.Col0 ).description[:1]
+    for i, n := range orientation {
+        if n == name {
+            return i + 1
+        }
+    }
+    return 1
+}
+
+// saveConvertedPicture saves the main picture of data as raw RGB samples at
+// path, as the library does, for the color spaces that the library does not
+// handle (RGB, CMYK and YCCK), with the given orientation. If bw is true the
+// samples are the Rec.601 luma repeated as R, G and B. If cmyk is true, the
+// samples of a CMYK or YCCK picture are saved instead as C, M, Y and K ink
+// amounts (4 bytes per pixel, 0 for no ink). It returns the picture
+// dimensions and the number of bytes written.
+func saveConvertedPicture( path string, data []byte, bw, cmyk bool,
+                           o *jpeg.Orientation ) (nc, nr uint, n int,
+                                                  err error) {
+    img, err := stdjpeg.Decode( bytes.NewReader( data ) )
+    if err != nil {
+        return 0, 0, 0, fmt.Errorf( "unable to decode the picture: %v\n", err )
+    }
+    var samples *image.RGBA
+    size := 3
+    if cmyk {
+        c, ok := img.(*image.CMYK)
+        if ! ok {
+            return 0, 0, 0, fmt.Errorf( "the picture has no CMYK samples\n" )
+        }
+        // orientImage only moves pixels: CMYK samples are carried as RGBA
+        samples = &image.RGBA{ Pix: c.Pix, Stride: c.Stride, Rect: c.Rect }
+        size = 4
+    } else {
+        samples = image.NewRGBA( img.Bounds().Sub( img.Bounds().Min ) )
+        draw.Draw( samples, samples.Rect, img, img.Bounds().Min, draw.Src )
+    }
+    if bw {
+        for i := 0; i < len(samples.Pix); i += 4 {
+            p := samples.Pix[i:i+3]
+            v := clampSample( 0.299 * float64(p[0]) + 0.587 * float64(p[1]) +
+                              0.114 * float64(p[2]) )
+            p[0], p[1], p[2] = v, v, v
+        }
+    }
+    return writeRawSamples( path, samples, size, o )
+}
@@ -0,0 +1,513 @@
+
+package main
+
+import (
+    "fmt"
+    "os"
+
+    "github.com/jrm-1535/jpeg"
+)
+
+// Arithmetic decoder (T.81 Annex D, sections F.2.4 and G.2): the library
+// only decodes Huffman coded frames and rejects arithmetic coded frames
+// (SOF9, SOF10) at their first scan, although they are legal. Their
+// coefficients are decoded here for the coefficient decoder, sequential and
+// progressive scans including successive approximation refinements, with the
+// conditioning defined by DAC segments or the default conditioning. A file
+// whose first frame is arithmetic coded is then checked without the library:
+// it is reported as complete if all scans are decoded up to EOI, and the MCUs
+// in the window given by -b and -e are traced with -mcu and -du.
+
+type arithDecoder struct {
+    data            []byte
+    pos             int
+    c, a            uint32
+    ct              int
+    marker          bool        // a marker was reached
+    shifts          int64       // renormalization shifts (bits consumed)
+}
+
+func (ad *arithDecoder) reset( ) {
+    ad.c, ad.a, ad.ct, ad.marker = 0, 0, -16, false  // 2 bytes to read first
+}
+
+// byteIn returns the next byte of entropy-coded data, or 0 after a marker,
+// which is legal in arithmetic coded data
+func (ad *arithDecoder) byteIn( ) uint32 {
+    if ad.marker || ad.pos >= len(ad.data) {
+        return 0
+    }
+    b := ad.data[ad.pos]
+    if b != 0xff {
+        ad.pos ++
+        return uint32(b)
+    }
+    if ad.pos + 1 < len(ad.data) && ad.data[ad.pos+1] == 0x00 {
+        ad.pos += 2
+        return 0xff
+    }
+    ad.marker = true
+    return 0
+}
+
+// decode returns the decision coded with the statistics bin st (section D.2)
+func (ad *arithDecoder) decode( st *byte ) int {
+    for ad.a < 0x8000 {                 // renormalization
+        if ad.ct --; ad.ct < 0 {
+            ad.c = ad.c << 8 | ad.byteIn()
+            if ad.ct += 8; ad.ct < 0 {
+                if ad.ct ++; ad.ct == 0 {
+                    ad.a = 0x8000       // initial bytes read
+                }
+            }
+        }
+        ad.a <<= 1
+        ad.shifts ++
+    }
+    sv := *st
+    qe := qeTable[sv & 0x7f]
+    nl, nm := byte(qe), byte(qe >> 8)
+    q := qe >> 16
+    ad.a -= q
+    temp := ad.a << uint(ad.ct)
+    d := int(sv >> 7)
+    switch {
+    case ad.c >= temp:
+        ad.c -= temp
+        if ad.a < q {                   // conditional exchange, MPS
+            *st = ( sv & 0x80 ) ^ nm
+        } else {
+            *st = ( sv & 0x80 ) ^ nl
+            d ^= 1
+        }
+        ad.a = q
+    case ad.a < 0x8000:
+        if ad.a < q {                   // conditional exchange, LPS
+            *st = ( sv & 0x80 ) ^ nl
+            d ^= 1
+        } else {
+            *st = ( sv & 0x80 ) ^ nm
+        }
+    }
+    return d
+}
+
+// restart skips to the RSTn marker expected at the end of a restart interval
+func (ad *arithDecoder) restart( ) (err error) {
+    ad.reset()
+    ad.pos, err = skipToRestart( ad.data, ad.pos )
+    return
+}
+
+// MCUs to print while decoding (-mcu, -du with -b and -e)
+type mcuTrace struct {
+    begin, end      uint
+    mcu, du         bool
+}
+
+func (mt *mcuTrace) in( mcu int ) bool {
+    return mt != nil && uint(mcu) >= mt.begin && uint(mcu) <= mt.end
+}
+
+// arithmetic scan decoding state
+type arithScanDecoder struct {
+    img             *coefImage
+    ad              *arithDecoder
+    comps           []int       // frame component indexes in scan
+    dcTables        []int
+    acTables        []int
+    dcL, dcU        []int       // DC conditioning of each scan component
+    acK             []int       // AC conditioning of each scan component
+    dcStats         [4][64]byte
+    acStats         [4][256]byte
+    pred            []int32
+    dcContext       []int
+    fixed           byte
+    ss, se          int
+    ah, al          int         // successive approximation
+}
+
+func (as *arithScanDecoder) resetStatistics( ) {
+    as.dcStats = [4][64]byte{}
+    as.acStats = [4][256]byte{}
+    for i := range as.pred {
+        as.pred[i], as.dcContext[i] = 0, 0
+    }
+    as.fixed = fixedState
+}
+
+// decodeBits decodes the magnitude bits of a non zero value of magnitude
+// category m, whose last category bin is st[x], and returns the value with
+// the given sign (figure F.24)
+func (as *arithScanDecoder) decodeBits( st []byte, x, m, sign int ) int32 {
+    v := m
+    for x += 14; m > 1; {
+        m >>= 1
+        if as.ad.decode( &st[x] ) != 0 {
+            v |= m
+        }
+    }
+    if v ++; sign != 0 {
+        v = -v
+    }
+    return int32(v)
+}
+
+// decodeCategory decodes the end of a magnitude category from bin st[x],
+// with m the category already decoded, and returns the category and its last
+// bin (figure F.23)
+func (as *arithScanDecoder) decodeCategory( st []byte, x,
+                                            m int ) (int, int, error) {
+    for ; as.ad.decode( &st[x] ) != 0; x++ {
+        if m <<= 1; m == 0x8000 {
+            return 0, x, fmt.Errorf( "invalid arithmetic code (magnitude " +
+                                     "overflow) @0x%x\n", as.ad.pos )
+        }
+    }
+    return m, x, nil
+}
+
+// decodeDC decodes the DC difference of a block of scan component sci and
+// returns the DC value (section F.1.4.4.1)
+func (as *arithScanDecoder) decodeDC( sci int ) (int32, error) {
+    st := as.dcStats[as.dcTables[sci]][:]
+    s0 := as.dcContext[sci]
+    if as.ad.decode( &st[s0] ) == 0 {
+        as.dcContext[sci] = 0
+        return as.pred[sci], nil
+    }
+    sign := as.ad.decode( &st[s0+1] )
+    x, m := s0 + 2 + sign, 0            // SP or SN
+    if as.ad.decode( &st[x] ) != 0 {
+        var err error
+        if m, x, err = as.decodeCategory( st, 20, 1 ); err != nil {
+            return 0, err
+        }
+    }
+    switch {
+    case m < 1 << uint(as.dcL[sci]) >> 1:
+        as.dcContext[sci] = 0
+    case m > 1 << uint(as.dcU[sci]) >> 1:
+        as.dcContext[sci] = 12 + 4 * sign
+    default:
+        as.dcContext[sci] = 4 + 4 * sign
+    }
+    as.pred[sci] += as.decodeBits( st, x, m, sign )
+    return as.pred[sci], nil
+}
+
+// decodeAC decodes the AC coefficients from ss to se of a block of scan
+// component sci (section F.1.4.4.2)
+func (as *arithScanDecoder) decodeAC( sci int, b *block, ss, se int ) error {
+    ad := as.ad
+    st := as.acStats[as.acTables[sci]][:]
+    for k := ss; k <= se; k++ {
+        x := 3 * ( k - 1 )
+        if ad.decode( &st[x] ) != 0 {
+            break                       // EOB
+        }
+        for ad.decode( &st[x+1] ) == 0 {
+            x += 3
+            if k ++; k > se {
+                return fmt.Errorf( "coefficient index overrun (%d)\n", k )
+            }
+        }
+        sign := ad.decode( &as.fixed )
+        x, m := x + 2, 0
+        if ad.decode( &st[x] ) != 0 {
+            m = 1
+            if ad.decode( &st[x] ) != 0 {
+                x = 217
+                if k <= as.acK[sci] {
+                    x = 189
+                }
+                var err error
+                if m, x, err = as.decodeCategory( st, x, 2 ); err != nil {
+                    return err
+                }
+            }
+        }
+        b[zigZag[k]] = as.decodeBits( st, x, m, sign ) << uint(as.al)
+    }
+    return nil
+}
+
+// decodeACRefine decodes a refinement AC scan of a progressive frame for a
+// block (section G.1.3.3)
+func (as *arithScanDecoder) decodeACRefine( sci int, b *block ) error {
+    ad := as.ad
+    st := as.acStats[as.acTables[sci]][:]
+    p1, m1 := int32(1) << uint(as.al), int32(-1) << uint(as.al)
+    kex := as.se                        // end of block of previous stages
+    for ; kex > 0 && b[zigZag[kex]] == 0; kex-- {
+    }
+    for k := as.ss; k <= as.se; k++ {
+        x := 3 * ( k - 1 )
+        if k > kex && ad.decode( &st[x] ) != 0 {
+            break                       // EOB
+        }
+        for {
+            c := &b[zigZag[k]]
+            if *c != 0 {                // correction bit
+                if ad.decode( &st[x+2] ) != 0 {
+                    if *c < 0 {
+                        *c += m1
+                    } else {
+                        *c += p1
+                    }
+                }
+                break
+            }
+            if ad.decode( &st[x+1] ) != 0 {   // newly non zero
+                if ad.decode( &as.fixed ) != 0 {
+                    *c = m1
+                } else {
+                    *c = p1
+                }
+                break
+            }
+            x += 3
+            if k ++; k > as.se {
+                return fmt.Errorf( "coefficient index overrun (%d)\n", k )
+            }
+        }
+    }
+    return nil
+}
+
+// decodeBlock decodes the data of a block in the scan, counting the bits used
+// as DC or AC bits according to the scan
+func (as *arithScanDecoder) decodeBlock( sci int, b *block,
+                                         cc *compCoefs ) (err error) {
+    before := as.ad.shifts
+    progressive := as.img.frame.marker == markerSOF0 + 10
+    var dc int32
+    switch {
+    case ! progressive:
+        if dc, err = as.decodeDC( sci ); err == nil {
+            b[0] = dc
+            cc.dcBits += as.ad.shifts - before
+            before = as.ad.shifts
+            err = as.decodeAC( sci, b, 1, 63 )
+        }
+        cc.acBits += as.ad.shifts - before
+        return
+    case as.ss == 0 && as.ah == 0:
+        if dc, err = as.decodeDC( sci ); err == nil {
+            b[0] = dc << uint(as.al)
+        }
+    case as.ss == 0:
+        if as.ad.decode( &as.fixed ) != 0 {
+            b[0] |= 1 << uint(as.al)
+        }
+    case as.ah == 0:
+        err = as.decodeAC( sci, b, as.ss, as.se )
+    default:
+        err = as.decodeACRefine( sci, b )
+    }
+    if as.ss == 0 {
+        cc.dcBits += as.ad.shifts - before
+    } else {
+        cc.acBits += as.ad.shifts - before
+    }
+    return
+}
+
+// traceBlock prints the coefficients of a block changed by the scan, as the
+// library does for Huffman coded scans with -mcu, and the block with -du
+func traceBlock( mt *mcuTrace, mcu, sci, row, col, pos int, prev,
+                 b *block ) {
+    if mt.mcu {
+        for k := 0; k < 64; k++ {
+            if b[zigZag[k]] == prev[zigZag[k]] {
+                continue
+            }
+            kind := "AC"
+            if k == 0 {
+                kind = "DC"
+            }
+            fmt.Printf( "MCU=%d comp=%d du=%d,%d coef=%d offset=%#x " +
+                        "Arithmetic %s: %d\n", mcu, sci, row, col, k, pos,
+                        kind, b[zigZag[k]] )
+        }
+    }
+    if mt.du {
+        for r := 0; r < 8; r++ {
+            if r == 0 {
+                fmt.Printf( "Data Unit:" )
+            } else {
+                fmt.Printf( "\n          " )
+            }
+            for c := 0; c < 8; c++ {
+                fmt.Printf( " %04d", b[8*r+c] )
+            }
+        }
+        fmt.Printf( "\n" )
+    }
+}
+
+// decodeArithmeticScan decodes the arithmetic coded data of a sequential or
+// progressive scan starting at offset in data, printing the MCUs in mt.
+func (img *coefImage) decodeArithmeticScan( data []byte, offset int,
+                                            sos []byte, ct *codingTables,
+                                            mt *mcuTrace ) error {
+    fh := img.frame
+    ns, err := scanComponents( sos )
+    if err != nil {
+        return err
+    }
+    as := &arithScanDecoder{ img: img,
+                             ad: &arithDecoder{ data: data, pos: offset },
+                             pred: make( []int32, ns ),
+                             dcContext: make( []int, ns ) }
+    as.ss, as.se = int(sos[1+2*ns]), int(sos[2+2*ns])
+    as.ah, as.al = int(sos[3+2*ns] >> 4), int(sos[3+2*ns] & 0x0f)
+    if fh.marker == markerSOF0 + 10 {
+        if as.se > 63 || as.ss > as.se || ( as.ss == 0 && as.se != 0 ) ||
+           ( as.ss > 0 && ns != 1 ) || as.al > 13 {
+            return fmt.Errorf( "invalid progressive scan parameters\n" )
+        }
+    } else if as.ss != 0 || as.se != 63 || sos[3+2*ns] != 0 {
+        return fmt.Errorf( "spectral selection or successive approximation " +
+                           "in a sequential frame\n" )
+    }
+    for i := 0; i < ns; i++ {
+        id, tables := sos[1+2*i], sos[2+2*i]
+        ci := -1
+        for j, c := range fh.comps {
+            if c.id == id {
+                ci = j
+            }
+        }
+        if ci == -1 {
+            return fmt.Errorf( "unknown component id %d in scan\n", id )
+        }
+        td, ta := int(tables >> 4 & 3), int(tables & 3)
+        as.comps = append( as.comps, ci )
+        as.dcTables = append( as.dcTables, td )
+        as.acTables = append( as.acTables, ta )
+        dc := ct.conditioning( 0, td )
+        as.dcL = append( as.dcL, int(dc & 0x0f) )
+        as.dcU = append( as.dcU, int(dc >> 4) )
+        as.acK = append( as.acK, int(ct.conditioning( 1, ta )) )
+    }
+    as.resetStatistics()
+    as.ad.reset()
+
+    var nx, ny int
+    if ns == 1 {
+        nx, ny = fh.compBlocks( as.comps[0] )
+    } else {
+        nx, ny = fh.mcus()
+    }
+    mcu := 0
+    var prev block
+    decode := func( sci, row, col int, b *block, cc *compCoefs ) error {
+        pos := as.ad.pos
+        prev = *b
+        if err := as.decodeBlock( sci, b, cc ); err != nil {
+            return fmt.Errorf( "MCU %d: %v", mcu, err )
+        }
+        if mt.in( mcu ) {
+            traceBlock( mt, mcu, sci, row, col, pos, &prev, b )
+        }
+        return nil
+    }
+    for my := 0; my < ny; my++ {
+        for mx := 0; mx < nx; mx++ {
+            if ct.restart > 0 && mcu > 0 && mcu % ct.restart == 0 {
+                if err := as.ad.restart(); err != nil {
+                    return err
+                }
+                if n := int(data[as.ad.pos-1] - markerRST0);
+                   n != ( mcu / ct.restart - 1 ) % 8 {
+                    img.issues = append( img.issues, fmt.Sprintf(
+                        "RST%d marker found instead of RST%d before MCU %d\n",
+                        n, ( mcu / ct.restart - 1 ) % 8, mcu ) )
+                }
+                img.restarts ++
+                as.resetStatistics()
+            }
+            for sci, ci := range as.comps {
+                cc := &img.comps[ci]
+                c := &fh.comps[ci]
+                if ns == 1 {
+                    if err := decode( sci, 0, 0, cc.at( mx, my ),
+                                      cc ); err != nil {
+                        return err
+                    }
+                    continue
+                }
+                for v := 0; v < c.v; v++ {
+                    for h := 0; h < c.h; h++ {
+                        b := cc.at( mx * c.h + h, my * c.v + v )
+                        if err := decode( sci, v, h, b, cc ); err != nil {
+                            return err
+                        }
+                    }
+                }
+            }
+            mcu ++
+        }
+    }
+    for _, ci := range as.comps {
+        for k := as.ss; k <= as.se && as.al == 0; k++ {
+            img.comps[ci].complete[k] = true
+        }
+    }
+    img.nScans ++
+    return nil
+}
+
+// isArithmetic returns true if m is the SOF marker of an arithmetic coded
+// frame
+func isArithmetic( m byte ) bool {
+    return isSOF( m ) && m >= markerSOF0 + 9
+}
+
+// checkArithmeticFile checks the file at path, whose first frame is arithmetic
+// coded and was rejected by the library, with the coefficient decoder. jpg is
+// what the library could parse before the first scan. It returns an error if
+// the file is not complete.
+func checkArithmeticFile( path string, data []byte, jpg *jpeg.Desc,
+                          process *jpgArgs, rep *fileReport ) error {
+    data, err := inputData( path, data )
+    if err != nil {
+        return fatalError{ fmt.Errorf( "unable to analyse file %s\n", path ) }
+    }
+    rep.setDesc( jpg )
+    jpg.FormatImageInfo( os.Stdout )
+    l := scanLayout( data )
+    var mt *mcuTrace
+    if c := &process.control; c.Mcu || c.Du {
+        mt = &mcuTrace{ begin: c.Begin, end: c.End, mcu: c.Mcu, du: c.Du }
+    }
+    img, err := decodeFrame( data, l, mt )
+    if err == nil && ! hasEOI( l ) {
+        err = fmt.Errorf( "missing EOI, the compressed picture may be " +
+                          "truncated\n" )
+    }
+    if err != nil {
+        text := fmt.Sprintf( "arithmetic coding: %v", err )
+        fmt.Printf( "%s", text )
+        rep.addMessage( errorSeverity, codeArithmetic, text )
+        return codedError{ fmt.Errorf( "file %s is not a complete jpeg " +
+                                       "file\n", path ), codeIncomplete }
+    }
+    rep.complete = true
+    jpg.FormatFrameInfo( os.Stdout, 0 )
+    fmt.Printf( "Arithmetic coding: %d scans and %d restart intervals " +
+                "decoded by jpegcheck\n", img.nScans, img.restarts )
+    for _, issue := range img.issues {
+        text := "arithmetic coding: " + issue
+        fmt.Printf( "  Warning: %s", text )
+        rep.addMessage( warningSeverity, codeArithmetic, text )
+    }
+    if process.output != "" {
+        text := "arithmetic coding: no copy written, the library cannot " +
+                "write arithmetic coded frames"
+        fmt.Printf( "%s\n", text )
+        rep.addMessage( warningSeverity, codeArithmetic, text )
+    }
+    return nil
+}
@@ -0,0 +1,414 @@
+
+package main
+
+import (
+    "bytes"
+    "fmt"
+)
+
+// Arithmetic encoder (T.81 Annex D), used to generate arithmetic coded
+// sequential and progressive files (SOF9, SOF10) for the test set.
+// Coefficients are coded as in section F.1.4 with the conditioning in force,
+// defined by a DAC segment or by default (L=0, U=1 for DC, Kx=5 for AC). As
+// for Huffman coding, progressive scans are limited to spectral selection.
+// The statistics are reset at each restart interval.
+
+// qeTable gives for each probability estimation state Qe in bits 16-31, the
+// next state after an MPS in bits 8-15, the MPS switch in bit 7 and the next
+// state after an LPS in bits 0-6 (table D.2). The last state is a fixed,
+// non-adaptive, probability of 0.5 used for the signs of AC coefficients.
+var qeTable = [114]uint32{
+    0x5a1d0181, 0x2586020e, 0x11140310, 0x080b0412, 0x03d80514, 0x01da0617,
+    0x00e50719, 0x006f081c, 0x0036091e, 0x001a0a21, 0x000d0b23, 0x00060c09,
+    0x00030d0a, 0x00010d0c, 0x5a7f0f8f, 0x3f251024, 0x2cf21126, 0x207c1227,
+    0x17b91328, 0x1182142a, 0x0cef152b, 0x09a1162d, 0x072f172e, 0x055c1830,
+    0x04061931, 0x03031a33, 0x02401b34, 0x01b11c36, 0x01441d38, 0x00f51e39,
+    0x00b71f3b, 0x008a203c, 0x0068213e, 0x004e223f, 0x003b2320, 0x002c0921,
+    0x5ae125a5, 0x484c2640, 0x3a0d2741, 0x2ef12843, 0x261f2944, 0x1f332a45,
+    0x19a82b46, 0x15182c48, 0x11772d49, 0x0e742e4a, 0x0bfb2f4b, 0x09f8304d,
+    0x0861314e, 0x0706324f, 0x05cd3330, 0x04de3432, 0x040f3532, 0x03633633,
+    0x02d43734, 0x025c3835, 0x01f83936, 0x01a43a37, 0x01603b38, 0x01253c39,
+    0x00f63d3a, 0x00cb3e3b, 0x00ab3f3d, 0x008f203d, 0x5b1241c1, 0x4d044250,
+    0x412c4351, 0x37d84452, 0x2fe84553, 0x293c4654, 0x23794756, 0x1edf4857,
+    0x1aa94957, 0x174e4a48, 0x14244b48, 0x119c4c4a, 0x0f6b4d4a, 0x0d514e4b,
+    0x0bb64f4d, 0x0a40304d, 0x583251d0, 0x4d1c5258, 0x438e5359, 0x3bdd545a,
+    0x34ee555b, 0x2eae565c, 0x299a575d, 0x25164756, 0x557059d8, 0x4ca95a5f,
+    0x44d95b60, 0x3e225c61, 0x38245d63, 0x32b45e63, 0x2e17565d, 0x56a860df,
+    0x4f466165, 0x47e56266, 0x41cf6367, 0x3c3d6468, 0x375e5d63, 0x52316669,
+    0x4c0f676a, 0x4639686b, 0x415e6367, 0x56276ae9, 0x50e76b6c, 0x4b85676d,
+    0x55976d6e, 0x504f6b6f, 0x5a106fee, 0x55226d70, 0x59eb6ff0, 0x5a1d7171,
+}
+
+const fixedState = 113
+
+type arithEncoder struct {
+    out             *bytes.Buffer
+    c, a            uint32
+    sc, zc          int         // stacked 0xff bytes and zero bytes
+    ct              int
+    buffer          int         // pending byte, -1 if none
+}
+
+func newArithEncoder( out *bytes.Buffer ) *arithEncoder {
+    ae := &arithEncoder{ out: out }
+    ae.reset()
+    return ae
+}
+
+func (ae *arithEncoder) reset( ) {
+    ae.c, ae.a, ae.ct = 0, 0x10000, 11
+    ae.sc, ae.zc, ae.buffer = 0, 0, -1
+}
+
+// emit writes a byte, stuffing a zero byte after 0xff
+func (ae *arithEncoder) emit( b int ) {
+    ae.out.WriteByte( byte(b) )
+    if byte(b) == 0xff {
+        ae.out.WriteByte( 0 )
+    }
+}
+
+func (ae *arithEncoder) emitZeros( ) {
+    for ; ae.zc > 0; ae.zc-- {
+        ae.out.WriteByte( 0 )
+    }
+}
+
+// byteOut outputs the byte temp taken from c, handling carries over the
+// pending and stacked bytes (section D.1.6)
+func (ae *arithEncoder) byteOut( temp uint32 ) {
+    switch {
+    case temp > 0xff:                   // carry
+        if ae.buffer >= 0 {
+            ae.emitZeros()
+            ae.emit( ae.buffer + 1 )
+        }
+        ae.zc += ae.sc                  // stacked 0xff become 0x00
+        ae.sc = 0
+        ae.buffer = int(temp & 0xff)
+    case temp == 0xff:
+        ae.sc ++
+    default:
+        ae.flushPending()
+        ae.buffer = int(temp)
+    }
+}
+
+// flushPending outputs the pending byte and the stacked 0xff bytes
+func (ae *arithEncoder) flushPending( ) {
+    if ae.buffer == 0 {
+        ae.zc ++
+    } else if ae.buffer >= 0 {
+        ae.emitZeros()
+        ae.emit( ae.buffer )
+    }
+    if ae.sc > 0 {
+        ae.emitZeros()
+        for ; ae.sc > 0; ae.sc-- {
+            ae.emit( 0xff )
+        }
+    }
+}
+
+// encode codes the decision d (0 or 1) with the statistics bin st
+func (ae *arithEncoder) encode( st *byte, d int ) {
+    sv := *st
+    qe := qeTable[sv & 0x7f]
+    nl, nm := byte(qe), byte(qe >> 8)
+    q := qe >> 16
+    ae.a -= q
+    if d != int(sv >> 7) {              // LPS
+        if ae.a >= q {
+            ae.c += ae.a
+            ae.a = q
+        }
+        *st = ( sv & 0x80 ) ^ nl
+    } else {                            // MPS
+        if ae.a >= 0x8000 {
+            return
+        }
+        if ae.a < q {
+            ae.c += ae.a
+            ae.a = q
+        }
+        *st = ( sv & 0x80 ) ^ nm
+    }
+    for ae.a < 0x8000 {                 // renormalization
+        ae.a <<= 1
+        ae.c <<= 1
+        if ae.ct --; ae.ct == 0 {
+            ae.byteOut( ae.c >> 19 )
+            ae.c &= 0x7ffff
+            ae.ct += 8
+        }
+    }
+}
+
+// flush terminates the entropy-coded data (section D.1.8)
+func (ae *arithEncoder) flush( ) {
+    if temp := ( ae.a - 1 + ae.c ) & 0xffff0000; temp < ae.c {
+        ae.c = temp + 0x8000
+    } else {
+        ae.c = temp
+    }
+    ae.c <<= uint(ae.ct)
+    if ae.c & 0xf8000000 != 0 {
+        if ae.buffer >= 0 {
+            ae.emitZeros()
+            ae.emit( ae.buffer + 1 )
+        }
+        ae.zc += ae.sc
+        ae.sc = 0
+    } else {
+        ae.flushPending()
+    }
+    if ae.c & 0x7fff800 != 0 {          // final bytes, unless zero
+        ae.emitZeros()
+        ae.emit( int(ae.c >> 19 & 0xff) )
+        if ae.c & 0x7f800 != 0 {
+            ae.emit( int(ae.c >> 11 & 0xff) )
+        }
+    }
+    ae.reset()
+}
+
+// arithmetic scan encoding state
+type arithScanEncoder struct {
+    ae              *arithEncoder
+    dcStats         [4][64]byte
+    acStats         [4][256]byte
+    dcTables        []int
+    acTables        []int
+    dcL, dcU        []int       // DC conditioning of each scan component
+    acK             []int       // AC conditioning of each scan component
+    pred            []int32
+    dcContext       []int
+    fixed           byte
+    ss, se, al      int         // spectral selection and point transform
+}
+
+func (as *arithScanEncoder) resetStatistics( ) {
+    as.dcStats = [4][64]byte{}
+    as.acStats = [4][256]byte{}
+    for i := range as.pred {
+        as.pred[i], as.dcContext[i] = 0, 0
+    }
+    as.fixed = fixedState
+}
+
+// encodeDC codes the difference between the DC value dc of a block of scan
+// component sci and the previous one
+func (as *arithScanEncoder) encodeDC( sci int, dc int32 ) {
+    ae := as.ae
+    st := as.dcStats[as.dcTables[sci]][:]
+    s0 := as.dcContext[sci]
+    v := int(dc - as.pred[sci])
+    as.pred[sci] = dc
+    if v == 0 {
+        ae.encode( &st[s0], 0 )
+        as.dcContext[sci] = 0
+        return
+    }
+    ae.encode( &st[s0], 1 )
+    x := s0 + 2                         // SP
+    sign := 0
+    if v < 0 {
+        v = -v
+        ae.encode( &st[s0+1], 1 )
+        x = s0 + 3                      // SN
+        sign = 1
+    } else {
+        ae.encode( &st[s0+1], 0 )
+    }
+    m := 0
+    if v - 1 != 0 {                     // X1, X2... from bin 20
+        ae.encode( &st[x], 1 )
+        m = 1
+        x = 20
+        for v2 := ( v - 1 ) >> 1; v2 != 0; v2 >>= 1 {
+            ae.encode( &st[x], 1 )
+            m <<= 1
+            x ++
+        }
+    }
+    ae.encode( &st[x], 0 )
+    switch {                            // conditioning category
+    case m < 1 << uint(as.dcL[sci]) >> 1:
+        as.dcContext[sci] = 0
+    case m > 1 << uint(as.dcU[sci]) >> 1:
+        as.dcContext[sci] = 12 + 4 * sign
+    default:
+        as.dcContext[sci] = 4 + 4 * sign
+    }
+    x += 14
+    for m >>= 1; m != 0; m >>= 1 {
+        ae.encode( &st[x], bit( v - 1, m ) )
+    }
+}
+
+// encodeAC codes the AC coefficients from ss to se of a block of scan
+// component sci
+func (as *arithScanEncoder) encodeAC( sci int, b *block, ss, se int ) {
+    ae := as.ae
+    st := as.acStats[as.acTables[sci]][:]
+    coef := func( k int ) int {
+        v := int(b[zigZag[k]])
+        if v < 0 {
+            return -( -v >> uint(as.al) )
+        }
+        return v >> uint(as.al)
+    }
+    ke := se
+    for ; ke >= ss && coef( ke ) == 0; ke-- {
+    }
+    k := ss
+    for ; k <= ke; k++ {
+        x := 3 * ( k - 1 )
+        ae.encode( &st[x], 0 )          // not EOB
+        for coef( k ) == 0 {
+            ae.encode( &st[x+1], 0 )
+            x += 3
+            k ++
+        }
+        ae.encode( &st[x+1], 1 )
+        v := coef( k )
+        if v < 0 {
+            v = -v
+            ae.encode( &as.fixed, 1 )
+        } else {
+            ae.encode( &as.fixed, 0 )
+        }
+        x += 2
+        m := 0
+        if v - 1 != 0 {
+            ae.encode( &st[x], 1 )
+            m = 1
+            if v2 := ( v - 1 ) >> 1; v2 != 0 {
+                ae.encode( &st[x], 1 )
+                m <<= 1
+                x = 217
+                if k <= as.acK[sci] {
+                    x = 189
+                }
+                for v2 >>= 1; v2 != 0; v2 >>= 1 {
+                    ae.encode( &st[x], 1 )
+                    m <<= 1
+                    x ++
+                }
+            }
+        }
+        ae.encode( &st[x], 0 )
+        x += 14
+        for m >>= 1; m != 0; m >>= 1 {
+            ae.encode( &st[x], bit( v - 1, m ) )
+        }
+    }
+    if k <= se {
+        ae.encode( &st[3*(k-1)], 1 )    // EOB
+    }
+}
+
+// encodeBlock codes the coefficients of a block selected by the scan
+func (as *arithScanEncoder) encodeBlock( sci int, b *block ) {
+    if as.ss == 0 {
+        as.encodeDC( sci, b[0] >> uint(as.al) )
+    }
+    if as.se > 0 {
+        ss := as.ss
+        if ss == 0 {
+            ss = 1
+        }
+        as.encodeAC( sci, b, ss, as.se )
+    }
+}
+
+func bit( v, m int ) int {
+    if v & m != 0 {
+        return 1
+    }
+    return 0
+}
+
+// encodeArithmeticScan writes the arithmetic coded data of a sequential scan
+// or of a progressive first scan from the coefficients of img, including RSTn
+// markers, with the conditioning and the restart interval of ct
+func (img *coefImage) encodeArithmeticScan( out *bytes.Buffer, sos []byte,
+                                            ct *codingTables ) error {
+    fh := img.frame
+    ns, err := scanComponents( sos )
+    if err != nil {
+        return err
+    }
+    as := &arithScanEncoder{ ae: newArithEncoder( out ),
+                             pred: make( []int32, ns ),
+                             dcContext: make( []int, ns ), se: 63 }
+    if fh.marker == markerSOF0 + 10 {
+        as.ss, as.se = int(sos[1+2*ns]), int(sos[2+2*ns])
+        as.al = int(sos[3+2*ns] & 0x0f)
+        if sos[3+2*ns] >> 4 != 0 {
+            return fmt.Errorf( "successive approximation refinement scans " +
+                               "cannot be encoded\n" )
+        }
+        if as.se > 63 || as.ss > as.se || ( as.ss == 0 && as.se != 0 ) ||
+           ( as.ss > 0 && ns != 1 ) {
+            return fmt.Errorf( "invalid progressive scan %d-%d\n", as.ss,
+                               as.se )
+        }
+    }
+    var comps []int
+    for i := 0; i < ns; i++ {
+        id, tables := sos[1+2*i], sos[2+2*i]
+        ci := -1
+        for j, c := range fh.comps {
+            if c.id == id {
+                ci = j
+            }
+        }
+        if ci == -1 {
+            return fmt.Errorf( "invalid scan component %d\n", id )
+        }
+        td, ta := int(tables >> 4 & 3), int(tables & 3)
+        comps = append( comps, ci )
+        as.dcTables = append( as.dcTables, td )
+        as.acTables = append( as.acTables, ta )
+        dc := ct.conditioning( 0, td )
+        as.dcL = append( as.dcL, int(dc & 0x0f) )
+        as.dcU = append( as.dcU, int(dc >> 4) )
+        as.acK = append( as.acK, int(ct.conditioning( 1, ta )) )
+    }
+    as.resetStatistics()
+    var nx, ny int
+    if ns == 1 {
+        nx, ny = fh.compBlocks( comps[0] )
+    } else {
+        nx, ny = fh.mcus()
+    }
+    mcu := 0
+    for my := 0; my < ny; my++ {
+        for mx := 0; mx < nx; mx++ {
+            if ct.restart > 0 && mcu > 0 && mcu % ct.restart == 0 {
+                as.ae.flush()
+                out.Write( []byte{ 0xff, markerRST0 +
+                                   byte( ( mcu / ct.restart - 1 ) % 8 ) } )
+                as.resetStatistics()
+            }
+            for sci, ci := range comps {
+                cc := &img.comps[ci]
+                c := &fh.comps[ci]
+                if ns == 1 {
+                    as.encodeBlock( sci, cc.at( mx, my ) )
+                    continue
+                }
+                for v := 0; v < c.v; v++ {
+                    for h := 0; h < c.h; h++ {
+                        as.encodeBlock( sci, cc.at( mx * c.h + h,
+                                                    my * c.v + v ) )
+                    }
+                }
+            }
+            mcu ++
+        }
+    }
+    as.ae.flush()
+    return nil
+}
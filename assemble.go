@@ -0,0 +1,289 @@
+
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "github.com/jrm-1535/jpeg"
+)
+
+// Segment surgery (jcheck disassemble <file> <dir> and jcheck assemble <dir>
+// -o <path>): a jpeg file is split into a directory of files, one per segment
+// content (without marker and length) and one per run of entropy-coded data
+// or of other bytes, with a manifest segments.json giving their order and
+// markers. Those files can be modified with a text or hex editor, removed,
+// added or reordered in the manifest, and the jpeg file is then rebuilt from
+// the directory, with the segment lengths computed from the file sizes. The
+// rebuilt file is validated by parsing it. Disassembling and assembling again
+// without modification gives a file identical to the original, including any
+// garbage, fill bytes, truncated segment or trailing data, which are kept as
+// raw data.
+
+const DISASSEMBLE_HELP =
+`jcheck disassemble <file> <dir>
+
+    Split a jpeg file into a directory of segment files and a manifest
+    segments.json, for jcheck assemble.
+`
+
+const ASSEMBLE_HELP =
+`jcheck assemble <dir> -o=<path> [-force]
+
+    Rebuild a jpeg file from a directory created by jcheck disassemble. The
+    manifest <dir>/segments.json lists in order the segments with their marker
+    name (SOI, APP1, DQT, SOS, RST0, EOI...) and, for segments with a length,
+    the file holding their content. Entries without a marker are raw data
+    (entropy-coded data, fill bytes, garbage or trailing data) copied as is.
+    Segment lengths are computed from the file sizes.
+
+        -o=<path>           path of the rebuilt jpeg file
+        -force              write the file even if it is not a valid jpeg file
+`
+
+const assemblyManifest = "segments.json"
+
+type assemblyEntry struct {
+    Marker          string      `json:"marker,omitempty"`
+    File            string      `json:"file,omitempty"`
+}
+
+type assembly struct {
+    Source          string      `json:"source,omitempty"`
+    Segments        []assemblyEntry `json:"segments"`
+}
+
+// markerByName returns the marker whose name is given by markerName
+func markerByName( name string ) (byte, bool) {
+    for m := 0x01; m < 0xff; m++ {
+        if markerName( byte(m) ) == name {
+            return byte(m), true
+        }
+    }
+    return 0, false
+}
+
+// disassembleData writes the segments of data as files in dir and returns the
+// manifest
+func disassembleData( data []byte, dir string ) (*assembly, error) {
+    a := new( assembly )
+    write := func( name string, content []byte ) (string, error) {
+        name = fmt.Sprintf( "%03d-%s.bin", len(a.Segments), name )
+        return name, os.WriteFile( filepath.Join( dir, name ), content, 0644 )
+    }
+    raw := func( kind string, start, end int ) error {
+        if start >= end {
+            return nil
+        }
+        name, err := write( kind, data[start:end] )
+        if err == nil {
+            a.Segments = append( a.Segments, assemblyEntry{ File: name } )
+        }
+        return err
+    }
+    l := scanLayout( data )
+    last := 0
+    for i := range l.segments {
+        s := &l.segments[i]
+        if err := raw( "data", last, s.offset ); err != nil {
+            return nil, err
+        }
+        name := markerName( s.marker )
+        last = s.end()
+        switch {
+        case last > len(data):          // truncated, kept as raw data
+            last = len(data)
+            if err := raw( "truncated", s.offset, last ); err != nil {
+                return nil, err
+            }
+            continue
+        case s.length == 0:
+            a.Segments = append( a.Segments, assemblyEntry{ Marker: name } )
+        default:
+            file, err := write( name, data[s.offset+4:last] )
+            if err != nil {
+                return nil, err
+            }
+            a.Segments = append( a.Segments, assemblyEntry{ Marker: name,
+                                                            File: file } )
+        }
+        if s.ecsEnd != 0 {
+            if err := raw( "ecs", last, s.ecsEnd ); err != nil {
+                return nil, err
+            }
+            last = s.ecsEnd
+        }
+    }
+    if err := raw( "data", last, len(data) ); err != nil {
+        return nil, err
+    }
+    return a, nil
+}
+
+// assembleData returns the jpeg data built from the manifest a and the
+// segment files in dir
+func assembleData( a *assembly, dir string ) ([]byte, error) {
+    var out bytes.Buffer
+    for i, e := range a.Segments {
+        var content []byte
+        if e.File != "" {
+            var err error
+            content, err = os.ReadFile( filepath.Join( dir, e.File ) )
+            if err != nil {
+                return nil, fmt.Errorf( "entry %d: %v\n", i, err )
+            }
+        }
+        if e.Marker == "" {
+            if e.File == "" {
+                return nil, fmt.Errorf( "entry %d: no marker and no file\n", i )
+            }
+            out.Write( content )
+            continue
+        }
+        m, ok := markerByName( e.Marker )
+        if ! ok {
+            return nil, fmt.Errorf( "entry %d: invalid marker %s\n", i,
+                                    e.Marker )
+        }
+        out.Write( []byte{ 0xff, m } )
+        if ! hasLength( m ) {
+            if e.File != "" {
+                return nil, fmt.Errorf( "entry %d: marker %s has no content\n",
+                                        i, e.Marker )
+            }
+            continue
+        }
+        if len(content) + 2 > 0xffff {
+            return nil, fmt.Errorf( "entry %d: %s content too large (%d " +
+                                    "bytes)\n", i, e.Marker, len(content) )
+        }
+        n := len(content) + 2
+        out.Write( []byte{ byte( n >> 8 ), byte(n) } )
+        out.Write( content )
+    }
+    return out.Bytes(), nil
+}
+
+// validateAssembled parses data without any output from the library and
+// returns an error if it is not a complete jpeg file
+func validateAssembled( data []byte ) (err error) {
+    stdout := os.Stdout
+    devNull, err := os.OpenFile( os.DevNull, os.O_WRONLY, 0 )
+    if err != nil {
+        return err
+    }
+    os.Stdout = devNull                 // library output
+    defer func( ) {
+        os.Stdout = stdout
+        devNull.Close()
+        if r := recover(); r != nil {
+            err = fmt.Errorf( "internal error while parsing: %v\n", r )
+        }
+    }()
+    var control jpeg.Control
+    jpg, err := jpeg.Parse( data, &control )
+    if err == nil && ( jpg == nil || ! jpg.IsComplete() ) {
+        err = fmt.Errorf( "not a complete jpeg file\n" )
+    }
+    return
+}
+
+func disassemble( args []string ) int {
+    flags := flag.NewFlagSet( "disassemble", flag.ContinueOnError )
+    flags.Usage = func( ) {
+        fmt.Fprintf( flags.Output(), DISASSEMBLE_HELP )
+    }
+    if err := flags.Parse( args ); err != nil {
+        return 2
+    }
+    if flags.NArg() != 2 {
+        flags.Usage()
+        return 2
+    }
+    path, dir := flags.Arg( 0 ), flags.Arg( 1 )
+    data, err := os.ReadFile( path )
+    if err == nil {
+        err = os.MkdirAll( dir, 0755 )
+    }
+    var a *assembly
+    if err == nil {
+        a, err = disassembleData( data, dir )
+    }
+    var manifest []byte
+    if err == nil {
+        a.Source = filepath.Base( path )
+        manifest, err = json.MarshalIndent( a, "", "  " )
+    }
+    if err == nil {
+        err = os.WriteFile( filepath.Join( dir, assemblyManifest ),
+                            append( manifest, '\n' ), 0644 )
+    }
+    if err != nil {
+        fmt.Printf( "jpegcheck: disassemble: %v\n", err )
+        return 1
+    }
+    fmt.Printf( "jpegcheck: %s split into %d entries in %s\n", path,
+                len(a.Segments), dir )
+    return 0
+}
+
+func assemble( args []string ) int {
+    flags := flag.NewFlagSet( "assemble", flag.ContinueOnError )
+    flags.Usage = func( ) {
+        fmt.Fprintf( flags.Output(), ASSEMBLE_HELP )
+    }
+    output := flags.String( "o", "", "path of the rebuilt jpeg file" )
+    force := flags.Bool( "force", false, "write even if not valid" )
+    if err := flags.Parse( args ); err != nil {
+        return 2
+    }
+    var dir string
+    if flags.NArg() > 0 {               // options may follow <dir>
+        dir = flags.Arg( 0 )
+        if err := flags.Parse( flags.Args()[1:] ); err != nil {
+            return 2
+        }
+    }
+    if dir == "" || flags.NArg() != 0 || *output == "" {
+        flags.Usage()
+        return 2
+    }
+    var a assembly
+    manifest, err := os.ReadFile( filepath.Join( dir, assemblyManifest ) )
+    if err == nil {
+        err = json.Unmarshal( manifest, &a )
+    }
+    if err != nil {
+        fmt.Printf( "jpegcheck: assemble: %s: %v\n", assemblyManifest, err )
+        return 1
+    }
+    data, err := assembleData( &a, dir )
+    if err != nil {
+        fmt.Printf( "jpegcheck: assemble: %v", err )
+        return 1
+    }
+    verr := validateAssembled( data )
+    if verr != nil {
+        fmt.Printf( "jpegcheck: assemble: rebuilt file is invalid: %s\n",
+                    strings.TrimSpace( verr.Error() ) )
+        if ! *force {
+            fmt.Printf( "jpegcheck: assemble: %s not written (use -force)\n",
+                        *output )
+            return 1
+        }
+    }
+    if err = os.WriteFile( *output, data, 0644 ); err != nil {
+        fmt.Printf( "jpegcheck: assemble: %v\n", err )
+        return 1
+    }
+    fmt.Printf( "jpegcheck: %d entries assembled as %s, %d bytes\n",
+                len(a.Segments), *output, len(data) )
+    if verr != nil {
+        return 1
+    }
+    return 0
+}
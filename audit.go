@@ -0,0 +1,259 @@
+
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/xml"
+    "fmt"
+    "os"
+    "strings"
+    "time"
+)
+
+// Audit trail (-audit): the modifications applied to a copy written with -o
+// are recorded in the copy itself, as an event of the XMP media management
+// history (xmpMM:History), with the tool version, the time, the operations
+// performed and the checksum of the original file. An existing history is
+// extended, otherwise it is added to the existing XMP packet or to a new XMP
+// APP1 segment.
+
+var xmpHeader = []byte( "http://ns.adobe.com/xap/1.0/\x00" )
+
+const (
+    nsXmpMM     = "http://ns.adobe.com/xap/1.0/mm/"
+    nsStEvt     = "http://ns.adobe.com/xap/1.0/sType/ResourceEvent#"
+)
+
+// operations returns the modifications requested, as given in options
+func (process *jpgArgs) operations( ) (ops []string, changed string) {
+    changed = "/metadata"
+    if process.control.TidyUp {
+        ops = append( ops, "tidyup" )
+        changed = "/"
+    }
+    for _, rm := range process.rmActions {
+        op := fmt.Sprintf( "rmeta=%d", rm.appId )
+        for _, sid := range rm.sIds {
+            op += fmt.Sprintf( ":%d", sid )
+        }
+        for _, tag := range rm.tags {
+            op += ":" + tagName( rm.sIds[0], tag )
+        }
+        ops = append( ops, op )
+    }
+    if process.fixByteOrder {
+        ops = append( ops, "fix-byte-order" )
+    }
+    if process.redact != nil {
+        ops = append( ops, "redact=" + process.redact.spec )
+        changed = "/"
+    }
+    if process.toGray {
+        ops = append( ops, "to-gray" )
+        changed = "/"
+    }
+    if qi := process.iQuant; qi != nil {
+        ops = append( ops, fmt.Sprintf( "iquant=%d:%s:%s", qi.dest, qi.path,
+                                        qi.mode ) )
+        if qi.mode == "requantize" {
+            changed = "/"
+        }
+    }
+    if hi := process.iHuff; hi != nil {
+        ops = append( ops, "ihuff=" + hi.path )
+    }
+    if process.setMeta != nil {
+        ops = append( ops, "setmeta=" + process.setMeta.spec )
+    }
+    if cm := process.copyMeta; cm != nil {
+        ops = append( ops, "copymeta=" + cm.source + ":" +
+                           strings.Join( cm.kinds, "," ) )
+    }
+    if process.loadMeta != nil {
+        ops = append( ops, "loadmeta=" + process.loadMeta.path )
+    }
+    if process.thumbs != "" {
+        ops = append( ops, "thumbs=" + process.thumbs )
+    }
+    if process.stripGps {
+        ops = append( ops, "strip-gps" )
+    }
+    if len(ops) == 0 {
+        ops = append( ops, "rewrite" )
+    }
+    return
+}
+
+func xmlEscape( s string ) string {
+    var b bytes.Buffer
+    xml.EscapeText( &b, []byte( s ) )
+    return b.String()
+}
+
+// auditEvent returns an XMP history event for the modifications made to the
+// file at path
+func auditEvent( path string, process *jpgArgs ) (string, error) {
+    sum, err := fileChecksum( path, "sha256" )
+    if err != nil {
+        return "", err
+    }
+    ops, changed := process.operations()
+    parameters := fmt.Sprintf( "%s; original sha256 %s",
+                               strings.Join( ops, " " ), sum )
+    when := ""
+    if t, ok := process.outputTime(); ok {
+        when = "<stEvt:when>" + t.Format( time.RFC3339 ) + "</stEvt:when>"
+    }
+    return fmt.Sprintf( "<rdf:li rdf:parseType=\"Resource\" " +
+                        "xmlns:stEvt=\"%s\">" +
+                        "<stEvt:action>saved</stEvt:action>%s" +
+                        "<stEvt:softwareAgent>jcheck %s</stEvt:softwareAgent>" +
+                        "<stEvt:changed>%s</stEvt:changed>" +
+                        "<stEvt:parameters>%s</stEvt:parameters>" +
+                        "</rdf:li>", nsStEvt, when, VERSION, changed,
+                        xmlEscape( parameters ) ), nil
+}
+
+func historyDescription( event string ) string {
+    return fmt.Sprintf( "<rdf:Description rdf:about=\"\" xmlns:xmpMM=\"%s\">" +
+                        "<xmpMM:History><rdf:Seq>%s</rdf:Seq></xmpMM:History>" +
+                        "</rdf:Description>", nsXmpMM, event )
+}
+
+func newXmpPacket( event string ) []byte {
+    return []byte( "<?xpacket begin=\"\xef\xbb\xbf\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>" +
+                   "<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">" +
+                   "<rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">" +
+                   historyDescription( event ) +
+                   "</rdf:RDF></x:xmpmeta><?xpacket end=\"w\"?>" )
+}
+
+// addToXmpPacket inserts event in the history of an existing packet, or adds a
+// history if there is none. Padding before the packet trailer is used for the
+// insertion if possible, so that the packet size does not change.
+func addToXmpPacket( packet []byte, event string ) ([]byte, error) {
+    var insert string
+    at := -1
+    if h := bytes.Index( packet, []byte( "<xmpMM:History>" ) ); h != -1 {
+        if end := bytes.Index( packet[h:], []byte( "</rdf:Seq>" ) ); end != -1 {
+            at, insert = h + end, event
+        }
+    }
+    if at == -1 {
+        at = bytes.Index( packet, []byte( "</rdf:RDF>" ) )
+        insert = historyDescription( event )
+    }
+    if at == -1 {
+        return nil, fmt.Errorf( "XMP packet without rdf:RDF element\n" )
+    }
+    res := make( []byte, 0, len(packet) + len(insert) )
+    res = append( res, packet[:at]... )
+    res = append( res, insert... )
+    res = append( res, packet[at:]... )
+
+    trailer := bytes.LastIndex( res, []byte( "<?xpacket end" ) )
+    if trailer == -1 {
+        return res, nil
+    }
+    padding := 0
+    for padding < trailer && bytes.IndexByte( []byte( " \t\r\n" ),
+                                              res[trailer-padding-1] ) != -1 {
+        padding ++
+    }
+    remove := len(insert)
+    if remove > padding - 1 {
+        remove = padding - 1
+    }
+    if remove > 0 {
+        res = append( res[:trailer-remove], res[trailer:]... )
+    }
+    return res, nil
+}
+
+// findXmp returns the XMP APP1 segment of data if any, and the offset where
+// a new XMP segment should be inserted otherwise, after JFIF and Exif.
+func findXmp( data []byte, l *fileLayout ) (xmp *segment, insertAt int) {
+    insertAt = 2                        // after SOI by default
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.marker == markerAPP0 + 1 &&
+           bytes.HasPrefix( s.data( data ), xmpHeader ) {
+            return s, insertAt
+        }
+        if s.marker == markerAPP0 || s.marker == markerAPP0 + 1 {
+            insertAt = s.end()
+        }
+        if isImageDataMarker( s.marker ) || s.marker == markerEOI {
+            break
+        }
+    }
+    return nil, insertAt
+}
+
+// removesApp returns true if the whole APPn segment n is removed by -rmeta
+func (process *jpgArgs) removesApp( n int ) bool {
+    for _, rm := range process.rmActions {
+        if ( rm.appId == n || rm.appId == -1 ) && len(rm.sIds) == 0 {
+            return true
+        }
+    }
+    return false
+}
+
+// recordAudit adds the audit event for the modifications made to the file at
+// path to its copy at output, and returns a description of the change. Since
+// the library does not keep XMP segments when writing, the XMP packet of the
+// original is extended if the copy has none, unless APP1 segments were
+// removed on purpose.
+func recordAudit( path, output string, process *jpgArgs ) (string, error) {
+    event, err := auditEvent( path, process )
+    if err != nil {
+        return "", fmt.Errorf( "audit: %v\n", err )
+    }
+    data, err := os.ReadFile( output )
+    if err != nil {
+        return "", fmt.Errorf( "audit: %v\n", err )
+    }
+    xmp, insertAt := findXmp( data, scanLayout( data ) )
+    start, end := insertAt, insertAt
+    var base []byte                     // existing packet, if any
+    if xmp != nil {
+        base = xmp.data( data )[len(xmpHeader):]
+        start, end = xmp.offset, xmp.end()
+    } else if ! process.removesApp( 1 ) {
+        if orig, err := os.ReadFile( path ); err == nil {
+            if s, _ := findXmp( orig, scanLayout( orig ) ); s != nil {
+                base = s.data( orig )[len(xmpHeader):]
+            }
+        }
+    }
+    packet := newXmpPacket( event )
+    if base != nil {
+        if packet, err = addToXmpPacket( base, event ); err != nil {
+            return "", fmt.Errorf( "audit: %v", err )
+        }
+    }
+    length := 2 + len(xmpHeader) + len(packet)
+    if length > 0xffff {
+        return "", fmt.Errorf( "audit: XMP packet too large for a segment\n" )
+    }
+    var b bytes.Buffer
+    b.Write( data[:start] )
+    b.Write( []byte{ 0xff, markerAPP0 + 1 } )
+    binary.Write( &b, binary.BigEndian, uint16(length) )
+    b.Write( xmpHeader )
+    b.Write( packet )
+    b.Write( data[end:] )
+    if err = writeFile( output, b.Bytes(), 0644 ); err != nil {
+        return "", fmt.Errorf( "audit: %v\n", err )
+    }
+    switch {
+    case xmp != nil:
+        return "audit: XMP history event added", nil
+    case base != nil:
+        return "audit: XMP packet of the original restored with a new " +
+               "history event", nil
+    }
+    return "audit: XMP history added in a new APP1 segment", nil
+}
@@ -0,0 +1,197 @@
+
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+// BagIt (RFC 8493) bags given as input: a bag is a directory with a bagit.txt
+// declaration, a payload directory data and at least one payload manifest
+// manifest-<algorithm>.txt listing the checksum of every payload file. The bag
+// is verified first (declaration, completeness and fixity), then the jpeg files
+// found in the payload are checked as any other file in the batch.
+
+type bagReport struct {
+    dir             string
+    errors          []string
+    nPayload        int         // number of payload files
+    jpegs           []string    // payload files starting with a jpeg SOI
+}
+
+func isBag( path string ) bool {
+    info, err := os.Stat( filepath.Join( path, "bagit.txt" ) )
+    return err == nil && info.Mode().IsRegular()
+}
+
+func (br *bagReport) addError( f string, a ...interface{} ) {
+    br.errors = append( br.errors, fmt.Sprintf( f, a... ) )
+}
+
+func (br *bagReport) checkDeclaration( ) {
+    f, err := os.Open( filepath.Join( br.dir, "bagit.txt" ) )
+    if err != nil {
+        br.addError( "unable to read bagit.txt: %v", err )
+        return
+    }
+    defer f.Close()
+    var version, encoding string
+    scanner := bufio.NewScanner( f )
+    for scanner.Scan() {
+        kv := strings.SplitN( scanner.Text(), ":", 2 )
+        if len(kv) != 2 {
+            continue
+        }
+        switch kv[0] {
+        case "BagIt-Version":               version = strings.TrimSpace( kv[1] )
+        case "Tag-File-Character-Encoding": encoding = strings.TrimSpace( kv[1] )
+        }
+    }
+    if version == "" {
+        br.addError( "bagit.txt: missing BagIt-Version" )
+    }
+    if encoding == "" {
+        br.addError( "bagit.txt: missing Tag-File-Character-Encoding" )
+    }
+}
+
+// payloadFiles returns the paths relative to the bag directory of all files in
+// the payload directory.
+func (br *bagReport) payloadFiles( ) (files []string) {
+    data := filepath.Join( br.dir, "data" )
+    err := filepath.WalkDir( data, func( path string, d fs.DirEntry, err error ) error {
+        if err != nil {
+            return err
+        }
+        if d.Type().IsRegular() {
+            rel, _ := filepath.Rel( br.dir, path )
+            files = append( files, filepath.ToSlash( rel ) )
+        }
+        return nil
+    })
+    if err != nil {
+        br.addError( "unable to read payload: %v", err )
+    }
+    sort.Strings( files )
+    return
+}
+
+// checkManifest verifies that all files listed in the manifest exist and have
+// the right checksum. If payload is not nil, it also verifies that all payload
+// files are listed in the manifest.
+func (br *bagReport) checkManifest( name string, payload []string ) {
+    algorithm := strings.TrimSuffix( name[strings.Index( name, "-" )+1:], ".txt" )
+    if _, ok := checksumAlgorithms[algorithm]; ! ok {
+        br.addError( "%s: unsupported algorithm %s", name, algorithm )
+        return
+    }
+    checksums, err := loadManifest( filepath.Join( br.dir, name ) )
+    if err != nil {
+        br.addError( "%v", strings.TrimSuffix( err.Error(), "\n" ) )
+        return
+    }
+    listed := make( []string, 0, len(checksums) )
+    for path := range checksums {
+        listed = append( listed, path )
+    }
+    sort.Strings( listed )
+    for _, path := range listed {
+        sum, err := fileChecksum( filepath.Join( br.dir,
+                                                 filepath.FromSlash( path ) ),
+                                  algorithm )
+        if err != nil {
+            br.addError( "%s: %s is missing", name, path )
+        } else if sum != checksums[path] {
+            br.addError( "%s: %s checksum mismatch", name, path )
+        }
+    }
+    for _, path := range payload {
+        if _, ok := checksums[path]; ! ok {
+            br.addError( "%s: payload file %s is not listed", name, path )
+        }
+    }
+}
+
+func isJpegFile( path string ) bool {
+    f, err := os.Open( path )
+    if err != nil {
+        return false
+    }
+    defer f.Close()
+    soi := make( []byte, 2 )
+    n, _ := f.Read( soi )
+    return n == 2 && bytes.Equal( soi, []byte{ 0xff, 0xd8 } )
+}
+
+// verifyBag verifies the bag at dir and collects its payload jpeg files.
+func verifyBag( dir string ) *bagReport {
+    br := new( bagReport )
+    br.dir = dir
+    br.checkDeclaration()
+
+    payload := br.payloadFiles()
+    br.nPayload = len(payload)
+
+    entries, err := os.ReadDir( dir )
+    if err != nil {
+        br.addError( "unable to read bag directory: %v", err )
+        return br
+    }
+    nManifests := 0
+    for _, e := range entries {
+        name := e.Name()
+        if ! strings.HasSuffix( name, ".txt" ) {
+            continue
+        }
+        if strings.HasPrefix( name, "manifest-" ) {
+            br.checkManifest( name, payload )
+            nManifests ++
+        } else if strings.HasPrefix( name, "tagmanifest-" ) {
+            br.checkManifest( name, nil )
+        }
+    }
+    if nManifests == 0 {
+        br.addError( "no payload manifest" )
+    }
+    for _, path := range payload {
+        full := filepath.Join( dir, filepath.FromSlash( path ) )
+        if isJpegFile( full ) {
+            br.jpegs = append( br.jpegs, full )
+        }
+    }
+    return br
+}
+
+func (br *bagReport) format( ) {
+    status := "valid"
+    if len(br.errors) > 0 {
+        status = "invalid"
+    }
+    fmt.Printf( "jpegcheck: bag %s is %s: %d payload files, %d jpeg files\n",
+                br.dir, status, br.nPayload, len(br.jpegs) )
+    for _, e := range br.errors {
+        fmt.Printf( "  %s\n", e )
+    }
+}
+
+// expandBags replaces each bag directory in paths with the jpeg files found in
+// its payload, after verifying the bag.
+func expandBags( paths []string ) (expanded []string, bags []*bagReport) {
+    for _, path := range paths {
+        if ! isBag( path ) {
+            expanded = append( expanded, path )
+            continue
+        }
+        br := verifyBag( path )
+        br.format()
+        bags = append( bags, br )
+        expanded = append( expanded, br.jpegs... )
+    }
+    return
+}
@@ -0,0 +1,399 @@
+
+package main
+
+import (
+    "fmt"
+    "io"
+    "math"
+    "math/rand"
+    "os"
+    "runtime/debug"
+    "sort"
+    "strings"
+    "time"
+)
+
+// checkFileSafely calls checkFile and recovers from any panic happening during
+// the analysis of the file, so that the panic is reported as an error for that
+// file and does not stop the processing of the following files. If the debug
+// option was given, the stack trace at the time of the panic is printed. Any
+// error is recorded in the file report rep.
+func checkFileSafely( path string, data []byte, process *jpgArgs,
+                      rep *fileReport ) (err error) {
+    defer func( ) {
+        sev := errorSeverity
+        if r := recover(); r != nil {
+            if process.debug {
+                fmt.Printf( "jpegcheck: panic while checking %s: %v\n%s\n",
+                            path, r, debug.Stack() )
+            }
+            err = codedError{ fmt.Errorf( "internal error while checking " +
+                                          "%s: %v\n", path, r ), codeInternal }
+            sev = fatalSeverity
+        }
+        if _, ok := err.(fatalError); ok {
+            sev = fatalSeverity
+        }
+        rep.analysed = true
+        if err != nil {
+            rep.failed = true
+            rep.addMessage( sev, errorCode( err ), err.Error() )
+        }
+        if process.diagnostics {
+            formatDiagnostics( rep, process.minSeverity )
+        }
+    }()
+    return checkFile( path, data, process, rep )
+}
+
+// selectSample returns a random subset of paths according to spec. The
+// selection depends only on the seed and on the list of paths, and the
+// selected paths are returned in their original order.
+func selectSample( paths []string, spec *sampleSpec ) []string {
+    n := spec.count
+    if n == 0 {
+        n = int( math.Ceil( float64(len(paths)) * spec.percent / 100 ) )
+    }
+    if n >= len(paths) {
+        return paths
+    }
+    rnd := rand.New( rand.NewSource( spec.seed ) )
+    indexes := rnd.Perm( len(paths) )[:n]
+    sort.Ints( indexes )
+    sample := make( []string, n )
+    for i, index := range indexes {
+        sample[i] = paths[index]
+    }
+    return sample
+}
+
+// wilsonInterval returns the 95% confidence interval for a proportion after
+// observing k events in a sample of n out of a population of total elements.
+// It uses the Wilson score interval, which remains meaningful when no event
+// or only events were observed, with a finite population correction.
+func wilsonInterval( k, n, total int ) (low, high float64) {
+    const z = 1.96
+    p := float64(k) / float64(n)
+    zz := z * z
+    if total > 1 {      // finite population correction
+        zz *= float64(total - n) / float64(total - 1)
+    }
+    nf := float64(n)
+    center := ( p + zz / (2 * nf) ) / ( 1 + zz / nf )
+    margin := math.Sqrt( p * (1 - p) / nf + zz / (4 * nf * nf) ) *
+              math.Sqrt( zz ) / ( 1 + zz / nf )
+    return math.Max( 0, center - margin ), math.Min( 1, center + margin )
+}
+
+func printSampleExtrapolation( nFailed, nSampled, total int, seed int64 ) {
+    fmt.Printf( "jpegcheck: sampled %d of %d files (seed %d)\n",
+                nSampled, total, seed )
+    if nSampled == 0 {
+        return
+    }
+    rate := float64(nFailed) / float64(nSampled)
+    low, high := wilsonInterval( nFailed, nSampled, total )
+    fmt.Printf( "  observed failure rate %.2f%%, 95%% confidence interval " +
+                "[%.2f%% - %.2f%%]\n", rate * 100, low * 100, high * 100 )
+    fmt.Printf( "  estimated failed files in the whole set: %d (between %d " +
+                "and %d)\n", int( math.Round( rate * float64(total) ) ),
+                int( math.Floor( low * float64(total) ) ),
+                int( math.Ceil( high * float64(total) ) ) )
+}
+
+// batch keeps track of the files processed in a batch
+type batch struct {
+    process         *jpgArgs
+    jnl             *journal        // if not nil, record outcome
+    cache           *fileCache      // if not nil, skip unchanged files
+    fixity          *fixity         // if not nil, generate/verify checksums
+    sinks           []reportSink    // machine readable reports
+    reports         chan *fileReport    // to the report stage
+    reported        <-chan struct{}     // closed when sinks are closed
+    capture         *stdoutCapture  // text printed per file, with -json
+    stdout          *os.File        // while stdout is discarded, with -q
+    dirs            map[string]*dirSummary  // outcome per directory, with -R
+    walk            *walkSummary    // links and files excluded, with -R
+
+    nFailed         int
+    nResumed        int             // found in journal
+    nCached         int             // found in cache
+    bags            []*bagReport    // bags given as input
+}
+
+func newBatch( process *jpgArgs ) (b *batch, err error) {
+    b = new( batch )
+    b.process = process
+    if process.recurse != "" {
+        b.dirs = make( map[string]*dirSummary )
+    }
+    if process.journal != "" {
+        if b.jnl, err = openJournal( process.journal, process.resume ); err != nil {
+            return nil, err
+        }
+    }
+    if process.cache != "" {
+        if b.cache, err = loadCache( process.cache,
+                                     process.cacheOptions ); err != nil {
+            b.close()
+            return nil, err
+        }
+    }
+    if b.sinks, err = openSinks( process.sinks, process ); err != nil {
+        b.close()
+        return nil, err
+    }
+    if process.json {
+        if b.capture, err = newStdoutCapture(); err != nil {
+            b.close()
+            return nil, fmt.Errorf( "unable to capture output: %v\n", err )
+        }
+        jr := startJsonReport( b.capture.stdout, process )
+        jr.stdout = true
+        b.sinks = append( b.sinks, jr )
+    }
+    if process.quiet {
+        devNull, err := os.OpenFile( os.DevNull, os.O_WRONLY, 0 )
+        if err != nil {
+            b.close()
+            return nil, fmt.Errorf( "unable to discard output: %v\n", err )
+        }
+        b.stdout, os.Stdout = os.Stdout, devNull
+    }
+    if process.checksum != nil || process.verifyChecksum != "" {
+        b.fixity, err = newFixity( process.checksum, process.verifyChecksum )
+        if err != nil {
+            b.close()
+            return nil, err
+        }
+    }
+    return
+}
+
+// output returns where the report stage prints, fixed when the batch starts:
+// the actual standard output with -json, which captures the output of the
+// check stage, or the standard output as set for the batch otherwise
+func (b *batch) output( ) io.Writer {
+    if b.capture != nil {
+        return b.capture.stdout
+    }
+    return os.Stdout
+}
+
+func (b *batch) close( ) {
+    if b.jnl != nil {
+        b.jnl.close()
+    }
+    if b.cache != nil {
+        if err := b.cache.save(); err != nil {
+            fmt.Printf( "jpegcheck: %v", err )
+        }
+    }
+    if b.fixity != nil {
+        if err := b.fixity.close(); err != nil {
+            fmt.Printf( "jpegcheck: %v", err )
+        }
+    }
+    if b.reports != nil {
+        close( b.reports )
+        <-b.reported
+        return
+    }
+    for _, sink := range b.sinks {      // report stage not started
+        sink.close()
+    }
+}
+
+// report sends the file report to the report stage, which adds it to the
+// requested machine readable reports. The report must not be modified after.
+func (b *batch) report( rep *fileReport ) {
+    if b.reports == nil {
+        return
+    }
+    if b.process.reproducible {         // input file times are not recorded
+        rep.modified = time.Time{}
+    }
+    if b.process.diagnostics {
+        rep.filterMessages( b.process.minSeverity )
+    }
+    b.reports <- rep
+}
+
+// checkPath processes a single file in the batch and returns whether it failed.
+func (b *batch) checkPath( in *checkInput ) (failed bool) {
+    path := in.path
+    rep := newFileReport( path )
+    rep.index = in.index
+    checked := false
+    defer func( ) {
+        rep.failed = failed
+        if b.dirs != nil {
+            b.countDir( path, failed, rep )
+        }
+        if b.capture != nil {
+            rep.text = append( rep.text, b.capture.take()... )
+        }
+        if checked && b.jnl != nil {
+            if jerr := b.jnl.record( rep ); jerr != nil {
+                fmt.Printf( "jpegcheck: unable to update journal: %v\n", jerr )
+                b.jnl.close()
+                b.jnl = nil
+            }
+        }
+        if b.process.quietSummary {
+            b.passOrFail( rep )
+        }
+        b.report( rep )
+    }()
+    if b.fixity != nil {
+        if err := b.fixity.check( path ); err != nil {
+            fmt.Printf( "jpegcheck: %v", err )
+            rep.addMessage( errorSeverity, codeFixity, err.Error() )
+            failed = true
+        }
+    }
+    if b.jnl != nil {
+        if done, jFailed, jReport := b.jnl.previous( path ); done {
+            b.nResumed ++
+            jReport.restore( rep, codeFixity )  // checksums verified above
+            return failed || jFailed
+        }
+    }
+    var info os.FileInfo
+    if b.cache != nil {
+        info, _ = os.Stat( path )
+        if info != nil && ! b.process.force && ! b.process.writesFiles {
+            if found, cFailed := b.cache.lookup( path, info ); found {
+                b.nCached ++
+                return failed || cFailed
+            }
+        }
+    }
+    checked = true
+    err := checkFileSafely( path, in.data, b.process, rep )
+    if err != nil {
+        fmt.Printf( "jpegcheck: %v", err )
+    }
+    if b.cache != nil && info != nil {
+        b.cache.update( path, info, err != nil )
+    }
+    invalid := failed || err != nil     // not for output errors only
+    if oerr, ok := err.(outputError); ok {
+        invalid = failed || oerr.invalid
+    }
+    failed = failed || err != nil
+    if b.process.onError != nil && b.process.onError.applies( rep, invalid ) {
+        if aerr := b.process.onError.apply( path ); aerr != nil {
+            fmt.Printf( "jpegcheck: %v", aerr )
+        }
+    }
+    return
+}
+
+// passOrFail prints the outcome of a file on the actual stdout, with -q
+func (b *batch) passOrFail( rep *fileReport ) {
+    if ! rep.failed {
+        fmt.Fprintf( b.stdout, "PASS %s\n", rep.path )
+        return
+    }
+    for _, m := range rep.messages {
+        if m.severity == errorSeverity {
+            fmt.Fprintf( b.stdout, "FAIL %s: %s\n", rep.path,
+                         strings.TrimSpace( m.text ) )
+            return
+        }
+    }
+    fmt.Fprintf( b.stdout, "FAIL %s\n", rep.path )
+}
+
+func (b *batch) summary( paths []string ) {
+    if len(paths) > 1 {
+        fmt.Printf( "jpegcheck: %d files checked, %d valid, %d failed\n",
+                    len(paths), len(paths) - b.nFailed, b.nFailed )
+        if b.nResumed > 0 {
+            fmt.Printf( "  including %d files checked in a previous run\n",
+                        b.nResumed )
+        }
+        if b.nCached > 0 {
+            fmt.Printf( "  including %d unchanged files found in cache\n",
+                        b.nCached )
+        }
+    }
+    if b.fixity != nil {
+        b.fixity.summary()
+    }
+    if len(b.bags) > 0 {
+        nInvalid := 0
+        for _, br := range b.bags {
+            if len(br.errors) > 0 {
+                nInvalid ++
+            }
+        }
+        fmt.Printf( "jpegcheck: %d bags verified, %d valid, %d invalid\n",
+                    len(b.bags), len(b.bags) - nInvalid, nInvalid )
+    }
+    if b.dirs != nil {
+        b.summaryByDir()
+    }
+    if b.walk != nil {
+        b.walk.summary()
+    }
+    if b.process.sample != nil {
+        printSampleExtrapolation( b.nFailed, len(paths),
+                                  len(b.process.inputs), b.process.sample.seed )
+    }
+}
+
+// processBatch checks all files given as arguments in sequence, reporting the
+// errors for each file and printing a final summary if more than one file was
+// processed. If a journal is requested, the outcome of each file is recorded
+// and when resuming a batch the files already recorded are not checked again
+// but their outcome is included in the summary. Similarly, if a cache is used
+// files that did not change since they were cached are not checked again,
+// unless the option -force was given. Checksums of all files are calculated
+// if a manifest must be generated or verified, and a checksum mismatch makes
+// the file fail. BagIt bags given as input are verified and replaced with the
+// jpeg files in their payload. Files are read in advance and reports are
+// written while the next files are analysed (see pipeline.go), except that
+// files are not read in advance if a journal or a cache may skip them. It
+// returns the number of files that failed.
+func processBatch( process *jpgArgs ) int {
+    b, err := newBatch( process )
+    if err != nil {
+        fmt.Printf( "jpegcheck: %v", err )
+        return len(process.inputs)
+    }
+    var paths []string
+    inputs := process.inputs
+    if process.recurse != "" {
+        var files []string
+        files, b.walk = findJpegFiles( process.recurse, process.followLinks,
+                                       process.allHardlinks, process.filter )
+        inputs = append( inputs, files... )
+    }
+    paths, b.bags = expandBags( inputs )
+    process.inputs = paths
+    if process.sample != nil {
+        paths = selectSample( paths, process.sample )
+    }
+    if len(b.sinks) > 0 {
+        b.reports = make( chan *fileReport, readAheadFiles )
+        b.reported = reportStage( b.sinks, b.reports, b.output() )
+    }
+    readAhead := b.jnl == nil && b.cache == nil
+    for in := range readStage( paths, readAhead ) {
+        if b.checkPath( in ) {
+            b.nFailed ++
+        }
+    }
+    b.close()
+    b.summary( paths )
+    if b.capture != nil {                   // summary is not in json output
+        b.capture.restore()
+    }
+    if b.stdout != nil {
+        os.Stdout.Close()
+        os.Stdout = b.stdout
+    }
+    return b.nFailed
+}
@@ -0,0 +1,244 @@
+
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+    "github.com/jrm-1535/jpeg"
+)
+
+// Benchmark mode (jcheck bench <dir>): measure the throughput of the main code
+// paths over a corpus of jpeg files, so that performance work on the decoder
+// can be measured in a repeatable way. Files are read in memory before being
+// processed, so that only processing is timed, and the output of the library
+// is discarded while measuring. Each mode is run several times and the best
+// run is kept. Results can be saved as json and compared with a previous run.
+
+const BENCH_HELP =
+`jcheck bench [-runs=<n>] [-modes=<m>[,<m>]] [-save=<path>] [-compare=<path>]
+             <dir>
+
+    Measure the throughput of jcheck over all jpeg files (.jpg, .jpeg) found
+    in <dir> and its subdirectories, in MB/s of jpeg data, for each mode:
+        parse       parse segments and entropy-coded data (default check)
+        decode      parse and decode the first frame into samples
+        strip       parse, remove all metadata and generate the copy
+        optimize    parse with -tidyup and generate the copy
+
+        -runs=<n>           number of runs per mode, the best one is kept
+                            (default 3)
+        -modes=<m>[,<m>]    modes to run (default all)
+        -save=<path>        save results as json at path
+        -compare=<path>     compare results with those saved in a previous run
+`
+
+var benchModes = []string{ "parse", "decode", "strip", "optimize" }
+
+type benchResult struct {
+    Mode            string      `json:"mode"`
+    Files           int         `json:"files"`
+    Failed          int         `json:"failed"`
+    Bytes           int64       `json:"bytes"`
+    Seconds         float64     `json:"seconds"`
+    MBps            float64     `json:"mbPerSecond"`
+}
+
+type benchResults struct {
+    Release         string      `json:"release"`
+    Corpus          string      `json:"corpus"`
+    Runs            int         `json:"runs"`
+    Results         []benchResult `json:"results"`
+}
+
+func isBenchMode( mode string ) bool {
+    for _, m := range benchModes {
+        if m == mode {
+            return true
+        }
+    }
+    return false
+}
+
+// benchFiles returns the paths of all jpeg files in dir
+func benchFiles( dir string ) (paths []string, err error) {
+    err = filepath.WalkDir( dir, func( path string, d fs.DirEntry,
+                                       err error ) error {
+        if err != nil {
+            return err
+        }
+        ext := strings.ToLower( filepath.Ext( path ) )
+        if ! d.IsDir() && ( ext == ".jpg" || ext == ".jpeg" ) {
+            paths = append( paths, path )
+        }
+        return nil
+    })
+    return
+}
+
+// benchOnce processes data according to mode and returns false if it failed
+func benchOnce( data []byte, mode string ) bool {
+    control := jpeg.Control{ TidyUp: mode == "optimize" }
+    jpg, err := jpeg.Parse( data, &control )
+    if jpg == nil || err != nil {
+        return false
+    }
+    switch mode {
+    case "decode":
+        _, err = jpg.MakeFrameRawPicture( 0 )
+    case "strip":
+        if err = jpg.RemoveMetadata( -1, nil ); err == nil {
+            _, err = jpg.Generate()
+        }
+    case "optimize":
+        _, err = jpg.Generate()
+    }
+    return err == nil
+}
+
+// benchRun processes all files once in mode and returns the result. Panics
+// are counted as failures.
+func benchRun( paths []string, mode string ) (res benchResult, err error) {
+    res = benchResult{ Mode: mode, Files: len(paths) }
+    stdout := os.Stdout
+    devNull, err := os.OpenFile( os.DevNull, os.O_WRONLY, 0 )
+    if err != nil {
+        return res, fmt.Errorf( "bench: %v\n", err )
+    }
+    defer func( ) {
+        os.Stdout = stdout
+        devNull.Close()
+    }()
+    var elapsed time.Duration
+    for _, path := range paths {
+        data, rerr := os.ReadFile( path )
+        if rerr != nil {
+            res.Failed ++
+            continue
+        }
+        res.Bytes += int64(len(data))
+        os.Stdout = devNull             // library output
+        start := time.Now()
+        ok := func( ) (ok bool) {
+            defer func( ) {
+                if recover() != nil {
+                    ok = false
+                }
+            }()
+            return benchOnce( data, mode )
+        }()
+        elapsed += time.Since( start )
+        os.Stdout = stdout
+        if ! ok {
+            res.Failed ++
+        }
+    }
+    res.Seconds = elapsed.Seconds()
+    if res.Seconds > 0 {
+        res.MBps = float64(res.Bytes) / 1e6 / res.Seconds
+    }
+    return
+}
+
+func loadBenchResults( path string ) (*benchResults, error) {
+    data, err := os.ReadFile( path )
+    if err != nil {
+        return nil, fmt.Errorf( "bench: %v\n", err )
+    }
+    prev := new( benchResults )
+    if err = json.Unmarshal( data, prev ); err != nil {
+        return nil, fmt.Errorf( "bench: invalid results in %s: %v\n", path, err )
+    }
+    return prev, nil
+}
+
+// bench runs the benchmark subcommand with its arguments and returns the exit
+// status
+func bench( args []string ) int {
+    flags := flag.NewFlagSet( "bench", flag.ContinueOnError )
+    flags.Usage = func( ) {
+        fmt.Fprintf( flags.Output(), BENCH_HELP )
+    }
+    runs := flags.Int( "runs", 3, "number of runs per mode" )
+    modes := flags.String( "modes", strings.Join( benchModes, "," ),
+                        "modes to run" )
+    save := flags.String( "save", "", "save results as json" )
+    compare := flags.String( "compare", "", "compare with previous results" )
+    if err := flags.Parse( args ); err != nil {
+        return 2
+    }
+    if flags.NArg() != 1 || *runs < 1 {
+        flags.Usage()
+        return 2
+    }
+    for _, m := range strings.Split( *modes, "," ) {
+        if ! isBenchMode( m ) {
+            fmt.Printf( "jpegcheck: bench: unknown mode %s\n", m )
+            return 2
+        }
+    }
+    var prev *benchResults
+    if *compare != "" {
+        var err error
+        if prev, err = loadBenchResults( *compare ); err != nil {
+            fmt.Printf( "jpegcheck: %v", err )
+            return 2
+        }
+    }
+    paths, err := benchFiles( flags.Arg( 0 ) )
+    if err != nil {
+        fmt.Printf( "jpegcheck: bench: %v\n", err )
+        return 2
+    }
+    if len(paths) == 0 {
+        fmt.Printf( "jpegcheck: bench: no jpeg file in %s\n", flags.Arg( 0 ) )
+        return 2
+    }
+    results := benchResults{ Release: VERSION, Corpus: flags.Arg( 0 ), Runs: *runs }
+    fmt.Printf( "jpegcheck: bench over %d files, best of %d runs\n",
+                len(paths), *runs )
+    fmt.Printf( "  %-9s %6s %6s %12s %10s %10s\n", "Mode", "Files", "Failed",
+                "Bytes", "Seconds", "MB/s" )
+    for _, mode := range strings.Split( *modes, "," ) {
+        var best benchResult
+        for r := 0; r < *runs; r++ {
+            res, err := benchRun( paths, mode )
+            if err != nil {
+                fmt.Printf( "jpegcheck: %v", err )
+                return 1
+            }
+            if r == 0 || res.Seconds < best.Seconds {
+                best = res
+            }
+        }
+        results.Results = append( results.Results, best )
+        fmt.Printf( "  %-9s %6d %6d %12d %10.3f %10.2f", mode, best.Files,
+                    best.Failed, best.Bytes, best.Seconds, best.MBps )
+        if prev != nil {
+            for _, p := range prev.Results {
+                if p.Mode == mode && p.MBps > 0 {
+                    fmt.Printf( "  %+.1f%% vs %.2f",
+                                ( best.MBps / p.MBps - 1 ) * 100, p.MBps )
+                }
+            }
+        }
+        fmt.Printf( "\n" )
+    }
+    if prev != nil && prev.Corpus != results.Corpus {
+        fmt.Printf( "  Warning: previous results were measured over %s\n",
+                    prev.Corpus )
+    }
+    if *save != "" {
+        data, _ := json.MarshalIndent( &results, "", "  " )
+        if err = os.WriteFile( *save, append( data, '\n' ), 0644 ); err != nil {
+            fmt.Printf( "jpegcheck: bench: %v\n", err )
+            return 1
+        }
+    }
+    return 0
+}
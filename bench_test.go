@@ -0,0 +1,113 @@
+package main
+
+import (
+    "os"
+    "testing"
+)
+
+// benchCorpus returns the valid files of the test set that mode can process,
+// with their total size
+func benchCorpus( b *testing.B, mode string ) ([][]byte, int64) {
+    b.Helper()
+    var corpus [][]byte
+    var size int64
+    for i := range testsetSpecs {
+        spec := &testsetSpecs[i]
+        if spec.breaks != nil {
+            continue
+        }
+        data, _, err := generateTestFile( spec, 75 )
+        if err != nil {
+            b.Fatalf( "%s: %v", spec.name, err )
+        }
+        if benchOnce( data, mode ) {    // e.g. not arithmetic coding
+            corpus = append( corpus, data )
+            size += int64(len(data))
+        }
+    }
+    if len(corpus) == 0 {
+        b.Fatalf( "no test set file for %s", mode )
+    }
+    return corpus, size
+}
+
+// benchMode runs mode over the test set, reporting the throughput. The output
+// of the library is discarded, as with jcheck bench.
+func benchMode( b *testing.B, mode string ) {
+    devNull, err := os.OpenFile( os.DevNull, os.O_WRONLY, 0 )
+    if err != nil {
+        b.Fatal( err )
+    }
+    stdout := os.Stdout
+    os.Stdout = devNull
+    defer func( ) {
+        os.Stdout = stdout
+        devNull.Close()
+    }()
+    corpus, size := benchCorpus( b, mode )
+    b.SetBytes( size )
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        for _, data := range corpus {
+            if ! benchOnce( data, mode ) {
+                b.Fatalf( "%s failed", mode )
+            }
+        }
+    }
+}
+
+func BenchmarkParse( b *testing.B ) {
+    benchMode( b, "parse" )
+}
+
+func BenchmarkDecode( b *testing.B ) {
+    benchMode( b, "decode" )
+}
+
+func BenchmarkStrip( b *testing.B ) {
+    benchMode( b, "strip" )
+}
+
+func BenchmarkOptimize( b *testing.B ) {
+    benchMode( b, "optimize" )
+}
+
+// BenchmarkHuffman decodes the coefficients of the Huffman coded files of the
+// test set, with and without the lookup of short codes
+func BenchmarkHuffman( b *testing.B ) {
+    var corpus [][]byte
+    var size int64
+    for i := range testsetSpecs {
+        spec := &testsetSpecs[i]
+        if spec.breaks != nil || isArithmetic( spec.marker ) {
+            continue
+        }
+        data, _, err := generateTestFile( spec, 75 )
+        if err != nil {
+            b.Fatalf( "%s: %v", spec.name, err )
+        }
+        if _, err = decodeCoefficients( data, scanLayout( data ) ); err == nil {
+            corpus = append( corpus, data )
+            size += int64(len(data))
+        }
+    }
+    for _, lookup := range []bool{ true, false } {
+        name := "lookup"
+        if ! lookup {
+            name = "bit-by-bit"
+        }
+        b.Run( name, func( b *testing.B ) {
+            huffLookup = lookup
+            defer func( ) { huffLookup = true }()
+            b.SetBytes( size )
+            for i := 0; i < b.N; i++ {
+                for _, data := range corpus {
+                    if _, err := decodeCoefficients( data,
+                                                scanLayout( data ) ); err != nil {
+                        b.Fatal( err )
+                    }
+                }
+            }
+        } )
+    }
+}
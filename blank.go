@@ -0,0 +1,120 @@
+
+package main
+
+import (
+    "fmt"
+    "image"
+    "math"
+)
+
+// Blank picture detection (-blank-check): failed scans, captures with the lens
+// cap on and camera glitches give pictures of (almost) a single color, which
+// batch audits must surface. The picture is decoded and flagged as blank if
+// the standard deviation of its luma (Rec.601) is at most -blank-stddev
+// levels, or if at least -blank-share percent of its pixels are within 8
+// levels of the mean color in R, G and B, which tolerates a few hot pixels or
+// a dust speck on an otherwise uniform picture.
+
+const (
+    blankTolerance      = 8         // levels from the mean color
+    defaultBlankStddev  = 2.0       // levels
+    defaultBlankShare   = 99.5      // percent
+)
+
+type blankThresholds struct {
+    stddev          float64     // largest luma standard deviation, in levels
+    share           float64     // smallest percentage of uniform pixels
+}
+
+// newBlankThresholds checks and returns the thresholds of -blank-check
+func newBlankThresholds( stddev, share float64 ) (*blankThresholds, error) {
+    if stddev < 0 {
+        return nil, fmt.Errorf( "invalid standard deviation %g\n", stddev )
+    }
+    if share <= 0 || share > 100 {
+        return nil, fmt.Errorf( "invalid percentage %g (0 to 100)\n", share )
+    }
+    return &blankThresholds{ stddev: stddev, share: share }, nil
+}
+
+type blankAnalysis struct {
+    mean            [3]float64  // R, G, B
+    stddev          float64     // of luma
+    share           float64     // percentage of pixels close to the mean
+}
+
+// analyseBlank returns the spread of the colors of img around its mean color
+func analyseBlank( img *image.RGBA ) blankAnalysis {
+    var ba blankAnalysis
+    w, h := img.Rect.Dx(), img.Rect.Dy()
+    n := float64(w * h)
+    if n == 0 {
+        return ba
+    }
+    var sum, sum2 float64
+    for y := 0; y < h; y++ {
+        p := img.Pix[img.PixOffset( img.Rect.Min.X, img.Rect.Min.Y + y ):]
+        for x := 0; x < w; x++ {
+            r, g, b := float64(p[4*x]), float64(p[4*x+1]), float64(p[4*x+2])
+            ba.mean[0] += r
+            ba.mean[1] += g
+            ba.mean[2] += b
+            l := 0.299 * r + 0.587 * g + 0.114 * b
+            sum += l
+            sum2 += l * l
+        }
+    }
+    for c := range ba.mean {
+        ba.mean[c] /= n
+    }
+    mean := sum / n
+    ba.stddev = math.Sqrt( math.Max( 0, sum2 / n - mean * mean ) )
+    close := 0
+    for y := 0; y < h; y++ {
+        p := img.Pix[img.PixOffset( img.Rect.Min.X, img.Rect.Min.Y + y ):]
+        for x := 0; x < w; x++ {
+            uniform := true
+            for c := 0; c < 3; c++ {
+                if math.Abs( float64(p[4*x+c]) - ba.mean[c] ) > blankTolerance {
+                    uniform = false
+                }
+            }
+            if uniform {
+                close++
+            }
+        }
+    }
+    ba.share = 100 * float64(close) / n
+    return ba
+}
+
+// blank returns true if the analysis is within the thresholds of bt
+func (ba *blankAnalysis) blank( bt *blankThresholds ) bool {
+    return ba.stddev <= bt.stddev || ba.share >= bt.share
+}
+
+// formatBlankCheck decodes the picture in data, prints the spread of its
+// colors and reports it as a warning if it is blank according to bt
+func formatBlankCheck( data []byte, bt *blankThresholds, rep *fileReport ) {
+    img, err := decodeRGBA( data )
+    if err != nil {
+        fmt.Printf( "Blank check: unable to decode the picture: %v\n", err )
+        rep.addMessage( infoSeverity, codeBlank, "blank check not done" )
+        return
+    }
+    ba := analyseBlank( img )
+    color := fmt.Sprintf( "#%02x%02x%02x", clampSample( ba.mean[0] ),
+                          clampSample( ba.mean[1] ), clampSample( ba.mean[2] ) )
+    fmt.Printf( "Blank check: mean color %s, luma standard deviation %.2f, " +
+                "%.2f%% of pixels within %d levels of the mean\n", color,
+                ba.stddev, ba.share, blankTolerance )
+    if ! ba.blank( bt ) {
+        return
+    }
+    text := fmt.Sprintf( "blank picture: almost uniform color %s (luma " +
+                         "standard deviation %.2f, %.2f%% of pixels within " +
+                         "%d levels)", color, ba.stddev, ba.share,
+                         blankTolerance )
+    fmt.Printf( "  Warning: %s\n", text )
+    rep.addMessage( warningSeverity, codeBlank, text )
+}
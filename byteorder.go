@@ -0,0 +1,276 @@
+
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "strings"
+)
+
+// TIFF byte order consistency: the byte order marker of the TIFF header in an
+// Exif APP1 segment applies to the whole TIFF structure, but some broken
+// writers encode some IFDs (typically the Exif or GPS IFD added by another
+// tool) in the opposite order, or mix the orders in the header itself. Such
+// files crash some parsers. Each IFD is decoded in the declared order and, if
+// it is not plausible that way (entry count, types, value offsets), in the
+// opposite order: an IFD that is only plausible in the opposite order is
+// reported as inconsistent. With -fix-byte-order, those IFDs are rewritten in
+// the declared order before the analysis, in place: entry fields, next IFD
+// offsets and the values of known types are byte swapped, and undefined
+// values such as maker notes are kept as is.
+
+const maxPlausibleEntries = 1000
+
+type tiffIfdOrder struct {
+    name            string
+    offset          uint32
+    order           binary.ByteOrder
+    swapped         bool        // in the opposite order of the header
+}
+
+func oppositeOrder( order binary.ByteOrder ) binary.ByteOrder {
+    if order == binary.ByteOrder( binary.LittleEndian ) {
+        return binary.BigEndian
+    }
+    return binary.LittleEndian
+}
+
+// plausibleIfd returns true if the IFD at offset in tiff can be decoded in
+// byte order: a reasonable number of entries, all of known types and with
+// values inside the data.
+func plausibleIfd( tiff []byte, offset uint32, order binary.ByteOrder ) bool {
+    if offset < 8 || uint64(offset) + 2 > uint64(len(tiff)) {
+        return false
+    }
+    n := int( order.Uint16( tiff[offset:] ) )
+    start := int(offset) + 2
+    if n == 0 || n > maxPlausibleEntries || start + 12 * n + 4 > len(tiff) {
+        return false
+    }
+    for i := 0; i < n; i++ {
+        p := start + 12 * i
+        e := ifdEntry{ typ: order.Uint16( tiff[p+2:] ),
+                       count: order.Uint32( tiff[p+4:] ) }
+        size := e.size()
+        if size < 0 {
+            return false
+        }
+        if size > 4 && uint64( order.Uint32( tiff[p+8:] ) ) + uint64(size) >
+                       uint64(len(tiff)) {
+            return false
+        }
+    }
+    return true
+}
+
+// tiffByteOrders returns the byte order declared in the TIFF header of tiff,
+// the problems found in the header itself and the IFDs found with their
+// actual byte order.
+func tiffByteOrders( tiff []byte ) (order binary.ByteOrder,
+                                    header []string, ifds []tiffIfdOrder) {
+    if len(tiff) < 8 {
+        return nil, nil, nil
+    }
+    switch string( tiff[0:2] ) {
+    case "II":
+        order = binary.LittleEndian
+    case "MM":
+        order = binary.BigEndian
+    default:
+        return nil, nil, nil
+    }
+    opposite := oppositeOrder( order )
+    if order.Uint16( tiff[2:] ) != 42 {
+        if opposite.Uint16( tiff[2:] ) != 42 {
+            return nil, nil, nil            // not TIFF
+        }
+        header = append( header, "TIFF magic number in the opposite order" )
+    }
+    first := order.Uint32( tiff[4:] )
+    if ! plausibleIfd( tiff, first, order ) &&
+       ! plausibleIfd( tiff, first, opposite ) {
+        if f := opposite.Uint32( tiff[4:] ); plausibleIfd( tiff, f, order ) ||
+                                             plausibleIfd( tiff, f, opposite ) {
+            header = append( header, "IFD0 offset in the opposite order" )
+            first = f
+        }
+    }
+    type pending struct {
+        name        string
+        offset      uint32
+        chain       int         // index in the IFD chain, -1 for sub-IFDs
+    }
+    queue := []pending{ { "IFD0", first, 0 } }
+    seen := make( map[uint32]bool )
+    for len(queue) > 0 {
+        p := queue[0]
+        queue = queue[1:]
+        if p.offset == 0 || seen[p.offset] {
+            continue
+        }
+        seen[p.offset] = true
+        io := tiffIfdOrder{ name: p.name, offset: p.offset, order: order }
+        if ! plausibleIfd( tiff, p.offset, order ) {
+            if ! plausibleIfd( tiff, p.offset, opposite ) {
+                continue
+            }
+            io.order, io.swapped = opposite, true
+        }
+        ifds = append( ifds, io )
+        t := &tiffReader{ data: tiff, order: io.order }
+        entries, next, err := t.readIfd( p.offset )
+        if err != nil {
+            continue
+        }
+        for i := range entries {
+            e := &entries[i]
+            if e.typ != tiffLong && e.typ != tiffIfd {
+                continue
+            }
+            switch e.tag {
+            case tagExifIfd:
+                queue = append( queue, pending{ "Exif IFD",
+                                                t.uint32Value( e ), -1 } )
+            case tagGpsIfd:
+                queue = append( queue, pending{ "GPS IFD",
+                                                t.uint32Value( e ), -1 } )
+            case tagInteropIfd:
+                queue = append( queue, pending{ "Interop IFD",
+                                                t.uint32Value( e ), -1 } )
+            }
+        }
+        if p.chain >= 0 {
+            queue = append( queue, pending{ fmt.Sprintf( "IFD%d", p.chain + 1 ),
+                                            next, p.chain + 1 } )
+        }
+    }
+    return
+}
+
+// swapValues byte swaps in place the n values of type typ in v
+func swapValues( v []byte, typ uint16, n int ) {
+    size := tiffTypeSizes[typ]
+    unit := size
+    if typ == tiffRational || typ == tiffSRational {
+        unit = 4                        // two longs
+    }
+    if unit == 1 {
+        return
+    }
+    for i := 0; i + unit <= n * size && i + unit <= len(v); i += unit {
+        for j := 0; j < unit / 2; j++ {
+            v[i+j], v[i+unit-1-j] = v[i+unit-1-j], v[i+j]
+        }
+    }
+}
+
+// swapIfd rewrites in out the IFD at offset in tiff from byte order from to
+// the opposite order. Values already swapped, by offset, are not swapped
+// again.
+func swapIfd( tiff, out []byte, offset uint32, from binary.ByteOrder,
+              done map[uint32]bool ) {
+    to := oppositeOrder( from )
+    t := &tiffReader{ data: tiff, order: from }
+    entries, next, err := t.readIfd( offset )
+    if err != nil {
+        return
+    }
+    to.PutUint16( out[offset:], uint16( len(entries) ) )
+    for i := range entries {
+        e := &entries[i]
+        p := e.position
+        to.PutUint16( out[p:], e.tag )
+        to.PutUint16( out[p+2:], e.typ )
+        to.PutUint32( out[p+4:], e.count )
+        size := e.size()
+        if size < 0 {
+            continue
+        }
+        if size <= 4 {
+            swapValues( out[p+8:p+12], e.typ, int(e.count) )
+            continue
+        }
+        at := from.Uint32( e.value )
+        to.PutUint32( out[p+8:], at )
+        if ! done[at] {
+            done[at] = true
+            swapValues( out[at:int(at)+size], e.typ, int(e.count) )
+        }
+    }
+    to.PutUint32( out[int(offset) + 2 + 12 * len(entries):], next )
+}
+
+// repairTiffByteOrder returns a copy of tiff rewritten consistently in the
+// byte order of its header, with the descriptions of the changes, or nil if
+// it is consistent.
+func repairTiffByteOrder( tiff []byte ) ([]byte, []string) {
+    order, header, ifds := tiffByteOrders( tiff )
+    if order == nil {
+        return nil, nil
+    }
+    changes := header
+    out := append( []byte( nil ), tiff... )
+    order.PutUint16( out[2:], 42 )
+    if len(ifds) > 0 {
+        order.PutUint32( out[4:], ifds[0].offset )
+    }
+    done := make( map[uint32]bool )
+    for _, io := range ifds {
+        if ! io.swapped {
+            continue
+        }
+        changes = append( changes, fmt.Sprintf( "%s @0x%x in the opposite " +
+                                                "order", io.name, io.offset ) )
+        swapIfd( tiff, out, io.offset, io.order, done )
+    }
+    if len(changes) == 0 {
+        return nil, nil
+    }
+    return out, changes
+}
+
+// checkByteOrder checks the byte order of the TIFF structure in the first Exif
+// APP1 segment of data, and returns data with a consistent TIFF structure and
+// the inconsistencies found, or nil if there is none.
+func checkByteOrder( data []byte, l *fileLayout ) ([]byte, []string) {
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.marker == markerSOS || s.marker == markerEOI {
+            break
+        }
+        if s.marker != markerAPP0 + 1 {
+            continue
+        }
+        tiff := exifTiffData( s.data( data ) )
+        if tiff == nil {
+            continue
+        }
+        repaired, changes := repairTiffByteOrder( tiff )
+        if repaired == nil {
+            return nil, nil
+        }
+        start := s.offset + 4 + len(exifHeader)
+        out := append( []byte( nil ), data... )
+        copy( out[start:], repaired )
+        return out, changes
+    }
+    return nil, nil
+}
+
+// formatByteOrder reports the byte order inconsistencies of the Exif TIFF
+// structure in data, if any.
+func formatByteOrder( data []byte, l *fileLayout, rep *fileReport,
+                      fix bool ) {
+    repaired, issues := checkByteOrder( data, l )
+    if repaired == nil {
+        return
+    }
+    text := "Exif byte order inconsistencies: " + strings.Join( issues, ", " )
+    if fix {
+        text += " (repaired by -fix-byte-order)"
+    } else {
+        text += " (can be repaired with -fix-byte-order)"
+    }
+    fmt.Printf( "%s\n", text )
+    rep.addMessage( warningSeverity, codeByteOrder, text )
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// orderedTiff returns TIFF data declared in byte order header, with an IFD0
+// giving an orientation and a GPS IFD giving a latitude. The magic number,
+// the IFD0 offset and each IFD with its values are written in their own order.
+func orderedTiff( header, magic, first, ifd0,
+                  gps binary.ByteOrder ) []byte {
+    t := make( []byte, 80 )
+    copy( t, "II" )
+    if header == binary.ByteOrder( binary.BigEndian ) {
+        copy( t, "MM" )
+    }
+    magic.PutUint16( t[2:], 42 )
+    first.PutUint32( t[4:], 8 )
+    entry := func( order binary.ByteOrder, p int, tag, typ uint16,
+                   count uint32 ) {
+        order.PutUint16( t[p:], tag )
+        order.PutUint16( t[p+2:], typ )
+        order.PutUint32( t[p+4:], count )
+    }
+    ifd0.PutUint16( t[8:], 2 )                          // IFD0 at 8
+    entry( ifd0, 10, tagOrientation, tiffShort, 1 )
+    ifd0.PutUint16( t[18:], 6 )
+    entry( ifd0, 22, tagGpsIfd, tiffLong, 1 )
+    ifd0.PutUint32( t[30:], 38 )
+    gps.PutUint16( t[38:], 1 )                          // GPS IFD at 38
+    entry( gps, 40, 0x0002, tiffRational, 3 )           // GPSLatitude
+    gps.PutUint32( t[48:], 56 )
+    for i, v := range []uint32{ 48, 1, 51, 1, 24, 1 } { // at 56
+        gps.PutUint32( t[56+4*i:], v )
+    }
+    return t
+}
+
+func TestRepairTiffByteOrder( t *testing.T ) {
+    le, be := binary.ByteOrder( binary.LittleEndian ),
+              binary.ByteOrder( binary.BigEndian )
+    tests := []struct {
+        name    string
+        tiff    []byte
+        changes []string            // nil if consistent
+    }{
+        { "little endian", orderedTiff( le, le, le, le, le ), nil },
+        { "big endian", orderedTiff( be, be, be, be, be ), nil },
+        { "GPS swapped", orderedTiff( le, le, le, le, be ),
+          []string{ "GPS IFD @0x26 in the opposite order" } },
+        { "IFD0 swapped", orderedTiff( be, be, be, le, be ),
+          []string{ "IFD0 @0x8 in the opposite order" } },
+        { "all swapped", orderedTiff( le, be, be, be, be ),
+          []string{ "TIFF magic number in the opposite order",
+                    "IFD0 offset in the opposite order",
+                    "IFD0 @0x8 in the opposite order",
+                    "GPS IFD @0x26 in the opposite order" } },
+    }
+    for _, tc := range tests {
+        t.Run( tc.name, func( t *testing.T ) {
+            order, _, _ := tiffByteOrders( tc.tiff )
+            repaired, changes := repairTiffByteOrder( tc.tiff )
+            if ! reflect.DeepEqual( changes, tc.changes ) {
+                t.Errorf( "changes %q, expected %q", changes, tc.changes )
+            }
+            if tc.changes == nil {
+                if repaired != nil {
+                    t.Errorf( "consistent data repaired" )
+                }
+                return
+            }
+            want := orderedTiff( order, order, order, order, order )
+            if ! bytes.Equal( repaired, want ) {
+                t.Errorf( "repaired\n% x\nexpected\n% x", repaired, want )
+            }
+            if again, _ := repairTiffByteOrder( repaired ); again != nil {
+                t.Errorf( "repaired data is not consistent" )
+            }
+        } )
+    }
+}
+
+// TestFixByteOrderCopy checks that the copy written with -fix-byte-order has
+// a consistent Exif TIFF structure with the same values
+func TestFixByteOrderCopy( t *testing.T ) {
+    le, be := binary.ByteOrder( binary.LittleEndian ),
+              binary.ByteOrder( binary.BigEndian )
+    tests := []struct {
+        name    string
+        tiff    []byte
+    }{
+        { "GPS swapped", orderedTiff( le, le, le, le, be ) },
+        { "IFD0 swapped", orderedTiff( be, be, be, le, be ) },
+    }
+    base := testsetData( t, "baseline-420.jpg" )
+    for _, tc := range tests {
+        t.Run( tc.name, func( t *testing.T ) {
+            dir := t.TempDir()
+            path := filepath.Join( dir, "in.jpg" )
+            out := filepath.Join( dir, "out.jpg" )
+            if err := os.WriteFile( path, withExif( base, tc.tiff ),
+                                    0644 ); err != nil {
+                t.Fatal( err )
+            }
+            if n := processBatch( checkerArgs( t, "-q", "-fix-byte-order",
+                                               "-o=" + out, path ) ); n != 0 {
+                t.Fatalf( "%d files failed", n )
+            }
+            data, err := os.ReadFile( out )
+            if err != nil {
+                t.Fatal( err )
+            }
+            if repaired, changes := checkByteOrder( data,
+                                            scanLayout( data ) ); repaired != nil {
+                t.Errorf( "copy is not consistent: %s",
+                          strings.Join( changes, ", " ) )
+            }
+            lines := metadataLines( data )
+            if ! hasTagValue( lines, "Orientation",
+                              "Row #0 Right, Col #0 Top" ) {
+                t.Errorf( "orientation not found in\n%s",
+                          strings.Join( lines, "\n" ) )
+            }
+        } )
+    }
+}
@@ -0,0 +1,344 @@
+
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "crypto/sha512"
+    "fmt"
+    "hash"
+    "os"
+    "sort"
+    "strings"
+)
+
+// C2PA (Content Credentials) manifests: a C2PA manifest store is a JUMBF
+// superbox labelled c2pa, carried in APP11 segments. Each manifest holds an
+// assertion store, a claim (CBOR) listing the assertions and referring to the
+// claim signature, a COSE_Sign1 structure (CBOR tag 18). The last manifest is
+// the active one. Signatures are checked at the structure level only, since
+// verifying them requires the signer certificate chain and trust lists, but
+// the hard binding of the manifest to the file (c2pa.hash.data assertion) is
+// recomputed.
+
+const coseSign1Tag = 18
+
+type c2paManifest struct {
+    label           string
+    kind            string      // c2ma (standard) or c2um (update)
+    assertions      []string
+    claim           cborMap
+    signature       string      // structure-level status
+    dataHash        string      // hard binding status
+    problems        []string
+}
+
+type c2paStore struct {
+    store           *jumbfStore
+    manifests       []*c2paManifest
+    problems        []string
+}
+
+// cborInt returns an integer CBOR value as an int64
+func cborInt( v interface{} ) (int64, bool) {
+    switch v := v.(type) {
+    case uint64:
+        return int64(v), v <= 1 << 62
+    case int64:
+        return v, true
+    }
+    return 0, false
+}
+
+// cborContent decodes the CBOR content box of a superbox as a map
+func cborContent( box *jumbfBox ) (cborMap, interface{}, error) {
+    c := box.content()
+    if c == nil || c.typ != "cbor" {
+        return nil, nil, fmt.Errorf( "no CBOR content\n" )
+    }
+    v, _, err := cborDecode( c.payload )
+    if err != nil {
+        return nil, nil, err
+    }
+    m, _ := v.(cborMap)
+    return m, v, nil
+}
+
+// checkDataHash recomputes the hash of the file excluding the given ranges,
+// as specified by a c2pa.hash.data assertion
+func checkDataHash( data []byte, assertion cborMap, claimAlg string ) string {
+    alg := assertion.text( "alg" )
+    if alg == "" {
+        alg = claimAlg
+    }
+    var h hash.Hash
+    switch alg {
+    case "sha256", "":  h = sha256.New()
+    case "sha384":      h = sha512.New384()
+    case "sha512":      h = sha512.New()
+    default:
+        return fmt.Sprintf( "unsupported hash algorithm %s", alg )
+    }
+    expected, _ := assertion.get( "hash" )
+    want, ok := expected.([]byte)
+    if ! ok {
+        return "missing hash value"
+    }
+    var ranges []byteRange
+    if exclusions, ok := assertion.get( "exclusions" ); ok {
+        list, _ := exclusions.([]interface{})
+        for _, e := range list {
+            em, _ := e.(cborMap)
+            start, ok1 := em.get( "start" )
+            length, ok2 := em.get( "length" )
+            s, ok3 := cborInt( start )
+            n, ok4 := cborInt( length )
+            if ! ( ok1 && ok2 && ok3 && ok4 ) || s < 0 || n < 0 ||
+               s + n > int64(len(data)) {
+                return "invalid exclusion range"
+            }
+            ranges = append( ranges, byteRange{ int(s), int(n) } )
+        }
+    }
+    sort.Slice( ranges, func( i, j int ) bool {
+        return ranges[i].offset < ranges[j].offset
+    })
+    pos := 0
+    for _, r := range ranges {
+        if r.offset < pos {
+            return "overlapping exclusion ranges"
+        }
+        h.Write( data[pos:r.offset] )
+        pos = r.offset + r.length
+    }
+    h.Write( data[pos:] )
+    if ! bytes.Equal( h.Sum( nil ), want ) {
+        return fmt.Sprintf( "%s MISMATCH, the file was modified after " +
+                            "signing", alg )
+    }
+    if alg == "" {
+        alg = "sha256"
+    }
+    return fmt.Sprintf( "%s matches (%d exclusion(s))", alg, len(ranges) )
+}
+
+// signatureStatus checks the structure of a claim signature box
+func signatureStatus( box *jumbfBox ) string {
+    _, v, err := cborContent( box )
+    if err != nil {
+        return fmt.Sprintf( "invalid (%v)", strings.TrimSpace( err.Error() ) )
+    }
+    tag, ok := v.(cborTag)
+    if ! ok || tag.number != coseSign1Tag {
+        return "invalid (not a COSE_Sign1 structure)"
+    }
+    parts, ok := tag.value.([]interface{})
+    if ! ok || len(parts) != 4 {
+        return "invalid (COSE_Sign1 is not an array of 4 items)"
+    }
+    sig, ok := parts[3].([]byte)
+    if ! ok || len(sig) == 0 {
+        return "invalid (empty signature)"
+    }
+    return fmt.Sprintf( "COSE_Sign1, %d bytes (structure only, certificate " +
+                        "chain not verified)", len(sig) )
+}
+
+func parseC2paManifest( box *jumbfBox, data []byte ) *c2paManifest {
+    cm := &c2paManifest{ label: box.desc.label, kind: box.desc.typeName() }
+    var claimBox, sigBox *jumbfBox
+    var hashData cborMap
+    for _, c := range box.children {
+        if c.desc == nil {
+            continue
+        }
+        switch c.desc.typeName() {
+        case "c2as":
+            for _, a := range c.children {
+                if a.desc == nil {
+                    continue
+                }
+                cm.assertions = append( cm.assertions, a.desc.label )
+                if strings.HasPrefix( a.desc.label, "c2pa.hash.data" ) {
+                    hashData, _, _ = cborContent( a )
+                }
+            }
+        case "c2cl":
+            claimBox = c
+        case "c2cs":
+            sigBox = c
+        }
+    }
+    if claimBox == nil {
+        cm.problems = append( cm.problems, "no claim" )
+    } else {
+        var err error
+        if cm.claim, _, err = cborContent( claimBox ); err != nil {
+            cm.problems = append( cm.problems, fmt.Sprintf( "invalid claim: " +
+                                  "%s", strings.TrimSpace( err.Error() ) ) )
+        }
+    }
+    if sigBox == nil {
+        cm.signature = "missing"
+        cm.problems = append( cm.problems, "no claim signature" )
+    } else {
+        cm.signature = signatureStatus( sigBox )
+        if strings.HasPrefix( cm.signature, "invalid" ) {
+            cm.problems = append( cm.problems, "signature " + cm.signature )
+        }
+    }
+    if hashData != nil {
+        cm.dataHash = checkDataHash( data, hashData, cm.claim.text( "alg" ) )
+        if strings.Contains( cm.dataHash, "MISMATCH" ) ||
+           ! strings.Contains( cm.dataHash, "matches" ) {
+            cm.problems = append( cm.problems, "data hash " + cm.dataHash )
+        }
+    }
+    return cm
+}
+
+// findC2pa returns the C2PA manifest store found in data, or nil if none
+func findC2pa( data []byte, l *fileLayout ) *c2paStore {
+    for _, st := range jumbfStores( data, l ) {
+        boxes, err := parseJumbfBoxes( st.data, 0 )
+        if len(boxes) == 0 || boxes[0].desc == nil ||
+           boxes[0].desc.typeName() != "c2pa" {
+            continue
+        }
+        cs := &c2paStore{ store: st, problems: st.problems }
+        if err != nil {
+            cs.problems = append( cs.problems, strings.TrimSpace( err.Error() ) )
+        }
+        for _, c := range boxes[0].children {
+            if c.desc != nil && ( c.desc.typeName() == "c2ma" ||
+                                  c.desc.typeName() == "c2um" ) {
+                cs.manifests = append( cs.manifests,
+                                       parseC2paManifest( c, data ) )
+            }
+        }
+        return cs
+    }
+    return nil
+}
+
+// formatC2pa prints a summary of the C2PA manifest store and reports problems
+// as warnings
+func formatC2pa( data []byte, l *fileLayout, rep *fileReport ) {
+    cs := findC2pa( data, l )
+    if cs == nil {
+        fmt.Printf( "No C2PA manifest\n" )
+        return
+    }
+    fmt.Printf( "C2PA manifest store: %d manifest(s) in %d APP11 segment(s), " +
+                "%d bytes\n", len(cs.manifests), len(cs.store.segments),
+                len(cs.store.data) )
+    warn := func( text string ) {
+        text = "C2PA: " + text
+        fmt.Printf( "  Warning: %s\n", text )
+        rep.addMessage( warningSeverity, codeC2pa, text )
+    }
+    for _, p := range cs.problems {
+        warn( p )
+    }
+    for i, cm := range cs.manifests {
+        active := ""
+        if i == len(cs.manifests) - 1 {
+            active = " (active)"
+        }
+        kind := ""
+        if cm.kind == "c2um" {
+            kind = "update "
+        }
+        fmt.Printf( "  %smanifest %s%s\n", kind, cm.label, active )
+        if g := cm.claim.text( "claim_generator" ); g != "" {
+            fmt.Printf( "    Claim generator: %s\n", g )
+        }
+        for _, f := range []struct{ key, name string }{
+                    { "dc:title", "Title" }, { "dc:format", "Format" },
+                    { "instanceID", "Instance id" } } {
+            if v := cm.claim.text( f.key ); v != "" {
+                fmt.Printf( "    %s: %s\n", f.name, v )
+            }
+        }
+        fmt.Printf( "    Assertions: %s\n", strings.Join( cm.assertions, ", " ) )
+        fmt.Printf( "    Signature: %s\n", cm.signature )
+        if cm.dataHash != "" {
+            fmt.Printf( "    Data hash: %s\n", cm.dataHash )
+        }
+        for _, p := range cm.problems {
+            warn( fmt.Sprintf( "manifest %s: %s", cm.label, p ) )
+        }
+    }
+}
+
+// saveC2pa writes the C2PA manifest store as a standalone .c2pa file
+func saveC2pa( path string, data []byte, l *fileLayout ) error {
+    cs := findC2pa( data, l )
+    if cs == nil {
+        return fmt.Errorf( "no C2PA manifest to save\n" )
+    }
+    if err := writeFile( path, cs.store.data, 0644 ); err != nil {
+        return fmt.Errorf( "unable to save C2PA manifest store: %v\n", err )
+    }
+    fmt.Printf( "Saved C2PA manifest store as %s, %d bytes\n", path,
+                len(cs.store.data) )
+    return nil
+}
+
+// removeC2pa removes the APP11 segments of any C2PA manifest store from the
+// file at path, and returns the number of segments removed.
+func removeC2pa( path string ) (int, error) {
+    data, err := os.ReadFile( path )
+    if err != nil {
+        return 0, fmt.Errorf( "remove C2PA: %v\n", err )
+    }
+    cs := findC2pa( data, scanLayout( data ) )
+    if cs == nil {
+        return 0, nil
+    }
+    segments := append( []*segment{ }, cs.store.segments... )
+    sort.Slice( segments, func( i, j int ) bool {
+        return segments[i].offset < segments[j].offset
+    })
+    var b bytes.Buffer
+    pos := 0
+    for _, s := range segments {
+        b.Write( data[pos:s.offset] )
+        pos = s.end()
+    }
+    b.Write( data[pos:] )
+    if err = writeFile( path, b.Bytes(), 0644 ); err != nil {
+        return 0, fmt.Errorf( "remove C2PA: %v\n", err )
+    }
+    return len(cs.store.segments), nil
+}
+
+// c2paCopy removes any C2PA manifest store from the copy at output if remove is
+// true, otherwise warns if the manifest store of the original at path was not
+// kept in the copy.
+func c2paCopy( path, output string, remove bool ) error {
+    orig, err := os.ReadFile( path )
+    if err != nil {
+        return fmt.Errorf( "C2PA: %v\n", err )
+    }
+    cs := findC2pa( orig, scanLayout( orig ) )
+    if remove {
+        if _, err = removeC2pa( output ); err != nil {
+            return err
+        }
+        if cs != nil {
+            fmt.Printf( "C2PA: manifest store (%d APP11 segment(s)) removed " +
+                        "from the copy\n", len(cs.store.segments) )
+        }
+        return nil
+    }
+    if cs == nil {
+        return nil
+    }
+    written, err := os.ReadFile( output )
+    if err == nil && findC2pa( written, scanLayout( written ) ) == nil {
+        fmt.Printf( "Warning: the C2PA manifest store of %s is not kept in " +
+                    "the copy\n", path )
+    }
+    return nil
+}
@@ -0,0 +1,164 @@
+
+package main
+
+import (
+    "bufio"
+    "crypto/sha256"
+    "encoding/hex"
+    "flag"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// A cache keeps the outcome of the files checked in previous runs, keyed by
+// file path and identified by their size, their modification time and a hash
+// of the options they were checked with, so that files that did not change
+// since they were checked with the same options are not analysed again. It is
+// a text file with one line per file: status (valid or failed), size,
+// modification time in nanoseconds since the epoch and options hash, followed
+// by the file path, all separated by tabs. The cache is not used to skip files
+// when files are written for each file checked (-o, -spict, -sign, -on-error
+// etc.), since nothing would be written for the skipped files.
+
+type cacheEntry struct {
+    size, mtime     int64
+    options         string
+    failed          bool
+}
+
+type fileCache struct {
+    path            string
+    options         string          // hash of the current options
+    entries         map[string]cacheEntry
+    modified        bool
+}
+
+// cacheNeutralFlags are the options that do not change the outcome of a file:
+// they are about the cache itself, select the files or route the reports
+var cacheNeutralFlags = map[string]bool{
+    "cache": true, "force": true, "journal": true, "resume": true,
+    "sample": true, "max-write-mbps": true, "max-open-files": true,
+    "checksum": true, "verify-checksum": true, "xml-report": true,
+    "report": true, "sink": true, "json": true, "q": true, "q-summary": true,
+    "R": true, "min-size": true, "max-size": true, "newer-than": true,
+    "older-than": true, "symlinks": true, "hardlinks": true,
+}
+
+// cacheOptions returns a hash of the options set in fs, except the neutral
+// ones, so that an outcome cached with other options is not reused
+func cacheOptions( fs *flag.FlagSet ) string {
+    h := sha256.New()
+    fs.Visit( func( f *flag.Flag ) {    // in lexicographical order
+        if ! cacheNeutralFlags[f.Name] {
+            fmt.Fprintf( h, "%s=%s\n", f.Name, f.Value.String() )
+        }
+    } )
+    return hex.EncodeToString( h.Sum( nil )[:8] )
+}
+
+func loadCache( path, options string ) (*fileCache, error) {
+    c := new( fileCache )
+    c.path, c.options = path, options
+    c.entries = make( map[string]cacheEntry )
+
+    f, err := os.Open( path )
+    if err != nil {
+        if os.IsNotExist( err ) {
+            return c, nil   // empty cache
+        }
+        return nil, fmt.Errorf( "unable to read cache %s: %v\n", path, err )
+    }
+    defer f.Close()
+    scanner := bufio.NewScanner( f )
+    for scanner.Scan() {
+        fields := strings.SplitN( scanner.Text(), "\t", 5 )
+        if len(fields) != 5 {
+            continue
+        }
+        var e cacheEntry
+        switch fields[0] {
+        case journalValid:  e.failed = false
+        case journalFailed: e.failed = true
+        default:            continue
+        }
+        if e.size, err = strconv.ParseInt( fields[1], 10, 64 ); err != nil {
+            continue
+        }
+        if e.mtime, err = strconv.ParseInt( fields[2], 10, 64 ); err != nil {
+            continue
+        }
+        e.options = fields[3]
+        c.entries[fields[4]] = e
+    }
+    if err = scanner.Err(); err != nil {
+        return nil, fmt.Errorf( "unable to read cache %s: %v\n", path, err )
+    }
+    return c, nil
+}
+
+// lookup returns whether the file at path is unchanged since it was cached
+// with the same options, and in that case whether it failed.
+func (c *fileCache) lookup( path string, info os.FileInfo ) (found, failed bool) {
+    e, ok := c.entries[path]
+    if ok && e.size == info.Size() && e.mtime == info.ModTime().UnixNano() &&
+       e.options == c.options {
+        return true, e.failed
+    }
+    return false, false
+}
+
+func (c *fileCache) update( path string, info os.FileInfo, failed bool ) {
+    c.entries[path] = cacheEntry{ size: info.Size(),
+                                  mtime: info.ModTime().UnixNano(),
+                                  options: c.options, failed: failed }
+    c.modified = true
+}
+
+// save writes the cache in a temporary file first and then replaces the
+// previous cache, so that an interrupted run does not leave a corrupted cache.
+func (c *fileCache) save( ) (err error) {
+    if ! c.modified {
+        return nil
+    }
+    var f *os.File
+    f, err = os.CreateTemp( filepath.Dir( c.path ), ".jcheck-cache-*" )
+    if err != nil {
+        return fmt.Errorf( "unable to save cache %s: %v\n", c.path, err )
+    }
+    defer func( ) {
+        if err != nil {
+            os.Remove( f.Name() )
+        }
+    }()
+    paths := make( []string, 0, len(c.entries) )
+    for path := range c.entries {
+        paths = append( paths, path )
+    }
+    sort.Strings( paths )
+    w := bufio.NewWriter( f )
+    for _, path := range paths {
+        e := c.entries[path]
+        status := journalValid
+        if e.failed {
+            status = journalFailed
+        }
+        fmt.Fprintf( w, "%s\t%d\t%d\t%s\t%s\n", status, e.size, e.mtime,
+                     e.options, path )
+    }
+    if err = w.Flush(); err == nil {
+        err = f.Close()
+    } else {
+        f.Close()
+    }
+    if err == nil {
+        err = os.Rename( f.Name(), c.path )
+    }
+    if err != nil {
+        err = fmt.Errorf( "unable to save cache %s: %v\n", c.path, err )
+    }
+    return
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestCacheOptions( t *testing.T ) {
+    tests := []struct {
+        name        string
+        first       []string        // options of the run filling the cache
+        second      []string        // options of the following run
+        output      bool            // both runs write out.jpg with -o
+        analysed    bool            // in the following run
+    }{
+        { "same options", nil, nil, false, false },
+        { "neutral option", nil, []string{ "-q-summary" }, false, false },
+        { "other options", nil, []string{ "-severity=info" }, false, true },
+        { "output option", []string{ "-tidyup" }, []string{ "-tidyup" },
+          true, true },
+    }
+    for _, tc := range tests {
+        t.Run( tc.name, func( t *testing.T ) {
+            dir := t.TempDir()
+            path := filepath.Join( dir, "baseline-420.jpg" )
+            if err := os.WriteFile( path, testsetData( t, "baseline-420.jpg" ),
+                                    0644 ); err != nil {
+                t.Fatal( err )
+            }
+            out := filepath.Join( dir, "out.jpg" )
+            run := func( options []string ) []jsonFile {
+                report := filepath.Join( dir, "report.json" )
+                args := append( []string{ "-q", "-report=" + report,
+                                "-cache=" + filepath.Join( dir, "cache" ) },
+                                options... )
+                if tc.output {
+                    args = append( args, "-o=" + out )
+                }
+                processBatch( checkerArgs( t, append( args, path )... ) )
+                return reportFiles( t, report )
+            }
+            run( tc.first )
+            os.Remove( out )
+            files := run( tc.second )
+            if len(files) != 1 || files[0].Analysed != tc.analysed {
+                t.Fatalf( "analysed %+v, expected %t", files, tc.analysed )
+            }
+            if _, err := os.Stat( out ); tc.output && err != nil {
+                t.Errorf( "output not written: %v", err )
+            }
+        } )
+    }
+}
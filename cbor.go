@@ -0,0 +1,159 @@
+
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "math"
+)
+
+// Minimal CBOR (RFC 8949) decoder for the structures embedded in metadata
+// containers such as C2PA claims. Only definite length items are supported.
+// Maps are decoded as a list of pairs to keep their order and non-text keys.
+
+type cborPair struct {
+    key, value      interface{}
+}
+
+type cborMap []cborPair
+
+type cborTag struct {
+    number          uint64
+    value           interface{}
+}
+
+type cborSimple byte
+
+// get returns the value associated with a text key
+func (m cborMap) get( key string ) (interface{}, bool) {
+    for _, p := range m {
+        if k, ok := p.key.(string); ok && k == key {
+            return p.value, true
+        }
+    }
+    return nil, false
+}
+
+func (m cborMap) text( key string ) string {
+    v, _ := m.get( key )
+    s, _ := v.(string)
+    return s
+}
+
+const cborMaxDepth = 64
+
+// cborDecode decodes one item from b and returns the remaining bytes
+func cborDecode( b []byte ) (interface{}, []byte, error) {
+    return cborItem( b, 0 )
+}
+
+func cborItem( b []byte, depth int ) (interface{}, []byte, error) {
+    if depth > cborMaxDepth {
+        return nil, nil, fmt.Errorf( "CBOR nesting too deep\n" )
+    }
+    if len(b) == 0 {
+        return nil, nil, fmt.Errorf( "truncated CBOR item\n" )
+    }
+    major, info := b[0] >> 5, b[0] & 0x1f
+    b = b[1:]
+    var arg uint64
+    switch {
+    case info < 24:
+        arg = uint64(info)
+    case info <= 27:
+        n := 1 << (info - 24)
+        if len(b) < n {
+            return nil, nil, fmt.Errorf( "truncated CBOR item\n" )
+        }
+        switch n {
+        case 1: arg = uint64(b[0])
+        case 2: arg = uint64( binary.BigEndian.Uint16( b ) )
+        case 4: arg = uint64( binary.BigEndian.Uint32( b ) )
+        case 8: arg = binary.BigEndian.Uint64( b )
+        }
+        b = b[n:]
+    default:
+        return nil, nil, fmt.Errorf( "unsupported CBOR additional info %d\n",
+                                     info )
+    }
+    switch major {
+    case 0:
+        return arg, b, nil
+    case 1:
+        return -1 - int64(arg), b, nil
+    case 2, 3:
+        if arg > uint64(len(b)) {
+            return nil, nil, fmt.Errorf( "truncated CBOR string\n" )
+        }
+        if major == 2 {
+            return b[:arg], b[arg:], nil
+        }
+        return string( b[:arg] ), b[arg:], nil
+    case 4:
+        if arg > uint64(len(b)) {       // at least 1 byte per item
+            return nil, nil, fmt.Errorf( "truncated CBOR array\n" )
+        }
+        list := make( []interface{}, 0, arg )
+        for i := uint64(0); i < arg; i++ {
+            var v interface{}
+            var err error
+            if v, b, err = cborItem( b, depth + 1 ); err != nil {
+                return nil, nil, err
+            }
+            list = append( list, v )
+        }
+        return list, b, nil
+    case 5:
+        if arg > uint64(len(b)) / 2 {
+            return nil, nil, fmt.Errorf( "truncated CBOR map\n" )
+        }
+        m := make( cborMap, 0, arg )
+        for i := uint64(0); i < arg; i++ {
+            var k, v interface{}
+            var err error
+            if k, b, err = cborItem( b, depth + 1 ); err != nil {
+                return nil, nil, err
+            }
+            if v, b, err = cborItem( b, depth + 1 ); err != nil {
+                return nil, nil, err
+            }
+            m = append( m, cborPair{ k, v } )
+        }
+        return m, b, nil
+    case 6:
+        v, rest, err := cborItem( b, depth + 1 )
+        if err != nil {
+            return nil, nil, err
+        }
+        return cborTag{ arg, v }, rest, nil
+    }
+    switch info {                       // major type 7
+    case 20: return false, b, nil
+    case 21: return true, b, nil
+    case 22, 23: return nil, b, nil
+    case 25: return float64( halfFloat( uint16(arg) ) ), b, nil
+    case 26: return float64( math.Float32frombits( uint32(arg) ) ), b, nil
+    case 27: return math.Float64frombits( arg ), b, nil
+    }
+    return cborSimple( arg ), b, nil
+}
+
+func halfFloat( h uint16 ) float64 {
+    exp := int( h >> 10 ) & 0x1f
+    mant := float64( h & 0x3ff )
+    var v float64
+    switch exp {
+    case 0:     v = math.Ldexp( mant, -24 )
+    case 31:
+        if mant == 0 {
+            v = math.Inf( 1 )
+        } else {
+            v = math.NaN()
+        }
+    default:    v = math.Ldexp( mant + 1024, exp - 25 )
+    }
+    if h & 0x8000 != 0 {
+        v = -v
+    }
+    return v
+}
@@ -0,0 +1,109 @@
+
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "image"
+    "math"
+    "path/filepath"
+)
+
+// Chroma planes (-schroma): codec research needs the chroma as stored, not
+// upsampled and interpolated to the picture size as in the saved picture. The
+// Cb and Cr components are reconstructed at their own resolution (inverse DCT
+// of the dequantized coefficients, cropped to the component size) and saved as
+// 16-bit grayscale png files, keeping the fractional part of the samples. A
+// json sidecar gives for each plane its size, sampling factors and the
+// position of its first sample in picture pixels, assuming the centered
+// siting of JFIF, so that the planes can be registered with the picture.
+// Given a prefix p, the files written are p-cb.png, p-cr.png and p.json.
+
+var chromaNames = []string{ "cb", "cr" }
+
+type chromaPlaneInfo struct {
+    Name            string      `json:"name"`
+    File            string      `json:"file"`       // relative to sidecar
+    Component       int         `json:"component"`  // index in frame
+    Id              int         `json:"id"`
+    Width           int         `json:"width"`
+    Height          int         `json:"height"`
+    H               int         `json:"h"`          // sampling factors
+    V               int         `json:"v"`
+    XSubsampling    float64     `json:"xSubsampling"`
+    YSubsampling    float64     `json:"ySubsampling"`
+    XOffset         float64     `json:"xOffset"`    // first sample center,
+    YOffset         float64     `json:"yOffset"`    // in picture pixels
+}
+
+type chromaSidecar struct {
+    Path            string      `json:"path"`
+    Width           int         `json:"width"`
+    Height          int         `json:"height"`
+    Precision       int         `json:"precision"`
+    Scale           float64     `json:"scale"`      // png value / sample
+    Siting          string      `json:"siting"`
+    Planes          []chromaPlaneInfo `json:"planes"`
+}
+
+// saveChromaPlanes saves the chroma planes of the picture in data as 16-bit
+// png files and a json sidecar, named from prefix.
+func saveChromaPlanes( prefix, path string, data []byte, l *fileLayout ) error {
+    img, err := decodeCoefficients( data, l )
+    if err != nil {
+        return fmt.Errorf( "chroma planes: %v", err )
+    }
+    fh := img.frame
+    if len(fh.comps) != 3 {
+        return fmt.Errorf( "chroma planes: %d component(s), Y, Cb and Cr " +
+                           "are expected\n", len(fh.comps) )
+    }
+    sc := chromaSidecar{ Path: path, Width: fh.width, Height: fh.height,
+                         Precision: fh.precision,
+                         Scale: float64( int(1) << uint(16 - fh.precision) ),
+                         Siting: "centered" }
+    for i, name := range chromaNames {
+        ci := i + 1
+        c := &fh.comps[ci]
+        p, err := img.componentPlane( ci )
+        if err != nil {
+            return fmt.Errorf( "chroma planes: %v", err )
+        }
+        gray := image.NewGray16( image.Rect( 0, 0, p.width, p.height ) )
+        for k, s := range p.samples {
+            v := math.Round( s * sc.Scale )
+            if v < 0 {
+                v = 0
+            } else if v > 65535 {
+                v = 65535
+            }
+            gray.Pix[2*k], gray.Pix[2*k+1] = byte( int(v) >> 8 ),
+                                             byte( int(v) )
+        }
+        file := prefix + "-" + name + ".png"
+        if err = writePng( file, gray ); err != nil {
+            return fmt.Errorf( "chroma planes: %v\n", err )
+        }
+        xs := float64(fh.hMax) / float64(c.h)
+        ys := float64(fh.vMax) / float64(c.v)
+        sc.Planes = append( sc.Planes, chromaPlaneInfo{ Name: name,
+                            File: filepath.Base( file ), Component: ci,
+                            Id: int(c.id), Width: p.width, Height: p.height,
+                            H: c.h, V: c.v, XSubsampling: xs, YSubsampling: ys,
+                            XOffset: ( xs - 1 ) / 2, YOffset: ( ys - 1 ) / 2 } )
+        fmt.Printf( "Saved %s plane (%dx%d, subsampling %gx%g) as %s\n",
+                    name, p.width, p.height, xs, ys, file )
+    }
+    var b bytes.Buffer
+    enc := json.NewEncoder( &b )
+    enc.SetEscapeHTML( false )
+    enc.SetIndent( "", "  " )
+    if err = enc.Encode( &sc ); err != nil {
+        return fmt.Errorf( "chroma planes: %v\n", err )
+    }
+    if err = writeFile( prefix + ".json", b.Bytes(), 0644 ); err != nil {
+        return fmt.Errorf( "chroma planes: %v\n", err )
+    }
+    return nil
+}
@@ -0,0 +1,150 @@
+
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    stdjpeg "image/jpeg"
+    "os/exec"
+    "plugin"
+    "strings"
+)
+
+// External classifiers (-classify): privacy workflows need to flag pictures
+// showing faces or documents before publication, which requires models that
+// do not belong in jcheck. jcheck decodes the main picture, downscales it so
+// that it fits in a square of -classify-size pixels and hands the RGB samples
+// to the classifier, either:
+//  - an executable, run for each file with the file path as argument and the
+//    samples as a binary PPM (P6) on its standard input, or
+//  - a Go plugin (.so), loaded once, exporting a function
+//      func Classify( width, height int, rgb []byte ) ([]string, error)
+// Each line printed by the executable, or string returned by the plugin, is a
+// verdict merged into the report: lines starting with "warning:" or "error:"
+// are reported with that severity, others as info. An error verdict makes the
+// file fail, so that it can be kept from publication, and so does a failure
+// of the classifier itself.
+
+const defaultClassifySize = 512
+
+type classifyFunc func( width, height int, rgb []byte ) ([]string, error)
+
+type classifier struct {
+    path            string
+    size            int             // largest side of pictures given
+    classify        classifyFunc    // plugin function, nil for an executable
+}
+
+// newClassifier returns a classifier for the executable or Go plugin at path
+func newClassifier( path string, size int ) (*classifier, error) {
+    c := &classifier{ path: path, size: size }
+    if ! strings.HasSuffix( path, ".so" ) {
+        if _, err := exec.LookPath( path ); err != nil {
+            return nil, fmt.Errorf( "classifier %s: %v\n", path, err )
+        }
+        return c, nil
+    }
+    p, err := plugin.Open( path )
+    if err != nil {
+        return nil, fmt.Errorf( "classifier %s: %v\n", path, err )
+    }
+    sym, err := p.Lookup( "Classify" )
+    if err != nil {
+        return nil, fmt.Errorf( "classifier %s: %v\n", path, err )
+    }
+    switch f := sym.(type) {
+    case func( int, int, []byte ) ([]string, error):
+        c.classify = f
+    case *classifyFunc:
+        c.classify = *f
+    default:
+        return nil, fmt.Errorf( "classifier %s: Classify has type %T\n",
+                                path, sym )
+    }
+    return c, nil
+}
+
+// run returns the verdicts of the classifier for the picture of the file at
+// path, given as w x h RGB samples
+func (c *classifier) run( path string, w, h int,
+                          rgb []byte ) ([]string, error) {
+    if c.classify != nil {
+        verdicts, err := c.classify( w, h, rgb )
+        if err != nil {
+            return nil, fmt.Errorf( "classifier %s failed: %v\n", c.path,
+                                    strings.TrimSpace( err.Error() ) )
+        }
+        return verdicts, nil
+    }
+    var stdin bytes.Buffer
+    fmt.Fprintf( &stdin, "P6\n%d %d\n255\n", w, h )
+    stdin.Write( rgb )
+    cmd := exec.Command( c.path, path )
+    cmd.Stdin = &stdin
+    out, err := cmd.Output()
+    if err != nil {
+        detail := err.Error()
+        if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+            detail = strings.TrimSpace( string(ee.Stderr) )
+        }
+        return nil, fmt.Errorf( "classifier %s failed: %s\n", c.path, detail )
+    }
+    var verdicts []string
+    sc := bufio.NewScanner( bytes.NewReader( out ) )
+    for sc.Scan() {
+        verdicts = append( verdicts, sc.Text() )
+    }
+    return verdicts, nil
+}
+
+// verdictSeverity returns the severity and text of a classifier verdict
+func verdictSeverity( v string ) (severity, string) {
+    for _, s := range []severity{ warningSeverity, errorSeverity } {
+        prefix := s.String() + ":"
+        if strings.HasPrefix( strings.ToLower( v ), prefix ) {
+            return s, strings.TrimSpace( v[len(prefix):] )
+        }
+    }
+    return infoSeverity, strings.TrimSpace( strings.TrimPrefix( v, "info:" ) )
+}
+
+// classifyPicture decodes the main picture in data, downscales it and merges
+// the verdicts of the classifier into the report. It returns the first error
+// verdict as an error.
+func classifyPicture( path string, data []byte, c *classifier,
+                      rep *fileReport ) (err error) {
+    main, err := stdjpeg.Decode( bytes.NewReader( data ) )
+    if err != nil {
+        return fmt.Errorf( "classify: unable to decode the picture: %v\n", err )
+    }
+    b := main.Bounds()
+    w, h := b.Dx(), b.Dy()
+    if w > c.size || h > c.size {
+        r := letterbox( w, h, c.size, c.size )
+        w, h = r.Dx(), r.Dy()
+    }
+    verdicts, rerr := c.run( path, w, h, rgbSamples( main, w, h ) )
+    if rerr != nil {
+        return rerr
+    }
+    fmt.Printf( "Classifier (%dx%d pixels):", w, h )
+    if len(verdicts) == 0 {
+        fmt.Printf( " no verdict\n" )
+    } else {
+        fmt.Printf( "\n" )
+    }
+    for _, v := range verdicts {
+        s, text := verdictSeverity( v )
+        if text == "" {
+            continue
+        }
+        fmt.Printf( "  [%s] %s\n", s, text )
+        if s == errorSeverity && err == nil {
+            err = fmt.Errorf( "classifier: %s\n", text )
+        } else {
+            rep.addMessage( s, codeClassifier, "classifier: " + text )
+        }
+    }
+    return
+}
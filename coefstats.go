@@ -0,0 +1,91 @@
+
+package main
+
+import (
+    "fmt"
+)
+
+// Coefficient statistics (-coef-stats): rate and quality studies, and the
+// identification of unusual encoders, need the distribution of the quantized
+// coefficients at each of the 64 positions of the blocks, along with the
+// quantization step used for that position. Only the blocks covering the
+// picture are counted, not the padding blocks of incomplete MCUs. A
+// coefficient is clipped if its dequantized value is outside of the range
+// of the DCT of samples at the frame precision (-1024 to 1023 for 8 bits),
+// which decoders have to clamp: a correct encoder never produces them.
+
+type coefPositionStats struct {
+    min, max        int32
+    sum, sumAbs     int64
+    zeros           int
+}
+
+// formatCoefficientStats prints the statistics of each coefficient position
+// for each component of the first frame in data
+func formatCoefficientStats( data []byte, l *fileLayout ) {
+    fmt.Printf( "Coefficient statistics:\n" )
+    img, err := decodeCoefficients( data, l )
+    if err != nil {
+        fmt.Printf( "  Not available: %v", err )
+        return
+    }
+    fh := img.frame
+    limit := int64(1) << uint(fh.precision + 2)
+    for ci := range fh.comps {
+        cc := &img.comps[ci]
+        qt := img.quant[cc.tq]
+        if qt == nil {
+            fmt.Printf( "  Component %d: missing quantization table %d\n",
+                        fh.comps[ci].id, cc.tq )
+            continue
+        }
+        var stats [64]coefPositionStats     // in zigzag order
+        for k := range stats {
+            stats[k].min, stats[k].max = 1 << 30, -1 << 30
+        }
+        bx, by := fh.compBlocks( ci )
+        clipped := 0
+        for y := 0; y < by; y++ {
+            for x := 0; x < bx; x++ {
+                b := cc.at( x, y )
+                for k := 0; k < 64; k++ {
+                    c := b[zigZag[k]]
+                    s := &stats[k]
+                    if c < s.min {
+                        s.min = c
+                    }
+                    if c > s.max {
+                        s.max = c
+                    }
+                    s.sum += int64(c)
+                    if c < 0 {
+                        s.sumAbs -= int64(c)
+                    } else {
+                        s.sumAbs += int64(c)
+                    }
+                    if c == 0 {
+                        s.zeros ++
+                    }
+                    if v := int64(c) * int64(qt.values[k]);
+                       v < -limit || v >= limit {
+                        clipped ++
+                    }
+                }
+            }
+        }
+        n := bx * by
+        fmt.Printf( "  Component %d: quantization table %d, %d blocks, %d " +
+                    "clipped coefficient(s)\n", fh.comps[ci].id, cc.tq, n,
+                    clipped )
+        fmt.Printf( "    %3s %5s %5s %7s %7s %9s %9s %7s\n", "zz", "(u,v)", "q",
+                    "min", "max", "mean", "mean|c|", "zeros" )
+        for k := range stats {
+            s := &stats[k]
+            fmt.Printf( "    %3d (%d,%d) %5d %7d %7d %9.3f %9.3f %6.2f%%\n", k,
+                        zigZag[k] % 8, zigZag[k] / 8, qt.values[k], s.min,
+                        s.max, float64(s.sum) / float64(n),
+                        float64(s.sumAbs) / float64(n),
+                        percent( int64(s.zeros), int64(n) ) )
+        }
+    }
+}
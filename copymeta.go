@@ -0,0 +1,238 @@
+
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+    "sort"
+    "strings"
+)
+
+// Metadata transplant (-copymeta=<source>[:<kind>[,<kind>]*]): the Exif, XMP
+// (main and extended packets) and ICC profile segments of a source jpeg file
+// are copied into the copy written with -o, replacing the segments of the same
+// kind, in order to re-attach metadata stripped by an external tool. This is
+// done right after writing, so that the other modifications (-rmeta tags,
+// -setmeta, -strip-gps, -audit) apply to the transplanted metadata. Copied
+// segments are inserted after the JFIF APP0 segment and after the leading
+// metadata segments that come first in the recommended order (see order.go),
+// and the offsets of an MPF segment are adjusted if the data that follows it
+// moves. Image data is not modified.
+
+var copyMetaKinds = map[string][]metadataRank{
+    "exif":     { rankExif },
+    "xmp":      { rankXmp, rankXmpExtended },
+    "icc":      { rankIcc },
+}
+
+type copyMetaSpec struct {
+    source          string
+    kinds           []string    // in the order exif, xmp, icc
+}
+
+// parseCopyMeta parses the argument of -copymeta. As paths may include ':',
+// the last part is taken as a list of kinds only if all are valid kinds.
+func parseCopyMeta( arg string ) (*copyMetaSpec, error) {
+    cm := &copyMetaSpec{ source: arg }
+    selected := map[string]bool{ "exif": true, "xmp": true, "icc": true }
+    if i := strings.LastIndex( arg, ":" ); i != -1 {
+        kinds := strings.Split( arg[i+1:], "," )
+        valid := true
+        for _, k := range kinds {
+            _, ok := copyMetaKinds[strings.ToLower( k )]
+            valid = valid && ok
+        }
+        if valid {
+            cm.source = arg[:i]
+            selected = make( map[string]bool )
+            for _, k := range kinds {
+                selected[strings.ToLower( k )] = true
+            }
+        }
+    }
+    if cm.source == "" {
+        return nil, fmt.Errorf( "missing source file\n" )
+    }
+    for _, k := range []string{ "exif", "xmp", "icc" } {
+        if selected[k] {
+            cm.kinds = append( cm.kinds, k )
+        }
+    }
+    return cm, nil
+}
+
+// ranks returns the segment ranks to copy
+func (cm *copyMetaSpec) ranks( ) map[metadataRank]bool {
+    ranks := make( map[metadataRank]bool )
+    for _, k := range cm.kinds {
+        for _, r := range copyMetaKinds[k] {
+            ranks[r] = true
+        }
+    }
+    return ranks
+}
+
+// metadataSegments returns the segments of data before the first scan whose
+// rank is in ranks, in file order
+func metadataSegments( data []byte, l *fileLayout,
+                       ranks map[metadataRank]bool ) (segs []*segment) {
+    for i := range l.segments {
+        s := &l.segments[i]
+        if isImageDataMarker( s.marker ) || s.marker == markerEOI {
+            break
+        }
+        if s.marker < markerAPP0 || s.marker > markerAPP15 {
+            continue
+        }
+        if r, _ := metadataSegmentRank( s, data ); ranks[r] {
+            segs = append( segs, s )
+        }
+    }
+    return
+}
+
+// copyMetaFile copies the segments selected by cm from its source file into
+// the file at output, and returns a description of the changes
+func copyMetaFile( output string, cm *copyMetaSpec ) (string, error) {
+    src, err := os.ReadFile( cm.source )
+    if err != nil {
+        return "", fmt.Errorf( "copymeta: %v\n", err )
+    }
+    sl := scanLayout( src )
+    if len(sl.segments) == 0 || sl.segments[0].marker != markerSOI {
+        return "", fmt.Errorf( "copymeta: %s is not a jpeg file\n",
+                               cm.source )
+    }
+    data, err := os.ReadFile( output )
+    if err != nil {
+        return "", fmt.Errorf( "copymeta: %v\n", err )
+    }
+    l := scanLayout( data )
+    ranks := cm.ranks()
+    copied := metadataSegments( src, sl, ranks )
+    var missing []string
+    for _, k := range cm.kinds {
+        found := false
+        for _, s := range copied {
+            r, _ := metadataSegmentRank( s, src )
+            for _, kr := range copyMetaKinds[k] {
+                found = found || r == kr
+            }
+        }
+        if ! found {
+            missing = append( missing, k )
+        }
+    }
+    // copied segments in the recommended order, ICC chunks by sequence
+    ordered := append( []*segment( nil ), copied... )
+    sequence := func( s *segment ) int {
+        if d := s.data( src ); len(d) > len(iccHeader) {
+            return int(d[len(iccHeader)])
+        }
+        return 0
+    }
+    sort.SliceStable( ordered, func( i, j int ) bool {
+        ri, _ := metadataSegmentRank( ordered[i], src )
+        rj, _ := metadataSegmentRank( ordered[j], src )
+        if ri == rankIcc && rj == rankIcc {
+            return sequence( ordered[i] ) < sequence( ordered[j] )
+        }
+        return ri < rj
+    })
+    replaced := metadataSegments( data, l, ranks )
+    isReplaced := make( map[int]bool )
+    for _, s := range replaced {
+        isReplaced[s.offset] = true
+    }
+    // insert after the leading APPn segments kept that rank before the
+    // first copied segment (JFIF at least)
+    insertAt := 2
+    if len(ordered) > 0 {
+        first, _ := metadataSegmentRank( ordered[0], src )
+        for i := 1; i < len(l.segments); i++ {
+            s := &l.segments[i]
+            if s.marker < markerAPP0 || s.marker > markerAPP15 {
+                break
+            }
+            if isReplaced[s.offset] {
+                continue
+            }
+            if r, _ := metadataSegmentRank( s, data ); r >= first {
+                break
+            }
+            insertAt = s.end()
+        }
+    }
+    var b bytes.Buffer
+    mpfOld, mpfNew := -1, -1
+    pos, inserted := 0, false
+    for i := range l.segments {
+        s := &l.segments[i]
+        if ! inserted && s.offset >= insertAt {
+            b.Write( data[pos:insertAt] )
+            pos, inserted = insertAt, true
+            for _, c := range ordered {
+                if err = appendSegment( &b, c.marker,
+                                        c.data( src ) ); err != nil {
+                    return "", fmt.Errorf( "copymeta: %v", err )
+                }
+            }
+        }
+        if isImageDataMarker( s.marker ) || s.marker == markerEOI {
+            break
+        }
+        if isReplaced[s.offset] {
+            b.Write( data[pos:s.offset] )
+            pos = s.end()
+            continue
+        }
+        if s.marker == markerAPP0 + 2 &&
+           bytes.HasPrefix( s.data( data ), []byte( "MPF\x00" ) ) {
+            b.Write( data[pos:s.offset] )
+            pos = s.offset
+            mpfOld, mpfNew = s.offset, b.Len()
+        }
+    }
+    b.Write( data[pos:] )
+    out := b.Bytes()
+    if mpfOld != -1 {                   // keep MPF offsets valid
+        delta := ( len(out) - mpfNew ) - ( len(data) - mpfOld )
+        if delta != 0 {
+            nl := scanLayout( out )
+            for i := range nl.segments {
+                s := &nl.segments[i]
+                if s.offset != mpfNew {
+                    continue
+                }
+                d, err := adjustMpfOffsets( s.data( out ), delta )
+                if err != nil {
+                    return "", fmt.Errorf( "copymeta: MPF: %v", err )
+                }
+                copy( out[s.offset+4:], d )
+                break
+            }
+        }
+    }
+    if err = writeFile( output, out, 0644 ); err != nil {
+        return "", fmt.Errorf( "copymeta: %v\n", err )
+    }
+    var names []string
+    for _, s := range ordered {
+        _, name := metadataSegmentRank( s, src )
+        names = append( names, name )
+    }
+    change := "copymeta: nothing copied"
+    if len(names) > 0 {
+        change = fmt.Sprintf( "copymeta: copied %s from %s",
+                              strings.Join( names, ", " ), cm.source )
+    }
+    if len(replaced) > 0 {
+        change += fmt.Sprintf( ", replacing %d segment(s)", len(replaced) )
+    }
+    if len(missing) > 0 {
+        change += fmt.Sprintf( " (no %s in source)",
+                               strings.Join( missing, ", " ) )
+    }
+    return change, nil
+}
@@ -0,0 +1,112 @@
+
+package main
+
+import (
+    "encoding/csv"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// CSV report: one line per file, with the outcome, the properties of the first
+// frame and the number of messages of each severity, so that batch results
+// can be loaded in a spreadsheet or a database table. The first line gives
+// the column names. The exposure columns are empty without -exposure-check,
+// flags are separated by ';', and the sharpness columns are empty without
+// -blur-check.
+
+var csvColumns = []string{ "index", "path", "size", "lastModified", "status",
+                           "complete", "failed", "encodingMode",
+                           "entropyCoding", "samplePrecision", "width",
+                           "height", "components", "subsampling", "fatal",
+                           "errors", "warnings", "infos", "firstMessage",
+                           "output", "outputSize", "meanLuma",
+                           "clippedHighlights", "clippedShadows",
+                           "exposureFlags", "laplacianVariance",
+                           "blurred" }
+
+type csvReport struct {
+    f               *os.File
+    w               *csv.Writer
+}
+
+func newCsvReport( path string, process *jpgArgs ) (*csvReport, error) {
+    f, err := os.OpenFile( path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644 )
+    if err != nil {
+        return nil, fmt.Errorf( "unable to create csv report %s: %v\n",
+                                path, err )
+    }
+    cr := &csvReport{ f: f, w: csv.NewWriter( f ) }
+    cr.w.Write( csvColumns )
+    return cr, nil
+}
+
+func (cr *csvReport) name( ) string {
+    return "csv report"
+}
+
+func (cr *csvReport) add( rep *fileReport ) error {
+    var mode, entropy, precision, width, height, components, subsampling string
+    if len(rep.frames) > 0 {
+        fi := rep.frames[0]
+        mode, entropy = encodingModeName( fi.Mode ), entropyCodingName( fi.Entropy )
+        precision = strconv.Itoa( int(fi.SampleSize) )
+        width, height = strconv.Itoa( int(fi.Width) ), strconv.Itoa( int(fi.Height) )
+        components = strconv.Itoa( len(fi.Components) )
+    } else if len(rep.structure) > 0 {
+        f := rep.structure[0]
+        mode, entropy = f.encodingMode(), f.entropyCoding()
+        precision = strconv.Itoa( f.precision )
+        width, height = strconv.Itoa( f.width ), strconv.Itoa( f.height )
+        components = strconv.Itoa( len(f.components) )
+    }
+    if len(rep.structure) > 0 {
+        subsampling = subsamplingEnum( rep.structure[0].h, rep.structure[0].v )
+    }
+    modified := ""
+    if ! rep.modified.IsZero() {
+        modified = rep.modified.Format( time.RFC3339 )
+    }
+    outputSize := ""
+    if rep.output != "" {
+        outputSize = strconv.Itoa( rep.outputSize )
+    }
+    var luma, highlights, shadows, flags string
+    if ei := rep.exposure; ei != nil {
+        luma = strconv.FormatFloat( ei.meanLuma, 'f', 1, 64 )
+        highlights = strconv.FormatFloat( ei.highlights, 'f', 2, 64 )
+        shadows = strconv.FormatFloat( ei.shadows, 'f', 2, 64 )
+        flags = strings.Join( ei.flags, ";" )
+    }
+    var variance, blurred string
+    if si := rep.sharpness; si != nil {
+        variance = strconv.FormatFloat( si.variance, 'f', 1, 64 )
+        blurred = strconv.FormatBool( si.blurred )
+    }
+    counts := severityCounts( rep )
+    return cr.w.Write( []string{ strconv.Itoa( rep.index ), rep.path,
+                                 strconv.FormatInt( rep.size, 10 ), modified,
+                                 xmlStatus( rep ),
+                                 strconv.FormatBool( rep.complete ),
+                                 strconv.FormatBool( rep.failed ),
+                                 mode, entropy, precision, width, height,
+                                 components, subsampling,
+                                 strconv.Itoa( counts[fatalSeverity] ),
+                                 strconv.Itoa( counts[errorSeverity] ),
+                                 strconv.Itoa( counts[warningSeverity] ),
+                                 strconv.Itoa( counts[infoSeverity] ),
+                                 firstMessage( rep ), rep.output,
+                                 outputSize, luma, highlights, shadows,
+                                 flags, variance, blurred } )
+}
+
+func (cr *csvReport) close( ) error {
+    cr.w.Flush()
+    if err := cr.w.Error(); err != nil {
+        cr.f.Close()
+        return err
+    }
+    return cr.f.Close()
+}
@@ -0,0 +1,947 @@
+
+package main
+
+import (
+    "fmt"
+    "math"
+)
+
+// Coefficient decoder: the library decodes scans internally but does not give
+// access to DCT coefficients or to the number of bits used for each of them.
+// This is a minimal decoder for sequential and progressive frames, Huffman
+// coded or arithmetic coded (see arithdec.go), working on the raw layout,
+// which gives access to the quantized coefficients of each block and to bit
+// statistics for analyses based on the compressed data.
+
+var zigZag = [64]int{
+     0,  1,  8, 16,  9,  2,  3, 10,
+    17, 24, 32, 25, 18, 11,  4,  5,
+    12, 19, 26, 33, 40, 48, 41, 34,
+    27, 20, 13,  6,  7, 14, 21, 28,
+    35, 42, 49, 56, 57, 50, 43, 36,
+    29, 22, 15, 23, 30, 37, 44, 51,
+    58, 59, 52, 45, 38, 31, 39, 46,
+    53, 60, 61, 54, 47, 55, 62, 63 }
+
+type frameComp struct {
+    id              byte
+    h, v            int     // sampling factors
+    tq              int     // quantization table selector
+}
+
+type frameHeader struct {
+    marker          byte
+    precision       int
+    height, width   int
+    comps           []frameComp
+    hMax, vMax      int
+}
+
+// maxFrameBlocks is the largest number of blocks, for all components, of a
+// frame given to the coefficient decoder: 4M blocks of 256 bytes, that is 1GB
+// of coefficients, or about 170M pixels with 4:2:0 subsampling. A corrupt
+// header could otherwise declare a frame of 65535x65535 pixels, whose
+// allocation would exhaust the memory, which cannot be recovered from.
+const maxFrameBlocks = 1 << 22
+
+// parseFrameHeader returns the frame header in segment s of data, after
+// checking that its dimensions, sampling factors and quantization table
+// selectors can be used to allocate and decode the frame
+func parseFrameHeader( s *segment, data []byte ) (*frameHeader, error) {
+    d := s.data( data )
+    if len(d) < 6 {
+        return nil, fmt.Errorf( "frame header is too short\n" )
+    }
+    fh := &frameHeader{ marker: s.marker, precision: int(d[0]),
+                        height: int(d[1]) << 8 + int(d[2]),
+                        width: int(d[3]) << 8 + int(d[4]) }
+    if fh.width == 0 {
+        return nil, fmt.Errorf( "invalid frame width 0\n" )
+    }
+    if fh.height == 0 {
+        return nil, fmt.Errorf( "frames with number of lines defined by DNL " +
+                                "are not supported\n" )
+    }
+    n := int(d[5])
+    if len(d) < 6 + 3 * n || n == 0 {
+        return nil, fmt.Errorf( "frame header is too short for %d " +
+                                "components\n", n )
+    }
+    for i := 0; i < n; i++ {
+        c := frameComp{ id: d[6+3*i], h: int(d[7+3*i] >> 4),
+                        v: int(d[7+3*i] & 0x0f), tq: int(d[8+3*i]) }
+        if c.h == 0 || c.v == 0 || c.h > 4 || c.v > 4 {
+            return nil, fmt.Errorf( "invalid sampling factors for component " +
+                                    "%d\n", c.id )
+        }
+        if c.tq > 3 {
+            return nil, fmt.Errorf( "invalid quantization table %d for " +
+                                    "component %d\n", c.tq, c.id )
+        }
+        if c.h > fh.hMax { fh.hMax = c.h }
+        if c.v > fh.vMax { fh.vMax = c.v }
+        fh.comps = append( fh.comps, c )
+    }
+    nx, ny := fh.mcus()
+    blocks := 0
+    for _, c := range fh.comps {
+        blocks += nx * c.h * ny * c.v
+    }
+    if blocks > maxFrameBlocks {
+        return nil, fmt.Errorf( "frame of %dx%d pixels is too large (%d " +
+                                "blocks, at most %d)\n", fh.width, fh.height,
+                                blocks, maxFrameBlocks )
+    }
+    return fh, nil
+}
+
+// mcus returns the number of MCUs per row and of MCU rows in interleaved scans
+func (fh *frameHeader) mcus( ) (nx, ny int) {
+    nx = ( fh.width + 8 * fh.hMax - 1 ) / ( 8 * fh.hMax )
+    ny = ( fh.height + 8 * fh.vMax - 1 ) / ( 8 * fh.vMax )
+    return
+}
+
+// compBlocks returns the number of blocks per row and per column actually
+// covering the image for component ci (used in non-interleaved scans)
+func (fh *frameHeader) compBlocks( ci int ) (bx, by int) {
+    c := &fh.comps[ci]
+    cw := ( fh.width * c.h + fh.hMax - 1 ) / fh.hMax
+    ch := ( fh.height * c.v + fh.vMax - 1 ) / fh.vMax
+    return ( cw + 7 ) / 8, ( ch + 7 ) / 8
+}
+
+// Huffman codes up to huffLookupBits long, which are most codes in practice,
+// are decoded with a single lookup of the next huffLookupBits bits, longer
+// codes are decoded bit by bit from the code limits. Lookup can be disabled
+// to measure its effect (BenchmarkHuffman).
+const huffLookupBits = 9
+
+var huffLookup = true
+
+type huffTable struct {
+    counts          [17]int
+    symbols         []byte
+    maxCode         [18]int32
+    valPtr          [17]int32
+    minCode         [17]int32
+    lookup          [1 << huffLookupBits]uint16 // symbol << 8 | length, or 0
+}
+
+func newHuffTable( counts []byte, symbols []byte ) *huffTable {
+    ht := &huffTable{ symbols: symbols }
+    code, k := int32(0), int32(0)
+    for l := 1; l <= 16; l++ {
+        ht.counts[l] = int(counts[l-1])
+        ht.valPtr[l] = k
+        ht.minCode[l] = code
+        code += int32(ht.counts[l])
+        k += int32(ht.counts[l])
+        if ht.counts[l] > 0 {
+            ht.maxCode[l] = code - 1
+        } else {
+            ht.maxCode[l] = -1
+        }
+        code <<= 1
+    }
+    ht.maxCode[17] = 0x7fffffff
+    for l := 1; l <= huffLookupBits; l++ {
+        for i := 0; i < ht.counts[l]; i++ {
+            code := int(ht.minCode[l]) + i
+            if code >= 1 << l {         // invalid table
+                return ht
+            }
+            e := uint16(symbols[int(ht.valPtr[l]) + i]) << 8 | uint16(l)
+            first := code << ( huffLookupBits - l )
+            for j := 0; j < 1 << ( huffLookupBits - l ); j++ {
+                ht.lookup[first + j] = e
+            }
+        }
+    }
+    return ht
+}
+
+type quantTable struct {
+    precision       int         // 0 for 8 bits, 1 for 16 bits
+    values          [64]uint16  // in zigzag order
+}
+
+// tables in force at some point in the file
+type codingTables struct {
+    quant           [4]*quantTable
+    dc, ac          [4]*huffTable
+    restart         int
+    cond            [2][4]byte  // arithmetic conditioning, DC and AC (DAC)
+    condSet         [2][4]bool  // false for the default conditioning
+}
+
+func (ct *codingTables) defineQuantization( d []byte ) error {
+    for len(d) > 0 {
+        pq, tq := int(d[0] >> 4), int(d[0] & 0x0f)
+        size := 64 * ( pq + 1 )
+        if tq >= len(ct.quant) || pq > 1 || len(d) < 1 + size {
+            return fmt.Errorf( "invalid DQT segment\n" )
+        }
+        qt := &quantTable{ precision: pq }
+        for i := 0; i < 64; i++ {
+            if pq == 0 {
+                qt.values[i] = uint16(d[1+i])
+            } else {
+                qt.values[i] = uint16(d[1+2*i]) << 8 + uint16(d[2+2*i])
+            }
+        }
+        ct.quant[tq] = qt
+        d = d[1+size:]
+    }
+    return nil
+}
+
+func (ct *codingTables) defineHuffman( d []byte ) error {
+    for len(d) > 0 {
+        if len(d) < 17 {
+            return fmt.Errorf( "invalid DHT segment\n" )
+        }
+        tc, th := int(d[0] >> 4), int(d[0] & 0x0f)
+        n := 0
+        for _, c := range d[1:17] {
+            n += int(c)
+        }
+        if tc > 1 || th >= len(ct.dc) || len(d) < 17 + n {
+            return fmt.Errorf( "invalid DHT segment\n" )
+        }
+        ht := newHuffTable( d[1:17], d[17:17+n] )
+        if tc == 0 {
+            ct.dc[th] = ht
+        } else {
+            ct.ac[th] = ht
+        }
+        d = d[17+n:]
+    }
+    return nil
+}
+
+// defineConditioning records the arithmetic conditioning tables of a DAC
+// segment: for DC tables the bounds L and U of the small difference
+// category, in the low and high nibbles, for AC tables the limit Kx of the
+// low frequency band (T.81 F.1.4.4)
+func (ct *codingTables) defineConditioning( d []byte ) error {
+    for ; len(d) > 0; d = d[2:] {
+        if len(d) < 2 {
+            return fmt.Errorf( "invalid DAC segment\n" )
+        }
+        tc, tb, cs := int(d[0] >> 4), int(d[0] & 0x0f), d[1]
+        if tc > 1 || tb >= len(ct.cond[0]) ||
+           ( tc == 0 && cs & 0x0f > cs >> 4 ) ||
+           ( tc == 1 && ( cs == 0 || cs > 63 ) ) {
+            return fmt.Errorf( "invalid DAC segment\n" )
+        }
+        ct.cond[tc][tb], ct.condSet[tc][tb] = cs, true
+    }
+    return nil
+}
+
+// conditioning returns the arithmetic conditioning value of table t of class
+// (0 for DC, 1 for AC), by default L=0 and U=1 for DC and Kx=5 for AC
+func (ct *codingTables) conditioning( class, t int ) byte {
+    switch {
+    case ct.condSet[class][t]:
+        return ct.cond[class][t]
+    case class == 0:
+        return 0x10
+    }
+    return 5
+}
+
+// bit reader over entropy-coded data, handling stuffed bytes and stopping at
+// markers
+type bitReader struct {
+    data            []byte
+    pos             int
+    acc             uint32
+    nBits           uint
+    marker          bool    // a marker was reached
+    padBits         uint    // zero bits added after the marker or the end
+    consumed        int64   // bits consumed
+    codes           int64   // Huffman codes decoded
+    lookupCodes     int64   // Huffman codes decoded by lookup
+}
+
+func (br *bitReader) fill( ) {
+    for br.nBits <= 24 {
+        var b byte
+        if ! br.marker && br.pos < len(br.data) {
+            b = br.data[br.pos]
+            if b == 0xff {
+                if br.pos + 1 < len(br.data) && br.data[br.pos+1] == 0x00 {
+                    br.pos += 2
+                } else {
+                    br.marker = true
+                    b = 0
+                    br.padBits += 8
+                }
+            } else {
+                br.pos ++
+            }
+        } else {
+            br.padBits += 8
+        }
+        br.acc |= uint32(b) << ( 24 - br.nBits )
+        br.nBits += 8
+    }
+}
+
+func (br *bitReader) bits( n uint ) int32 {
+    if n == 0 {
+        return 0
+    }
+    br.fill()
+    v := int32( br.acc >> ( 32 - n ) )
+    br.acc <<= n
+    br.nBits -= n
+    br.consumed += int64(n)
+    return v
+}
+
+// unusedBits returns the number of bits of entropy-coded data not consumed
+// before the next marker, or minus the number of bits consumed beyond it
+func (br *bitReader) unusedBits( ) int {
+    n := int(br.nBits) - int(br.padBits)
+    if n < 0 {
+        return n
+    }
+    for i := br.pos; i < len(br.data); i++ {
+        if br.data[i] == 0xff && i + 1 < len(br.data) {
+            if br.data[i+1] == 0xff {
+                continue                // fill byte
+            }
+            if br.data[i+1] != 0x00 {
+                break                   // marker
+            }
+            i++
+        }
+        n += 8
+    }
+    return n
+}
+
+// skipToRestart returns the position following the RSTn marker expected
+// after the entropy-coded data at pos in data
+func skipToRestart( data []byte, pos int ) (int, error) {
+    for pos + 1 < len(data) {           // skip remaining padding bits
+        if data[pos] == 0xff && data[pos+1] != 0x00 && data[pos+1] != 0xff {
+            break
+        }
+        pos ++
+    }
+    if pos + 1 >= len(data) || data[pos] != 0xff ||
+       data[pos+1] < markerRST0 || data[pos+1] > markerRST7 {
+        return pos, fmt.Errorf( "missing RST marker @0x%x\n", pos )
+    }
+    return pos + 2, nil
+}
+
+// restart skips to the RSTn marker expected at the end of a restart interval
+func (br *bitReader) restart( ) (err error) {
+    br.acc, br.nBits, br.marker, br.padBits = 0, 0, false, 0
+    br.pos, err = skipToRestart( br.data, br.pos )
+    return
+}
+
+// rstNumber returns the number n of the RSTn marker skipped by restart
+func (br *bitReader) rstNumber( ) int {
+    return int(br.data[br.pos-1] - markerRST0)
+}
+
+func (br *bitReader) decode( ht *huffTable ) (byte, uint, error) {
+    br.codes ++
+    if huffLookup {
+        br.fill()
+        if e := ht.lookup[br.acc >> ( 32 - huffLookupBits )]; e != 0 {
+            l := uint(e & 0xff)
+            br.acc <<= l
+            br.nBits -= l
+            br.consumed += int64(l)
+            br.lookupCodes ++
+            return byte(e >> 8), l, nil
+        }
+    }
+    code := br.bits( 1 )
+    l := 1
+    for ; l <= 16 && code > ht.maxCode[l]; l++ {
+        code = code << 1 | br.bits( 1 )
+    }
+    if l > 16 {
+        return 0, 16, fmt.Errorf( "invalid Huffman code @0x%x\n", br.pos )
+    }
+    return ht.symbols[ht.valPtr[l] + code - ht.minCode[l]], uint(l), nil
+}
+
+func extend( v int32, t uint ) int32 {
+    if t > 0 && v < 1 << ( t - 1 ) {
+        return v - ( 1 << t ) + 1
+    }
+    return v
+}
+
+type block [64]int32            // coefficients in natural order
+
+type compCoefs struct {
+    bx, by          int         // blocks per row and column (storage)
+    blocks          []block
+    tq              int
+    dcBits, acBits  int64       // bits used for DC and AC coefficients
+    complete        [64]bool    // coefficients with all bits decoded (zigzag)
+}
+
+func (cc *compCoefs) at( x, y int ) *block {
+    return &cc.blocks[y * cc.bx + x]
+}
+
+type coefImage struct {
+    frame           *frameHeader
+    comps           []compCoefs
+    quant           [4]*quantTable
+    nScans          int
+    restarts        int         // number of RSTn markers found
+    issues          []string    // entropy-coded data inconsistencies
+    codes           int64       // Huffman codes decoded
+    lookupCodes     int64       // Huffman codes decoded by lookup
+}
+
+// scan decoding state
+type scanDecoder struct {
+    img             *coefImage
+    br              *bitReader
+    dc, ac          []*huffTable
+    comps           []int       // frame component indexes in scan
+    pred            []int32
+    ss, se          int
+    ah, al          int         // successive approximation
+    eobRun          int         // remaining blocks in an EOB run
+}
+
+func (sd *scanDecoder) decodeBlock( sci int, b *block, cc *compCoefs ) error {
+    sym, l, err := sd.br.decode( sd.dc[sci] )
+    if err != nil {
+        return err
+    }
+    t := uint(sym)
+    if t > 16 {
+        return fmt.Errorf( "invalid DC magnitude %d\n", t )
+    }
+    diff := extend( sd.br.bits( t ), t )
+    sd.pred[sci] += diff
+    b[0] = sd.pred[sci]
+    cc.dcBits += int64(l + t)
+
+    for k := 1; k < 64; {
+        sym, l, err = sd.br.decode( sd.ac[sci] )
+        if err != nil {
+            return err
+        }
+        r, s := int(sym >> 4), uint(sym & 0x0f)
+        cc.acBits += int64(l + s)
+        if s == 0 {
+            if r != 15 {
+                break           // EOB
+            }
+            k += 16
+            continue
+        }
+        k += r
+        if k > 63 {
+            return fmt.Errorf( "coefficient index overrun (%d)\n", k )
+        }
+        b[zigZag[k]] = extend( sd.br.bits( s ), s )
+        k ++
+    }
+    return nil
+}
+
+// decodeDCFirst decodes the first DC scan of a progressive frame for a block
+func (sd *scanDecoder) decodeDCFirst( sci int, b *block ) error {
+    sym, _, err := sd.br.decode( sd.dc[sci] )
+    if err != nil {
+        return err
+    }
+    t := uint(sym)
+    if t > 16 {
+        return fmt.Errorf( "invalid DC magnitude %d\n", t )
+    }
+    sd.pred[sci] += extend( sd.br.bits( t ), t )
+    b[0] = sd.pred[sci] << sd.al
+    return nil
+}
+
+// decodeACFirst decodes the first AC scan of a progressive frame for a block
+func (sd *scanDecoder) decodeACFirst( b *block ) error {
+    if sd.eobRun > 0 {
+        sd.eobRun --
+        return nil
+    }
+    for k := sd.ss; k <= sd.se; {
+        sym, _, err := sd.br.decode( sd.ac[0] )
+        if err != nil {
+            return err
+        }
+        r, s := int(sym >> 4), uint(sym & 0x0f)
+        if s == 0 {
+            if r != 15 {
+                sd.eobRun = 1 << r - 1 + int(sd.br.bits( uint(r) ))
+                break
+            }
+            k += 16
+            continue
+        }
+        k += r
+        if k > sd.se {
+            return fmt.Errorf( "coefficient index overrun (%d)\n", k )
+        }
+        b[zigZag[k]] = extend( sd.br.bits( s ), s ) << sd.al
+        k ++
+    }
+    return nil
+}
+
+// refine adds a correction bit to a coefficient already not zero
+func (sd *scanDecoder) refine( c *int32 ) {
+    p1 := int32(1) << sd.al
+    if sd.br.bits( 1 ) == 1 && *c & p1 == 0 {
+        if *c >= 0 {
+            *c += p1
+        } else {
+            *c -= p1
+        }
+    }
+}
+
+// decodeACRefine decodes a refinement AC scan of a progressive frame for a
+// block
+func (sd *scanDecoder) decodeACRefine( b *block ) error {
+    k := sd.ss
+    if sd.eobRun == 0 {
+        for ; k <= sd.se; k++ {
+            sym, _, err := sd.br.decode( sd.ac[0] )
+            if err != nil {
+                return err
+            }
+            r, s := int(sym >> 4), uint(sym & 0x0f)
+            var z int32
+            if s == 0 {
+                if r != 15 {
+                    sd.eobRun = 1 << r + int(sd.br.bits( uint(r) ))
+                    break
+                }
+            } else {
+                if s != 1 {
+                    return fmt.Errorf( "invalid AC refinement magnitude %d\n", s )
+                }
+                z = int32(1) << sd.al
+                if sd.br.bits( 1 ) == 0 {
+                    z = -z
+                }
+            }
+            for ; k <= sd.se; k++ {     // skip r zero coefficients
+                c := &b[zigZag[k]]
+                if *c != 0 {
+                    sd.refine( c )
+                } else {
+                    if r == 0 {
+                        break
+                    }
+                    r --
+                }
+            }
+            if z != 0 {
+                if k > sd.se {
+                    return fmt.Errorf( "coefficient index overrun (%d)\n", k )
+                }
+                b[zigZag[k]] = z
+            }
+        }
+    }
+    if sd.eobRun > 0 {
+        for ; k <= sd.se; k++ {
+            if c := &b[zigZag[k]]; *c != 0 {
+                sd.refine( c )
+            }
+        }
+        sd.eobRun --
+    }
+    return nil
+}
+
+// decodeProgressive decodes the data of a block in a progressive scan,
+// counting the bits used as DC or AC bits according to the scan
+func (sd *scanDecoder) decodeProgressive( sci int, b *block,
+                                          cc *compCoefs ) (err error) {
+    before := sd.br.consumed
+    switch {
+    case sd.ss == 0 && sd.ah == 0:
+        err = sd.decodeDCFirst( sci, b )
+    case sd.ss == 0:
+        if sd.br.bits( 1 ) == 1 {
+            b[0] |= 1 << sd.al
+        }
+    case sd.ah == 0:
+        err = sd.decodeACFirst( b )
+    default:
+        err = sd.decodeACRefine( b )
+    }
+    if sd.ss == 0 {
+        cc.dcBits += sd.br.consumed - before
+    } else {
+        cc.acBits += sd.br.consumed - before
+    }
+    return
+}
+
+// checkAlignment records an issue if the entropy-coded data before the next
+// marker was not entirely used or was too short, after a restart interval or
+// at the end of a scan.
+func (sd *scanDecoder) checkAlignment( where string ) {
+    switch n := sd.br.unusedBits(); {
+    case n < 0:
+        sd.img.issues = append( sd.img.issues, fmt.Sprintf(
+            "entropy-coded data too short by %d bits %s\n", -n, where ) )
+    case n >= 8:
+        sd.img.issues = append( sd.img.issues, fmt.Sprintf(
+            "%d bytes of unused entropy-coded data %s\n", n / 8, where ) )
+    }
+}
+
+// scanComponents returns the number of components of the scan header sos,
+// after checking that sos is long enough for them
+func scanComponents( sos []byte ) (int, error) {
+    if len(sos) < 1 {
+        return 0, fmt.Errorf( "invalid SOS header\n" )
+    }
+    ns := int(sos[0])
+    if len(sos) < 1 + 2 * ns + 3 || ns == 0 {
+        return 0, fmt.Errorf( "invalid SOS header\n" )
+    }
+    return ns, nil
+}
+
+// decodeScan decodes the entropy-coded data of a sequential or progressive
+// scan starting at offset in data.
+func (img *coefImage) decodeScan( data []byte, offset int, sos []byte,
+                                  ct *codingTables ) error {
+    fh := img.frame
+    ns, err := scanComponents( sos )
+    if err != nil {
+        return err
+    }
+    sd := &scanDecoder{ img: img, br: &bitReader{ data: data, pos: offset },
+                        pred: make( []int32, ns ) }
+    defer func( ) {
+        img.codes += sd.br.codes
+        img.lookupCodes += sd.br.lookupCodes
+    }()
+    sd.ss, sd.se = int(sos[1+2*ns]), int(sos[2+2*ns])
+    sd.ah, sd.al = int(sos[3+2*ns] >> 4), int(sos[3+2*ns] & 0x0f)
+    progressive := fh.marker == markerSOF0 + 2
+    if progressive {
+        if sd.se > 63 || sd.ss > sd.se || ( sd.ss == 0 && sd.se != 0 ) ||
+           ( sd.ss > 0 && ns != 1 ) || sd.al > 13 {
+            return fmt.Errorf( "invalid progressive scan parameters\n" )
+        }
+    } else if sd.ss != 0 || sd.se != 63 || sos[3+2*ns] != 0 {
+        return fmt.Errorf( "spectral selection or successive approximation " +
+                           "in a sequential frame\n" )
+    }
+    for i := 0; i < ns; i++ {
+        id, tables := sos[1+2*i], sos[2+2*i]
+        ci := -1
+        for j, c := range fh.comps {
+            if c.id == id {
+                ci = j
+            }
+        }
+        if ci == -1 {
+            return fmt.Errorf( "unknown component id %d in scan\n", id )
+        }
+        dc, ac := ct.dc[tables >> 4 & 3], ct.ac[tables & 3]
+        if ( dc == nil && ( ! progressive || ( sd.ss == 0 && sd.ah == 0 ) ) ) ||
+           ( ac == nil && ( ! progressive || sd.ss > 0 ) ) {
+            return fmt.Errorf( "missing Huffman table for component %d\n", id )
+        }
+        sd.comps = append( sd.comps, ci )
+        sd.dc = append( sd.dc, dc )
+        sd.ac = append( sd.ac, ac )
+    }
+
+    decode := func( sci int, b *block, cc *compCoefs ) error {
+        if progressive {
+            return sd.decodeProgressive( sci, b, cc )
+        }
+        return sd.decodeBlock( sci, b, cc )
+    }
+    var nx, ny int
+    if ns == 1 {
+        nx, ny = fh.compBlocks( sd.comps[0] )
+    } else {
+        nx, ny = fh.mcus()
+    }
+    mcu := 0
+    for my := 0; my < ny; my++ {
+        for mx := 0; mx < nx; mx++ {
+            if ct.restart > 0 && mcu > 0 && mcu % ct.restart == 0 {
+                sd.checkAlignment( fmt.Sprintf( "before MCU %d", mcu ) )
+                if err := sd.br.restart(); err != nil {
+                    return err
+                }
+                if n := sd.br.rstNumber(); n != ( mcu / ct.restart - 1 ) % 8 {
+                    img.issues = append( img.issues, fmt.Sprintf(
+                        "RST%d marker found instead of RST%d before MCU %d\n",
+                        n, ( mcu / ct.restart - 1 ) % 8, mcu ) )
+                }
+                img.restarts ++
+                for i := range sd.pred {
+                    sd.pred[i] = 0
+                }
+                sd.eobRun = 0
+            }
+            for sci, ci := range sd.comps {
+                cc := &img.comps[ci]
+                c := &fh.comps[ci]
+                if ns == 1 {
+                    if err := decode( sci, cc.at( mx, my ), cc ); err != nil {
+                        return fmt.Errorf( "MCU %d: %v", mcu, err )
+                    }
+                    continue
+                }
+                for v := 0; v < c.v; v++ {
+                    for h := 0; h < c.h; h++ {
+                        b := cc.at( mx * c.h + h, my * c.v + v )
+                        if err := decode( sci, b, cc ); err != nil {
+                            return fmt.Errorf( "MCU %d: %v", mcu, err )
+                        }
+                    }
+                }
+            }
+            mcu ++
+        }
+    }
+    sd.checkAlignment( fmt.Sprintf( "at the end of scan %d", img.nScans + 1 ) )
+    for _, ci := range sd.comps {
+        for k := sd.ss; k <= sd.se && sd.al == 0; k++ {
+            img.comps[ci].complete[k] = true
+        }
+    }
+    img.nScans ++
+    return nil
+}
+
+// newCoefImage returns an image with all coefficients of frame fh set to 0
+func newCoefImage( fh *frameHeader ) *coefImage {
+    img := &coefImage{ frame: fh }
+    nx, ny := fh.mcus()
+    img.comps = make( []compCoefs, len(fh.comps) )
+    for ci, c := range fh.comps {
+        cc := &img.comps[ci]
+        cc.bx, cc.by = nx * c.h, ny * c.v
+        cc.blocks = make( []block, cc.bx * cc.by )
+        cc.tq = c.tq
+    }
+    return img
+}
+
+// decodeCoefficients decodes all DCT coefficients of the first frame in the
+// jpeg data. Only sequential and progressive frames, Huffman or arithmetic
+// coded, are supported.
+func decodeCoefficients( data []byte, l *fileLayout ) (*coefImage, error) {
+    return decodeFrame( data, l, nil )
+}
+
+// decodeFrame decodes the coefficients of the first frame in data, printing
+// the MCUs of arithmetic coded scans in mt if it is not nil
+func decodeFrame( data []byte, l *fileLayout, mt *mcuTrace ) (*coefImage,
+                                                              error) {
+    var ct codingTables
+    var img *coefImage
+    for i := range l.segments {
+        s := &l.segments[i]
+        var err error
+        switch {
+        case s.marker == markerDQT:
+            err = ct.defineQuantization( s.data( data ) )
+        case s.marker == markerDHT:
+            err = ct.defineHuffman( s.data( data ) )
+        case s.marker == markerDAC:
+            err = ct.defineConditioning( s.data( data ) )
+        case s.marker == markerDRI:
+            if d := s.data( data ); len(d) >= 2 {
+                ct.restart = int(d[0]) << 8 + int(d[1])
+            }
+        case isSOF( s.marker ):
+            if img != nil {
+                return img, nil         // only the first frame is decoded
+            }
+            if s.marker != markerSOF0 && s.marker != markerSOF0 + 1 &&
+               s.marker != markerSOF0 + 2 && s.marker != markerSOF0 + 9 &&
+               s.marker != markerSOF0 + 10 {
+                return nil, fmt.Errorf( "%s frames are not supported by the " +
+                                        "coefficient decoder\n",
+                                        markerName( s.marker ) )
+            }
+            var fh *frameHeader
+            if fh, err = parseFrameHeader( s, data ); err != nil {
+                return nil, err
+            }
+            img = newCoefImage( fh )
+        case s.marker == markerSOS:
+            if img == nil {
+                return nil, fmt.Errorf( "scan without frame\n" )
+            }
+            img.quant = ct.quant
+            if isArithmetic( img.frame.marker ) {
+                err = img.decodeArithmeticScan( data, s.end(), s.data( data ),
+                                                &ct, mt )
+            } else {
+                err = img.decodeScan( data, s.end(), s.data( data ), &ct )
+            }
+        case s.marker == markerEOI:
+            if img != nil {
+                return img, nil
+            }
+        }
+        if err != nil {
+            return img, err
+        }
+    }
+    if img == nil {
+        return nil, fmt.Errorf( "no frame\n" )
+    }
+    return img, nil
+}
+
+// dctBasis[x][u] is C(u)/2 * cos((2x+1)u.pi/16), so that the jpeg 8x8 DCT and
+// IDCT are computed as two separable 1D transforms
+var dctBasis [8][8]float64
+
+// dctMatrix and dctMatrixT are dctBasis and its transpose in row order, for
+// simdMatMul8
+var dctMatrix, dctMatrixT [64]float64
+
+func init( ) {
+    for x := 0; x < 8; x++ {
+        for u := 0; u < 8; u++ {
+            c := 0.5
+            if u == 0 {
+                c = 0.5 / math.Sqrt2
+            }
+            dctBasis[x][u] = c * math.Cos( float64(2 * x + 1) * float64(u) *
+                                           math.Pi / 16 )
+            dctMatrix[x*8+u] = dctBasis[x][u]
+            dctMatrixT[u*8+x] = dctBasis[x][u]
+        }
+    }
+}
+
+// idct computes the samples (without level shift) from the dequantized
+// coefficients, both in natural order
+func idct( in *[64]float64, out *[64]float64 ) {
+    var tmp [64]float64
+    if simdMatMul8 != nil {
+        simdMatMul8( in, &dctMatrixT, &tmp )
+        simdMatMul8( &dctMatrix, &tmp, out )
+        return
+    }
+    for v := 0; v < 8; v++ {            // rows: u -> x
+        for x := 0; x < 8; x++ {
+            var s float64
+            for u := 0; u < 8; u++ {
+                s += dctBasis[x][u] * in[v*8+u]
+            }
+            tmp[v*8+x] = s
+        }
+    }
+    for x := 0; x < 8; x++ {            // columns: v -> y
+        for y := 0; y < 8; y++ {
+            var s float64
+            for v := 0; v < 8; v++ {
+                s += dctBasis[y][v] * tmp[v*8+x]
+            }
+            out[y*8+x] = s
+        }
+    }
+}
+
+// fdct computes the coefficients from the samples (without level shift), both
+// in natural order
+func fdct( in *[64]float64, out *[64]float64 ) {
+    if simdMatMul8 != nil {
+        var tmp [64]float64
+        simdMatMul8( in, &dctMatrix, &tmp )
+        simdMatMul8( &dctMatrixT, &tmp, out )
+        return
+    }
+    portableFdct( in, out )
+}
+
+// portableFdct is fdct without SIMD, for encoding: the files that jcheck
+// generates must be the same on all processors
+func portableFdct( in *[64]float64, out *[64]float64 ) {
+    var tmp [64]float64
+    for y := 0; y < 8; y++ {            // rows: x -> u
+        for u := 0; u < 8; u++ {
+            var s float64
+            for x := 0; x < 8; x++ {
+                s += dctBasis[x][u] * in[y*8+x]
+            }
+            tmp[y*8+u] = s
+        }
+    }
+    for u := 0; u < 8; u++ {            // columns: y -> v
+        for v := 0; v < 8; v++ {
+            var s float64
+            for y := 0; y < 8; y++ {
+                s += dctBasis[y][v] * tmp[y*8+u]
+            }
+            out[v*8+u] = s
+        }
+    }
+}
+
+// plane is a component reconstructed at its own resolution
+type plane struct {
+    width, height   int
+    samples         []float64
+}
+
+func (p *plane) at( x, y int ) float64 {
+    return p.samples[y * p.width + x]
+}
+
+// componentPlane reconstructs the samples of component ci, cropped to the
+// component dimensions. Samples are level shifted but not clamped.
+func (img *coefImage) componentPlane( ci int ) (*plane, error) {
+    fh := img.frame
+    cc := &img.comps[ci]
+    qt := img.quant[cc.tq]
+    if qt == nil {
+        return nil, fmt.Errorf( "missing quantization table %d\n", cc.tq )
+    }
+    c := &fh.comps[ci]
+    p := &plane{ width: ( fh.width * c.h + fh.hMax - 1 ) / fh.hMax,
+                 height: ( fh.height * c.v + fh.vMax - 1 ) / fh.vMax }
+    p.samples = make( []float64, p.width * p.height )
+    shift := float64(int(1) << (fh.precision - 1))
+    var in, out [64]float64
+    for by := 0; by * 8 < p.height; by++ {
+        for bx := 0; bx * 8 < p.width; bx++ {
+            b := cc.at( bx, by )
+            for k := 0; k < 64; k++ {
+                in[zigZag[k]] = float64(b[zigZag[k]]) * float64(qt.values[k])
+            }
+            idct( &in, &out )
+            for y := 0; y < 8 && by * 8 + y < p.height; y++ {
+                for x := 0; x < 8 && bx * 8 + x < p.width; x++ {
+                    p.samples[(by*8+y) * p.width + bx*8+x] = out[y*8+x] + shift
+                }
+            }
+        }
+    }
+    return p, nil
+}
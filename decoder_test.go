@@ -0,0 +1,133 @@
+package main
+
+import (
+    "testing"
+)
+
+// testsetData returns the generated data of the valid test set file name
+func testsetData( t testing.TB, name string ) []byte {
+    t.Helper()
+    for i := range testsetSpecs {
+        spec := &testsetSpecs[i]
+        if spec.name != name || spec.breaks != nil {
+            continue
+        }
+        data, _, err := generateTestFile( spec, 75 )
+        if err != nil {
+            t.Fatalf( "%s: %v", name, err )
+        }
+        return data
+    }
+    t.Fatalf( "no valid test set file %s", name )
+    return nil
+}
+
+// decodeCorrupt decodes data, which must be rejected with an error
+func decodeCorrupt( t *testing.T, data []byte ) {
+    t.Helper()
+    defer func( ) {
+        if r := recover(); r != nil {
+            t.Fatalf( "decoder panic: %v", r )
+        }
+    }()
+    if _, err := decodeCoefficients( data, scanLayout( data ) ); err == nil {
+        t.Fatalf( "corrupt data decoded without error" )
+    }
+}
+
+func TestCorruptFrameHeader( t *testing.T ) {
+    tests := []struct {
+        name    string
+        offset  int     // in the SOF content
+        value   []byte
+    }{
+        { "huge frame", 1, []byte{ 0xff, 0xff, 0xff, 0xff } },
+        { "zero width", 3, []byte{ 0, 0 } },
+        { "zero height", 1, []byte{ 0, 0 } },
+        { "quantization table 48", 8, []byte{ 48 } },
+        { "sampling factor 0", 7, []byte{ 0x02 } },
+    }
+    for _, tc := range tests {
+        t.Run( tc.name, func( t *testing.T ) {
+            data := testsetData( t, "baseline-420.jpg" )
+            s, err := testsetSegment( data, markerSOF0 )
+            if err != nil {
+                t.Fatal( err )
+            }
+            copy( s.data( data )[tc.offset:], tc.value )
+            decodeCorrupt( t, data )
+        } )
+    }
+}
+
+func TestEmptyScanHeader( t *testing.T ) {
+    for _, name := range []string{ "baseline-420.jpg", "arithmetic-420.jpg" } {
+        t.Run( name, func( t *testing.T ) {
+            data := testsetData( t, name )
+            s, err := testsetSegment( data, markerSOS )
+            if err != nil {
+                t.Fatal( err )
+            }
+            // keep only the segment length, set to 2 for an empty content
+            empty := append( append( []byte( nil ), data[:s.offset+2]... ),
+                             0, 2 )
+            empty = append( empty, data[s.end():]... )
+            decodeCorrupt( t, empty )
+        } )
+    }
+}
+
+// TestRoundTrip encodes each valid file of the test set at several qualities
+// and checks that the decoder finds the coefficients that were encoded
+func TestRoundTrip( t *testing.T ) {
+    for i := range testsetSpecs {
+        spec := &testsetSpecs[i]
+        if spec.breaks != nil {
+            continue
+        }
+        t.Run( spec.name, func( t *testing.T ) {
+            for _, quality := range []int{ 25, 75, 95 } {
+                data, img, err := generateTestFile( spec, quality )
+                if err != nil {
+                    t.Fatalf( "quality %d: %v", quality, err )
+                }
+                if err = verifyTestFile( data, img ); err != nil {
+                    t.Errorf( "quality %d: %v", quality, err )
+                }
+            }
+        } )
+    }
+}
+
+// TestBrokenTestset decodes each broken file of the test set and reconstructs
+// its planes, which must not panic. Whether the file is rejected is checked by
+// TestTestsetManifest, since some faults (missing EOI or DQT) do not prevent
+// decoding the coefficients.
+func TestBrokenTestset( t *testing.T ) {
+    for i := range testsetSpecs {
+        spec := &testsetSpecs[i]
+        if spec.breaks == nil || spec.valid {
+            continue
+        }
+        t.Run( spec.name, func( t *testing.T ) {
+            data, err := spec.breaks( testsetData( t, spec.base ) )
+            if err != nil {
+                t.Fatal( err )
+            }
+            defer func( ) {
+                if r := recover(); r != nil {
+                    t.Fatalf( "decoder panic: %v", r )
+                }
+            }()
+            img, err := decodeCoefficients( data, scanLayout( data ) )
+            if err != nil {
+                return
+            }
+            for ci := range img.comps {
+                if _, err = img.componentPlane( ci ); err != nil {
+                    return
+                }
+            }
+        } )
+    }
+}
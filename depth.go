@@ -0,0 +1,185 @@
+
+package main
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/binary"
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// Depth maps written by phone portrait modes:
+//  - Google GDepth: the depth image is base64 encoded in the GDepth:Data XMP
+//    property, usually in the extended XMP packet.
+//  - Google Dynamic Depth: the depth image is a file appended after the
+//    primary image, described by an item of the Container:Directory XMP list
+//    with the semantic Depth. Items follow each other in list order after the
+//    primary image, each one followed by its padding.
+//  - Apple portrait exports: the depth (or disparity) image is an additional
+//    MPF image, with an XMP packet giving its auxiliary image type.
+
+const (
+    nsGDepth        = "http://ns.google.com/photos/1.0/depthmap/"
+    nsDDItem        = "http://ns.google.com/photos/dd/1.0/item/"
+    nsAppleDepth    = "http://ns.apple.com/depthData/1.0/"
+)
+
+var pngSignature = []byte( "\x89PNG\r\n\x1a\n" )
+
+// setImageInfo sets the format and size of a JPEG or PNG embedded image
+func (ei *embeddedImage) setImageInfo( ) {
+    if ! bytes.HasPrefix( ei.data, pngSignature ) {
+        ei.setJpegInfo()
+        return
+    }
+    ei.format = "PNG"
+    if len(ei.data) >= 24 && string( ei.data[12:16] ) == "IHDR" {
+        ei.width = int( binary.BigEndian.Uint32( ei.data[16:] ) )
+        ei.height = int( binary.BigEndian.Uint32( ei.data[20:] ) )
+    }
+}
+
+// gdepthImages returns the depth images stored in GDepth:Data properties. The
+// other GDepth properties are usually in the main packet and the data in the
+// extended packet.
+func gdepthImages( packets []*xmpPacket ) (images []*embeddedImage) {
+    format := ""
+    for _, p := range packets {
+        for _, r := range xmpResources( p.data ) {
+            if f := r[nsGDepth + " Format"]; f != "" {
+                format = f
+            }
+        }
+    }
+    for _, p := range packets {
+        for _, r := range xmpResources( p.data ) {
+            encoded, ok := r[nsGDepth + " Data"]
+            if ! ok {
+                continue
+            }
+            content, err := base64.StdEncoding.DecodeString( encoded )
+            if err != nil || len(content) == 0 {
+                continue
+            }
+            source := "GDepth XMP"
+            if format != "" {
+                source += " " + format
+            }
+            ei := &embeddedImage{ source: source, offset: p.offset,
+                                  length: len(content), data: content }
+            ei.setImageInfo()
+            images = append( images, ei )
+        }
+    }
+    return
+}
+
+// dynamicDepthImages returns the depth images appended after the primary image
+// as Dynamic Depth container items
+func dynamicDepthImages( data []byte, l *fileLayout,
+                         packets []*xmpPacket ) (images []*embeddedImage) {
+    pos := -1                           // end of the primary image
+    for i := range l.segments {
+        if l.segments[i].marker == markerEOI {
+            pos = l.segments[i].offset + 2
+            break
+        }
+    }
+    if pos == -1 {
+        return
+    }
+    for _, p := range packets {
+        for _, r := range xmpResources( p.data ) {
+            mime, ok := r[nsDDItem + " Mime"]
+            semantic := r[nsDDItem + " Semantic"]
+            if ! ok || semantic == "Primary" {
+                continue
+            }
+            length, _ := strconv.Atoi( r[nsDDItem + " Length"] )
+            padding, _ := strconv.Atoi( r[nsDDItem + " Padding"] )
+            if length <= 0 || pos + length > len(data) {
+                return
+            }
+            if semantic == "Depth" {
+                ei := &embeddedImage{ source: "Dynamic Depth " + mime,
+                                      offset: pos, length: length,
+                                      data: data[pos:pos+length] }
+                ei.setImageInfo()
+                images = append( images, ei )
+            }
+            pos += length + padding
+        }
+    }
+    return
+}
+
+// appleDepthImages returns the MPF images that are Apple depth or disparity
+// auxiliary images
+func appleDepthImages( embedded []*embeddedImage ) (images []*embeddedImage) {
+    for _, mi := range embedded {
+        if ! strings.HasPrefix( mi.id, "mpf" ) || mi.data == nil ||
+           mi.offset == 0 {             // primary image
+            continue
+        }
+        for _, p := range xmpPackets( mi.data, scanLayout( mi.data ) ) {
+            kind := ""
+            for _, r := range xmpResources( p.data ) {
+                for k, v := range r {
+                    if strings.HasSuffix( k, " AuxiliaryImageType" ) &&
+                       ( strings.Contains( v, ":aux:depth" ) ||
+                         strings.Contains( v, ":aux:disparity" ) ) {
+                        kind = v[strings.LastIndex( v, ":" ) + 1:]
+                    }
+                }
+            }
+            if kind == "" && bytes.Contains( p.data, []byte( nsAppleDepth ) ) {
+                kind = "depth"
+            }
+            if kind != "" {
+                ei := &embeddedImage{ source: "Apple " + kind + " (" +
+                                      mi.id + ")", offset: mi.offset,
+                                      length: mi.length, data: mi.data }
+                ei.setImageInfo()
+                images = append( images, ei )
+                break
+            }
+        }
+    }
+    return
+}
+
+// depthImages returns the depth maps found in data, given the other embedded
+// images, with ids depth1, depth2...
+func depthImages( data []byte, l *fileLayout,
+                  embedded []*embeddedImage ) (images []*embeddedImage) {
+    packets := xmpPackets( data, l )
+    images = append( images, gdepthImages( packets )... )
+    images = append( images, dynamicDepthImages( data, l, packets )... )
+    images = append( images, appleDepthImages( embedded )... )
+    for i, ei := range images {
+        ei.id = fmt.Sprintf( "depth%d", i + 1 )
+    }
+    return
+}
+
+// saveDepthMap saves the first depth map found, as stored (JPEG or PNG) or in
+// the format given by outputFormat for path and forced
+func saveDepthMap( images []*embeddedImage, path, forced string ) error {
+    for _, ei := range images {
+        if strings.HasPrefix( ei.id, "depth" ) {
+            content, err := ei.content( outputFormat( path, forced ) )
+            if err != nil {
+                return err
+            }
+            if err = writeFile( path, content, 0644 ); err != nil {
+                return fmt.Errorf( "unable to save depth map: %v\n", err )
+            }
+            fmt.Printf( "Saved depth map %s (%s, %s) as %s, %d bytes\n", ei.id,
+                        ei.source, ei.format, path, len(content) )
+            return nil
+        }
+    }
+    return fmt.Errorf( "no depth map to save\n" )
+}
@@ -0,0 +1,281 @@
+
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "image"
+    "image/draw"
+    stdjpeg "image/jpeg"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// Derivative presets (-derive): publication workflows make the same set of
+// outputs from every master, for instance a 2048 pixel JPEG for the web, a
+// 400 pixel thumbnail and a json metadata document. The set is defined once in
+// a json presets file, for example:
+//  { "derivatives": [
+//      { "name": "web", "path": "{dir}/web/{basename}.jpg",
+//        "size": "maxdim=2048", "quality": 90 },
+//      { "name": "thumb", "path": "{dir}/thumbs/{basename}.jpg",
+//        "size": "maxdim=400", "filter": "catmullrom", "quality": 80 },
+//      { "name": "meta", "path": "{dir}/meta/{basename}.json",
+//        "format": "metadata" } ] }
+// The main picture is decoded only once per file, turned upright according to
+// the Exif orientation, and all pictures are resampled from it. Derivative
+// pictures carry no metadata: they are given in sRGB, which is what decoders
+// assume without an ICC profile. Colors are not converted, so that a file
+// with an ICC profile that is not sRGB is reported.
+
+const defaultDerivativeQuality = 90
+
+var derivativeFormats = []string{ "jpeg", "png", "webp", "metadata" }
+
+type derivativeSpec struct {
+    Name            string      `json:"name"`
+    Path            string      `json:"path"`       // output path template
+    Format          string      `json:"format"`     // default from path
+    Size            string      `json:"size"`       // as -resize
+    Filter          string      `json:"filter"`     // as -resize-filter
+    Quality         int         `json:"quality"`    // jpeg only
+    Orient          *bool       `json:"orient"`     // default true
+    resize          *resizeSpec // nil for the original size
+}
+
+type derivativePresets struct {
+    Derivatives     []derivativeSpec `json:"derivatives"`
+}
+
+// derivativeFormat returns the format implied by the extension of path
+func derivativeFormat( path string ) string {
+    switch strings.ToLower( filepath.Ext( path ) ) {
+    case ".json":
+        return "metadata"
+    case ".png":
+        return "png"
+    case ".webp":
+        return "webp"
+    }
+    return "jpeg"
+}
+
+// loadDerivatives reads and checks the derivative presets file at path
+func loadDerivatives( path string ) ([]derivativeSpec, error) {
+    data, err := os.ReadFile( path )
+    if err != nil {
+        return nil, fmt.Errorf( "%v\n", err )
+    }
+    dec := json.NewDecoder( bytes.NewReader( data ) )
+    dec.DisallowUnknownFields()
+    presets := new( derivativePresets )
+    if err = dec.Decode( presets ); err != nil {
+        return nil, fmt.Errorf( "invalid presets in %s: %v\n",
+                                path, err )
+    }
+    if len(presets.Derivatives) == 0 {
+        return nil, fmt.Errorf( "no derivative in %s\n", path )
+    }
+    for i := range presets.Derivatives {
+        d := &presets.Derivatives[i]
+        if d.Name == "" {
+            d.Name = fmt.Sprintf( "#%d", i + 1 )
+        }
+        if d.Path == "" {
+            return nil, fmt.Errorf( "missing path for derivative " +
+                                    "%s\n", d.Name )
+        }
+        if d.Format == "" {
+            d.Format = derivativeFormat( d.Path )
+        }
+        valid := false
+        for _, f := range derivativeFormats {
+            valid = valid || f == d.Format
+        }
+        if ! valid {
+            return nil, fmt.Errorf( "invalid format %s for derivative " +
+                                    "%s (%s)\n", d.Format, d.Name,
+                                    strings.Join( derivativeFormats, ", " ) )
+        }
+        if d.Quality == 0 {
+            d.Quality = defaultDerivativeQuality
+        }
+        if d.Quality < 1 || d.Quality > 100 {
+            return nil, fmt.Errorf( "invalid quality %d for " +
+                                    "derivative %s (1 to 100)\n", d.Quality,
+                                    d.Name )
+        }
+        if d.Filter == "" {
+            d.Filter = resampleFilters[0].name
+        }
+        if d.Size != "" {
+            if d.resize, err = parseResize( d.Size, d.Filter ); err != nil {
+                return nil, fmt.Errorf( "derivative %s: %v", d.Name,
+                                        err )
+            }
+        }
+    }
+    return presets.Derivatives, nil
+}
+
+// orientedSize returns the dimensions of a picture of w x h pixels turned
+// according to the Exif orientation o
+func orientedSize( w, h, o int ) (ow, oh int) {
+    if o >= 5 && o <= 8 {
+        return h, w
+    }
+    return w, h
+}
+
+// orientedSource returns the position in a picture of w x h pixels of the
+// pixel at x, y in the picture turned according to the Exif orientation o
+func orientedSource( w, h, o, x, y int ) (sx, sy int) {
+    sx, sy = x, y
+    switch o {
+    case 2:
+        sx = w - 1 - x
+    case 3:
+        sx, sy = w - 1 - x, h - 1 - y
+    case 4:
+        sy = h - 1 - y
+    case 5:
+        sx, sy = y, x
+    case 6:
+        sx, sy = y, h - 1 - x
+    case 7:
+        sx, sy = w - 1 - y, h - 1 - x
+    case 8:
+        sx, sy = w - 1 - y, x
+    }
+    return
+}
+
+// orientImage returns img turned according to the Exif orientation o
+func orientImage( img *image.RGBA, o int ) *image.RGBA {
+    if o <= 1 || o > 8 {
+        return img
+    }
+    w, h := img.Rect.Dx(), img.Rect.Dy()
+    ow, oh := orientedSize( w, h, o )
+    res := image.NewRGBA( image.Rect( 0, 0, ow, oh ) )
+    for y := 0; y < oh; y++ {
+        for x := 0; x < ow; x++ {
+            sx, sy := orientedSource( w, h, o, x, y )
+            s := img.PixOffset( img.Rect.Min.X + sx, img.Rect.Min.Y + sy )
+            copy( res.Pix[res.PixOffset( x, y ):], img.Pix[s:s+4] )
+        }
+    }
+    return res
+}
+
+// iccProfileNotSRGB returns true if data includes an ICC profile that does not
+// describe itself as sRGB (in an ascii or UTF-16 description)
+func iccProfileNotSRGB( data []byte, l *fileLayout ) bool {
+    found := false
+    for _, s := range l.segments {
+        d := s.data( data )
+        if s.marker != markerAPP0 + 2 ||
+           ! bytes.HasPrefix( d, []byte( "ICC_PROFILE\x00" ) ) {
+            continue
+        }
+        if bytes.Contains( d, []byte( "sRGB" ) ) ||
+           bytes.Contains( d, []byte( "s\x00R\x00G\x00B" ) ) {
+            return false
+        }
+        found = true
+    }
+    return found
+}
+
+// saveDerivative encodes pic in the format of d at its path
+func saveDerivative( d *derivativeSpec, pic image.Image ) error {
+    switch d.Format {
+    case "webp":
+        b, err := encodeWebp( pic )
+        if err == nil {
+            err = writeFile( d.Path, b, 0644 )
+        }
+        return err
+    case "png":
+        return writePng( d.Path, pic )
+    }
+    w, done, err := createFile( d.Path )
+    if err != nil {
+        return err
+    }
+    err = stdjpeg.Encode( w, pic, &stdjpeg.Options{ Quality: d.Quality } )
+    if cerr := done(); err == nil {
+        err = cerr
+    }
+    return err
+}
+
+// saveDerivatives makes all derivatives of the file at path, whose content is
+// data. The main picture is decoded once for all derivatives. It returns the
+// first error, after trying all derivatives.
+func saveDerivatives( path string, data []byte, l *fileLayout,
+                      derivatives []derivativeSpec,
+                      rep *fileReport ) (err error) {
+    var decoded *image.RGBA
+    pictures := make( map[bool]*image.RGBA )    // by orient
+    picture := func( orient bool ) (*image.RGBA, error) {
+        if p, ok := pictures[orient]; ok {
+            return p, nil
+        }
+        if decoded == nil {
+            img, err := stdjpeg.Decode( bytes.NewReader( data ) )
+            if err != nil {
+                return nil, fmt.Errorf( "unable to decode the picture: %v\n",
+                                        err )
+            }
+            decoded = image.NewRGBA( img.Bounds().Sub( img.Bounds().Min ) )
+            draw.Draw( decoded, decoded.Rect, img, img.Bounds().Min, draw.Src )
+            if iccProfileNotSRGB( data, l ) {
+                text := "derive: the ICC profile is not sRGB, colors of " +
+                        "derivative pictures are not converted"
+                fmt.Printf( "jpegcheck: %s\n", text )
+                rep.addMessage( warningSeverity, codeDerive, text )
+            }
+        }
+        p := decoded
+        if orient {
+            p = orientImage( decoded, exifOrientation( data, l ) )
+        }
+        pictures[orient] = p
+        return p, nil
+    }
+    for i := range derivatives {
+        d := &derivatives[i]
+        var derr error
+        if d.Format == "metadata" {
+            derr = saveMetadataJson( d.Path, path, data, l )
+        } else {
+            derr = func( ) error {
+                pic, err := picture( d.Orient == nil || *d.Orient )
+                if err != nil {
+                    return err
+                }
+                w, h := pic.Rect.Dx(), pic.Rect.Dy()
+                if d.resize != nil {
+                    w, h = d.resize.size( pic.Rect.Dx(), pic.Rect.Dy() )
+                }
+                if w != pic.Rect.Dx() || h != pic.Rect.Dy() {
+                    pic = resizeImage( pic, w, h, d.resize.filter )
+                }
+                if err = saveDerivative( d, pic ); err != nil {
+                    return err
+                }
+                fmt.Printf( "jpegcheck: derivative %s: saved %dx%d %s as %s\n",
+                            d.Name, w, h, d.Format, d.Path )
+                return nil
+            }()
+        }
+        if derr != nil && err == nil {
+            err = fmt.Errorf( "derive: derivative %s: %s\n", d.Name,
+                              strings.TrimSpace( derr.Error() ) )
+        }
+    }
+    return
+}
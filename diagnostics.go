@@ -0,0 +1,372 @@
+
+package main
+
+import (
+    "fmt"
+    "regexp"
+    "strconv"
+    "strings"
+    "github.com/jrm-1535/jpeg"
+)
+
+// Specification clauses relevant to the diagnostics issued during analysis,
+// so that a rejection can be justified against the standard:
+//  ITU-T T.81 (ISO/IEC 10918-1) for the JPEG syntax,
+//  JFIF 1.02 (ISO/IEC 10918-5) for APP0 JFIF segments,
+//  Exif 2.32 (CIPA DC-008) for APP1 Exif segments.
+
+type citation struct {
+    spec            string
+    clause          string
+    title           string
+}
+
+func (c *citation) String( ) string {
+    if c.clause == "" {
+        return c.spec + " (" + c.title + ")"
+    }
+    return c.spec + " " + c.clause + " (" + c.title + ")"
+}
+
+var (
+    t81Markers      = citation{ "ITU-T T.81", "B.1.1.3", "Marker assignments" }
+    t81HighLevel    = citation{ "ITU-T T.81", "B.2.1", "High-level syntax" }
+    t81Frame        = citation{ "ITU-T T.81", "B.2.2", "Frame header syntax" }
+    t81Scan         = citation{ "ITU-T T.81", "B.2.3", "Scan header syntax" }
+    t81Quantization = citation{ "ITU-T T.81", "B.2.4.1",
+                                "Quantization table-specification syntax" }
+    t81Huffman      = citation{ "ITU-T T.81", "B.2.4.2",
+                                "Huffman table-specification syntax" }
+    t81Arithmetic   = citation{ "ITU-T T.81", "B.2.4.3",
+                                "Arithmetic conditioning table-specification syntax" }
+    t81Restart      = citation{ "ITU-T T.81", "B.2.4.4",
+                                "Restart interval definition syntax" }
+    t81Lines        = citation{ "ITU-T T.81", "B.2.5",
+                                "Define number of lines syntax" }
+    t81Hierarchical = citation{ "ITU-T T.81", "B.3", "Hierarchical syntax" }
+    t81Progressive  = citation{ "ITU-T T.81", "G.1.1.1.1", "Spectral selection control" }
+    jfifSyntax      = citation{ "JFIF 1.02", "", "JFIF file syntax" }
+    exifApp1        = citation{ "Exif 2.32", "4.7.2",
+                                "Interoperability structure of APP1 in compressed data" }
+)
+
+// diagnostic patterns are matched in order against the diagnostic text: more
+// specific patterns must come first.
+var diagnosticCitations = []struct {
+    pattern         string
+    cite            *citation
+} {
+    { "hierarchical image", &t81Hierarchical },
+    { "Frame structure:", &t81HighLevel },
+    { "app0:", &jfifSyntax },
+    { "JFIF", &jfifSyntax },
+    { "app1:", &exifApp1 },
+    { "exifApplication", &exifApp1 },
+    { "Wrong signature", &t81HighLevel },
+    { "invalid marker", &t81Markers },
+    { "reserved marker", &t81Markers },
+    { "should not happen in top level segments", &t81HighLevel },
+    { "Arithmetic coding table", &t81Arithmetic },
+    { "hierarchical table", &t81Hierarchical },
+    { "startOfFrame", &t81Frame },
+    { "frame component number of lines", &t81Frame },
+    { "processScan", &t81Scan },
+    { "for scan", &t81Scan },
+    { "Progressive frame", &t81Progressive },
+    { "Quantization", &t81Quantization },
+    { "HuffmanTable", &t81Huffman },
+    { "Huffman", &t81Huffman },
+    { "Restart", &t81Restart },
+    { "RST", &t81Restart },
+    { "DNL", &t81Lines },
+    { "number of lines", &t81Lines },
+    { "Wrong sequence", &t81HighLevel },
+}
+
+// citeDiagnostic returns the specification clause relevant to a diagnostic
+// message, or nil if none is known.
+func citeDiagnostic( text string ) *citation {
+    for _, dc := range diagnosticCitations {
+        if strings.Contains( text, dc.pattern ) {
+            return dc.cite
+        }
+    }
+    return nil
+}
+
+// Diagnostic codes: every message reported for a file is tagged with a stable
+// code, so that scripts and filters do not depend on the wording. Codes are
+// never renumbered or reused, new ones are added with the next free number.
+// jpegcheck gives its messages their code and severity where it raises them.
+// Only the diagnostics printed or returned by the jpeg library, which cannot
+// be tagged at their source, are classified from their text (see
+// libraryCodes). JC0000 is used for library messages not classified yet.
+const (
+    codeUnclassified        = "JC0000"
+    codeJpegSignature       = "JC0001"  // jpeg library diagnostics
+    codeInvalidMarker       = "JC0002"
+    codeReservedMarker      = "JC0003"
+    codeSequence            = "JC0004"
+    codeFrameHeader         = "JC0005"
+    codeScanHeader          = "JC0006"
+    codeQuantization        = "JC0007"
+    codeHuffman             = "JC0008"
+    codeRestart             = "JC0009"
+    codeLines               = "JC0010"
+    codeArithmeticTable     = "JC0011"
+    codeHierarchical        = "JC0012"
+    codeProgressive         = "JC0013"
+    codeJfif                = "JC0014"
+    codeExifApp1            = "JC0015"
+    codeScanEnd             = "JC0016"
+    codeIncompleteComponent = "JC0017"
+    codeRestartSync         = "JC0018"
+    codeSamplesPerLine      = "JC0019"
+    codeMakerNote           = "JC0020"
+    codeInternal            = "JC0021"  // jpegcheck diagnostics
+    codeIncomplete          = "JC0022"
+    codeLenient             = "JC0023"
+    codeByteOrder           = "JC0024"
+    codeExifPlacement       = "JC0025"
+    codeJpegXt              = "JC0026"
+    codeC2pa                = "JC0027"
+    codeJumbf               = "JC0028"
+    codeSecurity            = "JC0029"
+    codePolyglot            = "JC0030"
+    codeFingerprint         = "JC0031"
+    codePreservation        = "JC0032"
+    codeRecoverability      = "JC0033"
+    codeSplice              = "JC0034"
+    codeRendition           = "JC0035"
+    codeRepairSuggestion    = "JC0036"
+    codeAppliedRepair       = "JC0037"
+    codeClassifier          = "JC0038"
+    codeExiftool            = "JC0039"
+    codeSignature           = "JC0040"
+    codeScanVerification    = "JC0041"
+    codeReorder             = "JC0042"
+    codeRecursion           = "JC0043"
+    codeDerive              = "JC0044"
+    codeSpict               = "JC0045"
+    codeFrameStructure      = "JC0046"
+    codeAdobe               = "JC0047"
+    codeGrayscale           = "JC0048"
+    codeBlank               = "JC0049"
+    codeExposure            = "JC0050"
+    codeArithmetic          = "JC0051"
+    codeSharpness           = "JC0052"
+    codeRotation            = "JC0053"
+    codeOutputChange        = "JC0054"
+    codeMcuWindow           = "JC0055"
+    codeExtendedPrecision   = "JC0056"
+    codeByteStuffing        = "JC0057"
+    codeFixity              = "JC0058"
+    codeRestartSequence     = "JC0059"
+    codeTrailingData        = "JC0060"
+    codeOutput              = "JC0061"
+)
+
+// libraryCodes classify the diagnostics of the jpeg library. Patterns are
+// matched in order against the message text: more specific patterns must
+// come first.
+var libraryCodes = []struct {
+    pattern         string
+    code            string
+} {
+    { "Unexpected end of scan segment", codeScanEnd },
+    { "incomplete component", codeIncompleteComponent },
+    { "not synced with RST intervals", codeRestartSync },
+    { "Samples/Line", codeSamplesPerLine },
+    { "samples per line", codeSamplesPerLine },
+    { "unknown maker note", codeMakerNote },
+    { "Wrong signature", codeJpegSignature },
+    { "invalid marker", codeInvalidMarker },
+    { "reserved marker", codeReservedMarker },
+    { "Wrong sequence", codeSequence },
+    { "should not happen in top level segments", codeSequence },
+    { "app0:", codeJfif },
+    { "JFIF", codeJfif },
+    { "app1:", codeExifApp1 },
+    { "exifApplication", codeExifApp1 },
+    { "Arithmetic coding table", codeArithmeticTable },
+    { "hierarchical table", codeHierarchical },
+    { "Progressive frame", codeProgressive },
+    { "startOfFrame", codeFrameHeader },
+    { "frame component number of lines", codeFrameHeader },
+    { "processScan", codeScanHeader },
+    { "for scan", codeScanHeader },
+    { "Quantization", codeQuantization },
+    { "Huffman", codeHuffman },
+    { "Restart", codeRestart },
+    { "RST", codeRestart },
+    { "DNL", codeLines },
+    { "number of lines", codeLines },
+}
+
+// libraryCode returns the stable code of a diagnostic of the jpeg library
+func libraryCode( text string ) string {
+    for _, lc := range libraryCodes {
+        if strings.Contains( text, lc.pattern ) {
+            return lc.code
+        }
+    }
+    return codeUnclassified
+}
+
+// codedError is an error returned by checkFile, with the code of the
+// diagnostic recorded for the failure
+type codedError struct {
+    error
+    code            string
+}
+
+// errorCode returns the diagnostic code of an error returned by checkFile.
+// Errors without a code come from the jpeg library.
+func errorCode( err error ) string {
+    switch e := err.(type) {
+    case codedError:
+        return e.code
+    case fatalError:
+        return codeIncomplete
+    case outputError:
+        return codeOutput
+    }
+    return libraryCode( err.Error() )
+}
+
+var offsetPattern = regexp.MustCompile( `(?:offset[= ]|@ ?|at )0x([0-9a-fA-F]+)` )
+
+// diagnosticOffset returns the file offset given in a diagnostic message, or
+// -1 if none is given
+func diagnosticOffset( text string ) int64 {
+    m := offsetPattern.FindStringSubmatch( text )
+    if m == nil {
+        return -1
+    }
+    offset, err := strconv.ParseInt( m[1], 16, 64 )
+    if err != nil {
+        return -1
+    }
+    return offset
+}
+
+// libraryDiagnostic returns the severity and the code of a line printed by
+// the jpeg library while parsing with warnings enabled, or false if the line
+// is not a diagnostic
+func libraryDiagnostic( line string ) (severity, string, bool) {
+    switch {
+    case strings.Contains( line, "Unexpected end of scan segment" ):
+        return errorSeverity, codeScanEnd, true
+    case strings.Contains( strings.ToLower( line ), "warning" ):
+        return warningSeverity, libraryCode( line ), true
+    }
+    return 0, "", false
+}
+
+// restartMarkerAt returns true if a RSTn marker is at offset in data
+func restartMarkerAt( data []byte, offset int64 ) bool {
+    return offset >= 0 && offset + 1 < int64(len(data)) &&
+           data[offset] == 0xff && data[offset+1] >= markerRST0 &&
+           data[offset+1] <= markerRST0 + 7
+}
+
+// fatalError is returned when the analysis of a file could not be completed
+type fatalError struct {
+    error
+}
+
+// outputError is returned when the analysis of a file was completed, but one
+// of the outputs requested (copy, picture, signature...) could not be written.
+// It does not tell whether the file is valid: invalid is true if the file
+// also failed validation.
+type outputError struct {
+    error
+    invalid         bool
+}
+
+// Error returns the message of the error, terminated by a newline as the
+// messages of jpegcheck (the library returns some without newline)
+func (e outputError) Error( ) string {
+    text := e.error.Error()
+    if strings.HasSuffix( text, "\n" ) {
+        return text
+    }
+    return text + "\n"
+}
+
+// collectLibraryDiagnostics records the diagnostics among the lines printed by
+// the jpeg library while parsing data, and prints the other lines. The
+// library reports the end of each restart interval as an unexpected end of
+// scan segment, preceded by the components it finds incomplete and possibly
+// followed by a loss of synchronization with the RST intervals: those are
+// recorded as info when the segment ends on a RSTn marker, since the entropy
+// coded data is then checked by -verify-scan.
+func collectLibraryDiagnostics( lines []string, data []byte,
+                                rep *fileReport ) {
+    var incomplete []string     // until the next end of scan segment
+    atRestart := false          // last end of scan segment was on RSTn
+    for _, line := range lines {
+        s, code, ok := libraryDiagnostic( line )
+        switch {
+        case ! ok:
+            fmt.Printf( "%s\n", line )
+            continue
+        case code == codeIncompleteComponent:
+            incomplete = append( incomplete, line )
+            continue
+        case code == codeScanEnd:
+            atRestart = restartMarkerAt( data, diagnosticOffset( line ) )
+            is := warningSeverity       // of incomplete components
+            if atRestart {
+                s, is = infoSeverity, infoSeverity
+            }
+            for _, l := range incomplete {
+                rep.addMessage( is, codeIncompleteComponent, l )
+            }
+            incomplete = nil
+        case code == codeRestartSync && atRestart:
+            s = infoSeverity
+        }
+        rep.addMessage( s, code, line )
+    }
+    for _, l := range incomplete {
+        rep.addMessage( warningSeverity, codeIncompleteComponent, l )
+    }
+}
+
+// parseWithDiagnostics calls parse while capturing the output of the library,
+// in order to record its diagnostics about data in rep. The output is
+// restored even if parse panics.
+func parseWithDiagnostics( parse func( ) (*jpeg.Desc, error), data []byte,
+                           rep *fileReport ) (*jpeg.Desc, error) {
+    capture, err := newStdoutCapture()
+    if err != nil {
+        return nil, fmt.Errorf( "unable to capture diagnostics: %v\n", err )
+    }
+    defer func( ) {
+        lines := capture.take()
+        capture.restore()
+        collectLibraryDiagnostics( lines, data, rep )
+    }()
+    return parse()
+}
+
+// formatDiagnostics prints the messages recorded for a file that are at least
+// as severe as min, with their code and offset
+func formatDiagnostics( rep *fileReport, min severity ) {
+    header := false
+    for _, m := range rep.messages {
+        if m.severity < min {
+            continue
+        }
+        if ! header {
+            fmt.Printf( "Diagnostics:\n" )
+            header = true
+        }
+        at := ""
+        if m.offset >= 0 {
+            at = fmt.Sprintf( " @0x%x", m.offset )
+        }
+        fmt.Printf( "  [%s] %s%s: %s\n", m.severity, m.code, at, m.text )
+    }
+}
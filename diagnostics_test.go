@@ -0,0 +1,67 @@
+package main
+
+import (
+    "fmt"
+    "testing"
+)
+
+func TestRestartBoundaryDiagnostics( t *testing.T ) {
+    data := make( []byte, 0x20 )
+    data[0x10], data[0x11] = 0xff, markerRST0 + 1      // restart boundary
+    data[0x18], data[0x19] = 0xff, markerEOI
+    lines := []string{
+        "Warning: incomplete component 0 (0 rows): anchor 4 (max 6) row 0 " +
+        "col 0 count 0",
+        "MCU=2 comp=0 du=0,0 coef=0 offset=0x10 [0xff] Unexpected end of " +
+        "scan segment",
+        "Warning: end of slice @MCU 3 is not synced with RST intervals (2)",
+        "Warning: incomplete component 0 (1 rows): anchor 2 (max 6) row 0 " +
+        "col 0 count 0",
+        "MCU=4 comp=0 du=0,0 coef=0 offset=0x18 [0xff] Unexpected end of " +
+        "scan segment",
+        "Warning: end of slice @MCU 5 is not synced with RST intervals (2)",
+    }
+    expected := []struct {
+        s       severity
+        code    string
+    }{
+        { infoSeverity, codeIncompleteComponent },
+        { infoSeverity, codeScanEnd },
+        { infoSeverity, codeRestartSync },
+        { warningSeverity, codeIncompleteComponent },
+        { errorSeverity, codeScanEnd },
+        { warningSeverity, codeRestartSync },
+    }
+    rep := &fileReport{ }
+    collectLibraryDiagnostics( lines, data, rep )
+    if len(rep.messages) != len(expected) {
+        t.Fatalf( "%d messages, expected %d", len(rep.messages),
+                  len(expected) )
+    }
+    for i, m := range rep.messages {
+        if m.severity != expected[i].s || m.code != expected[i].code {
+            t.Errorf( "message %d: [%s] %s, expected [%s] %s", i, m.severity,
+                      m.code, expected[i].s, expected[i].code )
+        }
+    }
+}
+
+func TestErrorCode( t *testing.T ) {
+    tests := []struct {
+        err     error
+        code    string
+    }{
+        { codedError{ fmt.Errorf( "polyglot file: jpeg+zip" ),
+                      codePolyglot }, codePolyglot },
+        { fatalError{ fmt.Errorf( "unable to analyse file x.jpg" ) },
+          codeIncomplete },
+        { fmt.Errorf( "Wrong signature 0x0000 for a jpeg file" ),
+          codeJpegSignature },
+        { fmt.Errorf( "something else" ), codeUnclassified },
+    }
+    for _, tc := range tests {
+        if code := errorCode( tc.err ); code != tc.code {
+            t.Errorf( "%v: code %s, expected %s", tc.err, code, tc.code )
+        }
+    }
+}
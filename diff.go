@@ -0,0 +1,188 @@
+
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+    "strings"
+
+    "github.com/jrm-1535/jpeg"
+)
+
+// Differential report between an original file and its modified copy written
+// with -o after -tidyup or -rmeta.
+
+// segmentKey identifies a segment by its marker and its rank among segments
+// with the same marker, so that segments can be paired between two files.
+type segmentKey struct {
+    marker      byte
+    rank        int
+}
+
+func keySegments( l *fileLayout ) (keys []segmentKey,
+                                   index map[segmentKey]*segment) {
+    index = make( map[segmentKey]*segment )
+    ranks := make( map[byte]int )
+    for i := range l.segments {
+        s := &l.segments[i]
+        k := segmentKey{ s.marker, ranks[s.marker] }
+        ranks[s.marker] ++
+        keys = append( keys, k )
+        index[k] = s
+    }
+    return
+}
+
+func (k segmentKey) String( ) string {
+    return fmt.Sprintf( "%s #%d", markerName( k.marker ), k.rank )
+}
+
+// metadataLines returns the non-empty lines of formatted metadata for all app
+// segments
+func metadataLines( data []byte ) []string {
+    control := jpeg.Control{ }
+    jpg, err := jpeg.Parse( data, &control )
+    if err != nil {
+        return nil
+    }
+    var b bytes.Buffer
+    for id := 0; id < 16; id++ {
+        jpg.FormatMetadata( &b, id, []int{} )
+    }
+    var lines []string
+    for _, l := range strings.Split( b.String(), "\n" ) {
+        if strings.TrimSpace( l ) != "" {
+            lines = append( lines, l )
+        }
+    }
+    return lines
+}
+
+// lineDiff returns the lines only in before and the lines only in after,
+// preserving their order
+func lineDiff( before, after []string ) (removed, added []string) {
+    count := make( map[string]int )
+    for _, l := range after {
+        count[l] ++
+    }
+    for _, l := range before {
+        if count[l] > 0 {
+            count[l] --
+        } else {
+            removed = append( removed, l )
+        }
+    }
+    count = make( map[string]int )
+    for _, l := range before {
+        count[l] ++
+    }
+    for _, l := range after {
+        if count[l] > 0 {
+            count[l] --
+        } else {
+            added = append( added, l )
+        }
+    }
+    return
+}
+
+// entropyCodedData returns the concatenation of all entropy-coded data
+func entropyCodedData( data []byte, l *fileLayout ) []byte {
+    var b bytes.Buffer
+    for _, s := range l.segments {
+        if s.ecsEnd != 0 {
+            b.Write( data[s.end():s.ecsEnd] )
+        }
+    }
+    return b.Bytes()
+}
+
+// sizeChange describes the change from the original size to the written size
+func sizeChange( orig, written int ) string {
+    switch {
+    case written < orig:
+        return fmt.Sprintf( "%d bytes saved", orig - written )
+    case written > orig:
+        return fmt.Sprintf( "%d bytes added", written - orig )
+    }
+    return "same size"
+}
+
+// formatRewriteDiff prints a before/after comparison of the original file at
+// path and of its modified copy written at output, and records the changes in
+// the file report rep.
+func formatRewriteDiff( path, output string, rep *fileReport ) error {
+    orig, err := os.ReadFile( path )
+    if err != nil {
+        return fmt.Errorf( "diff: %v\n", err )
+    }
+    written, err := os.ReadFile( output )
+    if err != nil {
+        return fmt.Errorf( "diff: %v\n", err )
+    }
+    ol, wl := scanLayout( orig ), scanLayout( written )
+    oKeys, oIndex := keySegments( ol )
+    wKeys, wIndex := keySegments( wl )
+
+    note := func( f string, a ...interface{} ) {
+        change := fmt.Sprintf( f, a... )
+        fmt.Printf( "  %s\n", change )
+        rep.changes = append( rep.changes, change )
+    }
+    fmt.Printf( "Changes from %s to %s:\n", path, output )
+    note( "Size: %d -> %d bytes (%s)", len(orig), len(written),
+          sizeChange( len(orig), len(written) ) )
+    var changes int
+    for _, k := range oKeys {
+        o := oIndex[k]
+        w, ok := wIndex[k]
+        switch {
+        case ! ok:
+            note( "Removed  %-9s @0x%x, %d bytes", k, o.offset,
+                  len(segmentBytes( o, orig )) )
+        case o.length != w.length:
+            note( "Resized  %-9s @0x%x -> @0x%x, %d -> %d bytes", k,
+                  o.offset, w.offset, len(segmentBytes( o, orig )),
+                  len(segmentBytes( w, written )) )
+        case ! bytes.Equal( segmentBytes( o, orig ),
+                            segmentBytes( w, written ) ):
+            note( "Modified %-9s @0x%x -> @0x%x", k, o.offset, w.offset )
+        default:
+            continue
+        }
+        changes ++
+    }
+    for _, k := range wKeys {
+        if _, ok := oIndex[k]; ! ok {
+            w := wIndex[k]
+            note( "Added    %-9s @0x%x, %d bytes", k, w.offset,
+                  len(segmentBytes( w, written )) )
+            changes ++
+        }
+    }
+    if changes == 0 {
+        note( "No segment added, removed or modified" )
+    }
+
+    removed, added := lineDiff( metadataLines( orig ), metadataLines( written ) )
+    if len(removed) + len(added) == 0 {
+        note( "Metadata unchanged" )
+    } else {
+        note( "Metadata differences:" )
+        for _, l := range removed {
+            note( "  - %s", l )
+        }
+        for _, l := range added {
+            note( "  + %s", l )
+        }
+    }
+
+    if bytes.Equal( entropyCodedData( orig, ol ),
+                    entropyCodedData( written, wl ) ) {
+        note( "Image data untouched (entropy-coded data identical)" )
+    } else {
+        note( "Image data MODIFIED (entropy-coded data differs)" )
+    }
+    return nil
+}
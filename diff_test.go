@@ -0,0 +1,77 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestSizeChange( t *testing.T ) {
+    tests := []struct {
+        orig, written   int
+        expected        string
+    }{
+        { 1000, 900, "100 bytes saved" },
+        { 1000, 1002, "2 bytes added" },
+        { 1000, 1000, "same size" },
+    }
+    for _, tc := range tests {
+        if s := sizeChange( tc.orig, tc.written ); s != tc.expected {
+            t.Errorf( "%d -> %d: %q, expected %q", tc.orig, tc.written, s,
+                      tc.expected )
+        }
+    }
+}
+
+// TestOutputSize checks that the size reported for the copy is its final
+// size, after the passes that rewrite it
+func TestOutputSize( t *testing.T ) {
+    tests := []struct {
+        name    string
+        args    []string
+    }{
+        { "tidyup", []string{ "-tidyup" } },
+        { "strip-gps", []string{ "-strip-gps" } },
+        { "rmeta tags", []string{ "-rmeta=1:3:GPSLatitude" } },
+        { "sign", []string{ "-tidyup", "-sign=key" } },
+    }
+    data := withExif( testsetData( t, "baseline-420.jpg" ), gpsTiff() )
+    for _, tc := range tests {
+        t.Run( tc.name, func( t *testing.T ) {
+            dir := t.TempDir()
+            path := filepath.Join( dir, "in.jpg" )
+            key := filepath.Join( dir, "key" )
+            out := filepath.Join( dir, "out.jpg" )
+            report := filepath.Join( dir, "report.json" )
+            if err := os.WriteFile( path, data, 0644 ); err != nil {
+                t.Fatal( err )
+            }
+            if err := os.WriteFile( key, []byte( "0123456789abcdef" ),
+                                    0600 ); err != nil {
+                t.Fatal( err )
+            }
+            args := []string{ "-q", "-o=" + out, "-report=" + report }
+            for _, a := range tc.args {
+                args = append( args, strings.Replace( a, "=key", "=" + key,
+                                                      1 ) )
+            }
+            if n := processBatch( checkerArgs( t, append( args,
+                                                  path )... ) ); n != 0 {
+                t.Fatalf( "%d files failed", n )
+            }
+            info, err := os.Stat( out )
+            if err != nil {
+                t.Fatal( err )
+            }
+            files := reportFiles( t, report )
+            if len(files) != 1 || files[0].Output == nil {
+                t.Fatalf( "no output in report: %+v", files )
+            }
+            if size := files[0].Output.Size; size != int(info.Size()) {
+                t.Errorf( "reported size %d, actual size %d", size,
+                          info.Size() )
+            }
+        } )
+    }
+}
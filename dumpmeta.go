@@ -0,0 +1,91 @@
+
+package main
+
+import (
+    "bytes"
+    "encoding/csv"
+    "fmt"
+    "path/filepath"
+    "strings"
+)
+
+// Metadata sidecar (-dumpmeta=<path>.json|.csv): all decoded metadata, JFIF,
+// Exif, MPF, XMP, Photoshop IRB and IPTC-IIM, Adobe APP14 and comments, is
+// saved next to the processed file for indexing in a database. The json
+// sidecar is the document written by -meta-json; the csv sidecar has one line
+// per tag, with the container, group, id, name, type, count and value, so that
+// it can be loaded directly in a table.
+
+var dumpMetaColumns = []string{ "path", "container", "segment", "offset",
+                                "group", "id", "tag", "type", "count", "value",
+                                "error" }
+
+// dumpMetaFormat returns the sidecar format given by the extension of path
+func dumpMetaFormat( path string ) (string, error) {
+    switch ext := strings.ToLower( filepath.Ext( path ) ); ext {
+    case ".json", ".csv":
+        return ext[1:], nil
+    }
+    return "", fmt.Errorf( "invalid metadata sidecar %s (.json or .csv)\n",
+                           path )
+}
+
+// csvValue returns a tag value as a csv field: strings as is, other values
+// as with -meta-flat
+func csvValue( v interface{} ) string {
+    if s, ok := v.(string); ok {
+        return s
+    }
+    return flatValue( v )
+}
+
+// saveMetadataCsv writes all metadata found in data as csv at output, one
+// line per tag, or per group error if a group has no tag
+func saveMetadataCsv( output, path string, data []byte, l *fileLayout ) error {
+    containers := collectMetadata( data, l )
+    var b bytes.Buffer
+    w := csv.NewWriter( &b )
+    w.Write( dumpMetaColumns )
+    n := 0
+    for _, c := range containers {
+        offset := fmt.Sprintf( "%d", c.Offset )
+        for _, g := range c.Groups {
+            if len(g.Tags) == 0 && g.Error != "" {
+                w.Write( []string{ path, c.Name, c.Segment, offset, g.Name,
+                                   "", "", "", "", "",
+                                   strings.TrimSpace( g.Error ) } )
+            }
+            for _, t := range g.Tags {
+                w.Write( []string{ path, c.Name, c.Segment, offset, g.Name,
+                                   t.Id, t.Name, t.Type,
+                                   fmt.Sprintf( "%d", t.Count ),
+                                   csvValue( t.Value ),
+                                   strings.TrimSpace( t.Error ) } )
+                n++
+            }
+        }
+    }
+    w.Flush()
+    if err := w.Error(); err != nil {
+        return fmt.Errorf( "unable to encode metadata: %v\n", err )
+    }
+    if err := writeFile( output, b.Bytes(), 0644 ); err != nil {
+        return fmt.Errorf( "unable to save metadata: %v\n", err )
+    }
+    fmt.Printf( "Saved %d metadata tag(s) from %d container(s) as %s\n",
+                n, len(containers), output )
+    return nil
+}
+
+// dumpMetadata saves all metadata found in data as a json or csv sidecar at
+// output, depending on its extension
+func dumpMetadata( output, path string, data []byte, l *fileLayout ) error {
+    format, err := dumpMetaFormat( output )
+    if err != nil {
+        return err
+    }
+    if format == "csv" {
+        return saveMetadataCsv( output, path, data, l )
+    }
+    return saveMetadataJson( output, path, data, l )
+}
@@ -0,0 +1,421 @@
+
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Embedded image discovery: cameras embed pictures in many containers besides
+// the Exif thumbnail. Each embedded picture found is given a stable id made of
+// the container name and of an index, which can be used with -sthumb. Depth
+// maps are listed as well, since they are stored in the same containers.
+
+type embeddedImage struct {
+    id              string
+    source          string      // container description
+    format          string      // JPEG, RGB or palette
+    width, height   int         // 0 if unknown
+    offset, length  int         // byte range in file
+    data            []byte      // JPEG data or raw RGB samples
+}
+
+// known id prefixes, followed by an optional index
+var embeddedIdPrefixes = []string{ "jfif", "jfxx", "exif", "maker", "mpf",
+                                   "fpxr", "depth" }
+
+// isEmbeddedId returns true if id is a named embedded image id
+func isEmbeddedId( id string ) bool {
+    for _, p := range embeddedIdPrefixes {
+        if strings.HasPrefix( id, p ) {
+            rest := id[len(p):]
+            if rest == "" {
+                return true
+            }
+            _, err := strconv.ParseUint( rest, 10, 32 )
+            return err == nil
+        }
+    }
+    return false
+}
+
+// setJpegInfo sets the format and size of an embedded jpeg picture from its
+// frame header
+func (ei *embeddedImage) setJpegInfo( ) {
+    ei.format = "JPEG"
+    if ! bytes.HasPrefix( ei.data, []byte{ 0xff, markerSOI } ) {
+        ei.format = "JPEG?"     // not starting with SOI
+        return
+    }
+    l := scanLayout( ei.data )
+    for i := range l.segments {
+        s := &l.segments[i]
+        if isSOF( s.marker ) {
+            ei.format = "JPEG " + markerName( s.marker )
+            if fh, err := parseFrameHeader( s, ei.data ); err == nil {
+                ei.width, ei.height = fh.width, fh.height
+            }
+            return
+        }
+    }
+}
+
+// jfifImages returns the thumbnails in JFIF and JFXX APP0 segments
+func jfifImages( data []byte, s *segment ) (images []*embeddedImage) {
+    d := s.data( data )
+    start := s.offset + 4
+    switch {
+    case bytes.HasPrefix( d, []byte( "JFIF\x00" ) ) && len(d) >= 14:
+        w, h := int(d[12]), int(d[13])
+        if w * h == 0 || len(d) < 14 + 3 * w * h {
+            return
+        }
+        images = append( images, &embeddedImage{ id: "jfif",
+                    source: "JFIF APP0 thumbnail", format: "RGB",
+                    width: w, height: h, offset: start + 14,
+                    length: 3 * w * h, data: d[14:14+3*w*h] } )
+    case bytes.HasPrefix( d, []byte( "JFXX\x00" ) ) && len(d) >= 6:
+        ei := &embeddedImage{ id: "jfxx", source: "JFXX APP0 extension",
+                              offset: start + 6 }
+        switch d[5] {
+        case 0x10:
+            ei.data = d[6:]
+            ei.length = len(ei.data)
+            ei.setJpegInfo()
+        case 0x11, 0x13:
+            if len(d) < 8 {
+                return
+            }
+            w, h := int(d[6]), int(d[7])
+            n := 3 * w * h
+            if d[5] == 0x11 {
+                n = 768 + w * h
+            }
+            if len(d) < 8 + n {
+                return
+            }
+            ei.width, ei.height = w, h
+            ei.offset, ei.length = start + 8, n
+            ei.data = d[8:8+n]
+            ei.format = "RGB"
+            if d[5] == 0x11 {
+                ei.format = "palette"
+            }
+        default:
+            return
+        }
+        images = append( images, ei )
+    }
+    return
+}
+
+const (
+    tagImageWidth                   = 0x0100
+    tagImageLength                  = 0x0101
+    tagBitsPerSample                = 0x0102
+    tagCompression                  = 0x0103
+    tagPhotometricInterpretation    = 0x0106
+    tagStripOffsets                 = 0x0111
+    tagSamplesPerPixel              = 0x0115
+    tagStripByteCounts              = 0x0117
+)
+
+// tiffThumbnail returns an uncompressed 8-bit RGB thumbnail described by the
+// entries of IFD1, or nil if the thumbnail is not of this kind.
+func tiffThumbnail( t *tiffReader, entries []ifdEntry,
+                    tiffStart int ) *embeddedImage {
+    values := make( map[uint16][]uint32 )
+    for i := range entries {
+        if v, err := t.uint32Values( &entries[i] ); err == nil {
+            values[entries[i].tag] = v
+        }
+    }
+    first := func( tag uint16 ) uint32 {
+        if v := values[tag]; len(v) > 0 {
+            return v[0]
+        }
+        return 0
+    }
+    if first( tagCompression ) != 1 ||
+       first( tagPhotometricInterpretation ) != 2 ||
+       first( tagSamplesPerPixel ) != 3 || first( tagBitsPerSample ) != 8 {
+        return nil
+    }
+    width, height := int(first( tagImageWidth )), int(first( tagImageLength ))
+    offsets, counts := values[tagStripOffsets], values[tagStripByteCounts]
+    if width == 0 || height == 0 || len(offsets) == 0 ||
+       len(offsets) != len(counts) {
+        return nil
+    }
+    var samples []byte
+    for i, o := range offsets {
+        if uint64(o) + uint64(counts[i]) > uint64(len(t.data)) {
+            return nil
+        }
+        samples = append( samples, t.data[o:o+counts[i]]... )
+    }
+    if len(samples) < 3 * width * height {
+        return nil
+    }
+    return &embeddedImage{ id: "exif", source: "Exif IFD1 TIFF thumbnail",
+                           format: "RGB", width: width, height: height,
+                           offset: tiffStart + int(offsets[0]),
+                           length: len(samples),
+                           data: samples[:3*width*height] }
+}
+
+// exifImages returns the thumbnail referred to by IFD1 in an Exif segment,
+// either JPEG compressed or uncompressed RGB
+func exifImages( data []byte, s *segment ) (images []*embeddedImage) {
+    tiff := exifTiffData( s.data( data ) )
+    if tiff == nil {
+        return
+    }
+    t, err := newTiffReader( tiff )
+    if err != nil {
+        return
+    }
+    _, next, err := t.readIfd( t.first )
+    if err != nil || next == 0 {
+        return
+    }
+    entries, _, err := t.readIfd( next )
+    if err != nil {
+        return
+    }
+    tiffStart := s.offset + 4 + len(exifHeader)
+    if ei := tiffThumbnail( t, entries, tiffStart ); ei != nil {
+        return append( images, ei )
+    }
+    var offset, length uint32
+    for i := range entries {
+        switch entries[i].tag {
+        case tagJPEGInterchangeFormat:
+            offset = t.uint32Value( &entries[i] )
+        case tagJPEGInterchangeFormatLength:
+            length = t.uint32Value( &entries[i] )
+        }
+    }
+    if length == 0 || uint64(offset) + uint64(length) > uint64(len(tiff)) {
+        return
+    }
+    ei := &embeddedImage{ id: "exif", source: "Exif IFD1 thumbnail",
+                          offset: tiffStart + int(offset), length: int(length),
+                          data: tiff[offset:offset+length] }
+    ei.setJpegInfo()
+    return append( images, ei )
+}
+
+const (
+    tagMPEntry      = 0xb002
+)
+
+var mpTypes = map[uint32]string{
+    0x030000: "primary image",
+    0x010001: "large thumbnail (VGA)",
+    0x010002: "large thumbnail (full HD)",
+    0x020001: "panorama frame",
+    0x020002: "disparity image",
+    0x020003: "multi-angle image",
+}
+
+// mpfImages returns the images listed in the MP index IFD of an MPF APP2
+// segment. Offsets in MP entries are relative to the MP endian field.
+func mpfImages( data []byte, s *segment ) (images []*embeddedImage) {
+    d := s.data( data )
+    if ! bytes.HasPrefix( d, []byte( "MPF\x00" ) ) {
+        return
+    }
+    base := s.offset + 8
+    t, err := newTiffReader( d[4:] )
+    if err != nil {
+        return
+    }
+    entries, _, err := t.readIfd( t.first )
+    if err != nil {
+        return
+    }
+    for i := range entries {
+        if entries[i].tag != tagMPEntry {
+            continue
+        }
+        v, err := t.valueData( &entries[i] )
+        if err != nil {
+            return
+        }
+        for n := 0; n + 16 <= len(v); n += 16 {
+            attr := t.order.Uint32( v[n:] )
+            size := int(t.order.Uint32( v[n+4:] ))
+            offset := int(t.order.Uint32( v[n+8:] ))
+            source, ok := mpTypes[attr & 0xffffff]
+            if ! ok {
+                source = fmt.Sprintf( "type 0x%06x", attr & 0xffffff )
+            }
+            ei := &embeddedImage{ id: fmt.Sprintf( "mpf%d", n / 16 + 1 ),
+                                  source: "MPF " + source, length: size }
+            if offset != 0 {        // the primary image has offset 0
+                ei.offset = base + offset
+            }
+            if ei.offset + size <= len(data) {
+                ei.data = data[ei.offset:ei.offset+size]
+                ei.setJpegInfo()
+            } else {
+                ei.format = "beyond end of file"
+            }
+            images = append( images, ei )
+        }
+    }
+    return
+}
+
+type fpxrStream struct {
+    offset          int         // file offset of the first part
+    parts           map[uint32][]byte   // stream data by offset in stream
+}
+
+// fpxrImages returns the jpeg pictures found in FlashPix ready (FPXR) APP2
+// stream data, which can be split over several segments.
+func fpxrImages( data []byte, l *fileLayout ) (images []*embeddedImage) {
+    streams := make( map[uint16]*fpxrStream )
+    var indexes []int
+    for i := range l.segments {
+        s := &l.segments[i]
+        d := s.data( data )
+        if s.marker != markerAPP0 + 2 ||
+           ! bytes.HasPrefix( d, []byte( "FPXR\x00" ) ) || len(d) < 13 ||
+           d[6] != 2 {          // not stream data
+            continue
+        }
+        index := binary.BigEndian.Uint16( d[7:] )
+        offset := binary.BigEndian.Uint32( d[9:] )
+        st, ok := streams[index]
+        if ! ok {
+            st = &fpxrStream{ offset: s.offset + 4 + 13,
+                              parts: make( map[uint32][]byte ) }
+            streams[index] = st
+            indexes = append( indexes, int(index) )
+        }
+        st.parts[offset] = d[13:]
+    }
+    sort.Ints( indexes )
+    for _, index := range indexes {
+        st := streams[uint16(index)]
+        var offsets []int
+        for o := range st.parts {
+            offsets = append( offsets, int(o) )
+        }
+        sort.Ints( offsets )
+        var stream []byte
+        for _, o := range offsets {
+            stream = append( stream, st.parts[uint32(o)]... )
+        }
+        soi := bytes.Index( stream, []byte{ 0xff, markerSOI, 0xff } )
+        if soi == -1 {
+            continue
+        }
+        ei := &embeddedImage{ id: fmt.Sprintf( "fpxr%d", index ),
+                              source: fmt.Sprintf( "FPXR stream %d", index ),
+                              offset: st.offset + soi,
+                              length: len(stream) - soi, data: stream[soi:] }
+        ei.setJpegInfo()
+        images = append( images, ei )
+    }
+    return
+}
+
+// findEmbeddedImages returns all embedded pictures found in data, in the order
+// of their containers
+func findEmbeddedImages( data []byte, l *fileLayout ) (images []*embeddedImage) {
+    for i := range l.segments {
+        s := &l.segments[i]
+        switch s.marker {
+        case markerAPP0:
+            images = append( images, jfifImages( data, s )... )
+        case markerAPP0 + 1:
+            images = append( images, exifImages( data, s )... )
+            images = append( images, makerNoteImages( data, s )... )
+        case markerAPP0 + 2:
+            images = append( images, mpfImages( data, s )... )
+        }
+        if s.marker == markerEOI {
+            break               // ignore APPn segments of appended images
+        }
+    }
+    images = append( images, fpxrImages( data, l )... )
+    return append( images, depthImages( data, l, images )... )
+}
+
+func formatEmbeddedImages( images []*embeddedImage ) {
+    if len(images) == 0 {
+        fmt.Printf( "No embedded image\n" )
+        return
+    }
+    fmt.Printf( "Embedded images:\n" )
+    fmt.Printf( "  %-7s %-32s %-14s %11s %10s %9s\n", "Id", "Source", "Format",
+                "Size", "Offset", "Length" )
+    for _, ei := range images {
+        size := "-"
+        if ei.width != 0 {
+            size = fmt.Sprintf( "%dx%d", ei.width, ei.height )
+        }
+        fmt.Printf( "  %-7s %-32s %-14s %11s %#10x %9d\n", ei.id, ei.source,
+                    ei.format, size, ei.offset, ei.length )
+    }
+}
+
+// content returns the data to save for an embedded picture: transcoded if
+// format is not "", otherwise jpeg or png pictures as is and uncompressed ones
+// as binary PPM files.
+func (ei *embeddedImage) content( format string ) ([]byte, error) {
+    if format != "" {
+        return ei.transcode( format )
+    }
+    var content []byte
+    switch ei.format {
+    case "RGB":
+        content = append( []byte( fmt.Sprintf( "P6\n%d %d\n255\n", ei.width,
+                                               ei.height ) ), ei.data... )
+    case "palette":
+        content = []byte( fmt.Sprintf( "P6\n%d %d\n255\n", ei.width,
+                                       ei.height ) )
+        palette := ei.data[:768]
+        for _, p := range ei.data[768:] {
+            content = append( content, palette[3*int(p):3*int(p)+3]... )
+        }
+    default:
+        content = ei.data
+    }
+    return content, nil
+}
+
+// saveEmbeddedImage writes the embedded picture identified by id at path, in
+// the format given by outputFormat for path and forced.
+func saveEmbeddedImage( images []*embeddedImage, id, path,
+                        forced string ) error {
+    var ei *embeddedImage
+    for _, e := range images {
+        if e.id == id {
+            ei = e
+        }
+    }
+    if ei == nil {
+        return fmt.Errorf( "no embedded image with id %s\n", id )
+    }
+    if ei.data == nil {
+        return fmt.Errorf( "embedded image %s is not available\n", id )
+    }
+    content, err := ei.content( outputFormat( path, forced ) )
+    if err != nil {
+        return err
+    }
+    if err := writeFile( path, content, 0644 ); err != nil {
+        return fmt.Errorf( "unable to save embedded image %s: %v\n", id, err )
+    }
+    fmt.Printf( "Saved embedded image %s (%s) as %s, %d bytes\n", id,
+                ei.source, path, len(content) )
+    return nil
+}
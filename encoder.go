@@ -0,0 +1,284 @@
+
+package main
+
+import (
+    "bytes"
+    "fmt"
+)
+
+// Coefficient encoder: the counterpart of the coefficient decoder, for
+// modifications made in the DCT domain. The scans of a Huffman coded
+// sequential frame are entropy coded again from the coefficients, with the
+// Huffman tables and the restart interval in force in the file, so that
+// blocks whose coefficients did not change are coded exactly as before. A
+// coefficient requiring a code absent from the tables (tables optimized for
+// the original coefficients may lack rare codes) is reported as an error.
+// The first scans of a progressive frame (spectral selection, with a point
+// transform but without successive approximation refinement) can also be
+// coded, for generated files.
+
+type huffEncoder struct {
+    code            [256]uint16
+    size            [256]uint8  // 0 if the symbol has no code
+}
+
+func newHuffEncoder( ht *huffTable ) *huffEncoder {
+    he := new( huffEncoder )
+    for l := 1; l <= 16; l++ {
+        for i := 0; i < ht.counts[l]; i++ {
+            s := ht.symbols[int(ht.valPtr[l]) + i]
+            he.code[s] = uint16( int(ht.minCode[l]) + i )
+            he.size[s] = uint8(l)
+        }
+    }
+    return he
+}
+
+// bit writer over entropy-coded data, stuffing a zero byte after 0xff
+type bitWriter struct {
+    out             *bytes.Buffer
+    acc             uint32
+    nBits           uint
+}
+
+func (bw *bitWriter) write( v uint32, n uint ) {
+    for n > 0 {
+        k := n
+        if k > 8 {
+            k = 8
+        }
+        n -= k
+        bw.acc = bw.acc << k | ( v >> n ) & ( 1 << k - 1 )
+        bw.nBits += k
+        for bw.nBits >= 8 {
+            b := byte( bw.acc >> ( bw.nBits - 8 ) )
+            bw.out.WriteByte( b )
+            if b == 0xff {
+                bw.out.WriteByte( 0x00 )
+            }
+            bw.nBits -= 8
+        }
+    }
+}
+
+// flush pads the last byte with 1 bits
+func (bw *bitWriter) flush( ) {
+    if bw.nBits > 0 {
+        bw.write( 1 << ( 8 - bw.nBits ) - 1, 8 - bw.nBits )
+    }
+    bw.acc = 0
+}
+
+// magnitude returns the category of v and its additional bits
+func magnitude( v int32 ) (uint, uint32) {
+    a := v
+    if a < 0 {
+        a = -a
+        v --
+    }
+    t := uint(0)
+    for a > 0 {
+        a >>= 1
+        t ++
+    }
+    return t, uint32(v) & ( 1 << t - 1 )
+}
+
+// scan encoding state
+type scanEncoder struct {
+    bw              *bitWriter
+    dc, ac          []*huffEncoder
+    pred            []int32
+    ss, se, al      int         // spectral selection and point transform
+}
+
+func (se *scanEncoder) symbol( he *huffEncoder, s byte, what string ) error {
+    if he.size[s] == 0 {
+        return fmt.Errorf( "no Huffman code for %s symbol 0x%02x\n", what, s )
+    }
+    se.bw.write( uint32(he.code[s]), uint(he.size[s]) )
+    return nil
+}
+
+func (se *scanEncoder) encodeBlock( sci int, b *block ) error {
+    if se.ss == 0 {
+        dc := b[0] >> uint(se.al)
+        t, bits := magnitude( dc - se.pred[sci] )
+        se.pred[sci] = dc
+        if err := se.symbol( se.dc[sci], byte(t), "DC" ); err != nil {
+            return err
+        }
+        se.bw.write( bits, t )
+        if se.se == 0 {
+            return nil
+        }
+    }
+    run := 0
+    for k := se.ss; k <= se.se; k++ {
+        if k == 0 {
+            continue
+        }
+        v := b[zigZag[k]]
+        if v < 0 {
+            v = -( -v >> uint(se.al) )
+        } else {
+            v >>= uint(se.al)
+        }
+        if v == 0 {
+            run ++
+            continue
+        }
+        for ; run > 15; run -= 16 {
+            if err := se.symbol( se.ac[sci], 0xf0, "AC" ); err != nil {
+                return err
+            }
+        }
+        s, bits := magnitude( v )
+        if s > 15 {
+            return fmt.Errorf( "AC coefficient %d out of range\n", v )
+        }
+        if err := se.symbol( se.ac[sci], byte(run << 4) | byte(s),
+                             "AC" ); err != nil {
+            return err
+        }
+        se.bw.write( bits, s )
+        run = 0
+    }
+    if run > 0 {
+        return se.symbol( se.ac[sci], 0x00, "AC" )
+    }
+    return nil
+}
+
+// encodeScan writes the entropy-coded data of a sequential scan or of a
+// progressive first scan from the coefficients of img, including RSTn markers
+func (img *coefImage) encodeScan( out *bytes.Buffer, sos []byte,
+                                  ct *codingTables ) error {
+    fh := img.frame
+    ns, err := scanComponents( sos )
+    if err != nil {
+        return err
+    }
+    se := &scanEncoder{ bw: &bitWriter{ out: out }, pred: make( []int32, ns ),
+                        se: 63 }
+    if fh.marker == markerSOF0 + 2 {
+        se.ss, se.se = int(sos[1+2*ns]), int(sos[2+2*ns])
+        se.al = int(sos[3+2*ns] & 0x0f)
+        if sos[3+2*ns] >> 4 != 0 {
+            return fmt.Errorf( "successive approximation refinement scans " +
+                               "cannot be encoded\n" )
+        }
+        if se.se > 63 || se.ss > se.se || ( se.ss == 0 && se.se != 0 ) ||
+           ( se.ss > 0 && ns != 1 ) {
+            return fmt.Errorf( "invalid progressive scan %d-%d\n", se.ss,
+                               se.se )
+        }
+    }
+    var comps []int
+    for i := 0; i < ns; i++ {
+        id, tables := sos[1+2*i], sos[2+2*i]
+        ci := -1
+        for j, c := range fh.comps {
+            if c.id == id {
+                ci = j
+            }
+        }
+        dc, ac := ct.dc[tables >> 4 & 3], ct.ac[tables & 3]
+        if ci == -1 || ( dc == nil && se.ss == 0 ) || ( ac == nil && se.se > 0 ) {
+            return fmt.Errorf( "invalid scan component %d\n", id )
+        }
+        comps = append( comps, ci )
+        var dce, ace *huffEncoder
+        if se.ss == 0 {
+            dce = newHuffEncoder( dc )
+        }
+        if se.se > 0 {
+            ace = newHuffEncoder( ac )
+        }
+        se.dc = append( se.dc, dce )
+        se.ac = append( se.ac, ace )
+    }
+    var nx, ny int
+    if ns == 1 {
+        nx, ny = fh.compBlocks( comps[0] )
+    } else {
+        nx, ny = fh.mcus()
+    }
+    mcu := 0
+    for my := 0; my < ny; my++ {
+        for mx := 0; mx < nx; mx++ {
+            if ct.restart > 0 && mcu > 0 && mcu % ct.restart == 0 {
+                se.bw.flush()
+                out.Write( []byte{ 0xff, markerRST0 +
+                                   byte( ( mcu / ct.restart - 1 ) % 8 ) } )
+                for i := range se.pred {
+                    se.pred[i] = 0
+                }
+            }
+            for sci, ci := range comps {
+                cc := &img.comps[ci]
+                c := &fh.comps[ci]
+                if ns == 1 {
+                    if err := se.encodeBlock( sci, cc.at( mx, my ) ); err != nil {
+                        return fmt.Errorf( "MCU %d: %v", mcu, err )
+                    }
+                    continue
+                }
+                for v := 0; v < c.v; v++ {
+                    for h := 0; h < c.h; h++ {
+                        b := cc.at( mx * c.h + h, my * c.v + v )
+                        if err := se.encodeBlock( sci, b ); err != nil {
+                            return fmt.Errorf( "MCU %d: %v", mcu, err )
+                        }
+                    }
+                }
+            }
+            mcu ++
+        }
+    }
+    se.bw.flush()
+    return nil
+}
+
+// encodeCoefficients returns data with the entropy-coded data of all scans of
+// the first frame replaced by the coding of the coefficients of img, which
+// must have been decoded from data. Other segments are copied as is.
+func encodeCoefficients( data []byte, l *fileLayout,
+                         img *coefImage ) ([]byte, error) {
+    if img.frame.marker != markerSOF0 && img.frame.marker != markerSOF0 + 1 {
+        return nil, fmt.Errorf( "only Huffman sequential frames can be " +
+                                "encoded\n" )
+    }
+    var ct codingTables
+    var out bytes.Buffer
+    last, frames := 0, 0
+    for i := 0; i < len(l.segments); i++ {
+        s := &l.segments[i]
+        switch {
+        case s.marker == markerDHT:
+            if err := ct.defineHuffman( s.data( data ) ); err != nil {
+                return nil, err
+            }
+        case s.marker == markerDRI:
+            if d := s.data( data ); len(d) >= 2 {
+                ct.restart = int(d[0]) << 8 + int(d[1])
+            }
+        case isSOF( s.marker ):
+            frames ++
+        case s.marker == markerSOS && frames == 1:
+            out.Write( data[last:s.end()] )
+            if err := img.encodeScan( &out, s.data( data ), &ct ); err != nil {
+                return nil, err
+            }
+            last = s.ecsEnd
+            for i + 1 < len(l.segments) &&
+                l.segments[i+1].marker >= markerRST0 &&
+                l.segments[i+1].marker <= markerRST7 {
+                i ++
+                last = l.segments[i].ecsEnd
+            }
+        }
+    }
+    out.Write( data[last:] )
+    return out.Bytes(), nil
+}
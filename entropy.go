@@ -0,0 +1,103 @@
+
+package main
+
+import (
+    "fmt"
+)
+
+// Entropy statistics: how the compressed data is spent, for comparing encoders.
+
+func percent( part, total int64 ) float64 {
+    if total == 0 {
+        return 0
+    }
+    return 100 * float64(part) / float64(total)
+}
+
+// entropyCodedBytes returns the total size of entropy-coded data in the first
+// image of the file, the number of stuffed bytes it contains, and the size of
+// RSTn markers
+func entropyCodedBytes( data []byte, l *fileLayout ) (ecs, stuffed, rst int) {
+    for _, s := range l.segments {
+        if s.marker == markerEOI {
+            break
+        }
+        if s.ecsEnd == 0 {
+            continue
+        }
+        ecs += s.ecsEnd - s.end()
+        for i := s.end(); i < s.ecsEnd - 1; i++ {
+            if data[i] == 0xff && data[i+1] == 0x00 {
+                stuffed ++
+                i++
+            }
+        }
+        if s.marker != markerSOS {
+            rst += 2
+        }
+    }
+    return
+}
+
+func formatEntropyStats( data []byte, l *fileLayout ) {
+    ecs, stuffed, rst := entropyCodedBytes( data, l )
+    size := int64(l.size)
+    for _, s := range l.segments {
+        if s.marker == markerEOI {
+            size = int64(s.end())       // first image only
+            break
+        }
+    }
+    fmt.Printf( "Entropy statistics:\n" )
+    fmt.Printf( "  Entropy-coded data: %d bytes (%.2f%% of file)\n",
+                ecs, percent( int64(ecs), size ) )
+    fmt.Printf( "  Stuffed bytes: %d (%.3f%% of entropy-coded data)\n",
+                stuffed, percent( int64(stuffed), int64(ecs) ) )
+    overhead := size - int64(ecs)
+    fmt.Printf( "  Marker overhead: %d bytes (%.2f%% of file), including %d " +
+                "bytes of RSTn markers\n", overhead, percent( overhead, size ),
+                rst )
+
+    for i := range l.segments {
+        if ! isSOF( l.segments[i].marker ) {
+            continue
+        }
+        fh, err := parseFrameHeader( &l.segments[i], data )
+        if err == nil && fh.width * fh.height > 0 {
+            fmt.Printf( "  Compressed bits per pixel: %.3f (%dx%d)\n",
+                        float64(ecs * 8) / float64(fh.width * fh.height),
+                        fh.width, fh.height )
+        }
+        break
+    }
+
+    img, err := decodeCoefficients( data, l )
+    if err != nil {
+        fmt.Printf( "  Bit allocation not available: %v", err )
+        return
+    }
+    fh := img.frame
+    if ! isArithmetic( fh.marker ) {    // decoding speed: BenchmarkHuffman
+        fmt.Printf( "  Huffman codes: %d, %.2f%% decoded by %d-bit lookup\n",
+                    img.codes, percent( img.lookupCodes, img.codes ),
+                    huffLookupBits )
+    }
+    var dc, ac int64
+    for _, cc := range img.comps {
+        dc += cc.dcBits
+        ac += cc.acBits
+    }
+    total := dc + ac
+    fmt.Printf( "  %-9s %10s %8s %12s %8s %12s %8s\n", "Component", "Bytes",
+                "Share", "DC bits", "DC", "AC bits", "AC" )
+    for ci, cc := range img.comps {
+        bits := cc.dcBits + cc.acBits
+        fmt.Printf( "  %-9d %10d %7.2f%% %12d %7.2f%% %12d %7.2f%%\n",
+                    fh.comps[ci].id, ( bits + 7 ) / 8, percent( bits, total ),
+                    cc.dcBits, percent( cc.dcBits, bits ),
+                    cc.acBits, percent( cc.acBits, bits ) )
+    }
+    fmt.Printf( "  %-9s %10d %7.2f%% %12d %7.2f%% %12d %7.2f%%\n", "Total",
+                ( total + 7 ) / 8, 100.0, dc, percent( dc, total ),
+                ac, percent( ac, total ) )
+}
@@ -0,0 +1,109 @@
+
+package main
+
+import (
+    "github.com/jrm-1535/jpeg"
+)
+
+// Enumerated values in machine output: the orientation, the visual effect it
+// requires and the chroma subsampling are given in json as stable enum
+// strings, such as "rotate90cw" or "4:2:0", separate from the human text, so
+// that consumers do not have to parse descriptions. The enum strings must not
+// change once published; the descriptions can.
+
+type enumValue struct {
+    enum            string      // stable machine name
+    description     string      // human text
+}
+
+// effects is indexed by jpeg.VisualEffect
+var effects = [...]enumValue {
+    { "none", "no transformation" },
+    { "mirrorVertical", "vertical mirror" },
+    { "rotate90cw", "90 degree clockwise rotation" },
+    { "mirrorVerticalRotate90cw",
+      "vertical mirror and 90 degree clockwise rotation" },
+    { "mirrorHorizontal", "horizontal mirror" },
+    { "rotate180", "180 degree rotation" },
+    { "mirrorHorizontalRotate90cw",
+      "horizontal mirror and 90 degree clockwise rotation" },
+    { "rotate270cw", "270 degree clockwise rotation" },
+}
+
+// sides is indexed by jpeg.VisualSide
+var sides = [...]enumValue {
+    { "left", "Left" },
+    { "top", "Top" },
+    { "right", "Right" },
+    { "bottom", "Bottom" },
+}
+
+// orientationEffects gives the effect required by each tiff/exif orientation
+// value, from 1 (TL) to 8 (LB), in the order of the orientation names
+var orientationEffects = [...]jpeg.VisualEffect {
+    jpeg.None, jpeg.VerticalMirror, jpeg.Rotate180, jpeg.HorizontalMirror,
+    jpeg.HorizontalMirrorRotate90, jpeg.Rotate90, jpeg.VerticalMirrorRotate90,
+    jpeg.Rotate270,
+}
+
+func effectEnum( e jpeg.VisualEffect ) enumValue {
+    if e < 0 || int(e) >= len(effects) {
+        return enumValue{ "unknown", "unknown effect" }
+    }
+    return effects[e]
+}
+
+func sideEnum( s jpeg.VisualSide ) enumValue {
+    if s < 0 || int(s) >= len(sides) {
+        return enumValue{ "unknown", "Unknown" }
+    }
+    return sides[s]
+}
+
+type jsonOrientation struct {
+    Value           int         `json:"value"`          // tiff/exif tag value
+    Name            string      `json:"name"`           // TL to LB
+    Effect          string      `json:"effect"`         // enum
+    Description     string      `json:"description"`
+}
+
+// newJsonOrientation returns the orientation for the tiff/exif value o, from
+// 1 to 8
+func newJsonOrientation( o int ) *jsonOrientation {
+    if o < 1 || o > len(orientationEffects) {
+        o = 1
+    }
+    e := effects[orientationEffects[o-1]]
+    return &jsonOrientation{ Value: o, Name: orientation[o-1],
+                             Effect: e.enum, Description: e.description }
+}
+
+// subsamplingEnum returns the chroma subsampling of a frame given the
+// horizontal and vertical sampling factors of its components: "gray" for a
+// single component, "4:4:4", "4:2:2", "4:2:0", "4:4:0", "4:1:1" or "4:1:0"
+// when all chroma components share the same factors, otherwise "other"
+func subsamplingEnum( h, v []int ) string {
+    switch {
+    case len(h) == 0 || len(h) != len(v):
+        return "other"
+    case len(h) == 1:
+        return "gray"
+    }
+    for i := 2; i < len(h); i++ {
+        if h[i] != h[1] || v[i] != v[1] {
+            return "other"
+        }
+    }
+    if h[1] == 0 || v[1] == 0 || h[0] % h[1] != 0 || v[0] % v[1] != 0 {
+        return "other"
+    }
+    switch [2]int{ h[0] / h[1], v[0] / v[1] } {
+    case [2]int{ 1, 1 }:    return "4:4:4"
+    case [2]int{ 2, 1 }:    return "4:2:2"
+    case [2]int{ 2, 2 }:    return "4:2:0"
+    case [2]int{ 1, 2 }:    return "4:4:0"
+    case [2]int{ 4, 1 }:    return "4:1:1"
+    case [2]int{ 4, 2 }:    return "4:1:0"
+    }
+    return "other"
+}
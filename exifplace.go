@@ -0,0 +1,130 @@
+
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "strings"
+)
+
+// Exif placement: Exif metadata must be stored in an APP1 segment immediately
+// after SOI, or after the JFIF APP0 segment and its JFXX extension for JFIF
+// compatibility. Some phones write it in an APP2 segment, or after an XMP APP1
+// segment or the tables, where most readers ignore it: the metadata is then
+// invisible. Such placements are reported, and with -tidyup the Exif block is
+// moved as APP1 to its expected position before the analysis. An Exif block
+// found outside APP1 is only moved if there is no Exif APP1 segment already.
+
+type exifPlacement struct {
+    s               *segment
+    problem         string      // empty if correctly placed
+}
+
+// exifPlacements returns all Exif blocks found before the first scan of data,
+// with their placement problems if any.
+func exifPlacements( data []byte, l *fileLayout ) (exifs []exifPlacement) {
+    expected := true                    // nothing but SOI, JFIF, JFXX before
+    var previous string
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.marker == markerSOS || s.marker == markerEOI {
+            break
+        }
+        if s.marker == markerSOI {
+            continue
+        }
+        rank, name := rankOther, markerName( s.marker )
+        if s.marker >= markerAPP0 && s.marker <= markerAPP15 {
+            rank, name = metadataSegmentRank( s, data )
+        }
+        if exifTiffData( s.data( data ) ) != nil {
+            e := exifPlacement{ s: s }
+            switch {
+            case s.marker != markerAPP0 + 1:
+                e.problem = fmt.Sprintf( "Exif in %s instead of APP1 @0x%x",
+                                         markerName( s.marker ), s.offset )
+            case ! expected:
+                e.problem = fmt.Sprintf( "Exif APP1 @0x%x after %s", s.offset,
+                                         previous )
+            }
+            exifs = append( exifs, e )
+        }
+        if rank != rankJfif && rank != rankJfxx {
+            expected = false
+            if previous == "" {
+                previous = name
+            }
+        }
+    }
+    return
+}
+
+// relocateExif returns a copy of data with the misplaced Exif block moved as
+// APP1 right after SOI and JFIF segments, with a description of the change, or
+// nil if there is nothing to move.
+func relocateExif( data []byte, l *fileLayout ) ([]byte, string) {
+    exifs := exifPlacements( data, l )
+    var moved *exifPlacement
+    for i := range exifs {
+        e := &exifs[i]
+        if e.s.marker == markerAPP0 + 1 {   // APP1 takes precedence
+            if e.problem == "" {
+                return nil, ""
+            }
+            moved = e
+            break
+        }
+        if moved == nil && e.problem != "" {
+            moved = e
+        }
+    }
+    if moved == nil {
+        return nil, ""
+    }
+    at := 2
+    for i := 1; i < len(l.segments); i++ {
+        s := &l.segments[i]
+        if s.marker != markerAPP0 || s.offset != at {
+            break
+        }
+        if rank, _ := metadataSegmentRank( s, data ); rank != rankJfif &&
+                                                   rank != rankJfxx {
+            break
+        }
+        at = s.end()
+    }
+    s := moved.s
+    var b bytes.Buffer
+    b.Write( data[:at] )
+    b.Write( []byte{ 0xff, markerAPP0 + 1 } )
+    b.Write( data[s.offset+2:s.end()] )
+    b.Write( data[at:s.offset] )
+    b.Write( data[s.end():] )
+    return b.Bytes(), fmt.Sprintf( "%s moved as APP1 to 0x%x", moved.problem,
+                                   at )
+}
+
+// formatExifPlacement reports the Exif blocks in data that are not where
+// readers expect them.
+func formatExifPlacement( data []byte, l *fileLayout, rep *fileReport,
+                          fix bool ) {
+    var problems []string
+    for _, e := range exifPlacements( data, l ) {
+        if e.problem != "" {
+            problems = append( problems, e.problem )
+        }
+    }
+    if len(problems) == 0 {
+        return
+    }
+    text := "Nonstandard Exif placement: " + strings.Join( problems, ", " )
+    if moved, _ := relocateExif( data, l ); moved != nil {
+        if fix {
+            text += " (relocated by -tidyup)"
+        } else {
+            text += " (can be relocated with -tidyup)"
+        }
+    }
+    fmt.Printf( "%s\n", text )
+    rep.addMessage( warningSeverity, codeExifPlacement, text )
+}
@@ -0,0 +1,255 @@
+
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "os/exec"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Comparison with exiftool: before an archive switches tools, the metadata
+// read by jcheck is compared with the metadata read by exiftool on the same
+// files. exiftool is run with numeric values (-n) and family 1 group names
+// (-G1), and both sides are normalized before comparison: names are mapped,
+// rationals are compared as decimal values and a few values that exiftool
+// converts even with -n are converted in the same way.
+
+// exiftoolGroups maps jcheck container.group names to exiftool family 1 groups
+var exiftoolGroups = map[string]string{
+    "jfif.app0":        "JFIF",
+    "exif.ifd0":        "IFD0",
+    "exif.ifd1":        "IFD1",
+    "exif.exif":        "ExifIFD",
+    "exif.gps":         "GPS",
+    "exif.interop":     "InteropIFD",
+    "exif.subifd":      "SubIFD",
+    "mpf.index":        "MPF0",
+}
+
+// exiftoolNames maps jcheck tag names to exiftool tag names, where different
+var exiftoolNames = map[string]string{
+    "Version":                      "JFIFVersion",
+    "Units":                        "ResolutionUnit",
+    "XDensity":                     "XResolution",
+    "YDensity":                     "YResolution",
+    "XThumbnail":                   "ThumbnailWidth",
+    "YThumbnail":                   "ThumbnailHeight",
+    "ImageLength":                  "ImageHeight",
+    "DateTime":                     "ModifyDate",
+    "DateTimeDigitized":            "CreateDate",
+    "PhotographicSensitivity":      "ISO",
+    "ExposureBiasValue":            "ExposureCompensation",
+    "PixelXDimension":              "ExifImageWidth",
+    "PixelYDimension":              "ExifImageHeight",
+    "JPEGInterchangeFormat":        "ThumbnailOffset",
+    "JPEGInterchangeFormatLength":  "ThumbnailLength",
+    "InteroperabilityIndex":        "InteropIndex",
+    "InteroperabilityVersion":      "InteropVersion",
+    "FocalLengthIn35mmFilm":        "FocalLengthIn35mmFormat",
+    "CameraOwnerName":              "OwnerName",
+    "BodySerialNumber":             "SerialNumber",
+    "LensSpecification":            "LensInfo",
+}
+
+// exiftoolIgnored are the tags that exiftool does not report as such
+var exiftoolIgnored = map[string]bool{
+    "ExifIFDPointer": true, "GPSInfoIFDPointer": true,
+    "InteroperabilityIFDPointer": true, "SubIFDs": true,
+    "MakerNote": true, "MPEntry": true, "ExtensionCode": true,
+}
+
+// numbers returns the decimal values of a jcheck value, or nil if the value
+// is not numeric
+func numbers( v interface{} ) []float64 {
+    switch v := v.(type) {
+    case metaRational:
+        if v.Value == nil {
+            return []float64{ math.Inf( 1 ) }
+        }
+        return []float64{ *v.Value }
+    case []interface{}:
+        var list []float64
+        for _, e := range v {
+            n := numbers( e )
+            if n == nil {
+                return nil
+            }
+            list = append( list, n... )
+        }
+        return list
+    case string, []byte, nil:
+        return nil
+    }
+    f, err := strconv.ParseFloat( fmt.Sprint( v ), 64 )
+    if err != nil {
+        return nil
+    }
+    return []float64{ f }
+}
+
+// exiftoolValue converts a jcheck tag value into the value exiftool gives
+// with -n: byte arrays as numbers, undefined arrays as text.
+func exiftoolValue( mt *metaTag ) string {
+    name := mt.Name
+    n := numbers( mt.Value )
+    if b, ok := mt.Value.([]byte); ok && mt.Type == "BYTE" {
+        for _, v := range b {
+            n = append( n, float64(v) )
+        }
+    }
+    switch {
+    case n == nil:
+        if b, ok := mt.Value.([]byte); ok {
+            return strings.TrimRight( string( b ), "\x00 " )
+        }
+        return strings.TrimSpace( fmt.Sprint( mt.Value ) )
+    case ( name == "GPSLatitude" || name == "GPSLongitude" ||
+           name == "GPSDestLatitude" || name == "GPSDestLongitude" ) &&
+         len(n) == 3:
+        n = []float64{ n[0] + n[1] / 60 + n[2] / 3600 }
+    case name == "GPSTimeStamp" && len(n) == 3:
+        return fmt.Sprintf( "%02d:%02d:%s", int(n[0]), int(n[1]),
+                            strconv.FormatFloat( n[2], 'f', -1, 64 ) )
+    case ( name == "ApertureValue" || name == "MaxApertureValue" ) &&
+         len(n) == 1:
+        n[0] = math.Pow( 2, n[0] / 2 )
+    case name == "ShutterSpeedValue" && len(n) == 1:
+        n[0] = math.Pow( 2, -n[0] )
+    }
+    values := make( []string, len(n) )
+    for i, f := range n {
+        values[i] = strconv.FormatFloat( f, 'g', -1, 64 )
+    }
+    return strings.Join( values, " " )
+}
+
+// sameValue compares two normalized values, numbers with a relative tolerance
+// since exiftool rounds some conversions
+func sameValue( a, b string ) bool {
+    if a == b {
+        return true
+    }
+    fa, fb := strings.Fields( a ), strings.Fields( b )
+    if len(fa) != len(fb) || len(fa) == 0 {
+        return false
+    }
+    for i := range fa {
+        x, err1 := strconv.ParseFloat( fa[i], 64 )
+        y, err2 := strconv.ParseFloat( fb[i], 64 )
+        if err1 != nil || err2 != nil {
+            if fa[i] != fb[i] {
+                return false
+            }
+            continue
+        }
+        if math.Abs( x - y ) > 1e-4 * math.Max( math.Abs( x ), math.Abs( y ) ) &&
+           math.Abs( x - y ) > 1e-6 {
+            return false
+        }
+    }
+    return true
+}
+
+// runExiftool returns the tags reported by exiftool for the file at path,
+// indexed by group:name
+func runExiftool( path string ) (map[string]string, error) {
+    out, err := exec.Command( "exiftool", "-json", "-n", "-G1", "-a", "-u",
+                              "--", path ).Output()
+    if err != nil {
+        if _, ok := err.(*exec.ExitError); ! ok {
+            return nil, fmt.Errorf( "unable to run exiftool: %v\n", err )
+        }
+        if len(out) == 0 {
+            return nil, fmt.Errorf( "exiftool failed: %v\n", err )
+        }
+    }
+    var docs []map[string]interface{}
+    if err = json.Unmarshal( out, &docs ); err != nil || len(docs) != 1 {
+        return nil, fmt.Errorf( "unexpected exiftool output: %v\n", err )
+    }
+    tags := make( map[string]string )
+    for k, v := range docs[0] {
+        switch v := v.(type) {
+        case float64:
+            tags[k] = strconv.FormatFloat( v, 'g', -1, 64 )
+        default:
+            tags[k] = strings.TrimSpace( fmt.Sprint( v ) )
+        }
+    }
+    return tags, nil
+}
+
+// compareWithExiftool prints the tags for which jcheck and exiftool disagree,
+// the tags found by only one of them in the groups known to both, and adds a
+// warning to the report for each disagreement.
+func compareWithExiftool( path string, data []byte, l *fileLayout,
+                          rep *fileReport ) error {
+    et, err := runExiftool( path )
+    if err != nil {
+        return err
+    }
+    mapped := make( map[string]bool )
+    for _, g := range exiftoolGroups {
+        mapped[g] = true
+    }
+    var differ, missing []string
+    seen := make( map[string]bool )
+    compared := 0
+    for _, mc := range collectMetadata( data, l ) {
+        for _, g := range mc.Groups {
+            group, ok := exiftoolGroups[mc.Name + "." + g.Name]
+            if ! ok {
+                continue
+            }
+            for i := range g.Tags {
+                mt := &g.Tags[i]
+                if exiftoolIgnored[mt.Name] {
+                    continue
+                }
+                name := mt.Name
+                if n, ok := exiftoolNames[name]; ok {
+                    name = n
+                }
+                key := group + ":" + name
+                seen[key] = true
+                ours := exiftoolValue( mt )
+                theirs, ok := et[key]
+                compared ++
+                switch {
+                case ! ok:
+                    missing = append( missing, fmt.Sprintf(
+                            "%s: only in jcheck (%s)", key, ours ) )
+                case ! sameValue( ours, theirs ):
+                    differ = append( differ, fmt.Sprintf(
+                            "%s: jcheck %q, exiftool %q", key, ours, theirs ) )
+                }
+            }
+        }
+    }
+    for key, v := range et {
+        i := strings.IndexByte( key, ':' )
+        if i == -1 || ! mapped[key[:i]] || seen[key] {
+            continue
+        }
+        missing = append( missing, fmt.Sprintf( "%s: only in exiftool (%s)",
+                                                key, v ) )
+    }
+    sort.Strings( differ )
+    sort.Strings( missing )
+    fmt.Printf( "Comparison with exiftool: %d tag(s) compared, %d different, " +
+                "%d found by one tool only\n", compared, len(differ),
+                len(missing) )
+    for _, d := range differ {
+        fmt.Printf( "  differ  %s\n", d )
+        rep.addMessage( warningSeverity, codeExiftool,
+                        "exiftool comparison: " + d )
+    }
+    for _, m := range missing {
+        fmt.Printf( "  missing %s\n", m )
+    }
+    return nil
+}
@@ -0,0 +1,156 @@
+
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "image"
+    "image/draw"
+    stdjpeg "image/jpeg"
+    "strings"
+)
+
+// Exposure check (-exposure-check): digitization batches are triaged on the
+// capture quality, so the histogram of the picture is computed from the
+// decoded samples and the pixels whose channels are all clipped are counted:
+// a pixel is a clipped highlight if its R, G and B are all at least 254, and
+// a clipped shadow if they are all at most 1, which tolerates the rounding of
+// the decoder. A file is flagged if the percentage of clipped highlights
+// exceeds -clip-highlights (default 1%) or the percentage of clipped shadows
+// exceeds -clip-shadows (default 1%), which is reported as a warning. The
+// mean luma, the percentages and the flags are given in the csv and json
+// reports.
+
+const (
+    clipHigh                = 254       // lowest clipped highlight level
+    clipLow                 = 1         // highest clipped shadow level
+    defaultClipHighlights   = 1.0       // percent
+    defaultClipShadows      = 1.0       // percent
+)
+
+type exposureThresholds struct {
+    highlights      float64     // largest percentage of clipped highlights
+    shadows         float64     // largest percentage of clipped shadows
+}
+
+// newExposureThresholds checks and returns the thresholds of -exposure-check
+func newExposureThresholds( highlights,
+                            shadows float64 ) (*exposureThresholds, error) {
+    for _, t := range []float64{ highlights, shadows } {
+        if t < 0 || t > 100 {
+            return nil, fmt.Errorf( "invalid percentage %g (0 to 100)\n", t )
+        }
+    }
+    return &exposureThresholds{ highlights, shadows }, nil
+}
+
+// exposureInfo is the exposure of a file, recorded in its report
+type exposureInfo struct {
+    histogram       [256]int    // of Rec.601 luma
+    meanLuma        float64
+    highlights      float64     // percentage of clipped highlights
+    shadows         float64     // percentage of clipped shadows
+    flags           []string    // highlights, shadows
+}
+
+// decodeRGBA decodes the main picture of data in RGBA
+func decodeRGBA( data []byte ) (*image.RGBA, error) {
+    img, err := stdjpeg.Decode( bytes.NewReader( data ) )
+    if err != nil {
+        return nil, err
+    }
+    rgba := image.NewRGBA( img.Bounds().Sub( img.Bounds().Min ) )
+    draw.Draw( rgba, rgba.Rect, img, img.Bounds().Min, draw.Src )
+    return rgba, nil
+}
+
+// analyseExposure returns the histogram and the clipping of img, flagged
+// according to et
+func analyseExposure( img *image.RGBA, et *exposureThresholds ) *exposureInfo {
+    ei := &exposureInfo{ }
+    w, h := img.Rect.Dx(), img.Rect.Dy()
+    if w * h == 0 {
+        return ei
+    }
+    high, low := 0, 0
+    var sum float64
+    for y := 0; y < h; y++ {
+        p := img.Pix[img.PixOffset( img.Rect.Min.X, img.Rect.Min.Y + y ):]
+        for x := 0; x < w; x++ {
+            r, g, b := p[4*x], p[4*x+1], p[4*x+2]
+            l := 0.299 * float64(r) + 0.587 * float64(g) + 0.114 * float64(b)
+            ei.histogram[clampSample( l )]++
+            sum += l
+            switch {
+            case r >= clipHigh && g >= clipHigh && b >= clipHigh:
+                high++
+            case r <= clipLow && g <= clipLow && b <= clipLow:
+                low++
+            }
+        }
+    }
+    n := float64(w * h)
+    ei.meanLuma = sum / n
+    ei.highlights = 100 * float64(high) / n
+    ei.shadows = 100 * float64(low) / n
+    if ei.highlights > et.highlights {
+        ei.flags = append( ei.flags, "highlights" )
+    }
+    if ei.shadows > et.shadows {
+        ei.flags = append( ei.flags, "shadows" )
+    }
+    return ei
+}
+
+// percentile returns the luma level below which pc percent of the pixels are
+func (ei *exposureInfo) percentile( pc float64 ) int {
+    total := 0
+    for _, c := range ei.histogram {
+        total += c
+    }
+    limit, n := pc / 100 * float64(total), 0
+    for level, c := range ei.histogram {
+        n += c
+        if float64(n) >= limit {
+            return level
+        }
+    }
+    return 255
+}
+
+// formatExposureCheck decodes the picture in data, prints its exposure and
+// records it in rep, reporting clipping beyond the thresholds of et as a
+// warning
+func formatExposureCheck( data []byte, et *exposureThresholds,
+                          rep *fileReport ) {
+    img, err := decodeRGBA( data )
+    if err != nil {
+        fmt.Printf( "Exposure: unable to decode the picture: %v\n", err )
+        rep.addMessage( infoSeverity, codeExposure, "exposure check not done" )
+        return
+    }
+    ei := analyseExposure( img, et )
+    rep.exposure = ei
+    fmt.Printf( "Exposure: mean luma %.1f, luma at 1%% %d, median %d, at " +
+                "99%% %d\n", ei.meanLuma, ei.percentile( 1 ),
+                ei.percentile( 50 ), ei.percentile( 99 ) )
+    fmt.Printf( "  Clipped highlights %.2f%%, clipped shadows %.2f%%\n",
+                ei.highlights, ei.shadows )
+    var clipped []string
+    for _, f := range ei.flags {
+        switch f {
+        case "highlights":
+            clipped = append( clipped, fmt.Sprintf( "highlights %.2f%%",
+                                                    ei.highlights ) )
+        case "shadows":
+            clipped = append( clipped, fmt.Sprintf( "shadows %.2f%%",
+                                                    ei.shadows ) )
+        }
+    }
+    if len(clipped) == 0 {
+        return
+    }
+    text := "exposure: severe clipping of " + strings.Join( clipped, " and " )
+    fmt.Printf( "  Warning: %s\n", text )
+    rep.addMessage( warningSeverity, codeExposure, text )
+}
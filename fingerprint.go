@@ -0,0 +1,397 @@
+
+package main
+
+import (
+    "fmt"
+    "strings"
+)
+
+// Encoder fingerprint (-fingerprint): the choices made by an encoder identify
+// it well, and answer provenance questions quickly. The first signal is
+// whether the Huffman tables are exactly the example tables of T.81 Annex
+// K.3, which most camera firmware and simple encoders use as is. Other tables
+// are classified as optimized (a complete canonical code but for the one
+// reserved codeword, as built from symbol statistics by libjpeg), fixed (a
+// custom table covering all possible symbols) or unusual, with the reasons:
+// symbols invalid for their class, unassigned codes or a table never used by
+// any scan. Quantization tables are compared with the Annex K tables scaled
+// for a quality (as done by IJG libjpeg), and the coding process, sampling
+// factors, restart interval and order of the segments before the first scan
+// complete a one-line signature that can be used to group files.
+
+const (
+    huffStandard    = "Annex K"
+    huffOptimized   = "optimized"
+    huffFixed       = "fixed"
+    huffUnusual     = "unusual"
+)
+
+type annexKHuffTable struct {
+    class           string
+    name            string
+    counts          [16]byte
+    symbols         []byte
+}
+
+var annexKHuffTables = []annexKHuffTable{
+    { "dc", "luminance",
+      [16]byte{ 0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0 },
+      []byte{ 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11 } },
+    { "dc", "chrominance",
+      [16]byte{ 0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0 },
+      []byte{ 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11 } },
+    { "ac", "luminance",
+      [16]byte{ 0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 0x7d },
+      []byte{
+        0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+        0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+        0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+        0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+        0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+        0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+        0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+        0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+        0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+        0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+        0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+        0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+        0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+        0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+        0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+        0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+        0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+        0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+        0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+        0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+        0xf9, 0xfa } },
+    { "ac", "chrominance",
+      [16]byte{ 0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 0x77 },
+      []byte{
+        0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+        0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+        0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+        0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+        0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+        0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+        0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+        0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+        0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+        0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+        0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+        0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+        0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+        0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+        0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+        0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+        0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+        0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+        0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+        0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+        0xf9, 0xfa } },
+}
+
+// standard chrominance quantization table (T.81 Annex K.1), in natural order
+var standardChrominanceQuant = [64]uint16{
+    17, 18, 24, 47, 99, 99, 99, 99,
+    18, 21, 26, 66, 99, 99, 99, 99,
+    24, 26, 56, 99, 99, 99, 99, 99,
+    47, 66, 99, 99, 99, 99, 99, 99,
+    99, 99, 99, 99, 99, 99, 99, 99,
+    99, 99, 99, 99, 99, 99, 99, 99,
+    99, 99, 99, 99, 99, 99, 99, 99,
+    99, 99, 99, 99, 99, 99, 99, 99 }
+
+type huffVerdict struct {
+    table           huffTableText
+    kind            string
+    detail          string
+}
+
+// matches returns true if t is the Annex K table ak
+func (ak *annexKHuffTable) matches( t *huffTableText ) bool {
+    if t.Class != ak.class || len(t.Symbols) != len(ak.symbols) {
+        return false
+    }
+    for i, c := range ak.counts {
+        if t.Counts[i] != int(c) {
+            return false
+        }
+    }
+    for i, s := range ak.symbols {
+        if t.Symbols[i] != int(s) {
+            return false
+        }
+    }
+    return true
+}
+
+// classifyHuffTable returns the verdict for the table t, in the frame fh,
+// used or not by some scan. Progressive frames code runs of end of band with
+// AC symbols of size 0.
+func classifyHuffTable( t *huffTableText, fh *frameHeader,
+                        used bool ) huffVerdict {
+    hv := huffVerdict{ table: *t }
+    for i := range annexKHuffTables {
+        if annexKHuffTables[i].matches( t ) {
+            hv.kind, hv.detail = huffStandard, annexKHuffTables[i].name
+            return hv
+        }
+    }
+    var reasons []string
+    invalid, precision := 0, fh.precision
+    progressive := fh.marker == markerSOF0 + 2 || fh.marker == markerSOF0 + 6
+    for _, s := range t.Symbols {
+        size := s & 0x0f
+        if t.Class == "dc" && s > precision + 3 {
+            invalid ++
+        } else if t.Class == "ac" && ( size > precision + 2 ||
+                                       ( size == 0 && s != 0x00 &&
+                                         s != 0xf0 && ! progressive ) ) {
+            invalid ++
+        }
+    }
+    if invalid > 0 {
+        reasons = append( reasons, fmt.Sprintf( "%d symbol(s) invalid for " +
+                                                "class", invalid ) )
+    }
+    space, maxLength := 0, 0            // in codes of 16 bits
+    for l, c := range t.Counts {
+        space += c << uint(15 - l)
+        if c > 0 {
+            maxLength = l + 1
+        }
+    }
+    complete := 1 << 16 - 1 << uint(16 - maxLength)
+    if space < complete {
+        reasons = append( reasons, fmt.Sprintf( "%.1f%% of code space " +
+                                                "unassigned",
+                          100 * float64(complete - space) / ( 1 << 16 ) ) )
+    }
+    if ! used {
+        reasons = append( reasons, "not used by any scan" )
+    }
+    all := 12
+    if t.Class == "ac" {
+        all = 162
+    }
+    switch {
+    case len(reasons) > 0:
+        hv.kind, hv.detail = huffUnusual, strings.Join( reasons, ", " )
+    case len(t.Symbols) >= all:
+        hv.kind, hv.detail = huffFixed, "all symbols coded"
+    default:
+        hv.kind = huffOptimized
+        hv.detail = fmt.Sprintf( "%d symbols coded", len(t.Symbols) )
+    }
+    return hv
+}
+
+// ijgQuality returns the quality for which the Annex K table scaled as by IJG
+// libjpeg is qt, with the name of the table, or 0 if there is none
+func ijgQuality( qt *quantTable ) (int, string) {
+    if qt.precision != 0 {
+        return 0, ""
+    }
+    tables := []*[64]uint16{ &standardLuminanceQuant,
+                             &standardChrominanceQuant }
+    names := []string{ "luminance", "chrominance" }
+    for quality := 100; quality > 0; quality-- {
+        for i, table := range tables {
+            scaled := scaledQuant( table, quality )
+            k := 0
+            for ; k < 64; k++ {
+                if float64(qt.values[k]) != scaled[zigZag[k]] {
+                    break
+                }
+            }
+            if k == 64 {
+                return quality, names[i]
+            }
+        }
+    }
+    return 0, ""
+}
+
+type encoderFingerprint struct {
+    process         string
+    precision       int
+    sampling        string
+    restart         int
+    scans           int
+    huffman         []huffVerdict
+    quant           []string
+    segments        string
+    standard        bool        // all Huffman tables are Annex K tables
+    summary         string      // standard, optimized, fixed or unusual
+    qsummary        string
+}
+
+// fingerprint returns the encoder fingerprint of the first image in data
+func fingerprint( data []byte, l *fileLayout ) (*encoderFingerprint, error) {
+    ef := new( encoderFingerprint )
+    var fh *frameHeader
+    used := make( map[int]bool )    // by class << 4 | destination
+    var segments []string
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.marker == markerEOI {
+            break
+        }
+        if ef.scans == 0 && s.marker != markerSOI &&
+           ! ( s.marker >= markerRST0 && s.marker <= markerRST7 ) {
+            segments = append( segments, markerName( s.marker ) )
+        }
+        switch {
+        case isSOF( s.marker ) && fh == nil:
+            var err error
+            if fh, err = parseFrameHeader( s, data ); err != nil {
+                return nil, err
+            }
+        case s.marker == markerDRI:
+            if d := s.data( data ); len(d) >= 2 && ef.scans == 0 {
+                ef.restart = int(d[0]) << 8 + int(d[1])
+            }
+        case s.marker == markerSOS:
+            ef.scans ++
+            d := s.data( data )
+            for j := 0; len(d) > 0 && j < int(d[0]) && 2 + 2 * j < len(d);
+                j++ {
+                used[int(d[2+2*j] >> 4)] = true
+                used[0x10 | int(d[2+2*j] & 0x0f)] = true
+            }
+        }
+    }
+    if fh == nil {
+        return nil, fmt.Errorf( "no frame header\n" )
+    }
+    ef.process = markerName( fh.marker )
+    ef.precision = fh.precision
+    var sampling []string
+    for _, c := range fh.comps {
+        sampling = append( sampling, fmt.Sprintf( "%dx%d", c.h, c.v ) )
+    }
+    ef.sampling = strings.Join( sampling, "," )
+    ef.segments = strings.Join( segments, "," )
+
+    tables, err := huffTableDefinitions( data, l )
+    if err != nil {
+        return nil, err
+    }
+    ef.standard = len(tables) > 0
+    kinds := make( map[string]bool )
+    for i := range tables {
+        t := &tables[i]
+        tc := 0
+        if t.Class == "ac" {
+            tc = 1
+        }
+        hv := classifyHuffTable( t, fh,
+                                 used[tc << 4 | t.Destination] )
+        ef.huffman = append( ef.huffman, hv )
+        kinds[hv.kind] = true
+        if hv.kind != huffStandard {
+            ef.standard = false
+        }
+    }
+    for _, k := range []string{ huffUnusual, huffFixed, huffOptimized,
+                                huffStandard } {
+        if kinds[k] {
+            ef.summary = k
+            break
+        }
+    }
+    if len(tables) == 0 {
+        ef.summary = "none"
+    }
+
+    quant, err := quantTablesInForce( data, l )
+    if err != nil {
+        return nil, err
+    }
+    qualities := make( map[int]bool )
+    custom := false
+    for d, qt := range quant {
+        if qt == nil {
+            continue
+        }
+        if q, name := ijgQuality( qt ); q > 0 {
+            ef.quant = append( ef.quant, fmt.Sprintf( "table %d: Annex K %s " +
+                                                      "scaled for quality %d",
+                                                      d, name, q ) )
+            qualities[q] = true
+        } else {
+            ef.quant = append( ef.quant, fmt.Sprintf( "table %d: custom", d ) )
+            custom = true
+        }
+    }
+    switch {
+    case custom || len(qualities) == 0:
+        ef.qsummary = "custom"
+    case len(qualities) == 1:
+        for q := range qualities {
+            ef.qsummary = fmt.Sprintf( "ijg%d", q )
+        }
+    default:
+        ef.qsummary = "ijg-mixed"
+    }
+    return ef, nil
+}
+
+// signature returns the fingerprint as a single line
+func (ef *encoderFingerprint) signature( ) string {
+    return fmt.Sprintf( "%s %db %s dri%d scans%d huff=%s quant=%s %s",
+                        ef.process, ef.precision, ef.sampling, ef.restart,
+                        ef.scans, strings.ReplaceAll( ef.summary, " ", "" ),
+                        ef.qsummary, ef.segments )
+}
+
+// formatFingerprint prints the encoder fingerprint of the first image in data
+// and adds the Huffman table signal to the report
+func formatFingerprint( data []byte, l *fileLayout, rep *fileReport ) {
+    fmt.Printf( "Encoder fingerprint:\n" )
+    ef, err := fingerprint( data, l )
+    if err != nil {
+        fmt.Printf( "  Not available: %v", err )
+        return
+    }
+    fmt.Printf( "  Coding: %s, %d-bit, sampling %s, %d scan(s), restart " +
+                "interval %d\n", ef.process, ef.precision, ef.sampling,
+                ef.scans, ef.restart )
+    yes := "no"
+    if ef.standard {
+        yes = "yes"
+    }
+    fmt.Printf( "  Annex K standard Huffman tables: %s\n", yes )
+    for _, hv := range ef.huffman {
+        fmt.Printf( "    %s table %d (before scan %d): %s, %s\n",
+                    hv.table.Class, hv.table.Destination, hv.table.Scan,
+                    hv.kind, hv.detail )
+    }
+    fmt.Printf( "  Quantization tables:\n" )
+    for _, q := range ef.quant {
+        fmt.Printf( "    %s\n", q )
+    }
+    fmt.Printf( "  Segments before first scan: %s\n", ef.segments )
+    fmt.Printf( "  Signature: %s\n", ef.signature() )
+
+    switch ef.summary {
+    case huffStandard:
+        rep.addMessage( infoSeverity, codeFingerprint, "fingerprint: Annex " +
+                        "K standard Huffman tables" )
+    case huffUnusual:
+        var details []string
+        for _, hv := range ef.huffman {
+            if hv.kind == huffUnusual {
+                details = append( details, fmt.Sprintf( "%s table %d: %s",
+                                  hv.table.Class, hv.table.Destination,
+                                  hv.detail ) )
+            }
+        }
+        rep.addMessage( warningSeverity, codeFingerprint, "fingerprint: " +
+                        "unusual custom Huffman tables (" +
+                        strings.Join( details, "; " ) + ")" )
+    default:
+        rep.addMessage( infoSeverity, codeFingerprint, "fingerprint: " +
+                        ef.summary + " Huffman tables" )
+    }
+}
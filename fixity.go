@@ -0,0 +1,198 @@
+
+package main
+
+import (
+    "bufio"
+    "crypto/md5"
+    "crypto/sha1"
+    "crypto/sha256"
+    "crypto/sha512"
+    "encoding/hex"
+    "fmt"
+    "hash"
+    "io"
+    "os"
+    "sort"
+    "strings"
+)
+
+// Fixity checks: checksum manifests use the format of the sha256sum command,
+// which is also the format of BagIt manifests: one line per file made of the
+// hexadecimal checksum, two spaces and the file path.
+
+var checksumAlgorithms = map[string]func() hash.Hash {
+    "md5":      md5.New,
+    "sha1":     sha1.New,
+    "sha256":   sha256.New,
+    "sha512":   sha512.New,
+}
+
+// algorithmFromLength returns the checksum algorithm corresponding to the
+// length of a hexadecimal checksum.
+func algorithmFromLength( l int ) string {
+    switch l {
+    case 32:    return "md5"
+    case 40:    return "sha1"
+    case 64:    return "sha256"
+    case 128:   return "sha512"
+    }
+    return ""
+}
+
+func fileChecksum( path, algorithm string ) (string, error) {
+    f, err := os.Open( path )
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+    h := checksumAlgorithms[algorithm]()
+    if _, err = io.Copy( h, f ); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString( h.Sum( nil ) ), nil
+}
+
+// loadManifest returns the checksums found in a manifest, indexed by path.
+func loadManifest( path string ) (map[string]string, error) {
+    f, err := os.Open( path )
+    if err != nil {
+        return nil, fmt.Errorf( "unable to read manifest %s: %v\n", path, err )
+    }
+    defer f.Close()
+    checksums := make( map[string]string )
+    scanner := bufio.NewScanner( f )
+    for scanner.Scan() {
+        line := strings.TrimRight( scanner.Text(), "\r" )
+        i := strings.IndexAny( line, " \t" )
+        if i <= 0 {
+            continue
+        }
+        file := strings.TrimLeft( line[i:], " \t" )
+        file = strings.TrimPrefix( file, "*" )  // binary mode indicator
+        checksums[file] = strings.ToLower( line[:i] )
+    }
+    if err = scanner.Err(); err != nil {
+        return nil, fmt.Errorf( "unable to read manifest %s: %v\n", path, err )
+    }
+    return checksums, nil
+}
+
+type checksumSpec struct {
+    algorithm       string
+    manifest        string
+}
+
+func parseChecksum( checksum string ) (*checksumSpec, error) {
+// -checksum=<algorithm>:<manifest>
+    parts := strings.SplitN( checksum, ":", 2 )
+    if len(parts) != 2 || parts[1] == "" {
+        return nil, fmt.Errorf( "missing manifest path: -checksum=%s\n", checksum )
+    }
+    if _, ok := checksumAlgorithms[parts[0]]; ! ok {
+        return nil, fmt.Errorf( "unsupported checksum algorithm: %s\n", parts[0] )
+    }
+    return &checksumSpec{ algorithm: parts[0], manifest: parts[1] }, nil
+}
+
+type fixity struct {
+    algorithm       string              // for generated manifest
+    out             *os.File            // generated manifest, if not nil
+    expected        map[string]string   // manifest to verify, if not nil
+    seen            map[string]bool
+    nVerified       int
+    nMismatch       int
+    nUnlisted       int
+}
+
+func newFixity( generate *checksumSpec, verify string ) (*fixity, error) {
+    fx := new( fixity )
+    if verify != "" {
+        var err error
+        if fx.expected, err = loadManifest( verify ); err != nil {
+            return nil, err
+        }
+        fx.seen = make( map[string]bool )
+    }
+    if generate != nil {
+        f, err := os.OpenFile( generate.manifest,
+                               os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644 )
+        if err != nil {
+            return nil, fmt.Errorf( "unable to create manifest %s: %v\n",
+                                    generate.manifest, err )
+        }
+        fx.out = f
+        fx.algorithm = generate.algorithm
+    }
+    return fx, nil
+}
+
+// check computes the checksum of the file at path, adds it to the generated
+// manifest and compares it with the expected checksum. It returns an error if
+// the checksum cannot be calculated or if it does not match.
+func (fx *fixity) check( path string ) error {
+    if fx.out != nil {
+        sum, err := fileChecksum( path, fx.algorithm )
+        if err != nil {
+            return fmt.Errorf( "unable to calculate checksum of %s: %v\n", path, err )
+        }
+        fmt.Fprintf( fx.out, "%s  %s\n", sum, path )
+    }
+    if fx.expected == nil {
+        return nil
+    }
+    expected, ok := fx.expected[path]
+    if ! ok {
+        fx.nUnlisted ++
+        fmt.Printf( "jpegcheck: %s is not listed in manifest\n", path )
+        return nil
+    }
+    fx.seen[path] = true
+    algorithm := algorithmFromLength( len(expected) )
+    if algorithm == "" {
+        fx.nMismatch ++
+        return fmt.Errorf( "unknown checksum algorithm in manifest for %s\n", path )
+    }
+    sum, err := fileChecksum( path, algorithm )
+    if err != nil {
+        fx.nMismatch ++
+        return fmt.Errorf( "unable to calculate checksum of %s: %v\n", path, err )
+    }
+    if sum != expected {
+        fx.nMismatch ++
+        return fmt.Errorf( "%s checksum mismatch for %s\n", algorithm, path )
+    }
+    fx.nVerified ++
+    return nil
+}
+
+// missing returns the files listed in the verified manifest, that were not
+// checked.
+func (fx *fixity) missing( ) (files []string) {
+    for path := range fx.expected {
+        if ! fx.seen[path] {
+            files = append( files, path )
+        }
+    }
+    sort.Strings( files )
+    return
+}
+
+func (fx *fixity) summary( ) {
+    if fx.expected == nil {
+        return
+    }
+    missing := fx.missing()
+    fmt.Printf( "jpegcheck: checksums %d verified, %d mismatched, %d not in " +
+                "manifest, %d listed but not checked\n", fx.nVerified,
+                fx.nMismatch, fx.nUnlisted, len(missing) )
+    for _, path := range missing {
+        fmt.Printf( "  not checked: %s\n", path )
+    }
+}
+
+func (fx *fixity) close( ) (err error) {
+    if fx.out != nil {
+        err = fx.out.Close()
+    }
+    return
+}
@@ -0,0 +1,209 @@
+
+package main
+
+import (
+    "fmt"
+    "strings"
+)
+
+// Frame structure: the library describes files with one frame, or with the
+// frames of a hierarchical image, and attaches anything unexpected to the
+// first frame. The frame headers of the main image (until the first EOI) are
+// enumerated here from the raw data, with the scans that follow each of them,
+// so that files with several SOF markers, whether hierarchical or made of
+// concatenated frames, are reported frame by frame, each frame with its own
+// diagnostics, including the validity of their sample precision (see
+// precision.go).
+
+type frameEntry struct {
+    marker          byte
+    offset          int
+    precision       int
+    width, height   int
+    components      []byte      // component ids
+    h, v            []int       // component sampling factors
+    tq              []int       // component quantization table selectors
+    scans           int
+}
+
+// differential returns true for the frames of differential processes, which
+// are only allowed after the first frame of a hierarchical image
+func (f *frameEntry) differential( ) bool {
+    return ( f.marker >= markerSOF0 + 5 && f.marker <= markerSOF0 + 7 ) ||
+           f.marker >= markerSOF0 + 13
+}
+
+// encodingMode and entropyCoding return the names of the frame process, as
+// encodingModeName and entropyCodingName do for the library frames
+func (f *frameEntry) encodingMode( ) string {
+    m := int(f.marker - markerSOF0)
+    name := encodingModeNames[ m & 3 ]
+    if m & 3 == 0 {
+        name = encodingModeNames[0]
+        if m != 0 {
+            name = encodingModeNames[1]
+        }
+    }
+    if f.differential() {
+        name = "Differential " + name
+    }
+    return name
+}
+
+func (f *frameEntry) entropyCoding( ) string {
+    return entropyCodingNames[ int(f.marker - markerSOF0) >> 3 ]
+}
+
+func (f *frameEntry) hasComponent( id byte ) bool {
+    for _, c := range f.components {
+        if c == id {
+            return true
+        }
+    }
+    return false
+}
+
+// frameStructure returns the frames found in data before the first EOI, and
+// adds the structure anomalies to rep, grouped by frame
+func frameStructure( data []byte, l *fileLayout,
+                     rep *fileReport ) (frames []*frameEntry, dhp bool) {
+    var dhpWidth, dhpHeight int
+    var quant16 [4]bool         // destinations holding 16-bit tables
+    add := func( frame int, s severity, format string, a ...interface{} ) {
+        rep.addFrameMessage( frame, s, codeFrameStructure,
+                             "Frame structure: " + fmt.Sprintf( format, a... ) )
+    }
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.marker == markerEOI {
+            break
+        }
+        d := s.data( data )
+        switch {
+        case s.marker == markerDHP:
+            if len(d) >= 5 {
+                dhpHeight = int(d[1]) << 8 | int(d[2])
+                dhpWidth = int(d[3]) << 8 | int(d[4])
+            }
+            if len(frames) > 0 {
+                add( -1, errorSeverity, "DHP @0x%x after the first frame " +
+                     "header", s.offset )
+            }
+            dhp = true
+        case s.marker == markerDQT:
+            for len(d) > 0 {
+                pq, tq := int(d[0] >> 4), int(d[0] & 0x0f)
+                if tq < len(quant16) {
+                    quant16[tq] = pq == 1
+                }
+                if len(d) < 65 + 64 * pq {
+                    break
+                }
+                d = d[65+64*pq:]
+            }
+        case isSOF( s.marker ):
+            f := &frameEntry{ marker: s.marker, offset: s.offset }
+            if len(d) >= 6 {
+                f.precision = int(d[0])
+                f.height = int(d[1]) << 8 | int(d[2])
+                f.width = int(d[3]) << 8 | int(d[4])
+                for c := 6; c + 3 <= len(d) && len(f.components) < int(d[5]);
+                    c += 3 {
+                    f.components = append( f.components, d[c] )
+                    f.h = append( f.h, int(d[c+1] >> 4) )
+                    f.v = append( f.v, int(d[c+1] & 0x0f) )
+                    f.tq = append( f.tq, int(d[c+2]) )
+                }
+            }
+            frames = append( frames, f )
+            n := len(frames) - 1
+            switch {
+            case ! dhp && n > 0:
+                add( n, errorSeverity, "frame %d %s @0x%x follows another " +
+                     "frame in a non-hierarchical image (concatenated " +
+                     "frames?)", n, markerName( s.marker ), s.offset )
+            case ! dhp && f.differential():
+                add( n, errorSeverity, "differential frame %d %s @0x%x in " +
+                     "a non-hierarchical image", n, markerName( s.marker ),
+                     s.offset )
+            case dhp && n == 0 && f.differential():
+                add( n, errorSeverity, "first frame %s @0x%x of a " +
+                     "hierarchical image is differential",
+                     markerName( s.marker ), s.offset )
+            }
+            if dhp && ( f.width > dhpWidth || f.height > dhpHeight ) {
+                add( n, errorSeverity, "frame %d @0x%x is larger (%dx%d) " +
+                     "than the hierarchical image (%dx%d)", n, s.offset,
+                     f.width, f.height, dhpWidth, dhpHeight )
+            }
+            if len(d) >= 6 {
+                f.formatPrecisionIssues( n, quant16, rep )
+            }
+        case s.marker == markerSOS:
+            if len(frames) == 0 {
+                add( -1, errorSeverity, "scan @0x%x before any frame header",
+                     s.offset )
+                continue
+            }
+            n := len(frames) - 1
+            f := frames[n]
+            f.scans ++
+            if len(d) < 1 {
+                continue
+            }
+            for c := 1; c + 2 <= len(d) && c < 1 + 2 * int(d[0]); c += 2 {
+                if ! f.hasComponent( d[c] ) {
+                    add( n, errorSeverity, "scan @0x%x refers to component " +
+                         "%d, not in frame %d", s.offset, d[c], n )
+                }
+            }
+        }
+    }
+    for n, f := range frames {
+        if f.scans == 0 {
+            add( n, errorSeverity, "frame %d %s @0x%x has no scan", n,
+                 markerName( f.marker ), f.offset )
+        }
+    }
+    return
+}
+
+// formatFrameStructure records the frames of data in rep and prints them if
+// the file has several frame headers or anomalies in its frame structure
+func formatFrameStructure( data []byte, l *fileLayout, rep *fileReport ) {
+    frames, dhp := frameStructure( data, l, rep )
+    rep.structure = frames
+    anomalies := 0
+    for _, m := range rep.messages {
+        if strings.HasPrefix( m.text, "Frame structure:" ) {
+            anomalies ++
+        }
+    }
+    if len(frames) < 2 && anomalies == 0 {
+        return
+    }
+    kind := "single frame"
+    switch {
+    case dhp:
+        kind = "hierarchical image"
+    case len(frames) > 1:
+        kind = "multiple frames without DHP"
+    }
+    fmt.Printf( "Frame structure: %d frame(s), %s\n", len(frames), kind )
+    for _, m := range rep.messages {
+        if m.frame == -1 && strings.HasPrefix( m.text, "Frame structure:" ) {
+            fmt.Printf( "    [%s] %s\n", m.severity, m.text )
+        }
+    }
+    for n, f := range frames {
+        fmt.Printf( "  Frame #%d %s @0x%x: %dx%d, %d-bit, %d component(s), " +
+                    "%d scan(s)\n", n, markerName( f.marker ), f.offset,
+                    f.width, f.height, f.precision, len(f.components),
+                    f.scans )
+        for _, m := range rep.messages {
+            if m.frame == n {
+                fmt.Printf( "    [%s] %s\n", m.severity, m.text )
+            }
+        }
+    }
+}
@@ -0,0 +1,130 @@
+
+package main
+
+import (
+    "fmt"
+    "math"
+    "os"
+    "strings"
+)
+
+// Grayscale conversion (-gray): by default a BW picture saved with -spict is
+// the Y component as decoded, repeated as R, G and B, which is a mix of gamma-encoded R, G and B with
+// Rec.601 coefficients. Scientific users need to control how luminance is
+// derived, so the picture can instead be saved as RGB and converted with
+// Rec.601 or Rec.709 coefficients, either on gamma-encoded values like Y or in
+// linear light: samples are decoded with the sRGB transfer function, mixed,
+// and encoded again, which preserves the luminance of saturated colors. The
+// conversion is done in place, one row at a time, keeping the layout of a BW
+// picture, and the method used is recorded in the report.
+
+type grayMethod struct {
+    name            string
+    kr, kg, kb      float64
+    linear          bool        // mix in linear light
+    description     string
+}
+
+var grayMethods = []*grayMethod{
+    { "y", 0, 0, 0, false, "Y component as decoded (Rec.601, gamma-encoded)" },
+    { "rec601", 0.299, 0.587, 0.114, false,
+      "Rec.601 coefficients on gamma-encoded RGB" },
+    { "rec709", 0.2126, 0.7152, 0.0722, false,
+      "Rec.709 coefficients on gamma-encoded RGB" },
+    { "rec601-linear", 0.299, 0.587, 0.114, true,
+      "Rec.601 coefficients in linear light (sRGB transfer)" },
+    { "rec709-linear", 0.2126, 0.7152, 0.0722, true,
+      "Rec.709 coefficients in linear light (sRGB transfer)" },
+}
+
+// parseGray returns the grayscale conversion method called name
+func parseGray( name string ) (*grayMethod, error) {
+    var names []string
+    for _, gm := range grayMethods {
+        if gm.name == strings.ToLower( name ) {
+            return gm, nil
+        }
+        names = append( names, gm.name )
+    }
+    return nil, fmt.Errorf( "invalid grayscale method %s (%s)\n", name,
+                            strings.Join( names, ", " ) )
+}
+
+// fromRGB returns true if the method needs RGB samples rather than Y
+func (gm *grayMethod) fromRGB( ) bool {
+    return gm.name != "y"
+}
+
+const grayLinearLevels = 1 << 16
+
+// srgbToLinear returns the linear light value of an sRGB level in [0, 1]
+func srgbToLinear( v float64 ) float64 {
+    if v <= 0.04045 {
+        return v / 12.92
+    }
+    return math.Pow( ( v + 0.055 ) / 1.055, 2.4 )
+}
+
+// linearToSrgb returns the sRGB level of a linear light value in [0, 1]
+func linearToSrgb( v float64 ) float64 {
+    if v <= 0.0031308 {
+        return v * 12.92
+    }
+    return 1.055 * math.Pow( v, 1 / 2.4 ) - 0.055
+}
+
+// grayRawPicture converts in place the raw RGB picture of nc x nr pixels saved
+// at path to gray levels with the method gm, repeated as R, G and B.
+func grayRawPicture( path string, nc, nr, size int, gm *grayMethod ) error {
+    if size != 3 * nc * nr {
+        return fmt.Errorf( "gray: unexpected picture size %d for %dx%d RGB\n",
+                           size, nc, nr )
+    }
+    var toLinear [256]float64
+    var toSrgb []byte
+    if gm.linear {
+        for i := range toLinear {
+            toLinear[i] = srgbToLinear( float64(i) / 255 )
+        }
+        toSrgb = make( []byte, grayLinearLevels )
+        for i := range toSrgb {
+            toSrgb[i] = clampSample( 255 * linearToSrgb( float64(i) /
+                                             ( grayLinearLevels - 1 ) ) )
+        }
+    }
+    f, err := os.OpenFile( path, os.O_RDWR, 0 )
+    if err != nil {
+        return fmt.Errorf( "gray: %v\n", err )
+    }
+    defer f.Close()
+    rgb := make( []byte, 3 * nc )
+    for y := 0; y < nr; y++ {
+        offset := int64( 3 * y * nc )
+        if _, err = f.ReadAt( rgb, offset ); err != nil {
+            return fmt.Errorf( "gray: %v\n", err )
+        }
+        for x := 0; x < nc; x++ {
+            r, g, b := rgb[3*x], rgb[3*x+1], rgb[3*x+2]
+            var v byte
+            if gm.linear {
+                l := gm.kr * toLinear[r] + gm.kg * toLinear[g] +
+                     gm.kb * toLinear[b]
+                i := int( l * ( grayLinearLevels - 1 ) + 0.5 )
+                if i >= grayLinearLevels {
+                    i = grayLinearLevels - 1
+                }
+                v = toSrgb[i]
+            } else {
+                v = clampSample( gm.kr * float64(r) + gm.kg * float64(g) +
+                                 gm.kb * float64(b) )
+            }
+            rgb[3*x], rgb[3*x+1], rgb[3*x+2] = v, v, v
+        }
+        if _, err = f.WriteAt( rgb, offset ); err != nil {
+            return fmt.Errorf( "gray: %v\n", err )
+        }
+    }
+    fmt.Printf( "jpegcheck: converted %s to grayscale with %s\n", path,
+                gm.description )
+    return nil
+}
@@ -0,0 +1,280 @@
+
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "math"
+    "os"
+)
+
+// Grayscale pictures stored as color (-gray-check, -to-gray): scanned black
+// and white documents are often saved as YCbCr, with chroma planes that carry
+// no information but still take space. The Cb and Cr planes are reconstructed
+// at their own resolution and the picture is flagged if they are effectively
+// constant: at least 99.9% of the samples of each plane within 2 levels of the
+// plane mean, which tolerates compression noise and a few specks. The chroma
+// is neutral if both means are within 2 levels of the mid level, otherwise the
+// picture has a uniform tint that a conversion would remove. The potential
+// saving is the size of the entropy-coded data used by the chroma.
+// The conversion (-to-gray) rewrites the copy written with -o as a single
+// component frame: the Y coefficients are entropy coded again, in a single
+// scan per original scan including Y, with the tables of the file, and scans
+// of chroma only are dropped. It is only done if the chroma is effectively
+// constant, and is verified by decoding the result.
+
+const (
+    grayTolerance       = 2.0       // levels, for 8-bit samples
+    grayShare           = 0.999     // share of samples within tolerance
+)
+
+type chromaSpread struct {
+    mean            float64
+    within          float64     // share of samples within tolerance of mean
+    maxDeviation    float64
+}
+
+type grayAnalysis struct {
+    cb, cr          chromaSpread
+    constant        bool        // both planes effectively constant
+    neutral         bool        // and at the mid level
+    chromaBytes     int64       // entropy-coded data used by Cb and Cr
+}
+
+// spread returns the spread of the samples of p around their mean
+func spread( p *plane, tolerance float64 ) chromaSpread {
+    var cs chromaSpread
+    if len(p.samples) == 0 {
+        return cs
+    }
+    for _, s := range p.samples {
+        cs.mean += s
+    }
+    cs.mean /= float64(len(p.samples))
+    n := 0
+    for _, s := range p.samples {
+        d := math.Abs( s - cs.mean )
+        if d <= tolerance {
+            n++
+        }
+        if d > cs.maxDeviation {
+            cs.maxDeviation = d
+        }
+    }
+    cs.within = float64(n) / float64(len(p.samples))
+    return cs
+}
+
+// analyseGray returns the spread of the chroma planes of img, which must have
+// 3 components Y, Cb and Cr
+func analyseGray( img *coefImage ) (*grayAnalysis, error) {
+    fh := img.frame
+    if len(fh.comps) != 3 {
+        return nil, fmt.Errorf( "%d component(s), Y, Cb and Cr are " +
+                                "expected\n", len(fh.comps) )
+    }
+    scale := float64( int(1) << uint(fh.precision - 8) )
+    mid := float64( int(1) << uint(fh.precision - 1) )
+    ga := &grayAnalysis{ }
+    for ci, cs := range []*chromaSpread{ &ga.cb, &ga.cr } {
+        p, err := img.componentPlane( ci + 1 )
+        if err != nil {
+            return nil, err
+        }
+        *cs = spread( p, grayTolerance * scale )
+        cc := &img.comps[ci+1]
+        ga.chromaBytes += ( cc.dcBits + cc.acBits + 7 ) / 8
+    }
+    ga.constant = ga.cb.within >= grayShare && ga.cr.within >= grayShare
+    ga.neutral = ga.constant &&
+                 math.Abs( ga.cb.mean - mid ) <= grayTolerance * scale &&
+                 math.Abs( ga.cr.mean - mid ) <= grayTolerance * scale
+    return ga, nil
+}
+
+// formatGrayCheck prints whether the chroma of the picture in data is
+// effectively constant, and reports it as a warning with the potential saving
+func formatGrayCheck( data []byte, l *fileLayout, rep *fileReport ) {
+    cs, ok := fileColorSpace( data, l )
+    switch {
+    case ! ok:
+        return
+    case cs.name == "gray":
+        fmt.Printf( "Grayscale check: picture already stored as grayscale\n" )
+        return
+    case cs.name != "YCbCr":
+        fmt.Printf( "Grayscale check: not applicable to %s pictures\n",
+                    cs.name )
+        return
+    }
+    img, err := decodeCoefficients( data, l )
+    if err == nil && len(img.frame.comps) != 3 {
+        err = fmt.Errorf( "%d components\n", len(img.frame.comps) )
+    }
+    var ga *grayAnalysis
+    if err == nil {
+        ga, err = analyseGray( img )
+    }
+    if err != nil {
+        fmt.Printf( "Grayscale check: unable to analyse the chroma: %v", err )
+        rep.addMessage( infoSeverity, codeGrayscale,
+                        "grayscale check not done" )
+        return
+    }
+    fmt.Printf( "Grayscale check:\n" )
+    for i, s := range []chromaSpread{ ga.cb, ga.cr } {
+        fmt.Printf( "  %s mean %.1f, %.2f%% of samples within %.0f levels, " +
+                    "largest deviation %.1f\n", []string{ "Cb", "Cr" }[i],
+                    s.mean, 100 * s.within, grayTolerance, s.maxDeviation )
+    }
+    if ! ga.constant {
+        fmt.Printf( "  Color picture\n" )
+        return
+    }
+    tint := ""
+    if ! ga.neutral {
+        tint = " with a uniform tint"
+    }
+    text := fmt.Sprintf( "grayscale picture stored as YCbCr%s, chroma uses " +
+                         "%d bytes (%.1f%% of the file), use -to-gray to " +
+                         "convert it", tint, ga.chromaBytes,
+                         100 * float64(ga.chromaBytes) / float64(len(data)) )
+    fmt.Printf( "  Warning: %s\n", text )
+    rep.addMessage( warningSeverity, codeGrayscale, text )
+}
+
+// grayFrameHeader returns the header of a single component frame made of the
+// first component of fh
+func grayFrameHeader( fh *frameHeader ) *frameHeader {
+    gray := *fh
+    y := fh.comps[0]
+    y.h, y.v = 1, 1
+    gray.comps = []frameComp{ y }
+    gray.hMax, gray.vMax = 1, 1
+    return &gray
+}
+
+// encodeGray returns data with the first frame, which must have been decoded
+// as img, reduced to its first component
+func encodeGray( data []byte, l *fileLayout, img *coefImage ) ([]byte, error) {
+    fh := grayFrameHeader( img.frame )
+    gray := &coefImage{ frame: fh, comps: img.comps[:1], quant: img.quant }
+    y := fh.comps[0]
+    var ct codingTables
+    var out bytes.Buffer
+    last, frames := 0, 0
+    for i := 0; i < len(l.segments); i++ {
+        s := &l.segments[i]
+        switch {
+        case s.marker == markerDHT:
+            if err := ct.defineHuffman( s.data( data ) ); err != nil {
+                return nil, err
+            }
+        case s.marker == markerDRI:
+            if d := s.data( data ); len(d) >= 2 {
+                ct.restart = int(d[0]) << 8 + int(d[1])
+            }
+        case isSOF( s.marker ):
+            frames ++
+            if frames != 1 {
+                break
+            }
+            out.Write( data[last:s.offset] )
+            sof := []byte{ byte(fh.precision), byte(fh.height >> 8),
+                           byte(fh.height), byte(fh.width >> 8),
+                           byte(fh.width), 1, y.id, 0x11, byte(y.tq) }
+            if err := appendSegment( &out, s.marker, sof ); err != nil {
+                return nil, err
+            }
+            last = s.end()
+        case s.marker == markerSOS && frames == 1:
+            d := s.data( data )
+            ns, err := scanComponents( d )
+            if err != nil {
+                return nil, err
+            }
+            out.Write( data[last:s.offset] )
+            for c := 0; c < ns; c++ {
+                if d[1+2*c] != y.id {
+                    continue
+                }
+                sos := []byte{ 1, y.id, d[2+2*c], d[1+2*ns], d[2+2*ns],
+                               d[3+2*ns] }
+                if err := appendSegment( &out, markerSOS, sos ); err != nil {
+                    return nil, err
+                }
+                if err := gray.encodeScan( &out, sos, &ct ); err != nil {
+                    return nil, err
+                }
+            }
+            last = s.ecsEnd
+            for i + 1 < len(l.segments) &&
+                l.segments[i+1].marker >= markerRST0 &&
+                l.segments[i+1].marker <= markerRST7 {
+                i ++
+                last = l.segments[i].ecsEnd
+            }
+        }
+    }
+    out.Write( data[last:] )
+    return out.Bytes(), nil
+}
+
+// toGrayFile converts the picture in the file at output to grayscale if its
+// chroma is effectively constant, and returns a description of the change and
+// whether the file was converted.
+func toGrayFile( output string ) (string, bool, error) {
+    data, err := os.ReadFile( output )
+    if err != nil {
+        return "", false, fmt.Errorf( "to-gray: %v\n", err )
+    }
+    l := scanLayout( data )
+    if cs, ok := fileColorSpace( data, l ); ok && cs.name != "YCbCr" {
+        return fmt.Sprintf( "to-gray: %s picture not converted", cs.name ),
+               false, nil
+    }
+    img, err := decodeCoefficients( data, l )
+    if err != nil {
+        return "", false, fmt.Errorf( "to-gray: %v", err )
+    }
+    if m := img.frame.marker; m != markerSOF0 && m != markerSOF0 + 1 {
+        return "", false, fmt.Errorf( "to-gray: only available for Huffman " +
+                                      "sequential frames, not %s\n",
+                                      markerName( m ) )
+    }
+    ga, err := analyseGray( img )
+    if err != nil {
+        return "", false, fmt.Errorf( "to-gray: %v", err )
+    }
+    if ! ga.constant {
+        return "to-gray: color picture not converted", false, nil
+    }
+    gray, err := encodeGray( data, l, img )
+    if err != nil {
+        return "", false, fmt.Errorf( "to-gray: %v", err )
+    }
+    check, err := decodeCoefficients( gray, scanLayout( gray ) )
+    if err != nil {
+        return "", false, fmt.Errorf( "to-gray: converted picture cannot be " +
+                                      "decoded: %v", err )
+    }
+    bx, by := check.frame.compBlocks( 0 )
+    for y := 0; y < by; y++ {
+        for x := 0; x < bx; x++ {
+            if *check.comps[0].at( x, y ) != *img.comps[0].at( x, y ) {
+                return "", false, fmt.Errorf( "to-gray: block %d,%d is not " +
+                                              "coded as expected\n", x, y )
+            }
+        }
+    }
+    if err = writeFile( output, gray, 0644 ); err != nil {
+        return "", false, fmt.Errorf( "to-gray: %v\n", err )
+    }
+    tint := ""
+    if ! ga.neutral {
+        tint = ", uniform tint removed"
+    }
+    return fmt.Sprintf( "to-gray: converted to grayscale%s, %d bytes " +
+                        "instead of %d", tint, len(gray), len(data) ),
+           true, nil
+}
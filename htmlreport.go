@@ -0,0 +1,90 @@
+
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "html"
+    "os"
+    "time"
+)
+
+// HTML report: a self-contained page with one table row per file giving its
+// outcome and the properties of its first frame, followed by its messages,
+// for sharing batch results with people who do not read json or xml.
+
+const htmlReportStyle = `body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 2px 6px; text-align: left; }
+tr.failed td.status { color: #b00; }
+td.messages { font-size: smaller; }
+`
+
+type htmlReport struct {
+    f               *os.File
+    w               *bufio.Writer
+}
+
+func newHtmlReport( path string, process *jpgArgs ) (*htmlReport, error) {
+    f, err := os.OpenFile( path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644 )
+    if err != nil {
+        return nil, fmt.Errorf( "unable to create html report %s: %v\n",
+                                path, err )
+    }
+    hr := &htmlReport{ f: f, w: bufio.NewWriter( f ) }
+    fmt.Fprintf( hr.w, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n" +
+                 "<title>jcheck report</title>\n<style>\n%s</style>\n</head>\n" +
+                 "<body>\n<h1>jcheck %s report</h1>\n", htmlReportStyle,
+                 html.EscapeString( VERSION ) )
+    if now, ok := process.outputTime(); ok {
+        fmt.Fprintf( hr.w, "<p>%s</p>\n", now.Format( time.RFC3339 ) )
+    }
+    fmt.Fprintf( hr.w, "<table>\n<tr><th>#</th><th>File</th><th>Size</th>" +
+                 "<th>Status</th><th>Frame</th><th>Messages</th></tr>\n" )
+    return hr, nil
+}
+
+func (hr *htmlReport) name( ) string {
+    return "html report"
+}
+
+func (hr *htmlReport) add( rep *fileReport ) error {
+    class := ""
+    if rep.failed {
+        class = " class=\"failed\""
+    }
+    frame := ""
+    if len(rep.frames) > 0 {
+        fi := rep.frames[0]
+        frame = fmt.Sprintf( "%s, %dx%d, %d-bit, %d component(s)",
+                             encodingModeName( fi.Mode ), fi.Width, fi.Height,
+                             fi.SampleSize, len(fi.Components) )
+    } else if len(rep.structure) > 0 {
+        f := rep.structure[0]
+        frame = fmt.Sprintf( "%s, %dx%d, %d-bit, %d component(s)",
+                             f.encodingMode(), f.width, f.height, f.precision,
+                             len(f.components) )
+    }
+    fmt.Fprintf( hr.w, "<tr%s><td>%d</td><td>%s</td><td>%d</td>" +
+                 "<td class=\"status\">%s</td><td>%s</td><td class=\"messages\">",
+                 class, rep.index, html.EscapeString( rep.path ), rep.size,
+                 html.EscapeString( xmlStatus( rep ) ),
+                 html.EscapeString( frame ) )
+    for i, m := range rep.messages {
+        if i > 0 {
+            fmt.Fprintf( hr.w, "<br>" )
+        }
+        fmt.Fprintf( hr.w, "[%s] %s", m.severity, html.EscapeString( m.text ) )
+    }
+    fmt.Fprintf( hr.w, "</td></tr>\n" )
+    return nil
+}
+
+func (hr *htmlReport) close( ) error {
+    fmt.Fprintf( hr.w, "</table>\n</body>\n</html>\n" )
+    if err := hr.w.Flush(); err != nil {
+        hr.f.Close()
+        return err
+    }
+    return hr.f.Close()
+}
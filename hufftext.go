@@ -0,0 +1,277 @@
+
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "os"
+)
+
+// Huffman tables as json (-shuff, -ihuff): custom canonical tables are tested
+// by replacing the tables of a file and coding the scans again. All table
+// definitions of the first image are saved in file order, each with its class
+// (dc or ac), destination, the number of codes of each length from 1 to 16
+// bits and the symbols in code order, and with the index of the scan that
+// follows it. Tables read from such a file replace all definitions of the same
+// class and destination in the copy written with -o, and the scans are
+// entropy coded again from the coefficients, which are verified to be
+// unchanged: the picture is not modified. Each class and destination can be
+// given only once, and re-coding is only available for Huffman sequential
+// frames.
+
+type huffTableText struct {
+    Class           string      `json:"class"`      // dc or ac
+    Destination     int         `json:"destination"`
+    Scan            int         `json:"scan"`       // next scan, from 0
+    Counts          []int       `json:"counts"`     // codes of 1 to 16 bits
+    Symbols         []int       `json:"symbols"`
+}
+
+type huffTablesText struct {
+    Path            string      `json:"path,omitempty"`
+    Tables          []huffTableText `json:"tables"`
+}
+
+var huffClasses = [...]string{ "dc", "ac" }
+
+type huffImport struct {
+    path            string
+    tables          map[int][]byte  // DHT contents by class << 4 | destination
+}
+
+// huffTableDefinitions returns all Huffman table definitions of the first
+// image in data
+func huffTableDefinitions( data []byte, l *fileLayout ) ([]huffTableText,
+                                                         error) {
+    var tables []huffTableText
+    scan := 0
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.marker == markerEOI {
+            break
+        }
+        if s.marker == markerSOS {
+            scan ++
+        }
+        if s.marker != markerDHT {
+            continue
+        }
+        for d := s.data( data ); len(d) > 0; {
+            if len(d) < 17 {
+                return nil, fmt.Errorf( "invalid DHT segment\n" )
+            }
+            tc, th := int(d[0] >> 4), int(d[0] & 0x0f)
+            t := huffTableText{ Destination: th, Scan: scan,
+                                Counts: make( []int, 16 ) }
+            n := 0
+            for j, c := range d[1:17] {
+                t.Counts[j] = int(c)
+                n += int(c)
+            }
+            if tc > 1 || th > 3 || len(d) < 17 + n {
+                return nil, fmt.Errorf( "invalid DHT segment\n" )
+            }
+            t.Class = huffClasses[tc]
+            t.Symbols = make( []int, n )
+            for j, v := range d[17:17+n] {
+                t.Symbols[j] = int(v)
+            }
+            tables = append( tables, t )
+            d = d[17+n:]
+        }
+    }
+    return tables, nil
+}
+
+// saveHuffmanTables saves all Huffman table definitions of the first image
+// in data as json at output
+func saveHuffmanTables( output, path string, data []byte,
+                        l *fileLayout ) error {
+    tables, err := huffTableDefinitions( data, l )
+    if err != nil {
+        return fmt.Errorf( "save Huffman tables: %v", err )
+    }
+    if len(tables) == 0 {
+        return fmt.Errorf( "save Huffman tables: no table in %s\n", path )
+    }
+    var b bytes.Buffer
+    enc := json.NewEncoder( &b )
+    enc.SetIndent( "", "  " )
+    if err = enc.Encode( &huffTablesText{ Path: path,
+                                          Tables: tables } ); err != nil {
+        return fmt.Errorf( "save Huffman tables: %v\n", err )
+    }
+    if err = writeFile( output, b.Bytes(), 0644 ); err != nil {
+        return fmt.Errorf( "save Huffman tables: %v\n", err )
+    }
+    fmt.Printf( "Saved %d Huffman table definition(s) as %s\n", len(tables),
+                output )
+    return nil
+}
+
+// content returns the DHT segment content defining the table, after checking
+// that it is a valid canonical table: at most 256 symbols (16 for DC), all
+// different, codes fitting in their length and no code made of 1 bits only.
+func (t *huffTableText) content( ) ([]byte, error) {
+    tc := -1
+    for i, c := range huffClasses {
+        if c == t.Class {
+            tc = i
+        }
+    }
+    if tc == -1 || t.Destination < 0 || t.Destination > 3 {
+        return nil, fmt.Errorf( "invalid class %q or destination %d\n",
+                                t.Class, t.Destination )
+    }
+    name := fmt.Sprintf( "%s table %d", t.Class, t.Destination )
+    if len(t.Counts) != 16 {
+        return nil, fmt.Errorf( "%s: %d counts instead of 16\n", name,
+                                len(t.Counts) )
+    }
+    content := []byte{ byte( tc << 4 | t.Destination ) }
+    n, code := 0, 0
+    for l, c := range t.Counts {
+        if c < 0 || c > 255 {
+            return nil, fmt.Errorf( "%s: invalid count %d\n", name, c )
+        }
+        code = ( code + c ) << 1
+        n += c
+        if code > 1 << uint(l + 2) || ( code == 1 << uint(l + 2) &&
+                                        l == 15 ) {
+            return nil, fmt.Errorf( "%s: too many codes of %d bits or " +
+                                    "less\n", name, l + 1 )
+        }
+        content = append( content, byte(c) )
+    }
+    if n != len(t.Symbols) || n == 0 || n > 256 || ( tc == 0 && n > 16 ) {
+        return nil, fmt.Errorf( "%s: %d symbols for %d codes\n", name,
+                                len(t.Symbols), n )
+    }
+    var seen [256]bool
+    for _, s := range t.Symbols {
+        if s < 0 || s > 255 || seen[s] || ( tc == 0 && s > 15 ) {
+            return nil, fmt.Errorf( "%s: invalid or duplicate symbol %d\n",
+                                    name, s )
+        }
+        seen[s] = true
+        content = append( content, byte(s) )
+    }
+    return content, nil
+}
+
+// loadHuffmanTables reads replacement tables from the json file at path, and
+// returns their DHT contents indexed by class << 4 | destination
+func loadHuffmanTables( path string ) (map[int][]byte, error) {
+    data, err := os.ReadFile( path )
+    if err != nil {
+        return nil, err
+    }
+    dec := json.NewDecoder( bytes.NewReader( data ) )
+    dec.DisallowUnknownFields()
+    var text huffTablesText
+    if err = dec.Decode( &text ); err != nil {
+        return nil, fmt.Errorf( "invalid Huffman tables in %s: %v\n", path,
+                                err )
+    }
+    if len(text.Tables) == 0 {
+        return nil, fmt.Errorf( "no Huffman table in %s\n", path )
+    }
+    tables := make( map[int][]byte )
+    for i := range text.Tables {
+        content, err := text.Tables[i].content()
+        if err != nil {
+            return nil, err
+        }
+        if _, ok := tables[int(content[0])]; ok {
+            return nil, fmt.Errorf( "%s table %d is given more than once " +
+                                    "in %s\n", text.Tables[i].Class,
+                                    text.Tables[i].Destination, path )
+        }
+        tables[int(content[0])] = content
+    }
+    return tables, nil
+}
+
+// importHuffmanTables replaces the Huffman tables of the file at output by
+// tables, codes the scans again and returns a description of the change.
+func importHuffmanTables( output string, tables map[int][]byte ) (string,
+                                                                  error) {
+    data, err := os.ReadFile( output )
+    if err != nil {
+        return "", fmt.Errorf( "ihuff: %v\n", err )
+    }
+    l := scanLayout( data )
+    img, err := decodeCoefficients( data, l )
+    if err != nil {
+        return "", fmt.Errorf( "ihuff: %v", err )
+    }
+    if m := img.frame.marker; m != markerSOF0 && m != markerSOF0 + 1 {
+        return "", fmt.Errorf( "ihuff: only available for Huffman " +
+                               "sequential frames, not %s\n", markerName( m ) )
+    }
+    var out bytes.Buffer
+    last, replaced := 0, 0
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.marker == markerEOI {
+            break
+        }
+        if s.marker != markerDHT {
+            continue
+        }
+        var content []byte
+        for d := s.data( data ); len(d) >= 17; {
+            n := 0
+            for _, c := range d[1:17] {
+                n += int(c)
+            }
+            if len(d) < 17 + n {
+                break
+            }
+            if t, ok := tables[int(d[0])]; ok {
+                content = append( content, t... )
+                replaced ++
+            } else {
+                content = append( content, d[:17+n]... )
+            }
+            d = d[17+n:]
+        }
+        out.Write( data[last:s.offset] )
+        out.Write( []byte{ 0xff, markerDHT, byte( ( len(content) + 2 ) >> 8 ),
+                           byte( len(content) + 2 ) } )
+        out.Write( content )
+        last = s.end()
+    }
+    if replaced == 0 {
+        return "", fmt.Errorf( "ihuff: none of the tables given is defined " +
+                               "in the file\n" )
+    }
+    out.Write( data[last:] )
+    modified := out.Bytes()
+    recoded, err := encodeCoefficients( modified, scanLayout( modified ), img )
+    if err != nil {
+        return "", fmt.Errorf( "ihuff: %v", err )
+    }
+    check, err := decodeCoefficients( recoded, scanLayout( recoded ) )
+    if err != nil {
+        return "", fmt.Errorf( "ihuff: recoded picture cannot be decoded: %v",
+                               err )
+    }
+    for ci := range img.comps {
+        for i := range img.comps[ci].blocks {
+            if check.comps[ci].blocks[i] != img.comps[ci].blocks[i] {
+                return "", fmt.Errorf( "ihuff: block %d of component %d is " +
+                                       "not coded as expected\n", i, ci )
+            }
+        }
+    }
+    if err = writeFile( output, recoded, 0644 ); err != nil {
+        return "", fmt.Errorf( "ihuff: %v\n", err )
+    }
+    before, _, _ := entropyCodedBytes( data, l )
+    after, _, _ := entropyCodedBytes( recoded, scanLayout( recoded ) )
+    return fmt.Sprintf( "ihuff: %d table definition(s) replaced, scans coded " +
+                        "again, entropy-coded data %d bytes (was %d), " +
+                        "coefficients unchanged", replaced, after, before ), nil
+}
@@ -0,0 +1,229 @@
+
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "sort"
+    "strings"
+    "unicode/utf16"
+)
+
+// ICC profiles: a profile is stored in one or more APP2 segments starting with
+// the ICC_PROFILE identifier, followed by the sequence number of the chunk
+// (from 1) and the total number of chunks, since a profile can be larger than
+// a segment. The chunks are reassembled in sequence order, whatever their
+// order in the file, and the profile header and description tag are decoded
+// for -meta, while -sicc saves the profile as a standalone .icc file.
+
+var iccHeader = []byte( "ICC_PROFILE\x00" )
+
+type iccChunk struct {
+    seq, count      int
+    offset          int
+    data            []byte
+}
+
+// iccProfile returns the ICC profile reassembled from the APP2 segments found
+// before the image data, or nil if there is none, with the problems found in
+// the chunk sequence. A profile with missing chunks is not returned.
+func iccProfile( data []byte, l *fileLayout ) (profile []byte,
+                                                problems []string) {
+    var chunks []iccChunk
+    for i := range l.segments {
+        s := &l.segments[i]
+        if isImageDataMarker( s.marker ) || s.marker == markerEOI {
+            break
+        }
+        d := s.data( data )
+        if s.marker != markerAPP0 + 2 || ! bytes.HasPrefix( d, iccHeader ) ||
+           len(d) < len(iccHeader) + 2 {
+            continue
+        }
+        chunks = append( chunks, iccChunk{ seq: int(d[len(iccHeader)]),
+                                           count: int(d[len(iccHeader)+1]),
+                                           offset: s.offset,
+                                           data: d[len(iccHeader)+2:] } )
+    }
+    if len(chunks) == 0 {
+        return nil, nil
+    }
+    sort.SliceStable( chunks, func( i, j int ) bool {
+        return chunks[i].seq < chunks[j].seq
+    } )
+    count := chunks[0].count
+    for i, c := range chunks {
+        if c.count != count {
+            problems = append( problems, fmt.Sprintf( "chunk @0x%x gives %d " +
+                               "chunks instead of %d", c.offset, c.count,
+                               count ) )
+        }
+        if i > 0 && c.seq == chunks[i-1].seq {
+            problems = append( problems, fmt.Sprintf( "chunk %d @0x%x is " +
+                               "duplicated", c.seq, c.offset ) )
+        }
+    }
+    missing := count == 0
+    for seq := 1; seq <= count; seq++ {
+        found := false
+        for _, c := range chunks {
+            if c.seq == seq {
+                if ! found {
+                    profile = append( profile, c.data... )
+                }
+                found = true
+            }
+        }
+        if ! found {
+            problems = append( problems, fmt.Sprintf( "chunk %d of %d is " +
+                               "missing", seq, count ) )
+            missing = true
+        }
+    }
+    if missing {
+        return nil, problems
+    }
+    return profile, problems
+}
+
+var iccRenderingIntents = [...]string{ "perceptual", "relative colorimetric",
+                                       "saturation", "absolute colorimetric" }
+
+var iccClasses = map[string]string{
+    "scnr": "input device",
+    "mntr": "display device",
+    "prtr": "output device",
+    "link": "device link",
+    "spac": "color space conversion",
+    "abst": "abstract",
+    "nmcl": "named color",
+}
+
+// iccSignature returns a 4 byte signature as text, without trailing spaces
+func iccSignature( d []byte ) string {
+    return strings.TrimRight( strings.Trim( string( d[:4] ), "\x00" ), " " )
+}
+
+// iccDescription returns the text of the profile description tag, either a
+// textDescriptionType (version 2) or a multiLocalizedUnicodeType (version 4),
+// in which case the first record is used
+func iccDescription( profile []byte ) string {
+    if len(profile) < 132 {
+        return ""
+    }
+    n := int(binary.BigEndian.Uint32( profile[128:] ))
+    for i := 0; i < n && 144 + 12 * i <= len(profile); i++ {
+        t := profile[132+12*i:]
+        offset := int(binary.BigEndian.Uint32( t[4:] ))
+        size := int(binary.BigEndian.Uint32( t[8:] ))
+        if string( t[:4] ) != "desc" || offset < 0 || size < 12 ||
+           offset > len(profile) || size > len(profile) - offset {
+            continue
+        }
+        d := profile[offset:offset+size]
+        switch string( d[:4] ) {
+        case "desc":
+            l := int(binary.BigEndian.Uint32( d[8:] ))
+            if l > len(d) - 12 {
+                l = len(d) - 12
+            }
+            return strings.TrimRight( string( d[12:12+l] ), "\x00" )
+        case "mluc":
+            if len(d) < 28 {
+                return ""
+            }
+            l := int(binary.BigEndian.Uint32( d[20:] ))
+            o := int(binary.BigEndian.Uint32( d[24:] ))
+            if o > len(d) || l > len(d) - o {
+                return ""
+            }
+            u := make( []uint16, l / 2 )
+            for j := range u {
+                u[j] = binary.BigEndian.Uint16( d[o+2*j:] )
+            }
+            return strings.TrimRight( string( utf16.Decode( u ) ), "\x00" )
+        }
+    }
+    return ""
+}
+
+// formatIccProfile prints the header fields and the description of the ICC
+// profile found in data, if any
+func formatIccProfile( w io.Writer, data []byte ) {
+    profile, problems := iccProfile( data, scanLayout( data ) )
+    if profile == nil && problems == nil {
+        return
+    }
+    fmt.Fprintf( w, "------ ICC Profile:\n" )
+    for _, p := range problems {
+        fmt.Fprintf( w, "  Warning: %s\n", p )
+    }
+    if profile == nil {                 // incomplete
+        fmt.Fprintf( w, "------\n" )
+        return
+    }
+    if len(profile) < 128 {
+        fmt.Fprintf( w, "  Invalid profile (%d bytes)\n------\n", len(profile) )
+        return
+    }
+    field := func( name, format string, a ...interface{} ) {
+        fmt.Fprintf( w, "  %s:\n    %s\n\n", name, fmt.Sprintf( format, a... ) )
+    }
+    size := binary.BigEndian.Uint32( profile )
+    field( "Size", "%d bytes (%d in header)", len(profile), size )
+    if iccSignature( profile[36:] ) != "acsp" {
+        fmt.Fprintf( w, "  Warning: missing profile signature acsp\n\n" )
+    }
+    field( "Version", "%d.%d.%d", profile[8], profile[9] >> 4,
+           profile[9] & 0x0f )
+    class := iccSignature( profile[12:] )
+    if name, ok := iccClasses[class]; ok {
+        class += " (" + name + ")"
+    }
+    field( "Profile class", "%s", class )
+    field( "Color space", "%s", iccSignature( profile[16:] ) )
+    field( "Connection space", "%s", iccSignature( profile[20:] ) )
+    be := binary.BigEndian
+    field( "Date", "%04d-%02d-%02d %02d:%02d:%02d", be.Uint16( profile[24:] ),
+           be.Uint16( profile[26:] ), be.Uint16( profile[28:] ),
+           be.Uint16( profile[30:] ), be.Uint16( profile[32:] ),
+           be.Uint16( profile[34:] ) )
+    if cmm := iccSignature( profile[4:] ); cmm != "" {
+        field( "Preferred CMM", "%s", cmm )
+    }
+    if platform := iccSignature( profile[40:] ); platform != "" {
+        field( "Platform", "%s", platform )
+    }
+    intent := be.Uint32( profile[64:] )
+    if int(intent) < len(iccRenderingIntents) {
+        field( "Rendering intent", "%s", iccRenderingIntents[intent] )
+    } else {
+        field( "Rendering intent", "unknown (%d)", intent )
+    }
+    if creator := iccSignature( profile[80:] ); creator != "" {
+        field( "Creator", "%s", creator )
+    }
+    if desc := iccDescription( profile ); desc != "" {
+        field( "Description", "%s", desc )
+    }
+    fmt.Fprintf( w, "------\n" )
+}
+
+// saveIccProfile saves the ICC profile found in data as a new file at path
+func saveIccProfile( path string, data []byte, l *fileLayout ) error {
+    profile, problems := iccProfile( data, l )
+    if profile == nil {
+        if len(problems) > 0 {
+            return fmt.Errorf( "incomplete ICC profile: %s\n",
+                               strings.Join( problems, ", " ) )
+        }
+        return fmt.Errorf( "no ICC profile to save\n" )
+    }
+    if err := writeFile( path, profile, 0644 ); err != nil {
+        return fmt.Errorf( "unable to save ICC profile: %v\n", err )
+    }
+    fmt.Printf( "Saved ICC profile as %s, %d bytes\n", path, len(profile) )
+    return nil
+}
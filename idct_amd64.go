@@ -0,0 +1,15 @@
+
+package main
+
+// cpuHasAVX2FMA returns true if the processor and the OS support AVX2 and FMA
+func cpuHasAVX2FMA( ) bool
+
+// matMul8AVX2 computes c = a × m for 8x8 matrices in row order
+//go:noescape
+func matMul8AVX2( a, m, c *[64]float64 )
+
+func init( ) {
+    if cpuHasAVX2FMA() {
+        simdMatMul8 = matMul8AVX2
+    }
+}
@@ -0,0 +1,68 @@
+#include "textflag.h"
+
+// func cpuHasAVX2FMA() bool
+TEXT ·cpuHasAVX2FMA(SB), NOSPLIT, $0-1
+    MOVL    $1, AX
+    XORL    CX, CX
+    CPUID
+    ANDL    $0x18001000, CX         // FMA, OSXSAVE, AVX
+    CMPL    CX, $0x18001000
+    JNE     no
+    XORL    CX, CX
+    XGETBV                          // XMM and YMM state enabled by the OS
+    ANDL    $6, AX
+    CMPL    AX, $6
+    JNE     no
+    MOVL    $7, AX
+    XORL    CX, CX
+    CPUID
+    ANDL    $0x20, BX               // AVX2
+    JZ      no
+    MOVB    $1, ret+0(FP)
+    RET
+no:
+    MOVB    $0, ret+0(FP)
+    RET
+
+// func matMul8AVX2(a, m, c *[64]float64)
+// each row of c is the sum of the rows of m weighted by the row of a
+TEXT ·matMul8AVX2(SB), NOSPLIT, $0-24
+    MOVQ    a+0(FP), SI
+    MOVQ    m+8(FP), DI
+    MOVQ    c+16(FP), DX
+    MOVQ    $8, CX
+row:
+    VXORPD  Y0, Y0, Y0
+    VXORPD  Y1, Y1, Y1
+    VBROADCASTSD 0(SI), Y2
+    VFMADD231PD 0(DI), Y2, Y0
+    VFMADD231PD 32(DI), Y2, Y1
+    VBROADCASTSD 8(SI), Y2
+    VFMADD231PD 64(DI), Y2, Y0
+    VFMADD231PD 96(DI), Y2, Y1
+    VBROADCASTSD 16(SI), Y2
+    VFMADD231PD 128(DI), Y2, Y0
+    VFMADD231PD 160(DI), Y2, Y1
+    VBROADCASTSD 24(SI), Y2
+    VFMADD231PD 192(DI), Y2, Y0
+    VFMADD231PD 224(DI), Y2, Y1
+    VBROADCASTSD 32(SI), Y2
+    VFMADD231PD 256(DI), Y2, Y0
+    VFMADD231PD 288(DI), Y2, Y1
+    VBROADCASTSD 40(SI), Y2
+    VFMADD231PD 320(DI), Y2, Y0
+    VFMADD231PD 352(DI), Y2, Y1
+    VBROADCASTSD 48(SI), Y2
+    VFMADD231PD 384(DI), Y2, Y0
+    VFMADD231PD 416(DI), Y2, Y1
+    VBROADCASTSD 56(SI), Y2
+    VFMADD231PD 448(DI), Y2, Y0
+    VFMADD231PD 480(DI), Y2, Y1
+    VMOVUPD Y0, (DX)
+    VMOVUPD Y1, 32(DX)
+    ADDQ    $64, SI
+    ADDQ    $64, DX
+    DECQ    CX
+    JNZ     row
+    VZEROUPPER
+    RET
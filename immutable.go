@@ -0,0 +1,78 @@
+
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+)
+
+// Image data write-protection (-image-data-immutable): metadata-only workflows
+// must be guaranteed not to alter the compressed picture. Operations that can
+// modify image data are refused when options are parsed, and any copy written
+// is verified to contain exactly the same image data segments as the original,
+// otherwise it is removed.
+
+// isImageDataMarker returns true for the segments that define or contain the
+// compressed picture: tables, frame and scan headers, restart markers and the
+// entropy-coded data following them.
+func isImageDataMarker( m byte ) bool {
+    return isSOF( m ) || m == markerDHT || m == markerDAC || m == markerDQT ||
+           m == markerDRI || m == markerSOS || m == markerDNL ||
+           m == markerEXP || m == markerDHP ||
+           ( m >= markerRST0 && m <= markerRST7 )
+}
+
+// imageDataSegments returns the image data segments of data, in file order,
+// with their entropy-coded data
+func imageDataSegments( data []byte ) (segments [][]byte, markers []byte) {
+    l := scanLayout( data )
+    for i := range l.segments {
+        s := &l.segments[i]
+        if isImageDataMarker( s.marker ) {
+            segments = append( segments, segmentBytes( s, data ) )
+            markers = append( markers, s.marker )
+        }
+    }
+    return
+}
+
+// checkImageDataImmutable returns an error if the image data of the copy at
+// output is not byte identical to the image data of the original at path. The
+// copy is removed in that case.
+func checkImageDataImmutable( path, output string ) error {
+    orig, err := os.ReadFile( path )
+    if err != nil {
+        return fmt.Errorf( "image data check: %v\n", err )
+    }
+    written, err := os.ReadFile( output )
+    if err != nil {
+        return fmt.Errorf( "image data check: %v\n", err )
+    }
+    oSegments, oMarkers := imageDataSegments( orig )
+    wSegments, _ := imageDataSegments( written )
+    problem := ""
+    for i := range oSegments {
+        if i >= len(wSegments) {
+            problem = fmt.Sprintf( "%s #%d is missing in the copy",
+                                   markerName( oMarkers[i] ), i )
+            break
+        }
+        if ! bytes.Equal( oSegments[i], wSegments[i] ) {
+            problem = fmt.Sprintf( "%s #%d differs in the copy",
+                                   markerName( oMarkers[i] ), i )
+            break
+        }
+    }
+    if problem == "" && len(wSegments) > len(oSegments) {
+        problem = "the copy has additional image data segments"
+    }
+    if problem == "" {
+        fmt.Printf( "Image data: %d segments identical to the original\n",
+                    len(oSegments) )
+        return nil
+    }
+    os.Remove( output )
+    return fmt.Errorf( "image data would be modified (%s): copy %s removed\n",
+                       problem, output )
+}
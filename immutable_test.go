@@ -0,0 +1,21 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestImmutableRefusals( t *testing.T ) {
+    for _, option := range []string{ "-tidyup", "-apply-suggestions=ask",
+                                     "-redact=0,0,8,8", "-to-gray" } {
+        t.Run( option, func( t *testing.T ) {
+            _, err := parseCheckerArgs( "-image-data-immutable", "-o",
+                                        "out.jpg", option, "in.jpg" )
+            if err == nil ||
+               ! strings.Contains( err.Error(), "-image-data-immutable" ) {
+                t.Errorf( "%s not refused with -image-data-immutable: %v",
+                          option, err )
+            }
+        } )
+    }
+}
@@ -0,0 +1,278 @@
+
+package main
+
+import (
+    "bytes"
+    "crypto/md5"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "strings"
+)
+
+// Photoshop Image Resource Blocks (IRB) and IPTC-IIM records: APP13 segments
+// starting with "Photoshop 3.0" hold a sequence of resource blocks, each made
+// of a signature (8BIM), a resource id, a padded Pascal name and a padded data
+// block. The IRB may be continued in several APP13 segments. Resource 0x0404
+// holds the IPTC-IIM records used by news and photo agencies (caption,
+// keywords, byline, copyright...), each made of a tag marker 0x1c, a record
+// number, a dataset number, a length and a value. Resource 0x0425 holds the
+// MD5 digest of the IPTC records, which is checked to detect records edited by
+// tools unaware of the digest.
+
+var photoshopHeader = []byte( "Photoshop 3.0\x00" )
+
+const (
+    irbIptc         = 0x0404
+    irbIptcDigest   = 0x0425
+)
+
+var irbNames = map[uint16]string{
+    0x03e9: "Print info",
+    0x03ed: "Resolution info",
+    0x03f3: "Print flags",
+    0x0404: "IPTC-NAA record",
+    0x0406: "JPEG quality",
+    0x0409: "Thumbnail (Photoshop 4)",
+    0x040a: "Copyright flag",
+    0x040b: "URL",
+    0x040c: "Thumbnail",
+    0x040d: "Global angle",
+    0x040f: "ICC profile",
+    0x0414: "Document ID seed",
+    0x0419: "Global altitude",
+    0x041a: "Slices",
+    0x041e: "URL list",
+    0x0421: "Version info",
+    0x0422: "Exif data 1",
+    0x0423: "Exif data 3",
+    0x0424: "XMP metadata",
+    0x0425: "IPTC digest",
+    0x0426: "Print scale",
+    0x0428: "Pixel aspect ratio",
+    0x043a: "Print information",
+    0x043b: "Print style",
+    0x2710: "Print flags info",
+}
+
+// IPTC-IIM dataset names, by record << 8 | dataset
+var iptcNames = map[uint16]string{
+    0x0100: "ModelVersion",
+    0x0105: "Destination",
+    0x0114: "FileFormat",
+    0x0146: "DateSent",
+    0x0150: "TimeSent",
+    0x015a: "CodedCharacterSet",
+    0x0200: "RecordVersion",
+    0x0205: "ObjectName",
+    0x020a: "Urgency",
+    0x020f: "Category",
+    0x0214: "SupplementalCategories",
+    0x0219: "Keywords",
+    0x0228: "SpecialInstructions",
+    0x0237: "DateCreated",
+    0x023c: "TimeCreated",
+    0x0241: "OriginatingProgram",
+    0x0246: "ProgramVersion",
+    0x0250: "By-line",
+    0x0255: "By-lineTitle",
+    0x025a: "City",
+    0x025c: "Sub-location",
+    0x025f: "Province-State",
+    0x0264: "Country-PrimaryLocationCode",
+    0x0265: "Country-PrimaryLocationName",
+    0x0267: "OriginalTransmissionReference",
+    0x0269: "Headline",
+    0x026e: "Credit",
+    0x0273: "Source",
+    0x0274: "CopyrightNotice",
+    0x0276: "Contact",
+    0x0278: "Caption-Abstract",
+    0x027a: "Writer-Editor",
+}
+
+type irbBlock struct {
+    id              uint16
+    name            string
+    data            []byte
+}
+
+type iptcDataset struct {
+    record, dataset byte
+    value           []byte
+}
+
+// photoshopIrb returns the IRB data of the APP13 segments found before the
+// image data, concatenated in file order
+func photoshopIrb( data []byte, l *fileLayout ) (irb []byte, found bool) {
+    for i := range l.segments {
+        s := &l.segments[i]
+        if isImageDataMarker( s.marker ) || s.marker == markerEOI {
+            break
+        }
+        d := s.data( data )
+        if s.marker == markerAPP0 + 13 && bytes.HasPrefix( d, photoshopHeader ) {
+            irb = append( irb, d[len(photoshopHeader):]... )
+            found = true
+        }
+    }
+    return
+}
+
+// irbBlocks returns the resource blocks of irb, and an error if irb is not
+// made of valid blocks only
+func irbBlocks( irb []byte ) (blocks []irbBlock, err error) {
+    for len(irb) > 0 {
+        if len(irb) < 12 {
+            return blocks, fmt.Errorf( "%d extra bytes after last block",
+                                       len(irb) )
+        }
+        switch string( irb[:4] ) {
+        case "8BIM", "PHUT", "AgHg", "DCSR", "MeSa":
+        default:
+            return blocks, fmt.Errorf( "invalid block signature %q",
+                                       irb[:4] )
+        }
+        b := irbBlock{ id: binary.BigEndian.Uint16( irb[4:] ) }
+        nl := int(irb[6])
+        pos := 6 + ( nl + 2 ) &^ 1      // Pascal name padded to even length
+        if pos + 4 > len(irb) {
+            return blocks, fmt.Errorf( "truncated block 0x%04x", b.id )
+        }
+        b.name = string( irb[7:7+nl] )
+        size := int(binary.BigEndian.Uint32( irb[pos:] ))
+        pos += 4
+        if size < 0 || size > len(irb) - pos {
+            return blocks, fmt.Errorf( "truncated block 0x%04x (%d bytes " +
+                                       "instead of %d)", b.id, len(irb) - pos,
+                                       size )
+        }
+        b.data = irb[pos:pos+size]
+        blocks = append( blocks, b )
+        pos += ( size + 1 ) &^ 1
+        if pos > len(irb) {
+            pos = len(irb)
+        }
+        irb = irb[pos:]
+    }
+    return
+}
+
+// iptcDatasets returns the IPTC-IIM datasets in d, and an error if d is not
+// made of valid datasets only. Trailing zero padding is accepted.
+func iptcDatasets( d []byte ) (datasets []iptcDataset, err error) {
+    for len(d) > 0 {
+        if d[0] != 0x1c {
+            if len( bytes.Trim( d, "\x00" ) ) == 0 {
+                break                   // padding
+            }
+            return datasets, fmt.Errorf( "invalid tag marker 0x%02x", d[0] )
+        }
+        if len(d) < 5 {
+            return datasets, fmt.Errorf( "truncated dataset" )
+        }
+        ds := iptcDataset{ record: d[1], dataset: d[2] }
+        size, pos := int(binary.BigEndian.Uint16( d[3:] )), 5
+        if size & 0x8000 != 0 {         // extended dataset
+            n := size & 0x7fff
+            if n > 4 || pos + n > len(d) {
+                return datasets, fmt.Errorf( "invalid extended length" )
+            }
+            size = 0
+            for _, b := range d[pos:pos+n] {
+                size = size << 8 | int(b)
+            }
+            pos += n
+        }
+        if size > len(d) - pos {
+            return datasets, fmt.Errorf( "truncated dataset %d:%d",
+                                         ds.record, ds.dataset )
+        }
+        ds.value = d[pos:pos+size]
+        datasets = append( datasets, ds )
+        d = d[pos+size:]
+    }
+    return
+}
+
+// iptcValue returns a dataset value as text
+func iptcValue( ds *iptcDataset ) string {
+    switch {
+    case ds.record == 1 && ds.dataset == 90:   // coded character set
+        if bytes.Equal( ds.value, []byte( "\x1b%G" ) ) {
+            return "UTF-8"
+        }
+        return fmt.Sprintf( "% x", ds.value )
+    case ( ds.record == 1 || ds.record == 2 ) && ds.dataset == 0 &&
+         len(ds.value) == 2:
+        return fmt.Sprintf( "%d", binary.BigEndian.Uint16( ds.value ) )
+    }
+    for _, b := range ds.value {
+        if b < 0x20 && b != '\n' && b != '\r' && b != '\t' {
+            return fmt.Sprintf( "%d bytes: % x", len(ds.value), ds.value )
+        }
+    }
+    return string( ds.value )
+}
+
+// formatPhotoshopIrb prints the resource blocks found in APP13 segments, with
+// the IPTC-IIM records they include
+func formatPhotoshopIrb( w io.Writer, data []byte ) {
+    irb, found := photoshopIrb( data, scanLayout( data ) )
+    if ! found {
+        return
+    }
+    fmt.Fprintf( w, "------ Photoshop IRB Metadata:\n" )
+    blocks, err := irbBlocks( irb )
+    var iptc, digest []byte
+    for _, b := range blocks {
+        name, ok := irbNames[b.id]
+        if ! ok {
+            name = "unknown"
+        }
+        if b.name != "" {
+            name += " \"" + b.name + "\""
+        }
+        fmt.Fprintf( w, "  Resource 0x%04x %s: %d bytes\n", b.id, name,
+                     len(b.data) )
+        switch b.id {
+        case irbIptc:
+            iptc = b.data
+        case irbIptcDigest:
+            digest = b.data
+        }
+    }
+    if err != nil {
+        fmt.Fprintf( w, "  Warning: %v\n", err )
+    }
+    if iptc != nil {
+        fmt.Fprintf( w, "\n--- IPTC-IIM records\n" )
+        datasets, err := iptcDatasets( iptc )
+        for i := range datasets {
+            ds := &datasets[i]
+            name, ok := iptcNames[uint16(ds.record) << 8 | uint16(ds.dataset)]
+            if ! ok {
+                name = "unknown"
+            }
+            fmt.Fprintf( w, "  %d:%03d %s:\n", ds.record, ds.dataset, name )
+            for _, l := range strings.Split( iptcValue( ds ), "\n" ) {
+                fmt.Fprintf( w, "    %s\n", strings.TrimRight( l, "\r" ) )
+            }
+            fmt.Fprintf( w, "\n" )
+        }
+        if err != nil {
+            fmt.Fprintf( w, "  Warning: %v\n", err )
+        }
+        if digest != nil {
+            sum := md5.Sum( iptc )
+            if bytes.Equal( sum[:], digest ) {
+                fmt.Fprintf( w, "  IPTC digest matches the records\n" )
+            } else {
+                fmt.Fprintf( w, "  Warning: IPTC digest does not match the " +
+                             "records (modified without updating the " +
+                             "digest)\n" )
+            }
+        }
+    }
+    fmt.Fprintf( w, "------\n" )
+}
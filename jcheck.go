@@ -18,34 +18,115 @@ const (
     END         = (1<<bits.UintSize)-1
 
     HELP        = 
-`jcheck [-h] [-v] [-oh=<class>]
-        [-w] [-rp] [-m] [-mcu] [-du] [-b=nn] [-e=pp]
+`jcheck [-h] [-v] [-oh=<class>] [-debug] [-no-simd]
+        [-w] [-severity=<s>] [-rp [-rp-depth=<n>] [-rp-size=<n>]] [-m] [-mcu] [-du] [-b=nn] [-e=pp] [-ri=n]
+        [-security] [-splice-check=<path>] [-exiftool-compare] [-verify-scan]
+        [-preservation-check] [-thumb-privacy] [-gray-check] [-lenient=<q>[,<q>]]
+        [-blank-check [-blank-stddev=<l>] [-blank-share=<p>]]
+        [-exposure-check [-clip-highlights=<p>] [-clip-shadows=<p>]]
+        [-blur-check [-blur-threshold=<v>]] [-rotation-check]
+        [-classify=<path> [-classify-size=<n>]]
         [-t] [-meta=<a>[:<s>] [-qu=<d>s|x|b] [-en=<c>:<d>[:f]s|x|b] [-sc=<n>[:f]s|x|b]
-        [-tidyup] [-rmeta=<a>:<s>] [-sthumb=<i>:<path>] [-o=name] filepath
+        [-marker-stats] [-entropy-stats] [-stuffing] [-coef-stats] [-fingerprint] [-lthumb] [-meta-flat] [-c2pa]
+        [-jumbf] [-sjumbf=<b>:<path>] [-sscan=<n>:<path>] [-recoverability]
+        [-suggest=<path>] [-apply-suggestions=<path>|ask]
+        [-tidyup] [-fix-byte-order] [-rmeta=<a>:<s>[:<t>]] [-sthumb=<i>:<path>] [-qerr=<path>]
+        [-meta-json=<path>] [-dumpmeta=<path>] [-sc2pa=<path>] [-sicc=<path>] [-rm-c2pa] [-sdepth=<path>]
+        [-schroma=<prefix>] [-squant=<path>] [-iquant=<d>:<path> [-iquant-mode=<m>]]
+        [-shuff=<path>] [-ihuff=<path>] [-setmeta=<t>=<v>[,<t>=<v>]] [-strip-gps]
+        [-copymeta=<path>[:<k>[,<k>]]] [-loadmeta=<path>]
+        [-thumb-format=<f>] [-thumbs=<m>] [-redact=<r>[:<f>]] [-to-gray]
+        [-gray=<m>] [-stamp=<png>:<c>[:<o>]] [-resize=<s> [-resize-filter=<f>]]
+        [-derive=<presets>] [-o=name [-selftest-roundtrip] [-audit] [-undo=<path>]]
+        [-sanitize]
+        [-image-data-immutable] [-reproducible]
+        [-on-error=<action> [-fail-on=<s>]]
+        [-sample=<n>|<p>%%] [-seed=<s>] [-journal=<path> [-resume]]
+        [-max-write-mbps=<r>] [-max-open-files=<n>]
+        [-cache=<path> [-force]] [-checksum=<a>:<path>] [-verify-checksum=<path>]
+        [-sign=<keyfile>] [-verify-sig=<keyfile>]
+        [-xml-report=<path>] [-report=<path>] [-sink=<f>:<path>[,<f>:<path>]] [-json]
+        [-R=<dir> [-symlinks=<m>] [-hardlinks=<m>] [-min-size=<s>]
+         [-max-size=<s>] [-newer-than=<t>] [-older-than=<t>]] [-q [-q-summary]]
+        filepath [filepath...]
+jcheck bench [-runs=<n>] [-modes=<m>] [-save=<path>] [-compare=<path>] <dir>
+jcheck gen-testset [-quality=<q>] <dir>
+jcheck make [-pattern=<p>] [-size=<WxH>] [-quality=<q>] [-progressive] <path>
+jcheck disassemble <file> <dir>
+jcheck assemble <dir> -o=<path> [-force]
+jcheck undo [-o=<path>] <patch> <file>
 
     Check if a file is a valid jpeg document, allowing to print internal
     information about the jpeg encoding, to show errors during analysis, to fix
     a few minor errors in the jpeg file format, to save embedded thumbnails as
     separate JPEG files and to save the raw decoded RGB data. Without options it
-    just prints a short summary of the file contents.
+    just prints a short summary of the file contents. JPEG XT extension boxes
+    are always reported, since only the legacy base layer is decoded.
+
+    jcheck bench measures the throughput of the main code paths over a corpus
+    of jpeg files, see jcheck bench -h.
+
+    jcheck gen-testset synthesizes a suite of small jpeg files covering the main
+    features of the format and broken variants, for testing decoders, see
+    jcheck gen-testset -h.
+
+    jcheck make encodes a synthetic test picture (gradient, color bars or noise)
+    of any size and quality, see jcheck make -h.
+
+    jcheck disassemble splits a jpeg file into a directory of segment files
+    with a manifest, which can be edited before jcheck assemble rebuilds and
+    validates the jpeg file, see jcheck assemble -h.
+
+    jcheck undo restores an original file from the copy written with -o and
+    the patch saved with -undo, see jcheck undo -h.
 
     General options:
 
         -h                      print this short help message and exit
         -v                      print current jcheck version and exit
         -oh=<class>             print longer <class> options help and exit
-                                <class> can be: parse, display, modify or save
+                                <class> can be: parse, display, modify, save
+                                or batch
+        -debug                  print debugging information (stack trace) if
+                                the analysis of a file fails unexpectedly
+        -no-simd                do not use SIMD instructions (AVX2 on amd64)
+                                for the block transforms of the pictures
+                                reconstructed by jcheck (-spict of
+                                progressive or 12-bit frames, -splice-check)
 
     Parsing options:                    for more details -oh=parse
 
         -w                      warn about issues during parsing
+        -severity=<s>           list diagnostics at least as severe as s
         -x                      print extra information about frames
         -rp                     recursively parse embedded jpeg pictures
+        -rp-depth=<n>           maximum IFD nesting depth with -rp (default 8)
+        -rp-size=<n>            maximum embedded picture bytes with -rp
+        -lenient=<q>[,<q>]      tolerate known vendor quirks in Exif data
         -m                      print markers as parsing goes
         -mcu                    print detailed mcu parsing (very verbose)
         -du                     print data units from mcu (extremely verbose)
         -b=<nn>                 begin printing mcu/du at mcu #nn (default 0)
-        -e=<pp>                 end printing at mcu #pp (default end of scan)
+        -e=<pp>|+<n>            end printing at mcu #pp or n mcus after -b
+        -ri=<n>                 print mcu/du of restart interval #n only
+        -security               look for executables or scripts in metadata
+        -splice-check=<path>    look for pasted regions, save a suspicion map
+        -exiftool-compare       compare metadata values with exiftool
+        -verify-scan            entropy decode all scans to check image data
+        -preservation-check     give a verdict on long-term preservation
+        -thumb-privacy          compare embedded thumbnails with the picture
+        -gray-check             flag grayscale pictures stored as color
+        -blank-check            flag pictures of almost a single color
+        -blank-stddev=<l>       largest luma standard deviation of a blank picture
+        -blank-share=<p>        percentage of uniform pixels in a blank picture
+        -exposure-check         flag severe highlight or shadow clipping
+        -clip-highlights=<p>    largest percentage of clipped highlights
+        -clip-shadows=<p>       largest percentage of clipped shadows
+        -blur-check             flag out-of-focus or shaken pictures
+        -blur-threshold=<v>     smallest luma Laplacian variance of a sharp picture
+        -rotation-check         suggest a rotation if Exif orientation is missing
+        -classify=<path>        run an external classifier on the picture
+        -classify-size=<n>      largest side of pictures given to the classifier
 
     Display options:                    for more details -oh=display
 
@@ -54,33 +135,324 @@ const (
         -qu=<d>s|x|b            print quantization matrixes
         -en=<c>:<d>[:<f>]s|x|b  print entropy tables.
         -sc=<n>[:<f>]s|x|b      print scan information
+        -marker-stats           print marker statistics and anomalies
+        -entropy-stats          print compressed data statistics
+        -stuffing               print fill bytes, stuffed bytes and illegal 0xff
+        -coef-stats             print DCT coefficient statistics per position
+        -fingerprint            print the encoder fingerprint (standard tables)
+        -lthumb                 list all embedded images with their ids
+        -meta-flat              print all metadata tags as flat keys
+        -c2pa                   print C2PA (Content Credentials) manifests
+        -jumbf                  print the tree of JUMBF boxes in APP11
+        -recoverability         score how much of the picture survives damage
+        -suggest=<path>         save repair suggestions with their confidence
 
     Modification options:               for more details -oh=modify
 
         -tidyup                 fix common errors and clean file during analysis
+        -fix-byte-order         rewrite Exif IFDs in the declared byte order
+        -apply-suggestions=<p>  apply repair suggestions from file, or ask
         -rmeta=<a>[:<s>]        remove non-critical metadata from the file.
+        -rm-c2pa                remove C2PA manifests from the output file
+        -thumbs=<m>             strip or regenerate all embedded renditions
+        -redact=<r>[:<f>]       black out or pixelate a region of the picture
+        -to-gray                convert grayscale pictures stored as color
+        -iquant=<d>:<path>      replace a quantization table from a text file
+        -iquant-mode=<m>        requantize coefficients or replace header only
+        -ihuff=<path>           replace Huffman tables from a json file
+        -setmeta=<t>=<v>[,...]  modify or insert Exif tags in the output file
+        -strip-gps              remove all location data from the output file
+        -copymeta=<path>[:<k>]  copy Exif, XMP or ICC segments from another file
+        -loadmeta=<path>        write Exif tags and XMP properties from a json template
+        -image-data-immutable   refuse any change to the compressed picture
+        -audit                  record the modifications in the output file
+        -undo=<path>            save a patch restoring the original from -o
 
     Saving options:                     for more details -oh=save
 
         -sthumb=<t>:<p>         save embedded thumbnail into new file
         -spict=[<o>[,<f>]:]<p>  Save main picture as raw RGB samples
+        -gray=<m>               grayscale conversion for a BW saved picture
+        -stamp=<png>:<c>[:<o>]  composite a watermark onto the saved picture
+        -resize=<s>             resize the saved picture (WxH, p%%, maxdim=n)
+        -resize-filter=<f>      resampling filter for -resize
+        -derive=<presets>       save the derivatives defined in a presets file
+        -qerr=<path>            save a quantization error heat-map as png
+        -meta-json=<path>       save all metadata tags with their types as json
+        -dumpmeta=<path>        save all metadata as a json or csv sidecar
+        -sc2pa=<path>           save the C2PA manifest store as a .c2pa file
+        -sicc=<path>            save the ICC profile as a .icc file
+        -sjumbf=<b>:<p>         save JUMBF box into new file
+        -sscan=<n>:<p>          save the entropy-coded data of a scan into new file
+        -sdepth=<path>          save the portrait mode depth map into new file
+        -schroma=<prefix>       save Cb and Cr at their stored resolution
+        -squant=<path>          save quantization tables as editable text
+        -shuff=<path>           save Huffman tables as editable json
+        -thumb-format=<f>       transcode saved embedded images to png or webp
         -o name                 output the modified JPEG data to a new file
-
-    filepath is the path to the file to process
+        -selftest-roundtrip     verify the output file against the original
+        -sanitize               replace reserved characters in output names
+        -reproducible           write byte identical outputs for identical inputs
+
+    Batch options:                      for more details -oh=batch
+
+        -sample=<n>|<p>%%        check only a random sample of the given files
+        -seed=<s>               seed for the random sample (default 1)
+        -journal=<path>         record the outcome of each file in a journal
+        -resume                 resume an interrupted batch from its journal
+        -max-write-mbps=<r>     limit the rate of writes, in MB/s
+        -max-open-files=<n>     limit the number of files open at the same time
+        -cache=<path>           do not check again files unchanged since cached
+        -force                  check all files, even if unchanged in cache
+        -on-error=<action>      move, copy, delete or rename failed files
+        -fail-on=<s>            severity that fails a file for -on-error
+        -checksum=<a>:<path>    write a checksum manifest for all files
+        -verify-checksum=<path> verify file checksums from a manifest
+        -sign=<keyfile>         sign valid files (image data and Exif/ICC)
+        -verify-sig=<keyfile>   verify file signatures
+        -xml-report=<path>      write a JHOVE-like xml report for all files
+        -report=<path>          write a json report for all files
+        -sink=<f>:<path>        write a report in format f (json, xml, csv...)
+        -json                   print the analysis as json instead of text
+        -R=<dir>                check all jpeg files in a directory tree
+        -symlinks=<m>           with -R, skip or follow symbolic links
+        -hardlinks=<m>          with -R, check files with several paths once or
+                                for all paths
+        -min-size=<s>           with -R, check only files of at least s bytes
+        -max-size=<s>           with -R, check only files of at most s bytes
+        -newer-than=<t>         with -R, check only files modified after t
+        -older-than=<t>         with -R, check only files modified before t
+        -q                      print nothing, only set the exit status
+        -q-summary              with -q, print a PASS or FAIL line per file
+
+    filepath is the path to the file to process. If several filepaths are
+    given, they are processed in sequence with the same options (batch mode)
+    and a summary is printed at the end. A failure while processing one file
+    does not stop the batch. A filepath can also be a BagIt bag directory, in
+    which case the bag is verified and all jpeg files in its payload are added
+    to the batch. With -R, filepaths are optional.
+
+    The exit status is 0 if all files are valid, 1 if some file failed and 2
+    if the options are invalid.
 
 `
     PARSE_OPTIONS =
 `
     Parsing options:
 
-        -w          warn about inconsistencies and errors during parsing
+        -w          warn about inconsistencies and errors during parsing, same
+                    as -severity=warning
+        -severity=<s>
+                    collect all diagnostics for each file, including the
+                    warnings of the parser (which are not printed inline), and
+                    list at the end of the analysis those at least as severe
+                    as s (info, warning, error or fatal, for an analysis that
+                    could not be completed), each with a stable code (JCnnnn)
+                    and its file offset if known. Only those diagnostics are
+                    kept in the reports (-report, -xml-report and -json),
+                    where they are given with their code and offset. The end
+                    of each restart interval, which the parser reports as an
+                    unexpected end of scan segment (JC0016), is an info.
         -x          print extra information when parsing frame and scan headers
+                    and the specification clause relevant to each error
         -rp         recursively parse all embedded jpeg pictures (thumbnails).
+                    Before parsing, the Exif IFD structure is checked for
+                    offset loops and excessive nesting and the total size of
+                    embedded pictures is checked against a limit. If the
+                    check fails, a diagnostic is printed and embedded pictures
+                    are not parsed for that file.
+        -rp-depth=<n>
+                    maximum nesting depth of IFDs accepted with -rp, counting
+                    both chained IFDs and sub-IFDs (default 8).
+        -rp-size=<n>
+                    maximum total size in bytes of embedded pictures accepted
+                    with -rp (default 64 MiB).
+        -lenient=<q>[,<q>]
+                    tolerate known vendor quirks when reading Exif TIFF
+                    structures with jcheck's own reader (metadata, maker note
+                    previews, embedded pictures), so that their data can still
+                    be extracted. <q> can be:
+                      maker-base     maker note preview offsets relative to
+                                     another base than expected for the vendor
+                                     (Exif TIFF header or maker note start)
+                      ifd-count      IFD entry count off by one, in either
+                                     direction
+                      padded-values  single short values stored after their
+                                     padding in the value field
+                      all            all of the above
+                    Each quirk applied is reported as a warning.
         -m          print markers and offsets as parsing goes
-        -mcu        print detailed mcu parsing (very verbose)
+        -mcu        print detailed mcu parsing (very verbose). For arithmetic
+                    coded frames (SOF9, SOF10), which are decoded by jcheck
+                    instead of the library, the value of each coefficient
+                    decoded in each data unit is printed with the offset of
+                    the entropy-coded data.
         -du         print each data unit extracted from mcu (extremely verbose)
         -b=<nn>     begin printing mcu and/or du at mcu #nn (default 0)
-        -e=<pp>     end printing mcu/du at mcu #pp (default end of scan)
+        -e=<pp>|+<n>
+                    end printing mcu/du at mcu #pp (default end of scan), or
+                    n mcus after the mcu given by -b with +n. The mcus are
+                    numbered from 0 in each scan: the number of mcus of each
+                    scan of the first frame is printed with the usable range,
+                    and a warning is given if -b is beyond all scans.
+        -ri=<n>     print mcu and/or du of restart interval #n only, instead
+                    of giving -b and -e, since decoders usually report
+                    corruption by restart interval. Restart intervals are
+                    numbered from 0 in each scan, and interval n is made of
+                    the mcus n*r to n*r+r-1, where r is the restart interval
+                    defined by DRI for the first scan of each file. If the
+                    file has no restart interval, a warning is given and
+                    nothing is printed.
+        -security   look for signatures of executables, scripts, archives or
+                    suspicious URLs in APPn and COM segments, in data between
+                    segments and in data following EOI, and print a security
+                    warning with the offset of each kind of signature found.
+                    Plain URLs are reported only outside of APPn segments,
+                    since metadata commonly refers to XML namespaces.
+                    In addition, files that are also valid zip archives or pdf
+                    documents, or that include html tags in COM or APPn
+                    segments (polyglot files) are reported as security errors
+                    and fail.
+        -splice-check=<path>
+                    look for regions likely pasted from another jpeg picture,
+                    by tiles of 32x32 pixels of the luminance: tiles where the
+                    8x8 block grid is visible but shifted relatively to the
+                    grid of the whole picture, and tiles showing a jpeg ghost
+                    (a dip in the difference with a recompressed version at a
+                    lower quality than the rest of the picture) are reported
+                    as warnings. A suspicion map is saved as png at <path>,
+                    with the picture in gray and suspicious tiles in red
+                    (misaligned grid), orange (ghost) or bright red (both).
+                    Those are statistical hints, not proofs of manipulation.
+                    This is only available for Huffman coded sequential or
+                    progressive frames.
+        -exiftool-compare
+                    run exiftool (which must be installed and in the PATH) on
+                    the same file and compare the metadata values it reports
+                    with the values read by jcheck (as with -meta-json), in
+                    JFIF, Exif (IFD0, IFD1, Exif, GPS, interoperability and
+                    sub-IFDs) and MPF index groups. Tag names are mapped to
+                    exiftool names, rationals are compared as decimal values
+                    and values that exiftool converts (GPS coordinates, APEX
+                    aperture and shutter speed) are converted the same way.
+                    Tags with different values are printed and reported as
+                    warnings, tags found by only one of the tools are printed.
+                    This is intended to qualify jcheck against exiftool on a
+                    collection before switching tools.
+        -verify-scan
+                    entropy decode all scans of the first frame, independently
+                    of the analysis and without reconstructing samples, to
+                    check that the compressed picture is intact: invalid
+                    Huffman codes, coefficient index overruns, entropy-coded
+                    data too short or too long for its MCUs, and RSTn markers
+                    out of sequence are reported as errors and the file fails.
+                    This is only available for Huffman coded sequential or
+                    progressive frames. The sequence of RSTn markers is also
+                    checked without -verify-scan, from the markers only.
+        -preservation-check
+                    give a verdict on the suitability of the file for long-term
+                    preservation, combining the following checks with
+                    recommendations: conformance (structure and entropy-coded
+                    data, as with -verify-scan), coding process (Huffman
+                    sequential or progressive), metadata (APPn segments
+                    described by a public specification, maker notes), hidden
+                    data (as with -security, and payloads with an entropy above
+                    7.5 bits per byte where arbitrary data can be stored),
+                    quality (estimated quantization error, as with -qerr) and
+                    recoverability (as with -recoverability). A failed check
+                    makes the file unsuitable, which is reported as a warning,
+                    other checks only add recommendations.
+        -thumb-privacy
+                    compare all embedded renditions (JFIF, JFXX and Exif
+                    thumbnails, maker note previews, MPF and FlashPix images)
+                    with the main picture, resampled to their size, stretched
+                    and letterboxed, to detect pictures that were cropped or
+                    redacted while their thumbnails still show the original
+                    content. A rendition whose mean luminance difference
+                    exceeds 20 levels, or 60 levels in one of 8x8 tiles, is
+                    reported as a warning. See -thumbs to fix the copy.
+        -gray-check
+                    flag grayscale pictures stored as YCbCr, such as scanned
+                    black and white documents saved as color: the Cb and Cr
+                    planes are reconstructed and the picture is reported as a
+                    warning if at least 99.9% of the samples of each plane are
+                    within 2 levels of the plane mean, with the size of the
+                    entropy-coded data used by the chroma, which a conversion
+                    with -to-gray would save. A chroma mean away from the mid
+                    level is reported as a uniform tint. This is only
+                    available for Huffman coded sequential or progressive
+                    frames.
+        -blank-check
+                    flag blank pictures, typical of failed scans or camera
+                    glitches: the picture is decoded and reported as a warning
+                    if the standard deviation of its luma is at most
+                    -blank-stddev levels (default 2), or if at least
+                    -blank-share percent of its pixels (default 99.5) are
+                    within 8 levels of the mean color in R, G and B, which
+                    tolerates a few hot pixels or specks.
+        -blank-stddev=<levels>
+                    largest standard deviation of the luma, in levels from 0
+                    to 255, of a blank picture, with -blank-check.
+        -blank-share=<percent>
+                    smallest percentage of pixels close to the mean color in a
+                    blank picture, with -blank-check.
+        -exposure-check
+                    compute the luma histogram of the decoded picture and count
+                    the clipped pixels: highlights with R, G and B all at
+                    least 254, and shadows with R, G and B all at most 1. The
+                    mean luma, the 1%, 50% and 99% luma percentiles and the
+                    percentages of clipped pixels are printed, and clipping
+                    beyond -clip-highlights or -clip-shadows is reported as a
+                    warning. The mean luma, the percentages and the flags
+                    (highlights, shadows) are given in the csv and json
+                    reports, to triage capture quality across batches.
+        -clip-highlights=<percent>
+                    largest percentage of clipped highlights (default 1), with
+                    -exposure-check.
+        -clip-shadows=<percent>
+                    largest percentage of clipped shadows (default 1), with
+                    -exposure-check.
+        -blur-check
+                    estimate the sharpness of the decoded picture without a
+                    reference, as the variance of the Laplacian of its luma:
+                    edges give a large variance, whereas an out-of-focus or
+                    shaken capture gives a small one. A variance below
+                    -blur-threshold is reported as a warning. The variance and
+                    the blurred flag are given in the csv and json reports.
+        -blur-threshold=<variance>
+                    smallest variance of the luma Laplacian, in squared levels,
+                    of a sharp picture (default 100), with -blur-check. The
+                    variance depends on the content and the resolution, so the
+                    threshold should be tuned for each kind of batch.
+        -rotation-check
+                    if the file has no Exif orientation, as is common in
+                    scanned batches, estimate how the picture should be turned
+                    from simple statistics of the decoded picture: for a
+                    document (ink on paper), text lines should be horizontal
+                    and aligned on the left; for another picture, the top
+                    should be brighter and smoother than the bottom, with more
+                    horizontal than vertical edges. A likely rotation is
+                    reported as an info message with the Exif orientation to
+                    set with -setmeta=Orientation=<o>. The picture is never
+                    turned automatically.
+        -classify=<path>
+                    run an external classifier on the picture, for instance to
+                    flag pictures showing faces or documents before publication.
+                    The main picture is decoded and downscaled to fit in a
+                    square of -classify-size pixels. If path ends with .so it
+                    is a Go plugin, loaded once, that must export a function
+                      func Classify( width, height int, rgb []byte ) ([]string,
+                                                                      error)
+                    otherwise it is an executable, run for each file with the
+                    file path as argument and the picture as a binary PPM (P6)
+                    on its standard input, which must print one verdict per
+                    line. Verdicts starting with "warning:" or "error:" are
+                    reported with that severity, others as info. An error
+                    verdict or a failure of the classifier makes the file fail.
+        -classify-size=<n>
+                    largest side in pixels of the pictures given to the
+                    classifier with -classify (default 512). Smaller pictures
+                    are given at their size.
 
 `
 
@@ -103,9 +475,29 @@ const (
                     for a possible maker-note embedded ifd.
                     For example, -meta=0,1:0:2 will show all metadata available
                     in app0 and only ifds 0 and 2 in app1 (exif) segment.
+                    XMP packets in app1 segments (main and extended) are
+                    printed after the exif metadata if no subset id is given
+                    for app1, as properties named by their namespace prefix,
+                    with array items between brackets (index or language) and
+                    struct fields after '/', for example dc:title[x-default] or
+                    xmpMM:History[1]/stEvt:action.
+                    Similarly, the ICC profile in app2 segments is summarized
+                    after the other app2 metadata: header fields (version,
+                    profile class, color space, connection space, rendering
+                    intent...) and description tag, and the Photoshop image
+                    resource blocks in app13 segments are listed with the
+                    IPTC-IIM records they include (caption, keywords,
+                    byline, copyright...), checking the IPTC digest. The
+                    Adobe app14 segment is decoded with its DCTEncode version,
+                    flags and color transform, and the color space it gives.
+                    The maker note of Canon, Nikon, Sony, Fujifilm, Olympus
+                    and Panasonic cameras, selected by the Exif Make tag, is
+                    decoded after the other app1 metadata, either with sid 5
+                    or if no sid is given for app1: vendor tags are printed by
+                    name, with lens, focus mode and serial numbers decoded.
         -qu=<d>s|x|b[,<d>s|x|b]*
                     print quantization matrixes
-                    d is the table destination from 0 to 4, or * for all
+                    d is the table destination from 0 to 3, or * for all
                     destinations. The following letter, s, x or b requests
                     respectively that a standard form, an extra version or
                     both standard and extra version be used (default to
@@ -116,8 +508,10 @@ const (
         -en=<c>:<d>[:<f>]s|x|b[,<c>:<d>[:<f>]s|x|b]*
                     print entropy tables.
                     c is the table class, DC or AC or *, d is the table
-                    destination, from 0 to 4, or * for all destinations within
-                    the class and f is an optional frame number (0 by default).
+                    destination, from 0 to 3 (0 to 1 in baseline frames), or *
+                    for all destinations within the class and f is an optional
+                    frame number (0 by default). Destinations are checked
+                    against the process of each frame.
                     The following letter, s, x or b requests respectively that
                     a standard form, an extra version or both standard and
                     extra version be used (default to standard if absent).
@@ -139,6 +533,148 @@ const (
                     The following letter, s, x or b requests respectively that
                     a standard form, an extra version or both standard and
                     extra version be used (default to standard if absent).
+        -marker-stats
+                    print a compact table of all markers found in the file
+                    with their count and the offset of their first occurrence,
+                    followed by the number of fill bytes (0xff preceding a
+                    marker), padding bytes found between segments, trailing
+                    bytes after the last EOI and a list of unusual orderings
+                    (duplicate SOI or EOI, APPn after the frame header, etc.).
+                    Those statistics are obtained from a simple scan of the
+                    markers, independently of the analysis, so that they are
+                    available even if the analysis fails.
+        -stuffing   print the byte stuffing of the file: all 0xff fill bytes
+                    preceding markers, inside or outside entropy-coded data,
+                    with their offset and the marker that follows, then for
+                    each scan the size of its entropy-coded data, the number of
+                    stuffed 0xff00 sequences with the offset of the first one,
+                    the number of RSTn markers and the marker ending the scan,
+                    and finally all illegal 0xff sequences found in
+                    entropy-coded data (0xff followed by TEM or a reserved
+                    code) with their offset. Entropy-coded data is scanned
+                    until a marker other than RSTn, so that an illegal
+                    sequence does not end the scan. Illegal sequences are
+                    reported as a warning.
+        -entropy-stats
+                    print statistics about the entropy-coded data of the first
+                    image in the file: its size, the number of compressed bits
+                    per pixel, the percentage of stuffed bytes and of marker
+                    overhead (everything that is not entropy-coded data), and
+                    for each component the compressed size and the number of
+                    bits allocated to DC and AC coefficients, with the share of
+                    Huffman codes decoded by table lookup. The bit allocation
+                    is only available for Huffman coded sequential or
+                    progressive frames. The decoding speed with and without
+                    lookup tables is measured by the Go benchmark
+                    BenchmarkHuffman (go test -bench Huffman).
+        -coef-stats
+                    print for each component of the first image, and for each
+                    of the 64 coefficient positions in zigzag order, the
+                    quantization step of the table used by the component, the
+                    minimum, maximum, mean and mean absolute value of the
+                    quantized coefficients and the proportion of zeros, over
+                    all blocks covering the picture. The number of clipped
+                    coefficients, whose dequantized value is out of the range
+                    of the DCT at the frame precision (-1024 to 1023 for 8
+                    bits) and must be clamped by decoders, is also given: a
+                    correct encoder never produces them. This is only
+                    available for Huffman coded sequential or progressive
+                    frames.
+        -fingerprint
+                    print the encoder fingerprint of the first image: coding
+                    process, precision, sampling factors, number of scans,
+                    restart interval, the class of each Huffman table and of
+                    each quantization table, and the order of the segments
+                    before the first scan, followed by a one-line signature
+                    that can be used to group files by encoder. Whether the
+                    Huffman tables are exactly the example tables of Annex K
+                    (common in camera firmware) is reported. Other tables are
+                    optimized (complete canonical code built from symbol
+                    statistics), fixed (custom tables coding all symbols) or
+                    unusual: some symbols invalid for their class, part of the
+                    code space unassigned or a table never used by any scan,
+                    which is reported as a warning. Quantization tables are
+                    compared with the Annex K tables scaled for a quality as
+                    done by IJG libjpeg.
+        -lthumb
+                    list all pictures embedded in the file, with an id that can
+                    be used with -sthumb, their container, format, size in
+                    pixels and byte range in the file. The following containers
+                    are examined:
+                        jfif    uncompressed JFIF APP0 thumbnail
+                        jfxx    JFXX APP0 extension thumbnail
+                        exif    Exif thumbnail referred to by IFD1 (JPEG or
+                                uncompressed TIFF RGB)
+                        maker   large preview stored in the Exif maker note
+                                (Canon, Nikon, Olympus and Sony formats)
+                        mpf<n>  entry n of a multi-picture format (MPF) APP2
+                                index, where mpf1 is usually the main picture
+                        fpxr<n> jpeg picture in FlashPix ready APP2 stream n
+                        depth<n> depth map written by phone portrait modes:
+                                Google GDepth (XMP GDepth:Data), Google
+                                Dynamic Depth (item with the Depth semantic
+                                appended after the primary image) or Apple
+                                (MPF image with an XMP depth or disparity
+                                auxiliary image type)
+        -meta-flat
+                    print all metadata tags found in the file, one per line as
+                    <container>.<group>.<tag>=<value>, for example:
+                        exif.ifd0.Make="Canon"
+                        exif.gps.GPSLatitude=48/1 51/1 2400/100
+                    ascii values are quoted, rationals are given as n/d, byte
+                    and undefined values in base64 after "base64:" and
+                    multiple values are separated by spaces. Containers and
+                    groups are the same as in the json document saved by
+                    -meta-json, which is easier to use for typed values.
+        -c2pa
+                    print a summary of the C2PA (Content Credentials) manifest
+                    store carried in APP11 segments: for each manifest, its
+                    label, claim generator, title, format, assertions, claim
+                    signature and hard binding status. The last manifest is
+                    the active one. Signatures are checked at the structure
+                    level only (a COSE_Sign1 structure with a signature), the
+                    signer certificate is not verified. The data hash of the
+                    c2pa.hash.data assertion is recomputed: a mismatch means
+                    that the file was modified after signing. Problems are
+                    reported as warnings.
+        -jumbf
+                    print the tree of JUMBF (ISO/IEC 19566-5) boxes carried in
+                    APP11 segments, after reassembling the boxes split over
+                    several segments. For each box, its path in the tree (as
+                    used with -sjumbf), its type, offset in the reassembled
+                    store and payload size, and for superboxes the content
+                    type, label and id given by their description box. Top
+                    level boxes are numbered from 1 across all box instances,
+                    and the children of box 1 are 1.1, 1.2 and so on, 1.1
+                    being its description box. Problems are reported as
+                    warnings.
+        -recoverability
+                    print a score from 0 to 100 of how much of the picture is
+                    likely to survive corruption of the file, with the factors
+                    it is made of and suggestions to improve it: restart
+                    markers and their density (40 points for at least one per
+                    MCU row), coding process (20 points for sequential Huffman,
+                    10 for progressive, since errors spread to later scans),
+                    share of metadata before the frame header (20 points),
+                    and redundancy (10 points for a C2PA hash allowing to
+                    detect damage, 10 for an embedded thumbnail or preview).
+                    The score and suggestions are reported as info messages.
+        -suggest=<path>
+                    walk the raw file structure from marker to marker and save
+                    as json at <path> the concrete repairs found, each with
+                    its file offset, the bytes to remove and to insert there,
+                    a description and a confidence level (high, medium or
+                    low): a segment length field that does not lead to the
+                    next marker, corrected from the segment content (DHT, DQT,
+                    SOFn, SOS and DRI, high) or to the nearest length leading
+                    to valid segments (medium), garbage between segments
+                    (medium), a single restart marker out of sequence (high),
+                    a missing EOI (high, or medium if the file may be
+                    truncated) and data after EOI (low, since it may be
+                    intentional). Suggestions are printed and reported as info
+                    messages. Only high confidence ones are marked to be
+                    applied ("apply": true) in the file, which can be edited
+                    before giving it to -apply-suggestions.
 
 `
 
@@ -146,7 +682,41 @@ const (
 `
     Modification options:
 
-        -tidyup     fix common errors and clean file during analysis
+        -tidyup     fix common errors and clean file during analysis. In the
+                    copy written with -o, the APPn segments found before the
+                    first scan are also moved right after SOI in the
+                    recommended order: JFIF APP0 (then JFXX), Exif APP1, XMP
+                    APP1 (then extended XMP), ICC profile APP2 chunks,
+                    contiguous and sorted by sequence number, and all other
+                    APPn segments in their original order. Tables, frame
+                    header and comments keep their relative order, MPF offsets
+                    are adjusted and the segments moved are reported. An Exif
+                    block written in another APPn segment (as some phones do,
+                    making it invisible to most readers) or after other
+                    segments is moved as APP1 to its expected position before
+                    the analysis. Such placements are always reported.
+        -fix-byte-order
+                    rewrite the IFDs of the Exif TIFF structure that are
+                    encoded in the opposite byte order of the TIFF header
+                    (some broken writers mix them) in the declared order
+                    before the analysis, so that the analysis and the copy
+                    written with -o use a consistent structure. Entry fields,
+                    IFD offsets and values of known types are byte swapped;
+                    undefined values such as maker notes are kept as is.
+                    Inconsistencies are always reported as warnings, even
+                    without this option.
+        -apply-suggestions=<path>|ask
+                    apply to the raw file, before the analysis, the repairs
+                    marked to be applied in the json file saved by -suggest,
+                    which must have been made for the same file content (same
+                    size and sha256), so that the analysis and the copy
+                    written with -o (required) use the repaired file. With
+                    ask, the repairs found as with -suggest are proposed one
+                    by one, and applied if the answer read on the standard
+                    input is y. This guided repair is safer than -tidyup for
+                    precious files. Each repair applied is reported as a
+                    warning. Since repairs may modify the compressed picture,
+                    this option is refused with -image-data-immutable.
         -rmeta=<id>[:<sid>]*[,<id>[:<sid>]]*
                     remove non-critical metadata information from the file.
                     id is the jpeg app segment id (0 to 15, for app0 to app15)
@@ -155,14 +725,201 @@ const (
                     the app segment contains multiple containers that can be
                     identified by ids. This is intended for app1 containing
                     multiple tiff ifd. In this case the list of sids identifies
-                    all ifd ids to remove (whole ifds, it is not possible to
-                    remove only a few specific exif tags from an ifd). See
-                    option -meta for the how sid are used. If sids are absent,
-                    the whole app segment is removed.
+                    all ifd ids to remove (whole ifds). See option -meta for
+                    the how sid are used. If sids are absent, the whole app
+                    segment is removed.
+                    Alternatively, a single sid from 0 to 4 can be followed by
+                    a list of tags, given by name (ignoring case) or by
+                    hexadecimal id (0x...), in order to remove only those tags
+                    from that ifd in the copy written with -o: the values of
+                    the removed tags are cleared and other data is not moved.
+                    Tags may also be separated by commas. For example,
+                    -rmeta=1:3:GPSLatitude,GPSLongitude removes the position
+                    from the gps ifd (3), keeping the other gps tags.
                     For example, -r=1,13 will remove whole segments APP1 and
                     APP13, whereas -r=0,1:5:6 will remove the whole APP0 segment
                     and keep most of the APP1 (tiff/exif) ifds, removing only
                     the maker note (5) and the embedded preview picture (6).
+        -rm-c2pa    remove the C2PA manifest store from the copy written with -o.
+                    Without this option, a warning is printed if the manifest
+                    store is not kept in the copy. Removing or keeping the
+                    manifest store of a modified file invalidates its hard
+                    binding in both cases.
+        -image-data-immutable
+                    guarantee that the compressed picture is not modified:
+                    options that may alter entropy-coded data, coefficients or
+                    the tables needed to decode them (-tidyup,
+                    -apply-suggestions, -redact, -to-gray, -iquant and -ihuff)
+                    are refused, and the copy written with -o is verified to
+                    have exactly the same quantization and Huffman tables,
+                    frame and scan headers and entropy-coded data as the
+                    original.
+                    If it does not, the copy is removed and the file fails.
+                    This is intended for metadata-only workflows, such as
+                    -rmeta.
+        -thumbs=<mode>
+                    strip or regenerate all embedded renditions in the copy
+                    written with -o, after the other modifications. mode is
+                    strip, to remove JFIF, JFXX and Exif thumbnails, or regen,
+                    to replace them with renditions of the main picture of the
+                    same size and format. In both modes MPF and FlashPix
+                    images are removed. Previews in maker notes are not
+                    modified, remove the maker note instead (-rmeta=1:5).
+                    Image data is not modified.
+        -redact=<x>,<y>,<w>,<h>[:<fill>]
+                    redact the region of w x h pixels at x,y in the copy
+                    written with -o, in stored picture coordinates (before any
+                    Exif orientation). fill is black (default), white, gray, an
+                    RGB color given as rrggbb, or pixelate. The region is
+                    extended to whole MCUs, or to cells of at least 16x16
+                    pixels when pixelating, and only the blocks in the region
+                    are modified in the DCT domain: they keep only a DC
+                    coefficient, the fill level or the average of their cell.
+                    Scans are entropy coded again with the Huffman tables of
+                    the file, so that other blocks are coded exactly as
+                    before, which is verified. Embedded thumbnails are then
+                    regenerated from the redacted picture, unless -thumbs=strip
+                    is given. This is only available for Huffman sequential
+                    frames, and fails if the tables lack a code needed, and
+                    it is refused with -image-data-immutable and
+                    -selftest-roundtrip.
+        -to-gray    convert the copy written with -o to a single component
+                    (grayscale) frame if its chroma is effectively constant, as
+                    checked by -gray-check, otherwise leave it in color. The Y
+                    coefficients are entropy coded again with the Huffman
+                    tables of the file, without loss, which is verified, and
+                    scans of chroma only are dropped. This is only available
+                    for Huffman sequential frames, and it is refused with
+                    -image-data-immutable and -selftest-roundtrip.
+        -iquant=<destination>:<path>
+                    replace the quantization table <destination> (0 to 3) of
+                    the copy written with -o by the table read from the text
+                    file at <path>, in the format saved by -squant: the table
+                    with the same destination, or the only table in the file
+                    (64 steps in natural order, '#' starting a comment).
+        -iquant-mode=<mode>
+                    how the table given with -iquant is applied:
+                    requantize  (default) requantize the coefficients of all
+                                components using the table with the new
+                                steps, rounding to the nearest value, and
+                                entropy code the scans again with the Huffman
+                                tables of the file. This is LOSSY, which is
+                                reported as a warning with the number of
+                                coefficients modified and the rms error
+                                introduced. It is only available for Huffman
+                                sequential frames, and fails if the tables
+                                lack a code needed.
+                    header      replace only the table, without modifying the
+                                coefficients. This is refused unless the steps
+                                are unchanged at all positions where some
+                                coefficient is not zero, since the picture
+                                would change otherwise.
+                    Both are refused with -image-data-immutable and
+                    -selftest-roundtrip.
+        -ihuff=<path>
+                    replace the Huffman tables of the copy written with -o by
+                    the tables read from the json file at <path>, in the
+                    format saved by -shuff, and entropy code the scans again
+                    with the new tables, in order to test custom canonical
+                    tables. Each table given replaces all definitions of the
+                    same class (dc or ac) and destination in the first image;
+                    a class and destination can be given only once. Tables
+                    must be valid canonical tables (counts of codes of 1 to 16
+                    bits, no code made of 1 bits only, distinct symbols). The
+                    coefficients are verified to be unchanged after coding,
+                    and the size of the entropy-coded data before and after
+                    is printed. This is only available for Huffman sequential
+                    frames, fails if the tables lack a code needed, and is
+                    refused with -image-data-immutable and -selftest-roundtrip.
+        -setmeta=<tag>=<value>[,<tag>=<value>...]
+                    modify or insert individual Exif tags in the copy written
+                    with -o. Tags are given by name, ignoring case:
+                    ImageDescription, Make, Model, Orientation (1 to 8),
+                    Software, DateTime, Artist and Copyright in IFD0, and
+                    DateTimeOriginal, DateTimeDigitized (YYYY:MM:DD HH:MM:SS),
+                    OffsetTime, OffsetTimeOriginal, OffsetTimeDigitized
+                    (+HH:MM), ImageUniqueID, CameraOwnerName,
+                    BodySerialNumber, LensMake, LensModel and LensSerialNumber
+                    in the Exif IFD. Values are printable ASCII; a part without
+                    '=' continues the previous value, so that values can
+                    include commas, as in -setmeta="Copyright=Doe, Inc.".
+                    A value that fits in the space of the old one is replaced
+                    in place, a longer value or an IFD that needs a new entry
+                    is written at the end of the Exif data, so that the
+                    offsets of the thumbnail and of maker notes remain valid.
+                    The Exif IFD, or the whole Exif segment, is created if
+                    needed. Image data is not modified.
+        -strip-gps  remove the location of the picture from the copy written
+                    with -o, after all other modifications (-audit included),
+                    in the primary picture and in the MPF pictures that
+                    follow it: the GPS IFD of every Exif or MPF segment is
+                    cleared with the values of its tags and no longer
+                    referenced from IFD0, the GPS properties of the exif
+                    namespace (exif:GPSLatitude...) are blanked out in the
+                    main and extended XMP packets (the GUID of an extended
+                    packet is updated), and the LocationInfo tag of Nikon
+                    maker notes is cleared. What was removed is printed and
+                    reported. Other data is not moved, and image data is not
+                    modified. Not removed: location properties of other XMP
+                    namespaces (photoshop:City, Iptc4xmpExt:LocationShown...)
+                    or IPTC records, and the metadata of embedded pictures such
+                    as the Exif thumbnail.
+        -copymeta=<path>[:<kind>[,<kind>...]]
+                    copy metadata segments from the jpeg file at <path> into
+                    the copy written with -o, replacing the segments of the
+                    same kind, for instance to re-attach the metadata that an
+                    external tool stripped. <kind> is exif (Exif APP1), xmp
+                    (main and extended XMP APP1) or icc (ICC profile APP2
+                    chunks); all three are copied if no kind is given. Copied
+                    segments are inserted after the JFIF segment, in the
+                    recommended order, right after writing, so that the other
+                    modifications (-rmeta tags, -setmeta, -strip-gps, -audit)
+                    apply to them. Kinds absent from <path> are reported, and
+                    image data is not modified.
+        -loadmeta=<path>
+                    write the metadata described in the json template at
+                    <path> into the copy written with -o, for bulk tagging of
+                    generated or scanned pictures. The template is an object
+                    with the members "exif", giving tags by name with string
+                    or number values (the tags accepted by -setmeta), "xmp",
+                    giving properties by qualified name (such as dc:title)
+                    with a string or number value, an array of strings for an
+                    unordered array (rdf:Bag, or rdf:Seq for dc:creator and
+                    dc:date) or an object giving the text of each language
+                    (rdf:Alt, as in {"x-default": "Sunset", "fr": "Coucher"}),
+                    and "namespaces", giving the URI of other namespace
+                    prefixes than the usual ones (dc, xmp, xmpRights,
+                    photoshop, Iptc4xmpCore, exif, tiff...), for instance:
+                        { "exif": { "Artist": "Doe", "Orientation": 1 },
+                          "xmp": { "dc:subject": [ "scan", "archive" ] } }
+                    Exif tags are set as with -setmeta, creating the Exif
+                    segment if needed. The XMP packet made from the template
+                    replaces the XMP segments of the copy and is inserted
+                    after the JFIF and Exif segments. This is done after
+                    -copymeta and before -setmeta, -strip-gps and -audit,
+                    which apply to the imported metadata. Image data is not
+                    modified.
+        -audit      record the modifications applied to the copy written with
+                    -o in the copy itself, as an event of the XMP history
+                    (xmpMM:History) giving the jcheck version, the time, the
+                    operations performed (tidyup, rmeta=<a>[:<s>], strip-gps,
+                    redact=<r>, to-gray,
+                    iquant=<d>:<path>:<mode>, ihuff=<path>, setmeta=<t>=<v>,
+                    copymeta=<path>[:<k>], loadmeta=<path>, thumbs=<m>) and
+                    the sha256
+                    checksum of the original file. If the file
+                    has an XMP packet, the event is added to its history,
+                    otherwise a new XMP APP1 segment is inserted after the
+                    JFIF and Exif segments. Image data is not modified.
+        -undo=<path>
+                    save at <path> a binary patch that restores the original
+                    file exactly from the copy written with -o (required),
+                    once all modifications are done (signature included), with
+                    jcheck undo <path> <copy>. The patch holds only the
+                    original bytes of the regions that differ, segments
+                    removed, inserted or moved being recognized as such, with
+                    the size and sha256 of both files, so that mass edits can
+                    be reverted without keeping a full backup of each file.
 
 `
 
@@ -176,6 +933,13 @@ const (
                     Each thumbnail image is stored in a new file at their given
                     path. By convention, tid=0 refers always the main thumbnail
                     and tid=1 refers to a possible additional preview image.
+                    tid can also be any id given by -lthumb, such as mpf2,
+                    maker or jfxx: jpeg pictures are saved as is and uncompressed ones
+                    are saved as binary PPM files, unless the path ends with
+                    .png or .webp or -thumb-format is given, in which case
+                    they are transcoded (only for ids given by -lthumb).
+                    Paths may include ':' and ','; a ',' starts a new
+                    <tid>:<path> only if it is followed by an id and ':'.
         -spict=[<orientation>[,<format>]:]<path>
                     save the main picture possibly after transformation required
                     by <orientation> in the requested <format>.
@@ -199,16 +963,448 @@ const (
                     <format> indicates whether the picture should be stored as
                     color (RGB) or as black and white (Y). It is optional and
                     if missing it is assumed to mean using all available color
-                    components. <format> can be given as either BW or RGB.  
+                    components. <format> can be given as either BW or RGB, or
+                    CMYK for a CMYK or YCCK picture, which is then saved as C,
+                    M, Y and K ink amounts (4 bytes per pixel, 0 for no ink),
+                    without conversion; -resize and -stamp are not available
+                    with CMYK.
                     Therefore, if BW is not specified and all Y, Cb, Cr are
                     available, the picture is stored as packed RGB (3 bytes per
                     pixel), otherwise it is stored as 1 byte (Y) per pixel.
+                    Pictures in RGB, CMYK or YCCK, as given by the Adobe app14
+                    color transform or the component ids (see the color space
+                    printed when checking), are converted to RGB before being
+                    saved in the requested <format>.
+                    Progressive frames are reconstructed from the coefficients
+                    accumulated over all their scans.
+                    Pictures with 12-bit samples, common in medical and
+                    scientific imaging, are also reconstructed from their
+                    coefficients and saved with 2 bytes per sample, big-endian
+                    from 0 to 4095 (6 bytes per pixel, R, G and B, or Y
+                    repeated in BW); -resize, -stamp, -gray and the CMYK format
+                    are not available with them.
                     Note that if <format> is given, a leading comma ',' is
-                    required even if <orientation> is missing.
+                    required even if <orientation> is missing. A path that
+                    includes ':' (e.g. with a Windows drive letter) must then
+                    be preceded by ':' if no <orientation> or <format> is
+                    given.
+        -gray=<method>
+                    derive the BW picture saved with -spict with <method>
+                    instead of taking the Y component as decoded. <method> can
+                    be:
+                    y               the Y component (default), which mixes
+                                    gamma-encoded R, G and B with Rec.601
+                                    coefficients
+                    rec601, rec709  Rec.601 (0.299, 0.587, 0.114) or Rec.709
+                                    (0.2126, 0.7152, 0.0722) coefficients
+                                    applied to gamma-encoded R, G and B
+                    rec601-linear, rec709-linear
+                                    the same coefficients applied in linear
+                                    light: samples are decoded with the sRGB
+                                    transfer function, mixed and encoded again
+                    The method used is recorded in the report. The saved
+                    picture has the same layout whatever the method, with
+                    the gray level repeated as R, G and B.
+        -stamp=<png>:<corner>[:<opacity>]
+                    composite the watermark <png> onto the picture saved with
+                    -spict, using its alpha channel multiplied by <opacity>
+                    (0 to 1, default 1). <corner> is tl, tr, bl, br or center,
+                    with a margin of 1/50th of the smallest side of the
+                    picture, in the saved orientation. The watermark is
+                    clipped if larger than the picture, and converted to
+                    luminance for a BW picture. With -resize, the watermark
+                    is applied after resizing.
+        -resize=<size>
+                    resize the picture saved with -spict. <size> is given as
+                    WxH for an exact size, Wx or xH for a width or a height
+                    keeping the aspect ratio, p%% for a scale factor, or
+                    maxdim=n for the largest side, in which case the picture
+                    is never enlarged. The saved picture is resampled one row
+                    at a time, keeping only the source rows needed by the
+                    filter, so that memory use depends on the width of the
+                    result only.
+        -resize-filter=<filter>
+                    resampling filter used by -resize: lanczos (Lanczos 3, the
+                    default), catmullrom (Catmull-Rom cubic), or box (area
+                    average, without sharpening).
+        -derive=<presets>
+                    save for each file the set of derivatives defined in the
+                    json presets file at <presets>, decoding the picture only
+                    once for all of them. The file holds a list of
+                    derivatives, each with:
+                        "path"      output path, usually a template (required)
+                        "format"    jpeg, png, webp or metadata (by default
+                                    from the path extension, .json giving
+                                    metadata)
+                        "size"      as -resize (default original size)
+                        "filter"    as -resize-filter (default lanczos)
+                        "quality"   jpeg quality, 1 to 100 (default 90)
+                        "orient"    false to keep the stored orientation
+                        "name"      name used in messages
+                    for example:
+                    { "derivatives": [
+                      { "name": "web", "path": "{dir}/web/{basename}.jpg",
+                        "size": "maxdim=2048" },
+                      { "name": "thumb", "size": "maxdim=400",
+                        "path": "{dir}/thumbs/{basename}.jpg" },
+                      { "path": "{dir}/meta/{basename}.json" } ] }
+                    Pictures are turned upright according to the Exif
+                    orientation and carry no metadata, which makes them sRGB
+                    for decoders. Colors are not converted: a warning is given
+                    if the file has an ICC profile that is not sRGB. Metadata
+                    derivatives are saved as with -meta-json.
+        -qerr=<path>
+                    estimate the error introduced by quantization in each block
+                    of the luminance component, from the quantization steps
+                    and from which coefficients were quantized to zero, and
+                    save it as a png heat-map at <path>, from blue (no error)
+                    to red (rms error of 8 or more sample levels). The mean and
+                    maximum estimated errors and the proportion of blocks with
+                    an rms error above 4 are printed. A file where most blocks
+                    are degraded is likely a lossy derivative rather than a
+                    master. This is only available for Huffman coded
+                    sequential or progressive frames.
+        -meta-json=<path>
+                    save all metadata found in the file as a json document at
+                    <path>, for ingestion into other tools. JFIF and JFXX APP0
+                    fields, all Exif IFDs (including GPS, interoperability and
+                    sub-IFDs), MPF APP2 IFDs, XMP properties (main and
+                    extended packets), Photoshop APP13 resource blocks and
+                    their IPTC-IIM datasets, Adobe APP14 fields and comments
+                    are included. Each
+                    tag is given with its id, name, TIFF type, count and value:
+                    ascii values as strings, byte and undefined values as
+                    base64 strings, rationals as numerator, denominator and
+                    decimal value, other values as numbers, or arrays of them
+                    if count is more than 1. XMP properties are given by path
+                    (such as dc:subject[1]), IPTC datasets by record and
+                    dataset number (such as 2:025).
+        -dumpmeta=<path>
+                    save all metadata found in the file as a sidecar at <path>
+                    for indexing in a database: with the extension .json, the
+                    document written by -meta-json; with the extension .csv,
+                    one line per tag with the columns path, container,
+                    segment, offset, group, id, tag, type, count, value and
+                    error. Strings are given as is, byte arrays in base64 with
+                    the prefix "base64:", rationals as n/d and multiple values
+                    separated by spaces.
+        -sc2pa=<path>
+                    save the C2PA manifest store, reassembled from its APP11
+                    segments, as a standalone JUMBF file at <path> (usually
+                    with the extension .c2pa), which can be given to C2PA
+                    tools for full validation.
+        -sicc=<path>
+                    save the ICC profile, reassembled from its APP2 chunks in
+                    sequence order, as a standalone profile at <path>
+                    (usually with the extension .icc). This fails if there is
+                    no profile or if some chunks are missing.
+        -sjumbf=<box>:<path>[,<box>:<path>]
+                    save the JUMBF box identified by its path in the tree
+                    printed by -jumbf (for example 1.3.2) into a new file. A
+                    superbox is saved with its header as a standalone JUMBF
+                    file, and only the payload of a content box is saved (for
+                    example a JSON document or an embedded file).
+        -sscan=<n>:<path>[,<n>:<path>]
+                    save the raw entropy-coded data of the scan n (from 0, in
+                    file order, as for -sc in the first frame) into a new file,
+                    from the end of its SOS header to the next marker other
+                    than RSTn, with the byte stuffing and restart markers as
+                    stored.
+        -sdepth=<path>
+                    save the first depth map listed by -lthumb into a new file,
+                    as stored (usually JPEG or PNG). This is the same as
+                    -sthumb=depth1:<path>, but fails if there is no depth map.
+        -squant=<path>
+                    save the quantization tables in force for the first scan
+                    as text at <path>, each as a line "table <destination>
+                    <bits>" followed by its 64 steps as an 8x8 matrix in
+                    natural order (one row of the block per line). The file
+                    can be edited and given to -iquant.
+        -shuff=<path>
+                    save all Huffman table definitions of the first image as
+                    json at <path>, in file order: for each table its class
+                    (dc or ac), destination, the index of the scan that follows
+                    its definition (from 0), the number of codes of each
+                    length from 1 to 16 bits (counts) and the symbols in code
+                    order. The file can be edited and given to -ihuff.
+        -schroma=<prefix>
+                    save the Cb and Cr components at their stored (subsampled)
+                    resolution, without upsampling, as 16-bit grayscale png
+                    files <prefix>-cb.png and <prefix>-cr.png, with a json
+                    sidecar <prefix>.json. Samples are the inverse DCT of the
+                    dequantized coefficients, stored as sample x scale (256
+                    for 8-bit precision) to keep their fractional part. The
+                    sidecar gives the picture size and precision, the scale
+                    and, for each plane, its file, size, sampling factors,
+                    subsampling ratios and the position of its first sample
+                    in picture pixels, assuming the centered chroma siting of
+                    JFIF. This is only available for Huffman coded frames with
+                    3 components.
+        -thumb-format=<format>
+                    transcode all embedded images saved with -sthumb or -sdepth
+                    to <format>, whatever their path and embedded format, for
+                    example to give a uniform format to a gallery. <format> can
+                    be png or webp. Without this option, images are transcoded
+                    only if their path ends with .png or .webp. Transcoding is
+                    lossless from the decoded samples: WebP files are written
+                    uncompressed (lossless VP8L without compression), which is
+                    fine for thumbnails but larger than the original JPEG data.
         -o  name    output the modified JPEG data to a new file
                     this option is meaningful if -rmeta and/or -tydyip were
                     specified (if nothing was modified, the files will be
-                    similar if not identical).
+                    similar if not identical). If -tidyup or -rmeta were
+                    specified, a comparison of the original and output files
+                    is printed: segments added, removed, resized or modified,
+                    bytes saved, metadata differences and whether image data
+                    (entropy-coded data) is untouched.
+        -selftest-roundtrip
+                    after writing the output file requested by -o, read it
+                    back and verify that it can be parsed, that every segment
+                    not concerned by the requested modifications is byte
+                    identical to the original (entropy-coded data included),
+                    that the decoded samples of all frames are identical to
+                    the original ones, and that all IFD and value offsets in
+                    Exif metadata are valid. Any difference makes the file
+                    fail.
+        -sanitize   replace the characters that are reserved on Windows
+                    (<>:"/\|?* and control characters) by '_' in the file name
+                    of all output paths (-o, -sthumb, -spict, -qerr,
+                    -meta-json, -dumpmeta, -sc2pa, -sicc, -sjumbf, -sscan,
+                    -sdepth,
+                    -schroma, -squant, -shuff, -suggest, -undo, -splice-check and
+                    -derive presets),
+                    remove trailing dots and spaces and avoid reserved device
+                    names (CON, NUL, COM1...). Directories in
+                    the paths are not modified. Non-ASCII characters are kept.
+                    On Windows, paths longer than 248 characters are always
+                    given the \\?\ prefix.
+        -reproducible
+                    make all written outputs depend only on the input files and
+                    options, so that they are byte identical from one run to
+                    the next: no time is recorded in audit events (-audit) and
+                    json or xml reports unless the SOURCE_DATE_EPOCH environment
+                    variable gives one (in seconds since 1970-01-01 UTC), and
+                    the modification times of input files are not recorded in
+                    reports. Segments are always written in the order of the
+                    original file, and XMP padding is taken from the original
+                    packet.
+
+    Output paths given to -o, -sthumb, -spict, -qerr, -meta-json, -dumpmeta,
+    -sc2pa,
+    -sicc, -sjumbf, -sscan, -sdepth, -schroma, -squant, -shuff, -suggest, -undo and
+    -splice-check, and in
+    -derive
+    presets can be
+    templates, with placeholders replaced for each file processed, which allows using those options in batch mode:
+        {dir}       directory of the input file
+        {name}      file name of the input file
+        {basename}  file name of the input file without extension
+        {ext}       extension of the input file, without '.'
+        {index}     position of the input file in the batch, from 1
+        {index:<w>} same, padded with 0 to w digits
+        {meta:<f>}  Exif metadata field <f>, which can be Make, Model,
+                    Software, DateTime, Artist, Copyright, DateTimeOriginal
+                    or DateTimeDigitized ("unknown" if absent). Metadata values
+                    are always sanitized as with -sanitize.
+    Directories in expanded paths are created if needed. For example:
+        -sthumb=0:{dir}/thumbs/{basename}_thumb.jpg
+
+`
+
+    BATCH_OPTIONS =
+`
+    Batch options:
+
+        -sample=<n>|<p>%%
+                    check only a random sample of the files given as arguments,
+                    either a fixed number n of files or a percentage p of the
+                    total number of files. This is intended for quick audits of
+                    large archives. At the end of the batch, the failure rate
+                    observed in the sample is extrapolated to the whole set of
+                    files, with a 95%% confidence interval.
+        -seed=<s>   seed used to select the random sample. The same seed with
+                    the same list of files always selects the same sample, so
+                    that an audit can be reproduced. Default is 1.
+        -journal=<path>
+                    record in the journal file at path the outcome (valid or
+                    failed, including a checksum mismatch) and the report of
+                    each file as soon as it has been checked. The journal is
+                    a text file with one line per file, made of the outcome,
+                    a tab, the report in json, a tab and the file path.
+                    Without the option -resume an existing journal is
+                    replaced.
+        -resume     resume a batch that was interrupted, using the journal
+                    given with -journal: files already recorded in the journal
+                    are not checked again, but their outcome is included in
+                    the final summary and their recorded report in the
+                    machine readable reports. The same list of files and the
+                    same sampling options should be used when resuming.
+        -max-write-mbps=<r>
+                    limit the rate at which all outputs (-o and the files
+                    saved with other options) are written to <r> megabytes
+                    (10^6 bytes) per second, r being a decimal number, so that
+                    batch modifications on a network filesystem do not
+                    saturate the share. Writes wait once the rate is exceeded,
+                    which also stops reading the following files in advance.
+                    Copies written with -o are accounted for once written,
+                    delaying the following writes. Default is 0, unlimited.
+        -max-open-files=<n>
+                    limit to <n> the number of files open at the same time for
+                    reading input files (including the files read in advance)
+                    and writing outputs. Report files (-report, -xml-report,
+                    -sink) and the journal are not counted. Default is 0,
+                    unlimited.
+        -cache=<path>
+                    keep the outcome of each file checked in the cache file at
+                    path, identified by the file path, size and modification
+                    time. In following runs, files that did not change since
+                    they were cached are not checked again and their previous
+                    outcome is used in the final summary. This is intended for
+                    repeated validation of mostly static archives: since cached
+                    files are not analysed, nothing is printed for them. The
+                    outcome is only reused with the same options (except the
+                    options selecting the files or the reports), and when
+                    files are written for each file checked (e.g. -o, -spict,
+                    -sign or -on-error) all files are checked, as with
+                    -force.
+        -force      check all files even if they are unchanged in the cache,
+                    and update the cache with the new outcome.
+        -on-error=move:<dir>|copy:<dir>|delete|rename-suffix:<sfx>
+                    apply an action to each file that fails validation:
+                    move:<dir> moves the file into the existing directory dir,
+                    copy:<dir> copies the file into the existing directory dir,
+                    delete removes the file and rename-suffix:<sfx> renames the
+                    file by appending the suffix sfx to its name. Existing files
+                    are never replaced by move, copy or rename-suffix. Files
+                    taken from a journal or a cache are not affected. A file
+                    whose analysis succeeded is not affected either if only
+                    the outputs requested for it (-o, -spict...) could not be
+                    written.
+        -fail-on=<severity>
+                    with -on-error, apply the action to files that have a
+                    diagnostic at least as severe as severity (info, warning,
+                    error or fatal), in addition to the files that fail
+                    validation. Default is error. With fatal, the action only
+                    applies to files that could not be analysed. With info or
+                    warning, library warnings are collected as with -w.
+        -checksum=<algorithm>:<path>
+                    calculate the checksum of each file in the batch and write
+                    them in a manifest at path, in the format used by sha256sum
+                    and by BagIt manifests. The algorithm can be md5, sha1,
+                    sha256 or sha512.
+        -verify-checksum=<path>
+                    verify the checksum of each file in the batch against the
+                    manifest at path, in the same format. The algorithm is
+                    deduced from the checksum length. A file whose checksum
+                    does not match fails. A summary of the verification is
+                    printed at the end of the batch, including the files that
+                    are listed in the manifest but were not checked. Checksums
+                    are verified even for files found in a journal or a cache.
+        -sign=<keyfile>
+                    sign each file that is valid, so that later tampering can
+                    be detected with -verify-sig. The signature covers the
+                    image data (tables, frame and scan headers, entropy-coded
+                    data), the Exif APP1 segments and the ICC profile APP2
+                    segments, but not other metadata. It is stored in a new
+                    APP15 segment of the copy written with -o, or otherwise in
+                    a sidecar file named after the file with the suffix .jsig.
+                    keyfile is either a PEM encoded Ed25519 private key (PKCS#8,
+                    as generated by openssl genpkey -algorithm ed25519), or any
+                    other content of at least 16 bytes used as a HMAC-SHA256
+                    secret.
+        -verify-sig=<keyfile>
+                    verify the signature of each file, found in its APP15
+                    segment or in its sidecar file. keyfile is the HMAC secret
+                    or the Ed25519 public or private key. A file without a
+                    signature, or whose signature does not match, fails.
+        -xml-report=<path>
+                    write an xml audit report of all files in the batch into
+                    the file at path. The report is closely modeled on the
+                    JHOVE output: a root jhove element contains one repInfo
+                    element per file, giving its size, status (well-formed and
+                    valid or not), the error messages and the main properties
+                    of each frame.
+        -report=<path>
+                    write a json report of all files in the batch into the file
+                    at path, with the same information as the xml report. When
+                    a modified copy is written with -o, the report also gives
+                    its path, its size and the list of changes from the
+                    original, so that a single run produces both the modified
+                    file and its audit. -report can be combined with
+                    -xml-report.
+        -sink=<format>:<path>[,<format>:<path>...]
+                    write reports of all files in the batch in the given
+                    formats, each into the file at its path. The formats are:
+                      json  json document, as with -report
+                      xml   JHOVE style xml document, as with -xml-report
+                      csv   one line per file (status, first frame, number
+                            of messages per severity, first most severe
+                            message, output), after a line of column names
+                      html  self-contained html page with a table of files
+                      text  plain text, the outcome and messages of each file
+                    All formats receive the same report of each file and can
+                    be combined with each other and with -report and
+                    -xml-report.
+        -json
+                    print a single json document to stdout instead of text,
+                    for scripts. It gives for each file the information of the
+                    json report (-report) and in addition the markers with
+                    their offsets and lengths, the frame header, the
+                    quantization tables in natural order, the Huffman tables
+                    (as saved by -shuff) and all metadata (as saved by
+                    -meta-json). The orientation and the chroma subsampling
+                    are given as stable enum strings, such as "rotate90cw"
+                    or "4:2:0", next to their descriptions. The text printed by
+                    the other options for a
+                    file is given line by line in its text member, and the
+                    batch summary is not printed.
+        -R=<dir>
+                    walk the directory tree rooted at <dir> and add to the
+                    batch all regular files that start with the jpeg SOI
+                    marker, whatever their extension, after the filepaths
+                    given. In addition to the batch summary, a summary per
+                    directory gives the number of valid and invalid files and
+                    the number of files fixed, for which a modified copy was
+                    written with -o (which then must be a template).
+        -symlinks=skip|follow
+                    with -R, skip (the default) or follow symbolic links to
+                    files and directories. Links are followed after walking
+                    the tree, so that files are found under their real path
+                    first. A directory is walked only once: a link to a
+                    directory already walked, or that would make a loop, is
+                    not walked again. Broken links are reported. The number of
+                    links of each kind is given in the batch summary.
+        -hardlinks=once|all
+                    with -R, check a file found under several paths (hard
+                    links, or symbolic links when they are followed) only once,
+                    under the first path found (the default), or under all
+                    its paths. The files found under several paths are listed
+                    with all their paths in the batch summary.
+        -min-size=<s>, -max-size=<s>
+                    with -R, check only the files whose size is at least or at
+                    most <s> bytes, given as a number optionally followed by
+                    k, M or G (powers of 1024), for instance -max-size=2k to
+                    look for suspiciously small files.
+        -newer-than=<t>, -older-than=<t>
+                    with -R, check only the files modified after or before
+                    <t>, given as a local date (2024-01-31), a local date and
+                    time (2024-01-31T18:00:00), an RFC 3339 time, a duration
+                    before now in days (7d) or in hours, minutes and seconds
+                    (36h, 90m), or the path of an existing file whose
+                    modification time is used, for instance the report of the
+                    last audit to check only the files added or modified
+                    since. The number of jpeg files excluded by these filters
+                    is given in the batch summary.
+        -q          quiet mode, for using jcheck as a validity gate in build
+                    pipelines: nothing is printed while checking files, not
+                    even errors or the batch summary, and the outcome is only
+                    given by the exit status (0 if all files are valid, 1
+                    otherwise). Reports and other output files are still
+                    written. Option errors are still printed. It cannot be
+                    combined with -json.
+        -q-summary
+                    with -q, print a single line per file, PASS <path> if it
+                    is valid or FAIL <path>: <first error> otherwise.
 
 `
 )
@@ -232,19 +1428,125 @@ type enTable struct {
 type metaIds struct {
     appId           int
     sIds            []int
+    tags            []uint16        // tags to remove from the single sid
+}
+
+type embeddedSpec struct {
+    id              string
+    path            string
+}
+
+type scanSpec struct {
+    n               int
+    path            string
 }
 
 type storeParameters struct {
     row0        jpeg.VisualSide
     col0        jpeg.VisualSide
     bw          bool
+    cmyk        bool
     path        string
 }
 
+type sampleSpec struct {
+    count           int         // fixed number of files, if not 0
+    percent         float64     // percentage of files, if count is 0
+    seed            int64
+}
+
 type jpgArgs struct {
-    input, output   string
+    inputs          []string
+    output          string
+    debug           bool
+    sample          *sampleSpec // nil if all files must be checked
+    journal         string      // path to batch journal, if not empty
+    resume          bool        // resume batch from existing journal
+    cache           string      // path to file cache, if not empty
+    cacheOptions    string      // hash of the options, for the cache
+    force           bool        // ignore cached outcome
+    writesFiles     bool        // files are written for each file checked
+    onError         *onErrorAction  // action on failed files, if not nil
+    checksum        *checksumSpec   // manifest to generate, if not nil
+    verifyChecksum  string          // manifest to verify, if not empty
+    xmlReport       string          // xml report path, if not empty
+    jsonReport      string          // json report path, if not empty
+    sinks           []sinkSpec      // all machine readable reports
+    json            bool            // json analysis to stdout instead of text
+    quiet           bool            // no output, only the exit status
+    diagnostics     bool            // collect and list diagnostics
+    minSeverity     severity        // of diagnostics listed and reported
+    quietSummary    bool            // PASS or FAIL per file, with quiet
+    recurse         string          // directory tree to scan, if not empty
+    followLinks     bool            // follow symbolic links with -R
+    allHardlinks    bool            // check all paths to the same file
+    filter          *fileFilter     // files selected with -R, if not nil
     control         jpeg.Control
     tables          bool
+    markerStats     bool
+    entropyStats    bool
+    stuffing        bool
+    coefStats       bool
+    fixByteOrder    bool            // repair Exif byte order
+    suggest         string          // repair suggestions saved by path
+    applySuggestions string         // path or ask
+    suggestions     *suggestionReport // loaded from applySuggestions
+    undo            string          // undo patch path, if not empty
+    fingerprint     bool
+    recoverability  bool
+    verifyScan      bool
+    preservation    bool
+    thumbPrivacy    bool
+    grayCheck       bool
+    blank           *blankThresholds    // with -blank-check, if not nil
+    exposure        *exposureThresholds // with -exposure-check, if not nil
+    blurCheck       bool
+    blurThreshold   float64         // with -blur-check
+    rotationCheck   bool
+    thumbs          string          // strip or regen, if not ""
+    redact          *redactSpec     // region to redact, if not nil
+    toGray          bool            // convert copy if chroma is constant
+    restartInterval int             // MCU window as a restart interval, if >= 0
+    stamp           *stampSpec      // watermark for -spict, if not nil
+    resize          *resizeSpec     // size for -spict, if not nil
+    gray            *grayMethod     // BW conversion for -spict
+    derivatives     []derivativeSpec    // derivatives saved for each file
+    metaFlat        bool
+    exiftool        bool
+    qerr            string
+    spliceCheck     string
+    metaJson        string
+    dumpMeta        string          // metadata sidecar, .json or .csv
+    c2pa            bool
+    sC2pa           string
+    sIcc            string          // ICC profile saved by path
+    rmC2pa          bool
+    jumbf           bool
+    sJumbf          []embeddedSpec  // JUMBF boxes saved by path
+    sScan           []scanSpec      // entropy-coded scan data saved by path
+    sDepth          string
+    sChroma         string          // prefix of chroma plane files
+    sQuant          string
+    iQuant          *quantImport    // table to replace, if not nil
+    sHuff           string
+    iHuff           *huffImport     // tables to replace, if not nil
+    setMeta         *metaEdit       // Exif tags to set, if not nil
+    stripGps        bool            // remove location data from output
+    copyMeta        *copyMetaSpec   // metadata to copy into output, if not nil
+    loadMeta        *metaTemplate   // metadata to write into output, if not nil
+    thumbFormat     string          // png or webp, if not ""
+    selftest        bool
+    immutable       bool            // image data must not be modified
+    audit           bool            // record modifications in output
+    reproducible    bool            // no time recorded in outputs
+    signKey         *signingKey     // if not nil, sign valid files
+    verifyKey       *signingKey     // if not nil, verify signatures
+    classifier      *classifier     // if not nil, classify pictures
+    sanitize        bool
+    templates       bool            // some output paths are templates
+    security        bool
+    recurseDepth    int         // recursion guards
+    recurseSize     int
     meta            []metaIds
     quTables        []quTable
     enTables        []enTable
@@ -252,16 +1554,18 @@ type jpgArgs struct {
     rmActions       []metaIds
     svActions       []jpeg.ThumbSpec
     sPicture        storeParameters
+    svEmbedded      []embeddedSpec  // embedded images saved by id
+    listThumbs      bool
 }
 
-var format = [...]string { "BW", "RGB" }
-func getFormat( f string ) (bool, error) {
+var format = [...]string { "BW", "RGB", "CMYK" }
+func getFormat( f string ) (bw, cmyk bool, err error) {
     for i, fs := range format {
         if f == fs {
-            return i == 0, nil
+            return i == 0, i == 2, nil
         }
     }
-    return false, fmt.Errorf("format %s is not recognized\n", f )
+    return false, false, fmt.Errorf("format %s is not recognized\n", f )
 }
 
 var orientation = [...]string { "TL", "TR", "BR", "BL", "LT", "RT", "RB", "LB" }
@@ -287,10 +1591,12 @@ func getOrientation( o string ) (r, c jpeg.VisualSide, err error) {
 
 // undefined orientation is indicated by row0 and col0 both zero
 func parseSpict( spict string ) ( res storeParameters, err error ) {
-    parts := strings.Split( spict, ":" )
-    if len(parts) > 2 {
-        return res, fmt.Errorf("Save picture: syntax error: too many ':' in %s\n",
-                                spict )
+    // parameters end at the first ':', unless it is part of the path (Windows
+    // drive letter or \\?\ prefix, paths including ':', templates)
+    parts := strings.SplitN( spict, ":", 2 )
+    if len(parts) == 2 && ( len(parts[0]) == 1 ||
+                            strings.ContainsAny( parts[0], `/\.{` ) ) {
+        parts = parts[:1]
     }
     if len(parts) == 2 {
         spict = parts[1]
@@ -301,7 +1607,7 @@ func parseSpict( spict string ) ( res storeParameters, err error ) {
                                     part )
         }
         if len(params) == 2 {
-            res.bw, err = getFormat( params[1] )
+            res.bw, res.cmyk, err = getFormat( params[1] )
             if err != nil {
                 return res, fmt.Errorf("Save picture: syntax error: %v\n", err)
             }
@@ -317,21 +1623,58 @@ func parseSpict( spict string ) ( res storeParameters, err error ) {
     return
 }
 
-func parseSthumb( sthumb string ) (res []jpeg.ThumbSpec, err error) {
+func parseSthumb( sthumb string ) (res []jpeg.ThumbSpec,
+                                    named []embeddedSpec, err error) {
     // -sthumb=<tid>:<path>[,<tid>:<path>]
-    parts := strings.Split( sthumb, "," )
+    parts := splitSpecs( sthumb )
     for _, part := range parts {
-        specs := strings.Split( part, ":" )
+        specs := strings.SplitN( part, ":", 2 )
         if len(specs) != 2 {
-            return nil, fmt.Errorf("Save Thumbnails: missing path or id: %s\n",
-                                   part )
+            return nil, nil, fmt.Errorf("Save Thumbnails: missing path or id: %s\n",
+                                        part )
+        }
+        if isEmbeddedId( specs[0] ) {
+            named = append( named, embeddedSpec{ id: specs[0], path: specs[1] } )
+            continue
         }
-
         v, err := strconv.ParseInt(specs[0], 0, 64);
         if err != nil || v < 0 || v > 1 {
-            return nil, fmt.Errorf( "invalid Id: %s\n", specs[0] )
+            return nil, nil, fmt.Errorf( "invalid Id: %s\n", specs[0] )
+        }
+        res = append( res, jpeg.ThumbSpec{ Path: specs[1], ThId: int(v) } )
+    }
+    return
+}
+
+func parseSjumbf( sjumbf string ) (res []embeddedSpec, err error) {
+    // -sjumbf=<box>:<path>[,<box>:<path>]
+    for _, part := range splitSpecs( sjumbf ) {
+        specs := strings.SplitN( part, ":", 2 )
+        if len(specs) != 2 || specs[1] == "" {
+            return nil, fmt.Errorf( "Save JUMBF boxes: missing path or box: " +
+                                    "%s\n", part )
+        }
+        if ! isJumbfBoxId( specs[0] ) {
+            return nil, fmt.Errorf( "invalid JUMBF box: %s\n", specs[0] )
+        }
+        res = append( res, embeddedSpec{ id: specs[0], path: specs[1] } )
+    }
+    return
+}
+
+func parseSscan( sscan string ) (res []scanSpec, err error) {
+    // -sscan=<n>:<path>[,<n>:<path>]
+    for _, part := range splitSpecs( sscan ) {
+        specs := strings.SplitN( part, ":", 2 )
+        if len(specs) != 2 || specs[1] == "" {
+            return nil, fmt.Errorf( "Save scans: missing path or scan: %s\n",
+                                    part )
+        }
+        n, err := strconv.Atoi( specs[0] )
+        if err != nil || n < 0 {
+            return nil, fmt.Errorf( "invalid scan number: %s\n", specs[0] )
         }
-        res = append( res, jpeg.ThumbSpec{ specs[1], int(v) } )
+        res = append( res, scanSpec{ n: n, path: specs[1] } )
     }
     return
 }
@@ -348,6 +1691,21 @@ func parseMeta( rem string, remove bool ) (res []metaIds, err error ) {
     parts := strings.Split( rem, "," )
     for _, part := range parts {
         specs := strings.Split( part, ":" )
+        if remove && isTagSpec( part ) {    // more tags for the previous id
+            if len(res) == 0 || len(res[len(res)-1].tags) == 0 {
+                return nil, fmt.Errorf( "tag %s without app id and sid\n",
+                                        part )
+            }
+            last := &res[len(res)-1]
+            for _, t := range specs {
+                tag, err := parseTag( last.sIds[0], t )
+                if err != nil {
+                    return nil, err
+                }
+                last.tags = append( last.tags, tag )
+            }
+            continue
+        }
         v, e := strconv.ParseInt(specs[0], 0, 64);
         if e != nil || (( v < lowBound || v > 15 ) && v != -1) {
             err = fmt.Errorf( "invalid Id: %s\n", specs[0] )
@@ -355,19 +1713,40 @@ func parseMeta( rem string, remove bool ) (res []metaIds, err error ) {
         }
         id := int(v)
         if len(specs) == 1 || id == -1 {
-            res = append( res, metaIds{ id, []int{} } )
-            return
+            res = append( res, metaIds{ id, []int{}, nil } )
+            continue
         }
         var sids []int
+        var tags []uint16
         for _, sid := range specs[1:] {  // id positive integer
+            if remove && isTagSpec( sid ) {
+                if id != 1 || len(sids) != 1 {
+                    return nil, fmt.Errorf( "tag %s must follow app id 1 " +
+                                            "and a single sid\n", sid )
+                }
+                tag, err := parseTag( sids[0], sid )
+                if err != nil {
+                    return nil, err
+                }
+                tags = append( tags, tag )
+                continue
+            }
+            if len(tags) > 0 {
+                return nil, fmt.Errorf( "invalid tag: %s\n", sid )
+            }
 
-            v, err := strconv.ParseInt(sid, 0, 64); if err != nil || v < lowBound {
+            v, err := strconv.ParseInt(sid, 0, 64); if err != nil || v < 0 {
                 return nil, fmt.Errorf( "invalid Id: %s\n", sid )
             }
             id := int(v)
             sids = append( sids, id )
         }
-        res = append( res, metaIds{ id, sids } )
+        for _, sid := range sids {      // IFD0 tags can be removed, not IFD0
+            if len(tags) == 0 && sid < int(lowBound) {
+                return nil, fmt.Errorf( "invalid Id: %d\n", sid )
+            }
+        }
+        res = append( res, metaIds{ id, sids, tags } )
     }
     return res, nil
 }
@@ -447,7 +1826,7 @@ func parseQuantization( quantization string ) (res []quTable, err error) {
         if specs[0] == "*" {
             dest = -1
         } else {
-            v, err := strconv.ParseInt(specs[0], 0, 64); if err != nil || v < 0 || v > 3 {
+            v, err := strconv.ParseInt(specs[0], 0, 64); if err != nil || v < 0 || v > maxDestinationField {
                 return nil, fmt.Errorf(
                     "invalid Quantization table destination: %s\n", specs[0] )
             }
@@ -502,7 +1881,7 @@ func parseEntropy( entropy string ) (res []enTable, err error) {
                 return nil, fmt.Errorf(
                      "Unsupported case: all destinations for specific class\n" )
             }
-            v, err := strconv.ParseInt(specs[1], 0, 64); if err != nil || v < 0 || v > 3 {
+            v, err := strconv.ParseInt(specs[1], 0, 64); if err != nil || v < 0 || v > maxDestinationField {
                 return nil, fmt.Errorf( "invalid Entropy table destination: %s\n", specs[1] )
             }
             dest = int(v)
@@ -523,8 +1902,29 @@ func parseEntropy( entropy string ) (res []enTable, err error) {
     return res, nil
 }
 
-var classes = [...]string{ "parse", "display", "modify", "save" }
-var help    = [...]string{ PARSE_OPTIONS, DISPLAY_OPTIONS, MODIFY_OPTIONS, SAVE_OPTIONS }
+func parseSample( sample string, seed int64 ) (*sampleSpec, error) {
+// -sample=<n>|<p>%
+    res := new( sampleSpec )
+    res.seed = seed
+    if strings.HasSuffix( sample, "%" ) {
+        v, err := strconv.ParseFloat( sample[:len(sample)-1], 64 )
+        if err != nil || v <= 0 || v > 100 {
+            return nil, fmt.Errorf( "invalid sample percentage: %s\n", sample )
+        }
+        res.percent = v
+    } else {
+        v, err := strconv.ParseInt( sample, 0, 64 )
+        if err != nil || v <= 0 {
+            return nil, fmt.Errorf( "invalid sample size: %s\n", sample )
+        }
+        res.count = int(v)
+    }
+    return res, nil
+}
+
+var classes = [...]string{ "parse", "display", "modify", "save", "batch" }
+var help    = [...]string{ PARSE_OPTIONS, DISPLAY_OPTIONS, MODIFY_OPTIONS,
+                           SAVE_OPTIONS, BATCH_OPTIONS }
 func optionHelp( c string ) {
     for i := 0; i < len(classes); i++ {
         if classes[i] == c {
@@ -542,17 +1942,97 @@ func getArgs( ) (* jpgArgs, error) {
 
     var version bool
     flag.BoolVar( &version, "v", false, "print jcheck version and exits" )
+    flag.BoolVar( &pArgs.debug, "debug", false, "print stack trace on unexpected failure" )
+    var noSimd bool
+    flag.BoolVar( &noSimd, "no-simd", false, "do not use SIMD instructions" )
     flag.BoolVar( &pArgs.control.Markers, "m", false, "print markers and offsets as parsing goes" )
     flag.BoolVar( &pArgs.control.Warn, "w", false, "warn of errors during parsing" )
+    var minSeverity string
+    flag.StringVar( &minSeverity, "severity", "", "list diagnostics at least as severe" )
     flag.BoolVar( &pArgs.control.Verbose, "x", false, "print extra header information during parsing" )
     flag.BoolVar( &pArgs.control.Mcu, "mcu", false, "print minimum coded unit processing" )
     flag.BoolVar( &pArgs.control.Du, "du", false, "print resulting data unit" )
     flag.UintVar( &pArgs.control.Begin, "b", BEGIN, "begin printing mcu/du at mcu #nn (default 0)" )
-    flag.UintVar( &pArgs.control.End, "e", END, "end printing mcu/du at mcu #pp (default end of scan)" )
+    var mcuEnd string
+    flag.StringVar( &mcuEnd, "e", "", "end printing mcu/du at mcu #pp or +n (default end of scan)" )
+    flag.IntVar( &pArgs.restartInterval, "ri", -1, "print mcu/du of restart interval #n" )
     flag.BoolVar( &pArgs.control.Recurse, "rp", false, "Recursively parse embedded JPEG pictures" )
+    flag.IntVar( &pArgs.recurseDepth, "rp-depth", defaultRecurseDepth, "maximum IFD nesting depth" )
+    flag.IntVar( &pArgs.recurseSize, "rp-size", defaultRecurseSize, "maximum embedded picture size" )
     flag.BoolVar( &pArgs.control.TidyUp, "tidyup", false, "try fixing errors during analysis" )
+    flag.BoolVar( &pArgs.fixByteOrder, "fix-byte-order", false, "rewrite Exif IFDs in the declared byte order" )
+    flag.BoolVar( &pArgs.immutable, "image-data-immutable", false, "refuse any modification of image data" )
+    flag.BoolVar( &pArgs.audit, "audit", false, "record modifications in output file" )
+    flag.StringVar( &pArgs.undo, "undo", "", "save undo patch" )
+    flag.BoolVar( &pArgs.security, "security", false, "look for executables or scripts" )
+    var lenient string
+    flag.StringVar( &lenient, "lenient", "", "tolerate vendor quirks in Exif data" )
+    flag.BoolVar( &pArgs.exiftool, "exiftool-compare", false, "compare metadata with exiftool" )
+    flag.BoolVar( &pArgs.verifyScan, "verify-scan", false, "entropy decode all scans" )
+    flag.BoolVar( &pArgs.preservation, "preservation-check", false, "give a preservation verdict" )
+    flag.BoolVar( &pArgs.thumbPrivacy, "thumb-privacy", false, "compare embedded thumbnails with the picture" )
+    flag.BoolVar( &pArgs.grayCheck, "gray-check", false, "flag grayscale pictures stored as color" )
+    var blankCheck bool
+    flag.BoolVar( &blankCheck, "blank-check", false, "flag pictures of almost a single color" )
+    var blankStddev, blankShare float64
+    flag.Float64Var( &blankStddev, "blank-stddev", defaultBlankStddev, "largest luma standard deviation of a blank picture" )
+    flag.Float64Var( &blankShare, "blank-share", defaultBlankShare, "percentage of uniform pixels in a blank picture" )
+    var exposureCheck bool
+    flag.BoolVar( &exposureCheck, "exposure-check", false, "flag severe highlight or shadow clipping" )
+    var clipHighlights, clipShadows float64
+    flag.Float64Var( &clipHighlights, "clip-highlights", defaultClipHighlights, "largest percentage of clipped highlights" )
+    flag.Float64Var( &clipShadows, "clip-shadows", defaultClipShadows, "largest percentage of clipped shadows" )
+    flag.BoolVar( &pArgs.blurCheck, "blur-check", false, "flag out-of-focus or shaken pictures" )
+    var blurThreshold float64
+    flag.Float64Var( &blurThreshold, "blur-threshold", defaultBlurThreshold, "smallest luma Laplacian variance of a sharp picture" )
+    flag.BoolVar( &pArgs.rotationCheck, "rotation-check", false, "suggest a rotation if Exif orientation is missing" )
+    var classify string
+    flag.StringVar( &classify, "classify", "", "run an external classifier" )
+    var classifySize int
+    flag.IntVar( &classifySize, "classify-size", defaultClassifySize, "largest side of classified pictures" )
+    flag.StringVar( &pArgs.spliceCheck, "splice-check", "", "save a splicing suspicion map" )
 
     flag.BoolVar( &pArgs.tables, "t", false, "print jpeg tables during analysis" )
+    flag.BoolVar( &pArgs.markerStats, "marker-stats", false, "print marker statistics" )
+    flag.BoolVar( &pArgs.entropyStats, "entropy-stats", false, "print entropy-coded data statistics" )
+    flag.BoolVar( &pArgs.stuffing, "stuffing", false, "print fill and stuffed bytes" )
+    flag.BoolVar( &pArgs.coefStats, "coef-stats", false, "print DCT coefficient statistics" )
+    flag.BoolVar( &pArgs.fingerprint, "fingerprint", false, "print the encoder fingerprint" )
+    flag.BoolVar( &pArgs.metaFlat, "meta-flat", false, "print metadata as flat keys" )
+    flag.BoolVar( &pArgs.c2pa, "c2pa", false, "print C2PA manifests" )
+    flag.StringVar( &pArgs.sC2pa, "sc2pa", "", "save C2PA manifest store" )
+    flag.StringVar( &pArgs.sIcc, "sicc", "", "save ICC profile" )
+    flag.BoolVar( &pArgs.rmC2pa, "rm-c2pa", false, "remove C2PA manifests from output" )
+    flag.StringVar( &pArgs.thumbs, "thumbs", "", "strip or regenerate embedded renditions" )
+    var redact string
+    flag.StringVar( &redact, "redact", "", "redact a region of the picture" )
+    flag.BoolVar( &pArgs.toGray, "to-gray", false, "convert grayscale pictures stored as color" )
+    flag.BoolVar( &pArgs.jumbf, "jumbf", false, "print JUMBF box tree" )
+    flag.BoolVar( &pArgs.recoverability, "recoverability", false, "print recoverability score" )
+    flag.StringVar( &pArgs.suggest, "suggest", "", "save repair suggestions" )
+    flag.StringVar( &pArgs.applySuggestions, "apply-suggestions", "", "apply repair suggestions" )
+    var sjumbf string
+    flag.StringVar( &sjumbf, "sjumbf", "", "save JUMBF box in a new file" )
+    var sscan string
+    flag.StringVar( &sscan, "sscan", "", "save entropy-coded scan data in a new file" )
+    flag.StringVar( &pArgs.sDepth, "sdepth", "", "save depth map in a new file" )
+    flag.StringVar( &pArgs.sChroma, "schroma", "", "save chroma planes at stored resolution" )
+    flag.StringVar( &pArgs.sQuant, "squant", "", "save quantization tables as text" )
+    var iquant, iquantMode string
+    flag.StringVar( &iquant, "iquant", "", "replace a quantization table from a text file" )
+    flag.StringVar( &iquantMode, "iquant-mode", "requantize", "requantize or header" )
+    flag.StringVar( &pArgs.sHuff, "shuff", "", "save Huffman tables as json" )
+    var ihuff string
+    flag.StringVar( &ihuff, "ihuff", "", "replace Huffman tables from a json file" )
+    var setmeta string
+    flag.StringVar( &setmeta, "setmeta", "", "modify or insert Exif tags" )
+    flag.BoolVar( &pArgs.stripGps, "strip-gps", false, "remove location data from output" )
+    var copymeta string
+    flag.StringVar( &copymeta, "copymeta", "", "copy metadata segments from another file" )
+    var loadmeta string
+    flag.StringVar( &loadmeta, "loadmeta", "", "write metadata from a json template" )
+    flag.StringVar( &pArgs.thumbFormat, "thumb-format", "", "transcode saved embedded images" )
+    flag.BoolVar( &pArgs.listThumbs, "lthumb", false, "list all embedded images" )
     var meta string
     flag.StringVar( &meta, "meta", "", "print metadata" )
     var quantizer string
@@ -566,8 +2046,60 @@ func getArgs( ) (* jpgArgs, error) {
     var sthumb string
     flag.StringVar( &sthumb, "sthumb", "", "save embedded thumbnail in a new file" )
     var spict string
+    var stamp string
+    flag.StringVar( &stamp, "stamp", "", "composite a watermark onto the saved picture" )
+    var resize, resizeFilter string
+    flag.StringVar( &resize, "resize", "", "resize the saved picture" )
+    flag.StringVar( &resizeFilter, "resize-filter", "lanczos", "resampling filter" )
+    var gray string
+    flag.StringVar( &gray, "gray", "", "grayscale conversion for a BW saved picture" )
+    var derive string
+    flag.StringVar( &derive, "derive", "", "save derivatives defined in a presets file" )
     flag.StringVar( &spict, "spict", "", "save decompressed picture in a new file" )
+    flag.StringVar( &pArgs.qerr, "qerr", "", "save quantization error heat-map" )
+    flag.StringVar( &pArgs.metaJson, "meta-json", "", "save metadata as json" )
+    flag.StringVar( &pArgs.dumpMeta, "dumpmeta", "", "save metadata as a json or csv sidecar" )
     flag.StringVar( &pArgs.output, "o", "", "output modified JPEG data to the file`name`" )
+    flag.BoolVar( &pArgs.sanitize, "sanitize", false, "replace reserved characters in output file names" )
+    flag.BoolVar( &pArgs.reproducible, "reproducible", false, "write byte identical outputs for identical inputs" )
+    flag.BoolVar( &pArgs.selftest, "selftest-roundtrip", false, "verify output file after writing" )
+    var sample string
+    flag.StringVar( &sample, "sample", "", "check only a random sample of files" )
+    var seed int64
+    flag.Int64Var( &seed, "seed", 1, "seed for random sample" )
+    flag.StringVar( &pArgs.journal, "journal", "", "record batch progress in journal" )
+    flag.BoolVar( &pArgs.resume, "resume", false, "resume batch from journal" )
+    var maxWriteMbps float64
+    flag.Float64Var( &maxWriteMbps, "max-write-mbps", 0, "limit the write rate in MB/s" )
+    var maxOpenFiles int
+    flag.IntVar( &maxOpenFiles, "max-open-files", 0, "limit the number of open files" )
+    flag.StringVar( &pArgs.cache, "cache", "", "skip files unchanged since cached" )
+    flag.BoolVar( &pArgs.force, "force", false, "check all files regardless of cache" )
+    var onError, failOn string
+    flag.StringVar( &onError, "on-error", "", "action applied to failed files" )
+    flag.StringVar( &failOn, "fail-on", "", "severity that fails a file for -on-error" )
+    var checksum string
+    flag.StringVar( &checksum, "checksum", "", "write checksum manifest" )
+    flag.StringVar( &pArgs.verifyChecksum, "verify-checksum", "", "verify checksum manifest" )
+    var sign, verifySig string
+    flag.StringVar( &sign, "sign", "", "sign valid files with key" )
+    flag.StringVar( &verifySig, "verify-sig", "", "verify file signatures with key" )
+    flag.StringVar( &pArgs.xmlReport, "xml-report", "", "write xml report" )
+    flag.StringVar( &pArgs.jsonReport, "report", "", "write json report" )
+    var sinks string
+    flag.StringVar( &sinks, "sink", "", "write reports in the given formats" )
+    flag.BoolVar( &pArgs.json, "json", false, "print analysis as json" )
+    flag.BoolVar( &pArgs.quiet, "q", false, "print nothing, only set exit status" )
+    flag.BoolVar( &pArgs.quietSummary, "q-summary", false, "print PASS or FAIL per file with -q" )
+    flag.StringVar( &pArgs.recurse, "R", "", "check all jpeg files in directory tree" )
+    var symlinks, hardlinks string
+    var minSize, maxSize, newerThan, olderThan string
+    flag.StringVar( &minSize, "min-size", "", "check only files of at least this size with -R" )
+    flag.StringVar( &maxSize, "max-size", "", "check only files of at most this size with -R" )
+    flag.StringVar( &newerThan, "newer-than", "", "check only files modified after this time with -R" )
+    flag.StringVar( &olderThan, "older-than", "", "check only files modified before this time with -R" )
+    flag.StringVar( &symlinks, "symlinks", "", "skip or follow symbolic links with -R" )
+    flag.StringVar( &hardlinks, "hardlinks", "", "check files with several paths once or for all paths with -R" )
     var soptions string
     flag.StringVar( &soptions, "oh", "", "detailed options help" )
 
@@ -575,6 +2107,7 @@ func getArgs( ) (* jpgArgs, error) {
         fmt.Fprintf( flag.CommandLine.Output(), HELP )
     }
     flag.Parse()
+    pArgs.cacheOptions = cacheOptions( flag.CommandLine )
     if version {
         fmt.Fprintf( flag.CommandLine.Output(), "pdfCheck version %s\n", VERSION )
         os.Exit(0)
@@ -582,14 +2115,84 @@ func getArgs( ) (* jpgArgs, error) {
     if soptions != "" {
         optionHelp( soptions )
     }
+    if noSimd {
+        disableSimd()
+    }
+    if minSeverity != "" {
+        s, err := parseSeverity( minSeverity )
+        if err != nil {
+            return nil, fmt.Errorf( "getArgs: %w", err )
+        }
+        pArgs.diagnostics, pArgs.minSeverity = true, s
+        pArgs.control.Warn = true
+    } else if pArgs.control.Warn {
+        pArgs.diagnostics, pArgs.minSeverity = true, warningSeverity
+    }
+    if lenient != "" {
+        if err := parseQuirks( lenient ); err != nil {
+            return nil, fmt.Errorf( "getArgs: %w", err )
+        }
+    }
+
+    if pArgs.xmlReport != "" {
+        pArgs.sinks = append( pArgs.sinks, sinkSpec{ "xml", pArgs.xmlReport } )
+    }
+    if pArgs.jsonReport != "" {
+        pArgs.sinks = append( pArgs.sinks, sinkSpec{ "json", pArgs.jsonReport } )
+    }
+    if sinks != "" {
+        specs, err := parseSinks( sinks )
+        if err != nil {
+            return nil, fmt.Errorf( "getArgs: -sink: %v", err )
+        }
+        pArgs.sinks = append( pArgs.sinks, specs... )
+    }
+    if pArgs.quiet && pArgs.json {
+        return nil, fmt.Errorf( "getArgs: option -q cannot be combined with " +
+                                "-json\n" )
+    }
+    if pArgs.quietSummary && ! pArgs.quiet {
+        return nil, fmt.Errorf( "getArgs: option -q-summary requires -q\n" )
+    }
 
     arguments := flag.Args()
-    if len( arguments ) < 1 {
-        fmt.Printf( "Missing the name of the file to process\n" )
-        os.Exit(2)
+    if pArgs.recurse != "" {
+        if info, err := os.Stat( pArgs.recurse ); err != nil || ! info.IsDir() {
+            return nil, fmt.Errorf( "getArgs: -R %s is not a directory\n",
+                                    pArgs.recurse )
+        }
+    }
+    if ( symlinks != "" || hardlinks != "" ) && pArgs.recurse == "" {
+        return nil, fmt.Errorf( "getArgs: options -symlinks and -hardlinks " +
+                                "require -R\n" )
     }
-    if len( arguments ) > 1 {
-        fmt.Printf( "Too many files specified (only 1 file at a time)\n" )
+    filter, err := newFileFilter( minSize, maxSize, newerThan, olderThan )
+    if err != nil {
+        return nil, fmt.Errorf( "getArgs: %w", err )
+    }
+    if filter != nil && pArgs.recurse == "" {
+        return nil, fmt.Errorf( "getArgs: options -min-size, -max-size, " +
+                                "-newer-than and -older-than require -R\n" )
+    }
+    pArgs.filter = filter
+    switch symlinks {
+    case "", "skip":
+    case "follow":
+        pArgs.followLinks = true
+    default:
+        return nil, fmt.Errorf( "getArgs: invalid -symlinks %s (skip or " +
+                                "follow)\n", symlinks )
+    }
+    switch hardlinks {
+    case "", "once":
+    case "all":
+        pArgs.allHardlinks = true
+    default:
+        return nil, fmt.Errorf( "getArgs: invalid -hardlinks %s (once or " +
+                                "all)\n", hardlinks )
+    }
+    if len( arguments ) < 1 && pArgs.recurse == "" {
+        fmt.Printf( "Missing the name of the file to process\n" )
         os.Exit(2)
     }
     if meta != "" {
@@ -637,10 +2240,11 @@ func getArgs( ) (* jpgArgs, error) {
         pArgs.rmActions = rmActions
     }
     if sthumb != "" {
-        svActions, err := parseSthumb( sthumb )
+        svActions, svEmbedded, err := parseSthumb( sthumb )
         if err != nil {
             return nil, fmt.Errorf( "getArgs: %w", err )
         }
+        pArgs.svEmbedded = svEmbedded
 // Debug
         for _, xa := range svActions {
             fmt.Printf( "Save thumbnail %d:%s\n", xa.ThId, xa.Path )
@@ -648,6 +2252,49 @@ func getArgs( ) (* jpgArgs, error) {
 // end debug
         pArgs.svActions = svActions
     }
+    if pArgs.thumbFormat != "" && ! isTranscodeFormat( pArgs.thumbFormat ) {
+        return nil, fmt.Errorf( "getArgs: invalid -thumb-format %s (png or " +
+                                "webp)\n", pArgs.thumbFormat )
+    }
+    for _, xa := range pArgs.svActions {
+        if outputFormat( xa.Path, pArgs.thumbFormat ) != "" {
+            return nil, fmt.Errorf( "getArgs: thumbnail %d cannot be " +
+                                    "transcoded, use an id given by -lthumb " +
+                                    "such as exif or jfif\n", xa.ThId )
+        }
+    }
+
+    end, err := parseMcuEnd( mcuEnd, pArgs.control.Begin )
+    if err != nil {
+        return nil, fmt.Errorf( "getArgs: %w", err )
+    }
+    pArgs.control.End = end
+    if pArgs.restartInterval >= 0 {
+        switch {
+        case ! pArgs.control.Mcu && ! pArgs.control.Du:
+            return nil, fmt.Errorf( "getArgs: option -ri requires -mcu or " +
+                                    "-du\n" )
+        case pArgs.control.Begin != BEGIN || mcuEnd != "":
+            return nil, fmt.Errorf( "getArgs: option -ri cannot be combined " +
+                                    "with -b or -e\n" )
+        }
+    }
+
+    if sjumbf != "" {
+        sJumbf, err := parseSjumbf( sjumbf )
+        if err != nil {
+            return nil, fmt.Errorf( "getArgs: %w", err )
+        }
+        pArgs.sJumbf = sJumbf
+    }
+
+    if sscan != "" {
+        sScan, err := parseSscan( sscan )
+        if err != nil {
+            return nil, fmt.Errorf( "getArgs: %w", err )
+        }
+        pArgs.sScan = sScan
+    }
 
     if spict != "" {
         sparams, err := parseSpict( spict )
@@ -655,10 +2302,52 @@ func getArgs( ) (* jpgArgs, error) {
             return nil, fmt.Errorf( "getArgs: %w", err )
         }
 // Debug
-        fmt.Printf( "Save picture: orientation row0=%v col0=%v BW=%v to path %s\n",
-                    sparams.row0, sparams.col0, sparams.bw, sparams.path )
+        fmt.Printf( "Save picture: orientation row0=%v col0=%v BW=%v CMYK=%v to path %s\n",
+                    sparams.row0, sparams.col0, sparams.bw, sparams.cmyk,
+                    sparams.path )
 // end debug
         pArgs.sPicture = sparams
+        if sparams.cmyk && ( resize != "" || stamp != "" ) {
+            return nil, fmt.Errorf( "getArgs: options -resize and -stamp " +
+                                    "require -spict with the BW or RGB " +
+                                    "format\n" )
+        }
+    }
+    if resize != "" {
+        if spict == "" {
+            return nil, fmt.Errorf( "getArgs: option -resize requires -spict\n" )
+        }
+        var err error
+        if pArgs.resize, err = parseResize( resize, resizeFilter ); err != nil {
+            return nil, fmt.Errorf( "getArgs: -resize: %v", err )
+        }
+    }
+    if stamp != "" {
+        if spict == "" {
+            return nil, fmt.Errorf( "getArgs: option -stamp requires -spict\n" )
+        }
+        var err error
+        if pArgs.stamp, err = parseStamp( stamp ); err != nil {
+            return nil, fmt.Errorf( "getArgs: -stamp: %v", err )
+        }
+    }
+    if gray != "" {
+        if spict == "" || ! pArgs.sPicture.bw {
+            return nil, fmt.Errorf( "getArgs: option -gray requires -spict " +
+                                    "with the BW format\n" )
+        }
+        var err error
+        if pArgs.gray, err = parseGray( gray ); err != nil {
+            return nil, fmt.Errorf( "getArgs: -gray: %v", err )
+        }
+    } else {
+        pArgs.gray = grayMethods[0]
+    }
+    if derive != "" {
+        var err error
+        if pArgs.derivatives, err = loadDerivatives( derive ); err != nil {
+            return nil, fmt.Errorf( "getArgs: -derive: %v", err )
+        }
     }
 
     if pArgs.output == "" {
@@ -673,23 +2362,346 @@ func getArgs( ) (* jpgArgs, error) {
             fmt.Printf( "         proceeding anyway\n" )
         }
     } else {
-        if ! pArgs.control.TidyUp && len(pArgs.rmActions) == 0 {
+        if ! pArgs.control.TidyUp && len(pArgs.rmActions) == 0 &&
+           ! pArgs.rmC2pa && pArgs.thumbs == "" && redact == "" &&
+           ! pArgs.toGray &&
+           iquant == "" && ihuff == "" && setmeta == "" && copymeta == "" &&
+           loadmeta == "" &&
+           ! pArgs.stripGps && ! pArgs.fixByteOrder &&
+           pArgs.applySuggestions == "" {
             fmt.Printf( "Warning: although an output file is requested, " +
                         "tidying up or removing metadata from the original " +
                         "file is NOT requested\n" )
             fmt.Printf( "         proceeding anyway\n" )
         }
     }
-    pArgs.input = arguments[0]
+    if pArgs.immutable && pArgs.control.TidyUp {
+        return nil, fmt.Errorf( "getArgs: option -tidyup may modify image " +
+                                "data and is refused with " +
+                                "-image-data-immutable\n" )
+    }
+    if sign != "" {
+        var err error
+        if pArgs.signKey, err = loadSigningKey( sign ); err != nil {
+            return nil, fmt.Errorf( "getArgs: -sign: %v", err )
+        }
+        if pArgs.signKey.secret == nil && pArgs.signKey.private == nil {
+            return nil, fmt.Errorf( "getArgs: -sign requires a private key\n" )
+        }
+    }
+    if verifySig != "" {
+        var err error
+        if pArgs.verifyKey, err = loadSigningKey( verifySig ); err != nil {
+            return nil, fmt.Errorf( "getArgs: -verify-sig: %v", err )
+        }
+    }
+    if pArgs.stripGps && pArgs.output == "" {
+        return nil, fmt.Errorf( "getArgs: option -strip-gps requires -o\n" )
+    }
+    if pArgs.rmC2pa && pArgs.output == "" {
+        return nil, fmt.Errorf( "getArgs: option -rm-c2pa requires -o\n" )
+    }
+    if classify != "" {
+        if classifySize < 8 {
+            return nil, fmt.Errorf( "getArgs: invalid -classify-size %d\n",
+                                    classifySize )
+        }
+        var err error
+        if pArgs.classifier, err = newClassifier( classify,
+                                                  classifySize ); err != nil {
+            return nil, fmt.Errorf( "getArgs: -classify: %v", err )
+        }
+    }
+    if blankCheck {
+        var err error
+        if pArgs.blank, err = newBlankThresholds( blankStddev,
+                                                  blankShare ); err != nil {
+            return nil, fmt.Errorf( "getArgs: -blank-check: %v", err )
+        }
+    }
+    if exposureCheck {
+        var err error
+        if pArgs.exposure, err = newExposureThresholds( clipHighlights,
+                                                        clipShadows ); err != nil {
+            return nil, fmt.Errorf( "getArgs: -exposure-check: %v", err )
+        }
+    }
+    if pArgs.blurCheck {
+        var err error
+        if pArgs.blurThreshold, err = newBlurThreshold( blurThreshold ); err != nil {
+            return nil, fmt.Errorf( "getArgs: -blur-check: %v", err )
+        }
+    }
+    if redact != "" {
+        var err error
+        if pArgs.redact, err = parseRedact( redact ); err != nil {
+            return nil, fmt.Errorf( "getArgs: -redact: %v", err )
+        }
+        switch {
+        case pArgs.output == "":
+            return nil, fmt.Errorf( "getArgs: option -redact requires -o\n" )
+        case pArgs.immutable:
+            return nil, fmt.Errorf( "getArgs: option -redact modifies image " +
+                                    "data and is refused with " +
+                                    "-image-data-immutable\n" )
+        case pArgs.selftest:
+            return nil, fmt.Errorf( "getArgs: option -redact cannot be " +
+                                    "combined with -selftest-roundtrip\n" )
+        }
+    }
+    if pArgs.toGray {
+        switch {
+        case pArgs.output == "":
+            return nil, fmt.Errorf( "getArgs: option -to-gray requires -o\n" )
+        case pArgs.immutable:
+            return nil, fmt.Errorf( "getArgs: option -to-gray modifies image " +
+                                    "data and is refused with " +
+                                    "-image-data-immutable\n" )
+        case pArgs.selftest:
+            return nil, fmt.Errorf( "getArgs: option -to-gray cannot be " +
+                                    "combined with -selftest-roundtrip\n" )
+        }
+    }
+    if iquant != "" {
+        var err error
+        if pArgs.iQuant, err = parseQuantImport( iquant,
+                                                 iquantMode ); err != nil {
+            return nil, fmt.Errorf( "getArgs: -iquant: %v", err )
+        }
+        switch {
+        case pArgs.output == "":
+            return nil, fmt.Errorf( "getArgs: option -iquant requires -o\n" )
+        case pArgs.immutable:
+            return nil, fmt.Errorf( "getArgs: option -iquant modifies image " +
+                                    "data and is refused with " +
+                                    "-image-data-immutable\n" )
+        case pArgs.selftest:
+            return nil, fmt.Errorf( "getArgs: option -iquant cannot be " +
+                                    "combined with -selftest-roundtrip\n" )
+        }
+    }
+    if pArgs.applySuggestions != "" {
+        if pArgs.output == "" {
+            return nil, fmt.Errorf( "getArgs: option -apply-suggestions " +
+                                    "requires -o\n" )
+        }
+        if pArgs.immutable {
+            return nil, fmt.Errorf( "getArgs: option -apply-suggestions may " +
+                                    "modify image data and is refused with " +
+                                    "-image-data-immutable\n" )
+        }
+        if pArgs.applySuggestions != "ask" {
+            if len( arguments ) > 1 || pArgs.recurse != "" {
+                return nil, fmt.Errorf( "getArgs: option -apply-suggestions " +
+                                        "requires a single file to process " +
+                                        "unless it is ask\n" )
+            }
+            report, err := loadSuggestions( pArgs.applySuggestions )
+            if err != nil {
+                return nil, fmt.Errorf( "getArgs: -apply-suggestions: %v", err )
+            }
+            pArgs.suggestions = report
+        }
+    }
+    if setmeta != "" {
+        var err error
+        if pArgs.setMeta, err = parseSetMeta( setmeta ); err != nil {
+            return nil, fmt.Errorf( "getArgs: -setmeta: %v", err )
+        }
+        if pArgs.output == "" {
+            return nil, fmt.Errorf( "getArgs: option -setmeta requires -o\n" )
+        }
+    }
+    if copymeta != "" {
+        var err error
+        if pArgs.copyMeta, err = parseCopyMeta( copymeta ); err != nil {
+            return nil, fmt.Errorf( "getArgs: -copymeta: %v", err )
+        }
+        if _, err = os.Stat( pArgs.copyMeta.source ); err != nil {
+            return nil, fmt.Errorf( "getArgs: -copymeta: %v\n", err )
+        }
+        if pArgs.output == "" {
+            return nil, fmt.Errorf( "getArgs: option -copymeta requires -o\n" )
+        }
+    }
+    if loadmeta != "" {
+        var err error
+        if pArgs.loadMeta, err = loadMetaTemplate( loadmeta ); err != nil {
+            return nil, fmt.Errorf( "getArgs: -loadmeta: %v", err )
+        }
+        if pArgs.output == "" {
+            return nil, fmt.Errorf( "getArgs: option -loadmeta requires -o\n" )
+        }
+    }
+    if ihuff != "" {
+        tables, err := loadHuffmanTables( ihuff )
+        if err != nil {
+            return nil, fmt.Errorf( "getArgs: -ihuff: %v", err )
+        }
+        pArgs.iHuff = &huffImport{ path: ihuff, tables: tables }
+        switch {
+        case pArgs.output == "":
+            return nil, fmt.Errorf( "getArgs: option -ihuff requires -o\n" )
+        case pArgs.immutable:
+            return nil, fmt.Errorf( "getArgs: option -ihuff modifies image " +
+                                    "data and is refused with " +
+                                    "-image-data-immutable\n" )
+        case pArgs.selftest:
+            return nil, fmt.Errorf( "getArgs: option -ihuff cannot be " +
+                                    "combined with -selftest-roundtrip\n" )
+        }
+    }
+    if pArgs.thumbs != "" {
+        if ! isThumbsMode( pArgs.thumbs ) {
+            return nil, fmt.Errorf( "getArgs: invalid -thumbs %s (strip or " +
+                                    "regen)\n", pArgs.thumbs )
+        }
+        if pArgs.output == "" {
+            return nil, fmt.Errorf( "getArgs: option -thumbs requires -o\n" )
+        }
+    }
+    if pArgs.audit && pArgs.output == "" {
+        return nil, fmt.Errorf( "getArgs: option -audit requires -o\n" )
+    }
+    if pArgs.undo != "" && pArgs.output == "" {
+        return nil, fmt.Errorf( "getArgs: option -undo requires -o\n" )
+    }
+    if pArgs.selftest && pArgs.output == "" {
+        return nil, fmt.Errorf( "getArgs: option -selftest-roundtrip requires " +
+                                "-o\n" )
+    }
+    if sample != "" {
+        spec, err := parseSample( sample, seed )
+        if err != nil {
+            return nil, fmt.Errorf( "getArgs: %w", err )
+        }
+        pArgs.sample = spec
+    }
+
+    if onError != "" {
+        action, err := parseOnError( onError )
+        if err != nil {
+            return nil, fmt.Errorf( "getArgs: %w", err )
+        }
+        pArgs.onError = action
+        if failOn != "" {
+            if action.failOn, err = parseSeverity( failOn ); err != nil {
+                return nil, fmt.Errorf( "getArgs: -fail-on: %w", err )
+            }
+            if action.failOn < errorSeverity {
+                pArgs.control.Warn = true
+                if ! pArgs.diagnostics {
+                    pArgs.diagnostics = true
+                    pArgs.minSeverity = warningSeverity
+                }
+            }
+        }
+    } else if failOn != "" {
+        return nil, fmt.Errorf( "getArgs: option -fail-on requires " +
+                                "-on-error\n" )
+    }
+
+    if checksum != "" {
+        spec, err := parseChecksum( checksum )
+        if err != nil {
+            return nil, fmt.Errorf( "getArgs: %w", err )
+        }
+        pArgs.checksum = spec
+    }
+
+    if pArgs.dumpMeta != "" {
+        if _, err := dumpMetaFormat( pArgs.dumpMeta ); err != nil {
+            return nil, fmt.Errorf( "getArgs: %w", err )
+        }
+    }
+
+    if err := setThrottle( maxWriteMbps, maxOpenFiles ); err != nil {
+        return nil, fmt.Errorf( "getArgs: %w", err )
+    }
+
+    if pArgs.resume && pArgs.journal == "" {
+        return nil, fmt.Errorf( "getArgs: option -resume requires -journal\n" )
+    }
+
+    fixed := false      // some output paths are not templates
+    outputs := []*string{ &pArgs.output, &pArgs.sPicture.path, &pArgs.qerr,
+                          &pArgs.spliceCheck, &pArgs.metaJson,
+                          &pArgs.dumpMeta, &pArgs.sC2pa,
+                          &pArgs.sIcc,
+                          &pArgs.sDepth, &pArgs.sChroma, &pArgs.sQuant,
+                          &pArgs.sHuff, &pArgs.suggest, &pArgs.undo }
+    for i := range pArgs.svActions {
+        outputs = append( outputs, &pArgs.svActions[i].Path )
+    }
+    for i := range pArgs.svEmbedded {
+        outputs = append( outputs, &pArgs.svEmbedded[i].path )
+    }
+    for i := range pArgs.sJumbf {
+        outputs = append( outputs, &pArgs.sJumbf[i].path )
+    }
+    for i := range pArgs.sScan {
+        outputs = append( outputs, &pArgs.sScan[i].path )
+    }
+    for i := range pArgs.derivatives {
+        outputs = append( outputs, &pArgs.derivatives[i].Path )
+    }
+    pArgs.writesFiles = pArgs.signKey != nil || pArgs.onError != nil
+    for _, o := range outputs {
+        if *o == "" {
+            continue
+        }
+        pArgs.writesFiles = true
+        if hasTemplate( *o ) {
+            if err := validateTemplate( *o ); err != nil {
+                return nil, fmt.Errorf( "getArgs: %w", err )
+            }
+            pArgs.templates = true
+            continue
+        }
+        fixed = true
+        *o = outputPath( *o, pArgs.sanitize )
+    }
+    if ( len( arguments ) > 1 || pArgs.recurse != "" ) && fixed {
+        return nil, fmt.Errorf( "getArgs: options -o, -spict, -sthumb, -qerr, " +
+                                "-meta-json, -dumpmeta, -sc2pa, -sicc, " +
+                                "-sjumbf, -sscan, " +
+                                "-sdepth, " +
+                                "-schroma, -squant, -shuff, -suggest, -undo, " +
+                                "-splice-check and " +
+                                "-derive " +
+                                "require a single file to process (no -R), " +
+                                "unless " +
+                                "their paths are templates\n" )
+    }
+    for _, arg := range arguments {
+        pArgs.inputs = append( pArgs.inputs, longPath( arg ) )
+    }
     return pArgs, nil
 }
 
-func processMeta( w io.Writer, jpg *jpeg.Desc, args *jpgArgs ) (err error) {
+func processMeta( w io.Writer, jpg *jpeg.Desc, args *jpgArgs,
+                  data []byte ) (err error) {
     for _, mid := range args.meta {
         _, err = jpg.FormatMetadata( w, mid.appId, mid.sIds )
         if err != nil {
             break
         }
+        if ( mid.appId == 1 || mid.appId == -1 ) && len(mid.sIds) == 0 &&
+           data != nil {
+            formatXmpMetadata( w, data )
+        }
+        if mid.showsMakerNote() && data != nil {
+            formatMakerNote( w, data )
+        }
+        if ( mid.appId == 2 || mid.appId == -1 ) && data != nil {
+            formatIccProfile( w, data )
+        }
+        if ( mid.appId == 13 || mid.appId == -1 ) && data != nil {
+            formatPhotoshopIrb( w, data )
+        }
+        if ( mid.appId == 14 || mid.appId == -1 ) && data != nil {
+            formatAdobe( w, data )
+        }
     }
     return
 }
@@ -705,13 +2717,17 @@ func processTables( w io.Writer, jpg *jpeg.Desc, args *jpgArgs ) error {
     return nil
 }
 
-func processQuantization( w io.Writer, jpg *jpeg.Desc, args *jpgArgs ) (err error) {
+func processQuantization( w io.Writer, jpg *jpeg.Desc, args *jpgArgs,
+                          frames []byte ) (err error) {
 
 tableLoop:
     for _, qt := range args.quTables {
         if qt.frame == -1 {
             nFrames := jpg.GetNumberOfFrames()
             for i := uint(0); i < nFrames; i++ {
+                if err = checkDestination( frames, i, qt.dest, true ); err != nil {
+                    break tableLoop
+                }
                 _, err = jpg.FormatEncodingTable(
                                 os.Stdout, i, jpeg.Quantization, qt.dest, qt.mode )
                 if err != nil {
@@ -719,6 +2735,10 @@ tableLoop:
                 }
             }
         } else {
+            err = checkDestination( frames, uint(qt.frame), qt.dest, true )
+            if err != nil {
+                break tableLoop
+            }
             _, err = jpg.FormatEncodingTable(
                       os.Stdout, uint(qt.frame), jpeg.Quantization, qt.dest, qt.mode )
             if err != nil {
@@ -729,7 +2749,8 @@ tableLoop:
     return
 }
 
-func processEntropy( w io.Writer, jpg *jpeg.Desc, args *jpgArgs ) (err error) {
+func processEntropy( w io.Writer, jpg *jpeg.Desc, args *jpgArgs,
+                     frames []byte ) (err error) {
 
 tableLoop:
     for _, et := range args.enTables {
@@ -755,6 +2776,10 @@ tableLoop:
             if et.frame == -1 {
                 nFrames := jpg.GetNumberOfFrames()
                 for i := uint(0); i < nFrames; i++ {
+                    err = checkDestination( frames, i, et.dest, false )
+                    if err != nil {
+                        break tableLoop
+                    }
                     _, err = jpg.FormatEncodingTable(
                                     os.Stdout, i, jpeg.Entropy, dest, et.mode )
                     if err != nil {
@@ -762,6 +2787,10 @@ tableLoop:
                     }
                 }
             } else {
+                err = checkDestination( frames, uint(et.frame), et.dest, false )
+                if err != nil {
+                    break tableLoop
+                }
                 _, err = jpg.FormatEncodingTable(
                         os.Stdout, uint(et.frame), jpeg.Entropy, dest, et.mode )
                 if err != nil {
@@ -807,6 +2836,9 @@ func processSave( jpg *jpeg.Desc, args *jpgArgs ) (err error) {
 func processRemove( jpg *jpeg.Desc, args *jpgArgs ) (err error) {
 
     for _, rm := range args.rmActions {
+        if len(rm.tags) > 0 {
+            continue                    // removed after writing
+        }
         err = jpg.RemoveMetadata( rm.appId, rm.sIds )
         if err != nil {
             break;
@@ -815,122 +2847,530 @@ func processRemove( jpg *jpeg.Desc, args *jpgArgs ) (err error) {
     return
 }
 
-func main() {
+// checkFile processes a single jpeg file according to the requested options.
+// data is the file content if it was read in advance, or nil. It returns an
+// error if the file could not be analysed or if one of the requested actions
+// failed. The results of the analysis are also collected in rep.
+func checkFile( path string, data []byte, process *jpgArgs,
+                rep *fileReport ) (err error) {
 
-    process, err := getArgs()
-    if err != nil {
-        fmt.Printf( "jpegcheck: %v", err )
+    fmt.Printf( "jpegcheck: checking file %s\n", path )
+    defer formatAppliedQuirks( rep )
+    if process, err = process.forFile( path, rep.index ); err != nil {
         return
     }
-
-    fmt.Printf( "jpegcheck: checking file %s\n", process.input )
-
-    jpg, err := jpeg.Read( process.input, &process.control )
+    process = process.forRestartInterval( path, data, rep )
+    rawErr := processRawChecks( path, data, process, rep )
+
+    control := process.control
+    if control.Recurse {
+        if err = checkRecursion( path, data, process ); err != nil {
+            text := fmt.Sprintf( "Recursion disabled: %v", err )
+            fmt.Printf( "%s", text )
+            rep.addMessage( warningSeverity, codeRecursion, text )
+            control.Recurse = false
+        }
+    }
+    if process.applySuggestions != "" {
+        var raw, repaired []byte
+        if raw, err = inputData( path, data ); err != nil {
+            return
+        }
+        if repaired, err = process.repairData( raw, rep ); err != nil {
+            return
+        }
+        if repaired != nil {
+            data = repaired
+        }
+    }
+    if process.fixByteOrder || control.TidyUp {
+        if raw, rerr := inputData( path, data ); rerr == nil {
+            if process.fixByteOrder {
+                if repaired, _ := checkByteOrder( raw,
+                                            scanLayout( raw ) ); repaired != nil {
+                    data, raw = repaired, repaired
+                }
+            }
+            if control.TidyUp {
+                if moved, _ := relocateExif( raw,
+                                             scanLayout( raw ) ); moved != nil {
+                    data = moved
+                }
+            }
+        }
+    }
+    parse := func( ) (*jpeg.Desc, error) {
+        if data != nil {
+            return jpeg.Parse( data, &control )
+        }
+        return jpeg.Read( path, &control )
+    }
+    var jpg *jpeg.Desc
+    if process.diagnostics {
+        raw, _ := inputData( path, data )   // for restart boundaries
+        jpg, err = parseWithDiagnostics( parse, raw, rep )
+    } else {
+        jpg, err = parse()
+    }
+    if err != nil && jpg != nil && len(rep.structure) > 0 &&
+       isArithmetic( rep.structure[0].marker ) {
+        return checkArithmeticFile( path, data, jpg, process, rep )
+    }
+    if err != nil && extendedPrecision( rep ) {
+        return checkExtendedPrecisionFile( path, data, jpg, process, rep )
+    }
     if err != nil {
         fmt.Printf( "%v\n", err )
+        if process.control.Verbose {
+            formatCitation( errorSeverity, err.Error() )
+        }
+        if jpg == nil {
+            rep.addMessage( fatalSeverity, libraryCode( err.Error() ),
+                            err.Error() )
+        } else {
+            rep.addMessage( errorSeverity, libraryCode( err.Error() ),
+                            err.Error() )
+        }
     }
+    if jpg == nil {
+        return fatalError{ fmt.Errorf( "unable to analyse file %s\n", path ) }
+    }
+    rep.setDesc( jpg )
     jpg.FormatImageInfo( os.Stdout )
 /*
     jpg.FormatFrameInfo( os.Stdout, 0 )
     jpg.FormatEncodingTable( os.Stdout, 0, jpeg.Quantization, -1 )
     jpg.FormatEncodingTable( os.Stdout, 0, jpeg.Entropy, -1 )
 */
-    if jpg != nil && jpg.IsComplete( ) {
+    if ! jpg.IsComplete( ) {
+        return codedError{ fmt.Errorf( "file %s is not a complete jpeg " +
+                                       "file\n", path ), codeIncomplete }
+    }
 
-        jpg.FormatFrameInfo( os.Stdout, 0 )
-        err = processTables( os.Stdout, jpg, process )
-        if err != nil {
-            fmt.Printf( "jpegcheck: %v", err )
-            return
+    jpg.FormatFrameInfo( os.Stdout, 0 )
+    err = processTables( os.Stdout, jpg, process )
+    if err != nil {
+        return
+    }
+    var raw []byte                  // for XMP packets
+    if len(process.meta) > 0 {
+        raw, _ = inputData( path, data )
+    }
+    err = processMeta( os.Stdout, jpg, process, raw )
+    if err != nil {
+        return
+    }
+    var frames []byte               // SOF markers, for table destinations
+    if len(process.quTables) > 0 || len(process.enTables) > 0 {
+        if raw, rerr := inputData( path, data ); rerr == nil {
+            frames = frameMarkers( scanLayout( raw ) )
         }
-        err = processMeta( os.Stdout, jpg, process )
-        if err != nil {
-            fmt.Printf( "jpegcheck: %v", err )
-            return
+    }
+    err = processQuantization( os.Stdout, jpg, process, frames )
+    if err != nil {
+        return
+    }
+    err = processEntropy( os.Stdout, jpg, process, frames )
+    if err != nil {
+        return
+    }
+    err = processScan( os.Stdout, jpg, process )
+    if err != nil {
+        return
+    }
+
+    writing := true             // from here, errors are output errors
+    defer func( ) {
+        if writing && err != nil {
+            err = outputError{ err, rawErr != nil }
         }
-        err = processQuantization( os.Stdout, jpg, process )
+    }()
+    err = processSave( jpg, process )
+    if err != nil {
+        return
+    }
+    err = processRemove( jpg, process )
+    if err != nil {
+        return
+    }
+
+    actualL, dataL := jpg.GetActualLengths()
+    fmt.Printf( "Actual JPEG length: %d (original data length: %d)\n", actualL, dataL )
+
+    if process.output != "" {
+        fmt.Printf( "Generating a copy as '%s'\n", process.output )
+        var n int
+        throttle.open()
+        n, err = jpg.Write( process.output )
+        throttle.close()
         if err != nil {
-            fmt.Printf( "jpegcheck: %v", err )
             return
         }
-        err = processEntropy( os.Stdout, jpg, process )
-        if err != nil {
-            fmt.Printf( "jpegcheck: %v", err )
+        throttle.account( n )
+        fmt.Printf( "jpegcheck: written %d bytes\n", n )
+        rep.output, rep.outputSize = process.output, n
+        if err = c2paCopy( path, process.output, process.rmC2pa ); err != nil {
             return
         }
-        err = processScan( os.Stdout, jpg, process )
+        if process.rmC2pa {
+            if info, serr := os.Stat( process.output ); serr == nil {
+                rep.outputSize = int(info.Size())
+            }
+        }
+        if raw, rerr := inputData( path, data ); rerr == nil {
+            var change string
+            if change, err = adobeCopy( raw, process.output,
+                                        process.removesApp( 14 ) ); err != nil {
+                return
+            }
+            if change != "" {
+                fmt.Printf( "%s\n", change )
+                rep.addMessage( infoSeverity, codeAdobe, change )
+                if info, serr := os.Stat( process.output ); serr == nil {
+                    rep.outputSize = int(info.Size())
+                }
+            }
+            if change, err = xmpCopy( raw, process.output,
+                                      process.removesApp( 1 ) ); err != nil {
+                return
+            }
+            if change != "" {
+                fmt.Printf( "%s\n", change )
+                rep.addMessage( infoSeverity, codeOutputChange, change )
+                if info, serr := os.Stat( process.output ); serr == nil {
+                    rep.outputSize = int(info.Size())
+                }
+            }
+            if change, err = signatureCopy( raw, process.output,
+                                            process.removesApp( 15 ) ); err != nil {
+                return
+            }
+            if change != "" {
+                fmt.Printf( "%s\n", change )
+                rep.addMessage( infoSeverity, codeOutputChange, change )
+                if info, serr := os.Stat( process.output ); serr == nil {
+                    rep.outputSize = int(info.Size())
+                }
+            }
+        }
+        if process.copyMeta != nil {
+            var change string
+            if change, err = copyMetaFile( process.output,
+                                           process.copyMeta ); err != nil {
+                return
+            }
+            fmt.Printf( "%s\n", change )
+            rep.addMessage( infoSeverity, codeOutputChange, change )
+            if info, serr := os.Stat( process.output ); serr == nil {
+                rep.outputSize = int(info.Size())
+            }
+        }
+        if process.loadMeta != nil {
+            var change string
+            if change, err = loadMetaFile( process.output,
+                                           process.loadMeta ); err != nil {
+                return
+            }
+            fmt.Printf( "%s\n", change )
+            rep.addMessage( infoSeverity, codeOutputChange, change )
+            if info, serr := os.Stat( process.output ); serr == nil {
+                rep.outputSize = int(info.Size())
+            }
+        }
+        thumbs := process.thumbs
+        if process.redact != nil {
+            var change string
+            if change, err = redactFile( process.output,
+                                         process.redact ); err != nil {
+                return
+            }
+            fmt.Printf( "%s\n", change )
+            if info, serr := os.Stat( process.output ); serr == nil {
+                rep.outputSize = int(info.Size())
+            }
+            if thumbs == "" {
+                thumbs = "regen"
+            }
+        }
+        if process.toGray {
+            var change string
+            var converted bool
+            if change, converted, err = toGrayFile( process.output ); err != nil {
+                return
+            }
+            fmt.Printf( "%s\n", change )
+            if converted {
+                rep.addMessage( infoSeverity, codeGrayscale, change )
+            } else {
+                rep.addMessage( warningSeverity, codeGrayscale, change )
+            }
+            if info, serr := os.Stat( process.output ); serr == nil {
+                rep.outputSize = int(info.Size())
+            }
+        }
+        if process.iQuant != nil {
+            var change string
+            if change, err = importQuantTable( process.output,
+                                               process.iQuant ); err != nil {
+                return
+            }
+            fmt.Printf( "%s\n", change )
+            if process.iQuant.mode == "requantize" {
+                rep.addMessage( warningSeverity, codeOutputChange, change )
+            }
+            if info, serr := os.Stat( process.output ); serr == nil {
+                rep.outputSize = int(info.Size())
+            }
+        }
+        if process.iHuff != nil {
+            var change string
+            if change, err = importHuffmanTables( process.output,
+                                                  process.iHuff.tables ); err != nil {
+                return
+            }
+            fmt.Printf( "%s\n", change )
+            if info, serr := os.Stat( process.output ); serr == nil {
+                rep.outputSize = int(info.Size())
+            }
+        }
+        if process.removesTags() {
+            var change string
+            if change, err = removeExifTags( process.output,
+                                             process.rmActions ); err != nil {
+                return
+            }
+            fmt.Printf( "%s\n", change )
+            rep.addMessage( infoSeverity, codeOutputChange, change )
+            if info, serr := os.Stat( process.output ); serr == nil {
+                rep.outputSize = int(info.Size())
+            }
+        }
+        if process.setMeta != nil {
+            var change string
+            if change, err = setMetaFile( process.output,
+                                          process.setMeta ); err != nil {
+                return
+            }
+            fmt.Printf( "%s\n", change )
+            rep.addMessage( infoSeverity, codeOutputChange, change )
+            if info, serr := os.Stat( process.output ); serr == nil {
+                rep.outputSize = int(info.Size())
+            }
+        }
+        if process.control.TidyUp {
+            var moved []string
+            if moved, err = reorderMetadata( process.output ); err != nil {
+                return
+            }
+            for _, m := range moved {
+                fmt.Printf( "reorder: %s\n", m )
+            }
+            if len(moved) > 0 {
+                rep.addMessage( infoSeverity, codeReorder, "reorder: " +
+                                strings.Join( moved, ", " ) )
+            }
+            if info, serr := os.Stat( process.output ); serr == nil {
+                rep.outputSize = int(info.Size())
+            }
+        }
+        if thumbs != "" {
+            var changes []string
+            if changes, err = rewriteRenditions( process.output,
+                                                 thumbs ); err != nil {
+                return
+            }
+            fmt.Printf( "thumbs: %s\n", strings.Join( changes, ", " ) )
+            if info, serr := os.Stat( process.output ); serr == nil {
+                rep.outputSize = int(info.Size())
+            }
+        }
+        if process.audit {
+            var change string
+            if change, err = recordAudit( path, process.output,
+                                          process ); err != nil {
+                return
+            }
+            fmt.Printf( "%s\n", change )
+            if info, serr := os.Stat( process.output ); serr == nil {
+                rep.outputSize = int(info.Size())
+            }
+        }
+        if process.stripGps {
+            var change string
+            if change, err = stripGpsFile( path, process.output ); err != nil {
+                return
+            }
+            fmt.Printf( "%s\n", change )
+            rep.addMessage( infoSeverity, codeOutputChange, change )
+            if info, serr := os.Stat( process.output ); serr == nil {
+                rep.outputSize = int(info.Size())
+            }
+        }
+        if process.immutable {
+            if err = checkImageDataImmutable( path, process.output ); err != nil {
+                rep.output, rep.outputSize = "", 0
+                return
+            }
+        }
+        if process.control.TidyUp || len(process.rmActions) != 0 {
+            if err = formatRewriteDiff( path, process.output, rep ); err != nil {
+                return
+            }
+        }
+        if process.selftest {
+            if err = selftestRoundtrip( path, process.output, jpg,
+                                        process ); err != nil {
+                return
+            }
+        }
+    }
+    if process.signKey != nil && rawErr == nil {
+        if process.output != "" {
+            err = signFile( process.output, true, process.signKey )
+            if info, serr := os.Stat( process.output ); serr == nil {
+                rep.outputSize = int(info.Size())
+            }
+        } else {
+            err = signFile( path, false, process.signKey )
+        }
         if err != nil {
-            fmt.Printf( "jpegcheck: %v", err )
             return
         }
-
-        err = processSave( jpg, process )
-        if err != nil {
-            fmt.Printf( "jpegcheck: %v", err )
+    }
+    if process.undo != "" && process.output != "" {
+        var change string
+        if change, err = saveUndoPatch( path, process.output,
+                                        process.undo ); err != nil {
             return
         }
-        err = processRemove( jpg, process )
+        fmt.Printf( "%s\n", change )
+    }
+/*
+    if err == nil {
+        _, err = jpg.FormatFrameComponent( os.Stdout, 0, -1 )
         if err != nil {
-            fmt.Printf( "jpegcheck: %v", err )
             return
         }
-
-        actualL, dataL := jpg.GetActualLengths()
-        fmt.Printf( "Actual JPEG length: %d (original data length: %d)\n", actualL, dataL )
-
-        if process.output != "" {
-            fmt.Printf( "Generating a copy as '%s'\n", process.output )
-            var n int
-            n, err = jpg.Write( process.output )
+    }
+*/
+    if process.sPicture.path != "" {
+        var orientation *jpeg.Orientation
+        if process.sPicture.row0 == 0 && process.sPicture.col0 == 0 {
+            orientation, err = jpg.GetImageOrientation()
             if err != nil {
-                fmt.Printf( "jpegcheck: %v", err )
-                return
+                fmt.Printf( "Warning: no tiff/exif orientation specified: %v", err )
             } else {
-                fmt.Printf( "jpegcheck: written %d bytes\n", n )
+                fmt.Printf( "jpegcheck: save picture using tiff/exif orientation:\n" )
+                fmt.Printf( "  Source app%d Row 0 at %s, Column 0 at %s (effect: %s)\n",
+                            orientation.AppSource,
+                            sideEnum( orientation.Row0 ).description,
+                            sideEnum( orientation.Col0 ).description,
+                            effectEnum( orientation.Effect ).description )
             }
+        } else {
+            orientation = new(jpeg.Orientation)
+            orientation.Row0 = process.sPicture.row0
+            orientation.Col0 = process.sPicture.col0
         }
-/*
-        if err == nil {
-            _, err = jpg.FormatFrameComponent( os.Stdout, 0, -1 )
-            if err != nil {
-                fmt.Printf( "jpegcheck: %v", err )
-                return
+        var nc, nr uint
+        var n int
+        bw := process.sPicture.bw && ! process.gray.fromRGB()
+        switch {
+        case process.sPicture.cmyk && rep.colorSpace != "CMYK" &&
+             rep.colorSpace != "YCCK":
+            err = fmt.Errorf( "CMYK format for a %s picture\n",
+                              rep.colorSpace )
+        case extendedPrecision( rep ):  // not handled by the library
+            var raw []byte
+            if raw, err = inputData( path, data ); err == nil {
+                nc, nr, n, err = saveExtendedPicture( process, raw,
+                                            orientationValue( orientation ),
+                                            rep )
+            }
+        case rep.colorSpace == "RGB" || rep.colorSpace == "CMYK" ||
+             rep.colorSpace == "YCCK":  // not handled by the library
+            var raw []byte
+            if raw, err = inputData( path, data ); err == nil {
+                fmt.Printf( "jpegcheck: decoding %s picture with the " +
+                            "standard decoder\n", rep.colorSpace )
+                nc, nr, n, err = saveConvertedPicture( process.sPicture.path,
+                                                       raw, bw,
+                                                       process.sPicture.cmyk,
+                                                       orientation )
             }
+        case len(rep.structure) > 0 &&
+             rep.structure[0].marker == markerSOF0 + 2:
+            var raw []byte      // not handled by the library with restarts
+            if raw, err = inputData( path, data ); err == nil {
+                nc, nr, n, err = saveReconstructedPicture(
+                                            process.sPicture.path, raw, bw,
+                                            orientation )
+            }
+        default:
+            nc, nr, n, err = jpg.SaveRawPicture(process.sPicture.path,
+                                                bw, orientation)
         }
-*/
-        if process.sPicture.path != "" {
-            var orientation *jpeg.Orientation
-            if process.sPicture.row0 == 0 && process.sPicture.col0 == 0 {
-                orientation, err = jpg.GetImageOrientation()
-                if err != nil {
-                    fmt.Printf( "Warning: no tiff/exif orientation specified: %v", err )
-                } else {
-                    fmt.Printf( "jpegcheck: save picture using tiff/exif orientation:\n" )
-                    side := []string { "Left", "Top", "Right", "Bottom" }
-                    effect := []string {
-                            "None", "VerticalMirror", "Rotate90",
-                            "VerticalMirrorRotate90", "HorizontalMirror",
-                            "Rotate180", "HorizontalMirrorRotate90", "Rotate270" }
-                    fmt.Printf( "  Source app%d Row 0 at %s, Column 0 at %s (effect: %s)\n",
-                                orientation.AppSource, 
-                                side[orientation.Row0], side[orientation.Col0],
-                                effect[orientation.Effect] )
+        if err != nil {
+            return fmt.Errorf( "save picture: %v", err )
+        }
+        fmt.Printf( "Saved %s as nCols=%d nRows=%d size %d\n",
+                    process.sPicture.path, nc, nr, n )
+        if process.sPicture.bw {
+            if process.gray.fromRGB() {
+                if err = grayRawPicture( process.sPicture.path, int(nc),
+                                         int(nr), n, process.gray ); err != nil {
+                    return
                 }
-            } else {
-                orientation = new(jpeg.Orientation)
-                orientation.Row0 = process.sPicture.row0
-                orientation.Col0 = process.sPicture.col0
             }
-            var nc, nr uint
-            var n int
-            nc, nr, n, err = jpg.SaveRawPicture(process.sPicture.path,
-                                                process.sPicture.bw, orientation)
-            if err != nil {
-                fmt.Printf( "jpegcheck: save picture: %v", err )
-            } else {
-                fmt.Printf( "Saved %s as nCols=%d nRows=%d size %d\n",
-                            process.sPicture.path, nc, nr, n )
+            rep.addMessage( infoSeverity, codeSpict, "spict: grayscale from " +
+                                          process.gray.description )
+        }
+        if process.resize != nil {
+            var w, h int
+            if w, h, n, err = resizeRawPicture( process.sPicture.path,
+                                                int(nc), int(nr), n,
+                                                process.resize ); err != nil {
+                return
             }
+            nc, nr = uint(w), uint(h)
         }
+        if process.stamp != nil {
+            if err = stampRawPicture( process.sPicture.path, int(nc), int(nr),
+                                      n, process.stamp ); err != nil {
+                return
+            }
+        }
+    }
+    writing = false
+    return rawErr
+}
+
+func main() {
+
+    if len(os.Args) > 1 && os.Args[1] == "bench" {
+        os.Exit( bench( os.Args[2:] ) )
+    }
+    if len(os.Args) > 1 && os.Args[1] == "gen-testset" {
+        os.Exit( genTestset( os.Args[2:] ) )
+    }
+    if len(os.Args) > 1 && os.Args[1] == "make" {
+        os.Exit( makePicture( os.Args[2:] ) )
+    }
+    if len(os.Args) > 1 && os.Args[1] == "disassemble" {
+        os.Exit( disassemble( os.Args[2:] ) )
+    }
+    if len(os.Args) > 1 && os.Args[1] == "assemble" {
+        os.Exit( assemble( os.Args[2:] ) )
+    }
+    if len(os.Args) > 1 && os.Args[1] == "undo" {
+        os.Exit( undo( os.Args[2:] ) )
+    }
+    process, err := getArgs()
+    if err != nil {
+        fmt.Printf( "jpegcheck: %v", err )
+        os.Exit( 2 )
+    }
+    if processBatch( process ) > 0 {
+        os.Exit( 1 )
     }
 }
@@ -0,0 +1,240 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "os"
+    "strings"
+
+    "github.com/jrm-1535/jpeg"
+)
+
+// A journal records the outcome of each file checked in a batch, one line per
+// file made of the status (valid or failed), a tab, the report of the file in
+// json, a tab and the file path. Lines are appended as soon as a file has been
+// processed, so that an interrupted batch can be resumed later, skipping the
+// files that were already checked. The status is the final outcome of the
+// file, including a checksum mismatch, and the report is replayed in the
+// machine readable reports of the resumed batch.
+
+const (
+    journalValid    = "valid"
+    journalFailed   = "failed"
+)
+
+// journalMessage is a reportMessage, in json. The citation is found again
+// from the text.
+type journalMessage struct {
+    Severity        severity    `json:"severity"`
+    Code            string      `json:"code"`
+    Text            string      `json:"text"`
+    Offset          int64       `json:"offset"`
+    Frame           int         `json:"frame"`
+}
+
+// journalFrame is a frameEntry, in json
+type journalFrame struct {
+    Marker          byte        `json:"marker"`
+    Offset          int         `json:"offset"`
+    Precision       int         `json:"precision"`
+    Width           int         `json:"width"`
+    Height          int         `json:"height"`
+    Components      []byte      `json:"components"`
+    H               []int       `json:"h"`
+    V               []int       `json:"v"`
+    Tq              []int       `json:"tq"`
+    Scans           int         `json:"scans"`
+}
+
+// journalExposure is an exposureInfo, in json
+type journalExposure struct {
+    Histogram       [256]int    `json:"histogram"`
+    MeanLuma        float64     `json:"meanLuma"`
+    Highlights      float64     `json:"highlights"`
+    Shadows         float64     `json:"shadows"`
+    Flags           []string    `json:"flags,omitempty"`
+}
+
+// journalSharpness is a sharpnessInfo, in json
+type journalSharpness struct {
+    Variance        float64     `json:"variance"`
+    Blurred         bool        `json:"blurred"`
+}
+
+// journalReport is what a fileReport tells about the analysis of a file, in
+// json. The path, size and modification time are found again from the file.
+type journalReport struct {
+    Complete        bool                `json:"complete"`
+    Framing         jpeg.Framing        `json:"framing"`
+    Frames          []*jpeg.FrameInfo   `json:"frames,omitempty"`
+    Structure       []journalFrame      `json:"structure,omitempty"`
+    ColorSpace      string              `json:"colorSpace,omitempty"`
+    Exposure        *journalExposure    `json:"exposure,omitempty"`
+    Sharpness       *journalSharpness   `json:"sharpness,omitempty"`
+    Messages        []journalMessage    `json:"messages,omitempty"`
+    Output          string              `json:"output,omitempty"`
+    OutputSize      int                 `json:"outputSize,omitempty"`
+    Changes         []string            `json:"changes,omitempty"`
+    Analysis        *jsonAnalysis       `json:"analysis,omitempty"`
+    Text            []string            `json:"text,omitempty"`
+}
+
+func newJournalReport( rep *fileReport ) *journalReport {
+    jr := &journalReport{ Complete: rep.complete, Framing: rep.framing,
+                          Frames: rep.frames, ColorSpace: rep.colorSpace,
+                          Output: rep.output, OutputSize: rep.outputSize,
+                          Changes: rep.changes, Analysis: rep.analysis,
+                          Text: rep.text }
+    for _, fe := range rep.structure {
+        jr.Structure = append( jr.Structure, journalFrame{
+                        Marker: fe.marker, Offset: fe.offset,
+                        Precision: fe.precision, Width: fe.width,
+                        Height: fe.height, Components: fe.components,
+                        H: fe.h, V: fe.v, Tq: fe.tq, Scans: fe.scans } )
+    }
+    if e := rep.exposure; e != nil {
+        jr.Exposure = &journalExposure{ Histogram: e.histogram,
+                                        MeanLuma: e.meanLuma,
+                                        Highlights: e.highlights,
+                                        Shadows: e.shadows, Flags: e.flags }
+    }
+    if s := rep.sharpness; s != nil {
+        jr.Sharpness = &journalSharpness{ Variance: s.variance,
+                                          Blurred: s.blurred }
+    }
+    for _, m := range rep.messages {
+        jr.Messages = append( jr.Messages, journalMessage{
+                        Severity: m.severity, Code: m.code, Text: m.text,
+                        Offset: m.offset, Frame: m.frame } )
+    }
+    return jr
+}
+
+// restore sets in rep the analysis recorded in the journal, except for the
+// messages with a code in skip
+func (jr *journalReport) restore( rep *fileReport, skip ...string ) {
+    rep.complete, rep.framing = jr.Complete, jr.Framing
+    rep.frames, rep.colorSpace = jr.Frames, jr.ColorSpace
+    rep.output, rep.outputSize = jr.Output, jr.OutputSize
+    rep.changes, rep.analysis = jr.Changes, jr.Analysis
+    rep.text = append( jr.Text, rep.text... )
+    for _, f := range jr.Structure {
+        rep.structure = append( rep.structure, &frameEntry{
+                        marker: f.Marker, offset: f.Offset,
+                        precision: f.Precision, width: f.Width,
+                        height: f.Height, components: f.Components,
+                        h: f.H, v: f.V, tq: f.Tq, scans: f.Scans } )
+    }
+    if e := jr.Exposure; e != nil {
+        rep.exposure = &exposureInfo{ histogram: e.Histogram,
+                                      meanLuma: e.MeanLuma,
+                                      highlights: e.Highlights,
+                                      shadows: e.Shadows, flags: e.Flags }
+    }
+    if s := jr.Sharpness; s != nil {
+        rep.sharpness = &sharpnessInfo{ variance: s.Variance,
+                                        blurred: s.Blurred }
+    }
+next:
+    for _, m := range jr.Messages {
+        for _, code := range skip {
+            if m.Code == code {
+                continue next
+            }
+        }
+        rep.messages = append( rep.messages, reportMessage{ m.Severity,
+                                    m.Text, citeDiagnostic( m.Text ), m.Code,
+                                    m.Offset, m.Frame } )
+    }
+}
+
+// journalEntry is the outcome of a file recorded in a previous run
+type journalEntry struct {
+    failed          bool
+    report          *journalReport
+}
+
+type journal struct {
+    file            *os.File
+    done            map[string]journalEntry // path => outcome, from previous run
+}
+
+// openJournal opens the journal at path for appending. If resume is true, the
+// existing entries are loaded first, otherwise the journal is truncated.
+func openJournal( path string, resume bool ) (*journal, error) {
+    j := new( journal )
+    j.done = make( map[string]journalEntry )
+    flags := os.O_CREATE|os.O_WRONLY|os.O_APPEND
+    if resume {
+        if err := j.load( path ); err != nil {
+            return nil, err
+        }
+    } else {
+        flags |= os.O_TRUNC
+    }
+    f, err := os.OpenFile( path, flags, 0644 )
+    if err != nil {
+        return nil, fmt.Errorf( "unable to open journal %s: %v\n", path, err )
+    }
+    j.file = f
+    return j, nil
+}
+
+func (j *journal) load( path string ) error {
+    f, err := os.Open( path )
+    if err != nil {
+        if os.IsNotExist( err ) {
+            return nil      // nothing to resume
+        }
+        return fmt.Errorf( "unable to read journal %s: %v\n", path, err )
+    }
+    defer f.Close()
+    scanner := bufio.NewScanner( f )
+    scanner.Buffer( nil, 64 << 20 )     // reports may be large with -json
+    for scanner.Scan() {
+        // json never has a raw tab, the path may have some
+        fields := strings.SplitN( scanner.Text(), "\t", 3 )
+        if len(fields) != 3 {
+            continue        // incomplete line from an interrupted write
+        }
+        var entry journalEntry
+        switch fields[0] {
+        case journalValid:
+        case journalFailed: entry.failed = true
+        default:            continue
+        }
+        entry.report = new( journalReport )
+        if json.Unmarshal( []byte( fields[1] ), entry.report ) != nil {
+            continue        // incomplete report from an interrupted write
+        }
+        j.done[fields[2]] = entry
+    }
+    return scanner.Err()
+}
+
+// previous returns whether path was already checked in a previous run and in
+// that case whether it failed and its recorded report.
+func (j *journal) previous( path string ) (done, failed bool,
+                                            report *journalReport) {
+    entry, done := j.done[path]
+    return done, entry.failed, entry.report
+}
+
+// record appends the outcome and the report of a file that was just checked
+func (j *journal) record( rep *fileReport ) error {
+    status := journalValid
+    if rep.failed {
+        status = journalFailed
+    }
+    report, err := json.Marshal( newJournalReport( rep ) )
+    if err != nil {
+        return err
+    }
+    _, err = fmt.Fprintf( j.file, "%s\t%s\t%s\n", status, report, rep.path )
+    return err
+}
+
+func (j *journal) close( ) error {
+    return j.file.Close()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// reportFiles returns the files of the json report at path
+func reportFiles( t *testing.T, path string ) []jsonFile {
+    t.Helper()
+    b, err := os.ReadFile( path )
+    if err != nil {
+        t.Fatal( err )
+    }
+    var report struct {
+        Files       []jsonFile  `json:"files"`
+    }
+    if err = json.Unmarshal( b, &report ); err != nil {
+        t.Fatal( err )
+    }
+    return report.Files
+}
+
+func TestJournalResume( t *testing.T ) {
+    dir := t.TempDir()
+    var paths []string
+    for _, name := range []string{ "baseline-420.jpg", "restart-420.jpg" } {
+        path := filepath.Join( dir, name )
+        if err := os.WriteFile( path, testsetData( t, name ), 0644 ); err != nil {
+            t.Fatal( err )
+        }
+        paths = append( paths, path )
+    }
+    manifest := filepath.Join( dir, "manifest" )        // wrong checksum
+    if err := os.WriteFile( manifest, []byte( strings.Repeat( "0", 64 ) +
+                            "  " + paths[1] + "\n" ), 0644 ); err != nil {
+        t.Fatal( err )
+    }
+    jnl := filepath.Join( dir, "journal" )
+    first, resumed := filepath.Join( dir, "first.json" ),
+                      filepath.Join( dir, "resumed.json" )
+    args := []string{ "-q", "-verify-checksum=" + manifest,
+                      "-journal=" + jnl }
+    if n := processBatch( checkerArgs( t, append( args,
+                          append( []string{ "-report=" + first },
+                                  paths... )... )... ) ); n != 1 {
+        t.Fatalf( "%d files failed, expected 1", n )
+    }
+    b, err := os.ReadFile( jnl )
+    if err != nil {
+        t.Fatal( err )
+    }
+    if ! strings.HasPrefix( strings.Split( string( b ), "\n" )[1],
+                            journalFailed + "\t" ) {
+        t.Errorf( "checksum mismatch not recorded as failed: %s", b )
+    }
+    if n := processBatch( checkerArgs( t, append( args,
+                          append( []string{ "-resume", "-report=" + resumed },
+                                  paths... )... )... ) ); n != 1 {
+        t.Fatalf( "%d files failed after resuming, expected 1", n )
+    }
+    expected, replayed := reportFiles( t, first ), reportFiles( t, resumed )
+    if len(expected) != len(paths) || len(replayed) != len(expected) {
+        t.Fatalf( "%d files replayed, expected %d", len(replayed),
+                  len(expected) )
+    }
+    for i := range expected {
+        e, r := expected[i], replayed[i]
+        if r.Analysed {
+            t.Errorf( "%s analysed again", r.Path )
+        }
+        if r.Failed != e.Failed || r.Complete != e.Complete ||
+           ! reflect.DeepEqual( r.Frames, e.Frames ) ||
+           ! reflect.DeepEqual( r.Messages, e.Messages ) {
+            t.Errorf( "%s: replayed %+v, expected %+v", r.Path, r, e )
+        }
+    }
+}
+
+func TestJournalLoad( t *testing.T ) {
+    tests := []struct {
+        name    string
+        line    string
+        path    string          // "" if the line is ignored
+        failed  bool
+    }{
+        { "valid", "valid\t{}\ta.jpg", "a.jpg", false },
+        { "failed", "failed\t{}\ta.jpg", "a.jpg", true },
+        { "path with brace", "valid\t{}\t{b}.jpg", "{b}.jpg", false },
+        { "path with tab", "failed\t{}\tc\td.jpg", "c\td.jpg", true },
+        { "status and path only", "valid\t{x}.jpg", "", false },
+        { "interrupted report", "valid\t{\"complete\":", "", false },
+        { "unknown status", "done\t{}\ta.jpg", "", false },
+    }
+    for _, tt := range tests {
+        t.Run( tt.name, func( t *testing.T ) {
+            path := filepath.Join( t.TempDir(), "journal" )
+            if err := os.WriteFile( path, []byte( tt.line + "\n" ),
+                                    0644 ); err != nil {
+                t.Fatal( err )
+            }
+            j := &journal{ done: make( map[string]journalEntry ) }
+            if err := j.load( path ); err != nil {
+                t.Fatal( err )
+            }
+            if tt.path == "" {
+                if len(j.done) != 0 {
+                    t.Errorf( "line accepted: %v", j.done )
+                }
+                return
+            }
+            done, failed, report := j.previous( tt.path )
+            if ! done || failed != tt.failed || report == nil {
+                t.Errorf( "%q: done %v, failed %v, report %v", tt.path,
+                          done, failed, report )
+            }
+        } )
+    }
+}
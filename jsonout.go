@@ -0,0 +1,157 @@
+
+package main
+
+import (
+    "io"
+    "os"
+    "strings"
+)
+
+// JSON output (-json): the analysis of each file is written to stdout as a
+// single json document instead of text, for tools that would otherwise scrape
+// the human readable output. Each file is given as in the json report (see
+// jsonreport.go), with in addition the structure found in the raw data: the
+// markers with their offsets and lengths, the frame header, the quantization
+// and Huffman tables and all metadata (as with -meta-json). The text that the
+// requested options would print is not lost but given line by line in the
+// text member of each file, so that any option can be combined with -json.
+// Text printed after the last file, such as the batch summary, is dropped.
+
+type jsonMarker struct {
+    Marker          string      `json:"marker"`
+    Offset          int         `json:"offset"`
+    Length          int         `json:"length"`
+    Ecs             int         `json:"ecs,omitempty"`  // entropy-coded bytes
+}
+
+type jsonComponent struct {
+    Id              int         `json:"id"`
+    Horizontal      int         `json:"horizontalSampling"`
+    Vertical        int         `json:"verticalSampling"`
+    Quantization    int         `json:"quantizationTable"`
+}
+
+type jsonFrameHeader struct {
+    Marker          string      `json:"marker"`
+    Precision       int         `json:"precision"`
+    Width           int         `json:"width"`
+    Height          int         `json:"height"`
+    Subsampling     string      `json:"subsampling"`    // enum
+    ColorSpace      string      `json:"colorSpace"`     // enum
+    Components      []jsonComponent `json:"components"`
+}
+
+type jsonQuantTable struct {
+    Destination     int         `json:"destination"`
+    Precision       int         `json:"precision"`      // bits
+    Values          []int       `json:"values"`         // natural order
+}
+
+type jsonAnalysis struct {
+    Framing         string      `json:"framing,omitempty"`
+    Markers         []jsonMarker `json:"markers"`
+    RestartMarkers  int         `json:"restartMarkers,omitempty"`
+    Frame           *jsonFrameHeader `json:"frameHeader,omitempty"`
+    Orientation     *jsonOrientation `json:"orientation"`
+    Quantization    []jsonQuantTable `json:"quantizationTables,omitempty"`
+    Huffman         []huffTableText `json:"huffmanTables,omitempty"`
+    Metadata        []metaContainer `json:"metadata,omitempty"`
+}
+
+// newJsonAnalysis returns the structure found in the raw data of a file
+func newJsonAnalysis( data []byte, l *fileLayout ) *jsonAnalysis {
+    a := &jsonAnalysis{ Markers: []jsonMarker{},
+                        Orientation: newJsonOrientation( exifOrientation( data,
+                                                                          l ) ) }
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.marker >= markerRST0 && s.marker <= markerRST7 {
+            a.RestartMarkers ++
+            continue
+        }
+        m := jsonMarker{ Marker: markerName( s.marker ), Offset: s.offset,
+                         Length: s.length }
+        if s.ecsEnd > 0 {
+            m.Ecs = s.ecsEnd - s.end()
+        }
+        a.Markers = append( a.Markers, m )
+        if a.Frame == nil && isSOF( s.marker ) {
+            if fh, err := parseFrameHeader( s, data ); err == nil {
+                a.Frame = &jsonFrameHeader{ Marker: markerName( fh.marker ),
+                                            Precision: fh.precision,
+                                            Width: fh.width, Height: fh.height }
+                var h, v []int
+                for _, c := range fh.comps {
+                    a.Frame.Components = append( a.Frame.Components,
+                                    jsonComponent{ Id: int(c.id),
+                                                   Horizontal: c.h,
+                                                   Vertical: c.v,
+                                                   Quantization: c.tq } )
+                    h, v = append( h, c.h ), append( v, c.v )
+                }
+                a.Frame.Subsampling = subsamplingEnum( h, v )
+                if cs, ok := fileColorSpace( data, l ); ok {
+                    a.Frame.ColorSpace = cs.name
+                }
+            }
+        }
+    }
+    if tables, err := quantTablesInForce( data, l ); err == nil {
+        for d, qt := range tables {
+            if qt == nil {
+                continue
+            }
+            jq := jsonQuantTable{ Destination: d, Precision: 8,
+                                  Values: make( []int, 64 ) }
+            if qt.precision != 0 {
+                jq.Precision = 16
+            }
+            for k, v := range qt.values {
+                jq.Values[zigZag[k]] = int(v)
+            }
+            a.Quantization = append( a.Quantization, jq )
+        }
+    }
+    a.Huffman, _ = huffTableDefinitions( data, l )
+    a.Metadata = collectMetadata( data, l )
+    return a
+}
+
+// stdoutCapture redirects the standard output to a temporary file while the
+// files are checked, so that the text printed for each file can be taken and
+// added to its json output.
+type stdoutCapture struct {
+    stdout          *os.File    // actual standard output
+    tmp             *os.File
+}
+
+func newStdoutCapture( ) (*stdoutCapture, error) {
+    tmp, err := os.CreateTemp( "", "jcheck-json-*" )
+    if err != nil {
+        return nil, err
+    }
+    c := &stdoutCapture{ stdout: os.Stdout, tmp: tmp }
+    os.Stdout = tmp
+    return c, nil
+}
+
+// take returns the lines printed since the previous call
+func (c *stdoutCapture) take( ) []string {
+    if _, err := c.tmp.Seek( 0, io.SeekStart ); err != nil {
+        return nil
+    }
+    b, err := io.ReadAll( c.tmp )
+    c.tmp.Truncate( 0 )
+    c.tmp.Seek( 0, io.SeekStart )
+    if err != nil || len(b) == 0 {
+        return nil
+    }
+    return strings.Split( strings.TrimRight( string(b), "\n" ), "\n" )
+}
+
+// restore gives back the actual standard output
+func (c *stdoutCapture) restore( ) {
+    os.Stdout = c.stdout
+    c.tmp.Close()
+    os.Remove( c.tmp.Name() )
+}
@@ -0,0 +1,206 @@
+
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "os"
+    "time"
+)
+
+// JSON report: the same information as the xml report in a form easier to
+// consume by scripts, including the audit of any modified copy written with
+// -o, so that a single run yields both the repaired file and its report.
+
+type jsonMessage struct {
+    Severity        string      `json:"severity"`
+    Code            string      `json:"code"`
+    Offset          *int64      `json:"offset,omitempty"`
+    Text            string      `json:"text"`
+    Reference       string      `json:"reference,omitempty"`
+}
+
+type jsonFrame struct {
+    EncodingMode    string      `json:"encodingMode"`
+    EntropyCoding   string      `json:"entropyCoding"`
+    SamplePrecision uint        `json:"samplePrecision"`
+    Width           uint        `json:"width"`
+    Height          uint        `json:"height"`
+    Components      int         `json:"components"`
+    Subsampling     string      `json:"subsampling,omitempty"`  // enum
+    ColorSpace      string      `json:"colorSpace,omitempty"`   // enum
+    Marker          string      `json:"marker,omitempty"`
+    Offset          *int        `json:"offset,omitempty"`
+    Scans           *int        `json:"scans,omitempty"`
+    Messages        []jsonMessage `json:"messages,omitempty"`
+}
+
+type jsonOutput struct {
+    Path            string      `json:"path"`
+    Size            int         `json:"size"`
+    Changes         []string    `json:"changes,omitempty"`
+}
+
+type jsonExposure struct {
+    MeanLuma        float64     `json:"meanLuma"`
+    Highlights      float64     `json:"clippedHighlights"`     // percent
+    Shadows         float64     `json:"clippedShadows"`        // percent
+    Flags           []string    `json:"flags"`      // highlights, shadows
+}
+
+type jsonSharpness struct {
+    Variance        float64     `json:"laplacianVariance"`
+    Blurred         bool        `json:"blurred"`
+}
+
+type jsonFile struct {
+    Path            string      `json:"path"`
+    Size            int64       `json:"size"`
+    LastModified    string      `json:"lastModified,omitempty"`
+    Status          string      `json:"status"`
+    Analysed        bool        `json:"analysed"`
+    Complete        bool        `json:"complete"`
+    Failed          bool        `json:"failed"`
+    Frames          []jsonFrame `json:"frames,omitempty"`
+    Messages        []jsonMessage `json:"messages,omitempty"`
+    Exposure        *jsonExposure `json:"exposure,omitempty"`  // -exposure-check
+    Sharpness       *jsonSharpness `json:"sharpness,omitempty"` // -blur-check
+    Output          *jsonOutput `json:"output,omitempty"`
+    Analysis        *jsonAnalysis `json:"analysis,omitempty"`    // -json
+    Text            []string    `json:"text,omitempty"`        // -json
+}
+
+func newJsonFile( rep *fileReport ) *jsonFile {
+    jf := &jsonFile{ Path: rep.path, Size: rep.size, Status: xmlStatus( rep ),
+                     Analysed: rep.analysed, Complete: rep.complete,
+                     Failed: rep.failed }
+    if ! rep.modified.IsZero() {
+        jf.LastModified = rep.modified.Format( time.RFC3339 )
+    }
+    for _, fi := range rep.frames {
+        jf.Frames = append( jf.Frames, jsonFrame{
+                        EncodingMode: encodingModeName( fi.Mode ),
+                        EntropyCoding: entropyCodingName( fi.Entropy ),
+                        SamplePrecision: fi.SampleSize,
+                        Width: fi.Width, Height: fi.Height,
+                        Components: len(fi.Components) } )
+    }
+    for i, f := range rep.structure {   // frames unknown to the library
+        if i >= len(jf.Frames) {
+            jf.Frames = append( jf.Frames, jsonFrame{
+                        EncodingMode: f.encodingMode(),
+                        EntropyCoding: f.entropyCoding(),
+                        SamplePrecision: uint(f.precision),
+                        Width: uint(f.width), Height: uint(f.height),
+                        Components: len(f.components) } )
+        }
+        offset, scans := f.offset, f.scans
+        jf.Frames[i].Marker = markerName( f.marker )
+        jf.Frames[i].Offset, jf.Frames[i].Scans = &offset, &scans
+        jf.Frames[i].Subsampling = subsamplingEnum( f.h, f.v )
+    }
+    if len(jf.Frames) > 0 {
+        jf.Frames[0].ColorSpace = rep.colorSpace
+    }
+    if ei := rep.exposure; ei != nil {
+        jf.Exposure = &jsonExposure{ MeanLuma: ei.meanLuma,
+                                     Highlights: ei.highlights,
+                                     Shadows: ei.shadows,
+                                     Flags: append( []string{ }, ei.flags... ) }
+    }
+    if si := rep.sharpness; si != nil {
+        jf.Sharpness = &jsonSharpness{ Variance: si.variance,
+                                       Blurred: si.blurred }
+    }
+    for _, m := range rep.messages {
+        jm := jsonMessage{ Severity: m.severity.String(), Code: m.code,
+                           Text: m.text }
+        if m.offset >= 0 {
+            offset := m.offset
+            jm.Offset = &offset
+        }
+        if m.cite != nil {
+            jm.Reference = m.cite.String()
+        }
+        if m.frame >= 0 && m.frame < len(jf.Frames) {   // grouped by frame
+            jf.Frames[m.frame].Messages = append(
+                                        jf.Frames[m.frame].Messages, jm )
+            continue
+        }
+        jf.Messages = append( jf.Messages, jm )
+    }
+    if rep.output != "" {
+        jf.Output = &jsonOutput{ Path: rep.output, Size: rep.outputSize,
+                                 Changes: rep.changes }
+    }
+    if rep.analysis != nil {
+        jf.Analysis = rep.analysis
+        if len(rep.frames) > 0 {
+            jf.Analysis.Framing = framingName( rep.framing )
+        }
+    }
+    jf.Text = rep.text
+    return jf
+}
+
+type jsonReport struct {
+    f               *os.File
+    n               int         // number of files already in report
+    stdout          bool        // written to stdout (-json), not closed
+}
+
+func newJsonReport( path string, process *jpgArgs ) (*jsonReport, error) {
+    f, err := os.OpenFile( path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644 )
+    if err != nil {
+        return nil, fmt.Errorf( "unable to create json report %s: %v\n",
+                                path, err )
+    }
+    return startJsonReport( f, process ), nil
+}
+
+// startJsonReport writes the report header into f
+func startJsonReport( f *os.File, process *jpgArgs ) *jsonReport {
+    fmt.Fprintf( f, "{\n  \"tool\": \"jcheck\",\n  \"release\": %q,\n", VERSION )
+    if now, ok := process.outputTime(); ok {
+        fmt.Fprintf( f, "  \"date\": %q,\n", now.Format( time.RFC3339 ) )
+    }
+    fmt.Fprintf( f, "  \"files\": [" )
+    return &jsonReport{ f: f }
+}
+
+func (jr *jsonReport) name( ) string {
+    if jr.stdout {
+        return "json output"
+    }
+    return "json report"
+}
+
+func (jr *jsonReport) add( rep *fileReport ) error {
+    var b bytes.Buffer
+    enc := json.NewEncoder( &b )
+    enc.SetEscapeHTML( false )
+    enc.SetIndent( "    ", "  " )
+    if err := enc.Encode( newJsonFile( rep ) ); err != nil {
+        return err
+    }
+    sep := ",\n    "
+    if jr.n == 0 {
+        sep = "\n    "
+    }
+    jr.n ++
+    _, err := fmt.Fprintf( jr.f, "%s%s", sep, bytes.TrimRight( b.Bytes(), "\n" ) )
+    return err
+}
+
+func (jr *jsonReport) close( ) error {
+    _, err := fmt.Fprintf( jr.f, "\n  ]\n}\n" )
+    if jr.stdout {
+        return err
+    }
+    if err != nil {
+        jr.f.Close()
+        return err
+    }
+    return jr.f.Close()
+}
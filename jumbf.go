@@ -0,0 +1,346 @@
+
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// JUMBF (ISO/IEC 19566-5) boxes in APP11 segments: a JUMBF superbox can be
+// split over several APP11 segments, each starting with the common identifier
+// "JP", a box instance number and a packet sequence number. Segments after
+// the first one repeat the header of the superbox, which must be skipped when
+// the box is reassembled.
+
+type jumbfStore struct {
+    instance        uint16
+    segments        []*segment  // in sequence order
+    data            []byte      // reassembled superbox
+    problems        []string
+}
+
+// jumbfStores returns the JUMBF superboxes found in APP11 segments, in the
+// order of their first segment
+func jumbfStores( data []byte, l *fileLayout ) (stores []*jumbfStore) {
+    type packet struct {
+        seq         uint32
+        s           *segment
+        payload     []byte
+    }
+    packets := make( map[uint16][]packet )
+    var order []uint16
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.marker == markerEOI {
+            break
+        }
+        d := s.data( data )
+        if s.marker != markerAPP0 + 11 || len(d) < 8 ||
+           ! bytes.HasPrefix( d, []byte( "JP" ) ) {
+            continue
+        }
+        en := binary.BigEndian.Uint16( d[2:] )
+        if _, ok := packets[en]; ! ok {
+            order = append( order, en )
+        }
+        packets[en] = append( packets[en], packet{
+                                binary.BigEndian.Uint32( d[4:] ), s, d[8:] } )
+    }
+    for _, en := range order {
+        ps := packets[en]
+        sort.SliceStable( ps, func( i, j int ) bool {
+            return ps[i].seq < ps[j].seq
+        })
+        st := &jumbfStore{ instance: en }
+        for i, p := range ps {
+            st.segments = append( st.segments, p.s )
+            if p.seq != uint32(i + 1) {
+                st.problems = append( st.problems, fmt.Sprintf(
+                        "APP11 @0x%x: packet sequence %d, expected %d",
+                        p.s.offset, p.seq, i + 1 ) )
+            }
+            payload := p.payload
+            if i > 0 {                  // skip repeated superbox header
+                header := 8
+                if len(st.data) >= 8 &&
+                   binary.BigEndian.Uint32( st.data ) == 1 {
+                    header = 16         // XLBox
+                }
+                if len(payload) < header {
+                    st.problems = append( st.problems, fmt.Sprintf(
+                            "APP11 @0x%x: packet too short", p.s.offset ) )
+                    continue
+                }
+                payload = payload[header:]
+            }
+            st.data = append( st.data, payload... )
+        }
+        stores = append( stores, st )
+    }
+    return
+}
+
+// jumbfDesc is the content of a JUMBF description box (jumd)
+type jumbfDesc struct {
+    uuid            [16]byte
+    toggles         byte
+    label           string
+    id              uint32
+    hasId           bool
+}
+
+// typeName returns the 4 character code at the start of the description UUID,
+// such as c2pa or cbor, if it is printable
+func (jd *jumbfDesc) typeName( ) string {
+    for _, c := range jd.uuid[:4] {
+        if c < 0x20 || c > 0x7e {
+            return fmt.Sprintf( "%x", jd.uuid )
+        }
+    }
+    return string( jd.uuid[:4] )
+}
+
+type jumbfBox struct {
+    typ             string      // box type, such as jumb, jumd or cbor
+    offset          int         // offset in the reassembled store
+    length          int
+    raw             []byte      // whole box, header included
+    payload         []byte      // content after the box header
+    desc            *jumbfDesc  // for jumb superboxes
+    children        []*jumbfBox
+}
+
+func parseJumbfDesc( b []byte ) (*jumbfDesc, error) {
+    if len(b) < 17 {
+        return nil, fmt.Errorf( "description box too short\n" )
+    }
+    jd := &jumbfDesc{ toggles: b[16] }
+    copy( jd.uuid[:], b[:16] )
+    b = b[17:]
+    if jd.toggles & 0x02 != 0 {
+        end := bytes.IndexByte( b, 0 )
+        if end == -1 {
+            return nil, fmt.Errorf( "unterminated description label\n" )
+        }
+        jd.label, b = string( b[:end] ), b[end+1:]
+    }
+    if jd.toggles & 0x04 != 0 {
+        if len(b) < 4 {
+            return nil, fmt.Errorf( "description box too short for id\n" )
+        }
+        jd.id, jd.hasId = binary.BigEndian.Uint32( b ), true
+    }
+    return jd, nil
+}
+
+// parseJumbfBoxes returns the boxes found in b, starting at offset base in the
+// store, with the content of superboxes parsed recursively
+func parseJumbfBoxes( b []byte, base int ) (boxes []*jumbfBox, err error) {
+    for pos := 0; pos < len(b); {
+        if len(b) - pos < 8 {
+            return boxes, fmt.Errorf( "truncated box header @%d\n", base + pos )
+        }
+        length := int( binary.BigEndian.Uint32( b[pos:] ) )
+        header := 8
+        switch length {
+        case 0:                         // up to the end
+            length = len(b) - pos
+        case 1:
+            if len(b) - pos < 16 {
+                return boxes, fmt.Errorf( "truncated box header @%d\n",
+                                          base + pos )
+            }
+            xl := binary.BigEndian.Uint64( b[pos+8:] )
+            if xl > uint64(len(b) - pos) {
+                return boxes, fmt.Errorf( "box @%d goes beyond its container\n",
+                                          base + pos )
+            }
+            length, header = int(xl), 16
+        }
+        if length < header || length > len(b) - pos {
+            return boxes, fmt.Errorf( "invalid box length %d @%d\n", length,
+                                      base + pos )
+        }
+        box := &jumbfBox{ typ: string( b[pos+4:pos+8] ), offset: base + pos,
+                          length: length, raw: b[pos:pos+length],
+                          payload: b[pos+header:pos+length] }
+        boxes = append( boxes, box )
+        if box.typ == "jumb" {
+            box.children, err = parseJumbfBoxes( box.payload,
+                                                 box.offset + header )
+            if len(box.children) > 0 && box.children[0].typ == "jumd" {
+                d, derr := parseJumbfDesc( box.children[0].payload )
+                if err == nil {
+                    err = derr
+                }
+                box.desc = d
+            }
+            if err != nil {
+                return boxes, err
+            }
+        }
+        pos += length
+    }
+    return
+}
+
+// child returns the first superbox in box with the given description label
+func (box *jumbfBox) child( label string ) *jumbfBox {
+    for _, c := range box.children {
+        if c.desc != nil && c.desc.label == label {
+            return c
+        }
+    }
+    return nil
+}
+
+// content returns the first content box (not a description) in a superbox
+func (box *jumbfBox) content( ) *jumbfBox {
+    for _, c := range box.children {
+        if c.typ != "jumd" {
+            return c
+        }
+    }
+    return nil
+}
+
+// Box tree (-jumbf and -sjumbf): boxes are identified by their path in the
+// tree, made of 1-based indexes separated by dots. Top level boxes are numbered
+// across all stores, in the order of their first APP11 segment, so that 1 is
+// usually the first superbox and 1.2 its second child (the first child being
+// its description box).
+
+// isJumbfBoxId returns true if id is a valid box path, such as 1.2.3
+func isJumbfBoxId( id string ) bool {
+    if id == "" {
+        return false
+    }
+    for _, n := range strings.Split( id, "." ) {
+        if v, err := strconv.ParseUint( n, 10, 16 ); err != nil || v == 0 {
+            return false
+        }
+    }
+    return true
+}
+
+// jumbfContentType returns a short description of well-known content boxes
+func jumbfContentType( typ string ) string {
+    switch typ {
+    case "jumd":    return "description"
+    case "json":    return "JSON"
+    case "cbor":    return "CBOR"
+    case "xml ":    return "XML"
+    case "jp2c":    return "JPEG 2000 codestream"
+    case "uuid":    return "UUID"
+    case "bfdb":    return "embedded file description"
+    case "bidb":    return "embedded file"
+    case "c2sh":    return "salt hash"
+    }
+    return ""
+}
+
+type jumbfTopBox struct {
+    store           *jumbfStore
+    box             *jumbfBox
+}
+
+// jumbfTree returns the top level boxes of all JUMBF stores in data, with the
+// problems found while parsing them
+func jumbfTree( data []byte, l *fileLayout ) (top []jumbfTopBox,
+                                              problems []string) {
+    for _, st := range jumbfStores( data, l ) {
+        problems = append( problems, st.problems... )
+        boxes, err := parseJumbfBoxes( st.data, 0 )
+        if err != nil {
+            problems = append( problems, fmt.Sprintf( "store %d: %s",
+                               st.instance, strings.TrimSpace( err.Error() ) ) )
+        }
+        for _, b := range boxes {
+            top = append( top, jumbfTopBox{ st, b } )
+        }
+    }
+    return
+}
+
+func formatJumbfBox( id string, box *jumbfBox, depth int ) {
+    fmt.Printf( "  %s%s %s @%d, %d bytes", strings.Repeat( "  ", depth ),
+                id, box.typ, box.offset, len(box.payload) )
+    if box.desc != nil {
+        fmt.Printf( ", type %s", box.desc.typeName() )
+        if box.desc.label != "" {
+            fmt.Printf( ", label %q", box.desc.label )
+        }
+        if box.desc.hasId {
+            fmt.Printf( ", id %d", box.desc.id )
+        }
+        if box.desc.toggles & 0x01 != 0 {
+            fmt.Printf( ", requestable" )
+        }
+    } else if ct := jumbfContentType( box.typ ); ct != "" {
+        fmt.Printf( " (%s)", ct )
+    }
+    fmt.Printf( "\n" )
+    for i, c := range box.children {
+        formatJumbfBox( fmt.Sprintf( "%s.%d", id, i + 1 ), c, depth + 1 )
+    }
+}
+
+// formatJumbf prints the tree of all JUMBF boxes carried in APP11 segments,
+// and reports problems as warnings
+func formatJumbf( data []byte, l *fileLayout, rep *fileReport ) {
+    top, problems := jumbfTree( data, l )
+    if len(top) == 0 && len(problems) == 0 {
+        fmt.Printf( "No JUMBF box\n" )
+        return
+    }
+    fmt.Printf( "JUMBF boxes (offsets in the reassembled store, sizes without " +
+                "box header):\n" )
+    var store *jumbfStore
+    for i, t := range top {
+        if t.store != store {
+            store = t.store
+            fmt.Printf( " Box instance %d: %d APP11 segment(s), %d bytes\n",
+                        store.instance, len(store.segments), len(store.data) )
+        }
+        formatJumbfBox( strconv.Itoa( i + 1 ), t.box, 0 )
+    }
+    for _, p := range problems {
+        text := "JUMBF: " + p
+        fmt.Printf( "  Warning: %s\n", text )
+        rep.addMessage( warningSeverity, codeJumbf, text )
+    }
+}
+
+// saveJumbfBox saves the box identified by id: a superbox is saved as a
+// standalone JUMBF file, header included, while only the payload of a content
+// box is saved.
+func saveJumbfBox( data []byte, l *fileLayout, id, path string ) error {
+    top, _ := jumbfTree( data, l )
+    var box *jumbfBox
+    children := make( []*jumbfBox, len(top) )
+    for i, t := range top {
+        children[i] = t.box
+    }
+    for _, n := range strings.Split( id, "." ) {
+        i, _ := strconv.Atoi( n )
+        if i < 1 || i > len(children) {
+            return fmt.Errorf( "no JUMBF box %s\n", id )
+        }
+        box = children[i-1]
+        children = box.children
+    }
+    content := box.payload
+    if box.typ == "jumb" {
+        content = box.raw
+    }
+    if err := writeFile( path, content, 0644 ); err != nil {
+        return fmt.Errorf( "unable to save JUMBF box %s: %v\n", id, err )
+    }
+    fmt.Printf( "Saved JUMBF box %s (%s) as %s, %d bytes\n", id, box.typ,
+                path, len(content) )
+    return nil
+}
@@ -0,0 +1,470 @@
+
+package main
+
+import (
+    "fmt"
+)
+
+// Raw layout of a jpeg file: the library analyses segments but does not expose
+// where they are in the file, which is needed for structural statistics and
+// for locating data for security checks. This is a minimal marker scanner that
+// does not interpret segment contents, and tolerates most errors so that it
+// can describe broken files.
+
+const (
+    markerTEM   = 0x01
+    markerSOF0  = 0xc0
+    markerDHT   = 0xc4
+    markerJPG   = 0xc8
+    markerDAC   = 0xcc
+    markerRST0  = 0xd0
+    markerRST7  = 0xd7
+    markerSOI   = 0xd8
+    markerEOI   = 0xd9
+    markerSOS   = 0xda
+    markerDQT   = 0xdb
+    markerDNL   = 0xdc
+    markerDRI   = 0xdd
+    markerDHP   = 0xde
+    markerEXP   = 0xdf
+    markerAPP0  = 0xe0
+    markerAPP15 = 0xef
+    markerCOM   = 0xfe
+)
+
+func markerName( m byte ) string {
+    switch {
+    case m == markerDHT:    return "DHT"
+    case m == markerJPG:    return "JPG"
+    case m == markerDAC:    return "DAC"
+    case m >= markerSOF0 && m <= 0xcf:
+        return fmt.Sprintf( "SOF%d", m - markerSOF0 )
+    case m >= markerRST0 && m <= markerRST7:
+        return fmt.Sprintf( "RST%d", m - markerRST0 )
+    case m == markerSOI:    return "SOI"
+    case m == markerEOI:    return "EOI"
+    case m == markerSOS:    return "SOS"
+    case m == markerDQT:    return "DQT"
+    case m == markerDNL:    return "DNL"
+    case m == markerDRI:    return "DRI"
+    case m == markerDHP:    return "DHP"
+    case m == markerEXP:    return "EXP"
+    case m >= markerAPP0 && m <= markerAPP15:
+        return fmt.Sprintf( "APP%d", m - markerAPP0 )
+    case m == markerCOM:    return "COM"
+    case m == markerTEM:    return "TEM"
+    case m >= 0xf0 && m <= 0xfd:
+        return fmt.Sprintf( "JPG%d", m - 0xf0 )
+    }
+    return fmt.Sprintf( "RES%02x", m )
+}
+
+func isSOF( m byte ) bool {
+    return m >= markerSOF0 && m <= 0xcf &&
+           m != markerDHT && m != markerJPG && m != markerDAC
+}
+
+// Table destinations (ITU T.81 B.2.4): the 4-bit destination fields of DQT,
+// DHT and DAC could hold 16 values, but the processes allow only 4
+// quantization tables, 4 Huffman tables per class (2 in the baseline process)
+// and 4 arithmetic conditioning tables per class.
+const maxDestinationField = 15
+
+// maxDestination returns the highest table destination allowed by the frame
+// process given by its SOF marker, for quantization tables if quantization is
+// true, or for entropy coding tables
+func maxDestination( sof byte, quantization bool ) int {
+    if ! quantization && sof == markerSOF0 {
+        return 1
+    }
+    return 3
+}
+
+// frameMarkers returns the SOF markers of the frames in l, in file order
+func frameMarkers( l *fileLayout ) []byte {
+    var frames []byte
+    for _, s := range l.segments {
+        if isSOF( s.marker ) {
+            frames = append( frames, s.marker )
+        }
+    }
+    return frames
+}
+
+// checkDestination returns an error if the table destination dest is not
+// allowed by the process of frame, as given by frames. The check is skipped
+// for all destinations (dest -1) or for an unknown frame.
+func checkDestination( frames []byte, frame uint, dest int,
+                       quantization bool ) error {
+    if dest < 0 || frame >= uint(len(frames)) {
+        return nil
+    }
+    if max := maxDestination( frames[frame], quantization ); dest > max {
+        kind := "Entropy"
+        if quantization {
+            kind = "Quantization"
+        }
+        return fmt.Errorf( "invalid %s table destination %d for frame %d " +
+                           "(%s, 0 to %d)\n", kind, dest, frame,
+                           markerName( frames[frame] ), max )
+    }
+    return nil
+}
+
+// hasLength returns whether the marker is followed by a segment length
+func hasLength( m byte ) bool {
+    return ! ( m == markerTEM || m == markerSOI || m == markerEOI ||
+               ( m >= markerRST0 && m <= markerRST7 ) )
+}
+
+type segment struct {
+    marker          byte
+    offset          int     // offset of the marker (0xff)
+    length          int     // value of length field, 0 if no length
+    ecsEnd          int     // for SOS and RSTn: end of following entropy-coded
+                            // data (offset of the next marker), otherwise 0
+}
+
+// end returns the offset immediately after the segment, not including any
+// entropy-coded data
+func (s *segment) end( ) int {
+    if s.length == 0 {
+        return s.offset + 2
+    }
+    return s.offset + 2 + s.length
+}
+
+// data returns the segment content after the length field
+func (s *segment) data( jpg []byte ) []byte {
+    if s.length < 2 {
+        return nil
+    }
+    end := s.end()
+    if end > len(jpg) {
+        end = len(jpg)
+    }
+    return jpg[s.offset+4:end]
+}
+
+type byteRange struct {
+    offset, length  int
+}
+
+type fileLayout struct {
+    size            int
+    segments        []segment
+    fillBytes       int         // 0xff fill bytes preceding markers
+    garbage         []byteRange // non-marker bytes between segments
+    trailing        byteRange   // data after the last EOI that is not a marker
+    stuffed         int         // stuffed 0xff00 in entropy-coded data
+    truncated       bool        // last segment goes beyond end of file
+}
+
+// scanEntropyCoded returns the offset of the first marker following the
+// entropy-coded data starting at offset, updating the number of stuffed bytes.
+func (l *fileLayout) scanEntropyCoded( data []byte, offset int ) int {
+    for i := offset; i < len(data) - 1; i++ {
+        if data[i] != 0xff {
+            continue
+        }
+        switch next := data[i+1]; {
+        case next == 0x00:
+            l.stuffed ++
+            i++
+        case next == 0xff:      // fill byte before a marker
+        default:
+            return i
+        }
+    }
+    l.truncated = true
+    return len(data)
+}
+
+// scanLayout returns the sequence of segments found in data
+func scanLayout( data []byte ) *fileLayout {
+    l := new( fileLayout )
+    l.size = len(data)
+    afterEOI := false
+    for i := 0; i < len(data); {
+        if data[i] != 0xff || i + 1 >= len(data) {
+            start := i
+            for i < len(data) && data[i] != 0xff {
+                i++
+            }
+            if i + 1 >= len(data) {
+                i = len(data)
+            }
+            if afterEOI {
+                l.trailing = byteRange{ start, i - start }
+                break
+            }
+            l.garbage = append( l.garbage, byteRange{ start, i - start } )
+            continue
+        }
+        if data[i+1] == 0xff {  // fill byte
+            l.fillBytes ++
+            i++
+            continue
+        }
+        if data[i+1] == 0x00 {  // not a marker
+            l.garbage = append( l.garbage, byteRange{ i, 2 } )
+            i += 2
+            continue
+        }
+        s := segment{ marker: data[i+1], offset: i }
+        if hasLength( s.marker ) {
+            if i + 4 > len(data) {
+                l.truncated = true
+                l.segments = append( l.segments, s )
+                break
+            }
+            s.length = int(data[i+2]) << 8 + int(data[i+3])
+            if s.end() > len(data) {
+                l.truncated = true
+            }
+        }
+        next := s.end()
+        if s.marker == markerSOS ||
+           ( s.marker >= markerRST0 && s.marker <= markerRST7 ) {
+            if next < len(data) {
+                s.ecsEnd = l.scanEntropyCoded( data, next )
+                next = s.ecsEnd
+            }
+        }
+        l.segments = append( l.segments, s )
+        afterEOI = s.marker == markerEOI
+        i = next
+    }
+    return l
+}
+
+// needsRawData returns true if some options require reading the raw file
+func (process *jpgArgs) needsRawData( ) bool {
+    return process.markerStats || process.security || process.entropyStats ||
+           process.stuffing || process.coefStats || process.fingerprint ||
+           process.qerr != "" || process.spliceCheck != "" ||
+           process.metaJson != "" || process.dumpMeta != "" ||
+           process.metaFlat || process.exiftool ||
+           process.verifyKey != nil || process.c2pa || process.sC2pa != "" ||
+           process.sIcc != "" || process.control.Mcu || process.control.Du ||
+           process.jumbf || len(process.sJumbf) > 0 || len(process.sScan) > 0 ||
+           process.listThumbs || len(process.svEmbedded) > 0 ||
+           process.sDepth != "" || process.sChroma != "" ||
+           process.sQuant != "" || process.sHuff != "" ||
+           process.verifyScan || process.suggest != "" ||
+           process.recoverability || process.preservation ||
+           process.thumbPrivacy || process.grayCheck ||
+           process.blank != nil || process.exposure != nil ||
+           process.blurCheck || process.rotationCheck ||
+           process.classifier != nil ||
+           len(process.derivatives) > 0
+}
+
+// processRawChecks performs the checks that are based on the raw file layout
+// rather than on the analysis, so that they are available even if the analysis
+// fails. It returns an error if the restart markers are out of sequence, if a
+// security check failed or if a map could not be saved. JPEG XT extension
+// layers, the restart sequence and trailing data are always checked, since the
+// analysis ignores them.
+func processRawChecks( path string, data []byte, process *jpgArgs,
+                       rep *fileReport ) (err error) {
+    data, err = inputData( path, data )
+    if err != nil {
+        return nil  // reported by the analysis
+    }
+    l := scanLayout( data )
+    formatJpegXt( data, l, rep )
+    formatByteOrder( data, l, rep, process.fixByteOrder )
+    formatExifPlacement( data, l, rep, process.control.TidyUp )
+    formatFrameStructure( data, l, rep )
+    formatColorSpace( data, l, rep )
+    formatTrailingData( l, rep )
+    err = checkRestartSequence( l, rep )
+    if process.json {
+        rep.analysis = newJsonAnalysis( data, l )
+    }
+    if ! process.needsRawData() {
+        return
+    }
+    if process.control.Mcu || process.control.Du {
+        formatMcuWindow( data, l, process.control.Begin, process.control.End,
+                         rep )
+    }
+    if process.markerStats {
+        formatMarkerStats( l )
+    }
+    if process.stuffing {
+        formatStuffing( data, l, rep )
+    }
+    if process.entropyStats {
+        formatEntropyStats( data, l )
+    }
+    if process.coefStats {
+        formatCoefficientStats( data, l )
+    }
+    if process.fingerprint {
+        formatFingerprint( data, l, rep )
+    }
+    if process.verifyScan {
+        if verr := verifyScans( data, l, rep ); err == nil {
+            err = verr
+        }
+    }
+    if process.metaFlat {
+        formatMetadataFlat( data, l )
+    }
+    if process.c2pa {
+        formatC2pa( data, l, rep )
+    }
+    if process.jumbf {
+        formatJumbf( data, l, rep )
+    }
+    if process.recoverability {
+        formatRecoverability( data, l, rep )
+    }
+    if process.preservation {
+        formatPreservation( data, l, rep )
+    }
+    if process.thumbPrivacy {
+        formatThumbPrivacy( data, l, rep )
+    }
+    if process.grayCheck {
+        formatGrayCheck( data, l, rep )
+    }
+    if process.blank != nil {
+        formatBlankCheck( data, process.blank, rep )
+    }
+    if process.exposure != nil {
+        formatExposureCheck( data, process.exposure, rep )
+    }
+    if process.blurCheck {
+        formatBlurCheck( data, process.blurThreshold, rep )
+    }
+    if process.rotationCheck {
+        formatRotationCheck( data, l, rep )
+    }
+    for _, js := range process.sJumbf {
+        jerr := saveJumbfBox( data, l, js.id, js.path )
+        if err == nil {
+            err = jerr
+        }
+    }
+    for _, ss := range process.sScan {
+        serr := saveScan( data, l, ss.n, ss.path )
+        if err == nil {
+            err = serr
+        }
+    }
+    if process.sC2pa != "" {
+        cerr := saveC2pa( process.sC2pa, data, l )
+        if err == nil {
+            err = cerr
+        }
+    }
+    if process.sIcc != "" {
+        ierr := saveIccProfile( process.sIcc, data, l )
+        if err == nil {
+            err = ierr
+        }
+    }
+    if process.security {
+        formatSecurity( data, l, rep )
+        if perr := checkPolyglot( data, l, rep ); err == nil {
+            err = perr
+        }
+    }
+    if process.qerr != "" {
+        qerr := saveQuantizationErrorMap( process.qerr, data, l )
+        if err == nil {
+            err = qerr
+        }
+    }
+    if process.listThumbs || len(process.svEmbedded) > 0 ||
+       process.sDepth != "" {
+        images := findEmbeddedImages( data, l )
+        if process.listThumbs {
+            formatEmbeddedImages( images )
+        }
+        for _, es := range process.svEmbedded {
+            serr := saveEmbeddedImage( images, es.id, es.path,
+                                       process.thumbFormat )
+            if err == nil {
+                err = serr
+            }
+        }
+        if process.sDepth != "" {
+            derr := saveDepthMap( images, process.sDepth,
+                                  process.thumbFormat )
+            if err == nil {
+                err = derr
+            }
+        }
+    }
+    if process.sQuant != "" {
+        qerr := saveQuantText( process.sQuant, path, data, l )
+        if err == nil {
+            err = qerr
+        }
+    }
+    if process.suggest != "" {
+        serr := saveSuggestions( process.suggest, path, data, rep )
+        if err == nil {
+            err = serr
+        }
+    }
+    if process.sHuff != "" {
+        herr := saveHuffmanTables( process.sHuff, path, data, l )
+        if err == nil {
+            err = herr
+        }
+    }
+    if process.sChroma != "" {
+        cerr := saveChromaPlanes( process.sChroma, path, data, l )
+        if err == nil {
+            err = cerr
+        }
+    }
+    if process.spliceCheck != "" {
+        serr := checkSplicing( process.spliceCheck, data, l, rep )
+        if err == nil {
+            err = serr
+        }
+    }
+    if process.verifyKey != nil {
+        verr := verifySignature( path, data, process.verifyKey, rep )
+        if err == nil {
+            err = verr
+        }
+    }
+    if process.exiftool {
+        eerr := compareWithExiftool( path, data, l, rep )
+        if err == nil {
+            err = eerr
+        }
+    }
+    if process.classifier != nil {
+        cerr := classifyPicture( path, data, process.classifier, rep )
+        if err == nil {
+            err = cerr
+        }
+    }
+    if process.metaJson != "" {
+        merr := saveMetadataJson( process.metaJson, path, data, l )
+        if err == nil {
+            err = merr
+        }
+    }
+    if process.dumpMeta != "" {
+        merr := dumpMetadata( process.dumpMeta, path, data, l )
+        if err == nil {
+            err = merr
+        }
+    }
+    if len(process.derivatives) > 0 {
+        derr := saveDerivatives( path, data, l, process.derivatives, rep )
+        if err == nil {
+            err = derr
+        }
+    }
+    return
+}
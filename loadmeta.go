@@ -0,0 +1,312 @@
+
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "os"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Metadata import (-loadmeta=<template.json>): Exif tags and XMP properties
+// described in a json template are written into the copy written with -o, for
+// bulk tagging of generated or scanned pictures that have no metadata. The
+// template is an object with up to three members:
+//  - "exif": tags by name, as with -setmeta, with string or number values,
+//  - "xmp": properties by qualified name (dc:title), with a string or number
+//    for a simple value, an array of strings for an unordered array (rdf:Bag,
+//    rdf:Seq for dc:creator and dc:date) or an object giving the text of each
+//    language for a language alternative (rdf:Alt, such as {"x-default":
+//    "Sunset", "fr": "Coucher"}),
+//  - "namespaces": additional namespace URIs by prefix, for properties in
+//    other namespaces than the usual ones.
+// Exif tags are set as with -setmeta, creating an Exif segment if needed. The
+// XMP packet built from the template replaces the XMP segments of the copy,
+// and is inserted after the JFIF and Exif segments. This is done right after
+// writing, before -setmeta, -strip-gps and -audit, which then apply to the
+// imported metadata.
+
+type metaTemplate struct {
+    path            string
+    exif            *metaEdit       // nil if no exif member
+    xmp             []byte          // packet, nil if no xmp member
+    nXmp            int             // number of properties in packet
+}
+
+type metaTemplateJson struct {
+    Exif            map[string]interface{}  `json:"exif"`
+    Xmp             map[string]interface{}  `json:"xmp"`
+    Namespaces      map[string]string       `json:"namespaces"`
+}
+
+// xmpSeqProperties are ordered arrays, other arrays are unordered
+var xmpSeqProperties = map[string]bool{ "dc:creator": true, "dc:date": true }
+
+var xmpQualifiedName = regexp.MustCompile( `^([A-Za-z_][\w.-]*):([A-Za-z_][\w.-]*)$` )
+
+// templateText returns a string or number template value as text
+func templateText( v interface{} ) (string, bool) {
+    switch v := v.(type) {
+    case string:
+        return v, true
+    case float64:
+        return strconv.FormatFloat( v, 'f', -1, 64 ), true
+    case bool:
+        return strconv.FormatBool( v ), true
+    }
+    return "", false
+}
+
+// loadMetaTemplate reads and checks the json template at path
+func loadMetaTemplate( path string ) (*metaTemplate, error) {
+    data, err := os.ReadFile( path )
+    if err != nil {
+        return nil, fmt.Errorf( "%v\n", err )
+    }
+    var tj metaTemplateJson
+    dec := json.NewDecoder( bytes.NewReader( data ) )
+    dec.DisallowUnknownFields()
+    if err = dec.Decode( &tj ); err != nil {
+        return nil, fmt.Errorf( "%s: %v\n", path, err )
+    }
+    mt := &metaTemplate{ path: path }
+    if len(tj.Exif) > 0 {
+        mt.exif = &metaEdit{ spec: path }
+        for name, v := range tj.Exif {
+            tag := findEditableTag( name )
+            if tag == nil {
+                return nil, fmt.Errorf( "%s: unknown or non-editable tag %q " +
+                                        "(tags are %s)\n", path, name,
+                                        editableTagNames() )
+            }
+            text, ok := templateText( v )
+            if ! ok {
+                return nil, fmt.Errorf( "%s: value of %s is not a string or " +
+                                        "a number\n", path, tag.name )
+            }
+            if err = checkTagValue( tag, text ); err != nil {
+                return nil, fmt.Errorf( "%s: %v", path, err )
+            }
+            for _, s := range mt.exif.settings {
+                if s.tag == tag {
+                    return nil, fmt.Errorf( "%s: tag %s is given twice\n",
+                                            path, tag.name )
+                }
+            }
+            mt.exif.settings = append( mt.exif.settings,
+                                       metaSetting{ tag, text } )
+        }
+        sort.Slice( mt.exif.settings, func( i, j int ) bool {
+            return mt.exif.settings[i].tag.tag < mt.exif.settings[j].tag.tag
+        })
+    }
+    if len(tj.Xmp) > 0 {
+        mt.xmp, err = templateXmpPacket( tj.Xmp, tj.Namespaces )
+        if err != nil {
+            return nil, fmt.Errorf( "%s: %v", path, err )
+        }
+        mt.nXmp = len(tj.Xmp)
+    }
+    if mt.exif == nil && mt.xmp == nil {
+        return nil, fmt.Errorf( "%s: no exif or xmp metadata\n", path )
+    }
+    return mt, nil
+}
+
+// templateXmpPacket returns an XMP packet with the properties given in props,
+// in the namespaces given by their usual prefix or in namespaces
+func templateXmpPacket( props map[string]interface{},
+                        namespaces map[string]string ) ([]byte, error) {
+    uris := make( map[string]string )
+    for uri, prefix := range xmpPrefixes {
+        uris[prefix] = uri
+    }
+    for prefix, uri := range namespaces {
+        if ! xmpQualifiedName.MatchString( prefix + ":x" ) || uri == "" {
+            return nil, fmt.Errorf( "invalid namespace %q: %q\n", prefix, uri )
+        }
+        uris[prefix] = uri
+    }
+    names := make( []string, 0, len(props) )
+    for name := range props {
+        names = append( names, name )
+    }
+    sort.Strings( names )
+    used := make( map[string]bool )
+    var elements strings.Builder
+    for _, name := range names {
+        m := xmpQualifiedName.FindStringSubmatch( name )
+        if m == nil {
+            return nil, fmt.Errorf( "invalid XMP property name %q " +
+                                    "(prefix:name)\n", name )
+        }
+        switch prefix := m[1]; {
+        case prefix == "rdf" || prefix == "x" || prefix == "xml":
+            return nil, fmt.Errorf( "XMP property %s is reserved\n", name )
+        case uris[prefix] == "":
+            return nil, fmt.Errorf( "unknown namespace prefix %s in %s " +
+                                    "(add it to namespaces)\n", prefix, name )
+        default:
+            used[prefix] = true
+        }
+        value, err := templateXmpValue( name, props[name] )
+        if err != nil {
+            return nil, err
+        }
+        fmt.Fprintf( &elements, "<%s>%s</%s>", name, value, name )
+    }
+    prefixes := make( []string, 0, len(used) )
+    for prefix := range used {
+        prefixes = append( prefixes, prefix )
+    }
+    sort.Strings( prefixes )
+    var b strings.Builder
+    b.WriteString( "<?xpacket begin=\"\xef\xbb\xbf\" " +
+                   "id=\"W5M0MpCehiHzreSzNTczkc9d\"?>" +
+                   "<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">" +
+                   "<rdf:RDF xmlns:rdf=\"" + rdfNamespace + "\">" +
+                   "<rdf:Description rdf:about=\"\"" )
+    for _, prefix := range prefixes {
+        fmt.Fprintf( &b, " xmlns:%s=\"%s\"", prefix,
+                     xmlEscape( uris[prefix] ) )
+    }
+    b.WriteString( ">" )
+    b.WriteString( elements.String() )
+    b.WriteString( "</rdf:Description></rdf:RDF></x:xmpmeta>" +
+                   "<?xpacket end=\"w\"?>" )
+    packet := []byte( b.String() )
+    if 2 + len(xmpHeader) + len(packet) > 0xffff {
+        return nil, fmt.Errorf( "XMP packet too large for a segment\n" )
+    }
+    return packet, nil
+}
+
+// templateXmpValue returns the content of the element of property name, given
+// its template value v
+func templateXmpValue( name string, v interface{} ) (string, error) {
+    if text, ok := templateText( v ); ok {
+        return xmlEscape( text ), nil
+    }
+    var b strings.Builder
+    switch v := v.(type) {
+    case []interface{}:
+        array := "rdf:Bag"
+        if xmpSeqProperties[name] {
+            array = "rdf:Seq"
+        }
+        b.WriteString( "<" + array + ">" )
+        for _, item := range v {
+            text, ok := templateText( item )
+            if ! ok {
+                return "", fmt.Errorf( "array items of %s are not strings " +
+                                       "or numbers\n", name )
+            }
+            b.WriteString( "<rdf:li>" + xmlEscape( text ) + "</rdf:li>" )
+        }
+        b.WriteString( "</" + array + ">" )
+    case map[string]interface{}:
+        langs := make( []string, 0, len(v) )
+        for lang := range v {
+            if lang != "x-default" {
+                langs = append( langs, lang )
+            }
+        }
+        sort.Strings( langs )
+        if _, ok := v["x-default"]; ok {
+            langs = append( []string{ "x-default" }, langs... )
+        }
+        b.WriteString( "<rdf:Alt>" )
+        for _, lang := range langs {
+            text, ok := templateText( v[lang] )
+            if ! ok {
+                return "", fmt.Errorf( "%s text in %s is not a string\n",
+                                       lang, name )
+            }
+            fmt.Fprintf( &b, "<rdf:li xml:lang=\"%s\">%s</rdf:li>",
+                         xmlEscape( lang ), xmlEscape( text ) )
+        }
+        b.WriteString( "</rdf:Alt>" )
+    default:
+        return "", fmt.Errorf( "invalid value for %s\n", name )
+    }
+    return b.String(), nil
+}
+
+// replaceXmpFile replaces all XMP segments, main and extended, of the file at
+// output with a segment holding packet, inserted after the JFIF and Exif
+// segments. It returns the number of segments replaced.
+func replaceXmpFile( output string, packet []byte ) (int, error) {
+    data, err := os.ReadFile( output )
+    if err != nil {
+        return 0, fmt.Errorf( "%v\n", err )
+    }
+    l := scanLayout( data )
+    insertAt, replaced := 2, 0          // after SOI, JFIF and Exif
+    for i := range l.segments {
+        s := &l.segments[i]
+        if isImageDataMarker( s.marker ) || s.marker == markerEOI {
+            break
+        }
+        switch {
+        case isXmpSegment( data, s ):
+            replaced ++
+        case s.marker == markerAPP0 || s.marker == markerAPP0 + 1:
+            insertAt = s.end()
+        }
+    }
+    var b bytes.Buffer
+    pos, inserted := 0, false
+    for i := range l.segments {
+        s := &l.segments[i]
+        if ! inserted && s.offset >= insertAt {
+            b.Write( data[pos:insertAt] )
+            pos, inserted = insertAt, true
+            payload := append( append( []byte( nil ), xmpHeader... ),
+                               packet... )
+            if err = appendSegment( &b, markerAPP0 + 1, payload ); err != nil {
+                return 0, err
+            }
+        }
+        if isImageDataMarker( s.marker ) || s.marker == markerEOI {
+            break
+        }
+        if isXmpSegment( data, s ) {
+            b.Write( data[pos:s.offset] )
+            pos = s.end()
+        }
+    }
+    b.Write( data[pos:] )
+    if err = writeFile( output, b.Bytes(), 0644 ); err != nil {
+        return 0, fmt.Errorf( "%v\n", err )
+    }
+    return replaced, nil
+}
+
+// loadMetaFile writes the metadata of mt into the file at output, and returns
+// a description of the changes
+func loadMetaFile( output string, mt *metaTemplate ) (string, error) {
+    var changes []string
+    if mt.exif != nil {
+        c, err := setExifFile( output, mt.exif )
+        if err != nil {
+            return "", fmt.Errorf( "loadmeta: %v", err )
+        }
+        changes = append( changes, c... )
+    }
+    if mt.xmp != nil {
+        n, err := replaceXmpFile( output, mt.xmp )
+        if err != nil {
+            return "", fmt.Errorf( "loadmeta: %v", err )
+        }
+        c := fmt.Sprintf( "XMP packet with %d properties", mt.nXmp )
+        if n > 0 {
+            c += fmt.Sprintf( ", replacing %d segment(s)", n )
+        }
+        changes = append( changes, c )
+    }
+    return "loadmeta: " + strings.Join( changes, ", " ), nil
+}
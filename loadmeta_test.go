@@ -0,0 +1,110 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// TestLoadMetaRoundTrip loads json templates into files with -loadmeta and
+// reads back the Exif tags and XMP properties written
+func TestLoadMetaRoundTrip( t *testing.T ) {
+    base := testsetData( t, "baseline-420.jpg" )
+    oldXmp := append( append( []byte( nil ), xmpHeader... ),
+                      `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:` +
+                      `rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+                      `<rdf:Description xmlns:dc="http://purl.org/dc/` +
+                      `elements/1.1/" dc:format="old"/></rdf:RDF>` +
+                      `</x:xmpmeta>`... )
+    withXmp := withExif( base, gpsTiff() )
+    at := scanLayout( withXmp ).segments[2].end()  // after JFIF and Exif
+    withXmp = append( append( append( []byte( nil ), withXmp[:at]... ),
+                              segmentBytesOf( markerAPP0 + 1, oldXmp )... ),
+                      withXmp[at:]... )
+    tests := []struct {
+        name        string
+        data        []byte
+        template    string
+        exif        [][2]string     // formatted tag name and value
+        xmp         []xmpProperty   // in document order
+    }{
+        { "exif", base,
+          `{"exif": {"Artist": "somebody", "Software": "X"}}`,
+          [][2]string{ { "Artist", "somebody" }, { "Software", "X" } }, nil },
+        { "xmp", base,
+          `{"xmp": {"dc:title": {"x-default": "Sunset", "fr": "Coucher"},
+                    "dc:creator": ["A", "B"], "xmp:Rating": 3}}`,
+          nil, []xmpProperty{ { "dc:creator[1]", "A" },
+                              { "dc:creator[2]", "B" },
+                              { "dc:title[x-default]", "Sunset" },
+                              { "dc:title[fr]", "Coucher" },
+                              { "xmp:Rating", "3" } } },
+        { "namespace", base,
+          `{"xmp": {"my:label": "v"},
+            "namespaces": {"my": "http://example.com/my/"}}`,
+          nil, []xmpProperty{ { "my:label", "v" } } },
+        { "existing metadata", withXmp,
+          `{"exif": {"Copyright": "nobody"}, "xmp": {"dc:subject": ["s"]}}`,
+          [][2]string{ { "Copyright", "nobody" } },
+          []xmpProperty{ { "dc:subject[1]", "s" } } },
+    }
+    for _, tc := range tests {
+        t.Run( tc.name, func( t *testing.T ) {
+            dir := t.TempDir()
+            template := filepath.Join( dir, "template.json" )
+            path := filepath.Join( dir, "out.jpg" )
+            if err := os.WriteFile( template, []byte( tc.template ),
+                                    0644 ); err != nil {
+                t.Fatal( err )
+            }
+            if err := os.WriteFile( path, tc.data, 0644 ); err != nil {
+                t.Fatal( err )
+            }
+            mt, err := loadMetaTemplate( template )
+            if err != nil {
+                t.Fatal( err )
+            }
+            if _, err = loadMetaFile( path, mt ); err != nil {
+                t.Fatal( err )
+            }
+            data, err := os.ReadFile( path )
+            if err != nil {
+                t.Fatal( err )
+            }
+            lines := metadataLines( data )
+            if lines == nil {
+                t.Fatalf( "output does not parse" )
+            }
+            for _, w := range tc.exif {
+                if ! hasTagValue( lines, w[0], w[1] ) {
+                    t.Errorf( "%s is not %q in\n%s", w[0], w[1],
+                              strings.Join( lines, "\n" ) )
+                }
+            }
+            packets := xmpPackets( data, scanLayout( data ) )
+            if tc.xmp == nil {
+                if len(packets) != 0 {
+                    t.Errorf( "%d XMP packets written", len(packets) )
+                }
+                return
+            }
+            if len(packets) != 1 {
+                t.Fatalf( "%d XMP packets, expected 1", len(packets) )
+            }
+            props := xmpProperties( packets[0].data )
+            if len(props) != len(tc.xmp) {
+                t.Fatalf( "XMP properties %q, expected %q", props, tc.xmp )
+            }
+            for i, p := range props {
+                if p != tc.xmp[i] {
+                    t.Errorf( "XMP property %q, expected %q", p, tc.xmp[i] )
+                }
+            }
+            if s := exifPlacements( data, scanLayout( data ) ); len(s) > 0 &&
+                                    s[0].s.offset > packets[0].offset {
+                t.Errorf( "XMP inserted before Exif" )
+            }
+        } )
+    }
+}
@@ -0,0 +1,126 @@
+
+package main
+
+import (
+    "flag"
+    "fmt"
+    "math"
+    "os"
+    "strings"
+)
+
+// Synthetic picture encoder (jcheck make): a test picture generated from a
+// pattern is encoded from scratch, as a baseline or progressive 4:2:0 jpeg
+// file, with the same encoder as gen-testset (see testset.go). This exercises
+// the writer side and gives controlled inputs for decoder benchmarking, since
+// the picture content, its size and the quality are chosen independently. The
+// noise pattern is deterministic, so that the same arguments always produce
+// the same file.
+
+const MAKE_HELP =
+`jcheck make [-pattern=<p>] [-size=<WxH>] [-quality=<q>] [-progressive] <path>
+
+    Encode a synthetic test picture as a 4:2:0 jpeg file in <path>.
+
+        -pattern=<p>        gradient (default), bars or noise
+        -size=<WxH>         picture width and height (default 640x480)
+        -quality=<q>        IJG quality of the quantization tables (default 75)
+        -progressive        progressive instead of baseline encoding, with a
+                            DC scan followed by 2 AC scans per component
+`
+
+var makePatterns = map[string]picturePattern{
+    "gradient": gradientPattern,
+    "bars":     barsPattern,
+    "noise":    noisePattern,
+}
+
+// gradientPattern is a horizontal red ramp, a vertical green ramp and a
+// diagonal blue ramp
+func gradientPattern( x, y, w, h int ) (r, g, b float64) {
+    fx, fy := float64(x) / float64(w - 1), float64(y) / float64(h - 1)
+    return fx, fy, ( 2 - fx - fy ) / 2
+}
+
+// barsPattern is made of 8 vertical color bars in decreasing luminance order,
+// above a luminance ramp on the bottom quarter
+func barsPattern( x, y, w, h int ) (r, g, b float64) {
+    if y >= h - h / 4 {
+        v := float64(x) / float64(w - 1)
+        return v, v, v
+    }
+    bar := x * 8 / w
+    return float64( ( bar ^ 7 ) >> 2 & 1 ), float64( ( bar ^ 7 ) >> 1 & 1 ),
+           float64( ( bar ^ 7 ) & 1 )
+}
+
+// noisePattern is uniform random noise, the worst case for compression,
+// derived from the pixel coordinates only
+func noisePattern( x, y, w, h int ) (r, g, b float64) {
+    v := uint64(y) << 32 | uint64(x)
+    v ^= v >> 33
+    v *= 0xff51afd7ed558ccd
+    v ^= v >> 33
+    v *= 0xc4ceb9fe1a85ec53
+    v ^= v >> 33
+    return float64( v & 0xff ) / 255, float64( v >> 8 & 0xff ) / 255,
+           float64( v >> 16 & 0xff ) / 255
+}
+
+func makePicture( args []string ) int {
+    flags := flag.NewFlagSet( "make", flag.ContinueOnError )
+    flags.Usage = func( ) {
+        fmt.Fprintf( flags.Output(), MAKE_HELP )
+    }
+    pattern := flags.String( "pattern", "gradient", "synthetic pattern" )
+    size := flags.String( "size", "640x480", "picture size" )
+    quality := flags.Int( "quality", 75, "IJG quality of quantization tables" )
+    progressive := flags.Bool( "progressive", false, "progressive encoding" )
+    if err := flags.Parse( args ); err != nil {
+        return 2
+    }
+    if flags.NArg() != 1 {
+        flags.Usage()
+        return 2
+    }
+    pf := makePatterns[*pattern]
+    if pf == nil {
+        fmt.Printf( "jpegcheck: make: invalid pattern %s (gradient, bars or " +
+                    "noise)\n", *pattern )
+        return 2
+    }
+    var w, h int
+    if n, err := fmt.Sscanf( strings.ToLower( *size ), "%dx%d", &w, &h );
+       err != nil || n != 2 || w < 2 || h < 2 || w > math.MaxUint16 ||
+       h > math.MaxUint16 {
+        fmt.Printf( "jpegcheck: make: invalid size %s (WxH, from 2 to %d)\n",
+                    *size, math.MaxUint16 )
+        return 2
+    }
+    if *quality < 1 || *quality > 100 {
+        fmt.Printf( "jpegcheck: make: invalid quality %d (1 to 100)\n",
+                    *quality )
+        return 2
+    }
+    spec := testsetSpec{ marker: markerSOF0, precision: 8, width: w,
+                         height: h, sampling: sampling420, pattern: pf }
+    spec.comment = fmt.Sprintf( "jcheck make -pattern=%s -size=%dx%d " +
+                                "-quality=%d", *pattern, w, h, *quality )
+    kind := "baseline"
+    if *progressive {
+        spec.marker, kind = markerSOF0 + 2, "progressive"
+        spec.comment += " -progressive"
+    }
+    data, _, err := generateTestFile( &spec, *quality )
+    if err != nil {
+        fmt.Printf( "jpegcheck: make: %v", err )
+        return 1
+    }
+    if err = os.WriteFile( flags.Arg( 0 ), data, 0644 ); err != nil {
+        fmt.Printf( "jpegcheck: make: %v\n", err )
+        return 1
+    }
+    fmt.Printf( "jpegcheck: %s %dx%d %s picture written in %s (%d bytes)\n",
+                *pattern, w, h, kind, flags.Arg( 0 ), len(data) )
+    return 0
+}
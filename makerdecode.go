@@ -0,0 +1,568 @@
+
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "strings"
+)
+
+// Maker note decoding: the library does not decode the maker notes of most
+// vendors and reports the maker note IFD (id 5) as absent. The maker note of
+// the first Exif segment is decoded here for Canon, Nikon, Sony, Fujifilm,
+// Olympus and Panasonic, selected by the Exif Make tag, or by the maker note
+// header if Make is missing. The vendor IFD is located as for the previews
+// (see makernotes.go) and its tags are printed with their vendor names, with
+// the values of the best known tags (lens, focus mode, serial numbers)
+// decoded. Other tags are printed with their id and raw value.
+
+// makerTag describes a vendor tag: its name and how to decode its value, or
+// nil to print the raw value
+type makerTag struct {
+    name            string
+    decode          func( v interface{} ) string
+}
+
+// makerSubIfd describes a vendor tag whose value is an IFD
+type makerSubIfd struct {
+    name            string
+    tags            map[uint16]makerTag
+}
+
+type makerVendor struct {
+    name            string
+    makes           []string        // Make tag prefixes, in upper case
+    headers         []string        // maker note headers
+    locate          func( mn *makerNote ) (*tiffReader, uint32, error)
+    tags            map[uint16]makerTag
+    subIfds         map[uint16]makerSubIfd
+}
+
+// intValue returns the integer value of a single typed value
+func intValue( v interface{} ) (int, bool) {
+    switch v := v.(type) {
+    case uint8:     return int(v), true
+    case int8:      return int(v), true
+    case uint16:    return int(v), true
+    case int16:     return int(v), true
+    case uint32:    return int(v), true
+    case int32:     return int(v), true
+    }
+    return 0, false
+}
+
+// valueList returns the typed values of an entry as a list
+func valueList( v interface{} ) []interface{} {
+    switch v := v.(type) {
+    case []interface{}:
+        return v
+    case []byte:
+        values := make( []interface{}, len(v) )
+        for i, b := range v {
+            values[i] = b
+        }
+        return values
+    }
+    return []interface{}{ v }
+}
+
+// rawMakerValue returns a raw value as a single line, without the content of
+// large binary values such as previews
+func rawMakerValue( v interface{} ) string {
+    if b, ok := v.([]byte); ok && len(b) > 32 {
+        return fmt.Sprintf( "%d bytes", len(b) )
+    }
+    return flatValue( v )
+}
+
+// makerText decodes ascii values, and undefined values holding text
+func makerText( v interface{} ) string {
+    switch v := v.(type) {
+    case string:
+        return strings.TrimSpace( v )
+    case []byte:
+        if t := bytes.TrimRight( v, "\x00 " ); isPrintable( t ) {
+            return string( t )
+        }
+    }
+    return rawMakerValue( v )
+}
+
+func isPrintable( b []byte ) bool {
+    for _, c := range b {
+        if c < 0x20 || c > 0x7e {
+            return false
+        }
+    }
+    return true
+}
+
+// makerNames returns a decoder giving the names of integer values, for the
+// first value if there are several
+func makerNames( names map[int]string ) func( v interface{} ) string {
+    return func( v interface{} ) string {
+        i, ok := intValue( valueList( v )[0] )
+        if ! ok {
+            return rawMakerValue( v )
+        }
+        if name, ok := names[i]; ok {
+            return name
+        }
+        return fmt.Sprintf( "Unknown (%d)", i )
+    }
+}
+
+// rationalValue returns the decimal value of a rational
+func rationalValue( v interface{} ) (float64, bool) {
+    if r, ok := v.(metaRational); ok && r.Value != nil {
+        return *r.Value, true
+    }
+    return 0, false
+}
+
+// lensRange decodes the 4 rationals of a lens specification: focal lengths
+// and apertures at both ends of the focal range
+func lensRange( v interface{} ) string {
+    values := valueList( v )
+    if len(values) != 4 {
+        return rawMakerValue( v )
+    }
+    var f [4]float64
+    for i := range f {
+        var ok bool
+        if f[i], ok = rationalValue( values[i] ); ! ok {
+            return rawMakerValue( v )
+        }
+    }
+    focal := fmt.Sprintf( "%gmm", f[0] )
+    if f[1] != f[0] {
+        focal = fmt.Sprintf( "%g-%gmm", f[0], f[1] )
+    }
+    aperture := fmt.Sprintf( "f/%g", f[2] )
+    if f[3] != f[2] {
+        aperture = fmt.Sprintf( "f/%g-%g", f[2], f[3] )
+    }
+    return focal + " " + aperture
+}
+
+// makerField describes the value at index in an array of values
+type makerField struct {
+    index           int
+    tag             makerTag
+}
+
+// makerFields returns a decoder printing the given fields of an array of
+// values, one per line
+func makerFields( fields []makerField ) func( v interface{} ) string {
+    return func( v interface{} ) string {
+        values := valueList( v )
+        var lines []string
+        for _, f := range fields {
+            if f.index >= len(values) {
+                continue
+            }
+            value := rawMakerValue( values[f.index] )
+            if f.tag.decode != nil {
+                value = f.tag.decode( values[f.index] )
+            }
+            lines = append( lines, f.tag.name + ": " + value )
+        }
+        if len(lines) == 0 {
+            return rawMakerValue( v )
+        }
+        return strings.Join( lines, "\n" )
+    }
+}
+
+// canonFocalRange decodes the focal range of the Canon camera settings, given
+// in focal units per mm
+func canonFocalRange( v interface{} ) string {
+    values := valueList( v )
+    if len(values) < 26 {
+        return rawMakerValue( v )
+    }
+    max, _ := intValue( values[23] )
+    min, _ := intValue( values[24] )
+    units, _ := intValue( values[25] )
+    if units == 0 {
+        return fmt.Sprintf( "%d-%d", min, max )
+    }
+    if min == max {
+        return fmt.Sprintf( "%gmm", float64(min) / float64(units) )
+    }
+    return fmt.Sprintf( "%g-%gmm", float64(min) / float64(units),
+                        float64(max) / float64(units) )
+}
+
+var canonCameraSettings = []makerField {
+    { 1, makerTag{ "MacroMode", makerNames( map[int]string{
+                    1: "Macro", 2: "Normal" } ) } },
+    { 3, makerTag{ "Quality", makerNames( map[int]string{
+                    1: "Economy", 2: "Normal", 3: "Fine", 4: "RAW",
+                    5: "Superfine", 130: "Light (RAW)",
+                    131: "Standard (RAW)" } ) } },
+    { 7, makerTag{ "FocusMode", makerNames( map[int]string{
+                    0: "One-shot AF", 1: "AI Servo AF", 2: "AI Focus AF",
+                    3: "Manual Focus", 4: "Single", 5: "Continuous",
+                    6: "Manual Focus", 16: "Pan Focus",
+                    256: "One-shot AF (Live View)",
+                    257: "AI Servo AF (Live View)",
+                    258: "AI Focus AF (Live View)" } ) } },
+    { 22, makerTag{ "LensType", nil } },
+}
+
+var canonVendor = makerVendor{
+    name: "Canon", makes: []string{ "CANON" },
+    locate: func( mn *makerNote ) (*tiffReader, uint32, error) {
+        return &tiffReader{ data: mn.tiff, order: mn.order },
+               uint32(mn.offset), nil
+    },
+    tags: map[uint16]makerTag{
+        0x0001: { "CameraSettings", func( v interface{} ) string {
+                    return makerFields( canonCameraSettings )( v ) +
+                           "\nFocalRange: " + canonFocalRange( v ) } },
+        0x0002: { "FocalLength", nil },
+        0x0004: { "ShotInfo", nil },
+        0x0006: { "ImageType", makerText },
+        0x0007: { "FirmwareVersion", makerText },
+        0x0008: { "FileNumber", nil },
+        0x0009: { "OwnerName", makerText },
+        0x000c: { "SerialNumber", nil },
+        0x0010: { "CanonModelID", func( v interface{} ) string {
+                    if i, ok := intValue( v ); ok {
+                        return fmt.Sprintf( "0x%08x", i )
+                    }
+                    return rawMakerValue( v )
+                } },
+        0x0095: { "LensModel", makerText },
+        0x0096: { "InternalSerialNumber", makerText },
+        0x00b6: { "PreviewImageInfo", nil },
+    },
+}
+
+var nikonVendor = makerVendor{
+    name: "Nikon", makes: []string{ "NIKON" }, headers: []string{ "Nikon\x00" },
+    locate: func( mn *makerNote ) (*tiffReader, uint32, error) {
+        if len(mn.content) < 18 ||
+           ! bytes.HasPrefix( mn.content, []byte( "Nikon\x00" ) ) {
+            return nil, 0, fmt.Errorf( "no Nikon header with an inner TIFF " +
+                                       "header\n" )
+        }
+        t, err := newTiffReader( mn.content[10:] )
+        if err != nil {
+            return nil, 0, err
+        }
+        return t, t.first, nil
+    },
+    tags: map[uint16]makerTag{
+        0x0001: { "MakerNoteVersion", makerText },
+        0x0002: { "ISO", nil },
+        0x0004: { "Quality", makerText },
+        0x0005: { "WhiteBalance", makerText },
+        0x0007: { "FocusMode", makerText },
+        0x0011: { "PreviewIFD", nil },
+        0x001d: { "SerialNumber", makerText },
+        0x0039: { "LocationInfo", nil },
+        0x0083: { "LensType", func( v interface{} ) string {
+                    i, ok := intValue( valueList( v )[0] )
+                    if ! ok {
+                        return rawMakerValue( v )
+                    }
+                    var kind []string
+                    for b, name := range []string{ "MF", "D", "G", "VR",
+                                                   "1", "FT-1", "E", "AF-P" } {
+                        if i & ( 1 << b ) != 0 {
+                            kind = append( kind, name )
+                        }
+                    }
+                    if len(kind) == 0 {
+                        return "AF"
+                    }
+                    return strings.Join( kind, " " )
+                } },
+        0x0084: { "Lens", lensRange },
+        0x0093: { "NEFCompression", nil },
+        0x0098: { "LensData", nil },
+        0x00a7: { "ShutterCount", nil },
+    },
+    subIfds: map[uint16]makerSubIfd{
+        0x0011: { "PreviewIFD", map[uint16]makerTag{
+                    0x0201: { "PreviewImageStart", nil },
+                    0x0202: { "PreviewImageLength", nil } } },
+    },
+}
+
+var sonyVendor = makerVendor{
+    name: "Sony", makes: []string{ "SONY" },
+    headers: []string{ "SONY DSC ", "SONY CAM " },
+    locate: func( mn *makerNote ) (*tiffReader, uint32, error) {
+        offset := mn.offset
+        if bytes.HasPrefix( mn.content, []byte( "SONY DSC " ) ) ||
+           bytes.HasPrefix( mn.content, []byte( "SONY CAM " ) ) {
+            offset += 12
+        }
+        return &tiffReader{ data: mn.tiff, order: mn.order },
+               uint32(offset), nil
+    },
+    tags: map[uint16]makerTag{
+        0x0102: { "Quality", makerNames( map[int]string{
+                    0: "RAW", 1: "Super Fine", 2: "Fine", 3: "Standard",
+                    4: "Economy", 5: "Extra Fine", 6: "RAW + JPEG" } ) },
+        0x0104: { "FlashExposureComp", nil },
+        0x0105: { "Teleconverter", nil },
+        0x0115: { "WhiteBalance", nil },
+        0x2001: { "PreviewImage", nil },
+        0x2002: { "Rating", nil },
+        0x201b: { "FocusMode", makerNames( map[int]string{
+                    0: "Manual", 2: "AF-S", 3: "AF-C", 4: "AF-A",
+                    6: "DMF" } ) },
+        0xb000: { "FileFormat", nil },
+        0xb001: { "SonyModelID", nil },
+        0xb020: { "CreativeStyle", makerText },
+        0xb027: { "LensType", nil },
+    },
+}
+
+var fujifilmVendor = makerVendor{
+    name: "Fujifilm", makes: []string{ "FUJIFILM" },
+    headers: []string{ "FUJIFILM" },
+    locate: func( mn *makerNote ) (*tiffReader, uint32, error) {
+        if len(mn.content) < 12 ||
+           ! bytes.HasPrefix( mn.content, []byte( "FUJIFILM" ) ) {
+            return nil, 0, fmt.Errorf( "no FUJIFILM header\n" )
+        }
+        return &tiffReader{ data: mn.content, order: binary.LittleEndian },
+               binary.LittleEndian.Uint32( mn.content[8:] ), nil
+    },
+    tags: map[uint16]makerTag{
+        0x0000: { "Version", makerText },
+        0x0010: { "InternalSerialNumber", makerText },
+        0x1000: { "Quality", makerText },
+        0x1001: { "Sharpness", nil },
+        0x1002: { "WhiteBalance", nil },
+        0x1021: { "FocusMode", makerNames( map[int]string{
+                    0: "Auto", 1: "Manual", 65535: "Movie" } ) },
+        0x1022: { "AFMode", nil },
+        0x1031: { "PictureMode", nil },
+        0x1404: { "MinFocalLength", nil },
+        0x1405: { "MaxFocalLength", nil },
+        0x1406: { "MaxApertureAtMinFocal", nil },
+        0x1407: { "MaxApertureAtMaxFocal", nil },
+        0x1438: { "ImageCount", nil },
+    },
+}
+
+var olympusVendor = makerVendor{
+    name: "Olympus", makes: []string{ "OLYMPUS", "OM DIGITAL" },
+    headers: []string{ "OLYMPUS\x00", "OM SYSTEM\x00", "OLYMP\x00" },
+    locate: func( mn *makerNote ) (*tiffReader, uint32, error) {
+        c := mn.content
+        var order []byte
+        var offset uint32
+        switch {
+        case bytes.HasPrefix( c, []byte( "OLYMPUS\x00" ) ) && len(c) >= 16:
+            order, offset = c[8:10], 12
+        case bytes.HasPrefix( c, []byte( "OM SYSTEM\x00" ) ) && len(c) >= 20:
+            order, offset = c[12:14], 16
+        case bytes.HasPrefix( c, []byte( "OLYMP\x00" ) ):
+            return &tiffReader{ data: mn.tiff, order: mn.order },
+                   uint32(mn.offset + 8), nil
+        default:
+            return nil, 0, fmt.Errorf( "no Olympus header\n" )
+        }
+        t := &tiffReader{ data: c }         // offsets from the maker note
+        switch string( order ) {
+        case "II":  t.order = binary.LittleEndian
+        case "MM":  t.order = binary.BigEndian
+        default:    return nil, 0, fmt.Errorf( "invalid byte order\n" )
+        }
+        return t, offset, nil
+    },
+    tags: map[uint16]makerTag{
+        0x0000: { "MakerNoteVersion", makerText },
+        0x0104: { "BodyFirmwareVersion", makerText },
+        0x0200: { "SpecialMode", nil },
+        0x0201: { "Quality", nil },
+        0x0207: { "CameraType", makerText },
+        0x0209: { "CameraID", makerText },
+        0x2010: { "Equipment", nil },
+        0x2020: { "CameraSettings", nil },
+    },
+    subIfds: map[uint16]makerSubIfd{
+        0x2010: { "Equipment", map[uint16]makerTag{
+                    0x0000: { "EquipmentVersion", makerText },
+                    0x0100: { "CameraType2", makerText },
+                    0x0101: { "SerialNumber", makerText },
+                    0x0102: { "InternalSerialNumber", makerText },
+                    0x0201: { "LensType", nil },
+                    0x0202: { "LensSerialNumber", makerText },
+                    0x0203: { "LensModel", makerText },
+                    0x0204: { "LensFirmwareVersion", nil } } },
+        0x2020: { "CameraSettings", map[uint16]makerTag{
+                    0x0100: { "PreviewImageValid", nil },
+                    0x0101: { "PreviewImageStart", nil },
+                    0x0102: { "PreviewImageLength", nil },
+                    0x0200: { "ExposureMode", makerNames( map[int]string{
+                                1: "Manual", 2: "Program",
+                                3: "Aperture-priority AE",
+                                4: "Shutter speed priority AE",
+                                5: "Program-shift" } ) },
+                    0x0301: { "FocusMode", makerNames( map[int]string{
+                                0: "Single AF", 1: "Sequential shooting AF",
+                                2: "Continuous AF", 3: "Multi AF",
+                                4: "Face detect", 10: "MF" } ) } } },
+    },
+}
+
+var panasonicVendor = makerVendor{
+    name: "Panasonic", makes: []string{ "PANASONIC" },
+    headers: []string{ "Panasonic\x00" },
+    locate: func( mn *makerNote ) (*tiffReader, uint32, error) {
+        if ! bytes.HasPrefix( mn.content, []byte( "Panasonic\x00" ) ) {
+            return nil, 0, fmt.Errorf( "no Panasonic header\n" )
+        }
+        return &tiffReader{ data: mn.tiff, order: mn.order },
+               uint32(mn.offset + 12), nil
+    },
+    tags: map[uint16]makerTag{
+        0x0001: { "ImageQuality", makerNames( map[int]string{
+                    2: "High", 3: "Normal", 6: "Very High", 7: "RAW",
+                    9: "Motion Picture" } ) },
+        0x0002: { "FirmwareVersion", nil },
+        0x0003: { "WhiteBalance", nil },
+        0x0007: { "FocusMode", makerNames( map[int]string{
+                    1: "Auto", 2: "Manual", 4: "Auto, Focus button",
+                    5: "Auto, Continuous", 6: "AF-S", 7: "AF-C",
+                    8: "AF-F" } ) },
+        0x000f: { "AFAreaMode", nil },
+        0x001a: { "ImageStabilization", nil },
+        0x0025: { "InternalSerialNumber", makerText },
+        0x0051: { "LensType", makerText },
+        0x0052: { "LensSerialNumber", makerText },
+        0x0053: { "AccessoryType", makerText },
+    },
+}
+
+var makerVendors = []*makerVendor{ &canonVendor, &nikonVendor, &sonyVendor,
+                                   &fujifilmVendor, &olympusVendor,
+                                   &panasonicVendor }
+
+// makerVendorOf returns the vendor given by the Exif Make tag, or by the
+// maker note header if maker is empty, or nil if it is not supported
+func makerVendorOf( maker string, content []byte ) *makerVendor {
+    maker = strings.ToUpper( strings.TrimSpace( maker ) )
+    for _, v := range makerVendors {
+        for _, m := range v.makes {
+            if maker != "" && strings.HasPrefix( maker, m ) {
+                return v
+            }
+        }
+        for _, h := range v.headers {
+            if maker == "" && bytes.HasPrefix( content, []byte( h ) ) {
+                return v
+            }
+        }
+    }
+    return nil
+}
+
+// formatMakerIfd prints the entries of the vendor IFD at offset, and returns
+// the offsets of its sub IFDs
+func formatMakerIfd( w io.Writer, t *tiffReader, offset uint32,
+                     tags map[uint16]makerTag,
+                     subIfds map[uint16]makerSubIfd ) (subs []uint16,
+                                                       offsets []uint32) {
+    entries, _, err := t.readIfd( offset )
+    if err != nil {
+        fmt.Fprintf( w, "  %s\n", trimNewline( err.Error() ) )
+        return
+    }
+    for i := range entries {
+        e := &entries[i]
+        mt := newMetaTag( t, e, nil )
+        tag, known := tags[e.tag]
+        if ! known {
+            tag.name = fmt.Sprintf( "Tag 0x%04x", e.tag )
+        }
+        value := rawMakerValue( mt.Value )
+        switch {
+        case mt.Error != "":
+            value = mt.Error
+        case tag.decode != nil:
+            value = tag.decode( mt.Value )
+        }
+        fmt.Fprintf( w, "  %s:\n", tag.name )
+        for _, l := range strings.Split( value, "\n" ) {
+            fmt.Fprintf( w, "    %s\n", l )
+        }
+        fmt.Fprintf( w, "\n" )
+        if _, ok := subIfds[e.tag]; ok {
+            switch {            // sub IFDs as pointers or embedded
+            case e.count == 1 && ( e.typ == tiffLong || e.typ == tiffIfd ):
+                offsets = append( offsets, t.uint32Value( e ) )
+            case e.typ == tiffUndefined && e.size() > 4:
+                offsets = append( offsets, t.order.Uint32( e.value ) )
+            default:
+                continue
+            }
+            subs = append( subs, e.tag )
+        }
+    }
+    return
+}
+
+// showsMakerNote returns true if the maker note is requested by -meta, with
+// the whole app1 segment or with its sid 5
+func (mid *metaIds) showsMakerNote( ) bool {
+    if mid.appId != 1 && mid.appId != -1 {
+        return false
+    }
+    for _, sid := range mid.sIds {
+        if sid == 5 {
+            return true
+        }
+    }
+    return len(mid.sIds) == 0
+}
+
+// formatMakerNote prints the decoded maker note of the first Exif segment in
+// data, if its vendor is supported
+func formatMakerNote( w io.Writer, data []byte ) {
+    l := scanLayout( data )
+    for i := range l.segments {
+        s := &l.segments[i]
+        if isImageDataMarker( s.marker ) || s.marker == markerEOI {
+            return
+        }
+        if s.marker != markerAPP0 + 1 || exifTiffData( s.data( data ) ) == nil {
+            continue
+        }
+        mn := findMakerNote( data, s )
+        if mn == nil {
+            return
+        }
+        tags := exifAsciiTags( data, &fileLayout{ segments: []segment{ *s } } )
+        v := makerVendorOf( tags[metaTemplateTags["Make"]], mn.content )
+        if v == nil {
+            return
+        }
+        fmt.Fprintf( w, "------ Maker Note Metadata:\n" )
+        fmt.Fprintf( w, "\n--- %s maker note IFD (id 5, @0x%04x, %d bytes)\n",
+                     v.name, mn.tiffStart + mn.offset, len(mn.content) )
+        t, offset, err := v.locate( mn )
+        if err != nil {
+            fmt.Fprintf( w, "  not decoded: %s\n", trimNewline( err.Error() ) )
+        } else {
+            subs, offsets := formatMakerIfd( w, t, offset, v.tags, v.subIfds )
+            for j, tag := range subs {
+                sub := v.subIfds[tag]
+                fmt.Fprintf( w, "--- %s maker note %s\n", v.name, sub.name )
+                formatMakerIfd( w, t, offsets[j], sub.tags, nil )
+            }
+        }
+        fmt.Fprintf( w, "------\n" )
+        return
+    }
+}
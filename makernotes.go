@@ -0,0 +1,240 @@
+
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "strings"
+)
+
+// Maker note previews: many cameras store a large preview jpeg picture in the
+// proprietary maker note of the Exif IFD. The structure of maker notes depends
+// on the vendor: most are IFDs, preceded or not by a vendor header, with value
+// offsets relative either to the Exif TIFF header, to an inner TIFF header or
+// to the maker note itself.
+
+const (
+    tagMakerNote                = 0x927c
+
+    tagCanonPreviewInfo         = 0x00b6
+    tagNikonPreviewIfd          = 0x0011
+    tagOlympusCameraSettings    = 0x2010
+    tagOlympusPreviewStart      = 0x0102
+    tagOlympusPreviewLength     = 0x0103
+    tagSonyPreviewImage         = 0x2001
+)
+
+// makerNote locates the maker note of an Exif segment
+type makerNote struct {
+    tiff            []byte      // Exif TIFF data
+    tiffStart       int         // file offset of the TIFF data
+    offset          int         // maker note offset in TIFF data
+    content         []byte
+    order           binary.ByteOrder
+}
+
+func findMakerNote( data []byte, s *segment ) *makerNote {
+    tiff := exifTiffData( s.data( data ) )
+    if tiff == nil {
+        return nil
+    }
+    t, err := newTiffReader( tiff )
+    if err != nil {
+        return nil
+    }
+    entries, _, err := t.readIfd( t.first )
+    if err != nil {
+        return nil
+    }
+    for i := range entries {
+        if entries[i].tag != tagExifIfd {
+            continue
+        }
+        exif, _, err := t.readIfd( t.uint32Value( &entries[i] ) )
+        if err != nil {
+            return nil
+        }
+        for j := range exif {
+            e := &exif[j]
+            if e.tag != tagMakerNote || e.size() <= 4 {
+                continue
+            }
+            content, err := t.valueData( e )
+            if err != nil {
+                return nil
+            }
+            return &makerNote{ tiff: tiff,
+                               tiffStart: s.offset + 4 + len(exifHeader),
+                               offset: int(t.order.Uint32( e.value )),
+                               content: content, order: t.order }
+        }
+    }
+    return nil
+}
+
+// previewImage returns an embedded image from a byte range in reader data, where
+// base is the file offset of the reader data
+func previewImage( source string, t *tiffReader, base int,
+                   start, length uint32 ) *embeddedImage {
+    if length == 0 || uint64(start) + uint64(length) > uint64(len(t.data)) {
+        return nil
+    }
+    ei := &embeddedImage{ source: source, offset: base + int(start),
+                          length: int(length),
+                          data: t.data[start:start+length] }
+    ei.setJpegInfo()
+    return ei
+}
+
+// canonPreview: the maker note is an IFD without header, with offsets relative
+// to the Exif TIFF header. PreviewImageInfo gives the preview length at index
+// 2 and its start at index 5.
+func (mn *makerNote) canonPreview( ) *embeddedImage {
+    t := &tiffReader{ data: mn.tiff, order: mn.order }
+    entries, _, err := t.readIfd( uint32(mn.offset) )
+    if err != nil {
+        return nil
+    }
+    for i := range entries {
+        e := &entries[i]
+        if e.tag != tagCanonPreviewInfo || e.typ != tiffLong || e.count < 6 {
+            continue
+        }
+        v, err := t.valueData( e )
+        if err != nil {
+            return nil
+        }
+        return mn.preview( "Canon maker note preview", t, mn.tiffStart,
+                             t.order.Uint32( v[20:] ), t.order.Uint32( v[8:] ) )
+    }
+    return nil
+}
+
+// nikonPreview: the maker note starts with "Nikon\0", a version and an inner
+// TIFF header to which all offsets are relative. The preview IFD gives the
+// preview start and length as in IFD1.
+func (mn *makerNote) nikonPreview( ) *embeddedImage {
+    if len(mn.content) < 18 || ! bytes.HasPrefix( mn.content, []byte( "Nikon\x00" ) ) {
+        return nil
+    }
+    t, err := newTiffReader( mn.content[10:] )
+    if err != nil {
+        return nil
+    }
+    entries, _, err := t.readIfd( t.first )
+    if err != nil {
+        return nil
+    }
+    for i := range entries {
+        if entries[i].tag != tagNikonPreviewIfd {
+            continue
+        }
+        preview, _, err := t.readIfd( t.uint32Value( &entries[i] ) )
+        if err != nil {
+            return nil
+        }
+        var start, length uint32
+        for j := range preview {
+            switch preview[j].tag {
+            case tagJPEGInterchangeFormat:
+                start = t.uint32Value( &preview[j] )
+            case tagJPEGInterchangeFormatLength:
+                length = t.uint32Value( &preview[j] )
+            }
+        }
+        return mn.preview( "Nikon maker note preview", t,
+                             mn.tiffStart + mn.offset + 10, start, length )
+    }
+    return nil
+}
+
+// olympusPreview: new style maker notes start with "OLYMPUS\0" followed by a
+// byte order mark, with offsets relative to the maker note. The camera
+// settings IFD gives the preview start and length.
+func (mn *makerNote) olympusPreview( ) *embeddedImage {
+    if len(mn.content) < 16 ||
+       ! bytes.HasPrefix( mn.content, []byte( "OLYMPUS\x00" ) ) {
+        return nil
+    }
+    t := &tiffReader{ data: mn.content }
+    switch string( mn.content[8:10] ) {
+    case "II":  t.order = binary.LittleEndian
+    case "MM":  t.order = binary.BigEndian
+    default:    return nil
+    }
+    entries, _, err := t.readIfd( 12 )
+    if err != nil {
+        return nil
+    }
+    for i := range entries {
+        if entries[i].tag != tagOlympusCameraSettings {
+            continue
+        }
+        settings, _, err := t.readIfd( t.uint32Value( &entries[i] ) )
+        if err != nil {
+            return nil
+        }
+        var start, length uint32
+        for j := range settings {
+            switch settings[j].tag {
+            case tagOlympusPreviewStart:
+                start = t.uint32Value( &settings[j] )
+            case tagOlympusPreviewLength:
+                length = t.uint32Value( &settings[j] )
+            }
+        }
+        return mn.preview( "Olympus maker note preview", t,
+                             mn.tiffStart + mn.offset, start, length )
+    }
+    return nil
+}
+
+// sonyPreview: the maker note starts with "SONY DSC " followed by an IFD with
+// offsets relative to the Exif TIFF header. The preview jpeg data is the value
+// of the PreviewImage tag.
+func (mn *makerNote) sonyPreview( ) *embeddedImage {
+    if ! bytes.HasPrefix( mn.content, []byte( "SONY DSC " ) ) {
+        return nil
+    }
+    t := &tiffReader{ data: mn.tiff, order: mn.order }
+    entries, _, err := t.readIfd( uint32(mn.offset + 12) )
+    if err != nil {
+        return nil
+    }
+    for i := range entries {
+        e := &entries[i]
+        if e.tag != tagSonyPreviewImage || e.size() <= 4 {
+            continue
+        }
+        return mn.preview( "Sony maker note preview", t, mn.tiffStart,
+                             t.order.Uint32( e.value ), uint32(e.size()) )
+    }
+    return nil
+}
+
+// makerNoteImages returns the preview found in the maker note of an Exif
+// segment, according to the maker note header or to the camera make.
+func makerNoteImages( data []byte, s *segment ) (images []*embeddedImage) {
+    mn := findMakerNote( data, s )
+    if mn == nil {
+        return
+    }
+    tags := exifAsciiTags( data, &fileLayout{ segments: []segment{ *s } } )
+    vendor := strings.TrimSpace( tags[metaTemplateTags["Make"]] )
+    var ei *embeddedImage
+    switch {
+    case bytes.HasPrefix( mn.content, []byte( "Nikon\x00" ) ):
+        ei = mn.nikonPreview()
+    case bytes.HasPrefix( mn.content, []byte( "OLYMPUS\x00" ) ):
+        ei = mn.olympusPreview()
+    case bytes.HasPrefix( mn.content, []byte( "SONY DSC " ) ):
+        ei = mn.sonyPreview()
+    case vendor == "Canon":
+        ei = mn.canonPreview()
+    }
+    if ei != nil {
+        ei.id = "maker"
+        images = append( images, ei )
+    }
+    return
+}
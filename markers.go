@@ -0,0 +1,125 @@
+
+package main
+
+import (
+    "fmt"
+    "sort"
+)
+
+// Marker statistics: a compact structural fingerprint of the file, with the
+// number of each marker, unusual marker orderings and padding between segments.
+
+type markerCount struct {
+    marker          byte
+    count           int
+    first           int     // offset of first occurrence
+}
+
+// orderingAnomalies returns a description of the unusual marker orderings
+func orderingAnomalies( l *fileLayout ) (anomalies []string) {
+    add := func( f string, a ...interface{} ) {
+        anomalies = append( anomalies, fmt.Sprintf( f, a... ) )
+    }
+    if len(l.segments) == 0 || l.segments[0].marker != markerSOI ||
+       l.segments[0].offset != 0 {
+        add( "file does not start with SOI" )
+    }
+    var nSOI, nEOI, nSOF, nSOS int    // nSOF is for the current image
+    for i, s := range l.segments {
+        switch {
+        case s.marker == markerSOI:
+            nSOI ++
+            nSOF = 0
+            if nSOI > 1 && nEOI < nSOI - 1 {
+                add( "duplicate SOI @0x%x", s.offset )
+            }
+        case s.marker == markerEOI:
+            nEOI ++
+            if nEOI > nSOI {
+                add( "duplicate EOI @0x%x", s.offset )
+            }
+        case isSOF( s.marker ):
+            nSOF ++
+            if nSOF > 1 {
+                add( "additional frame header %s @0x%x",
+                     markerName( s.marker ), s.offset )
+            }
+        case s.marker == markerSOS:
+            if nSOF == 0 {
+                add( "SOS before any frame header @0x%x", s.offset )
+            }
+            nSOS ++
+        case s.marker >= markerAPP0 && s.marker <= markerAPP15:
+            if nSOF > 0 {
+                add( "%s after frame header @0x%x", markerName( s.marker ),
+                     s.offset )
+            }
+            if s.marker == markerAPP0 && i > 1 &&
+               l.segments[i-1].marker != markerAPP0 {
+                add( "APP0 not immediately after SOI @0x%x", s.offset )
+            }
+        }
+    }
+    if nSOI > 1 && nEOI == nSOI {
+        add( "%d concatenated images", nSOI )
+    }
+    if nSOS == 0 {
+        add( "no scan" )
+    }
+    if nEOI == 0 {
+        add( "no EOI" )
+    }
+    if l.truncated {
+        add( "truncated segment at end of file" )
+    }
+    return
+}
+
+func formatMarkerStats( l *fileLayout ) {
+    counts := make( map[byte]*markerCount )
+    nRST := 0
+    for _, s := range l.segments {
+        if s.marker >= markerRST0 && s.marker <= markerRST7 {
+            nRST ++
+            continue
+        }
+        if mc, ok := counts[s.marker]; ok {
+            mc.count ++
+        } else {
+            counts[s.marker] = &markerCount{ s.marker, 1, s.offset }
+        }
+    }
+    list := make( []*markerCount, 0, len(counts) )
+    for _, mc := range counts {
+        list = append( list, mc )
+    }
+    sort.Slice( list, func( i, j int ) bool {
+        return list[i].first < list[j].first
+    })
+
+    fmt.Printf( "Marker statistics:\n" )
+    fmt.Printf( "  %-8s %6s  %s\n", "Marker", "Count", "First offset" )
+    for _, mc := range list {
+        fmt.Printf( "  %-8s %6d  0x%x\n", markerName( mc.marker ), mc.count,
+                    mc.first )
+    }
+    if nRST > 0 {
+        fmt.Printf( "  %-8s %6d\n", "RSTn", nRST )
+    }
+    garbage := 0
+    for _, g := range l.garbage {
+        garbage += g.length
+    }
+    fmt.Printf( "  Fill bytes: %d, padding bytes between segments: %d in %d " +
+                "places, trailing bytes: %d\n", l.fillBytes, garbage,
+                len(l.garbage), l.trailing.length )
+    anomalies := orderingAnomalies( l )
+    if len(anomalies) == 0 {
+        fmt.Printf( "  No ordering anomaly\n" )
+        return
+    }
+    fmt.Printf( "  Ordering anomalies:\n" )
+    for _, a := range anomalies {
+        fmt.Printf( "    %s\n", a )
+    }
+}
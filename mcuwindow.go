@@ -0,0 +1,185 @@
+
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// MCU window (-b and -e with -mcu or -du): the library prints the MCUs of each
+// scan whose number, counted from 0 in each scan, is in the window, and prints
+// nothing if the window is beyond the scans. The number of MCUs of each scan
+// of the first frame is computed from the frame and scan headers, in order to
+// report the usable range and to warn when the window is out of range.
+// With -ri, the window is given as a restart interval number instead, which
+// is converted for each file into the MCUs of that interval, using the
+// restart interval defined by the DRI segment in effect for the first scan.
+
+// parseMcuEnd parses the -e value: an MCU number, or +N for N MCUs after the
+// begin MCU
+func parseMcuEnd( e string, begin uint ) (uint, error) {
+    if e == "" {
+        return END, nil
+    }
+    relative := strings.HasPrefix( e, "+" )
+    v, err := strconv.ParseUint( strings.TrimPrefix( e, "+" ), 0, 64 )
+    if err != nil {
+        return 0, fmt.Errorf( "invalid -e=%s (<mcu> or +<count>)\n", e )
+    }
+    if relative {
+        if v > uint64(END - begin) {
+            return END, nil
+        }
+        return begin + uint(v), nil
+    }
+    if uint(v) < begin {
+        return 0, fmt.Errorf( "-e=%s is before -b=%d\n", e, begin )
+    }
+    return uint(v), nil
+}
+
+// restartIntervals returns the restart interval, in MCUs, in effect for each
+// scan of the first frame in data (0 if there is none)
+func restartIntervals( data []byte, l *fileLayout ) (intervals []int) {
+    ri, frames := 0, 0
+    for i := range l.segments {
+        s := &l.segments[i]
+        switch {
+        case s.marker == markerEOI:
+            return
+        case isSOF( s.marker ):
+            if frames ++; frames > 1 {
+                return                  // first frame only
+            }
+        case s.marker == markerDRI:
+            if d := s.data( data ); len(d) >= 2 {
+                ri = int(d[0]) << 8 | int(d[1])
+            }
+        case s.marker == markerSOS && frames == 1:
+            intervals = append( intervals, ri )
+        }
+    }
+    return
+}
+
+// forRestartInterval returns the arguments to use for the file at path, with
+// the MCU window set to the restart interval given by -ri, or with MCU tracing
+// disabled if the file has no restart interval
+func (process *jpgArgs) forRestartInterval( path string, data []byte,
+                                            rep *fileReport ) *jpgArgs {
+    if process.restartInterval < 0 {
+        return process
+    }
+    data, err := inputData( path, data )
+    if err != nil {
+        return process
+    }
+    p := *process
+    intervals := restartIntervals( data, scanLayout( data ) )
+    if len(intervals) == 0 || intervals[0] == 0 {
+        text := fmt.Sprintf( "MCU window: -ri=%d ignored, the first scan " +
+                             "has no restart interval", p.restartInterval )
+        fmt.Printf( "%s\n", text )
+        rep.addMessage( warningSeverity, codeMcuWindow, text )
+        p.control.Mcu, p.control.Du = false, false
+        return &p
+    }
+    n := uint(intervals[0])
+    p.control.Begin = uint(p.restartInterval) * n
+    p.control.End = p.control.Begin + n - 1
+    fmt.Printf( "MCU window: restart interval %d (every %d MCUs) is MCUs %d " +
+                "to %d\n", p.restartInterval, n, p.control.Begin,
+                p.control.End )
+    for i, ri := range intervals[1:] {
+        if ri != intervals[0] {
+            fmt.Printf( "MCU window: scan %d has a different restart " +
+                        "interval (%d MCUs), the same MCUs are printed\n",
+                        i + 1, ri )
+        }
+    }
+    return &p
+}
+
+// scanMcus returns the number of MCUs of each scan of the first frame in data
+func scanMcus( data []byte, l *fileLayout ) (counts []int, err error) {
+    var fh *frameHeader
+    for i := range l.segments {
+        s := &l.segments[i]
+        switch {
+        case s.marker == markerEOI:
+            return
+        case isSOF( s.marker ):
+            if fh != nil {
+                return                  // first frame only
+            }
+            if fh, err = parseFrameHeader( s, data ); err != nil {
+                return nil, err
+            }
+        case s.marker == markerSOS && fh != nil:
+            d := s.data( data )
+            if len(d) < 3 {
+                return counts, fmt.Errorf( "scan header is too short\n" )
+            }
+            if d[0] != 1 {              // interleaved
+                nx, ny := fh.mcus()
+                counts = append( counts, nx * ny )
+                continue
+            }
+            ci := -1
+            for j := range fh.comps {
+                if fh.comps[j].id == d[1] {
+                    ci = j
+                }
+            }
+            if ci == -1 {
+                return counts, fmt.Errorf( "scan %d refers to unknown " +
+                                           "component %d\n", len(counts),
+                                           d[1] )
+            }
+            bx, by := fh.compBlocks( ci )
+            counts = append( counts, bx * by )
+        }
+    }
+    return
+}
+
+// formatMcuWindow prints the MCU totals of each scan and the usable range, and
+// warns if the window given by begin and end is beyond all scans
+func formatMcuWindow( data []byte, l *fileLayout, begin, end uint,
+                      rep *fileReport ) {
+    counts, err := scanMcus( data, l )
+    if err != nil {
+        fmt.Printf( "MCU window: %v", err )
+    }
+    if len(counts) == 0 {
+        return
+    }
+    max := 0
+    totals := make( []string, len(counts) )
+    for i, n := range counts {
+        totals[i] = fmt.Sprintf( "scan %d: %d MCUs", i, n )
+        if n > max {
+            max = n
+        }
+    }
+    fmt.Printf( "MCU window: %s (usable range 0 to %d)\n",
+                strings.Join( totals, ", " ), max - 1 )
+    if begin >= uint(max) {
+        text := fmt.Sprintf( "MCU window: -b=%d is beyond the last MCU of all " +
+                             "scans (%d), nothing to print", begin, max - 1 )
+        fmt.Printf( "%s\n", text )
+        rep.addMessage( warningSeverity, codeMcuWindow, text )
+        return
+    }
+    for i, n := range counts {
+        if begin >= uint(n) {
+            fmt.Printf( "MCU window: nothing printed for scan %d (%d MCUs)\n",
+                        i, n )
+        }
+    }
+    if end != END && end >= uint(max) {
+        fmt.Printf( "MCU window: -e=%d is beyond the last MCU, printing up " +
+                    "to the end of each scan\n", end )
+    }
+}
@@ -0,0 +1,559 @@
+
+package main
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+)
+
+// Typed metadata dump: the library formats metadata as text for display only,
+// which loses value types and structure. The metadata containers are read here
+// directly into a model that keeps tag ids, TIFF types and exact values, for
+// ingestion by other tools.
+
+var tiffTypeNames = [...]string{ "", "BYTE", "ASCII", "SHORT", "LONG",
+                                 "RATIONAL", "SBYTE", "UNDEFINED", "SSHORT",
+                                 "SLONG", "SRATIONAL", "FLOAT", "DOUBLE", "IFD" }
+
+var tiffTagNames = map[uint16]string{
+    0x00fe: "NewSubfileType",           0x0100: "ImageWidth",
+    0x0101: "ImageLength",              0x0102: "BitsPerSample",
+    0x0103: "Compression",              0x0106: "PhotometricInterpretation",
+    0x010e: "ImageDescription",         0x010f: "Make",
+    0x0110: "Model",                    0x0111: "StripOffsets",
+    0x0112: "Orientation",              0x0115: "SamplesPerPixel",
+    0x0116: "RowsPerStrip",             0x0117: "StripByteCounts",
+    0x011a: "XResolution",              0x011b: "YResolution",
+    0x011c: "PlanarConfiguration",      0x0128: "ResolutionUnit",
+    0x012d: "TransferFunction",         0x0131: "Software",
+    0x0132: "DateTime",                 0x013b: "Artist",
+    0x013e: "WhitePoint",               0x013f: "PrimaryChromaticities",
+    0x014a: "SubIFDs",                  0x0201: "JPEGInterchangeFormat",
+    0x0202: "JPEGInterchangeFormatLength",
+    0x0211: "YCbCrCoefficients",        0x0212: "YCbCrSubSampling",
+    0x0213: "YCbCrPositioning",         0x0214: "ReferenceBlackWhite",
+    0x02bc: "XMLPacket",                0x4746: "Rating",
+    0x8298: "Copyright",                0x829a: "ExposureTime",
+    0x829d: "FNumber",                  0x83bb: "IPTCNAA",
+    0x8769: "ExifIFDPointer",           0x8773: "InterColorProfile",
+    0x8822: "ExposureProgram",          0x8824: "SpectralSensitivity",
+    0x8825: "GPSInfoIFDPointer",        0x8827: "PhotographicSensitivity",
+    0x8828: "OECF",                     0x8830: "SensitivityType",
+    0x8832: "RecommendedExposureIndex", 0x9000: "ExifVersion",
+    0x9003: "DateTimeOriginal",         0x9004: "DateTimeDigitized",
+    0x9010: "OffsetTime",               0x9011: "OffsetTimeOriginal",
+    0x9012: "OffsetTimeDigitized",      0x9101: "ComponentsConfiguration",
+    0x9102: "CompressedBitsPerPixel",   0x9201: "ShutterSpeedValue",
+    0x9202: "ApertureValue",            0x9203: "BrightnessValue",
+    0x9204: "ExposureBiasValue",        0x9205: "MaxApertureValue",
+    0x9206: "SubjectDistance",          0x9207: "MeteringMode",
+    0x9208: "LightSource",              0x9209: "Flash",
+    0x920a: "FocalLength",              0x9214: "SubjectArea",
+    0x927c: "MakerNote",                0x9286: "UserComment",
+    0x9290: "SubSecTime",               0x9291: "SubSecTimeOriginal",
+    0x9292: "SubSecTimeDigitized",      0xa000: "FlashpixVersion",
+    0xa001: "ColorSpace",               0xa002: "PixelXDimension",
+    0xa003: "PixelYDimension",          0xa004: "RelatedSoundFile",
+    0xa005: "InteroperabilityIFDPointer",
+    0xa20b: "FlashEnergy",              0xa20e: "FocalPlaneXResolution",
+    0xa20f: "FocalPlaneYResolution",    0xa210: "FocalPlaneResolutionUnit",
+    0xa214: "SubjectLocation",          0xa215: "ExposureIndex",
+    0xa217: "SensingMethod",            0xa300: "FileSource",
+    0xa301: "SceneType",                0xa302: "CFAPattern",
+    0xa401: "CustomRendered",           0xa402: "ExposureMode",
+    0xa403: "WhiteBalance",             0xa404: "DigitalZoomRatio",
+    0xa405: "FocalLengthIn35mmFilm",    0xa406: "SceneCaptureType",
+    0xa407: "GainControl",              0xa408: "Contrast",
+    0xa409: "Saturation",               0xa40a: "Sharpness",
+    0xa40b: "DeviceSettingDescription", 0xa40c: "SubjectDistanceRange",
+    0xa420: "ImageUniqueID",            0xa430: "CameraOwnerName",
+    0xa431: "BodySerialNumber",         0xa432: "LensSpecification",
+    0xa433: "LensMake",                 0xa434: "LensModel",
+    0xa435: "LensSerialNumber",         0xa500: "Gamma",
+    0xc4a5: "PrintImageMatching",       0xea1c: "Padding",
+}
+
+var gpsTagNames = map[uint16]string{
+    0x00: "GPSVersionID",               0x01: "GPSLatitudeRef",
+    0x02: "GPSLatitude",                0x03: "GPSLongitudeRef",
+    0x04: "GPSLongitude",               0x05: "GPSAltitudeRef",
+    0x06: "GPSAltitude",                0x07: "GPSTimeStamp",
+    0x08: "GPSSatellites",              0x09: "GPSStatus",
+    0x0a: "GPSMeasureMode",             0x0b: "GPSDOP",
+    0x0c: "GPSSpeedRef",                0x0d: "GPSSpeed",
+    0x0e: "GPSTrackRef",                0x0f: "GPSTrack",
+    0x10: "GPSImgDirectionRef",         0x11: "GPSImgDirection",
+    0x12: "GPSMapDatum",                0x13: "GPSDestLatitudeRef",
+    0x14: "GPSDestLatitude",            0x15: "GPSDestLongitudeRef",
+    0x16: "GPSDestLongitude",           0x17: "GPSDestBearingRef",
+    0x18: "GPSDestBearing",             0x19: "GPSDestDistanceRef",
+    0x1a: "GPSDestDistance",            0x1b: "GPSProcessingMethod",
+    0x1c: "GPSAreaInformation",         0x1d: "GPSDateStamp",
+    0x1e: "GPSDifferential",            0x1f: "GPSHPositioningError",
+}
+
+var interopTagNames = map[uint16]string{
+    0x0001: "InteroperabilityIndex",    0x0002: "InteroperabilityVersion",
+    0x1000: "RelatedImageFileFormat",   0x1001: "RelatedImageWidth",
+    0x1002: "RelatedImageLength",
+}
+
+var mpfTagNames = map[uint16]string{
+    0xb000: "MPFVersion",               0xb001: "NumberOfImages",
+    0xb002: "MPEntry",                  0xb003: "ImageUIDList",
+    0xb004: "TotalFrames",              0xb101: "MPIndividualNum",
+    0xb201: "PanOrientation",           0xb202: "PanOverlapH",
+    0xb203: "PanOverlapV",              0xb204: "BaseViewpointNum",
+    0xb205: "ConvergenceAngle",         0xb206: "BaselineLength",
+    0xb207: "VerticalDivergence",       0xb208: "AxisDistanceX",
+    0xb209: "AxisDistanceY",            0xb20a: "AxisDistanceZ",
+    0xb20b: "YawAngle",                 0xb20c: "PitchAngle",
+    0xb20d: "RollAngle",
+}
+
+// metaRational is a TIFF rational or signed rational value. Value is the
+// decimal value, absent if the denominator is 0.
+type metaRational struct {
+    Numerator       int64       `json:"numerator"`
+    Denominator     int64       `json:"denominator"`
+    Value           *float64    `json:"value,omitempty"`
+}
+
+func newMetaRational( n, d int64 ) metaRational {
+    r := metaRational{ Numerator: n, Denominator: d }
+    if d != 0 {
+        v := float64(n) / float64(d)
+        r.Value = &v
+    }
+    return r
+}
+
+type metaTag struct {
+    Id              string      `json:"id,omitempty"`      // 0x hex tag
+    Name            string      `json:"name"`
+    Type            string      `json:"type"`
+    Count           uint32      `json:"count"`
+    Value           interface{} `json:"value"`
+    Error           string      `json:"error,omitempty"`
+}
+
+type metaGroup struct {
+    Name            string      `json:"name"`
+    Tags            []metaTag   `json:"tags"`
+    Error           string      `json:"error,omitempty"`
+}
+
+type metaContainer struct {
+    Name            string      `json:"name"`
+    Segment         string      `json:"segment"`
+    Offset          int         `json:"offset"`
+    Groups          []metaGroup `json:"groups"`
+}
+
+// finite returns v, or nil if v cannot be represented in JSON
+func finite( v float64 ) interface{} {
+    if math.IsNaN( v ) || math.IsInf( v, 0 ) {
+        return nil
+    }
+    return v
+}
+
+// typedValue returns the values of an entry with a go type matching their
+// TIFF type: a string for ascii, a byte slice for byte and undefined, a number
+// or metaRational for a single value, and a slice for multiple values.
+func (t *tiffReader) typedValue( e *ifdEntry ) (interface{}, error) {
+    v, err := t.valueData( e )
+    if err != nil {
+        return nil, err
+    }
+    switch e.typ {
+    case tiffAscii:
+        return string( bytes.TrimRight( v, "\x00" ) ), nil
+    case tiffByte, tiffUndefined:
+        return v, nil
+    }
+    values := make( []interface{}, e.count )
+    for i := range values {
+        switch e.typ {
+        case tiffSByte:
+            values[i] = int8( v[i] )
+        case tiffShort:
+            values[i] = t.order.Uint16( v[i*2:] )
+        case tiffSShort:
+            values[i] = int16( t.order.Uint16( v[i*2:] ) )
+        case tiffLong, tiffIfd:
+            values[i] = t.order.Uint32( v[i*4:] )
+        case tiffSLong:
+            values[i] = int32( t.order.Uint32( v[i*4:] ) )
+        case tiffRational:
+            values[i] = newMetaRational( int64( t.order.Uint32( v[i*8:] ) ),
+                                         int64( t.order.Uint32( v[i*8+4:] ) ) )
+        case tiffSRational:
+            values[i] = newMetaRational(
+                            int64( int32( t.order.Uint32( v[i*8:] ) ) ),
+                            int64( int32( t.order.Uint32( v[i*8+4:] ) ) ) )
+        case tiffFloat:
+            values[i] = finite( float64( math.Float32frombits(
+                                            t.order.Uint32( v[i*4:] ) ) ) )
+        case tiffDouble:
+            values[i] = finite( math.Float64frombits( t.order.Uint64( v[i*8:] ) ) )
+        }
+    }
+    if len(values) == 1 {
+        return values[0], nil
+    }
+    return values, nil
+}
+
+func newMetaTag( t *tiffReader, e *ifdEntry, names map[uint16]string ) metaTag {
+    mt := metaTag{ Id: fmt.Sprintf( "0x%04x", e.tag ), Name: names[e.tag],
+                   Count: e.count }
+    if mt.Name == "" {
+        mt.Name = fmt.Sprintf( "Tag0x%04x", e.tag )
+    }
+    if e.size() < 0 {
+        mt.Type = fmt.Sprintf( "type%d", e.typ )
+        mt.Error = "unknown type"
+        return mt
+    }
+    mt.Type = tiffTypeNames[e.typ]
+    v, err := t.typedValue( e )
+    if err != nil {
+        mt.Error = trimNewline( err.Error() )
+    }
+    mt.Value = v
+    return mt
+}
+
+func trimNewline( s string ) string {
+    return string( bytes.TrimRight( []byte( s ), "\n" ) )
+}
+
+type tiffGroupReader struct {
+    t               *tiffReader
+    follow          bool        // read sub-IFDs
+    visited         map[uint32]bool
+    groups          []metaGroup
+}
+
+var subIfdGroups = map[uint16]string{ tagExifIfd: "exif", tagGpsIfd: "gps",
+                                      tagInteropIfd: "interop",
+                                      tagSubIfds: "subifd" }
+
+var subIfdTagNames = map[uint16]map[uint16]string{ tagGpsIfd: gpsTagNames,
+                                                   tagInteropIfd: interopTagNames }
+
+// read appends the IFD chain starting at offset as groups named by name from
+// their rank in the chain, followed by the sub-IFDs they refer to. IFDs that
+// were already read are ignored.
+func (gr *tiffGroupReader) read( offset uint32, name func( i int ) string,
+                                 tagNames map[uint16]string ) {
+    for i := 0; offset != 0 && ! gr.visited[offset]; i++ {
+        gr.visited[offset] = true
+        g := metaGroup{ Name: name( i ) }
+        entries, next, err := gr.t.readIfd( offset )
+        if err != nil {
+            g.Error = trimNewline( err.Error() )
+            gr.groups = append( gr.groups, g )
+            return
+        }
+        var subs []*ifdEntry
+        for j := range entries {
+            e := &entries[j]
+            g.Tags = append( g.Tags, newMetaTag( gr.t, e, tagNames ) )
+            if _, ok := subIfdGroups[e.tag]; ok && gr.follow {
+                subs = append( subs, e )
+            }
+        }
+        gr.groups = append( gr.groups, g )
+        for _, e := range subs {
+            sub := subIfdTagNames[e.tag]
+            if sub == nil {
+                sub = tiffTagNames
+            }
+            base := subIfdGroups[e.tag]
+            subName := func( i int ) string {
+                if i == 0 {
+                    return base
+                }
+                return fmt.Sprintf( "%s%d", base, i )
+            }
+            offsets := []uint32{ gr.t.uint32Value( e ) }
+            if e.tag == tagSubIfds && e.count > 1 {
+                values, err := gr.t.valueData( e )
+                if err != nil || e.typ != tiffLong && e.typ != tiffIfd {
+                    continue
+                }
+                offsets = offsets[:0]
+                for j := uint32(0); j < e.count; j++ {
+                    offsets = append( offsets, gr.t.order.Uint32( values[j*4:] ) )
+                }
+            }
+            for _, o := range offsets {
+                gr.read( o, subName, sub )
+            }
+        }
+        offset = next
+    }
+}
+
+// tiffGroups returns the IFD chain of t and, if follow is true, all the
+// sub-IFDs it refers to
+func tiffGroups( t *tiffReader, follow bool, name func( i int ) string,
+                 tagNames map[uint16]string ) []metaGroup {
+    gr := &tiffGroupReader{ t: t, follow: follow,
+                            visited: make( map[uint32]bool ) }
+    gr.read( t.first, name, tagNames )
+    return gr.groups
+}
+
+func exifGroupName( i int ) string {
+    return fmt.Sprintf( "ifd%d", i )
+}
+
+func mpfGroupName( i int ) string {
+    if i == 0 {
+        return "index"
+    }
+    return "attributes"
+}
+
+// jfifGroup returns the fields of a JFIF or JFXX APP0 segment
+func jfifGroup( d []byte ) (name string, g metaGroup, ok bool) {
+    field := func( name, typ string, v interface{} ) {
+        g.Tags = append( g.Tags, metaTag{ Name: name, Type: typ, Count: 1,
+                                          Value: v } )
+    }
+    switch {
+    case bytes.HasPrefix( d, []byte( "JFIF\x00" ) ) && len(d) >= 14:
+        g.Name = "app0"
+        field( "Version", "ASCII", fmt.Sprintf( "%d.%02d", d[5], d[6] ) )
+        field( "Units", "BYTE", d[7] )
+        field( "XDensity", "SHORT", uint16(d[8]) << 8 | uint16(d[9]) )
+        field( "YDensity", "SHORT", uint16(d[10]) << 8 | uint16(d[11]) )
+        field( "XThumbnail", "BYTE", d[12] )
+        field( "YThumbnail", "BYTE", d[13] )
+        return "jfif", g, true
+    case bytes.HasPrefix( d, []byte( "JFXX\x00" ) ) && len(d) >= 6:
+        g.Name = "app0"
+        field( "ExtensionCode", "BYTE", d[5] )
+        return "jfxx", g, true
+    }
+    return
+}
+
+// xmpGroup returns the properties of an XMP packet, by path
+func xmpGroup( name string, packet []byte ) metaGroup {
+    g := metaGroup{ Name: name, Tags: []metaTag{ } }
+    for _, p := range xmpProperties( packet ) {
+        g.Tags = append( g.Tags, metaTag{ Name: p.path, Type: "XMP", Count: 1,
+                                          Value: p.value } )
+    }
+    return g
+}
+
+// photoshopGroups returns the resource blocks of a Photoshop IRB and the
+// IPTC-IIM datasets it includes
+func photoshopGroups( irb []byte ) []metaGroup {
+    ig := metaGroup{ Name: "irb", Tags: []metaTag{ } }
+    blocks, err := irbBlocks( irb )
+    if err != nil {
+        ig.Error = err.Error()
+    }
+    groups := []metaGroup{ }
+    for _, b := range blocks {
+        name, ok := irbNames[b.id]
+        if ! ok {
+            name = fmt.Sprintf( "Resource0x%04x", b.id )
+        }
+        ig.Tags = append( ig.Tags, metaTag{ Id: fmt.Sprintf( "0x%04x", b.id ),
+                                            Name: name, Type: "UNDEFINED",
+                                            Count: uint32(len(b.data)),
+                                            Value: b.data } )
+        if b.id != irbIptc {
+            continue
+        }
+        g := metaGroup{ Name: "iptc", Tags: []metaTag{ } }
+        datasets, err := iptcDatasets( b.data )
+        if err != nil {
+            g.Error = err.Error()
+        }
+        for i := range datasets {
+            ds := &datasets[i]
+            name, ok := iptcNames[uint16(ds.record) << 8 | uint16(ds.dataset)]
+            if ! ok {
+                name = fmt.Sprintf( "Dataset%d:%03d", ds.record, ds.dataset )
+            }
+            g.Tags = append( g.Tags, metaTag{
+                            Id: fmt.Sprintf( "%d:%03d", ds.record, ds.dataset ),
+                            Name: name, Type: "IPTC",
+                            Count: uint32(len(ds.value)),
+                            Value: iptcValue( ds ) } )
+        }
+        groups = append( groups, g )
+    }
+    return append( []metaGroup{ ig }, groups... )
+}
+
+// adobeGroup returns the fields of an Adobe APP14 segment
+func adobeGroup( d []byte ) (g metaGroup, ok bool) {
+    as, ok := parseAdobe( d )
+    if ! ok {
+        return
+    }
+    g.Name = "app14"
+    g.Tags = []metaTag{
+        { Name: "DCTEncodeVersion", Type: "SHORT", Count: 1, Value: as.version },
+        { Name: "APP14Flags0", Type: "SHORT", Count: 1, Value: as.flags0 },
+        { Name: "APP14Flags1", Type: "SHORT", Count: 1, Value: as.flags1 },
+        { Name: "ColorTransform", Type: "BYTE", Count: 1, Value: as.transform },
+    }
+    return g, true
+}
+
+// collectMetadata returns all metadata containers found in data, in file
+// order, ignoring the segments of appended images.
+func collectMetadata( data []byte, l *fileLayout ) (containers []metaContainer) {
+    packets := make( map[int]*xmpPacket )      // by first segment offset
+    for _, p := range xmpPackets( data, l ) {
+        packets[p.offset] = p
+    }
+    irbDone := false
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.marker == markerEOI {
+            break
+        }
+        d := s.data( data )
+        mc := metaContainer{ Segment: markerName( s.marker ), Offset: s.offset }
+        switch {
+        case s.marker == markerAPP0:
+            name, g, ok := jfifGroup( d )
+            if ! ok {
+                continue
+            }
+            mc.Name = name
+            mc.Groups = []metaGroup{ g }
+        case s.marker > markerAPP0 && s.marker <= markerAPP15 &&
+             exifTiffData( d ) != nil:
+            mc.Name = "exif"
+            t, err := newTiffReader( exifTiffData( d ) )
+            if err != nil {
+                mc.Groups = []metaGroup{ { Name: "ifd0",
+                                           Error: trimNewline( err.Error() ) } }
+                break
+            }
+            mc.Groups = tiffGroups( t, true, exifGroupName, tiffTagNames )
+        case s.marker == markerAPP0 + 2 && bytes.HasPrefix( d, []byte( "MPF\x00" ) ):
+            mc.Name = "mpf"
+            t, err := newTiffReader( d[4:] )
+            if err != nil {
+                mc.Groups = []metaGroup{ { Name: "index",
+                                           Error: trimNewline( err.Error() ) } }
+                break
+            }
+            mc.Groups = tiffGroups( t, false, mpfGroupName, mpfTagNames )
+        case s.marker == markerAPP0 + 1 && packets[s.offset] != nil:
+            p := packets[s.offset]
+            mc.Name = "xmp"
+            name := "main"
+            if p.extended {
+                name = "extended"
+            }
+            mc.Groups = []metaGroup{ xmpGroup( name, p.data ) }
+        case s.marker == markerAPP0 + 13 &&
+             bytes.HasPrefix( d, photoshopHeader ) && ! irbDone:
+            irbDone = true              // IRB of all APP13 segments
+            irb, _ := photoshopIrb( data, l )
+            mc.Name = "photoshop"
+            mc.Groups = photoshopGroups( irb )
+        case s.marker == markerAPP0 + 14:
+            g, ok := adobeGroup( d )
+            if ! ok {
+                continue
+            }
+            mc.Name = "adobe"
+            mc.Groups = []metaGroup{ g }
+        case s.marker == markerCOM:
+            mc.Name = "comment"
+            mt := metaTag{ Name: "Comment", Type: "ASCII", Count: uint32(len(d)),
+                           Value: string( d ) }
+            if ! utf8.Valid( d ) {
+                mt.Type, mt.Value = "UNDEFINED", d
+            }
+            mc.Groups = []metaGroup{ { Name: "com", Tags: []metaTag{ mt } } }
+        default:
+            continue
+        }
+        containers = append( containers, mc )
+    }
+    return
+}
+
+type metaDocument struct {
+    Path            string      `json:"path"`
+    Containers      []metaContainer `json:"containers"`
+}
+
+// saveMetadataJson writes all metadata found in data as a json document at
+// output. Byte arrays are encoded in base64.
+func saveMetadataJson( output, path string, data []byte, l *fileLayout ) error {
+    doc := metaDocument{ Path: path, Containers: collectMetadata( data, l ) }
+    if doc.Containers == nil {
+        doc.Containers = []metaContainer{ }
+    }
+    var b bytes.Buffer
+    enc := json.NewEncoder( &b )
+    enc.SetEscapeHTML( false )
+    enc.SetIndent( "", "  " )
+    if err := enc.Encode( &doc ); err != nil {
+        return fmt.Errorf( "unable to encode metadata: %v\n", err )
+    }
+    if err := writeFile( output, b.Bytes(), 0644 ); err != nil {
+        return fmt.Errorf( "unable to save metadata: %v\n", err )
+    }
+    fmt.Printf( "Saved metadata from %d container(s) as %s\n",
+                len(doc.Containers), output )
+    return nil
+}
+
+// flatValue returns a value as a single line string: quoted strings, base64
+// byte arrays, rationals as n/d and multiple values separated by spaces.
+func flatValue( v interface{} ) string {
+    switch v := v.(type) {
+    case nil:
+        return ""
+    case string:
+        return strconv.Quote( v )
+    case []byte:
+        return "base64:" + base64.StdEncoding.EncodeToString( v )
+    case metaRational:
+        return fmt.Sprintf( "%d/%d", v.Numerator, v.Denominator )
+    case []interface{}:
+        values := make( []string, len(v) )
+        for i, e := range v {
+            values[i] = flatValue( e )
+        }
+        return strings.Join( values, " " )
+    }
+    return fmt.Sprint( v )
+}
+
+// formatMetadataFlat prints all metadata tags found in data, one per line
+// as <container>.<group>.<tag>=<value>, for line oriented scripts.
+func formatMetadataFlat( data []byte, l *fileLayout ) {
+    for _, mc := range collectMetadata( data, l ) {
+        for _, g := range mc.Groups {
+            for _, mt := range g.Tags {
+                fmt.Printf( "%s.%s.%s=%s\n", mc.Name, g.Name, mt.Name,
+                            flatValue( mt.Value ) )
+            }
+        }
+    }
+}
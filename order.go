@@ -0,0 +1,178 @@
+
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+    "sort"
+    "strings"
+)
+
+// Metadata segment ordering (-tidyup): some readers only look for metadata
+// where the specifications put it, and ignore or reject files in which an
+// APPn segment follows the tables or the frame header, or in which ICC
+// profile chunks are out of order. With -tidyup, the APPn segments found
+// before the first scan of the copy written with -o are moved right after
+// SOI, in the recommended order:
+//  - JFIF APP0, which must follow SOI, then its JFXX extension,
+//  - Exif APP1, which comes next (immediately after SOI without JFIF),
+//  - XMP APP1, followed by extended XMP segments,
+//  - ICC profile APP2 chunks, contiguous and sorted by sequence number,
+//  - all other APPn segments, in their original order.
+// Other segments (tables, frame header, comments) keep their relative order.
+// Offsets in an MPF segment are relative to the segment itself, and are
+// adjusted if it moves. Segments are not reordered if there is padding
+// between them, since the size of the header would change.
+
+type metadataRank int
+
+const (
+    rankJfif metadataRank = iota
+    rankJfxx
+    rankExif
+    rankXmp
+    rankXmpExtended
+    rankIcc
+    rankOther
+)
+
+var xmpExtendedHeader = []byte( "http://ns.adobe.com/xmp/extension/\x00" )
+
+// metadataSegmentRank returns the rank of the APPn segment s with its name
+func metadataSegmentRank( s *segment, data []byte ) (metadataRank, string) {
+    d := s.data( data )
+    switch {
+    case s.marker == markerAPP0 && bytes.HasPrefix( d, []byte( "JFIF\x00" ) ):
+        return rankJfif, "JFIF APP0"
+    case s.marker == markerAPP0 && bytes.HasPrefix( d, []byte( "JFXX\x00" ) ):
+        return rankJfxx, "JFXX APP0"
+    case s.marker == markerAPP0 + 1 && bytes.HasPrefix( d, exifHeader ):
+        return rankExif, "Exif APP1"
+    case s.marker == markerAPP0 + 1 && bytes.HasPrefix( d, xmpHeader ):
+        return rankXmp, "XMP APP1"
+    case s.marker == markerAPP0 + 1 && bytes.HasPrefix( d, xmpExtendedHeader ):
+        return rankXmpExtended, "extended XMP APP1"
+    case s.marker == markerAPP0 + 2 &&
+         bytes.HasPrefix( d, []byte( "ICC_PROFILE\x00" ) ) && len(d) >= 14:
+        return rankIcc, fmt.Sprintf( "ICC APP2 chunk %d/%d", d[12], d[13] )
+    case s.marker == markerAPP0 + 2 && bytes.HasPrefix( d, []byte( "MPF\x00" ) ):
+        return rankOther, "MPF APP2"
+    case s.marker == markerAPP0 + 2 && bytes.HasPrefix( d, []byte( "FPXR\x00" ) ):
+        return rankOther, "FPXR APP2"
+    }
+    return rankOther, markerName( s.marker )
+}
+
+// adjustMpfOffsets returns a copy of the MPF segment content d with the
+// offsets of its MP entries increased by delta
+func adjustMpfOffsets( d []byte, delta int ) ([]byte, error) {
+    d = append( []byte( nil ), d... )
+    t, err := newTiffReader( d[4:] )
+    if err != nil {
+        return nil, err
+    }
+    entries, _, err := t.readIfd( t.first )
+    if err != nil {
+        return nil, err
+    }
+    for i := range entries {
+        if entries[i].tag != tagMPEntry {
+            continue
+        }
+        v, err := t.valueData( &entries[i] )
+        if err != nil {
+            return nil, err
+        }
+        for n := 0; n + 16 <= len(v); n += 16 {
+            if offset := int(t.order.Uint32( v[n+8:] )); offset != 0 {
+                t.order.PutUint32( v[n+8:], uint32( offset + delta ) )
+            }
+        }
+    }
+    return d, nil
+}
+
+type orderedSegment struct {
+    s               *segment
+    rank            metadataRank
+    name            string
+    sequence        int         // ICC chunk sequence number
+    index           int         // in original order
+}
+
+// reorderMetadata moves the APPn segments of the file at output into the
+// recommended order, and returns the descriptions of the segments moved.
+func reorderMetadata( output string ) ([]string, error) {
+    data, err := os.ReadFile( output )
+    if err != nil {
+        return nil, fmt.Errorf( "reorder: %v\n", err )
+    }
+    l := scanLayout( data )
+    if len(l.segments) == 0 || l.segments[0].marker != markerSOI {
+        return nil, nil
+    }
+    var apps, others []orderedSegment
+    start, end := l.segments[0].end(), 0
+    for i := 1; i < len(l.segments); i++ {
+        s := &l.segments[i]
+        if s.marker == markerSOS || s.marker == markerEOI {
+            end = s.offset
+            break
+        }
+        if s.offset != l.segments[i-1].end() {
+            return []string{ "segments not reordered: padding between " +
+                             "segments" }, nil
+        }
+        o := orderedSegment{ s: s, index: i }
+        if s.marker >= markerAPP0 && s.marker <= markerAPP15 {
+            o.rank, o.name = metadataSegmentRank( s, data )
+            if o.rank == rankIcc {
+                o.sequence = int(s.data( data )[12])
+            }
+            apps = append( apps, o )
+        } else {
+            o.name = markerName( s.marker )
+            others = append( others, o )
+        }
+    }
+    if end == 0 {
+        return nil, nil
+    }
+    sort.SliceStable( apps, func( i, j int ) bool {
+        if apps[i].rank != apps[j].rank {
+            return apps[i].rank < apps[j].rank
+        }
+        return apps[i].sequence < apps[j].sequence
+    } )
+    order := append( apps, others... )
+    var b bytes.Buffer
+    b.Write( data[:start] )
+    var moved []string
+    for i, o := range order {
+        s := o.s
+        at := b.Len()
+        if o.index != i + 1 && i < len(apps) {
+            moved = append( moved, fmt.Sprintf( "%s moved from 0x%x to 0x%x",
+                                                o.name, s.offset, at ) )
+        }
+        if strings.HasPrefix( o.name, "MPF" ) && at != s.offset {
+            d, err := adjustMpfOffsets( s.data( data ), s.offset - at )
+            if err != nil {
+                return nil, fmt.Errorf( "reorder: MPF: %v", err )
+            }
+            b.Write( data[s.offset:s.offset+4] )
+            b.Write( d )
+            continue
+        }
+        b.Write( data[s.offset:s.end()] )
+    }
+    if len(moved) == 0 {
+        return nil, nil
+    }
+    b.Write( data[end:] )
+    if err = writeFile( output, b.Bytes(), 0644 ); err != nil {
+        return nil, fmt.Errorf( "reorder: %v\n", err )
+    }
+    return moved, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+// mpfSegment returns an MPF APP2 segment listing the primary image and a
+// second image at offset, relative to the MP endian field
+func mpfSegment( offset, size uint32 ) []byte {
+    be := binary.BigEndian
+    t := []byte( "MPF\x00MM\x00*\x00\x00\x00\x08" )
+    t = append( t, 0, 1 )                               // MP index IFD at 8
+    e := make( []byte, 12 )
+    be.PutUint16( e, tagMPEntry )
+    be.PutUint16( e[2:], tiffUndefined )
+    be.PutUint32( e[4:], 32 )
+    be.PutUint32( e[8:], 26 )
+    t = append( append( t, e... ), 0, 0, 0, 0 )
+    entries := make( []byte, 32 )                       // at 26
+    be.PutUint32( entries, 0x20030000 )
+    be.PutUint32( entries[16:], 0x00010001 )
+    be.PutUint32( entries[20:], size )
+    be.PutUint32( entries[24:], offset )
+    return segmentBytesOf( markerAPP0 + 2, append( t, entries... ) )
+}
+
+// TestReorderMetadata checks that -tidyup puts the APPn segments in the
+// recommended order, keeps all segments and the scans, and keeps the MPF
+// offsets pointing at the second image.
+func TestReorderMetadata( t *testing.T ) {
+    picture := testsetData( t, "baseline-420.jpg" )
+    l := scanLayout( picture )
+    jfifEnd, sos := l.segments[1].end(), 0
+    for i := range l.segments {
+        if l.segments[i].marker == markerSOS {
+            sos = l.segments[i].offset
+            break
+        }
+    }
+    icc := func( n byte ) []byte {
+        d := append( []byte( "ICC_PROFILE\x00" ), n, 2 )
+        return segmentBytesOf( markerAPP0 + 2, append( d, "profile"... ) )
+    }
+    exif := append( append( []byte( nil ), exifHeader... ), gpsTiff()... )
+    xmp := append( append( []byte( nil ), xmpHeader... ), "<x:xmpmeta/>"... )
+    pieces := map[string][]byte{
+        "JFIF APP0":            picture[2:jfifEnd],
+        "Exif APP1":            segmentBytesOf( markerAPP0 + 1, exif ),
+        "XMP APP1":             segmentBytesOf( markerAPP0 + 1, xmp ),
+        "ICC APP2 chunk 1/2":   icc( 1 ),
+        "ICC APP2 chunk 2/2":   icc( 2 ),
+        "MPF APP2":             nil,    // made once its offset is known
+        "tables":               picture[jfifEnd:sos],   // with comments
+    }
+    tests := []struct {
+        name    string
+        layout  []string            // pieces before the scan
+        want    []string            // expected order
+    }{
+        { "ordered",
+          []string{ "JFIF APP0", "Exif APP1", "MPF APP2", "tables" },
+          []string{ "JFIF APP0", "Exif APP1", "MPF APP2", "tables" } },
+        { "MPF first",
+          []string{ "JFIF APP0", "MPF APP2", "XMP APP1", "Exif APP1",
+                    "tables" },
+          []string{ "JFIF APP0", "Exif APP1", "XMP APP1", "MPF APP2",
+                    "tables" } },
+        { "MPF after tables",
+          []string{ "JFIF APP0", "tables", "ICC APP2 chunk 2/2",
+                    "MPF APP2", "ICC APP2 chunk 1/2" },
+          []string{ "JFIF APP0", "ICC APP2 chunk 1/2", "ICC APP2 chunk 2/2",
+                    "MPF APP2", "tables" } },
+    }
+    for _, tc := range tests {
+        t.Run( tc.name, func( t *testing.T ) {
+            mpfSize := len(mpfSegment( 0, 0 ))
+            size := 2 + len(picture) - sos
+            for _, name := range tc.layout {
+                if name == "MPF APP2" {
+                    size += mpfSize
+                } else {
+                    size += len(pieces[name])
+                }
+            }
+            data := append( []byte( nil ), picture[:2]... )
+            for _, name := range tc.layout {
+                piece := pieces[name]
+                if name == "MPF APP2" {
+                    piece = mpfSegment( uint32( size - len(data) - 8 ),
+                                        uint32( len(picture) ) )
+                }
+                data = append( data, piece... )
+            }
+            data = append( data, picture[sos:]... )
+            data = append( data, picture... )           // second image
+            path := filepath.Join( t.TempDir(), "out.jpg" )
+            if err := os.WriteFile( path, data, 0644 ); err != nil {
+                t.Fatal( err )
+            }
+            moved, err := reorderMetadata( path )
+            if err != nil {
+                t.Fatal( err )
+            }
+            out, err := os.ReadFile( path )
+            if err != nil {
+                t.Fatal( err )
+            }
+            if reflect.DeepEqual( tc.layout, tc.want ) {
+                if moved != nil || ! bytes.Equal( out, data ) {
+                    t.Errorf( "ordered segments moved: %q", moved )
+                }
+                return
+            }
+            var order []string
+            ol := scanLayout( out )
+            for i := 1; i < len(ol.segments); i++ {
+                s := &ol.segments[i]
+                if s.marker == markerSOS {
+                    break
+                }
+                name := "tables"
+                if s.marker >= markerAPP0 && s.marker <= markerAPP15 {
+                    _, name = metadataSegmentRank( s, out )
+                } else if order[len(order)-1] == name {
+                    continue
+                }
+                order = append( order, name )
+            }
+            if ! reflect.DeepEqual( order, tc.want ) {
+                t.Errorf( "order %q, expected %q", order, tc.want )
+            }
+            tail := len(picture) - sos + len(picture)   // scans, second image
+            if len(out) != len(data) ||
+               ! bytes.Equal( out[len(out)-tail:], data[len(data)-tail:] ) {
+                t.Errorf( "scans or second image modified" )
+            }
+            var images []*embeddedImage
+            for i := range ol.segments {
+                images = append( images,
+                                 mpfImages( out, &ol.segments[i] )... )
+            }
+            if len(images) != 2 {
+                t.Fatalf( "%d MPF images, expected 2", len(images) )
+            }
+            if second := len(out) - len(picture); images[1].offset != second ||
+               ! bytes.Equal( images[1].data, picture ) {
+                t.Errorf( "MPF second image at 0x%x, expected 0x%x",
+                          images[1].offset, second )
+            }
+            if again, _ := reorderMetadata( path ); again != nil {
+                t.Errorf( "reordered segments moved again: %q", again )
+            }
+        } )
+    }
+}
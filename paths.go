@@ -0,0 +1,109 @@
+
+package main
+
+import (
+    "path/filepath"
+    "runtime"
+    "strings"
+    "unicode"
+)
+
+// File name handling: output paths given in options may contain ':' and ','
+// (Windows drive letters, names in archives), may be longer than the historic
+// Windows limit, and names generated from input files or metadata may contain
+// characters that are reserved on some systems.
+
+// maxShortPath is the length from which Windows requires the \\?\ prefix
+const maxShortPath = 248
+
+// longPath returns a path usable on Windows whatever its length, by making it
+// absolute with the \\?\ prefix if it is too long. Paths are not modified on
+// other systems, or if they already have the prefix.
+func longPath( p string ) string {
+    if runtime.GOOS != "windows" || len(p) < maxShortPath ||
+       strings.HasPrefix( p, `\\?\` ) {
+        return p
+    }
+    abs, err := filepath.Abs( p )
+    if err != nil {
+        return p
+    }
+    if strings.HasPrefix( abs, `\\` ) {         // UNC path \\server\share
+        return `\\?\UNC\` + abs[2:]
+    }
+    return `\\?\` + abs
+}
+
+var reservedNames = map[string]bool{
+    "CON": true, "PRN": true, "AUX": true, "NUL": true,
+    "COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+    "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+    "LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+    "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true }
+
+// sanitizeFileName returns name (a single path element) with the characters
+// that are reserved on Windows or are control characters replaced by '_',
+// without trailing dots or spaces and not using a reserved device name.
+// Non-ASCII characters are kept unchanged.
+func sanitizeFileName( name string ) string {
+    name = strings.Map( func( r rune ) rune {
+        if unicode.IsControl( r ) || strings.ContainsRune( `<>:"/\|?*`, r ) ||
+           r == unicode.ReplacementChar {
+            return '_'
+        }
+        return r
+    }, name )
+    name = strings.TrimRight( name, ". " )
+    base := strings.ToUpper( strings.SplitN( name, ".", 2 )[0] )
+    if reservedNames[base] {
+        name = "_" + name
+    }
+    if name == "" {
+        name = "_"
+    }
+    return name
+}
+
+// outputPath returns the path to use for an output file given as p in an
+// option, with its file name sanitized if requested.
+func outputPath( p string, sanitize bool ) string {
+    if p == "" {
+        return p
+    }
+    if sanitize {
+        dir, name := filepath.Split( p )
+        p = dir + sanitizeFileName( name )
+    }
+    return longPath( p )
+}
+
+// splitSpecs splits a list of <id>:<path> specifications separated by ','
+// where paths may themselves contain ',': a ',' separates two specifications
+// only if it is followed by a number, an embedded image id or a JUMBF box path
+// and ':'.
+func splitSpecs( s string ) (specs []string) {
+    for _, part := range strings.Split( s, "," ) {
+        if len(specs) > 0 && ! startsWithId( part ) {
+            specs[len(specs)-1] += "," + part
+            continue
+        }
+        specs = append( specs, part )
+    }
+    return
+}
+
+func startsWithId( s string ) bool {
+    i := strings.IndexByte( s, ':' )
+    if i <= 0 {
+        return false
+    }
+    if isEmbeddedId( s[:i] ) || isJumbfBoxId( s[:i] ) {
+        return true
+    }
+    for _, r := range s[:i] {
+        if r < '0' || r > '9' {
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,106 @@
+
+package main
+
+import (
+    "fmt"
+    "io"
+    "os"
+)
+
+// Batch pipeline: files are processed in three stages connected by channels,
+//  - the read stage reads the next files in memory while the current one is
+//    analysed, so that I/O overlaps the analysis,
+//  - the check stage analyses files in order, printing results as it goes,
+//  - the report stage sends the report of each file to all sinks, so that
+//    formatting and writing machine readable reports overlaps the analysis
+//    of the following files.
+// The check stage stays sequential, since results are printed as they are
+// found and the jpeg library is not safe for concurrent use. New report
+// formats only need to implement reportSink and be registered in sinkFormats
+// (see sinks.go). Reads and writes are limited by -max-write-mbps and
+// -max-open-files (see throttle.go): a throttled check stage blocks the read
+// stage once its channel is full.
+
+const (
+    readAheadFiles  = 2             // files read in advance
+    readAheadLimit  = 64 << 20      // larger files are read when analysed
+)
+
+// reportSink receives the report of each file processed in a batch
+type reportSink interface {
+    name( ) string
+    add( rep *fileReport ) error
+    close( ) error
+}
+
+// checkInput is a file to check, with its content if it was read in advance
+type checkInput struct {
+    path            string
+    index           int         // position in batch, from 1
+    data            []byte      // nil if not read in advance
+}
+
+// inputData returns data if the file at path was read in advance, or reads it
+func inputData( path string, data []byte ) ([]byte, error) {
+    if data != nil {
+        return data, nil
+    }
+    return readFile( path )
+}
+
+// readStage sends the files at paths in order, read in advance if readAhead is
+// true and they are not too large. Files that cannot be read are sent without
+// data, so that the error is reported by the analysis.
+func readStage( paths []string, readAhead bool ) <-chan *checkInput {
+    out := make( chan *checkInput, readAheadFiles )
+    go func( ) {
+        defer close( out )
+        for i, path := range paths {
+            in := &checkInput{ path: path, index: i + 1 }
+            if readAhead {
+                if info, err := os.Stat( path ); err == nil &&
+                   info.Mode().IsRegular() && info.Size() <= readAheadLimit {
+                    in.data, _ = readFile( path )
+                }
+            }
+            out <- in
+        }
+    }()
+    return out
+}
+
+// reportStage adds each report received to all sinks, then closes the sinks
+// when no more report is sent. A sink that fails is closed and dropped, with
+// an error printed in out: the stage must not print on the standard output,
+// which the check stage redirects while it runs (see parseWithDiagnostics).
+// The returned channel is closed when all sinks are closed.
+func reportStage( sinks []reportSink, reports <-chan *fileReport,
+                  out io.Writer ) <-chan struct{} {
+    done := make( chan struct{} )
+    go func( ) {
+        defer close( done )
+        for rep := range reports {
+            for i, sink := range sinks {
+                if sink == nil {
+                    continue
+                }
+                if err := sink.add( rep ); err != nil {
+                    fmt.Fprintf( out, "jpegcheck: unable to write %s: %v\n",
+                                 sink.name(), err )
+                    sink.close()
+                    sinks[i] = nil
+                }
+            }
+        }
+        for _, sink := range sinks {
+            if sink == nil {
+                continue
+            }
+            if err := sink.close(); err != nil {
+                fmt.Fprintf( out, "jpegcheck: unable to write %s: %v\n",
+                             sink.name(), err )
+            }
+        }
+    }()
+    return done
+}
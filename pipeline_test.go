@@ -0,0 +1,57 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "strings"
+    "testing"
+
+    "github.com/jrm-1535/jpeg"
+)
+
+// failingSink fails to add any report
+type failingSink struct {
+    closed          bool
+}
+
+func (fs *failingSink) name( ) string {
+    return "failing sink"
+}
+
+func (fs *failingSink) add( rep *fileReport ) error {
+    return fmt.Errorf( "no space left" )
+}
+
+func (fs *failingSink) close( ) error {
+    fs.closed = true
+    return nil
+}
+
+// TestReportStageOutput checks, with -race, that the report stage does not
+// print on the standard output while the check stage redirects it
+func TestReportStageOutput( t *testing.T ) {
+    var out bytes.Buffer
+    sink := &failingSink{ }
+    reports := make( chan *fileReport, readAheadFiles )
+    done := reportStage( []reportSink{ sink }, reports, &out )
+    parse := func( ) (*jpeg.Desc, error) {
+        fmt.Printf( "library output\n" )
+        return nil, fmt.Errorf( "not parsed" )
+    }
+    for i := 0; i < 8; i++ {
+        reports <- &fileReport{ path: "test.jpg", index: i + 1 }
+        _, err := parseWithDiagnostics( parse, nil, &fileReport{ } )
+        if err == nil {
+            t.Fatalf( "parse error not returned" )
+        }
+    }
+    close( reports )
+    <-done
+    if ! sink.closed {
+        t.Errorf( "failing sink not closed" )
+    }
+    if n := strings.Count( out.String(), "unable to write failing sink" );
+       n != 1 {
+        t.Errorf( "%d sink errors printed, expected 1", n )
+    }
+}
@@ -0,0 +1,50 @@
+
+package main
+
+import (
+    "image"
+    "image/color"
+    "image/png"
+)
+
+// Streamed png maps: the png encoder reads the pixels of an image row by row,
+// so maps are given as images computing each pixel when it is read, from much
+// smaller per-block or per-tile states, instead of materializing an RGBA
+// buffer of the whole picture (4 bytes per pixel for panorama files). Only a
+// couple of rows and the compressor state are kept in memory while writing.
+
+// pixelFunc is an opaque image whose pixels are computed by at
+type pixelFunc struct {
+    bounds          image.Rectangle
+    at              func( x, y int ) color.RGBA
+}
+
+func (p *pixelFunc) ColorModel( ) color.Model {
+    return color.RGBAModel
+}
+
+func (p *pixelFunc) Bounds( ) image.Rectangle {
+    return p.bounds
+}
+
+func (p *pixelFunc) At( x, y int ) color.Color {
+    return p.at( x, y )
+}
+
+// Opaque avoids a first pass of the encoder over all pixels to look for alpha
+func (p *pixelFunc) Opaque( ) bool {
+    return true
+}
+
+// writePng encodes img as png in a new file at path
+func writePng( path string, img image.Image ) error {
+    w, done, err := createFile( path )
+    if err != nil {
+        return err
+    }
+    err = png.Encode( w, img )
+    if cerr := done(); err == nil {
+        err = cerr
+    }
+    return err
+}
@@ -0,0 +1,86 @@
+
+package main
+
+import (
+    "archive/zip"
+    "bytes"
+    "fmt"
+)
+
+// Polyglot detection: files engineered to be valid both as jpeg and as another
+// format, which is a known way to smuggle content through upload pipelines.
+
+// zipPolyglot returns the number of entries if data can be read as a zip
+// archive, whose directory is found from the end of the file.
+func zipPolyglot( data []byte ) int {
+    if bytes.LastIndex( data, []byte( "PK\x05\x06" ) ) == -1 {
+        return 0
+    }
+    zr, err := zip.NewReader( bytes.NewReader( data ), int64(len(data)) )
+    if err != nil {
+        return 0
+    }
+    return len(zr.File)
+}
+
+// pdfPolyglot returns whether data can be read as a pdf document: pdf readers
+// accept a header anywhere in the first 1024 bytes and need an end of file
+// marker.
+func pdfPolyglot( data []byte ) bool {
+    head := data
+    if len(head) > 1024 {
+        head = head[:1024]
+    }
+    return bytes.Contains( head, []byte( "%PDF-" ) ) &&
+           bytes.Contains( data, []byte( "%%EOF" ) )
+}
+
+var htmlTags = [][]byte{ []byte( "<html" ), []byte( "<script" ),
+                         []byte( "<svg" ), []byte( "<!doctype html" ),
+                         []byte( "<iframe" ), []byte( "<body" ) }
+
+// htmlPolyglot returns the offset of a html tag found in a COM or APPn
+// segment, which makes the file render as html when it is sniffed by a
+// browser, or -1 if there is none.
+func htmlPolyglot( data []byte, l *fileLayout ) int {
+    for _, s := range l.segments {
+        if ( s.marker < markerAPP0 || s.marker > markerAPP15 ) &&
+           s.marker != markerCOM {
+            continue
+        }
+        content := bytes.ToLower( s.data( data ) )
+        for _, tag := range htmlTags {
+            if i := bytes.Index( content, tag ); i != -1 {
+                return s.offset + 4 + i
+            }
+        }
+    }
+    return -1
+}
+
+// checkPolyglot reports any polyglot found in data and returns an error if
+// the file is a polyglot.
+func checkPolyglot( data []byte, l *fileLayout, rep *fileReport ) error {
+    var found []string
+    if n := zipPolyglot( data ); n > 0 {
+        found = append( found, fmt.Sprintf( "jpeg+zip polyglot (%d archive " +
+                                            "entries)", n ) )
+    }
+    if pdfPolyglot( data ) {
+        found = append( found, "jpeg+pdf polyglot" )
+    }
+    if offset := htmlPolyglot( data, l ); offset != -1 {
+        found = append( found, fmt.Sprintf( "jpeg+html polyglot (html tag " +
+                                            "@0x%x)", offset ) )
+    }
+    for _, f := range found {
+        text := "Security error: " + f
+        fmt.Printf( "%s\n", text )
+        rep.addMessage( errorSeverity, codePolyglot, text )
+    }
+    if len(found) > 0 {
+        return codedError{ fmt.Errorf( "polyglot file: %s\n", found[0] ),
+                           codePolyglot }
+    }
+    return nil
+}
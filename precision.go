@@ -0,0 +1,193 @@
+package main
+
+import (
+    "fmt"
+    "os"
+
+    "github.com/jrm-1535/jpeg"
+)
+
+// Extended precision: medical and scientific pictures are commonly coded with
+// 12-bit samples in extended sequential or progressive frames. The sample
+// precision of each frame is validated against its process (T.81 B.2.2: 8
+// bits for baseline, 8 or 12 bits for other DCT-based processes, 2 to 16 bits
+// for lossless), as well as the quantization tables it uses, since 16-bit
+// tables are only allowed with 12-bit samples (T.81 B.2.4.1). If the library
+// rejects a file with more than 8-bit samples, the file is checked with the
+// coefficient decoder and its tables are printed. Such pictures are saved by
+// -spict from their coefficients, with 16 bits per sample (see
+// rawpicture.go).
+
+// lossless returns true for the frames of lossless processes
+func (f *frameEntry) lossless( ) bool {
+    return int(f.marker - markerSOF0) & 3 == 3
+}
+
+// precisionIssue returns why the sample precision of f is invalid for its
+// process, or "" if it is valid
+func (f *frameEntry) precisionIssue( ) string {
+    switch {
+    case f.lossless():
+        if f.precision < 2 || f.precision > 16 {
+            return fmt.Sprintf( "%d-bit samples in a lossless frame (2 to " +
+                                "16 bits)", f.precision )
+        }
+    case f.marker == markerSOF0:
+        if f.precision != 8 {
+            return fmt.Sprintf( "%d-bit samples in a baseline frame (8 " +
+                                "bits only, use SOF1 for 12 bits)",
+                                f.precision )
+        }
+    case f.precision != 8 && f.precision != 12:
+        return fmt.Sprintf( "%d-bit samples in a %s frame (8 or 12 bits)",
+                            f.precision, f.encodingMode() )
+    }
+    return ""
+}
+
+// formatPrecisionIssues adds to rep the precision issues of frame n, given
+// which quantization table destinations hold 16-bit tables
+func (f *frameEntry) formatPrecisionIssues( n int, quant16 [4]bool,
+                                            rep *fileReport ) {
+    if text := f.precisionIssue(); text != "" {
+        rep.addFrameMessage( n, errorSeverity, codeFrameStructure,
+                             fmt.Sprintf( "Frame structure: frame %d %s " +
+                                          "@0x%x has %s", n,
+                                          markerName( f.marker ), f.offset,
+                                          text ) )
+    }
+    if f.precision != 8 || f.lossless() {
+        return
+    }
+    for i, tq := range f.tq {
+        if tq < len(quant16) && quant16[tq] {
+            rep.addFrameMessage( n, warningSeverity, codeFrameStructure,
+                                 fmt.Sprintf( "Frame structure: component " +
+                                              "%d of frame %d uses 16-bit " +
+                                              "quantization table %d with " +
+                                              "8-bit samples",
+                                              f.components[i], n, tq ) )
+        }
+    }
+}
+
+// formatCodingTables prints the quantization tables and the Huffman table
+// definitions of data, as the library would
+func formatCodingTables( path string, data []byte, l *fileLayout ) {
+    if tables, err := quantTablesInForce( data, l ); err == nil {
+        fmt.Printf( "%s", formatQuantText( path, tables ) )
+    }
+    defs, err := huffTableDefinitions( data, l )
+    if err != nil {
+        return
+    }
+    for _, t := range defs {
+        longest := 0
+        for i, c := range t.Counts {
+            if c > 0 {
+                longest = i + 1
+            }
+        }
+        fmt.Printf( "Huffman %s table %d (scan %d): %d symbols, codes up to " +
+                    "%d bits\n", t.Class, t.Destination, t.Scan,
+                    len(t.Symbols), longest )
+    }
+}
+
+// checkExtendedPrecisionFile checks the file at path, whose first frame has
+// more than 8-bit samples and was rejected by the library, with the
+// coefficient decoder. jpg is what the library could parse, if anything. It
+// returns an error if the file is not complete or if the picture could not
+// be saved with -spict.
+func checkExtendedPrecisionFile( path string, data []byte, jpg *jpeg.Desc,
+                                 process *jpgArgs, rep *fileReport ) error {
+    data, err := inputData( path, data )
+    if err != nil {
+        return fatalError{ fmt.Errorf( "unable to analyse file %s\n", path ) }
+    }
+    if jpg != nil {
+        rep.setDesc( jpg )
+        jpg.FormatImageInfo( os.Stdout )
+    }
+    l := scanLayout( data )
+    img, err := decodeFrame( data, l, nil )
+    if err == nil && ! hasEOI( l ) {
+        err = fmt.Errorf( "missing EOI, the compressed picture may be " +
+                          "truncated\n" )
+    }
+    if err != nil {
+        text := fmt.Sprintf( "extended precision: %v", err )
+        fmt.Printf( "%s", text )
+        rep.addMessage( errorSeverity, codeExtendedPrecision, text )
+        return codedError{ fmt.Errorf( "file %s is not a complete jpeg " +
+                                       "file\n", path ), codeIncomplete }
+    }
+    rep.complete = true
+    fmt.Printf( "Extended precision: %d-bit samples, %dx%d, %d " +
+                "component(s), %d scans and %d restart intervals decoded by " +
+                "jpegcheck\n", img.frame.precision, img.frame.width,
+                img.frame.height, len(img.frame.comps), img.nScans,
+                img.restarts )
+    if process.tables {
+        formatCodingTables( path, data, l )
+    }
+    for _, issue := range img.issues {
+        text := "extended precision: " + issue
+        fmt.Printf( "  Warning: %s", text )
+        rep.addMessage( warningSeverity, codeExtendedPrecision, text )
+    }
+    if process.output != "" {
+        text := "extended precision: no copy written, the library cannot " +
+                "write frames with more than 8-bit samples"
+        fmt.Printf( "%s\n", text )
+        rep.addMessage( warningSeverity, codeExtendedPrecision, text )
+    }
+    if process.sPicture.path == "" {
+        return nil
+    }
+    o := exifOrientation( data, l )
+    if process.sPicture.row0 != 0 || process.sPicture.col0 != 0 {
+        o = orientationValue( &jpeg.Orientation{ Row0: process.sPicture.row0,
+                                                 Col0: process.sPicture.col0 } )
+    }
+    nc, nr, n, err := saveExtendedPicture( process, data, o, rep )
+    if err != nil {
+        return outputError{ fmt.Errorf( "save picture: %v", err ), false }
+    }
+    fmt.Printf( "Saved %s as nCols=%d nRows=%d size %d\n",
+                process.sPicture.path, nc, nr, n )
+    return nil
+}
+
+// saveExtendedPicture saves the picture of data, with more than 8-bit
+// samples, as raw 16-bit samples with the Exif orientation o for -spict,
+// which excludes the options that work on 8-bit raw samples
+func saveExtendedPicture( process *jpgArgs, data []byte, o int,
+                          rep *fileReport ) (nc, nr uint, n int, err error) {
+    switch {
+    case process.sPicture.cmyk:
+        err = fmt.Errorf( "CMYK format is not available with 16-bit " +
+                          "samples\n" )
+    case process.resize != nil || process.stamp != nil ||
+         process.gray.fromRGB():
+        err = fmt.Errorf( "-resize, -stamp and -gray are not available " +
+                          "with 16-bit samples\n" )
+    case rep.colorSpace != "gray" && rep.colorSpace != "YCbCr" &&
+         rep.colorSpace != "RGB":
+        err = fmt.Errorf( "%s pictures with more than 8-bit samples are " +
+                          "not supported\n", rep.colorSpace )
+    default:
+        fmt.Printf( "jpegcheck: saving %s picture as 16-bit samples\n",
+                    rep.colorSpace )
+        return saveReconstructedPicture16( process.sPicture.path, data,
+                                           process.sPicture.bw,
+                                           rep.colorSpace == "RGB", o )
+    }
+    return
+}
+
+// extendedPrecision returns true if the first frame found in the raw data of
+// the file of rep has more than 8-bit samples
+func extendedPrecision( rep *fileReport ) bool {
+    return len(rep.structure) > 0 && rep.structure[0].precision > 8
+}
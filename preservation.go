@@ -0,0 +1,320 @@
+
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "math"
+    "strings"
+)
+
+// Preservation check (-preservation-check): a verdict on whether the file is
+// suitable for long-term preservation as is, combining the raw layout checks
+// in the way archival policy checklists do:
+//  - conformance: structure and entropy-coded data of the first image,
+//  - coding process: widely supported Huffman sequential or progressive,
+//  - metadata: APPn segments documented by a public specification,
+//  - hidden data: no executable or polyglot content, no high entropy payload
+//    (encrypted or compressed in an unknown way) where arbitrary data fits,
+//  - quality: not a heavily compressed derivative,
+//  - recoverability: resilience to corruption of the file.
+// A failed check makes the file unsuitable, a check with a warning only adds
+// recommendations. The verdict does not change the outcome of the analysis.
+
+type checkStatus int
+const (
+    checkPass checkStatus = iota
+    checkWarn
+    checkFail
+)
+
+var checkStatusNames = [...]string{ "pass", "warn", "FAIL" }
+
+const (
+    hiddenMinLength     = 1024  // shorter payloads are not evaluated
+    hiddenMaxEntropy    = 7.5   // bits per byte, above is encrypted-like
+)
+
+// documentedApps are the APPn payloads described by public specifications
+var documentedApps = []struct {
+    marker          byte
+    prefix          string
+    name            string
+} {
+    { markerAPP0, "JFIF\x00", "JFIF" },
+    { markerAPP0, "JFXX\x00", "JFXX" },
+    { markerAPP0 + 1, "Exif\x00\x00", "Exif" },
+    { markerAPP0 + 1, "http://ns.adobe.com/xap/1.0/\x00", "XMP" },
+    { markerAPP0 + 1, "http://ns.adobe.com/xmp/extension/\x00", "extended XMP" },
+    { markerAPP0 + 2, "ICC_PROFILE\x00", "ICC profile" },
+    { markerAPP0 + 2, "MPF\x00", "MPF" },
+    { markerAPP0 + 2, "FPXR\x00", "FlashPix" },
+    { markerAPP0 + 11, "JP", "JUMBF" },
+    { markerAPP0 + 13, "Photoshop 3.0\x00", "Photoshop IRB" },
+    { markerAPP0 + 14, "Adobe", "Adobe" },
+}
+
+// appName returns the name of a documented APPn payload, or "" if unknown
+func appName( marker byte, d []byte ) string {
+    for _, a := range documentedApps {
+        if a.marker == marker && bytes.HasPrefix( d, []byte( a.prefix ) ) {
+            return a.name
+        }
+    }
+    return ""
+}
+
+// byteEntropy returns the Shannon entropy of b in bits per byte
+func byteEntropy( b []byte ) float64 {
+    var counts [256]int
+    for _, c := range b {
+        counts[c] ++
+    }
+    var h float64
+    for _, n := range counts {
+        if n > 0 {
+            p := float64(n) / float64(len(b))
+            h -= p * math.Log2( p )
+        }
+    }
+    return h
+}
+
+type preservationCheck struct {
+    name            string
+    status          checkStatus
+    details         []string
+}
+
+type preservationVerdict struct {
+    checks          []*preservationCheck
+    recommendations []string
+}
+
+func (pv *preservationVerdict) check( name string ) *preservationCheck {
+    pc := &preservationCheck{ name: name }
+    pv.checks = append( pv.checks, pc )
+    return pc
+}
+
+func (pc *preservationCheck) set( status checkStatus, f string,
+                                  a ...interface{} ) {
+    if status > pc.status {
+        pc.status = status
+    }
+    pc.details = append( pc.details, fmt.Sprintf( f, a... ) )
+}
+
+func (pv *preservationVerdict) recommend( f string, a ...interface{} ) {
+    pv.recommendations = append( pv.recommendations, fmt.Sprintf( f, a... ) )
+}
+
+func (pv *preservationVerdict) status( ) (s checkStatus) {
+    for _, pc := range pv.checks {
+        if pc.status > s {
+            s = pc.status
+        }
+    }
+    return
+}
+
+func (pv *preservationVerdict) checkConformance( data []byte, l *fileLayout,
+                                                 sof byte ) {
+    pc := pv.check( "Conformance" )
+    if len(l.segments) == 0 || l.segments[0].marker != markerSOI {
+        pc.set( checkFail, "file does not start with SOI" )
+    }
+    if l.truncated || ! hasEOI( l ) {
+        pc.set( checkFail, "file is truncated" )
+    }
+    if sof <= markerSOF0 + 2 {
+        if _, issues := scanIssues( data, l ); len(issues) > 0 {
+            pc.set( checkFail, "%s", strings.TrimSpace( issues[0] ) )
+        }
+    } else {
+        pc.set( checkWarn, "entropy-coded data not verified" )
+    }
+    for _, a := range orderingAnomalies( l ) {
+        pc.set( checkWarn, "%s", a )
+    }
+    if len(l.garbage) > 0 {
+        pc.set( checkWarn, "%d place(s) with bytes between segments",
+                len(l.garbage) )
+    }
+    if l.trailing.length > 0 {
+        pc.set( checkWarn, "%d bytes after EOI", l.trailing.length )
+    }
+    switch pc.status {
+    case checkPass:
+        pc.set( checkPass, "structure and entropy-coded data are valid" )
+    case checkWarn:
+        pv.recommend( "review the structure anomalies (see -marker-stats)" )
+    default:
+        pv.recommend( "repair the file or find an intact copy before ingest" )
+    }
+}
+
+func (pv *preservationVerdict) checkCoding( sof byte ) {
+    pc := pv.check( "Coding process" )
+    switch {
+    case sof <= markerSOF0 + 1:
+        pc.set( checkPass, "Huffman sequential" )
+    case sof == markerSOF0 + 2:
+        pc.set( checkPass, "Huffman progressive" )
+    default:
+        pc.set( checkFail, "%s frames are not widely supported",
+                markerName( sof ) )
+        pv.recommend( "migrate the picture to a widely supported format" )
+    }
+}
+
+func (pv *preservationVerdict) checkMetadata( data []byte, l *fileLayout ) {
+    pc := pv.check( "Metadata" )
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.marker < markerAPP0 || s.marker > markerAPP15 {
+            continue
+        }
+        if appName( s.marker, s.data( data ) ) == "" {
+            pc.set( checkWarn, "undocumented %s payload @0x%x",
+                    markerName( s.marker ), s.offset )
+        } else if s.marker == markerAPP0 + 1 && findMakerNote( data, s ) != nil {
+            pc.set( checkPass, "Exif maker note in a proprietary format" )
+            pv.recommend( "export the maker note with the vendor tools if " +
+                          "its content matters" )
+        }
+    }
+    if len(pc.details) == 0 {
+        pc.set( checkPass, "documented metadata only" )
+    } else if pc.status != checkPass {
+        pv.recommend( "document or export proprietary APPn payloads, which " +
+                      "only vendor software can read" )
+    }
+}
+
+func (pv *preservationVerdict) checkHiddenData( data []byte, l *fileLayout ) {
+    pc := pv.check( "Hidden data" )
+    if n := len( scanSecurity( data, l ) ); n > 0 {
+        pc.set( checkFail, "%d suspicious signature(s), see -security", n )
+    }
+    if zipPolyglot( data ) > 0 || pdfPolyglot( data ) ||
+       htmlPolyglot( data, l ) != -1 {
+        pc.set( checkFail, "polyglot file, see -security" )
+    }
+    evaluate := func( b []byte, where string ) {
+        if len(b) < hiddenMinLength {
+            return
+        }
+        if h := byteEntropy( b ); h > hiddenMaxEntropy {
+            pc.set( checkFail, "%d bytes of encrypted-like data (%.2f bits " +
+                    "per byte) in %s", len(b), h, where )
+        }
+    }
+    for i := range l.segments {
+        s := &l.segments[i]
+        if ( s.marker >= markerAPP0 && s.marker <= markerAPP15 &&
+             appName( s.marker, s.data( data ) ) == "" ) ||
+           s.marker == markerCOM {
+            evaluate( s.data( data ), fmt.Sprintf( "%s @0x%x",
+                                          markerName( s.marker ), s.offset ) )
+        }
+    }
+    for _, g := range l.garbage {
+        evaluate( data[g.offset:g.offset+g.length],
+                  fmt.Sprintf( "bytes between segments @0x%x", g.offset ) )
+    }
+    if t := l.trailing; t.length > 0 {
+        evaluate( data[t.offset:t.offset+t.length], "data after EOI" )
+    }
+    if pc.status == checkPass {
+        pc.set( checkPass, "no hidden content found" )
+    } else {
+        pv.recommend( "investigate the hidden content before ingest" )
+    }
+}
+
+func (pv *preservationVerdict) checkQuality( data []byte, l *fileLayout ) {
+    pc := pv.check( "Quality" )
+    img, err := decodeCoefficients( data, l )
+    if err != nil {
+        pc.set( checkWarn, "not evaluated" )
+        return
+    }
+    mean, err := img.meanQuantizationError()
+    switch {
+    case err != nil:
+        pc.set( checkWarn, "not evaluated" )
+    case mean > qerrDegraded:
+        pc.set( checkWarn, "estimated rms error %.2f, heavily compressed", mean )
+        pv.recommend( "look for a less compressed master of the picture" )
+    default:
+        pc.set( checkPass, "estimated rms error %.2f", mean )
+    }
+}
+
+func (pv *preservationVerdict) checkRecoverability( data []byte,
+                                                    l *fileLayout ) {
+    pc := pv.check( "Recoverability" )
+    rs := recoverability( data, l )
+    if rs.score < recoveryRestartMax {
+        pc.set( checkWarn, "score %d/100, see -recoverability", rs.score )
+        pv.recommendations = append( pv.recommendations, rs.suggestions... )
+    } else {
+        pc.set( checkPass, "score %d/100", rs.score )
+    }
+}
+
+// preservation returns the preservation verdict for the first image in data
+func preservation( data []byte, l *fileLayout ) *preservationVerdict {
+    pv := new( preservationVerdict )
+    var sof byte
+    for _, s := range l.segments {
+        if isSOF( s.marker ) {
+            sof = s.marker
+            break
+        }
+    }
+    if sof == 0 {
+        pv.check( "Conformance" ).set( checkFail, "no frame found" )
+        return pv
+    }
+    pv.checkConformance( data, l, sof )
+    pv.checkCoding( sof )
+    pv.checkMetadata( data, l )
+    pv.checkHiddenData( data, l )
+    pv.checkQuality( data, l )
+    pv.checkRecoverability( data, l )
+    return pv
+}
+
+// formatPreservation prints the preservation verdict with the checks it is
+// made of and recommendations. An unsuitable verdict is reported as a warning,
+// other verdicts as info.
+func formatPreservation( data []byte, l *fileLayout, rep *fileReport ) {
+    pv := preservation( data, l )
+    verdict, sev := "suitable for preservation", infoSeverity
+    switch pv.status() {
+    case checkWarn:
+        verdict = "suitable for preservation, with recommendations"
+    case checkFail:
+        verdict, sev = "not suitable for preservation as is", warningSeverity
+    }
+    fmt.Printf( "Preservation check: %s\n", verdict )
+    for _, pc := range pv.checks {
+        fmt.Printf( "  %-4s %-15s %s\n", checkStatusNames[pc.status], pc.name,
+                    strings.Join( pc.details, "; " ) )
+        if pc.status == checkFail {
+            rep.addMessage( warningSeverity, codePreservation,
+                            fmt.Sprintf( "preservation: %s: %s", pc.name,
+                                         strings.Join( pc.details, "; " ) ) )
+        }
+    }
+    seen := make( map[string]bool )
+    for _, r := range pv.recommendations {
+        if ! seen[r] {
+            fmt.Printf( "  Recommendation: %s\n", r )
+            seen[r] = true
+        }
+    }
+    rep.addMessage( sev, codePreservation, "preservation verdict: " + verdict )
+}
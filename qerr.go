@@ -0,0 +1,120 @@
+
+package main
+
+import (
+    "fmt"
+    "image"
+    "image/color"
+    "math"
+)
+
+// Quantization error estimate: quantizing a DCT coefficient with a step q
+// introduces an error uniformly distributed in [-q/2, q/2], i.e. a variance of
+// q*q/12. For coefficients quantized to 0, the original value was most often
+// much smaller than q/2 and a variance of q*q/48 is assumed instead. Since the
+// jpeg DCT is orthonormal, the mean square error over the 64 pixels of a block
+// is the sum of the coefficient error variances divided by 64.
+
+const (
+    qerrFullScale   = 8.0       // rms error shown as full red in heat maps
+    qerrDegraded    = 4.0       // rms error above which a block is degraded
+)
+
+// blockQuantizationError returns the estimated rms error in sample levels
+func blockQuantizationError( b *block, qt *quantTable ) float64 {
+    var mse float64
+    for k := 0; k < 64; k++ {
+        q := float64(qt.values[k])
+        if b[zigZag[k]] != 0 {
+            mse += q * q / 12
+        } else {
+            mse += q * q / 48
+        }
+    }
+    return math.Sqrt( mse / 64 )
+}
+
+// heatColor maps t in [0, 1] to a blue, green, yellow, red color ramp
+func heatColor( t float64 ) color.RGBA {
+    if t > 1 {
+        t = 1
+    }
+    var r, g, b float64
+    switch {
+    case t < 1.0 / 3:
+        g, b = 3 * t, 1 - 3 * t
+    case t < 2.0 / 3:
+        r, g = 3 * t - 1, 1
+    default:
+        r, g = 1, 3 - 3 * t
+    }
+    return color.RGBA{ uint8(255 * r), uint8(255 * g), uint8(255 * b), 255 }
+}
+
+// meanQuantizationError returns the mean estimated rms error of the blocks of
+// the first component
+func (img *coefImage) meanQuantizationError( ) (float64, error) {
+    cc := &img.comps[0]
+    qt := img.quant[cc.tq]
+    if qt == nil {
+        return 0, fmt.Errorf( "missing quantization table %d\n", cc.tq )
+    }
+    var sum float64
+    for i := range cc.blocks {
+        sum += blockQuantizationError( &cc.blocks[i], qt )
+    }
+    return sum / float64(len(cc.blocks)), nil
+}
+
+// saveQuantizationErrorMap writes a png heat-map of the estimated quantization
+// error of the luminance (first component) blocks in the first frame, and
+// prints a summary of the estimated errors.
+func saveQuantizationErrorMap( path string, data []byte, l *fileLayout ) error {
+    img, err := decodeCoefficients( data, l )
+    if err != nil {
+        return fmt.Errorf( "quantization error map: %v", err )
+    }
+    fh := img.frame
+    cc := &img.comps[0]
+    qt := img.quant[cc.tq]
+    if qt == nil {
+        return fmt.Errorf( "quantization error map: missing quantization " +
+                           "table %d\n", cc.tq )
+    }
+    // size in pixels of one block of the first component
+    bw := 8 * fh.hMax / fh.comps[0].h
+    bh := 8 * fh.vMax / fh.comps[0].v
+
+    nbx := ( fh.width + bw - 1 ) / bw
+    nby := ( fh.height + bh - 1 ) / bh
+    colors := make( []color.RGBA, nbx * nby )
+    var sum, max float64
+    var n, degraded int
+    for by := 0; by < nby; by++ {
+        for bx := 0; bx < nbx; bx++ {
+            e := blockQuantizationError( cc.at( bx, by ), qt )
+            sum += e
+            if e > max {
+                max = e
+            }
+            if e > qerrDegraded {
+                degraded ++
+            }
+            n ++
+            colors[by * nbx + bx] = heatColor( e / qerrFullScale )
+        }
+    }
+    heat := &pixelFunc{ bounds: image.Rect( 0, 0, fh.width, fh.height ),
+                        at: func( x, y int ) color.RGBA {
+                            return colors[y / bh * nbx + x / bw]
+                        } }
+    if err = writePng( path, heat ); err != nil {
+        return fmt.Errorf( "quantization error map: %v\n", err )
+    }
+    fmt.Printf( "Quantization error (estimated rms, in sample levels):\n" )
+    fmt.Printf( "  Mean %.2f, max %.2f, %d/%d blocks (%.1f%%) above %.1f\n",
+                sum / float64(n), max, degraded, n,
+                percent( int64(degraded), int64(n) ), qerrDegraded )
+    fmt.Printf( "  Heat-map saved as %s\n", path )
+    return nil
+}
@@ -0,0 +1,395 @@
+
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "math"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// Quantization tables as text (-squant, -iquant): encoder tuning experiments
+// need to edit the tables of a file and see the effect. Tables in force for
+// the first scan are saved as 8x8 matrices in natural order (one row per line,
+// from the top), each preceded by a line "table <destination> <bits>", with
+// comments starting with '#'. A table read from such a file (or from a file
+// with only 64 values) replaces a table of the copy written with -o, either:
+//  - requantize: the coefficients of all components using the table are
+//    requantized with the new steps, which is lossy, and the scans are
+//    entropy coded again (Huffman sequential frames only), or
+//  - header: only the table is replaced, which is refused unless the steps
+//    are unchanged at all positions where coefficients are not zero, since
+//    the picture would change otherwise.
+
+var quantImportModes = []string{ "requantize", "header" }
+
+type quantImport struct {
+    dest            int
+    path            string
+    mode            string
+    table           *quantTable
+}
+
+// quantTablesInForce returns the quantization tables defined before the
+// first scan in data
+func quantTablesInForce( data []byte, l *fileLayout ) ([4]*quantTable, error) {
+    var ct codingTables
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.marker == markerSOS {
+            break
+        }
+        if s.marker == markerDQT {
+            if err := ct.defineQuantization( s.data( data ) ); err != nil {
+                return ct.quant, err
+            }
+        }
+    }
+    return ct.quant, nil
+}
+
+// formatQuantText returns the tables as text
+func formatQuantText( path string, tables [4]*quantTable ) string {
+    var b strings.Builder
+    fmt.Fprintf( &b, "# quantization tables of %s, in natural order\n", path )
+    for d, qt := range tables {
+        if qt == nil {
+            continue
+        }
+        fmt.Fprintf( &b, "table %d %d\n", d, 8 * ( qt.precision + 1 ) )
+        var natural [64]uint16
+        for k, v := range qt.values {
+            natural[zigZag[k]] = v
+        }
+        for r := 0; r < 8; r++ {
+            for c := 0; c < 8; c++ {
+                fmt.Fprintf( &b, "%5d", natural[r*8+c] )
+            }
+            b.WriteString( "\n" )
+        }
+    }
+    return b.String()
+}
+
+// saveQuantText saves the quantization tables in force for the first scan
+// of data as text at output
+func saveQuantText( output, path string, data []byte, l *fileLayout ) error {
+    tables, err := quantTablesInForce( data, l )
+    if err != nil {
+        return fmt.Errorf( "save quantization tables: %v", err )
+    }
+    n := 0
+    for _, qt := range tables {
+        if qt != nil {
+            n ++
+        }
+    }
+    if n == 0 {
+        return fmt.Errorf( "save quantization tables: no table in %s\n", path )
+    }
+    text := formatQuantText( path, tables )
+    if err = writeFile( output, []byte( text ), 0644 ); err != nil {
+        return fmt.Errorf( "save quantization tables: %v\n", err )
+    }
+    fmt.Printf( "Saved %d quantization table(s) as %s\n", n, output )
+    return nil
+}
+
+// loadQuantText reads the table for destination dest from the text file at
+// path: the table with that destination, or the only table in the file
+func loadQuantText( path string, dest int ) (*quantTable, error) {
+    f, err := os.Open( path )
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    tables := make( map[int][]uint16 )
+    var order []int
+    current := -1
+    sc := bufio.NewScanner( f )
+    for line := 1; sc.Scan(); line++ {
+        text := sc.Text()
+        if i := strings.IndexByte( text, '#' ); i != -1 {
+            text = text[:i]
+        }
+        fields := strings.Fields( text )
+        if len(fields) > 0 && fields[0] == "table" {
+            d := -1
+            if len(fields) >= 2 {
+                d, err = strconv.Atoi( fields[1] )
+            }
+            if d < 0 || d > 3 || err != nil {
+                return nil, fmt.Errorf( "%s:%d: invalid table destination\n",
+                                        path, line )
+            }
+            if _, ok := tables[d]; ok {
+                return nil, fmt.Errorf( "%s:%d: table %d defined twice\n",
+                                        path, line, d )
+            }
+            current = d
+            tables[d] = nil
+            order = append( order, d )
+            continue
+        }
+        for _, field := range fields {
+            v, err := strconv.ParseUint( field, 10, 16 )
+            if err != nil || v == 0 {
+                return nil, fmt.Errorf( "%s:%d: invalid step %s (1 to " +
+                                        "65535)\n", path, line, field )
+            }
+            if current == -1 {      // values without table line
+                current = dest
+                tables[dest] = nil
+                order = append( order, dest )
+            }
+            if len(tables[current]) == 64 {
+                return nil, fmt.Errorf( "%s:%d: more than 64 values for " +
+                                        "table %d\n", path, line, current )
+            }
+            tables[current] = append( tables[current], uint16(v) )
+        }
+    }
+    if err = sc.Err(); err != nil {
+        return nil, err
+    }
+    values, ok := tables[dest]
+    if ! ok && len(order) == 1 {
+        values = tables[order[0]]
+    } else if ! ok {
+        return nil, fmt.Errorf( "no table %d in %s\n", dest, path )
+    }
+    if len(values) != 64 {
+        return nil, fmt.Errorf( "%d values instead of 64 in %s\n",
+                                len(values), path )
+    }
+    qt := new( quantTable )
+    for k := range qt.values {
+        qt.values[k] = values[zigZag[k]]
+        if qt.values[k] > 255 {
+            qt.precision = 1
+        }
+    }
+    return qt, nil
+}
+
+// parseQuantImport parses -iquant=<dest>:<path> and loads the table
+func parseQuantImport( spec, mode string ) (*quantImport, error) {
+    valid := false
+    for _, m := range quantImportModes {
+        valid = valid || m == mode
+    }
+    if ! valid {
+        return nil, fmt.Errorf( "invalid mode %s (%s)\n", mode,
+                                strings.Join( quantImportModes, " or " ) )
+    }
+    parts := strings.SplitN( spec, ":", 2 )
+    d, err := strconv.Atoi( parts[0] )
+    if len(parts) != 2 || err != nil || d < 0 || d > 3 || parts[1] == "" {
+        return nil, fmt.Errorf( "invalid table %s (<destination>:<path>, " +
+                                "destination 0 to 3)\n", spec )
+    }
+    qi := &quantImport{ dest: d, path: parts[1], mode: mode }
+    if qi.table, err = loadQuantText( qi.path, d ); err != nil {
+        return nil, fmt.Errorf( "%s\n", strings.TrimSpace( err.Error() ) )
+    }
+    return qi, nil
+}
+
+// replaceQuantTable returns data with all definitions of table dest before
+// the first scan replaced by qt
+func replaceQuantTable( data []byte, l *fileLayout, dest int,
+                        qt *quantTable ) ([]byte, error) {
+    var out bytes.Buffer
+    last, scans, replaced := 0, 0, 0
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.marker == markerEOI {
+            break
+        }
+        if s.marker == markerSOS {
+            scans ++
+        }
+        if s.marker != markerDQT {
+            continue
+        }
+        var content []byte
+        for d := s.data( data ); len(d) > 0; {
+            pq, tq := int(d[0] >> 4), int(d[0] & 0x0f)
+            size := 1 + 64 * ( pq + 1 )
+            if pq > 1 || len(d) < size {
+                return nil, fmt.Errorf( "invalid DQT segment\n" )
+            }
+            if tq != dest {
+                content = append( content, d[:size]... )
+                d = d[size:]
+                continue
+            }
+            if scans > 0 {
+                return nil, fmt.Errorf( "table %d is redefined between " +
+                                        "scans\n", dest )
+            }
+            content = append( content, byte( qt.precision << 4 | dest ) )
+            for _, v := range qt.values {
+                if qt.precision == 1 {
+                    content = append( content, byte( v >> 8 ) )
+                }
+                content = append( content, byte( v ) )
+            }
+            replaced ++
+            d = d[size:]
+        }
+        out.Write( data[last:s.offset] )
+        out.Write( []byte{ 0xff, markerDQT, byte( ( len(content) + 2 ) >> 8 ),
+                           byte( len(content) + 2 ) } )
+        out.Write( content )
+        last = s.end()
+    }
+    if replaced == 0 {
+        return nil, fmt.Errorf( "no table %d in the file\n", dest )
+    }
+    out.Write( data[last:] )
+    return out.Bytes(), nil
+}
+
+// requantize requantizes the coefficients of the components using table
+// dest with the steps of qt, and returns the number of coefficients changed
+// and the rms error introduced on dequantized coefficients
+func (img *coefImage) requantize( dest int, qt *quantTable ) (int, float64) {
+    old := img.quant[dest]
+    limit := int64(1) << uint(img.frame.precision + 2)
+    changed, n := 0, 0
+    var sum float64
+    for ci := range img.comps {
+        cc := &img.comps[ci]
+        if cc.tq != dest {
+            continue
+        }
+        for bi := range cc.blocks {
+            b := &cc.blocks[bi]
+            for k := 0; k < 64; k++ {
+                n ++
+                c := &b[zigZag[k]]
+                qo, qn := int64(old.values[k]), int64(qt.values[k])
+                if *c == 0 || qo == qn {
+                    continue
+                }
+                v := int64(*c) * qo
+                nc := int64( math.Round( float64(v) / float64(qn) ) )
+                if nc * qn >= limit {
+                    nc = ( limit - 1 ) / qn
+                } else if nc * qn < -limit {
+                    nc = -limit / qn
+                }
+                d := float64( nc * qn - v )
+                sum += d * d
+                if nc != int64(*c) {
+                    changed ++
+                }
+                *c = int32(nc)
+            }
+        }
+    }
+    if n == 0 {
+        return 0, 0
+    }
+    return changed, math.Sqrt( sum / float64(n) )
+}
+
+// importQuantTable replaces a quantization table in the file at output, and
+// returns a description of the change.
+func importQuantTable( output string, qi *quantImport ) (string, error) {
+    data, err := os.ReadFile( output )
+    if err != nil {
+        return "", fmt.Errorf( "iquant: %v\n", err )
+    }
+    l := scanLayout( data )
+    img, err := decodeCoefficients( data, l )
+    if err != nil {
+        return "", fmt.Errorf( "iquant: %v", err )
+    }
+    old := img.quant[qi.dest]
+    if old == nil {
+        return "", fmt.Errorf( "iquant: no table %d in the file\n", qi.dest )
+    }
+    if qi.table.precision == 1 && img.frame.precision == 8 {
+        return "", fmt.Errorf( "iquant: steps above 255 are not allowed for " +
+                               "8-bit samples\n" )
+    }
+    users := 0
+    for ci := range img.comps {
+        if img.comps[ci].tq == qi.dest {
+            users ++
+        }
+    }
+    var description string
+    if qi.mode == "header" {
+        for ci := range img.comps {
+            cc := &img.comps[ci]
+            if cc.tq != qi.dest {
+                continue
+            }
+            for k := 0; k < 64; k++ {
+                if old.values[k] == qi.table.values[k] {
+                    continue
+                }
+                for bi := range cc.blocks {
+                    if cc.blocks[bi][zigZag[k]] != 0 {
+                        return "", fmt.Errorf( "iquant: header-only " +
+                                               "replacement would change the " +
+                                               "picture: step %d differs " +
+                                               "(%d instead of %d) where " +
+                                               "coefficients are not zero, " +
+                                               "use -iquant-mode=requantize\n",
+                                               k, qi.table.values[k],
+                                               old.values[k] )
+                    }
+                }
+            }
+        }
+        description = fmt.Sprintf( "iquant: table %d replaced from %s, " +
+                                   "header only, picture unchanged",
+                                   qi.dest, qi.path )
+    } else {
+        if m := img.frame.marker; m != markerSOF0 && m != markerSOF0 + 1 {
+            return "", fmt.Errorf( "iquant: requantization is only available " +
+                                   "for Huffman sequential frames, not %s\n",
+                                   markerName( m ) )
+        }
+        changed, rms := img.requantize( qi.dest, qi.table )
+        description = fmt.Sprintf( "iquant: LOSSY: table %d replaced from " +
+                                   "%s, %d coefficient(s) of %d component(s) " +
+                                   "requantized, rms error %.3f",
+                                   qi.dest, qi.path, changed, users, rms )
+    }
+    modified, err := replaceQuantTable( data, l, qi.dest, qi.table )
+    if err != nil {
+        return "", fmt.Errorf( "iquant: %v", err )
+    }
+    if qi.mode == "requantize" {
+        modified, err = encodeCoefficients( modified, scanLayout( modified ),
+                                            img )
+        if err != nil {
+            return "", fmt.Errorf( "iquant: %v", err )
+        }
+    }
+    check, err := decodeCoefficients( modified, scanLayout( modified ) )
+    if err != nil {
+        return "", fmt.Errorf( "iquant: modified picture cannot be decoded: " +
+                               "%v", err )
+    }
+    for ci := range img.comps {
+        for i := range img.comps[ci].blocks {
+            if check.comps[ci].blocks[i] != img.comps[ci].blocks[i] {
+                return "", fmt.Errorf( "iquant: block %d of component %d is " +
+                                       "not coded as expected\n", i, ci )
+            }
+        }
+    }
+    if err = writeFile( output, modified, 0644 ); err != nil {
+        return "", fmt.Errorf( "iquant: %v\n", err )
+    }
+    return description, nil
+}
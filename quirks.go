@@ -0,0 +1,182 @@
+
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "strings"
+    "sync"
+)
+
+// Lenient TIFF parsing (-lenient): some vendors write Exif structures that do
+// not follow the specification, but whose data can still be extracted if the
+// quirk is known. Each quirk can be tolerated individually:
+//  - maker-base: maker note preview offsets relative to another base than the
+//    one expected for the vendor (Exif TIFF header or maker note start),
+//  - ifd-count: IFD entry count off by one, either too large (the last entry
+//    is the next IFD offset followed by garbage, or the table does not fit in
+//    the data) or too small (the next IFD offset is followed by an entry with
+//    a larger tag, a valid type and then the actual next IFD offset),
+//  - padded-values: single short values stored right-justified in the 4-byte
+//    value field, after the padding instead of before it.
+// Without -lenient the quirks are strictly rejected or ignored as before. The
+// quirks applied while checking a file are always reported, since a checker
+// must flag them even while it extracts the data.
+
+type tiffQuirk int
+
+const (
+    quirkMakerBase tiffQuirk = iota
+    quirkIfdCount
+    quirkPaddedValues
+    nQuirks
+)
+
+var quirkNames = [nQuirks]string{ "maker-base", "ifd-count", "padded-values" }
+
+var lenientQuirks [nQuirks]bool     // quirks tolerated
+var appliedQuirks []string          // since the last call to takeAppliedQuirks
+var appliedMutex sync.Mutex
+
+// parseQuirks enables the quirks given as a comma separated list of names, or
+// all quirks if the list is "all"
+func parseQuirks( list string ) error {
+    for _, name := range strings.Split( list, "," ) {
+        if name == "all" {
+            for q := range lenientQuirks {
+                lenientQuirks[q] = true
+            }
+            continue
+        }
+        found := false
+        for q, n := range quirkNames {
+            if n == name {
+                lenientQuirks[q], found = true, true
+            }
+        }
+        if ! found {
+            return fmt.Errorf( "invalid lenient quirk %q (%s or all)\n", name,
+                               strings.Join( quirkNames[:], ", " ) )
+        }
+    }
+    return nil
+}
+
+// quirkApplied records that the quirk q was tolerated, with a description of
+// where. The same description is recorded only once.
+func quirkApplied( q tiffQuirk, format string, a ...interface{} ) {
+    text := quirkNames[q] + ": " + fmt.Sprintf( format, a... )
+    appliedMutex.Lock()
+    defer appliedMutex.Unlock()
+    for _, t := range appliedQuirks {
+        if t == text {
+            return
+        }
+    }
+    appliedQuirks = append( appliedQuirks, text )
+}
+
+// takeAppliedQuirks returns the quirks applied since the previous call
+func takeAppliedQuirks( ) []string {
+    appliedMutex.Lock()
+    defer appliedMutex.Unlock()
+    applied := appliedQuirks
+    appliedQuirks = nil
+    return applied
+}
+
+// formatAppliedQuirks reports the quirks tolerated while checking a file
+func formatAppliedQuirks( rep *fileReport ) {
+    for _, text := range takeAppliedQuirks() {
+        text = "Lenient parsing, " + text
+        fmt.Printf( "%s\n", text )
+        rep.addMessage( warningSeverity, codeLenient, text )
+    }
+}
+
+// fixIfdCount returns the entries and the next IFD offset of the IFD at
+// offset after correcting an entry count off by one, if the quirk is tolerated
+func (t *tiffReader) fixIfdCount( offset uint32, entries []ifdEntry,
+                                  next uint32 ) ([]ifdEntry, uint32) {
+    if ! lenientQuirks[quirkIfdCount] || len(entries) == 0 {
+        return entries, next
+    }
+    last := &entries[len(entries)-1]
+    if len(entries) > 1 && last.size() < 0 {     // one entry too many
+        quirkApplied( quirkIfdCount, "IFD @0x%x declares %d entries instead " +
+                      "of %d", offset, len(entries), len(entries) - 1 )
+        return entries[:len(entries)-1], t.order.Uint32( t.data[last.position:] )
+    }
+    p := last.position + 12                     // one entry too few?
+    if p + 16 > len(t.data) {
+        return entries, next
+    }
+    e := ifdEntry{ tag: t.order.Uint16( t.data[p:] ),
+                   typ: t.order.Uint16( t.data[p+2:] ),
+                   count: t.order.Uint32( t.data[p+4:] ),
+                   value: t.data[p+8:p+12], position: p }
+    size := e.size()
+    if e.tag <= last.tag || size < 0 || e.count == 0 ||
+       ( size > 4 && uint64( t.order.Uint32( e.value ) ) + uint64(size) >
+                     uint64(len(t.data)) ) {
+        return entries, next
+    }
+    if n := t.order.Uint32( t.data[p+12:] ); n != 0 &&
+                                               uint64(n) + 2 > uint64(len(t.data)) {
+        return entries, next
+    }
+    quirkApplied( quirkIfdCount, "IFD @0x%x declares %d entries instead of %d",
+                  offset, len(entries), len(entries) + 1 )
+    return append( entries, e ), t.order.Uint32( t.data[p+12:] )
+}
+
+// paddedValue returns the value field of a single short value stored after
+// its padding, or nil if the quirk is not tolerated or not present
+func paddedValue( e *ifdEntry ) []byte {
+    if ! lenientQuirks[quirkPaddedValues] || e.count != 1 ||
+       ( e.typ != tiffShort && e.typ != tiffSShort ) {
+        return nil
+    }
+    if e.value[0] != 0 || e.value[1] != 0 ||
+       ( e.value[2] == 0 && e.value[3] == 0 ) {
+        return nil
+    }
+    quirkApplied( quirkPaddedValues, "tag 0x%04x @0x%x short value after " +
+                  "its padding", e.tag, e.position )
+    return e.value[2:4]
+}
+
+// preview returns the preview image at start and length relative to the base
+// of t, whose data starts at file offset base. If the bytes there are not a
+// jpeg picture and the quirk is tolerated, the offsets are tried relative to
+// the Exif TIFF header and to the maker note start.
+func (mn *makerNote) preview( source string, t *tiffReader, base int,
+                              start, length uint32 ) *embeddedImage {
+    ei := previewImage( source, t, base, start, length )
+    if ! lenientQuirks[quirkMakerBase] ||
+       ( ei != nil && bytes.HasPrefix( ei.data, []byte{ 0xff, markerSOI } ) ) {
+        return ei
+    }
+    bases := []struct {
+        name        string
+        data        []byte
+        base        int
+    }{
+        { "the Exif TIFF header", mn.tiff, mn.tiffStart },
+        { "the maker note", mn.tiff[mn.offset:], mn.tiffStart + mn.offset },
+    }
+    for _, b := range bases {
+        if b.base == base {
+            continue
+        }
+        other := previewImage( source, &tiffReader{ data: b.data }, b.base,
+                               start, length )
+        if other != nil &&
+           bytes.HasPrefix( other.data, []byte{ 0xff, markerSOI } ) {
+            quirkApplied( quirkMakerBase, "%s offset relative to %s", source,
+                          b.name )
+            return other
+        }
+    }
+    return ei
+}
@@ -0,0 +1,216 @@
+
+package main
+
+import (
+    "fmt"
+    "image"
+    "math"
+
+    "github.com/jrm-1535/jpeg"
+)
+
+// Raw pictures saved without the library (-spict): the library reconstructs
+// progressive frames incorrectly when their scans have restart markers, so
+// progressive frames are reconstructed here from the coefficients decoded by
+// the coefficient decoder, which accumulates the DC and AC coefficients of
+// all scans, including successive approximation refinements, before the
+// inverse DCT. Chroma is upsampled by replication, as the library does, and
+// YCbCr is converted to RGB as specified by JFIF. The samples are written as
+// the library writes them: 3 bytes per pixel, R, G and B, or Y repeated for
+// a BW picture. Pictures with 12-bit samples, which the library does not
+// save, are reconstructed the same way and written with 2 bytes per sample.
+
+// writeRawSamples orients samples according to o and writes the first size
+// bytes of each pixel at path. It returns the dimensions of the oriented
+// picture and the number of bytes written.
+func writeRawSamples( path string, samples *image.RGBA, size int,
+                      o *jpeg.Orientation ) (nc, nr uint, n int, err error) {
+    samples = orientImage( samples, orientationValue( o ) )
+    w, done, err := createFile( path )
+    if err != nil {
+        return 0, 0, 0, err
+    }
+    width, height := samples.Rect.Dx(), samples.Rect.Dy()
+    row := make( []byte, size * width )
+    for y := 0; y < height && err == nil; y++ {
+        for x := 0; x < width; x++ {
+            p := samples.Pix[samples.PixOffset( samples.Rect.Min.X + x,
+                                                samples.Rect.Min.Y + y ):]
+            copy( row[size*x:size*x+size], p[:size] )
+        }
+        _, err = w.Write( row )
+    }
+    if cerr := done(); err == nil {
+        err = cerr
+    }
+    return uint(width), uint(height), size * width * height, err
+}
+
+// reconstructPlanes returns the header of the first frame of data, which
+// must have 1 or 3 components (Y or YCbCr), and the planes of its components
+// reconstructed from its coefficients, only the first one if bw is true
+func reconstructPlanes( data []byte, l *fileLayout,
+                        bw bool ) (*frameHeader, []*plane, error) {
+    img, err := decodeCoefficients( data, l )
+    if err != nil {
+        return nil, nil, err
+    }
+    fh := img.frame
+    if len(fh.comps) != 1 && len(fh.comps) != 3 {
+        return nil, nil, fmt.Errorf( "%d components: not a YCbCr or " +
+                                     "grayscale picture\n", len(fh.comps) )
+    }
+    nComps := len(fh.comps)
+    if bw {
+        nComps = 1
+    }
+    planes := make( []*plane, nComps )
+    for ci := range planes {
+        if planes[ci], err = img.componentPlane( ci ); err != nil {
+            return nil, nil, err
+        }
+    }
+    return fh, planes, nil
+}
+
+// planeSamples returns in s the samples of planes for the pixel at x, y of
+// the frame fh, with chroma upsampled by replication, rounded and clamped
+// from 0 to max
+func planeSamples( fh *frameHeader, planes []*plane, x, y int, max float64,
+                   s *[3]float64 ) {
+    for ci, p := range planes {
+        c := &fh.comps[ci]
+        px, py := x * c.h / fh.hMax, y * c.v / fh.vMax
+        if px >= p.width {
+            px = p.width - 1
+        }
+        if py >= p.height {
+            py = p.height - 1
+        }
+        s[ci] = math.Min( max, math.Max( 0, math.Floor( p.at( px, py ) +
+                                                        0.5 ) ) )
+    }
+}
+
+// reconstructPicture returns the picture of the first frame of data, which
+// must have 1 or 3 components (Y or YCbCr) with 8-bit samples,
+// reconstructed from its coefficients. If bw is true, the picture is Y
+// repeated as R, G and B.
+func reconstructPicture( data []byte, l *fileLayout,
+                         bw bool ) (*image.RGBA, error) {
+    fh, planes, err := reconstructPlanes( data, l, bw )
+    if err != nil {
+        return nil, err
+    }
+    if fh.precision != 8 {
+        return nil, fmt.Errorf( "%d-bit samples are not supported\n",
+                                fh.precision )
+    }
+    nComps := len(planes)
+    rgba := image.NewRGBA( image.Rect( 0, 0, fh.width, fh.height ) )
+    var s [3]float64
+    for y := 0; y < fh.height; y++ {
+        for x := 0; x < fh.width; x++ {
+            planeSamples( fh, planes, x, y, 255, &s )
+            o := rgba.PixOffset( x, y )
+            if nComps == 1 {
+                rgba.Pix[o], rgba.Pix[o+1], rgba.Pix[o+2] = byte(s[0]),
+                                                            byte(s[0]),
+                                                            byte(s[0])
+            } else {
+                cb, cr := s[1] - 128, s[2] - 128
+                rgba.Pix[o] = clampSample( s[0] + 1.402 * cr )
+                rgba.Pix[o+1] = clampSample( s[0] - 0.344136 * cb -
+                                             0.714136 * cr )
+                rgba.Pix[o+2] = clampSample( s[0] + 1.772 * cb )
+            }
+            rgba.Pix[o+3] = 0xff
+        }
+    }
+    return rgba, nil
+}
+
+// saveReconstructedPicture saves the main picture of data, reconstructed from
+// its coefficients, as raw samples at path with the given orientation
+func saveReconstructedPicture( path string, data []byte, bw bool,
+                               o *jpeg.Orientation ) (nc, nr uint, n int,
+                                                      err error) {
+    rgba, err := reconstructPicture( data, scanLayout( data ), bw )
+    if err != nil {
+        return 0, 0, 0, fmt.Errorf( "unable to reconstruct the picture: %v",
+                                    err )
+    }
+    return writeRawSamples( path, rgba, 3, o )
+}
+
+// saveReconstructedPicture16 saves the main picture of data, which must have
+// more than 8-bit samples, reconstructed from its coefficients as raw 16-bit
+// samples at path with the Exif orientation o: 6 bytes per pixel, R, G and B,
+// or Y repeated for a BW picture, each big-endian from 0 to the largest value
+// at the frame precision (4095 for 12 bits). YCbCr is converted to RGB unless
+// rgb is true, in which case the components are already R, G and B and Y is
+// their Rec.601 luma. It
+// returns the dimensions of the oriented picture and the number of bytes
+// written.
+func saveReconstructedPicture16( path string, data []byte, bw, rgb bool,
+                                 o int ) (nc, nr uint, n int, err error) {
+    fh, planes, err := reconstructPlanes( data, scanLayout( data ),
+                                          bw && ! rgb )
+    if err != nil {
+        return 0, 0, 0, fmt.Errorf( "unable to reconstruct the picture: %v",
+                                    err )
+    }
+    max := float64( int(1) << uint(fh.precision) - 1 )
+    mid := float64( int(1) << uint(fh.precision - 1) )
+    samples := make( []uint16, 3 * fh.width * fh.height )
+    var s [3]float64
+    for y := 0; y < fh.height; y++ {
+        for x := 0; x < fh.width; x++ {
+            planeSamples( fh, planes, x, y, max, &s )
+            p := samples[3*(y*fh.width+x):]
+            switch {
+            case len(planes) == 1:
+                p[0], p[1], p[2] = uint16(s[0]), uint16(s[0]), uint16(s[0])
+            case rgb:
+                p[0], p[1], p[2] = uint16(s[0]), uint16(s[1]), uint16(s[2])
+            default:
+                cb, cr := s[1] - mid, s[2] - mid
+                p[0] = clampSample16( s[0] + 1.402 * cr, max )
+                p[1] = clampSample16( s[0] - 0.344136 * cb - 0.714136 * cr,
+                                      max )
+                p[2] = clampSample16( s[0] + 1.772 * cb, max )
+            }
+            if bw && len(planes) == 3 {
+                v := clampSample16( 0.299 * float64(p[0]) +
+                                    0.587 * float64(p[1]) +
+                                    0.114 * float64(p[2]), max )
+                p[0], p[1], p[2] = v, v, v
+            }
+        }
+    }
+    w, done, err := createFile( path )
+    if err != nil {
+        return 0, 0, 0, err
+    }
+    width, height := orientedSize( fh.width, fh.height, o )
+    row := make( []byte, 6 * width )
+    for y := 0; y < height && err == nil; y++ {
+        for x := 0; x < width; x++ {
+            sx, sy := orientedSource( fh.width, fh.height, o, x, y )
+            p := samples[3*(sy*fh.width+sx):]
+            for c := 0; c < 3; c++ {
+                row[6*x+2*c], row[6*x+2*c+1] = byte(p[c] >> 8), byte(p[c])
+            }
+        }
+        _, err = w.Write( row )
+    }
+    if cerr := done(); err == nil {
+        err = cerr
+    }
+    return uint(width), uint(height), 6 * width * height, err
+}
+
+// clampSample16 returns v rounded and clamped from 0 to max
+func clampSample16( v, max float64 ) uint16 {
+    return uint16( math.Min( max, math.Max( 0, math.Floor( v + 0.5 ) ) ) )
+}
@@ -0,0 +1,175 @@
+
+package main
+
+import (
+    "fmt"
+)
+
+// Recoverability: how much of the picture survives corruption of the file.
+// Entropy-coded data has no redundancy, so a single bit error desynchronizes
+// the decoder until the next RSTn marker, or until the end of the scan if
+// there is none. The score (0 to 100) adds up:
+//  - restart markers (40): full score for at least one RSTn per MCU row,
+//    proportionally less for longer intervals, none without restart markers.
+//  - coding process (20): sequential Huffman pictures lose only the blocks
+//    following an error, while an error in a progressive scan spreads to all
+//    later scans (EOB runs cover many blocks), and arithmetic, lossless or
+//    hierarchical pictures are rarely decodable by recovery tools.
+//  - ordering (20): metadata before the frame header, such as large previews,
+//    is where a corrupted length prevents finding the picture at all, so the
+//    score is reduced by the share of the file it takes.
+//  - redundancy (20): an integrity hash (C2PA hard binding) allows detecting
+//    damage, an embedded thumbnail or preview keeps a fallback rendition.
+
+const (
+    recoveryRestartMax      = 40
+    recoveryCodingMax       = 20
+    recoveryOrderingMax     = 20
+    recoveryRedundancyMax   = 20
+)
+
+type recoveryFactor struct {
+    name            string
+    score, max      int
+    detail          string
+}
+
+type recoveryScore struct {
+    score           int
+    factors         []recoveryFactor
+    suggestions     []string
+}
+
+func (rs *recoveryScore) add( name string, score, max int, detail string ) {
+    rs.factors = append( rs.factors, recoveryFactor{ name, score, max, detail } )
+    rs.score += score
+}
+
+func (rs *recoveryScore) suggest( f string, a ...interface{} ) {
+    rs.suggestions = append( rs.suggestions, fmt.Sprintf( f, a... ) )
+}
+
+// recoverability evaluates how resilient the first image in data is to
+// corruption
+func recoverability( data []byte, l *fileLayout ) *recoveryScore {
+    rs := new( recoveryScore )
+    var fh *frameHeader
+    sof, metadata, restart, nRST := -1, 0, 0, 0
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.marker == markerEOI {
+            break
+        }
+        switch {
+        case isSOF( s.marker ) && fh == nil:
+            sof = i
+            fh, _ = parseFrameHeader( s, data )
+        case ( s.marker >= markerAPP0 && s.marker <= markerAPP15 ) ||
+             s.marker == markerCOM:
+            if fh == nil {              // APPn or COM before the frame
+                metadata += s.end() - s.offset
+            }
+        case s.marker == markerDRI:
+            if d := s.data( data ); len(d) >= 2 {
+                restart = int(d[0]) << 8 | int(d[1])
+            }
+        case s.marker >= markerRST0 && s.marker <= markerRST7:
+            nRST ++
+        }
+    }
+    if fh == nil || fh.width == 0 {
+        rs.suggest( "no usable frame header, the picture cannot be evaluated" )
+        return rs
+    }
+
+    nx, _ := fh.mcus()
+    switch {
+    case restart == 0 || nRST == 0:
+        rs.add( "Restart markers", 0, recoveryRestartMax,
+                "none, an error corrupts the rest of the scan" )
+        rs.suggest( "add restart markers, one per MCU row (e.g. jpegtran " +
+                    "-restart 1)" )
+    default:
+        score := recoveryRestartMax
+        if restart > nx {
+            score = recoveryRestartMax * nx / restart
+        }
+        ecs, _, _ := entropyCodedBytes( data, l )
+        rs.add( "Restart markers", score, recoveryRestartMax, fmt.Sprintf(
+                "%d RSTn, every %d MCUs (%.2f MCU rows), one per %d bytes",
+                nRST, restart, float64(restart) / float64(nx),
+                ecs / ( nRST + 1 ) ) )
+        if restart > nx {
+            rs.suggest( "use shorter restart intervals, at most one MCU row " +
+                        "(%d MCUs)", nx )
+        }
+    }
+
+    m := l.segments[sof].marker
+    switch {
+    case m == markerSOF0 || m == markerSOF0 + 1:
+        rs.add( "Coding process", recoveryCodingMax, recoveryCodingMax,
+                "sequential Huffman" )
+    case m == markerSOF0 + 2:
+        rs.add( "Coding process", recoveryCodingMax / 2, recoveryCodingMax,
+                "progressive Huffman, errors spread to later scans" )
+        rs.suggest( "store the picture as baseline sequential (e.g. jpegtran " +
+                    "without -progressive), losslessly" )
+    default:
+        rs.add( "Coding process", recoveryCodingMax / 4, recoveryCodingMax,
+                markerName( m ) + ", rarely supported by recovery tools" )
+        rs.suggest( "migrate the picture to baseline sequential Huffman " +
+                    "coding" )
+    }
+
+    share := percent( int64(metadata), int64(l.size) )
+    score := recoveryOrderingMax - int( share * recoveryOrderingMax / 100 + 0.5 )
+    rs.add( "Ordering", score, recoveryOrderingMax, fmt.Sprintf(
+            "%d bytes (%.1f%%) of metadata before the frame header", metadata,
+            share ) )
+    if share > 25 {
+        rs.suggest( "keep large previews and metadata in separate files" )
+    }
+
+    score = 0
+    var found string
+    if findC2pa( data, l ) != nil {
+        score += recoveryRedundancyMax / 2
+        found = "C2PA hash"
+    } else {
+        rs.suggest( "keep a checksum of the file (e.g. -checksum) to detect " +
+                    "damage" )
+    }
+    for _, ei := range findEmbeddedImages( data, l ) {
+        if ei.isRendition() {
+            score += recoveryRedundancyMax / 2
+            if found != "" {
+                found += ", "
+            }
+            found += "embedded " + ei.id + " rendition"
+            break
+        }
+    }
+    if found == "" {
+        found = "none"
+    }
+    rs.add( "Redundancy", score, recoveryRedundancyMax, found )
+    return rs
+}
+
+// formatRecoverability prints the recoverability score of the file with the
+// contributing factors and suggestions, which are also reported as info
+func formatRecoverability( data []byte, l *fileLayout, rep *fileReport ) {
+    rs := recoverability( data, l )
+    fmt.Printf( "Recoverability score: %d/100\n", rs.score )
+    for _, f := range rs.factors {
+        fmt.Printf( "  %-16s %2d/%-2d %s\n", f.name, f.score, f.max, f.detail )
+    }
+    rep.addMessage( infoSeverity, codeRecoverability,
+                    fmt.Sprintf( "recoverability score %d/100", rs.score ) )
+    for _, s := range rs.suggestions {
+        fmt.Printf( "  Suggestion: %s\n", s )
+        rep.addMessage( infoSeverity, codeRecoverability,
+                        "recoverability: " + s )
+    }
+}
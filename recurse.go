@@ -0,0 +1,349 @@
+
+package main
+
+import (
+    "fmt"
+    "io/fs"
+    "math"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Recursive directory scan (-R): all regular files found in a directory tree
+// that start with the jpeg SOI marker are added to the batch, whatever their
+// name or extension, in lexical order. Files that cannot be read are skipped
+// with a message. In addition to the batch summary, a summary per directory
+// gives the number of valid and invalid files, and of files fixed, i.e. for
+// which a modified copy was written with -o (given as a template).
+//
+// Archive trees are full of links: symbolic links are skipped by default, or
+// followed with -symlinks=follow once the tree itself has been walked, so
+// that files are found under their real path first. A directory is only
+// walked once: a link to a directory already walked, including a link that
+// would make a loop, is not walked again. Paths that lead to the same file,
+// hard links or symbolic links to a file already found, are only checked once
+// unless -hardlinks=all is given. Files are compared with os.SameFile (device
+// and inode on unix), among files of the same size. The links found are given
+// in the batch summary.
+//
+// Files can be selected by size (-min-size, -max-size) and by modification
+// time (-newer-than, -older-than) while walking, for instance to check only
+// the files added since the last audit. Files excluded are counted in the
+// batch summary.
+
+type dirSummary struct {
+    valid, invalid  int
+    fixed           int
+}
+
+// fileFilter selects files by size and modification time
+type fileFilter struct {
+    minSize         int64           // -1 if no minimum
+    maxSize         int64           // -1 if no maximum
+    newer           time.Time       // zero if no limit
+    older           time.Time       // zero if no limit
+}
+
+var sizeUnits = map[string]int64{ "": 1, "k": 1 << 10, "m": 1 << 20,
+                                  "g": 1 << 30 }
+
+// parseFileSize parses a size in bytes, possibly followed by the unit k, M
+// or G (powers of 1024)
+func parseFileSize( s string ) (int64, error) {
+    t := strings.TrimSuffix( strings.ToLower( s ), "b" )
+    unit := strings.TrimLeft( t, "0123456789" )
+    scale, ok := sizeUnits[unit]
+    n, err := strconv.ParseInt( t[:len(t)-len(unit)], 10, 64 )
+    if ! ok || err != nil || n > math.MaxInt64 / scale {
+        return 0, fmt.Errorf( "invalid size %s (<n>[k|M|G])\n", s )
+    }
+    return n * scale, nil
+}
+
+// parseFileTime parses a time limit: a date (2006-01-02) or a date and time
+// (2006-01-02T15:04:05) in local time, an RFC 3339 time, a duration before
+// now in days (7d) or as hours, minutes and seconds (36h, 90m), or the path of
+// an existing file, whose modification time is used
+func parseFileTime( s string, now time.Time ) (time.Time, error) {
+    for _, layout := range []string{ "2006-01-02", "2006-01-02T15:04:05" } {
+        if t, err := time.ParseInLocation( layout, s, time.Local ); err == nil {
+            return t, nil
+        }
+    }
+    if t, err := time.Parse( time.RFC3339, s ); err == nil {
+        return t, nil
+    }
+    if strings.HasSuffix( s, "d" ) {
+        if n, err := strconv.Atoi( s[:len(s)-1] ); err == nil && n >= 0 {
+            return now.AddDate( 0, 0, -n ), nil
+        }
+    }
+    if d, err := time.ParseDuration( s ); err == nil && d >= 0 {
+        return now.Add( -d ), nil
+    }
+    if info, err := os.Stat( s ); err == nil {
+        return info.ModTime(), nil
+    }
+    return time.Time{}, fmt.Errorf( "invalid time %s (date, RFC 3339 time, " +
+                                    "duration or file)\n", s )
+}
+
+// newFileFilter returns the filter given by the options -min-size,
+// -max-size, -newer-than and -older-than, or nil if none is given
+func newFileFilter( minSize, maxSize, newer, older string ) (*fileFilter,
+                                                            error) {
+    if minSize == "" && maxSize == "" && newer == "" && older == "" {
+        return nil, nil
+    }
+    ff := &fileFilter{ minSize: -1, maxSize: -1 }
+    var err error
+    if minSize != "" {
+        if ff.minSize, err = parseFileSize( minSize ); err != nil {
+            return nil, fmt.Errorf( "-min-size: %v", err )
+        }
+    }
+    if maxSize != "" {
+        if ff.maxSize, err = parseFileSize( maxSize ); err != nil {
+            return nil, fmt.Errorf( "-max-size: %v", err )
+        }
+    }
+    now := time.Now()
+    if newer != "" {
+        if ff.newer, err = parseFileTime( newer, now ); err != nil {
+            return nil, fmt.Errorf( "-newer-than: %v", err )
+        }
+    }
+    if older != "" {
+        if ff.older, err = parseFileTime( older, now ); err != nil {
+            return nil, fmt.Errorf( "-older-than: %v", err )
+        }
+    }
+    return ff, nil
+}
+
+// selects returns true if the file described by info passes the filter
+func (ff *fileFilter) selects( info os.FileInfo ) bool {
+    size, modified := info.Size(), info.ModTime()
+    switch {
+    case ff.minSize != -1 && size < ff.minSize,
+         ff.maxSize != -1 && size > ff.maxSize,
+         ! ff.newer.IsZero() && ! modified.After( ff.newer ),
+         ! ff.older.IsZero() && ! modified.Before( ff.older ):
+        return false
+    }
+    return true
+}
+
+// walkSummary gives the links found and the files excluded by the filter
+// while walking a directory tree
+type walkSummary struct {
+    fileLinks       int             // symbolic links to files
+    dirLinks        int             // symbolic links to directories
+    broken          int             // symbolic links to nothing
+    walked          int             // links to directories already walked
+    followed        bool            // symbolic links were followed
+    same            [][]string      // paths of the same file, first checked
+    skipped         int             // paths to a file already found
+    filtered        bool            // a filter was applied
+    excluded        int             // files excluded by the filter
+}
+
+type treeWalk struct {
+    follow          bool            // follow symbolic links
+    allPaths        bool            // check all paths to the same file
+    filter          *fileFilter     // nil if all files are selected
+    rejected        map[int64][]os.FileInfo // files excluded by size
+    files           []string
+    bySize          map[int64][]int // index in files of found files by size
+    infos           []os.FileInfo   // of found files
+    same            map[int]int     // index in links.same by index in files
+    dirs            []os.FileInfo   // directories walked
+    pending         []string        // symbolic links to follow
+    summary         walkSummary
+}
+
+// findJpegFiles returns all jpeg files in the tree rooted at dir that pass
+// filter if it is not nil, following symbolic links if follow is true and
+// keeping all paths to the same file if allPaths is true, and a summary of
+// the links found and of the files excluded
+func findJpegFiles( dir string, follow, allPaths bool,
+                    filter *fileFilter ) ([]string, *walkSummary) {
+    tw := &treeWalk{ follow: follow, allPaths: allPaths, filter: filter,
+                     bySize: make( map[int64][]int ),
+                     rejected: make( map[int64][]os.FileInfo ),
+                     same: make( map[int]int ) }
+    tw.summary.followed = follow
+    tw.summary.filtered = filter != nil
+    tw.enter( dir )
+    for len(tw.pending) > 0 {
+        path := tw.pending[0]
+        tw.pending = tw.pending[1:]
+        tw.enter( path )
+    }
+    return tw.files, &tw.summary
+}
+
+// enter walks the directory or adds the file at path
+func (tw *treeWalk) enter( path string ) {
+    info, err := os.Stat( path )
+    switch {
+    case err != nil:
+        fmt.Printf( "jpegcheck: %v\n", err )
+    case info.IsDir():
+        for _, d := range tw.dirs {
+            if os.SameFile( info, d ) {
+                tw.summary.walked ++
+                return
+            }
+        }
+        tw.dirs = append( tw.dirs, info )
+        tw.walk( path )
+    case info.Mode().IsRegular():
+        if ! isJpegFile( path ) {
+            break
+        }
+        if tw.filter != nil && ! tw.filter.selects( info ) {
+            tw.reject( info )
+            break
+        }
+        tw.add( path, info )
+    }
+}
+
+// walk adds the jpeg files found in dir and walks its sub-directories. Symbolic
+// links are counted, and kept for later if they are followed.
+func (tw *treeWalk) walk( dir string ) {
+    entries, err := os.ReadDir( dir )   // sorted by name
+    if err != nil {
+        fmt.Printf( "jpegcheck: %v\n", err )
+    }
+    for _, e := range entries {
+        path := filepath.Join( dir, e.Name() )
+        mode := e.Type()
+        switch {
+        case mode & fs.ModeSymlink != 0:
+            info, err := os.Stat( path )
+            switch {
+            case err != nil:
+                tw.summary.broken ++
+                if tw.follow {
+                    fmt.Printf( "jpegcheck: broken link %s\n", path )
+                }
+                continue
+            case info.IsDir():
+                tw.summary.dirLinks ++
+            case info.Mode().IsRegular():
+                tw.summary.fileLinks ++
+            }
+            if tw.follow {
+                tw.pending = append( tw.pending, path )
+            }
+        case mode.IsDir(), mode.IsRegular():
+            tw.enter( path )
+        }
+    }
+}
+
+// reject counts a file excluded by the filter, once for all its paths
+func (tw *treeWalk) reject( info os.FileInfo ) {
+    for _, r := range tw.rejected[info.Size()] {
+        if os.SameFile( info, r ) {
+            return
+        }
+    }
+    tw.rejected[info.Size()] = append( tw.rejected[info.Size()], info )
+    tw.summary.excluded ++
+}
+
+// add adds the file at path, unless it is the same file as a file already
+// found and all paths are not requested
+func (tw *treeWalk) add( path string, info os.FileInfo ) {
+    for _, i := range tw.bySize[info.Size()] {
+        if ! os.SameFile( info, tw.infos[i] ) {
+            continue
+        }
+        g, ok := tw.same[i]
+        if ! ok {
+            g = len(tw.summary.same)
+            tw.same[i] = g
+            tw.summary.same = append( tw.summary.same, []string{ tw.files[i] } )
+        }
+        tw.summary.same[g] = append( tw.summary.same[g], path )
+        if ! tw.allPaths {
+            tw.summary.skipped ++
+            return
+        }
+        break
+    }
+    tw.bySize[info.Size()] = append( tw.bySize[info.Size()], len(tw.files) )
+    tw.files = append( tw.files, path )
+    tw.infos = append( tw.infos, info )
+}
+
+// summary prints the number of files excluded if a filter was applied and the
+// links found, if any
+func (ws *walkSummary) summary( ) {
+    if ws.filtered {
+        fmt.Printf( "jpegcheck: %d jpeg files excluded by size or date\n",
+                    ws.excluded )
+    }
+    if ws.fileLinks + ws.dirLinks + ws.broken + len(ws.same) == 0 {
+        return
+    }
+    action := "skipped"
+    if ws.followed {
+        action = "followed"
+    }
+    fmt.Printf( "jpegcheck: symbolic links %s: %d to files, %d to " +
+                "directories, %d broken\n", action, ws.fileLinks,
+                ws.dirLinks, ws.broken )
+    if ws.walked > 0 {
+        fmt.Printf( "  %d links to directories already walked (or loops) " +
+                    "not walked again\n", ws.walked )
+    }
+    if len(ws.same) == 0 {
+        return
+    }
+    fmt.Printf( "jpegcheck: %d files found under several paths, " +
+                "%d paths not checked again\n", len(ws.same), ws.skipped )
+    for _, paths := range ws.same {
+        fmt.Printf( "  %s\n", strings.Join( paths, " = " ) )
+    }
+}
+
+// countDir records the outcome of the file at path in its directory summary
+func (b *batch) countDir( path string, failed bool, rep *fileReport ) {
+    dir := filepath.Dir( path )
+    ds := b.dirs[dir]
+    if ds == nil {
+        ds = new( dirSummary )
+        b.dirs[dir] = ds
+    }
+    if failed {
+        ds.invalid ++
+    } else {
+        ds.valid ++
+    }
+    if rep.output != "" {
+        ds.fixed ++
+    }
+}
+
+// summaryByDir prints the outcome of the files checked in each directory
+func (b *batch) summaryByDir( ) {
+    dirs := make( []string, 0, len(b.dirs) )
+    for dir := range b.dirs {
+        dirs = append( dirs, dir )
+    }
+    sort.Strings( dirs )
+    fmt.Printf( "jpegcheck: %d directories with jpeg files\n", len(dirs) )
+    for _, dir := range dirs {
+        ds := b.dirs[dir]
+        fmt.Printf( "  %s: %d files, %d valid, %d invalid, %d fixed\n", dir,
+                    ds.valid + ds.invalid, ds.valid, ds.invalid, ds.fixed )
+    }
+}
@@ -0,0 +1,112 @@
+
+package main
+
+import (
+    "fmt"
+)
+
+// Guards for the recursive parsing of embedded pictures (-rp): before enabling
+// recursion, the Exif IFD structure is walked to detect offset loops and
+// excessive nesting, and the total size of embedded pictures is compared with
+// the requested limit. If the file is suspicious, recursion is disabled for
+// this file and a specific diagnostic is reported.
+
+const (
+    defaultRecurseDepth = 8
+    defaultRecurseSize  = 64 << 20
+)
+
+type ifdWalker struct {
+    t               *tiffReader
+    maxDepth        int
+    visited         map[uint32]bool
+    embedded        int         // total size of embedded jpeg pictures
+    visit           func( e *ifdEntry ) error   // optional, for each entry
+}
+
+var subIfdTags = map[uint16]string{ tagExifIfd: "Exif", tagGpsIfd: "GPS",
+                                    tagInteropIfd: "Interoperability",
+                                    tagSubIfds: "SubIFD" }
+
+func (w *ifdWalker) walk( offset uint32, depth int ) error {
+    for ; offset != 0; depth ++ {
+        if depth > w.maxDepth {
+            return fmt.Errorf( "IFD nesting deeper than %d levels\n", w.maxDepth )
+        }
+        if w.visited[offset] {
+            return fmt.Errorf( "IFD offset loop: IFD @0x%x is referred to " +
+                               "more than once\n", offset )
+        }
+        w.visited[offset] = true
+        entries, next, err := w.t.readIfd( offset )
+        if err != nil {
+            return err
+        }
+        for i := range entries {
+            e := &entries[i]
+            if w.visit != nil {
+                if err = w.visit( e ); err != nil {
+                    return err
+                }
+            }
+            if _, ok := subIfdTags[e.tag]; ok {
+                if e.tag == tagSubIfds && e.count > 1 {
+                    values, err := w.t.valueData( e )
+                    if err != nil {
+                        return err
+                    }
+                    for j := uint32(0); j < e.count; j++ {
+                        sub := w.t.order.Uint32( values[j*4:] )
+                        if err = w.walk( sub, depth + 1 ); err != nil {
+                            return err
+                        }
+                    }
+                    continue
+                }
+                if err = w.walk( w.t.uint32Value( e ), depth + 1 ); err != nil {
+                    return err
+                }
+            } else if e.tag == tagJPEGInterchangeFormatLength {
+                w.embedded += int( w.t.uint32Value( e ) )
+            }
+        }
+        offset = next
+    }
+    return nil
+}
+
+// checkRecursion returns an error if parsing recursively the embedded pictures
+// of the jpeg file at path could be unsafe. data is the file content if it
+// was read in advance, or nil.
+func checkRecursion( path string, data []byte, process *jpgArgs ) error {
+    data, err := inputData( path, data )
+    if err != nil {
+        return nil          // reported by the analysis
+    }
+    l := scanLayout( data )
+    embedded := 0
+    for _, s := range l.segments {
+        if s.marker != markerAPP0 + 1 {
+            continue
+        }
+        tiff := exifTiffData( s.data( data ) )
+        if tiff == nil {
+            continue
+        }
+        t, err := newTiffReader( tiff )
+        if err != nil {
+            return fmt.Errorf( "APP1 @0x%x: %v", s.offset, err )
+        }
+        w := &ifdWalker{ t: t, maxDepth: process.recurseDepth,
+                         visited: make( map[uint32]bool ) }
+        if err = w.walk( t.first, 0 ); err != nil {
+            return fmt.Errorf( "APP1 @0x%x: %v", s.offset, err )
+        }
+        embedded += w.embedded
+    }
+    if embedded > process.recurseSize {
+        return fmt.Errorf( "embedded pictures total %d bytes, more than the " +
+                           "limit of %d bytes\n", embedded, process.recurseSize )
+    }
+    return nil
+}
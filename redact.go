@@ -0,0 +1,212 @@
+
+package main
+
+import (
+    "fmt"
+    "math"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// Redaction (-redact): a rectangular region of the copy written with -o is
+// blacked out, filled with a color or pixelated in the DCT domain, so that
+// the rest of the picture is not degraded by a new compression. Modified
+// blocks keep only their DC coefficient, which is the fill level or, when
+// pixelating, the average DC of the blocks in a cell of at least 16x16
+// pixels. The region is extended to whole MCUs (or cells), and the scans are
+// entropy coded again with the tables of the file: blocks outside the region
+// are coded exactly as before, which is verified by decoding the result.
+// Embedded thumbnails are regenerated from the redacted picture, unless
+// -thumbs=strip is given.
+// Coordinates are in the stored picture, before any Exif orientation.
+
+const redactCell = 16       // minimum pixelation cell size in pixels
+
+type redactSpec struct {
+    spec            string      // as given, for the audit trail
+    x, y, w, h      int
+    fill            string      // color name, or "pixelate"
+    rgb             [3]int
+}
+
+var redactColors = map[string][3]int{
+    "black": { 0, 0, 0 }, "white": { 255, 255, 255 }, "gray": { 128, 128, 128 },
+}
+
+// parseRedact parses a redaction specification x,y,w,h[:<fill>] where fill
+// is black (default), white, gray, pixelate or an RGB color given as rrggbb
+func parseRedact( spec string ) (*redactSpec, error) {
+    rs := &redactSpec{ spec: spec, fill: "black" }
+    parts := strings.SplitN( spec, ":", 2 )
+    if len(parts) == 2 {
+        rs.fill = strings.ToLower( parts[1] )
+    }
+    coords := strings.Split( parts[0], "," )
+    if len(coords) != 4 {
+        return nil, fmt.Errorf( "invalid redaction region %s (x,y,w,h)\n",
+                                parts[0] )
+    }
+    v := []*int{ &rs.x, &rs.y, &rs.w, &rs.h }
+    for i, c := range coords {
+        n, err := strconv.ParseUint( strings.TrimSpace( c ), 10, 16 )
+        if err != nil {
+            return nil, fmt.Errorf( "invalid redaction region %s (x,y,w,h)\n",
+                                    parts[0] )
+        }
+        *v[i] = int(n)
+    }
+    if rs.w == 0 || rs.h == 0 {
+        return nil, fmt.Errorf( "empty redaction region %s\n", parts[0] )
+    }
+    if rgb, ok := redactColors[rs.fill]; ok {
+        rs.rgb = rgb
+    } else if rs.fill != "pixelate" {
+        c, err := strconv.ParseUint( strings.TrimPrefix( rs.fill, "#" ), 16, 32 )
+        if err != nil || len(strings.TrimPrefix( rs.fill, "#" )) != 6 {
+            return nil, fmt.Errorf( "invalid redaction fill %s (black, white, " +
+                                    "gray, pixelate or rrggbb)\n", rs.fill )
+        }
+        rs.rgb = [3]int{ int(c >> 16), int(c >> 8 & 0xff), int(c & 0xff) }
+    }
+    return rs, nil
+}
+
+// fillLevels returns the sample levels of the fill color for each component
+func (rs *redactSpec) fillLevels( nComps int ) ([]float64, error) {
+    r, g, b := float64(rs.rgb[0]), float64(rs.rgb[1]), float64(rs.rgb[2])
+    y := 0.299 * r + 0.587 * g + 0.114 * b
+    switch nComps {
+    case 1:
+        return []float64{ y }, nil
+    case 3:
+        return []float64{ y, 128 - 0.168736 * r - 0.331264 * g + 0.5 * b,
+                          128 + 0.5 * r - 0.418688 * g - 0.081312 * b }, nil
+    }
+    return nil, fmt.Errorf( "fill colors are not available for %d " +
+                            "components, use pixelate\n", nComps )
+}
+
+// redactCoefficients modifies the blocks of img in the region, and returns
+// the region actually redacted and the number of blocks modified
+func (rs *redactSpec) redactCoefficients( img *coefImage ) (x0, y0, x1, y1,
+                                                            n int, err error) {
+    fh := img.frame
+    cw, ch := 8 * fh.hMax, 8 * fh.vMax          // MCU size
+    if rs.fill == "pixelate" {
+        cw, ch = redactCell * ( ( cw + redactCell - 1 ) / redactCell ),
+                 redactCell * ( ( ch + redactCell - 1 ) / redactCell )
+    }
+    if rs.x >= fh.width || rs.y >= fh.height {
+        return 0, 0, 0, 0, 0, fmt.Errorf( "redaction region outside of the " +
+                                          "%dx%d picture\n", fh.width,
+                                          fh.height )
+    }
+    x0, y0 = rs.x / cw * cw, rs.y / ch * ch
+    x1 = ( rs.x + rs.w + cw - 1 ) / cw * cw
+    y1 = ( rs.y + rs.h + ch - 1 ) / ch * ch
+    var levels []float64
+    if rs.fill != "pixelate" {
+        if levels, err = rs.fillLevels( len(fh.comps) ); err != nil {
+            return
+        }
+    }
+    for ci, c := range fh.comps {
+        cc := &img.comps[ci]
+        q := img.quant[cc.tq]
+        if q == nil {
+            return 0, 0, 0, 0, 0, fmt.Errorf( "missing quantization table " +
+                                              "%d\n", cc.tq )
+        }
+        // cell and region in blocks of the component
+        cbw, cbh := cw * c.h / fh.hMax / 8, ch * c.v / fh.vMax / 8
+        bx0, by0 := x0 * c.h / fh.hMax / 8, y0 * c.v / fh.vMax / 8
+        bx1, by1 := x1 * c.h / fh.hMax / 8, y1 * c.v / fh.vMax / 8
+        for cy := by0; cy < by1 && cy < cc.by; cy += cbh {
+            for cx := bx0; cx < bx1 && cx < cc.bx; cx += cbw {
+                var dc int32
+                if levels != nil {
+                    dc = int32( math.Round( 8 * ( levels[ci] - 128 ) /
+                                            float64(q.values[0]) ) )
+                } else {
+                    var sum, count int
+                    for y := cy; y < cy + cbh && y < cc.by; y++ {
+                        for x := cx; x < cx + cbw && x < cc.bx; x++ {
+                            sum += int(cc.at( x, y )[0])
+                            count ++
+                        }
+                    }
+                    dc = int32( math.Round( float64(sum) / float64(count) ) )
+                }
+                for y := cy; y < cy + cbh && y < cc.by; y++ {
+                    for x := cx; x < cx + cbw && x < cc.bx; x++ {
+                        b := cc.at( x, y )
+                        nb := block{ dc }
+                        if *b != nb {
+                            *b = nb
+                            n ++
+                        }
+                    }
+                }
+            }
+        }
+    }
+    if x1 > fh.width {
+        x1 = fh.width
+    }
+    if y1 > fh.height {
+        y1 = fh.height
+    }
+    return
+}
+
+// redactFile redacts the region of the picture in the file at output, and
+// returns a description of the change.
+func redactFile( output string, rs *redactSpec ) (string, error) {
+    data, err := os.ReadFile( output )
+    if err != nil {
+        return "", fmt.Errorf( "redact: %v\n", err )
+    }
+    l := scanLayout( data )
+    img, err := decodeCoefficients( data, l )
+    if err != nil {
+        return "", fmt.Errorf( "redact: %v", err )
+    }
+    if m := img.frame.marker; m != markerSOF0 && m != markerSOF0 + 1 {
+        return "", fmt.Errorf( "redact: only available for Huffman " +
+                               "sequential frames, not %s\n", markerName( m ) )
+    }
+    x0, y0, x1, y1, n, err := rs.redactCoefficients( img )
+    if err != nil {
+        return "", fmt.Errorf( "redact: %v", err )
+    }
+    redacted, err := encodeCoefficients( data, l, img )
+    if err != nil {
+        return "", fmt.Errorf( "redact: %v", err )
+    }
+    check, err := decodeCoefficients( redacted, scanLayout( redacted ) )
+    if err != nil {
+        return "", fmt.Errorf( "redact: redacted picture cannot be decoded: " +
+                               "%v", err )
+    }
+    total := 0
+    for ci := range img.comps {
+        for i := range img.comps[ci].blocks {
+            if check.comps[ci].blocks[i] != img.comps[ci].blocks[i] {
+                return "", fmt.Errorf( "redact: block %d of component %d " +
+                                       "is not coded as expected\n", i, ci )
+            }
+        }
+        total += len(img.comps[ci].blocks)
+    }
+    if err = writeFile( output, redacted, 0644 ); err != nil {
+        return "", fmt.Errorf( "redact: %v\n", err )
+    }
+    how := "pixelated"
+    if rs.fill != "pixelate" {
+        how = "filled with " + rs.fill
+    }
+    return fmt.Sprintf( "redact: %dx%d region at %d,%d %s, %d of %d blocks " +
+                        "modified, other blocks coded as before", x1 - x0,
+                        y1 - y0, x0, y0, how, n, total ), nil
+}
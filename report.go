@@ -0,0 +1,152 @@
+
+package main
+
+import (
+    "fmt"
+    "os"
+    "strings"
+    "time"
+    "github.com/jrm-1535/jpeg"
+)
+
+// fileReport collects the results of the analysis of one file, for the machine
+// readable reports. It is filled by checkFile as analysis goes.
+
+type severity int
+const (
+    infoSeverity severity = iota
+    warningSeverity
+    errorSeverity
+    fatalSeverity                   // the analysis could not be completed
+)
+
+var severityNames = [...]string{ "info", "warning", "error", "fatal" }
+
+func (s severity) String( ) string {
+    return severityNames[s]
+}
+
+// parseSeverity returns the severity given by its name
+func parseSeverity( name string ) (severity, error) {
+    for s, n := range severityNames {
+        if n == name {
+            return severity(s), nil
+        }
+    }
+    return 0, fmt.Errorf( "invalid severity %s (%s)\n", name,
+                          strings.Join( severityNames[:], ", " ) )
+}
+
+type reportMessage struct {
+    severity        severity
+    text            string
+    cite            *citation   // relevant specification clause, if known
+    code            string      // stable diagnostic code
+    offset          int64       // in file, -1 if unknown
+    frame           int         // frame concerned, -1 for the whole file
+}
+
+type fileReport struct {
+    path            string
+    index           int         // position in batch, from 1
+    size            int64
+    modified        time.Time
+    analysed        bool        // false if outcome was taken from journal/cache
+    complete        bool        // parsed from SOI to EOI
+    failed          bool
+    framing         jpeg.Framing
+    frames          []*jpeg.FrameInfo
+    structure       []*frameEntry   // frame headers found in raw data
+    colorSpace      string      // of the first frame, from its components
+    exposure        *exposureInfo   // with -exposure-check
+    sharpness       *sharpnessInfo  // with -blur-check
+    messages        []reportMessage
+    output          string      // modified copy written with -o, if any
+    outputSize      int
+    changes         []string    // differences between file and its copy
+    analysis        *jsonAnalysis   // raw data structure, with -json
+    text            []string    // printed while checking, with -json
+}
+
+func newFileReport( path string ) *fileReport {
+    rep := new( fileReport )
+    rep.path = path
+    if info, err := os.Stat( path ); err == nil {
+        rep.size = info.Size()
+        rep.modified = info.ModTime()
+    }
+    return rep
+}
+
+// addMessage adds a message concerning the whole file, with its severity and
+// its diagnostic code
+func (rep *fileReport) addMessage( s severity, code, text string ) {
+    rep.addFrameMessage( -1, s, code, text )
+}
+
+// addFrameMessage adds a message concerning the frame given by its index in
+// the file, or the whole file if frame is -1
+func (rep *fileReport) addFrameMessage( frame int, s severity, code,
+                                        text string ) {
+    text = strings.TrimSpace( text )
+    rep.messages = append( rep.messages,
+                           reportMessage{ s, text, citeDiagnostic( text ), code,
+                                          diagnosticOffset( text ), frame } )
+}
+
+// filterMessages removes the messages less severe than min
+func (rep *fileReport) filterMessages( min severity ) {
+    var kept []reportMessage
+    for _, m := range rep.messages {
+        if m.severity >= min {
+            kept = append( kept, m )
+        }
+    }
+    rep.messages = kept
+}
+
+// formatCitation prints the severity and specification clause of a diagnostic
+// message, if the clause is known.
+func formatCitation( s severity, text string ) {
+    if cite := citeDiagnostic( text ); cite != nil {
+        fmt.Printf( "  [%s] see %s\n", s, cite )
+    }
+}
+
+// setDesc records the general information found in the parsed jpeg data
+func (rep *fileReport) setDesc( jpg *jpeg.Desc ) {
+    rep.complete = jpg.IsComplete()
+    rep.framing = jpg.GetImageInfo()
+    nFrames := jpg.GetNumberOfFrames()
+    for i := uint(0); i < nFrames; i++ {
+        if fi, err := jpg.GetFrameInfo( i ); err == nil {
+            rep.frames = append( rep.frames, fi )
+        }
+    }
+}
+
+var encodingModeNames = [...]string{ "Baseline Sequential",
+                                     "Extended Sequential",
+                                     "Extended Progressive", "Lossless" }
+func encodingModeName( m jpeg.EncodingMode ) string {
+    if int(m) < len(encodingModeNames) {
+        return encodingModeNames[m]
+    }
+    return "Unknown Encoding Mode"
+}
+
+var entropyCodingNames = [...]string{ "Huffman Coding", "Arithmetic Coding" }
+func entropyCodingName( e jpeg.EntropyCoding ) string {
+    if int(e) < len(entropyCodingNames) {
+        return entropyCodingNames[e]
+    }
+    return "Unknown Entropy Coding"
+}
+
+var framingNames = [...]string{ "Single Frame", "Hierarchical Frames" }
+func framingName( f jpeg.Framing ) string {
+    if int(f) < len(framingNames) {
+        return framingNames[f]
+    }
+    return "Unknown Framing"
+}
@@ -0,0 +1,29 @@
+
+package main
+
+import (
+    "os"
+    "strconv"
+    "time"
+)
+
+// Reproducible outputs (-reproducible): identical inputs and options must give
+// byte identical outputs, for content-addressed storage. Written pictures,
+// maps and metadata dumps do not depend on the time, segment order follows
+// the original file and XMP padding is taken from the original packet, so the
+// only nondeterminism left is the time recorded in audit events and reports,
+// and the modification time of input files recorded in reports.
+
+// outputTime returns the time to record in outputs: the current time, or with
+// -reproducible the time given by the SOURCE_DATE_EPOCH environment variable
+// (as in reproducible builds). ok is false if no time must be recorded.
+func (process *jpgArgs) outputTime( ) (t time.Time, ok bool) {
+    if ! process.reproducible {
+        return time.Now(), true
+    }
+    epoch, err := strconv.ParseInt( os.Getenv( "SOURCE_DATE_EPOCH" ), 10, 64 )
+    if err != nil {
+        return time.Time{}, false
+    }
+    return time.Unix( epoch, 0 ).UTC(), true
+}
@@ -0,0 +1,353 @@
+
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "image"
+    "math"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// Resizing (-resize): derivatives at delivery sizes are made from the picture
+// saved with -spict, with a separable resampling filter (Lanczos 3 by default,
+// Catmull-Rom or box). The saved picture is read again one row at a time and
+// only the source rows under the vertical filter are kept, horizontally
+// resampled, so that memory use is proportional to the width of the result.
+// The size is given as:
+//  - WxH, an exact size, or Wx or xH to keep the aspect ratio,
+//  - p%, a scale factor,
+//  - maxdim=n, the largest side, never enlarging the picture.
+
+type resampleFilter struct {
+    name            string
+    support         float64
+    kernel          func( x float64 ) float64
+}
+
+func sinc( x float64 ) float64 {
+    if x == 0 {
+        return 1
+    }
+    x *= math.Pi
+    return math.Sin( x ) / x
+}
+
+var resampleFilters = []*resampleFilter{
+    { "lanczos", 3, func( x float64 ) float64 {
+        if x = math.Abs( x ); x < 3 {
+            return sinc( x ) * sinc( x / 3 )
+        }
+        return 0
+    } },
+    { "catmullrom", 2, func( x float64 ) float64 {
+        switch x = math.Abs( x ); {
+        case x < 1:
+            return 1.5 * x * x * x - 2.5 * x * x + 1
+        case x < 2:
+            return -0.5 * x * x * x + 2.5 * x * x - 4 * x + 2
+        }
+        return 0
+    } },
+    { "box", 0.5, func( x float64 ) float64 {
+        if x >= -0.5 && x < 0.5 {
+            return 1
+        }
+        return 0
+    } },
+}
+
+type resizeSpec struct {
+    w, h            int         // exact size, one may be 0
+    percent         float64     // scale factor in percent, if not 0
+    maxDim          int         // largest side, if not 0
+    filter          *resampleFilter
+}
+
+// parseResize parses a size specification and a filter name
+func parseResize( spec, filter string ) (*resizeSpec, error) {
+    rs := new( resizeSpec )
+    for _, f := range resampleFilters {
+        if f.name == filter {
+            rs.filter = f
+        }
+    }
+    if rs.filter == nil {
+        return nil, fmt.Errorf( "invalid resize filter %s (lanczos, " +
+                                "catmullrom or box)\n", filter )
+    }
+    var err error
+    switch {
+    case strings.HasPrefix( spec, "maxdim=" ):
+        rs.maxDim, err = strconv.Atoi( spec[len("maxdim="):] )
+        if err == nil && rs.maxDim <= 0 {
+            err = fmt.Errorf( "not positive" )
+        }
+    case strings.HasSuffix( spec, "%" ):
+        rs.percent, err = strconv.ParseFloat( strings.TrimSuffix( spec, "%" ),
+                                              64 )
+        if err == nil && ( rs.percent <= 0 || rs.percent > 1000 ) {
+            err = fmt.Errorf( "out of range" )
+        }
+    default:
+        dims := strings.Split( strings.ToLower( spec ), "x" )
+        if len(dims) != 2 || dims[0] + dims[1] == "" {
+            err = fmt.Errorf( "not WxH" )
+            break
+        }
+        for i, p := range []*int{ &rs.w, &rs.h } {
+            if dims[i] == "" {
+                continue
+            }
+            if *p, err = strconv.Atoi( dims[i] ); err == nil && *p <= 0 {
+                err = fmt.Errorf( "not positive" )
+            }
+            if err != nil {
+                break
+            }
+        }
+    }
+    if err != nil {
+        return nil, fmt.Errorf( "invalid resize %s (WxH, p%% or maxdim=n)\n",
+                                spec )
+    }
+    return rs, nil
+}
+
+// size returns the size of the resized picture of nc x nr pixels
+func (rs *resizeSpec) size( nc, nr int ) (w, h int) {
+    scale := func( f float64 ) (int, int) {
+        return int( math.Max( 1, math.Round( float64(nc) * f ) ) ),
+               int( math.Max( 1, math.Round( float64(nr) * f ) ) )
+    }
+    switch {
+    case rs.maxDim != 0:
+        m := nc
+        if nr > m {
+            m = nr
+        }
+        if m <= rs.maxDim {
+            return nc, nr
+        }
+        return scale( float64(rs.maxDim) / float64(m) )
+    case rs.percent != 0:
+        return scale( rs.percent / 100 )
+    case rs.w == 0:
+        w, _ = scale( float64(rs.h) / float64(nr) )
+        return w, rs.h
+    case rs.h == 0:
+        _, h = scale( float64(rs.w) / float64(nc) )
+        return rs.w, h
+    }
+    return rs.w, rs.h
+}
+
+// contribution of source samples to a resampled sample
+type contribution struct {
+    first           int
+    weights         []float64
+}
+
+// resampleWeights returns the contributions of src samples to each of dst
+// samples, normalized and clamped to the edges
+func resampleWeights( src, dst int, f *resampleFilter ) []contribution {
+    scale := float64(dst) / float64(src)
+    fs := math.Min( scale, 1 )          // widen the filter when reducing
+    support := f.support / fs
+    contribs := make( []contribution, dst )
+    for i := range contribs {
+        center := ( float64(i) + 0.5 ) / scale - 0.5
+        first := int( math.Ceil( center - support ) )
+        last := int( math.Floor( center + support ) )
+        c := &contribs[i]
+        var sum float64
+        for j := first; j <= last; j++ {
+            w := f.kernel( ( float64(j) - center ) * fs )
+            k := j
+            if k < 0 {
+                k = 0
+            } else if k >= src {
+                k = src - 1
+            }
+            if len(c.weights) == 0 {
+                c.first = k
+            }
+            for c.first + len(c.weights) <= k {
+                c.weights = append( c.weights, 0 )
+            }
+            c.weights[k - c.first] += w
+            sum += w
+        }
+        if sum == 0 {       // box filter between samples
+            c.first, c.weights = int( center + 0.5 ), []float64{ 1 }
+            if c.first >= src {
+                c.first = src - 1
+            }
+            continue
+        }
+        for j := range c.weights {
+            c.weights[j] /= sum
+        }
+    }
+    return contribs
+}
+
+func clampSample( v float64 ) byte {
+    switch {
+    case v <= 0:
+        return 0
+    case v >= 255:
+        return 255
+    }
+    return byte( v + 0.5 )
+}
+
+// resizeRawPicture resizes the raw picture of nc x nr pixels saved at path,
+// which has 3 (RGB) or 1 (Y) bytes per pixel, and returns its new size.
+func resizeRawPicture( path string, nc, nr, size int,
+                       rs *resizeSpec ) (w, h, n int, err error) {
+    if nc == 0 || nr == 0 || size % ( nc * nr ) != 0 {
+        return 0, 0, 0, fmt.Errorf( "resize: unexpected picture size %d for " +
+                                    "%dx%d\n", size, nc, nr )
+    }
+    bpp := size / ( nc * nr )
+    w, h = rs.size( nc, nr )
+    if w == nc && h == nr {
+        fmt.Printf( "jpegcheck: %s is already at the requested size\n", path )
+        return nc, nr, size, nil
+    }
+    in, err := os.Open( path )
+    if err != nil {
+        return 0, 0, 0, fmt.Errorf( "resize: %v\n", err )
+    }
+    defer in.Close()
+    tmp := path + ".resize"
+    out, err := os.Create( tmp )
+    if err != nil {
+        return 0, 0, 0, fmt.Errorf( "resize: %v\n", err )
+    }
+    defer func( ) {
+        if out != nil {
+            out.Close()
+            os.Remove( tmp )
+        }
+    }()
+    hc := resampleWeights( nc, w, rs.filter )
+    vc := resampleWeights( nr, h, rs.filter )
+    src := make( []byte, nc * bpp )
+    rows := make( map[int][]float64 )   // horizontally resampled source rows
+    row := func( y int ) ([]float64, error) {
+        if r, ok := rows[y]; ok {
+            return r, nil
+        }
+        if _, err := in.ReadAt( src, int64( y * nc * bpp ) ); err != nil {
+            return nil, err
+        }
+        r := make( []float64, w * bpp )
+        for x, c := range hc {
+            for k, wt := range c.weights {
+                s := ( c.first + k ) * bpp
+                for b := 0; b < bpp; b++ {
+                    r[x * bpp + b] += wt * float64(src[s + b])
+                }
+            }
+        }
+        rows[y] = r
+        return r, nil
+    }
+    bw := bufio.NewWriter( out )
+    acc := make( []float64, w * bpp )
+    line := make( []byte, w * bpp )
+    for _, c := range vc {
+        for y := range rows {
+            if y < c.first {
+                delete( rows, y )
+            }
+        }
+        for i := range acc {
+            acc[i] = 0
+        }
+        for k, wt := range c.weights {
+            r, err := row( c.first + k )
+            if err != nil {
+                return 0, 0, 0, fmt.Errorf( "resize: %v\n", err )
+            }
+            for i, v := range r {
+                acc[i] += wt * v
+            }
+        }
+        for i, v := range acc {
+            line[i] = clampSample( v )
+        }
+        if _, err = bw.Write( line ); err != nil {
+            return 0, 0, 0, fmt.Errorf( "resize: %v\n", err )
+        }
+    }
+    if err = bw.Flush(); err == nil {
+        err = out.Close()
+    }
+    out = nil
+    if err == nil {
+        err = os.Rename( tmp, path )
+    }
+    if err != nil {
+        os.Remove( tmp )
+        return 0, 0, 0, fmt.Errorf( "resize: %v\n", err )
+    }
+    fmt.Printf( "jpegcheck: resized %s from %dx%d to %dx%d (%s)\n", path,
+                nc, nr, w, h, rs.filter.name )
+    return w, h, w * h * bpp, nil
+}
+
+// resizeImage returns img resampled to w x h pixels with the filter f, in the
+// same way as resizeRawPicture but in memory. Alpha is ignored.
+func resizeImage( img *image.RGBA, w, h int, f *resampleFilter ) *image.RGBA {
+    nc, nr := img.Rect.Dx(), img.Rect.Dy()
+    hc := resampleWeights( nc, w, f )
+    vc := resampleWeights( nr, h, f )
+    rows := make( map[int][]float64 )   // horizontally resampled source rows
+    row := func( y int ) []float64 {
+        if r, ok := rows[y]; ok {
+            return r
+        }
+        src := img.Pix[img.PixOffset( img.Rect.Min.X, img.Rect.Min.Y + y ):]
+        r := make( []float64, w * 3 )
+        for x, c := range hc {
+            for k, wt := range c.weights {
+                s := ( c.first + k ) * 4
+                for b := 0; b < 3; b++ {
+                    r[x * 3 + b] += wt * float64(src[s + b])
+                }
+            }
+        }
+        rows[y] = r
+        return r
+    }
+    res := image.NewRGBA( image.Rect( 0, 0, w, h ) )
+    acc := make( []float64, w * 3 )
+    for y, c := range vc {
+        for sy := range rows {
+            if sy < c.first {
+                delete( rows, sy )
+            }
+        }
+        for i := range acc {
+            acc[i] = 0
+        }
+        for k, wt := range c.weights {
+            for i, v := range row( c.first + k ) {
+                acc[i] += wt * v
+            }
+        }
+        line := res.Pix[res.PixOffset( 0, y ):]
+        for x := 0; x < w; x++ {
+            line[4*x] = clampSample( acc[3*x] )
+            line[4*x+1] = clampSample( acc[3*x+1] )
+            line[4*x+2] = clampSample( acc[3*x+2] )
+            line[4*x+3] = 255
+        }
+    }
+    return res
+}
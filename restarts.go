@@ -0,0 +1,59 @@
+package main
+
+import (
+    "fmt"
+)
+
+// Restart sequence and trailing data: checked from the raw layout of every
+// file, since the analysis of the library does not report them properly.
+//  - RSTn markers must follow each other modulo 8 in each scan, starting
+//    with RST0 (T.81 B.2.1). The library only warns about a wrong sequence
+//    and decodes the following intervals at the wrong place, so that a file
+//    with a missing or misplaced RSTn would pass unless -verify-scan is
+//    given: a wrong sequence is an error that fails the check.
+//  - data after the last EOI is not part of the jpeg data, and is either
+//    intentional (e.g. a vendor trailer) or left over by a bad transfer. The
+//    picture is still valid, so it is a warning (see also -security for
+//    appended archives and -suggest to remove it).
+
+// checkRestartSequence reports the RSTn markers out of sequence in l, and
+// returns an error if any
+func checkRestartSequence( l *fileLayout, rep *fileReport ) error {
+    var first string
+    expected, scan := 0, 0
+    for _, s := range l.segments {
+        switch {
+        case s.marker == markerSOS:
+            expected = 0
+            scan ++
+        case s.marker >= markerRST0 && s.marker <= markerRST0 + 7:
+            n := int(s.marker - markerRST0)
+            if n != expected {
+                text := fmt.Sprintf( "Restart sequence: RST%d @0x%x in scan " +
+                                     "%d, RST%d expected", n, s.offset, scan,
+                                     expected )
+                fmt.Printf( "%s\n", text )
+                rep.addMessage( errorSeverity, codeRestartSequence, text )
+                if first == "" {
+                    first = text
+                }
+            }
+            expected = ( n + 1 ) % 8
+        }
+    }
+    if first != "" {
+        return codedError{ fmt.Errorf( "invalid restart sequence: %s\n",
+                                       first ), codeRestartSequence }
+    }
+    return nil
+}
+
+// formatTrailingData warns about the data after the last EOI in l, if any
+func formatTrailingData( l *fileLayout, rep *fileReport ) {
+    if t := l.trailing; t.length > 0 {
+        text := fmt.Sprintf( "Trailing data: %d bytes after EOI @0x%x",
+                             t.length, t.offset )
+        fmt.Printf( "Warning: %s\n", text )
+        rep.addMessage( warningSeverity, codeTrailingData, text )
+    }
+}
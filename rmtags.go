@@ -0,0 +1,231 @@
+
+package main
+
+import (
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// Selective Exif tag removal (-rmeta=1:<sid>:<tag>[:<tag>...]): the library
+// only removes whole IFDs, so individual tags are removed from the copy
+// written with -o, in the IFD given by sid: the following entries are moved
+// up in the IFD, and the freed entry as well as the values of the removed tags
+// are cleared, so that the removed data (typically GPS coordinates) does not
+// remain in the file. Other data is not moved, so that offsets remain valid.
+
+// tagIfdNames gives the IFD names and the tag names of the sids that can be
+// used with tags
+var tagIfdNames = [...]struct{
+    name            string
+    tags            map[uint16]string
+}{
+    { "IFD0", tiffTagNames },
+    { "IFD1", tiffTagNames },
+    { "Exif IFD", tiffTagNames },
+    { "GPS IFD", gpsTagNames },
+    { "Interop IFD", interopTagNames },
+}
+
+// isTagSpec returns true if s is a tag given by name or by hexadecimal id,
+// rather than an app id or a sid
+func isTagSpec( s string ) bool {
+    return strings.HasPrefix( s, "0x" ) ||
+           ( s != "" && ( s[0] < '0' || s[0] > '9' ) && s[0] != '-' )
+}
+
+// parseTag returns the id of the tag given by name or by hexadecimal id in the
+// IFD identified by sid
+func parseTag( sid int, s string ) (uint16, error) {
+    if sid < 0 || sid >= len(tagIfdNames) {
+        return 0, fmt.Errorf( "tags cannot be removed from sid %d (0 to " +
+                              "%d)\n", sid, len(tagIfdNames) - 1 )
+    }
+    if strings.HasPrefix( s, "0x" ) {
+        v, err := strconv.ParseUint( s[2:], 16, 16 )
+        if err != nil {
+            return 0, fmt.Errorf( "invalid tag %s\n", s )
+        }
+        return uint16(v), nil
+    }
+    for tag, name := range tagIfdNames[sid].tags {
+        if strings.EqualFold( name, s ) {
+            return tag, nil
+        }
+    }
+    for i, ifd := range tagIfdNames {
+        for _, name := range ifd.tags {
+            if strings.EqualFold( name, s ) {
+                return 0, fmt.Errorf( "tag %s belongs to the %s (sid %d), " +
+                                      "not to the %s\n", s, ifd.name, i,
+                                      tagIfdNames[sid].name )
+            }
+        }
+    }
+    return 0, fmt.Errorf( "unknown tag %s\n", s )
+}
+
+// tagName returns the name of tag in the IFD identified by sid, or its
+// hexadecimal id if it has no name
+func tagName( sid int, tag uint16 ) string {
+    if name, ok := tagIfdNames[sid].tags[tag]; ok {
+        return name
+    }
+    return fmt.Sprintf( "0x%04x", tag )
+}
+
+// removesTags returns true if individual tags are to be removed
+func (process *jpgArgs) removesTags( ) bool {
+    for _, rm := range process.rmActions {
+        if len(rm.tags) > 0 {
+            return true
+        }
+    }
+    return false
+}
+
+// tagIfdOffset returns the offset of the IFD identified by sid in t, or 0 if
+// it is absent
+func tagIfdOffset( t *tiffReader, sid int ) uint32 {
+    entries, next, err := t.readIfd( t.first )
+    if err != nil {
+        return 0
+    }
+    pointer := func( entries []ifdEntry, tag uint16 ) uint32 {
+        for i := range entries {
+            if entries[i].tag == tag {
+                return t.uint32Value( &entries[i] )
+            }
+        }
+        return 0
+    }
+    switch sid {
+    case 0:
+        return t.first
+    case 1:
+        return next
+    case 2:
+        return pointer( entries, tagExifIfd )
+    case 3:
+        return pointer( entries, tagGpsIfd )
+    }
+    exif := pointer( entries, tagExifIfd )
+    if exif == 0 {
+        return 0
+    }
+    if entries, _, err = t.readIfd( exif ); err != nil {
+        return 0
+    }
+    return pointer( entries, tagInteropIfd )
+}
+
+// removeIfdTags removes the entries of the given tags from the IFD at offset
+// in tiff, identified by sid, in place, and returns the names of the tags
+// removed
+func removeIfdTags( tiff []byte, offset uint32, sid int,
+                    tags []uint16 ) ([]string, error) {
+    t, err := newTiffReader( tiff )
+    if err != nil {
+        return nil, err
+    }
+    entries, next, err := t.readIfd( offset )
+    if err != nil {
+        return nil, err
+    }
+    var kept []ifdEntry
+    var removed []string
+    for i := range entries {
+        e := &entries[i]
+        remove := false
+        for _, tag := range tags {
+            remove = remove || e.tag == tag
+        }
+        if ! remove {
+            kept = append( kept, *e )
+            continue
+        }
+        removed = append( removed, tagName( sid, e.tag ) )
+        if size := e.size(); size > 4 {
+            at := uint64(t.order.Uint32( e.value ))
+            if at + uint64(size) <= uint64(len(tiff)) {
+                for j := at; j < at + uint64(size); j++ {
+                    tiff[j] = 0
+                }
+            }
+        }
+    }
+    if len(removed) == 0 {
+        return nil, nil
+    }
+    entry := make( []byte, 12 * len(kept) )
+    for i := range kept {
+        copy( entry[12*i:], tiff[kept[i].position:kept[i].position+12] )
+    }
+    start := int(offset) + 2
+    t.order.PutUint16( tiff[offset:], uint16(len(kept)) )
+    copy( tiff[start:], entry )
+    t.order.PutUint32( tiff[start+len(entry):], next )
+    end := start + 12 * len(entries) + 4
+    for j := start + len(entry) + 4; j < end; j++ {
+        tiff[j] = 0
+    }
+    return removed, nil
+}
+
+// removeExifTags removes the tags given in the actions from the first Exif
+// segment of the file at output, and returns a description of the changes
+func removeExifTags( output string, actions []metaIds ) (string, error) {
+    data, err := os.ReadFile( output )
+    if err != nil {
+        return "", fmt.Errorf( "rmeta: %v\n", err )
+    }
+    l := scanLayout( data )
+    var tiff []byte
+    for i := range l.segments {
+        s := &l.segments[i]
+        if isImageDataMarker( s.marker ) || s.marker == markerEOI {
+            break
+        }
+        if s.marker == markerAPP0 + 1 {
+            if tiff = exifTiffData( s.data( data ) ); tiff != nil {
+                break
+            }
+        }
+    }
+    if tiff == nil {
+        return "rmeta: no Exif segment, no tag removed", nil
+    }
+    t, err := newTiffReader( tiff )
+    if err != nil {
+        return "", fmt.Errorf( "rmeta: %v", err )
+    }
+    var changes []string
+    for _, rm := range actions {
+        if len(rm.tags) == 0 {
+            continue
+        }
+        sid := rm.sIds[0]
+        ifd := tagIfdNames[sid]
+        offset := tagIfdOffset( t, sid )
+        if offset == 0 {
+            changes = append( changes, "no " + ifd.name )
+            continue
+        }
+        removed, err := removeIfdTags( tiff, offset, sid, rm.tags )
+        if err != nil {
+            return "", fmt.Errorf( "rmeta: %s: %v", ifd.name, err )
+        }
+        if len(removed) == 0 {
+            changes = append( changes, "no tag to remove in " + ifd.name )
+            continue
+        }
+        changes = append( changes, fmt.Sprintf( "%s removed from %s",
+                                                strings.Join( removed, ", " ),
+                                                ifd.name ) )
+    }
+    if err = writeFile( output, data, 0644 ); err != nil {
+        return "", fmt.Errorf( "rmeta: %v\n", err )
+    }
+    return "rmeta: " + strings.Join( changes, "; " ), nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+    "bytes"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestParseTag( t *testing.T ) {
+    tests := []struct {
+        sid     int
+        spec    string
+        tag     uint16
+        err     string              // expected in the error, if any
+    }{
+        { 0, "Software", 0x0131, "" },
+        { 0, "software", 0x0131, "" },
+        { 0, "0x013b", 0x013b, "" },
+        { 3, "GPSLatitude", 0x0002, "" },
+        { 0, "GPSLatitude", 0, "belongs to the GPS IFD (sid 3)" },
+        { 0, "NoSuchTag", 0, "unknown tag" },
+        { 0, "0xzz", 0, "invalid tag" },
+        { 5, "Software", 0, "cannot be removed from sid 5" },
+    }
+    for _, tc := range tests {
+        tag, err := parseTag( tc.sid, tc.spec )
+        switch {
+        case tc.err == "" && err != nil:
+            t.Errorf( "%d:%s: %v", tc.sid, tc.spec, err )
+        case tc.err != "" && ( err == nil ||
+                               ! strings.Contains( err.Error(), tc.err ) ):
+            t.Errorf( "%d:%s: error %v, expected %q", tc.sid, tc.spec, err,
+                      tc.err )
+        case tag != tc.tag:
+            t.Errorf( "%d:%s: tag 0x%04x, expected 0x%04x", tc.sid, tc.spec,
+                      tag, tc.tag )
+        }
+    }
+}
+
+// ifdValues returns the values by tag of the IFD identified by sid in the
+// first Exif segment of data
+func ifdValues( t *testing.T, data []byte, sid int ) map[uint16][]byte {
+    var tiff []byte
+    l := scanLayout( data )
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.marker == markerAPP0 + 1 {
+            if tiff = exifTiffData( s.data( data ) ); tiff != nil {
+                break
+            }
+        }
+    }
+    r, err := newTiffReader( tiff )
+    if err != nil {
+        t.Fatal( err )
+    }
+    values := make( map[uint16][]byte )
+    offset := tagIfdOffset( r, sid )
+    if offset == 0 {
+        return values
+    }
+    entries, _, err := r.readIfd( offset )
+    if err != nil {
+        t.Fatal( err )
+    }
+    for i := range entries {
+        v, err := r.valueData( &entries[i] )
+        if err != nil {
+            t.Fatal( err )
+        }
+        values[entries[i].tag] = append( []byte( nil ), v... )
+    }
+    return values
+}
+
+// TestRemoveExifTags checks that -rmeta=1:<sid>:<tag> removes the tags and
+// clears their values, and keeps the other tags with their values
+func TestRemoveExifTags( t *testing.T ) {
+    sids := []int{ 0, 2, 3 }            // IFD0, Exif IFD and GPS IFD
+    tests := []struct {
+        name    string
+        spec    string
+        removed map[int][]uint16    // tags removed by sid
+        change  string
+    }{
+        { "GPS tag", "1:3:GPSLatitude",
+          map[int][]uint16{ 3: { 0x0002 } },
+          "GPSLatitude removed from GPS IFD" },
+        { "tag id", "1:0:0x0131",
+          map[int][]uint16{ 0: { 0x0131 } }, "Software removed from IFD0" },
+        { "two tags", "1:0:Software:Artist",
+          map[int][]uint16{ 0: { 0x0131, 0x013b } },
+          "Software, Artist removed from IFD0" },
+        { "two IFDs", "1:2:LensMake,1:3:GPSLatitude",
+          map[int][]uint16{ 2: { 0xa433 }, 3: { 0x0002 } },
+          "LensMake removed from Exif IFD; GPSLatitude removed from GPS IFD" },
+        { "absent tag", "1:0:Copyright", nil, "no tag to remove in IFD0" },
+    }
+    path := filepath.Join( t.TempDir(), "in.jpg" )
+    data := withExif( testsetData( t, "baseline-420.jpg" ), gpsTiff() )
+    if err := os.WriteFile( path, data, 0644 ); err != nil {
+        t.Fatal( err )
+    }
+    me, err := parseSetMeta( "Software=jpegcheck rmtags test," +
+                             "Artist=somebody,LensMake=some lens maker" )
+    if err != nil {
+        t.Fatal( err )
+    }
+    if _, err = setExifFile( path, me ); err != nil {
+        t.Fatal( err )
+    }
+    if data, err = os.ReadFile( path ); err != nil {
+        t.Fatal( err )
+    }
+    for _, tc := range tests {
+        t.Run( tc.name, func( t *testing.T ) {
+            out := filepath.Join( t.TempDir(), "out.jpg" )
+            if err := os.WriteFile( out, data, 0644 ); err != nil {
+                t.Fatal( err )
+            }
+            actions, err := parseMeta( tc.spec, true )
+            if err != nil {
+                t.Fatal( err )
+            }
+            change, err := removeExifTags( out, actions )
+            if err != nil {
+                t.Fatal( err )
+            }
+            if change != "rmeta: " + tc.change {
+                t.Errorf( "change %q, expected %q", change, tc.change )
+            }
+            modified, err := os.ReadFile( out )
+            if err != nil {
+                t.Fatal( err )
+            }
+            if len(modified) != len(data) {
+                t.Errorf( "size changed from %d to %d", len(data),
+                          len(modified) )
+            }
+            for _, sid := range sids {
+                before := ifdValues( t, data, sid )
+                after := ifdValues( t, modified, sid )
+                for _, tag := range tc.removed[sid] {
+                    if _, ok := after[tag]; ok {
+                        t.Errorf( "%s not removed", tagName( sid, tag ) )
+                    }
+                    if v := before[tag]; len(v) > 4 &&
+                                         bytes.Contains( modified, v ) {
+                        t.Errorf( "%s value left in the file",
+                                  tagName( sid, tag ) )
+                    }
+                    delete( before, tag )
+                }
+                for tag, v := range before {
+                    if ! bytes.Equal( after[tag], v ) {
+                        t.Errorf( "%s changed from % x to % x",
+                                  tagName( sid, tag ), v, after[tag] )
+                    }
+                }
+                if len(after) != len(before) {
+                    t.Errorf( "%d tags in %s, expected %d", len(after),
+                              tagIfdNames[sid].name, len(before) )
+                }
+            }
+            if metadataLines( modified ) == nil {
+                t.Errorf( "output does not parse" )
+            }
+        } )
+    }
+}
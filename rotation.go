@@ -0,0 +1,237 @@
+package main
+
+import (
+    "fmt"
+    "image"
+    "math"
+    "sort"
+)
+
+// Rotation suggestion (-rotation-check): scanned batches routinely lack an
+// orientation tag, so when the first Exif segment gives no orientation the
+// decoded picture, downscaled to fit in rotationSize pixels, is turned in the
+// 4 possible ways and each way is scored as upright with simple statistics:
+//  - a document, mostly paper with some ink, is upright if the ink gathers in
+//    horizontal lines (the row profile of ink varies more than the column
+//    profile), and if the lines start at the same position on the left while
+//    they end raggedly on the right,
+//  - another picture is upright if the top is brighter and smoother than the
+//    bottom, as with the sky over the ground, and, to a lesser extent, if it
+//    has more horizontal than vertical edges, as with the horizon.
+// Each statistic scores from -1 to 1 and the scores are added. If the best
+// way beats the picture as is by at least rotationMargin, the rotation is
+// suggested as an info message, with the Exif orientation that -setmeta would
+// set: the picture is never turned automatically, since the statistics are
+// easily fooled by unusual content.
+
+const (
+    rotationSize        = 512       // largest side of the analysed picture
+    rotationMargin      = 0.25      // smallest score gain to suggest
+    paperTolerance      = 32        // levels from the paper
+    inkContrast         = 64        // levels below the paper
+)
+
+// rotations are the Exif orientations that turn the picture clockwise by 0,
+// 90, 180 and 270 degrees
+var rotations = [...]int{ 1, 6, 3, 8 }
+
+// lumaGrid is the Rec.601 luma of a picture
+type lumaGrid struct {
+    w, h            int
+    l               []float64
+}
+
+func newLumaGrid( img *image.RGBA ) *lumaGrid {
+    g := &lumaGrid{ w: img.Rect.Dx(), h: img.Rect.Dy() }
+    g.l = make( []float64, g.w * g.h )
+    for y := 0; y < g.h; y++ {
+        p := img.Pix[img.PixOffset( img.Rect.Min.X, img.Rect.Min.Y + y ):]
+        for x := 0; x < g.w; x++ {
+            g.l[y*g.w+x] = 0.299 * float64(p[4*x]) + 0.587 * float64(p[4*x+1]) +
+                           0.114 * float64(p[4*x+2])
+        }
+    }
+    return g
+}
+
+func (g *lumaGrid) at( x, y int ) float64 {
+    return g.l[y * g.w + x]
+}
+
+// paperLevel returns the luma of the paper, if g looks like a document with
+// some ink on a light background, or -1
+func (g *lumaGrid) paperLevel( ) float64 {
+    sorted := append( []float64{ }, g.l... )
+    sort.Float64s( sorted )
+    paper := sorted[len(sorted) * 9 / 10]
+    if paper < 128 {
+        return -1
+    }
+    onPaper, ink := 0, 0
+    for _, v := range g.l {
+        switch {
+        case math.Abs( v - paper ) <= paperTolerance:
+            onPaper++
+        case v < paper - inkContrast:
+            ink++
+        }
+    }
+    n := float64(len(g.l))
+    if float64(onPaper) < 0.6 * n || float64(ink) < 0.005 * n ||
+       float64(ink) > 0.25 * n {
+        return -1
+    }
+    return paper
+}
+
+// balance returns (a - b) / (a + b), or 0 if both are 0
+func balance( a, b float64 ) float64 {
+    if a + b == 0 {
+        return 0
+    }
+    return ( a - b ) / ( a + b )
+}
+
+// meanStddev returns the mean and the standard deviation of v
+func meanStddev( v []float64 ) (mean, sd float64) {
+    if len(v) == 0 {
+        return 0, 0
+    }
+    var sum, sum2 float64
+    for _, x := range v {
+        sum += x
+        sum2 += x * x
+    }
+    n := float64(len(v))
+    mean = sum / n
+    return mean, math.Sqrt( math.Max( 0, sum2 / n - mean * mean ) )
+}
+
+// variation returns the coefficient of variation of v
+func variation( v []float64 ) float64 {
+    mean, sd := meanStddev( v )
+    if mean == 0 {
+        return 0
+    }
+    return sd / mean
+}
+
+// documentScore returns how much g looks like an upright document whose ink
+// is darker than paper - inkContrast
+func (g *lumaGrid) documentScore( paper float64 ) float64 {
+    rows, cols := make( []float64, g.h ), make( []float64, g.w )
+    var first, last []float64
+    for y := 0; y < g.h; y++ {
+        start, end := -1, -1
+        for x := 0; x < g.w; x++ {
+            if g.at( x, y ) < paper - inkContrast {
+                rows[y]++
+                cols[x]++
+                if start == -1 {
+                    start = x
+                }
+                end = x
+            }
+        }
+        if rows[y] >= 0.02 * float64(g.w) {
+            first = append( first, float64(start) )
+            last = append( last, float64(g.w - 1 - end) )
+        }
+    }
+    score := balance( variation( rows ), variation( cols ) )
+    if len(first) > 1 {     // spread of line ends and starts
+        _, ends := meanStddev( last )
+        _, starts := meanStddev( first )
+        score += balance( ends, starts )
+    }
+    return score
+}
+
+// sceneScore returns how much g looks like an upright scene
+func (g *lumaGrid) sceneScore( ) float64 {
+    third := g.h / 3
+    var top, bottom, topEdges, bottomEdges, horizontal, vertical float64
+    for y := 0; y < g.h - 1; y++ {
+        for x := 0; x < g.w - 1; x++ {
+            l := g.at( x, y )
+            dx := math.Abs( g.at( x + 1, y ) - l )
+            dy := math.Abs( g.at( x, y + 1 ) - l )
+            vertical += dx
+            horizontal += dy
+            switch {
+            case y < third:
+                top += l
+                topEdges += dx + dy
+            case y >= g.h - third:
+                bottom += l
+                bottomEdges += dx + dy
+            }
+        }
+    }
+    return balance( top, bottom ) + balance( bottomEdges, topEdges ) +
+           balance( horizontal, vertical ) / 2
+}
+
+// rotationSuggestion returns the clockwise rotation in degrees (0, 90, 180 or
+// 270) that seems to make img upright, the kind of heuristic used and the
+// scores of the 4 rotations
+func rotationSuggestion( img *image.RGBA ) (int, string, [4]float64) {
+    w, h := img.Rect.Dx(), img.Rect.Dy()
+    if w > rotationSize || h > rotationSize {
+        r := letterbox( w, h, rotationSize, rotationSize )
+        img = resizeImage( img, r.Dx(), r.Dy(), resampleFilters[2] ) // box
+    }
+    paper := newLumaGrid( img ).paperLevel()
+    kind := "scene"
+    if paper >= 0 {
+        kind = "document"
+    }
+    var scores [4]float64
+    best := 0
+    for i, o := range rotations {
+        g := newLumaGrid( orientImage( img, o ) )
+        if g.w < 3 || g.h < 3 {
+            return 0, kind, scores
+        }
+        if paper >= 0 {
+            scores[i] = g.documentScore( paper )
+        } else {
+            scores[i] = g.sceneScore()
+        }
+        if scores[i] > scores[best] {
+            best = i
+        }
+    }
+    if scores[best] - scores[0] < rotationMargin {
+        best = 0
+    }
+    return 90 * best, kind, scores
+}
+
+// formatRotationCheck suggests a rotation for the picture in data if the file
+// has no Exif orientation, as an info message in rep
+func formatRotationCheck( data []byte, l *fileLayout, rep *fileReport ) {
+    if o, ok := exifOrientationTag( data, l ); ok {
+        fmt.Printf( "Rotation: Exif orientation %d given, no suggestion\n", o )
+        return
+    }
+    img, err := decodeRGBA( data )
+    if err != nil {
+        fmt.Printf( "Rotation: unable to decode the picture: %v\n", err )
+        rep.addMessage( infoSeverity, codeRotation, "rotation check not done" )
+        return
+    }
+    degrees, kind, scores := rotationSuggestion( img )
+    fmt.Printf( "Rotation: no Exif orientation, %s scores %.2f (as is), " +
+                "%.2f (90), %.2f (180), %.2f (270)\n", kind, scores[0],
+                scores[1], scores[2], scores[3] )
+    if degrees == 0 {
+        return
+    }
+    text := fmt.Sprintf( "Rotation suggestion: the picture seems to need a " +
+                         "%d degree clockwise rotation (%s heuristic), which " +
+                         "-setmeta=Orientation=%d would record", degrees,
+                         kind, rotations[degrees/90] )
+    fmt.Printf( "  %s\n", text )
+    rep.addMessage( infoSeverity, codeRotation, text )
+}
@@ -0,0 +1,204 @@
+
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+    "strings"
+
+    "github.com/jrm-1535/jpeg"
+)
+
+// Round-trip self test: after writing a modified copy (-o), the copy is read
+// back and compared with the original file, so that a rewrite that damages the
+// file does not go unnoticed.
+
+// segmentBytes returns the complete segment, including its marker and any
+// following entropy-coded data
+func segmentBytes( s *segment, data []byte ) []byte {
+    end := s.end()
+    if s.ecsEnd != 0 {
+        end = s.ecsEnd
+    }
+    if end > len(data) {
+        end = len(data)
+    }
+    return data[s.offset:end]
+}
+
+// mayChange returns true if the requested modifications can legitimately
+// change or remove a segment with marker m
+func mayChange( m byte, process *jpgArgs ) bool {
+    if process.control.TidyUp {
+        return true
+    }
+    if ( process.audit || process.fixByteOrder || process.setMeta != nil ||
+         process.loadMeta != nil || process.stripGps ) && m == markerAPP0 + 1 {
+        return true
+    }
+    if process.copyMeta != nil && ( m == markerAPP0 + 1 || m == markerAPP0 + 2 ) {
+        return true
+    }
+    if process.rmC2pa && m == markerAPP0 + 11 {
+        return true
+    }
+    if len(process.rmActions) != 0 {
+        return ( m >= markerAPP0 && m <= markerAPP15 ) || m == markerCOM
+    }
+    return false
+}
+
+// compareSegments checks that segments of the copy are identical to segments of
+// the original, except for those that the modifications could change. It
+// returns the number of identical and modified segments and the list of
+// problems found.
+func compareSegments( orig, written []byte, process *jpgArgs ) (identical,
+                                    modified int, problems []string) {
+    ol, cl := scanLayout( orig ), scanLayout( written )
+    remaining := make( map[string]int )
+    for i := range ol.segments {
+        remaining[string(segmentBytes( &ol.segments[i], orig ))] ++
+    }
+    for i := range cl.segments {
+        s := &cl.segments[i]
+        key := string(segmentBytes( s, written ))
+        if remaining[key] > 0 {
+            remaining[key] --
+            identical ++
+            continue
+        }
+        modified ++
+        if ! mayChange( s.marker, process ) {
+            problems = append( problems, fmt.Sprintf( "%s @0x%x differs from " +
+                               "the original", markerName( s.marker ),
+                               s.offset ) )
+        }
+    }
+    for i := range ol.segments {
+        s := &ol.segments[i]
+        key := string(segmentBytes( s, orig ))
+        if remaining[key] > 0 {
+            remaining[key] --
+            if ! mayChange( s.marker, process ) {
+                problems = append( problems, fmt.Sprintf( "original %s @0x%x " +
+                                   "is missing in the copy",
+                                   markerName( s.marker ), s.offset ) )
+            }
+        }
+    }
+    if cl.truncated {
+        problems = append( problems, "copy is truncated" )
+    }
+    return
+}
+
+// comparePictures checks that the decoded samples of all frames are identical
+func comparePictures( orig, written *jpeg.Desc ) (problems []string) {
+    n := orig.GetNumberOfFrames()
+    if c := written.GetNumberOfFrames(); c != n {
+        return []string{ fmt.Sprintf( "%d frames in the copy instead of %d",
+                                      c, n ) }
+    }
+    for f := 0; f < int(n); f++ {
+        origSamples, err := orig.MakeFrameRawPicture( f )
+        if err != nil {
+            problems = append( problems, fmt.Sprintf( "frame %d: samples of " +
+                               "the original not available: %v", f,
+                               strings.TrimSuffix( err.Error(), "\n" ) ) )
+            continue
+        }
+        copySamples, err := written.MakeFrameRawPicture( f )
+        if err != nil || len(copySamples) != len(origSamples) {
+            problems = append( problems, fmt.Sprintf( "frame %d: samples of " +
+                               "the copy not available", f ) )
+            continue
+        }
+        for c := range origSamples {
+            if ! bytes.Equal( *origSamples[c], *copySamples[c] ) {
+                problems = append( problems, fmt.Sprintf( "frame %d component " +
+                                   "%d: decoded samples differ", f, c ) )
+            }
+        }
+    }
+    return
+}
+
+// checkExifPointers checks that all IFD and value offsets in the Exif segments
+// of data are valid
+func checkExifPointers( data []byte ) (problems []string) {
+    l := scanLayout( data )
+    for _, s := range l.segments {
+        if s.marker != markerAPP0 + 1 {
+            continue
+        }
+        tiff := exifTiffData( s.data( data ) )
+        if tiff == nil {
+            continue
+        }
+        t, err := newTiffReader( tiff )
+        if err == nil {
+            var thumbOffset uint32
+            w := &ifdWalker{ t: t, maxDepth: defaultRecurseDepth,
+                             visited: make( map[uint32]bool ) }
+            w.visit = func( e *ifdEntry ) error {
+                switch e.tag {
+                case tagJPEGInterchangeFormat:
+                    thumbOffset = t.uint32Value( e )
+                case tagJPEGInterchangeFormatLength:
+                    end := uint64(thumbOffset) + uint64(t.uint32Value( e ))
+                    if end > uint64(len(t.data)) {
+                        return fmt.Errorf( "thumbnail beyond end of data\n" )
+                    }
+                }
+                _, err := t.valueData( e )
+                return err
+            }
+            err = w.walk( t.first, 0 )
+        }
+        if err != nil {
+            problems = append( problems, fmt.Sprintf( "APP1 @0x%x: %s",
+                               s.offset, strings.TrimSuffix( err.Error(),
+                                                             "\n" ) ) )
+        }
+    }
+    return
+}
+
+// selftestRoundtrip verifies the copy written at output from the original file
+// at path and from its analysis jpg. It returns an error listing all problems
+// found.
+func selftestRoundtrip( path, output string, jpg *jpeg.Desc,
+                        process *jpgArgs ) error {
+    orig, err := os.ReadFile( path )
+    if err != nil {
+        return fmt.Errorf( "round-trip: %v\n", err )
+    }
+    written, err := os.ReadFile( output )
+    if err != nil {
+        return fmt.Errorf( "round-trip: %v\n", err )
+    }
+    identical, modified, problems := compareSegments( orig, written, process )
+
+    control := jpeg.Control{ }
+    cjpg, err := jpeg.Parse( written, &control )
+    switch {
+    case err != nil:
+        problems = append( problems, "copy cannot be parsed: " +
+                           strings.TrimSuffix( err.Error(), "\n" ) )
+    case ! cjpg.IsComplete():
+        problems = append( problems, "copy is incomplete" )
+    default:
+        problems = append( problems, comparePictures( jpg, cjpg )... )
+    }
+    problems = append( problems, checkExifPointers( written )... )
+
+    if len(problems) > 0 {
+        return fmt.Errorf( "round-trip self test failed:\n  %s\n",
+                           strings.Join( problems, "\n  " ) )
+    }
+    fmt.Printf( "Round-trip self test passed: %d identical segments, %d " +
+                "modified, decoded samples identical, Exif offsets valid\n",
+                identical, modified )
+    return nil
+}
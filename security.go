@@ -0,0 +1,110 @@
+
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "sort"
+)
+
+// Security screening: look for signatures of executables, scripts, archives
+// and suspicious URLs in the places where a jpeg file can carry arbitrary data
+// without affecting the image: APPn and COM segments, bytes between segments
+// and data after EOI.
+
+type signature struct {
+    pattern         []byte
+    kind            string
+    urlLike         bool    // only reported outside of APPn segments
+}
+
+var securitySignatures = []signature {
+    { []byte( "This program cannot be run in DOS mode" ), "Windows executable", false },
+    { []byte( "\x7fELF" ), "ELF executable", false },
+    { []byte( "\xfe\xed\xfa\xce" ), "Mach-O executable", false },
+    { []byte( "\xfe\xed\xfa\xcf" ), "Mach-O executable", false },
+    { []byte( "\xcf\xfa\xed\xfe" ), "Mach-O executable", false },
+    { []byte( "#!/" ), "shell script", false },
+    { []byte( "<script" ), "HTML script", false },
+    { []byte( "<SCRIPT" ), "HTML script", false },
+    { []byte( "<?php" ), "PHP script", false },
+    { []byte( "<%@" ), "server page script", false },
+    { []byte( "javascript:" ), "javascript URL", false },
+    { []byte( "vbscript:" ), "vbscript URL", false },
+    { []byte( "eval(" ), "script evaluation", false },
+    { []byte( "powershell" ), "powershell command", false },
+    { []byte( "cmd.exe" ), "windows command", false },
+    { []byte( "PK\x03\x04" ), "ZIP archive", false },
+    { []byte( "Rar!\x1a\x07" ), "RAR archive", false },
+    { []byte( "7z\xbc\xaf\x27\x1c" ), "7z archive", false },
+    { []byte( "\x1f\x8b\x08" ), "gzip data", false },
+    { []byte( "%PDF-" ), "PDF document", false },
+    { []byte( "http://" ), "URL", true },
+    { []byte( "https://" ), "URL", true },
+}
+
+type securityFinding struct {
+    offset          int
+    kind            string
+    region          string
+}
+
+// scanRegion looks for each signature in data, reporting only the first
+// occurrence of each kind of signature in the region.
+func scanRegion( data []byte, base int, region string,
+                 urls bool ) (findings []securityFinding) {
+    seen := make( map[string]bool )
+    for _, sig := range securitySignatures {
+        if ( sig.urlLike && ! urls ) || seen[sig.kind] {
+            continue
+        }
+        if i := bytes.Index( data, sig.pattern ); i != -1 {
+            seen[sig.kind] = true
+            findings = append( findings,
+                               securityFinding{ base + i, sig.kind, region } )
+        }
+    }
+    return
+}
+
+// scanSecurity returns all security findings in the jpeg data
+func scanSecurity( data []byte, l *fileLayout ) (findings []securityFinding) {
+    for _, s := range l.segments {
+        if ( s.marker >= markerAPP0 && s.marker <= markerAPP15 ) ||
+           s.marker == markerCOM {
+            findings = append( findings,
+                               scanRegion( s.data( data ), s.offset + 4,
+                                           markerName( s.marker ),
+                                           s.marker == markerCOM )... )
+        }
+    }
+    for _, g := range l.garbage {
+        findings = append( findings,
+                           scanRegion( data[g.offset:g.offset+g.length],
+                                       g.offset, "data between segments",
+                                       true )... )
+    }
+    if t := l.trailing; t.length > 0 {
+        findings = append( findings,
+                           scanRegion( data[t.offset:t.offset+t.length],
+                                       t.offset, "data after EOI", true )... )
+    }
+    return
+}
+
+func formatSecurity( data []byte, l *fileLayout, rep *fileReport ) {
+    findings := scanSecurity( data, l )
+    if len(findings) == 0 {
+        fmt.Printf( "Security: no suspicious content found\n" )
+        return
+    }
+    sort.Slice( findings, func( i, j int ) bool {
+        return findings[i].offset < findings[j].offset
+    })
+    for _, f := range findings {
+        text := fmt.Sprintf( "Security warning: %s signature @0x%x in %s",
+                             f.kind, f.offset, f.region )
+        fmt.Printf( "%s\n", text )
+        rep.addMessage( warningSeverity, codeSecurity, text )
+    }
+}
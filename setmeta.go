@@ -0,0 +1,465 @@
+
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Exif tag editing (-setmeta): individual tags of IFD0 or of the Exif IFD are
+// modified or inserted in the first Exif APP1 segment of the copy written with
+// -o. A tag whose new value fits in the space of the old one is modified in
+// place, a longer value is appended at the end of the TIFF data, and an IFD
+// that needs a new entry is rebuilt with its entries kept in tag order: in
+// place if nothing but padding follows it, otherwise at the end of the TIFF
+// data, the old one being cleared. Nothing else is moved, so that the offsets
+// used by the thumbnail and by maker notes remain valid. If the copy has no
+// Exif segment, a new one is created after the JFIF segments.
+
+type editableTag struct {
+    name            string
+    exif            bool        // in the Exif IFD, otherwise in IFD0
+    tag, typ        uint16
+}
+
+var editableTags = []editableTag{
+    { "ImageDescription", false, 0x010e, tiffAscii },
+    { "Make", false, 0x010f, tiffAscii },
+    { "Model", false, 0x0110, tiffAscii },
+    { "Orientation", false, tagOrientation, tiffShort },
+    { "Software", false, 0x0131, tiffAscii },
+    { "DateTime", false, 0x0132, tiffAscii },
+    { "Artist", false, 0x013b, tiffAscii },
+    { "Copyright", false, 0x8298, tiffAscii },
+    { "DateTimeOriginal", true, 0x9003, tiffAscii },
+    { "DateTimeDigitized", true, 0x9004, tiffAscii },
+    { "OffsetTime", true, 0x9010, tiffAscii },
+    { "OffsetTimeOriginal", true, 0x9011, tiffAscii },
+    { "OffsetTimeDigitized", true, 0x9012, tiffAscii },
+    { "ImageUniqueID", true, 0xa420, tiffAscii },
+    { "CameraOwnerName", true, 0xa430, tiffAscii },
+    { "BodySerialNumber", true, 0xa431, tiffAscii },
+    { "LensMake", true, 0xa433, tiffAscii },
+    { "LensModel", true, 0xa434, tiffAscii },
+    { "LensSerialNumber", true, 0xa435, tiffAscii },
+}
+
+type metaSetting struct {
+    tag             *editableTag
+    value           string
+}
+
+type metaEdit struct {
+    spec            string          // as given in -setmeta
+    settings        []metaSetting
+}
+
+// editableTagNames returns the names of the tags that can be set
+func editableTagNames( ) string {
+    names := make( []string, len(editableTags) )
+    for i := range editableTags {
+        names[i] = editableTags[i].name
+    }
+    return strings.Join( names, ", " )
+}
+
+// findEditableTag returns the editable tag given by name, ignoring case, or
+// nil if there is none
+func findEditableTag( name string ) *editableTag {
+    for i := range editableTags {
+        if strings.EqualFold( editableTags[i].name, name ) {
+            return &editableTags[i]
+        }
+    }
+    return nil
+}
+
+// checkTagValue returns an error if value is not valid for tag
+func checkTagValue( tag *editableTag, value string ) error {
+    switch tag.name {
+    case "Orientation":
+        if v, err := strconv.Atoi( value ); err != nil || v < 1 || v > 8 {
+            return fmt.Errorf( "invalid Orientation %q (1 to 8)\n", value )
+        }
+    case "DateTime", "DateTimeOriginal", "DateTimeDigitized":
+        if _, err := time.Parse( "2006:01:02 15:04:05", value ); err != nil {
+            return fmt.Errorf( "invalid %s %q (YYYY:MM:DD HH:MM:SS)\n",
+                               tag.name, value )
+        }
+    case "OffsetTime", "OffsetTimeOriginal", "OffsetTimeDigitized":
+        if _, err := time.Parse( "-07:00", value ); err != nil {
+            return fmt.Errorf( "invalid %s %q (+HH:MM or -HH:MM)\n",
+                               tag.name, value )
+        }
+    }
+    for _, c := range []byte( value ) {
+        if c < 0x20 || c > 0x7e {
+            return fmt.Errorf( "%s value %q is not printable ascii\n",
+                               tag.name, value )
+        }
+    }
+    return nil
+}
+
+// parseSetMeta parses the -setmeta value: a comma separated list of
+// <tag>=<value>. A part without '=' continues the previous value, so that
+// values may include commas.
+func parseSetMeta( spec string ) (*metaEdit, error) {
+    me := &metaEdit{ spec: spec }
+    for _, part := range strings.Split( spec, "," ) {
+        eq := strings.IndexByte( part, '=' )
+        if eq == -1 {
+            if len(me.settings) == 0 {
+                return nil, fmt.Errorf( "missing tag name in %q\n", part )
+            }
+            me.settings[len(me.settings)-1].value += "," + part
+            continue
+        }
+        tag := findEditableTag( part[:eq] )
+        if tag == nil {
+            return nil, fmt.Errorf( "unknown or non-editable tag %q " +
+                                    "(tags are %s)\n", part[:eq],
+                                    editableTagNames() )
+        }
+        for _, s := range me.settings {
+            if s.tag == tag {
+                return nil, fmt.Errorf( "tag %s is given twice\n", tag.name )
+            }
+        }
+        me.settings = append( me.settings, metaSetting{ tag, part[eq+1:] } )
+    }
+    for _, s := range me.settings {
+        if err := checkTagValue( s.tag, s.value ); err != nil {
+            return nil, err
+        }
+    }
+    return me, nil
+}
+
+// ifdUpdate is the new content of an entry, with its values in the TIFF byte
+// order
+type ifdUpdate struct {
+    tag, typ        uint16
+    count           uint32
+    value           []byte
+    name            string      // for the description of the change
+    text            string
+}
+
+func newIfdUpdate( s *metaSetting, order binary.ByteOrder ) ifdUpdate {
+    u := ifdUpdate{ tag: s.tag.tag, typ: s.tag.typ, name: s.tag.name,
+                    text: strconv.Quote( s.value ) }
+    if s.tag.typ == tiffShort {
+        u.text = s.value
+        v, _ := strconv.Atoi( s.value )
+        u.value = make( []byte, 2 )
+        order.PutUint16( u.value, uint16(v) )
+        u.count = 1
+        return u
+    }
+    u.value = append( []byte( s.value ), 0 )
+    u.count = uint32( len(u.value) )
+    return u
+}
+
+// appendTiffData appends v at the end of the TIFF data, on a word boundary,
+// and returns its offset
+func appendTiffData( out *[]byte, v []byte ) uint32 {
+    if len(*out) & 1 != 0 {
+        *out = append( *out, 0 )
+    }
+    offset := uint32( len(*out) )
+    *out = append( *out, v... )
+    return offset
+}
+
+// exifTailPadding is the number of bytes at the end of an Exif segment that
+// the exif library does not read: the TIFF data is padded with zeros after
+// an IFD or a value is appended, so that it remains visible.
+const exifTailPadding = 6
+
+func clearBytes( v []byte ) {
+    for i := range v {
+        v[i] = 0
+    }
+}
+
+func isZeroPadding( v []byte ) bool {
+    for _, b := range v {
+        if b != 0 {
+            return false
+        }
+    }
+    return true
+}
+
+// putEntryValue writes the value of u in the entry at p, either in the entry,
+// in the space of the old value if it fits, or at the end of the TIFF data
+func putEntryValue( out *[]byte, order binary.ByteOrder, p int, old *ifdEntry,
+                    u *ifdUpdate ) {
+    field := make( []byte, 4 )
+    switch {
+    case len(u.value) <= 4:
+        copy( field, u.value )
+    case old != nil && old.size() >= len(u.value):
+        at := order.Uint32( old.value )
+        v := (*out)[at:int(at)+old.size()]
+        clearBytes( v )
+        copy( v, u.value )
+        order.PutUint32( field, at )
+    default:
+        order.PutUint32( field, appendTiffData( out, u.value ) )
+    }
+    order.PutUint16( (*out)[p:], u.tag )
+    order.PutUint16( (*out)[p+2:], u.typ )
+    order.PutUint32( (*out)[p+4:], u.count )
+    copy( (*out)[p+8:p+12], field )
+}
+
+// updateIfd applies updates to the IFD at offset in out (0 if it does not
+// exist), and returns the offset of the IFD, which differs if the IFD had to
+// be rebuilt at the end of the TIFF data to insert entries
+func updateIfd( t *tiffReader, out *[]byte, offset uint32,
+                updates []ifdUpdate, changes *[]string ) (uint32, error) {
+    var entries []ifdEntry
+    var next uint32
+    if offset != 0 {
+        var err error
+        if entries, next, err = t.readIfd( offset ); err != nil {
+            return 0, err
+        }
+    }
+    type slot struct {
+        tag     uint16
+        old     *ifdEntry           // existing entry
+        update  *ifdUpdate          // new content of the entry
+    }
+    slots := make( []slot, len(entries), len(entries) + len(updates) )
+    for j := range entries {
+        slots[j] = slot{ tag: entries[j].tag, old: &entries[j] }
+    }
+    rebuild := false
+    for i := range updates {
+        u := &updates[i]
+        var s *slot
+        for j := range entries {
+            if entries[j].tag == u.tag {
+                s = &slots[j]
+            }
+        }
+        if s == nil {
+            slots = append( slots, slot{ tag: u.tag, update: u } )
+            rebuild = true
+            if u.name != "" {
+                *changes = append( *changes, fmt.Sprintf( "%s=%s inserted",
+                                                          u.name, u.text ) )
+            }
+            continue
+        }
+        old := s.old
+        if u.name != "" {
+            was := ""
+            if v, err := t.asciiValue( old ); err == nil {
+                was = fmt.Sprintf( " (was %q)", v )
+            } else if old.typ == tiffShort {
+                was = fmt.Sprintf( " (was %d)", t.uint32Value( old ) )
+            }
+            *changes = append( *changes, fmt.Sprintf( "%s=%s modified%s",
+                                                      u.name, u.text, was ) )
+        }
+        if old.size() < 0 || ( old.size() > 4 &&
+           uint64(t.order.Uint32( old.value )) + uint64(old.size()) >
+           uint64(len(t.data)) ) {
+            s.old = &ifdEntry{ tag: old.tag, position: old.position }
+        }
+        s.update = u
+    }
+    if ! rebuild {
+        for _, s := range slots {
+            if s.update != nil {
+                putEntryValue( out, t.order, s.old.position, s.old, s.update )
+            }
+        }
+        return offset, nil
+    }
+    // rebuild the IFD with all entries in tag order
+    sort.SliceStable( slots, func( i, j int ) bool {
+        return slots[i].tag < slots[j].tag
+    } )
+    n := len(slots)
+    ifd := make( []byte, 2 + 12 * n + 4 )
+    t.order.PutUint16( ifd, uint16(n) )
+    for i, s := range slots {
+        if s.update == nil {
+            p := s.old.position
+            copy( ifd[2+12*i:], (*out)[p:p+12] )
+        }
+    }
+    t.order.PutUint32( ifd[2+12*n:], next )
+    inPlace := false
+    if offset != 0 {
+        // an IFD followed only by padding is rebuilt in place, otherwise
+        // the old one is cleared so that no stale copy remains
+        end := int(offset) + 2 + 12 * len(entries) + 4
+        if inPlace = isZeroPadding( (*out)[end:] ); inPlace {
+            *out = (*out)[:offset]
+        } else {
+            clearBytes( (*out)[offset:end] )
+        }
+    }
+    at := appendTiffData( out, ifd )
+    if inPlace {
+        *out = append( *out, make( []byte, exifTailPadding )... )
+    }
+    for i, s := range slots {
+        if s.update == nil {
+            continue
+        }
+        old := s.old        // its value space is gone if it was after the IFD
+        if inPlace && old != nil && old.size() > 4 &&
+           t.order.Uint32( old.value ) >= offset {
+            old = nil
+        }
+        putEntryValue( out, t.order, int(at) + 2 + 12 * i, old, s.update )
+    }
+    return at, nil
+}
+
+// newTiffData returns an empty big endian TIFF structure, with an IFD0
+// without entries
+func newTiffData( ) []byte {
+    return []byte{ 'M', 'M', 0, 42, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0 }
+}
+
+// setExifTags returns a copy of tiff with the tags of me set, and the
+// descriptions of the changes
+func setExifTags( tiff []byte, me *metaEdit ) ([]byte, []string, error) {
+    t, err := newTiffReader( tiff )
+    if err != nil {
+        return nil, nil, err
+    }
+    ifd0, _, err := t.readIfd( t.first )
+    if err != nil {
+        return nil, nil, err
+    }
+    var exifOffset uint32
+    for i := range ifd0 {
+        if ifd0[i].tag == tagExifIfd {
+            exifOffset = t.uint32Value( &ifd0[i] )
+        }
+    }
+    var main, exif []ifdUpdate
+    for i := range me.settings {
+        u := newIfdUpdate( &me.settings[i], t.order )
+        if me.settings[i].tag.exif {
+            exif = append( exif, u )
+        } else {
+            main = append( main, u )
+        }
+    }
+    if len(exif) > 0 {              // IFD0 points to the Exif IFD
+        v := make( []byte, 4 )
+        t.order.PutUint32( v, exifOffset )
+        main = append( main, ifdUpdate{ tag: tagExifIfd, typ: tiffLong,
+                                        count: 1, value: v } )
+    }
+    out := append( []byte( nil ), tiff... )
+    var changes []string
+    ifd0At := t.first
+    if len(main) > 0 {
+        if ifd0At, err = updateIfd( t, &out, t.first, main,
+                                    &changes ); err != nil {
+            return nil, nil, fmt.Errorf( "IFD0: %v", err )
+        }
+        t.order.PutUint32( out[4:], ifd0At )
+    }
+    if len(exif) > 0 {
+        at, err := updateIfd( t, &out, exifOffset, exif, &changes )
+        if err != nil {
+            return nil, nil, fmt.Errorf( "Exif IFD: %v", err )
+        }
+        if exifOffset == 0 {
+            changes = append( changes, "Exif IFD created" )
+        }
+        // the Exif IFD pointer is set once the Exif IFD is in place
+        r := &tiffReader{ data: out, order: t.order }
+        entries, _, err := r.readIfd( ifd0At )
+        if err != nil {
+            return nil, nil, fmt.Errorf( "IFD0: %v", err )
+        }
+        for _, e := range entries {
+            if e.tag == tagExifIfd {
+                t.order.PutUint32( out[e.position+8:], at )
+            }
+        }
+    }
+    if len(out) != len(tiff) {
+        out = append( out, make( []byte, exifTailPadding )... )
+    }
+    return out, changes, nil
+}
+
+// setMetaFile sets the Exif tags given in me in the file at output, and
+// returns a description of the change
+func setMetaFile( output string, me *metaEdit ) (string, error) {
+    changes, err := setExifFile( output, me )
+    if err != nil {
+        return "", fmt.Errorf( "setmeta: %v", err )
+    }
+    return "setmeta: " + strings.Join( changes, ", " ), nil
+}
+
+// setExifFile sets the Exif tags given in me in the file at output, creating
+// an Exif segment if needed, and returns the descriptions of the changes
+func setExifFile( output string, me *metaEdit ) ([]string, error) {
+    data, err := os.ReadFile( output )
+    if err != nil {
+        return nil, fmt.Errorf( "%v\n", err )
+    }
+    l := scanLayout( data )
+    var exif *segment
+    insertAt := 2                       // after SOI, JFIF and JFXX segments
+    for i := range l.segments {
+        s := &l.segments[i]
+        if isImageDataMarker( s.marker ) || s.marker == markerEOI {
+            break
+        }
+        if s.marker == markerAPP0 && insertAt == s.offset {
+            insertAt = s.end()
+        }
+        if s.marker == markerAPP0 + 1 && exifTiffData( s.data( data ) ) != nil {
+            exif = s
+            break
+        }
+    }
+    start, end := insertAt, insertAt
+    tiff := newTiffData()
+    if exif != nil {
+        start, end = exif.offset, exif.end()
+        tiff = exifTiffData( exif.data( data ) )
+    }
+    tiff, changes, err := setExifTags( tiff, me )
+    if err != nil {
+        return nil, err
+    }
+    var b bytes.Buffer
+    b.Write( data[:start] )
+    payload := append( append( []byte( nil ), exifHeader... ), tiff... )
+    if err = appendSegment( &b, markerAPP0 + 1, payload ); err != nil {
+        return nil, err
+    }
+    b.Write( data[end:] )
+    if err = writeFile( output, b.Bytes(), 0644 ); err != nil {
+        return nil, fmt.Errorf( "%v\n", err )
+    }
+    if exif == nil {
+        changes = append( []string{ "new Exif segment" }, changes... )
+    }
+    return changes, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// withExif returns data with an Exif segment made of tiff after the first
+// segment, which is the JFIF segment in the test set files
+func withExif( data, tiff []byte ) []byte {
+    at := scanLayout( data ).segments[1].end()
+    exif := append( append( []byte( nil ), exifHeader... ), tiff... )
+    out := append( []byte( nil ), data[:at]... )
+    out = append( out, segmentBytesOf( markerAPP0 + 1, exif )... )
+    return append( out, data[at:]... )
+}
+
+// hasTagValue returns whether the formatted metadata lines give value for tag
+func hasTagValue( lines []string, tag, value string ) bool {
+    for i := 0; i + 1 < len(lines); i++ {
+        if strings.TrimSpace( lines[i] ) == tag + ":" &&
+           strings.TrimSpace( lines[i+1] ) == value {
+            return true
+        }
+    }
+    return false
+}
+
+func TestSetMetaRoundTrip( t *testing.T ) {
+    base := testsetData( t, "baseline-420.jpg" )
+    tests := []struct {
+        name    string
+        data    []byte
+        edits   []string            // successive -setmeta values
+        want    [][2]string         // formatted tag name and value
+        ifd0    uint32              // IFD0 offset if kept in place, or 0
+    }{
+        { "short new", base, []string{ "Software=X" },
+          [][2]string{ { "Software", "X" } }, 8 },
+        { "long new", base, []string{ "Software=jpegcheck test suite" },
+          [][2]string{ { "Software", "jpegcheck test suite" } }, 8 },
+        { "short then exif", base,
+          []string{ "Software=X", "LensMake=Y" },
+          [][2]string{ { "Software", "X" }, { "Lens Make", "Y" } }, 8 },
+        { "long then short", base,
+          []string{ "Artist=somebody else", "Artist=Z,Orientation=6" },
+          [][2]string{ { "Artist", "Z" } }, 0 },
+        { "short then long", base,
+          []string{ "Make=AB", "Make=A much longer make,LensModel=L" },
+          [][2]string{ { "Make", "A much longer make" },
+                       { "Lens Model", "L" } }, 8 },
+        { "existing exif", withExif( base, gpsTiff() ),
+          []string{ "Software=X", "Copyright=nobody in particular" },
+          [][2]string{ { "Software", "X" },
+                       { "Copyright", "nobody in particular" } }, 0 },
+    }
+    for _, tt := range tests {
+        t.Run( tt.name, func( t *testing.T ) {
+            path := filepath.Join( t.TempDir(), "out.jpg" )
+            if err := os.WriteFile( path, tt.data, 0644 ); err != nil {
+                t.Fatal( err )
+            }
+            for _, spec := range tt.edits {
+                me, err := parseSetMeta( spec )
+                if err != nil {
+                    t.Fatalf( "%s: %v", spec, err )
+                }
+                if _, err = setExifFile( path, me ); err != nil {
+                    t.Fatalf( "%s: %v", spec, err )
+                }
+            }
+            data, err := os.ReadFile( path )
+            if err != nil {
+                t.Fatal( err )
+            }
+            defer func( ) {
+                if r := recover(); r != nil {
+                    t.Fatalf( "output does not parse: %v", r )
+                }
+            }()
+            lines := metadataLines( data )
+            if lines == nil {
+                t.Fatalf( "output does not parse" )
+            }
+            for _, w := range tt.want {
+                if ! hasTagValue( lines, w[0], w[1] ) {
+                    t.Errorf( "%s is not %q in\n%s", w[0], w[1],
+                              strings.Join( lines, "\n" ) )
+                }
+            }
+            l := scanLayout( data )
+            for _, s := range l.segments {
+                tiff := exifTiffData( s.data( data ) )
+                if s.marker != markerAPP0 + 1 || tiff == nil {
+                    continue
+                }
+                r, err := newTiffReader( tiff )
+                if err != nil {
+                    t.Fatal( err )
+                }
+                if tt.ifd0 != 0 && r.first != tt.ifd0 {
+                    t.Errorf( "IFD0 moved from 0x%x to 0x%x", tt.ifd0,
+                              r.first )
+                }
+                if r.first != 8 && r.order.Uint16( tiff[8:] ) != 0 {
+                    t.Errorf( "IFD0 at 0x8 left behind" )
+                }
+                break
+            }
+        } )
+    }
+}
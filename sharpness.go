@@ -0,0 +1,92 @@
+package main
+
+import (
+    "fmt"
+    "image"
+)
+
+// Sharpness check (-blur-check): out-of-focus or shaken captures must be
+// flagged during validation runs, without a reference picture to compare
+// with. The picture is decoded and the variance of the Laplacian of its luma
+// (Rec.601) is computed with the 4-neighbour kernel over the inner pixels:
+// edges give large Laplacian values of both signs, whereas a blurred picture
+// has only smooth transitions and a small variance. A file is flagged as
+// blurred if the variance is below -blur-threshold (default 100, in squared
+// levels). The variance also depends on the content and on the resolution,
+// so the threshold should be tuned for each kind of batch. The variance and
+// the flag are given in the csv and json reports.
+
+const (
+    defaultBlurThreshold    = 100.0     // squared levels
+)
+
+// newBlurThreshold checks and returns the threshold of -blur-check
+func newBlurThreshold( threshold float64 ) (float64, error) {
+    if threshold < 0 {
+        return 0, fmt.Errorf( "invalid variance %g\n", threshold )
+    }
+    return threshold, nil
+}
+
+// sharpnessInfo is the sharpness of a file, recorded in its report
+type sharpnessInfo struct {
+    variance        float64     // of the Laplacian of luma
+    blurred         bool        // variance below the threshold
+}
+
+// laplacianVariance returns the variance of the Laplacian of the luma of img,
+// or 0 if img is too small to have inner pixels
+func laplacianVariance( img *image.RGBA ) float64 {
+    w, h := img.Rect.Dx(), img.Rect.Dy()
+    if w < 3 || h < 3 {
+        return 0
+    }
+    luma := make( []float64, w * h )
+    for y := 0; y < h; y++ {
+        p := img.Pix[img.PixOffset( img.Rect.Min.X, img.Rect.Min.Y + y ):]
+        for x := 0; x < w; x++ {
+            luma[y*w+x] = 0.299 * float64(p[4*x]) + 0.587 * float64(p[4*x+1]) +
+                          0.114 * float64(p[4*x+2])
+        }
+    }
+    var sum, sum2 float64
+    for y := 1; y < h - 1; y++ {
+        for x := 1; x < w - 1; x++ {
+            i := y * w + x
+            l := luma[i-w] + luma[i+w] + luma[i-1] + luma[i+1] - 4 * luma[i]
+            sum += l
+            sum2 += l * l
+        }
+    }
+    n := float64((w - 2) * (h - 2))
+    mean := sum / n
+    v := sum2 / n - mean * mean
+    if v < 0 {
+        return 0
+    }
+    return v
+}
+
+// formatBlurCheck decodes the picture in data, prints its sharpness and
+// records it in rep, reporting a variance of the Laplacian below threshold as
+// a warning
+func formatBlurCheck( data []byte, threshold float64, rep *fileReport ) {
+    img, err := decodeRGBA( data )
+    if err != nil {
+        fmt.Printf( "Sharpness: unable to decode the picture: %v\n", err )
+        rep.addMessage( infoSeverity, codeSharpness, "blur check not done" )
+        return
+    }
+    si := &sharpnessInfo{ variance: laplacianVariance( img ) }
+    si.blurred = si.variance < threshold
+    rep.sharpness = si
+    fmt.Printf( "Sharpness: variance of the luma Laplacian %.1f (threshold " +
+                "%.1f)\n", si.variance, threshold )
+    if ! si.blurred {
+        return
+    }
+    text := fmt.Sprintf( "blurred picture: variance of the luma Laplacian " +
+                         "%.1f below %.1f", si.variance, threshold )
+    fmt.Printf( "  Warning: %s\n", text )
+    rep.addMessage( warningSeverity, codeSharpness, text )
+}
@@ -0,0 +1,315 @@
+
+package main
+
+import (
+    "bytes"
+    "crypto/ed25519"
+    "crypto/hmac"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/pem"
+    "fmt"
+    "os"
+    "strings"
+)
+
+// Signatures (-sign and -verify-sig): after validation, a file can be signed
+// so that any later tampering with its picture or with the metadata needed to
+// display it is detected. The signature covers the image data segments (as
+// protected by -image-data-immutable), the Exif APP1 segments and the ICC
+// profile APP2 segments, in file order. It is stored in an APP15 segment of
+// the copy written with -o, or in a sidecar file next to the file otherwise.
+//
+// A key file is either a PEM encoded Ed25519 key (private key to sign, public
+// or private key to verify), or any other content used as a HMAC-SHA256
+// secret.
+
+var signatureHeader = []byte( "JCHECK-SIG\x00" )
+
+const (
+    signatureSidecar    = ".jsig"
+    signatureScope      = "image,exif,icc"
+)
+
+type signingKey struct {
+    secret          []byte              // HMAC secret, if not nil
+    private         ed25519.PrivateKey  // if not nil, can sign
+    public          ed25519.PublicKey
+}
+
+// loadSigningKey reads a key file
+func loadSigningKey( path string ) (*signingKey, error) {
+    data, err := os.ReadFile( path )
+    if err != nil {
+        return nil, fmt.Errorf( "unable to read key file: %v\n", err )
+    }
+    block, _ := pem.Decode( data )
+    if block == nil {
+        secret := bytes.TrimSpace( data )
+        if len(secret) < 16 {
+            return nil, fmt.Errorf( "HMAC secret in %s is too short (less " +
+                                    "than 16 bytes)\n", path )
+        }
+        return &signingKey{ secret: secret }, nil
+    }
+    switch block.Type {
+    case "PRIVATE KEY":
+        k, err := x509.ParsePKCS8PrivateKey( block.Bytes )
+        if err != nil {
+            return nil, fmt.Errorf( "invalid private key in %s: %v\n", path, err )
+        }
+        private, ok := k.(ed25519.PrivateKey)
+        if ! ok {
+            return nil, fmt.Errorf( "private key in %s is not an Ed25519 " +
+                                    "key\n", path )
+        }
+        return &signingKey{ private: private,
+                            public: private.Public().(ed25519.PublicKey) }, nil
+    case "PUBLIC KEY":
+        k, err := x509.ParsePKIXPublicKey( block.Bytes )
+        if err != nil {
+            return nil, fmt.Errorf( "invalid public key in %s: %v\n", path, err )
+        }
+        public, ok := k.(ed25519.PublicKey)
+        if ! ok {
+            return nil, fmt.Errorf( "public key in %s is not an Ed25519 " +
+                                    "key\n", path )
+        }
+        return &signingKey{ public: public }, nil
+    }
+    return nil, fmt.Errorf( "unsupported PEM block %s in %s\n", block.Type, path )
+}
+
+func (k *signingKey) algorithm( ) string {
+    if k.secret != nil {
+        return "hmac-sha256"
+    }
+    return "ed25519"
+}
+
+// isSignedSegment returns true if a segment is covered by the signature
+func isSignedSegment( s *segment, data []byte ) bool {
+    if isImageDataMarker( s.marker ) {
+        return true
+    }
+    d := s.data( data )
+    switch s.marker {
+    case markerAPP0 + 1:
+        return exifTiffData( d ) != nil
+    case markerAPP0 + 2:
+        return bytes.HasPrefix( d, []byte( "ICC_PROFILE\x00" ) )
+    }
+    return false
+}
+
+// signedDigest returns the sha256 digest of all segments covered by the
+// signature in data
+func signedDigest( data []byte ) []byte {
+    h := sha256.New()
+    l := scanLayout( data )
+    for i := range l.segments {
+        s := &l.segments[i]
+        if isSignedSegment( s, data ) {
+            h.Write( segmentBytes( s, data ) )
+        }
+    }
+    return h.Sum( nil )
+}
+
+func (k *signingKey) sign( digest []byte ) ([]byte, error) {
+    if k.secret != nil {
+        mac := hmac.New( sha256.New, k.secret )
+        mac.Write( digest )
+        return mac.Sum( nil ), nil
+    }
+    if k.private == nil {
+        return nil, fmt.Errorf( "a private key is required to sign\n" )
+    }
+    return ed25519.Sign( k.private, digest ), nil
+}
+
+func (k *signingKey) verify( digest, signature []byte ) bool {
+    if k.secret != nil {
+        mac := hmac.New( sha256.New, k.secret )
+        mac.Write( digest )
+        return hmac.Equal( mac.Sum( nil ), signature )
+    }
+    return ed25519.Verify( k.public, digest, signature )
+}
+
+// signature block, as stored in APP15 after the header or in a sidecar file
+func signatureBlock( algorithm string, signature []byte ) []byte {
+    return []byte( fmt.Sprintf( "algorithm: %s\nscope: %s\nsignature: %s\n",
+                   algorithm, signatureScope,
+                   base64.StdEncoding.EncodeToString( signature ) ) )
+}
+
+func parseSignatureBlock( b []byte ) (algorithm string, signature []byte,
+                                      err error) {
+    fields := make( map[string]string )
+    for _, line := range strings.Split( string( b ), "\n" ) {
+        if i := strings.Index( line, ": " ); i != -1 {
+            fields[line[:i]] = strings.TrimSpace( line[i+2:] )
+        }
+    }
+    if fields["scope"] != signatureScope {
+        return "", nil, fmt.Errorf( "unsupported signature scope %q\n",
+                                    fields["scope"] )
+    }
+    signature, err = base64.StdEncoding.DecodeString( fields["signature"] )
+    if err != nil || len(signature) == 0 {
+        return "", nil, fmt.Errorf( "invalid signature encoding\n" )
+    }
+    return fields["algorithm"], signature, nil
+}
+
+// signFile signs the file at path. If embed is true, the signature is stored in
+// an APP15 segment inserted after the JFIF and Exif segments (replacing any
+// previous one), otherwise in a sidecar file.
+func signFile( path string, embed bool, key *signingKey ) error {
+    data, err := os.ReadFile( path )
+    if err != nil {
+        return fmt.Errorf( "sign: %v\n", err )
+    }
+    signature, err := key.sign( signedDigest( data ) )
+    if err != nil {
+        return fmt.Errorf( "sign: %v", err )
+    }
+    block := signatureBlock( key.algorithm(), signature )
+    if ! embed {
+        sidecar := path + signatureSidecar
+        if err = writeFile( sidecar, block, 0644 ); err != nil {
+            return fmt.Errorf( "sign: %v\n", err )
+        }
+        fmt.Printf( "Signed %s (%s), signature saved as %s\n", path,
+                    key.algorithm(), sidecar )
+        return nil
+    }
+    if len(data) < 2 || data[0] != 0xff || data[1] != markerSOI {
+        return fmt.Errorf( "sign: %s does not start with SOI\n", path )
+    }
+    if s := findSignatureSegment( data ); s != nil {
+        data = append( append( []byte( nil ), data[:s.offset]... ),
+                       data[s.end():]... )
+    }
+    at := signatureOffset( data )
+    var b bytes.Buffer
+    b.Write( data[:at] )
+    b.Write( []byte{ 0xff, markerAPP15 } )
+    binary.Write( &b, binary.BigEndian,
+                  uint16( 2 + len(signatureHeader) + len(block) ) )
+    b.Write( signatureHeader )
+    b.Write( block )
+    b.Write( data[at:] )
+    if err = writeFile( path, b.Bytes(), 0644 ); err != nil {
+        return fmt.Errorf( "sign: %v\n", err )
+    }
+    fmt.Printf( "Signed %s (%s), signature stored in APP15\n", path,
+                key.algorithm() )
+    return nil
+}
+
+// signatureOffset returns the offset where the APP15 signature segment is
+// inserted in data: after SOI and the JFIF, JFXX and Exif segments that
+// follow, since readers expect JFIF first and Exif right after it.
+func signatureOffset( data []byte ) int {
+    at := 2
+    l := scanLayout( data )
+    for i := 1; i < len(l.segments); i++ {
+        s := &l.segments[i]
+        if s.offset != at || s.marker < markerAPP0 || s.marker > markerAPP15 {
+            break
+        }
+        if rank, _ := metadataSegmentRank( s, data ); rank > rankExif {
+            break
+        }
+        at = s.end()
+    }
+    return at
+}
+
+func findSignatureSegment( data []byte ) *segment {
+    l := scanLayout( data )
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.marker == markerAPP15 &&
+           bytes.HasPrefix( s.data( data ), signatureHeader ) {
+            return s
+        }
+    }
+    return nil
+}
+
+// signatureCopy puts back the APP15 signature segment of the original data
+// orig in the copy at output if it has none, unless remove is true, since the
+// library does not keep it when writing. The segment is inserted after the
+// JFIF and Exif segments, as by signFile. The copy is verified only if nothing it covers was
+// modified. It returns a description of the change, or "" if nothing was
+// done.
+func signatureCopy( orig []byte, output string, remove bool ) (string, error) {
+    s := findSignatureSegment( orig )
+    if s == nil || remove {
+        return "", nil
+    }
+    data, err := os.ReadFile( output )
+    if err != nil {
+        return "", fmt.Errorf( "sign: %v\n", err )
+    }
+    if findSignatureSegment( data ) != nil {
+        return "", nil
+    }
+    if len(data) < 2 || data[0] != 0xff || data[1] != markerSOI {
+        return "", fmt.Errorf( "sign: %s does not start with SOI\n", output )
+    }
+    at := signatureOffset( data )
+    var b bytes.Buffer
+    b.Write( data[:at] )
+    b.Write( orig[s.offset:s.end()] )
+    b.Write( data[at:] )
+    if err = writeFile( output, b.Bytes(), 0644 ); err != nil {
+        return "", fmt.Errorf( "sign: %v\n", err )
+    }
+    return "sign: APP15 signature segment of the original put back in the " +
+           "copy", nil
+}
+
+// verifySignature checks the signature of the file at path, stored in an
+// APP15 segment or in a sidecar file, and reports the outcome.
+func verifySignature( path string, data []byte, key *signingKey,
+                      rep *fileReport ) error {
+    var block []byte
+    source := "APP15"
+    if s := findSignatureSegment( data ); s != nil {
+        block = s.data( data )[len(signatureHeader):]
+    } else {
+        sidecar := path + signatureSidecar
+        var err error
+        if block, err = os.ReadFile( sidecar ); err != nil {
+            return codedError{ fmt.Errorf( "no signature found in APP15 or " +
+                                           "in %s\n", sidecar ), codeSignature }
+        }
+        source = sidecar
+    }
+    algorithm, signature, err := parseSignatureBlock( block )
+    if err != nil {
+        return codedError{ fmt.Errorf( "signature in %s: %v", source, err ),
+                           codeSignature }
+    }
+    if algorithm != key.algorithm() {
+        return codedError{ fmt.Errorf( "signature in %s uses %s, but the " +
+                                       "key is for %s\n", source, algorithm,
+                                       key.algorithm() ), codeSignature }
+    }
+    if ! key.verify( signedDigest( data ), signature ) {
+        return codedError{ fmt.Errorf( "signature mismatch (%s): the file " +
+                                       "was modified after signing or the " +
+                                       "key is wrong\n", source ),
+                           codeSignature }
+    }
+    text := fmt.Sprintf( "Signature verified (%s, %s)", algorithm, source )
+    fmt.Printf( "%s\n", text )
+    rep.addMessage( infoSeverity, codeSignature, text )
+    return nil
+}
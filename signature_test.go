@@ -0,0 +1,188 @@
+package main
+
+import (
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/x509"
+    "encoding/pem"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// signingKeyFiles writes in dir a HMAC secret, an Ed25519 private key and its
+// public key, and returns their paths by name
+func signingKeyFiles( t *testing.T, dir string ) map[string]string {
+    public, private, err := ed25519.GenerateKey( rand.Reader )
+    if err != nil {
+        t.Fatal( err )
+    }
+    der, err := x509.MarshalPKCS8PrivateKey( private )
+    if err != nil {
+        t.Fatal( err )
+    }
+    pub, err := x509.MarshalPKIXPublicKey( public )
+    if err != nil {
+        t.Fatal( err )
+    }
+    contents := map[string][]byte{
+        "hmac":     []byte( "0123456789abcdef\n" ),
+        "other":    []byte( "fedcba9876543210\n" ),
+        "ed25519":  pem.EncodeToMemory( &pem.Block{ Type: "PRIVATE KEY",
+                                                    Bytes: der } ),
+        "public":   pem.EncodeToMemory( &pem.Block{ Type: "PUBLIC KEY",
+                                                    Bytes: pub } ),
+    }
+    paths := make( map[string]string )
+    for name, content := range contents {
+        paths[name] = filepath.Join( dir, name + ".key" )
+        if err := os.WriteFile( paths[name], content, 0600 ); err != nil {
+            t.Fatal( err )
+        }
+    }
+    return paths
+}
+
+// flipSegmentByte returns a copy of data with the last byte of the first
+// segment accepted by match inverted
+func flipSegmentByte( data []byte, match func( s *segment ) bool ) []byte {
+    out := append( []byte( nil ), data... )
+    l := scanLayout( out )
+    for i := range l.segments {
+        if s := &l.segments[i]; match( s ) {
+            out[s.end()-1] ^= 0xff
+            break
+        }
+    }
+    return out
+}
+
+// TestSignatureRoundTrip signs a file with -sign, edits the signed file and
+// checks the outcome of the verification
+func TestSignatureRoundTrip( t *testing.T ) {
+    data := withExif( testsetData( t, "baseline-420.jpg" ), gpsTiff() )
+    untouched := func( t *testing.T, path string, d []byte ) []byte {
+        return d
+    }
+    comment := func( t *testing.T, path string, d []byte ) []byte {
+        at := 0                         // before the tables
+        l := scanLayout( d )
+        for i := range l.segments {
+            if isImageDataMarker( l.segments[i].marker ) {
+                at = l.segments[i].offset
+                break
+            }
+        }
+        out := append( []byte( nil ), d[:at]... )
+        out = append( out, segmentBytesOf( markerCOM,
+                                           []byte( "not signed" ) )... )
+        return append( out, d[at:]... )
+    }
+    exif := func( t *testing.T, path string, d []byte ) []byte {
+        return flipSegmentByte( d, func( s *segment ) bool {
+            return s.marker == markerAPP0 + 1 &&
+                   exifTiffData( s.data( d ) ) != nil
+        } )
+    }
+    image := func( t *testing.T, path string, d []byte ) []byte {
+        return flipSegmentByte( d, func( s *segment ) bool {
+            return s.marker == markerDQT
+        } )
+    }
+    tidyup := func( t *testing.T, path string, d []byte ) []byte {
+        out := filepath.Join( filepath.Dir( path ), "tidy.jpg" )
+        if n := processBatch( checkerArgs( t, "-q", "-tidyup", "-o=" + out,
+                                           path ) ); n != 0 {
+            t.Fatalf( "tidyup: %d files failed", n )
+        }
+        tidy, err := os.ReadFile( out )
+        if err != nil {
+            t.Fatal( err )
+        }
+        return tidy
+    }
+    tests := []struct {
+        name        string
+        sign        string      // signing key
+        verify      string      // verification key
+        embed       bool        // signed with -o, in APP15
+        edit        func( t *testing.T, path string, d []byte ) []byte
+        valid       bool
+    }{
+        { "hmac app15", "hmac", "hmac", true, untouched, true },
+        { "hmac sidecar", "hmac", "hmac", false, untouched, true },
+        { "ed25519 app15", "ed25519", "public", true, untouched, true },
+        { "ed25519 sidecar", "ed25519", "ed25519", false, untouched, true },
+        { "wrong key", "hmac", "other", true, untouched, false },
+        { "wrong algorithm", "hmac", "public", true, untouched, false },
+        { "comment added", "hmac", "hmac", true, comment, true },
+        { "exif modified", "ed25519", "public", true, exif, false },
+        { "image modified", "hmac", "hmac", false, image, false },
+        { "tidyup copy", "hmac", "hmac", true, tidyup, true },
+    }
+    for _, tc := range tests {
+        t.Run( tc.name, func( t *testing.T ) {
+            dir := t.TempDir()
+            keys := signingKeyFiles( t, dir )
+            path := filepath.Join( dir, "in.jpg" )
+            signed := path
+            args := []string{ "-q", "-sign=" + keys[tc.sign] }
+            if tc.embed {
+                signed = filepath.Join( dir, "signed.jpg" )
+                args = append( args, "-o=" + signed )
+            }
+            if err := os.WriteFile( path, data, 0644 ); err != nil {
+                t.Fatal( err )
+            }
+            if n := processBatch( checkerArgs( t, append( args,
+                                                  path )... ) ); n != 0 {
+                t.Fatalf( "%d files failed", n )
+            }
+            d, err := os.ReadFile( signed )
+            if err != nil {
+                t.Fatal( err )
+            }
+            if tc.embed != ( findSignatureSegment( d ) != nil ) {
+                t.Fatalf( "signature in APP15: %v, expected %v",
+                          ! tc.embed, tc.embed )
+            }
+            check := filepath.Join( dir, "check.jpg" )
+            if err = os.WriteFile( check, tc.edit( t, signed, d ),
+                                   0644 ); err != nil {
+                t.Fatal( err )
+            }
+            if ! tc.embed {
+                sig, err := os.ReadFile( signed + signatureSidecar )
+                if err != nil {
+                    t.Fatal( err )
+                }
+                err = os.WriteFile( check + signatureSidecar, sig, 0644 )
+                if err != nil {
+                    t.Fatal( err )
+                }
+            }
+            key, err := loadSigningKey( keys[tc.verify] )
+            if err != nil {
+                t.Fatal( err )
+            }
+            checked, err := os.ReadFile( check )
+            if err != nil {
+                t.Fatal( err )
+            }
+            err = verifySignature( check, checked, key, &fileReport{ } )
+            if tc.valid && err != nil {
+                t.Errorf( "signature not verified: %v", err )
+            } else if ! tc.valid && err == nil {
+                t.Errorf( "signature verified" )
+            }
+            if ! tc.valid {
+                return
+            }
+            if n := processBatch( checkerArgs( t, "-q", "-verify-sig=" +
+                                               keys[tc.verify],
+                                               check ) ); n != 0 {
+                t.Errorf( "-verify-sig: %d files failed", n )
+            }
+        } )
+    }
+}
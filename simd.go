@@ -0,0 +1,25 @@
+package main
+
+// SIMD paths: the block transforms of the pictures reconstructed from their
+// coefficients are 8x8 matrix products, which are done with AVX2 and FMA
+// instructions on amd64 when the processor supports them. They are used by
+// -spict for the frames that jcheck reconstructs itself (progressive frames
+// and extended frames with more than 8-bit samples), by -splice-check, and by
+// the analyses based on component planes. The result may differ from the
+// portable code in the last bits, since products are fused with additions.
+// Option -no-simd forces the portable code. The files that jcheck generates
+// (gen-testset, make) are always encoded with the portable code, so that they
+// do not depend on the processor.
+// Not covered: the pictures saved by the jpeg library (-spict for baseline
+// frames) cannot use these paths, chroma upsampling and YCbCr to RGB
+// conversion are always portable, and there is no NEON implementation for
+// arm64, where the portable code is used.
+
+// simdMatMul8 computes c = a × m for 8x8 matrices in row order, or is nil if
+// no SIMD implementation is available on this processor
+var simdMatMul8 func( a, m, c *[64]float64 )
+
+// disableSimd forces the portable implementations
+func disableSimd( ) {
+    simdMatMul8 = nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+    "bytes"
+    "image"
+    "math"
+    "math/rand"
+    "testing"
+)
+
+// withoutSimd runs f with the portable implementations, and restores the
+// SIMD implementations afterwards
+func withoutSimd( f func( ) ) {
+    saved := simdMatMul8
+    defer func( ) { simdMatMul8 = saved }()
+    disableSimd()
+    f()
+}
+
+func TestSimdTransforms( t *testing.T ) {
+    if simdMatMul8 == nil {
+        t.Skip( "no SIMD implementation on this processor" )
+    }
+    r := rand.New( rand.NewSource( 1 ) )
+    for i := 0; i < 100; i++ {
+        var in, simd, portable [64]float64
+        for j := range in {
+            in[j] = r.Float64() * 2048 - 1024
+        }
+        for _, tc := range []struct {
+            name    string
+            f       func( in, out *[64]float64 )
+        }{
+            { "idct", idct }, { "fdct", fdct },
+        } {
+            tc.f( &in, &simd )
+            withoutSimd( func( ) { tc.f( &in, &portable ) } )
+            for j := range simd {
+                if math.Abs( simd[j] - portable[j] ) > 1e-9 {
+                    t.Fatalf( "%s block %d sample %d: simd %g, portable %g",
+                              tc.name, i, j, simd[j], portable[j] )
+                }
+            }
+        }
+    }
+}
+
+func TestSimdReconstructedPicture( t *testing.T ) {
+    if simdMatMul8 == nil {
+        t.Skip( "no SIMD implementation on this processor" )
+    }
+    for _, name := range []string{ "progressive-420.jpg",
+                                   "progressive-gray.jpg" } {
+        t.Run( name, func( t *testing.T ) {
+            data := testsetData( t, name )
+            simd, err := reconstructPicture( data, scanLayout( data ), false )
+            if err != nil {
+                t.Fatal( err )
+            }
+            var portable *image.RGBA
+            withoutSimd( func( ) {
+                portable, err = reconstructPicture( data, scanLayout( data ),
+                                                    false )
+            })
+            if err != nil {
+                t.Fatal( err )
+            }
+            for i := range simd.Pix {   // rounding may differ by 1
+                d := int(simd.Pix[i]) - int(portable.Pix[i])
+                if d < -1 || d > 1 {
+                    t.Fatalf( "sample %d: simd %d, portable %d", i,
+                              simd.Pix[i], portable.Pix[i] )
+                }
+            }
+        } )
+    }
+}
+
+func TestSimdGeneratedFiles( t *testing.T ) {
+    if simdMatMul8 == nil {
+        t.Skip( "no SIMD implementation on this processor" )
+    }
+    for i := range testsetSpecs {
+        spec := &testsetSpecs[i]
+        if spec.breaks != nil {
+            continue
+        }
+        for _, quality := range []int{ 10, 50, 75, 90, 100 } {
+            simd, _, err := generateTestFile( spec, quality )
+            if err != nil {
+                t.Fatalf( "%s: %v", spec.name, err )
+            }
+            var portable []byte
+            withoutSimd( func( ) {
+                portable, _, err = generateTestFile( spec, quality )
+            })
+            if err != nil {
+                t.Fatalf( "%s: %v", spec.name, err )
+            }
+            if ! bytes.Equal( simd, portable ) {
+                t.Errorf( "%s quality %d: simd and portable files differ",
+                          spec.name, quality )
+            }
+        }
+    }
+}
@@ -0,0 +1,118 @@
+
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+)
+
+// Report sinks: the analysis of each file produces a typed fileReport
+// (status, frames, messages with severity, code, offset and frame, output and
+// changes), which the report stage hands to every requested sink (see
+// pipeline.go). Each report format implements reportSink and is registered in
+// sinkFormats with the function that opens it, so that adding a format only
+// takes a new file and an entry here, without touching the analysis or the
+// batch code. Sinks are requested with -sink=<format>:<path>, -report and
+// -xml-report being kept as shortcuts for the json and xml sinks. A database
+// sink such as SQLite would be added the same way, but requires a driver that
+// this module does not depend on.
+
+type sinkFormat struct {
+    description     string
+    open            func( path string, process *jpgArgs ) (reportSink, error)
+}
+
+var sinkFormats = map[string]sinkFormat{
+    "json": { "json document, as with -report",
+              func( path string, process *jpgArgs ) (reportSink, error) {
+                  return newJsonReport( path, process )
+              } },
+    "xml":  { "JHOVE style xml document, as with -xml-report",
+              func( path string, process *jpgArgs ) (reportSink, error) {
+                  return newXmlReport( path, process )
+              } },
+    "csv":  { "one line per file, for spreadsheets and databases",
+              func( path string, process *jpgArgs ) (reportSink, error) {
+                  return newCsvReport( path, process )
+              } },
+    "html": { "self-contained html page with a table of files",
+              func( path string, process *jpgArgs ) (reportSink, error) {
+                  return newHtmlReport( path, process )
+              } },
+    "text": { "plain text, the outcome and messages of each file",
+              func( path string, process *jpgArgs ) (reportSink, error) {
+                  return newTextReport( path, process )
+              } },
+}
+
+type sinkSpec struct {
+    format          string
+    path            string
+}
+
+// sinkFormatNames returns the names of the registered formats, sorted
+func sinkFormatNames( ) []string {
+    names := make( []string, 0, len(sinkFormats) )
+    for name := range sinkFormats {
+        names = append( names, name )
+    }
+    sort.Strings( names )
+    return names
+}
+
+// parseSinks parses the argument of -sink, a comma separated list of
+// <format>:<path>
+func parseSinks( arg string ) ([]sinkSpec, error) {
+    var specs []sinkSpec
+    for _, part := range strings.Split( arg, "," ) {
+        parts := strings.SplitN( part, ":", 2 )
+        if len(parts) != 2 || parts[1] == "" {
+            return nil, fmt.Errorf( "invalid sink %s (<format>:<path>)\n",
+                                    part )
+        }
+        format := strings.ToLower( parts[0] )
+        if _, ok := sinkFormats[format]; ! ok {
+            return nil, fmt.Errorf( "unknown sink format %s (%s)\n", parts[0],
+                                    strings.Join( sinkFormatNames(), ", " ) )
+        }
+        specs = append( specs, sinkSpec{ format, parts[1] } )
+    }
+    return specs, nil
+}
+
+// openSinks opens the requested sinks, closing those already open if one
+// cannot be opened
+func openSinks( specs []sinkSpec, process *jpgArgs ) ([]reportSink, error) {
+    var sinks []reportSink
+    for _, spec := range specs {
+        sink, err := sinkFormats[spec.format].open( spec.path, process )
+        if err != nil {
+            for _, s := range sinks {
+                s.close()
+            }
+            return nil, err
+        }
+        sinks = append( sinks, sink )
+    }
+    return sinks, nil
+}
+
+// severityCounts returns the number of messages of each severity in rep
+func severityCounts( rep *fileReport ) (counts [len(severityNames)]int) {
+    for _, m := range rep.messages {
+        counts[m.severity] ++
+    }
+    return
+}
+
+// firstMessage returns the text of the first most severe message in rep
+func firstMessage( rep *fileReport ) string {
+    text, worst := "", severity( -1 )
+    for _, m := range rep.messages {
+        if m.severity > worst {
+            text, worst = m.text, m.severity
+        }
+    }
+    return text
+}
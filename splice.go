@@ -0,0 +1,265 @@
+
+package main
+
+import (
+    "fmt"
+    "image"
+    "image/color"
+    "math"
+)
+
+// Splice detection: a region pasted from another jpeg picture often keeps the
+// traces of its original compression. Two classic indicators are computed on
+// tiles of the reconstructed luminance:
+//  - block grid misalignment: the blocking artifacts of the pasted region are
+//    on an 8x8 grid that is shifted relatively to the grid of the picture.
+//  - jpeg ghosts: when recompressed at various qualities, the difference with
+//    the original decreases steadily with the quality, except for a region
+//    that was previously compressed at a lower quality, which shows a dip at
+//    that quality.
+// Both are statistical hints and not proofs of manipulation.
+
+const (
+    spliceTile          = 32    // tile size in pixels, multiple of 8
+    spliceGridStrength  = 1.5   // minimum peak/mean ratio of a visible grid
+    spliceGhostDip      = 0.9   // difference ratio below which a dip is a ghost
+    spliceMinVariance   = 25.0  // tiles with less variance are not analysed
+)
+
+// standard luminance quantization table (T.81 Annex K.1), in natural order
+var standardLuminanceQuant = [64]uint16{
+    16, 11, 10, 16,  24,  40,  51,  61,
+    12, 12, 14, 19,  26,  58,  60,  55,
+    14, 13, 16, 24,  40,  57,  69,  56,
+    14, 17, 22, 29,  51,  87,  80,  62,
+    18, 22, 37, 56,  68, 109, 103,  77,
+    24, 35, 55, 64,  81, 104, 113,  92,
+    49, 64, 78, 87, 103, 121, 120, 101,
+    72, 92, 95, 98, 112, 100, 103,  99 }
+
+// scaledQuant returns the standard table scaled for quality (1 to 100) as
+// commonly done by encoders
+func scaledQuant( table *[64]uint16, quality int ) (q [64]float64) {
+    scale := 200 - 2 * quality
+    if quality < 50 {
+        scale = 5000 / quality
+    }
+    for i, v := range table {
+        s := ( int(v) * scale + 50 ) / 100
+        if s < 1 {
+            s = 1
+        } else if s > 255 {
+            s = 255
+        }
+        q[i] = float64(s)
+    }
+    return
+}
+
+var ghostQualities = []int{ 50, 55, 60, 65, 70, 75, 80, 85, 90, 95 }
+
+type spliceTileResult struct {
+    analysed        bool
+    gridX, gridY    int         // phase of the strongest grid in the tile
+    misaligned      bool
+    ghost           int         // quality showing a ghost, 0 if none
+}
+
+// spliceMark is the state of a tile in the suspicion map
+type spliceMark struct {
+    misaligned      bool
+    ghost           bool        // ghost different from the global one
+}
+
+// gridProfile accumulates the absolute differences between adjacent samples
+// in the rectangle r, according to the column (h) and row (v) phase modulo 8
+// of the second sample. Block boundaries of an aligned grid are at phase 0.
+func gridProfile( p *plane, r image.Rectangle ) (h, v [8]float64) {
+    for y := r.Min.Y; y < r.Max.Y; y++ {
+        for x := r.Min.X; x < r.Max.X; x++ {
+            if x > 0 {
+                h[x % 8] += math.Abs( p.at( x, y ) - p.at( x - 1, y ) )
+            }
+            if y > 0 {
+                v[y % 8] += math.Abs( p.at( x, y ) - p.at( x, y - 1 ) )
+            }
+        }
+    }
+    return
+}
+
+// gridPhase returns the phase of the maximum of a profile and whether it is
+// strong enough to be a visible grid
+func gridPhase( profile [8]float64 ) (phase int, visible bool) {
+    var sum float64
+    for i, e := range profile {
+        sum += e
+        if e > profile[phase] {
+            phase = i
+        }
+    }
+    if sum == 0 {
+        return 0, false
+    }
+    return phase, profile[phase] / ( sum / 8 ) >= spliceGridStrength
+}
+
+// ghostDifferences returns for each ghost quality the mean square difference
+// between the samples in r (aligned on the block grid) and the same samples
+// recompressed at that quality
+func ghostDifferences( p *plane, r image.Rectangle ) []float64 {
+    diffs := make( []float64, len(ghostQualities) )
+    var in, coefs, out [64]float64
+    for qi, quality := range ghostQualities {
+        qt := scaledQuant( &standardLuminanceQuant, quality )
+        var sum float64
+        n := 0
+        for by := r.Min.Y; by + 8 <= r.Max.Y; by += 8 {
+            for bx := r.Min.X; bx + 8 <= r.Max.X; bx += 8 {
+                for y := 0; y < 8; y++ {
+                    for x := 0; x < 8; x++ {
+                        in[y*8+x] = p.at( bx + x, by + y ) - 128
+                    }
+                }
+                fdct( &in, &coefs )
+                for k := range coefs {
+                    coefs[k] = math.Round( coefs[k] / qt[k] ) * qt[k]
+                }
+                idct( &coefs, &out )
+                for k := range out {
+                    d := out[k] - in[k]
+                    sum += d * d
+                }
+                n += 64
+            }
+        }
+        if n > 0 {
+            diffs[qi] = sum / float64(n)
+        }
+    }
+    return diffs
+}
+
+func variance( p *plane, r image.Rectangle ) float64 {
+    var s, s2 float64
+    for y := r.Min.Y; y < r.Max.Y; y++ {
+        for x := r.Min.X; x < r.Max.X; x++ {
+            v := p.at( x, y )
+            s += v
+            s2 += v * v
+        }
+    }
+    n := float64(r.Dx() * r.Dy())
+    return s2 / n - ( s / n ) * ( s / n )
+}
+
+// ghostQuality returns the quality at which differences show a dip, i.e. a
+// quality lower than the maximum for which the difference is significantly
+// smaller than at the next higher quality, or 0 if there is no dip.
+func ghostQuality( diffs []float64 ) int {
+    for i := 0; i < len(diffs) - 1; i++ {
+        if diffs[i] < spliceGhostDip * diffs[i+1] {
+            return ghostQualities[i]
+        }
+    }
+    return 0
+}
+
+func analyseSpliceTile( p *plane, r image.Rectangle,
+                        phaseX, phaseY int ) (res spliceTileResult) {
+    if variance( p, r ) < spliceMinVariance {
+        return
+    }
+    res.analysed = true
+    h, v := gridProfile( p, r )
+    var visibleX, visibleY bool
+    res.gridX, visibleX = gridPhase( h )
+    res.gridY, visibleY = gridPhase( v )
+    res.misaligned = ( visibleX && res.gridX != phaseX ) ||
+                     ( visibleY && res.gridY != phaseY )
+    res.ghost = ghostQuality( ghostDifferences( p, r ) )
+    return
+}
+
+// checkSplicing analyses the luminance of the first frame by tiles and saves
+// a suspicion map at path: the picture in gray with suspicious tiles in red
+// (misaligned grid) or orange (ghost) and tiles with both indicators in
+// bright red. Suspicious tiles are reported as warnings in rep.
+func checkSplicing( path string, data []byte, l *fileLayout,
+                    rep *fileReport ) error {
+    img, err := decodeCoefficients( data, l )
+    if err != nil {
+        return fmt.Errorf( "splice check: %v", err )
+    }
+    fh := img.frame
+    if fh.comps[0].h != fh.hMax || fh.comps[0].v != fh.vMax {
+        return fmt.Errorf( "splice check: first component is subsampled\n" )
+    }
+    p, err := img.componentPlane( 0 )
+    if err != nil {
+        return fmt.Errorf( "splice check: %v", err )
+    }
+    whole := image.Rect( 0, 0, p.width, p.height )
+    h, v := gridProfile( p, whole )
+    phaseX, _ := gridPhase( h )
+    phaseY, _ := gridPhase( v )
+    globalGhost := ghostQuality( ghostDifferences( p, whole ) )
+
+    ntx := ( p.width + spliceTile - 1 ) / spliceTile
+    tiles := make( []spliceMark, ntx * ( ( p.height + spliceTile - 1 ) /
+                                          spliceTile ) )
+    var nTiles, nAnalysed, nMisaligned, nGhosts int
+    for ty := 0; ty < p.height; ty += spliceTile {
+        for tx := 0; tx < p.width; tx += spliceTile {
+            r := image.Rect( tx, ty, tx + spliceTile, ty + spliceTile ).
+                                                            Intersect( whole )
+            res := analyseSpliceTile( p, r, phaseX, phaseY )
+            nTiles ++
+            ghost := res.ghost != 0 && res.ghost != globalGhost
+            if res.analysed {
+                nAnalysed ++
+            }
+            if res.misaligned {
+                nMisaligned ++
+                rep.addMessage( warningSeverity, codeSplice, fmt.Sprintf(
+                    "splice check: block grid misaligned by (%d,%d) in tile " +
+                    "@(%d,%d)\n", ( res.gridX - phaseX + 8 ) % 8,
+                    ( res.gridY - phaseY + 8 ) % 8, tx, ty ) )
+            }
+            if ghost {
+                nGhosts ++
+                rep.addMessage( warningSeverity, codeSplice, fmt.Sprintf(
+                    "splice check: jpeg ghost at quality %d in tile @(%d,%d)\n",
+                    res.ghost, tx, ty ) )
+            }
+            tiles[ty / spliceTile * ntx + tx / spliceTile] =
+                                spliceMark{ res.misaligned, ghost }
+        }
+    }
+    smap := &pixelFunc{ bounds: whole, at: func( x, y int ) color.RGBA {
+        g := math.Max( 0, math.Min( 255, p.at( x, y ) ) ) / 2
+        c := color.RGBA{ uint8(g), uint8(g), uint8(g), 255 }
+        t := tiles[y / spliceTile * ntx + x / spliceTile]
+        switch {
+        case t.misaligned && t.ghost:
+            c.R = 255
+        case t.misaligned:
+            c.R = uint8(128 + g)
+        case t.ghost:
+            c.R, c.G = uint8(128 + g), uint8(64 + g)
+        }
+        return c
+    } }
+    if err = writePng( path, smap ); err != nil {
+        return fmt.Errorf( "splice check: %v\n", err )
+    }
+    fmt.Printf( "Splice check (%dx%d tiles):\n", spliceTile, spliceTile )
+    fmt.Printf( "  Block grid phase (%d,%d)", phaseX, phaseY )
+    if globalGhost != 0 {
+        fmt.Printf( ", global ghost at quality %d", globalGhost )
+    }
+    fmt.Printf( "\n  %d tiles, %d analysed, %d with misaligned grid, %d with " +
+                "ghost\n", nTiles, nAnalysed, nMisaligned, nGhosts )
+    fmt.Printf( "  Suspicion map saved as %s\n", path )
+    return nil
+}
@@ -0,0 +1,45 @@
+
+package main
+
+import (
+    "fmt"
+)
+
+// Scan extraction (-sscan): the entropy-coded data of a scan, from the end of
+// its SOS header to the next marker that is not a restart marker, is saved
+// as is, with its byte stuffing and its RSTn markers, for offline analysis or
+// for stitching experiments. Scans are numbered from 0 in file order, which
+// is the scan number used by -sc for the first frame.
+
+// saveScan saves the entropy-coded data of scan n in a new file at path
+func saveScan( data []byte, l *fileLayout, n int, path string ) error {
+    count := 0
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.marker != markerSOS {
+            continue
+        }
+        if count < n {
+            count ++
+            continue
+        }
+        end, restarts := s.ecsEnd, 0
+        for j := i + 1; j < len(l.segments); j++ {
+            r := &l.segments[j]
+            if r.offset != end || r.marker < markerRST0 ||
+               r.marker > markerRST7 {
+                break
+            }
+            end = r.ecsEnd
+            restarts ++
+        }
+        if err := writeFile( path, data[s.end():end], 0644 ); err != nil {
+            return fmt.Errorf( "unable to save scan %d: %v\n", n, err )
+        }
+        fmt.Printf( "Saved scan %d entropy-coded data (offset 0x%x, %d " +
+                    "restart markers) as %s, %d bytes\n", n, s.end(),
+                    restarts, path, end - s.end() )
+        return nil
+    }
+    return fmt.Errorf( "no scan %d (%d scans in file)\n", n, count )
+}
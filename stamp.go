@@ -0,0 +1,153 @@
+
+package main
+
+import (
+    "fmt"
+    "image"
+    "image/draw"
+    "image/png"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// Stamping (-stamp): proofing workflows need watermarked derivatives, made in
+// the same pass as the validation. The watermark is a png picture composited
+// with its alpha channel and an optional opacity onto the picture saved with
+// -spict, in a corner or in the center, at a margin of 1/50th of the smallest
+// side of the picture. The saved picture is modified in place, only in the
+// rows covered by the watermark, so that memory use does not depend on the
+// picture size. A watermark larger than the picture is clipped.
+
+var stampCorners = []string{ "tl", "tr", "bl", "br", "center" }
+
+type stampSpec struct {
+    path            string
+    corner          string
+    opacity         float64     // 0 to 1
+    img             *image.NRGBA
+}
+
+// parseStamp parses a stamp specification <png>:<corner>[:<opacity>] and loads
+// the watermark. The path may include ':', parameters are taken from the end.
+func parseStamp( spec string ) (*stampSpec, error) {
+    ss := &stampSpec{ opacity: 1 }
+    parts := strings.Split( spec, ":" )
+    if n := len(parts); n > 2 {
+        if o, err := strconv.ParseFloat( parts[n-1], 64 ); err == nil {
+            if o < 0 || o > 1 {
+                return nil, fmt.Errorf( "invalid stamp opacity %s (0 to 1)\n",
+                                        parts[n-1] )
+            }
+            ss.opacity = o
+            parts = parts[:n-1]
+        }
+    }
+    if len(parts) < 2 {
+        return nil, fmt.Errorf( "missing stamp corner in %s\n", spec )
+    }
+    ss.corner = strings.ToLower( parts[len(parts)-1] )
+    ss.path = strings.Join( parts[:len(parts)-1], ":" )
+    valid := false
+    for _, c := range stampCorners {
+        valid = valid || c == ss.corner
+    }
+    if ! valid {
+        return nil, fmt.Errorf( "invalid stamp corner %s (%s)\n", ss.corner,
+                                strings.Join( stampCorners, ", " ) )
+    }
+    f, err := os.Open( ss.path )
+    if err != nil {
+        return nil, fmt.Errorf( "unable to open stamp: %v\n", err )
+    }
+    defer f.Close()
+    img, err := png.Decode( f )
+    if err != nil {
+        return nil, fmt.Errorf( "unable to decode stamp %s: %v\n", ss.path, err )
+    }
+    ss.img = image.NewNRGBA( img.Bounds().Sub( img.Bounds().Min ) )
+    draw.Draw( ss.img, ss.img.Rect, img, img.Bounds().Min, draw.Src )
+    return ss, nil
+}
+
+// position returns the top left position of the watermark in a picture of
+// nc x nr pixels
+func (ss *stampSpec) position( nc, nr int ) (x, y int) {
+    sw, sh := ss.img.Rect.Dx(), ss.img.Rect.Dy()
+    margin := nc
+    if nr < margin {
+        margin = nr
+    }
+    margin /= 50
+    x, y = margin, margin
+    switch ss.corner {
+    case "tr":
+        x = nc - sw - margin
+    case "bl":
+        y = nr - sh - margin
+    case "br":
+        x, y = nc - sw - margin, nr - sh - margin
+    case "center":
+        x, y = ( nc - sw ) / 2, ( nr - sh ) / 2
+    }
+    if x < 0 {
+        x = 0
+    }
+    if y < 0 {
+        y = 0
+    }
+    return
+}
+
+// stampRawPicture composites the watermark onto the raw picture of nc x nr
+// pixels saved at path, which has 3 (RGB) or 1 (Y) bytes per pixel.
+func stampRawPicture( path string, nc, nr, size int, ss *stampSpec ) error {
+    if nc == 0 || nr == 0 || size % ( nc * nr ) != 0 {
+        return fmt.Errorf( "stamp: unexpected picture size %d for %dx%d\n",
+                           size, nc, nr )
+    }
+    bpp := size / ( nc * nr )
+    if bpp != 1 && bpp != 3 {
+        return fmt.Errorf( "stamp: unexpected %d bytes per pixel\n", bpp )
+    }
+    f, err := os.OpenFile( path, os.O_RDWR, 0 )
+    if err != nil {
+        return fmt.Errorf( "stamp: %v\n", err )
+    }
+    defer f.Close()
+    x0, y0 := ss.position( nc, nr )
+    w, h := ss.img.Rect.Dx(), ss.img.Rect.Dy()
+    if x0 + w > nc {
+        w = nc - x0
+    }
+    if y0 + h > nr {
+        h = nr - y0
+    }
+    row := make( []byte, w * bpp )
+    for y := 0; y < h; y++ {
+        offset := int64( ( ( y0 + y ) * nc + x0 ) * bpp )
+        if _, err = f.ReadAt( row, offset ); err != nil {
+            return fmt.Errorf( "stamp: %v\n", err )
+        }
+        for x := 0; x < w; x++ {
+            c := ss.img.NRGBAAt( x, y )
+            a := float64(c.A) / 255 * ss.opacity
+            blend := func( d *byte, s float64 ) {
+                *d = byte( float64(*d) * ( 1 - a ) + s * a + 0.5 )
+            }
+            if bpp == 1 {
+                blend( &row[x], luma( c.R, c.G, c.B ) )
+                continue
+            }
+            blend( &row[3*x], float64(c.R) )
+            blend( &row[3*x+1], float64(c.G) )
+            blend( &row[3*x+2], float64(c.B) )
+        }
+        if _, err = f.WriteAt( row, offset ); err != nil {
+            return fmt.Errorf( "stamp: %v\n", err )
+        }
+    }
+    fmt.Printf( "jpegcheck: stamped %s with %s (%dx%d at %d,%d, opacity " +
+                "%.2f)\n", path, ss.path, w, h, x0, y0, ss.opacity )
+    return nil
+}
@@ -0,0 +1,337 @@
+
+package main
+
+import (
+    "bytes"
+    "crypto/md5"
+    "encoding/binary"
+    "encoding/hex"
+    "fmt"
+    "os"
+    "regexp"
+    "strings"
+)
+
+// GPS anonymization (-strip-gps): the location of the picture is removed from
+// the copy written with -o in one pass, after the other modifications, in the
+// primary picture and in the pictures that follow it (MPF):
+//  - the GPS IFD of every Exif segment, and of MPF segments if any, is
+//    cleared, with the values of its tags, and the GPSInfoIFDPointer tag is
+//    removed from IFD0,
+//  - the GPS properties of the exif namespace (exif:GPSLatitude...) are
+//    blanked out in every main XMP packet, keeping the packet size, and in
+//    extended XMP packets, whose GUID is updated,
+//  - the LocationInfo tag of Nikon maker notes is cleared.
+// Other data is not moved, so that offsets remain valid. The library does not
+// keep XMP packets when writing, so the GPS properties of the original packet
+// are reported as not kept if the copy has no XMP packet. Not covered: the
+// location given by properties of other XMP namespaces (photoshop:City,
+// Iptc4xmpExt:LocationShown...) or by IPTC records, and the metadata of the
+// pictures embedded in other segments, such as the Exif thumbnail.
+
+const (
+    nsExif              = "http://ns.adobe.com/exif/1.0/"
+    tagNikonLocation    = 0x0039
+)
+
+var xmpNamespaceDecl = regexp.MustCompile( `xmlns:([A-Za-z_][\w.-]*)\s*=\s*` +
+                                           `["']` + regexp.QuoteMeta( nsExif ) +
+                                           `["']` )
+
+// stripGpsIfd clears the GPS IFD of the TIFF data in tiff, in place, and
+// returns the names of the tags removed, or nil if there is no GPS IFD
+func stripGpsIfd( tiff []byte ) ([]string, error) {
+    t, err := newTiffReader( tiff )
+    if err != nil {
+        return nil, err
+    }
+    offset := tagIfdOffset( t, 3 )
+    if offset == 0 {
+        return nil, nil
+    }
+    entries, _, err := t.readIfd( offset )
+    if err != nil {
+        return nil, err
+    }
+    removed := make( []string, 0, len(entries) )
+    for i := range entries {
+        e := &entries[i]
+        removed = append( removed, tagName( 3, e.tag ) )
+        if size := e.size(); size > 4 {
+            at := uint64(t.order.Uint32( e.value ))
+            if at + uint64(size) <= uint64(len(tiff)) {
+                for j := at; j < at + uint64(size); j++ {
+                    tiff[j] = 0
+                }
+            }
+        }
+    }
+    end := int(offset) + 2 + 12 * len(entries) + 4
+    for j := int(offset); j < end; j++ {
+        tiff[j] = 0
+    }
+    if _, err = removeIfdTags( tiff, t.first, 0,
+                               []uint16{ tagGpsIfd } ); err != nil {
+        return nil, err
+    }
+    return removed, nil
+}
+
+// stripNikonLocation clears the LocationInfo tag of a Nikon maker note, in
+// place, and returns true if it was found
+func stripNikonLocation( mn *makerNote ) bool {
+    if len(mn.content) < 18 ||
+       ! bytes.HasPrefix( mn.content, []byte( "Nikon\x00" ) ) {
+        return false
+    }
+    t, err := newTiffReader( mn.content[10:] )
+    if err != nil {
+        return false
+    }
+    entries, _, err := t.readIfd( t.first )
+    if err != nil {
+        return false
+    }
+    for i := range entries {
+        e := &entries[i]
+        if e.tag != tagNikonLocation {
+            continue
+        }
+        v, err := t.valueData( e )
+        if err != nil {
+            return false
+        }
+        for j := range v {
+            v[j] = 0
+        }
+        return true
+    }
+    return false
+}
+
+// xmpGpsProperties returns the byte ranges of the GPS properties of the exif
+// namespace in packet, either attributes or elements, with their names
+func xmpGpsProperties( packet []byte ) (ranges [][2]int, names []string) {
+    for _, m := range xmpNamespaceDecl.FindAllSubmatch( packet, -1 ) {
+        prefix := string( m[1] ) + ":GPS"
+        for p := 0; ; {
+            i := bytes.Index( packet[p:], []byte( prefix ) )
+            if i == -1 {
+                break
+            }
+            start := p + i
+            end := start + len(prefix)
+            for end < len(packet) && isNameByte( packet[end] ) {
+                end ++
+            }
+            name := string( packet[start:end] )
+            p = end
+            if start > 0 && packet[start-1] == '<' {    // element
+                start --
+                closing := []byte( "</" + name + ">" )
+                gt := bytes.IndexByte( packet[end:], '>' )
+                if gt == -1 {
+                    break
+                }
+                end += gt + 1
+                if packet[end-2] != '/' {
+                    c := bytes.Index( packet[end:], closing )
+                    if c == -1 {
+                        break
+                    }
+                    end += c + len(closing)
+                }
+            } else if start > 0 && ( packet[start-1] == ' ' ||
+                                     packet[start-1] == '\t' ||
+                                     packet[start-1] == '\n' ||
+                                     packet[start-1] == '\r' ) {
+                rest := packet[end:]            // attribute
+                eq := bytes.IndexByte( rest, '=' )
+                if eq == -1 || len( bytes.TrimSpace( rest[:eq] ) ) != 0 {
+                    continue
+                }
+                q := eq + 1
+                for q < len(rest) && rest[q] == ' ' {
+                    q ++
+                }
+                if q >= len(rest) || ( rest[q] != '"' && rest[q] != '\'' ) {
+                    continue
+                }
+                c := bytes.IndexByte( rest[q+1:], rest[q] )
+                if c == -1 {
+                    break
+                }
+                end += q + 1 + c + 1
+            } else {
+                continue                        // closing tag or text
+            }
+            ranges = append( ranges, [2]int{ start, end } )
+            names = append( names, name )
+            p = end
+        }
+    }
+    return
+}
+
+func isNameByte( c byte ) bool {
+    return c == '_' || c == '-' || c == '.' || ( c >= '0' && c <= '9' ) ||
+           ( c >= 'a' && c <= 'z' ) || ( c >= 'A' && c <= 'Z' )
+}
+
+// blankXmpGps blanks out the GPS properties of the exif namespace in packet,
+// in place, and returns their names
+func blankXmpGps( packet []byte ) []string {
+    ranges, names := xmpGpsProperties( packet )
+    for _, r := range ranges {
+        for j := r[0]; j < r[1]; j++ {
+            packet[j] = ' '
+        }
+    }
+    return names
+}
+
+// xmpExtension is an extended XMP packet, split in parts stored in APP1
+// segments after the extension header, the GUID, the full length and the
+// offset of the part
+type xmpExtension struct {
+    guid            []byte      // in the segments
+    headers         [][]byte    // GUID, length and offset of each part
+    parts           [][]byte    // in the segments
+}
+
+// strip blanks out the GPS properties of the exif namespace in the extended
+// packet reassembled from its parts, in place, and returns their names. Since
+// the GUID is the MD5 digest of the packet, it is updated in the parts and in
+// the main packets that reference it.
+func (x *xmpExtension) strip( mains [][]byte ) []string {
+    var size uint32
+    for _, h := range x.headers {
+        if l := binary.BigEndian.Uint32( h[32:] ); l > size {
+            size = l
+        }
+    }
+    if size > 1 << 28 {                 // ignore unreasonable sizes
+        return nil
+    }
+    packet := make( []byte, size )
+    for i, p := range x.parts {
+        offset := binary.BigEndian.Uint32( x.headers[i][36:] )
+        if uint64(offset) + uint64(len(p)) <= uint64(size) {
+            copy( packet[offset:], p )
+        }
+    }
+    names := blankXmpGps( packet )
+    if len(names) == 0 {
+        return nil
+    }
+    sum := md5.Sum( packet )
+    guid := []byte( strings.ToUpper( hex.EncodeToString( sum[:] ) ) )
+    for _, m := range mains {
+        for p := 0; ; {
+            i := bytes.Index( m[p:], x.guid )
+            if i == -1 {
+                break
+            }
+            copy( m[p+i:], guid )
+            p += i + len(guid)
+        }
+    }
+    for i, p := range x.parts {
+        offset := binary.BigEndian.Uint32( x.headers[i][36:] )
+        if uint64(offset) + uint64(len(p)) <= uint64(size) {
+            copy( p, packet[offset:] )
+        }
+        copy( x.headers[i], guid )
+    }
+    return names
+}
+
+// stripGpsFile removes the location data from the file at output, the copy of
+// the file at path, and returns a description of what was removed. All Exif
+// segments, MPF segments, main and extended XMP packets are processed, in
+// the primary picture and in the pictures that follow it (MPF).
+func stripGpsFile( path, output string ) (string, error) {
+    data, err := os.ReadFile( output )
+    if err != nil {
+        return "", fmt.Errorf( "strip-gps: %v\n", err )
+    }
+    l := scanLayout( data )
+    var removed []string
+    var mains [][]byte
+    var extensions []*xmpExtension
+    byGuid := make( map[string]*xmpExtension )
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.marker != markerAPP0 + 1 && s.marker != markerAPP0 + 2 {
+            continue
+        }
+        d := s.data( data )
+        var tiff []byte
+        what := "GPS IFD"
+        switch {
+        case s.marker == markerAPP0 + 2:
+            if bytes.HasPrefix( d, []byte( "MPF\x00" ) ) {
+                tiff, what = d[4:], "MPF GPS IFD"
+            }
+        case bytes.HasPrefix( d, exifHeader ):
+            tiff = exifTiffData( d )
+            if mn := findMakerNote( data, s ); mn != nil &&
+               stripNikonLocation( mn ) {
+                removed = append( removed, "Nikon maker note LocationInfo" )
+            }
+        case bytes.HasPrefix( d, xmpHeader ):
+            packet := d[len(xmpHeader):]
+            mains = append( mains, packet )
+            if names := blankXmpGps( packet ); len(names) > 0 {
+                removed = append( removed, "XMP properties " +
+                                  strings.Join( names, ", " ) )
+            }
+        case bytes.HasPrefix( d, xmpExtensionHeader ) &&
+             len(d) >= len(xmpExtensionHeader) + 40:
+            d = d[len(xmpExtensionHeader):]
+            x, ok := byGuid[string( d[:32] )]
+            if ! ok {
+                x = &xmpExtension{ guid: append( []byte( nil ), d[:32]... ) }
+                byGuid[string( d[:32] )] = x
+                extensions = append( extensions, x )
+            }
+            x.headers = append( x.headers, d[:40] )
+            x.parts = append( x.parts, d[40:] )
+        }
+        if tiff != nil {
+            tags, err := stripGpsIfd( tiff )
+            if err != nil {
+                return "", fmt.Errorf( "strip-gps: %v", err )
+            }
+            if tags != nil {
+                removed = append( removed, what + " (" +
+                                  strings.Join( tags, ", " ) + ")" )
+            }
+        }
+    }
+    for _, x := range extensions {
+        if names := x.strip( mains ); len(names) > 0 {
+            removed = append( removed, "extended XMP properties " +
+                              strings.Join( names, ", " ) )
+        }
+    }
+    if err = writeFile( output, data, 0644 ); err != nil {
+        return "", fmt.Errorf( "strip-gps: %v\n", err )
+    }
+    if len(mains) == 0 {
+        if orig, err := os.ReadFile( path ); err == nil {
+            if s, _ := findXmp( orig, scanLayout( orig ) ); s != nil {
+                packet := s.data( orig )[len(xmpHeader):]
+                if _, names := xmpGpsProperties( packet ); len(names) > 0 {
+                    removed = append( removed, "XMP properties " +
+                                      strings.Join( names, ", " ) +
+                                      " (XMP packet not kept in the copy)" )
+                }
+            }
+        }
+    }
+    if len(removed) == 0 {
+        return "strip-gps: no location data found", nil
+    }
+    return "strip-gps: removed " + strings.Join( removed, "; " ), nil
+}
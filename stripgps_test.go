@@ -0,0 +1,115 @@
+package main
+
+import (
+    "bytes"
+    "crypto/md5"
+    "encoding/binary"
+    "encoding/hex"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// gpsTiff returns little-endian TIFF data with a GPS IFD giving a latitude
+func gpsTiff( ) []byte {
+    t := []byte( "II*\x00\x08\x00\x00\x00" )
+    le := binary.LittleEndian
+    entry := func( tag, typ uint16, count, value uint32 ) []byte {
+        e := make( []byte, 12 )
+        le.PutUint16( e, tag )
+        le.PutUint16( e[2:], typ )
+        le.PutUint32( e[4:], count )
+        le.PutUint32( e[8:], value )
+        return e
+    }
+    t = append( t, 1, 0 )                               // IFD0 at 8
+    t = append( t, entry( tagGpsIfd, 4, 1, 26 )... )
+    t = append( t, 0, 0, 0, 0 )
+    t = append( t, 1, 0 )                               // GPS IFD at 26
+    t = append( t, entry( 0x0002, 5, 3, 44 )... )       // GPSLatitude
+    t = append( t, 0, 0, 0, 0 )
+    for _, v := range []uint32{ 48, 1, 51, 1, 24, 1 } { // at 44
+        t = append( t, 0, 0, 0, 0 )
+        le.PutUint32( t[len(t)-4:], v )
+    }
+    return t
+}
+
+func TestStripGpsAllSegments( t *testing.T ) {
+    const latitude = `<exif:GPSLatitude>48,51.4N</exif:GPSLatitude>`
+    extended := []byte( `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF ` +
+                        `xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-` +
+                        `ns#"><rdf:Description xmlns:exif="` + nsExif + `">` +
+                        latitude + `</rdf:Description></rdf:RDF></x:xmpmeta>` )
+    sum := md5.Sum( extended )
+    guid := strings.ToUpper( hex.EncodeToString( sum[:] ) )
+    main := []byte( `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF ` +
+                    `xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+                    `<rdf:Description xmlns:xmpNote="http://ns.adobe.com/` +
+                    `xmp/note/" xmpNote:HasExtendedXMP="` + guid + `"/>` +
+                    `</rdf:RDF></x:xmpmeta>` )
+    var segments []byte
+    exif := append( append( []byte( nil ), exifHeader... ), gpsTiff()... )
+    segments = append( segments, segmentBytesOf( markerAPP0 + 1, exif )... )
+    segments = append( segments, segmentBytesOf( markerAPP0 + 1,
+                       append( append( []byte( nil ), xmpHeader... ),
+                               main... ) )... )
+    half := len(extended) / 2
+    for _, part := range [][2]int{ { 0, half }, { half, len(extended) } } {
+        d := append( append( []byte( nil ), xmpExtensionHeader... ), guid... )
+        d = append( d, make( []byte, 8 )... )
+        binary.BigEndian.PutUint32( d[len(d)-8:], uint32(len(extended)) )
+        binary.BigEndian.PutUint32( d[len(d)-4:], uint32(part[0]) )
+        d = append( d, extended[part[0]:part[1]]... )
+        segments = append( segments, segmentBytesOf( markerAPP0 + 1, d )... )
+    }
+    mpf := append( []byte( "MPF\x00" ), gpsTiff()... )
+    segments = append( segments, segmentBytesOf( markerAPP0 + 2, mpf )... )
+    picture := testsetData( t, "baseline-420.jpg" )
+    var data []byte
+    data = append( data, picture[:2]... )
+    data = append( data, segments... )
+    data = append( data, picture[2:]... )
+    second := append( append( []byte( nil ), picture[:2]... ), // MPF picture
+                      segmentBytesOf( markerAPP0 + 1, exif )... )
+    data = append( append( data, second... ), picture[2:]... )
+
+    dir := t.TempDir()
+    path := filepath.Join( dir, "gps.jpg" )
+    if err := os.WriteFile( path, data, 0644 ); err != nil {
+        t.Fatal( err )
+    }
+    text, err := stripGpsFile( path, path )
+    if err != nil {
+        t.Fatal( err )
+    }
+    if n := strings.Count( text, "GPS IFD (GPSLatitude)" ); n != 3 {
+        t.Errorf( "%d GPS IFD removed, expected 3: %s", n, text )
+    }
+    if ! strings.Contains( text, "extended XMP properties exif:GPSLatitude" ) {
+        t.Errorf( "extended XMP not stripped: %s", text )
+    }
+    stripped, err := os.ReadFile( path )
+    if err != nil {
+        t.Fatal( err )
+    }
+    if len(stripped) != len(data) {
+        t.Fatalf( "size changed from %d to %d", len(data), len(stripped) )
+    }
+    if bytes.Contains( stripped, []byte( "GPSLatitude" ) ) ||
+       bytes.Contains( stripped, []byte( guid ) ) {
+        t.Errorf( "latitude or old GUID left in the copy" )
+    }
+    var packet []byte
+    for _, x := range xmpPackets( stripped, scanLayout( stripped ) ) {
+        if x.extended {
+            packet = x.data
+        }
+    }
+    sum = md5.Sum( packet )
+    guid = strings.ToUpper( hex.EncodeToString( sum[:] ) )
+    if ! bytes.Contains( stripped, []byte( `HasExtendedXMP="` + guid ) ) {
+        t.Errorf( "GUID of the extended packet not updated" )
+    }
+}
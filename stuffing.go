@@ -0,0 +1,173 @@
+
+package main
+
+import (
+    "fmt"
+)
+
+// Byte stuffing (-stuffing): in entropy-coded data, a 0xff byte must be
+// followed by a stuffed 0x00, and the only markers allowed are RSTn, while any
+// marker may be preceded by 0xff fill bytes. Encoders that forget to stuff, or
+// that stuff the wrong bytes, produce 0xff followed by a reserved code, which
+// decoders handle differently. The entropy-coded data of each scan is scanned
+// independently of the segment layout, so that an illegal sequence does not
+// end the scan, and all fill bytes, stuffed bytes and illegal sequences are
+// reported with their offsets.
+
+type fillRun struct {
+    offset, count   int
+    marker          byte        // following marker
+}
+
+type illegalSequence struct {
+    offset          int
+    code            byte        // byte following 0xff
+    scan            int
+}
+
+type scanStuffing struct {
+    offset          int         // SOS marker
+    size            int         // entropy-coded bytes, RSTn included
+    stuffed         int
+    firstStuffed    int         // offset of the first stuffed byte, or -1
+    rst             int
+    end             int         // offset of the terminating marker
+    marker          byte        // terminating marker, 0 if none
+}
+
+type stuffingReport struct {
+    fills           []fillRun
+    scans           []scanStuffing
+    illegal         []illegalSequence
+}
+
+// scanStuffingOf scans the entropy-coded data starting at offset, for scan n,
+// and returns the offset following it
+func (sr *stuffingReport) scanStuffingOf( data []byte, offset,
+                                          n int, ss *scanStuffing ) int {
+    ss.firstStuffed = -1
+    fill := 0
+    i := offset
+    for ; i < len(data) - 1; i++ {
+        if data[i] != 0xff {
+            continue
+        }
+        code := data[i+1]
+        switch {
+        case code == 0x00:
+            if ss.stuffed == 0 {
+                ss.firstStuffed = i
+            }
+            ss.stuffed ++
+            fill = 0
+            i++
+            continue
+        case code == 0xff:
+            fill ++
+            continue
+        }
+        if fill > 0 {
+            sr.fills = append( sr.fills, fillRun{ i - fill, fill, code } )
+            fill = 0
+        }
+        switch {
+        case code >= markerRST0 && code <= markerRST7:
+            ss.rst ++
+            i++
+        case code < markerSOF0:         // TEM and reserved codes
+            sr.illegal = append( sr.illegal, illegalSequence{ i, code, n } )
+            i++
+        default:
+            ss.end, ss.marker = i, code
+            ss.size = i - offset
+            return i
+        }
+    }
+    ss.end, ss.size = len(data), len(data) - offset
+    return len(data)
+}
+
+// byteStuffing returns the fill bytes, stuffed bytes and illegal sequences
+// found in data
+func byteStuffing( data []byte, l *fileLayout ) *stuffingReport {
+    sr := new( stuffingReport )
+    scanned := 0                        // end of the last scan
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.offset < scanned {
+            continue                    // inside the last scan
+        }
+        if s.marker >= markerRST0 && s.marker <= markerRST7 {
+            continue
+        }
+        start := 0                      // fill bytes outside scans
+        if i > 0 {
+            start = l.segments[i-1].end()
+            if e := l.segments[i-1].ecsEnd; e != 0 {
+                start = e
+            }
+        }
+        if start < scanned {
+            start = scanned
+        }
+        fill := 0
+        for p := s.offset - 1; p >= start && data[p] == 0xff; p-- {
+            fill ++
+        }
+        if fill > 0 {
+            sr.fills = append( sr.fills, fillRun{ s.offset - fill, fill,
+                                                  s.marker } )
+        }
+        if s.marker == markerSOS && s.end() < len(data) {
+            ss := scanStuffing{ offset: s.offset }
+            scanned = sr.scanStuffingOf( data, s.end(), len(sr.scans), &ss )
+            sr.scans = append( sr.scans, ss )
+        }
+    }
+    return sr
+}
+
+// formatStuffing prints the fill bytes, stuffed bytes and illegal 0xff
+// sequences found in data, and reports the illegal sequences
+func formatStuffing( data []byte, l *fileLayout, rep *fileReport ) {
+    sr := byteStuffing( data, l )
+    fmt.Printf( "Byte stuffing:\n" )
+    total := 0
+    for _, f := range sr.fills {
+        total += f.count
+    }
+    fmt.Printf( "  Fill bytes before markers: %d in %d place(s)\n", total,
+                len(sr.fills) )
+    for _, f := range sr.fills {
+        fmt.Printf( "    @0x%x: %d fill byte(s) before %s\n", f.offset,
+                    f.count, markerName( f.marker ) )
+    }
+    for n, ss := range sr.scans {
+        first := ""
+        if ss.firstStuffed >= 0 {
+            first = fmt.Sprintf( " (first @0x%x)", ss.firstStuffed )
+        }
+        end := "end of file"
+        if ss.marker != 0 {
+            end = fmt.Sprintf( "%s @0x%x", markerName( ss.marker ), ss.end )
+        }
+        fmt.Printf( "  Scan %d @0x%x: %d entropy-coded bytes, %d stuffed " +
+                    "0xff00%s, %d RSTn, ended by %s\n", n, ss.offset, ss.size,
+                    ss.stuffed, first, ss.rst, end )
+    }
+    if len(sr.illegal) == 0 {
+        fmt.Printf( "  No illegal 0xff sequence in entropy-coded data\n" )
+        return
+    }
+    fmt.Printf( "  Illegal 0xff sequences in entropy-coded data: %d\n",
+                len(sr.illegal) )
+    for _, is := range sr.illegal {
+        fmt.Printf( "    @0x%x: 0xff 0x%02x in scan %d\n", is.offset, is.code,
+                    is.scan )
+    }
+    first := sr.illegal[0]
+    rep.addMessage( warningSeverity, codeByteStuffing, fmt.Sprintf(
+                    "Byte stuffing: %d illegal 0xff sequence(s) in " +
+                    "entropy-coded data, first 0xff 0x%02x @0x%x in scan %d",
+                    len(sr.illegal), first.code, first.offset, first.scan ) )
+}
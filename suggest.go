@@ -0,0 +1,418 @@
+
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "os"
+    "sort"
+    "strings"
+)
+
+// Guided repair (-suggest and -apply-suggestions): instead of the blanket
+// fixes of -tidyup, the raw file structure is walked from marker to marker and
+// each problem that has a concrete byte-level repair gives a suggestion, with
+// a confidence level:
+//  - a segment length field that does not lead to the next marker, replaced
+//    by the length computed from the segment content (DHT, DQT, SOFn, SOS,
+//    DRI), with a high confidence, or by the nearest length leading to a
+//    chain of valid segments, with a medium confidence,
+//  - garbage bytes between segments, removed (medium),
+//  - a single restart marker out of sequence, renumbered (high),
+//  - a missing EOI marker, appended (high if the last segment is complete,
+//    medium if the file ends in a segment or in entropy-coded data, which may
+//    be truncated),
+//  - data after EOI, removed (low, since it may be intentional, e.g. an
+//    appended video).
+// Suggestions are saved as json with the size and sha256 of the file they
+// apply to, and only high confidence ones are marked to be applied. The file
+// can be edited and replayed with -apply-suggestions, or the suggestions can
+// be accepted one by one interactively with -apply-suggestions=ask. Accepted
+// repairs are made to the raw data before the analysis, so that the copy
+// written with -o is repaired.
+
+const (
+    highConfidence      = "high"
+    mediumConfidence    = "medium"
+    lowConfidence       = "low"
+)
+
+const maxLengthDelta = 64   // largest length correction searched for
+
+type repairSuggestion struct {
+    Id              int         `json:"id"`
+    Offset          int         `json:"offset"`
+    Description     string      `json:"description"`
+    Confidence      string      `json:"confidence"`
+    Apply           bool        `json:"apply"`
+    Remove          int         `json:"remove"`           // bytes at offset
+    Insert          string      `json:"insert,omitempty"` // hex, at offset
+}
+
+type suggestionReport struct {
+    File            string      `json:"file"`
+    Size            int         `json:"size"`
+    Sha256          string      `json:"sha256"`
+    Suggestions     []repairSuggestion `json:"suggestions"`
+}
+
+// suggestionWalker finds repair suggestions in data
+type suggestionWalker struct {
+    data            []byte
+    suggestions     []repairSuggestion
+}
+
+func (w *suggestionWalker) suggest( offset int, confidence string, remove int,
+                                    insert []byte, format string,
+                                    a ...interface{} ) {
+    w.suggestions = append( w.suggestions, repairSuggestion{
+                            Id: len(w.suggestions) + 1, Offset: offset,
+                            Description: fmt.Sprintf( format, a... ),
+                            Confidence: confidence,
+                            Apply: confidence == highConfidence,
+                            Remove: remove,
+                            Insert: hex.EncodeToString( insert ) } )
+}
+
+// isMarkerAt returns true if a marker (or a fill byte) starts at offset p
+func (w *suggestionWalker) isMarkerAt( p int ) bool {
+    return p >= 0 && p + 1 < len(w.data) && w.data[p] == 0xff &&
+           w.data[p+1] != 0x00
+}
+
+// chainsAt returns true if a marker starts at p and, if it is followed by a
+// length, the segment ends on another marker or at the end of data
+func (w *suggestionWalker) chainsAt( p int ) bool {
+    if ! w.isMarkerAt( p ) {
+        return false
+    }
+    m := w.data[p+1]
+    if m == 0xff || ! hasLength( m ) || m == markerSOS {
+        return true
+    }
+    if p + 4 > len(w.data) {
+        return false
+    }
+    end := p + 2 + int(w.data[p+2]) << 8 + int(w.data[p+3])
+    return end == len(w.data) || w.isMarkerAt( end )
+}
+
+// contentLength returns the length field value implied by the content of the
+// segment with marker m starting at offset start (after its length field)
+func (w *suggestionWalker) contentLength( m byte, start int ) (int, bool) {
+    d := w.data
+    switch {
+    case m == markerDHT:
+        p := start
+        for p < len(d) && d[p] != 0xff {
+            if p + 17 > len(d) {
+                return 0, false
+            }
+            n := 0
+            for _, c := range d[p+1:p+17] {
+                n += int(c)
+            }
+            p += 17 + n
+        }
+        return p - start + 2, p > start && p <= len(d)
+    case m == markerDQT:
+        p := start
+        for p < len(d) && d[p] != 0xff {
+            if d[p] >> 4 > 1 {
+                return 0, false
+            }
+            p += 1 + 64 * int( d[p] >> 4 + 1 )
+        }
+        return p - start + 2, p > start && p <= len(d)
+    case isSOF( m ):
+        if start + 6 > len(d) {
+            return 0, false
+        }
+        return 8 + 3 * int(d[start+5]), true
+    case m == markerSOS:
+        if start >= len(d) {
+            return 0, false
+        }
+        return 6 + 2 * int(d[start]), true
+    case m == markerDRI:
+        return 4, true
+    }
+    return 0, false
+}
+
+// segmentEnd returns the end of the segment with marker m at offset p, with a
+// corrected length if its length field does not lead to a marker
+func (w *suggestionWalker) segmentEnd( m byte, p int ) int {
+    d := w.data
+    length := int(d[p+2]) << 8 + int(d[p+3])
+    end := p + 2 + length
+    if end == len(d) || w.isMarkerAt( end ) {
+        return end
+    }
+    fixed, confidence, reason := 0, "", ""
+    if n, ok := w.contentLength( m, p + 4 ); ok && n != length &&
+                                              w.chainsAt( p + 2 + n ) {
+        fixed, confidence, reason = n, highConfidence, "content"
+    } else {
+        for delta := 1; delta <= maxLengthDelta && fixed == 0; delta++ {
+            for _, n := range []int{ length - delta, length + delta } {
+                if n >= 2 && n <= 0xffff && w.chainsAt( p + 2 + n ) {
+                    fixed, confidence, reason = n, mediumConfidence,
+                                                "next marker"
+                    break
+                }
+            }
+        }
+    }
+    if fixed == 0 {
+        return end
+    }
+    w.suggest( p + 2, confidence, 2, []byte{ byte( fixed >> 8 ), byte(fixed) },
+               "length field of %s at 0x%x is 0x%04x but %s suggests 0x%04x",
+               markerName( m ), p, length, reason, fixed )
+    return p + 2 + fixed
+}
+
+// scanEnd returns the end of the entropy-coded data starting at p, after
+// checking the sequence of its restart markers
+func (w *suggestionWalker) scanEnd( p int ) int {
+    d := w.data
+    var restarts []int
+    for p + 1 < len(d) {
+        if d[p] != 0xff || d[p+1] == 0x00 {
+            p++
+            continue
+        }
+        if d[p+1] < markerRST0 || d[p+1] > markerRST7 {
+            break
+        }
+        restarts = append( restarts, p )
+        p += 2
+    }
+    if p + 1 >= len(d) {
+        p = len(d)
+    }
+    for i, r := range restarts {
+        expected := markerRST0 + byte( i % 8 )
+        if i > 0 {
+            expected = markerRST0 + ( d[restarts[i-1]+1] - markerRST0 + 1 ) % 8
+        }
+        // a single wrong marker is followed by the expected next one
+        if d[r+1] == expected || ( i + 1 < len(restarts) &&
+           d[restarts[i+1]+1] != markerRST0 + ( expected - markerRST0 + 1 ) % 8 ) {
+            continue
+        }
+        w.suggest( r, highConfidence, 2, []byte{ 0xff, expected },
+                   "restart marker %s at 0x%x is out of sequence, expected %s",
+                   markerName( d[r+1] ), r, markerName( expected ) )
+        d[r+1] = expected               // walker copy, for the next ones
+    }
+    return p
+}
+
+// findRepairs returns the repair suggestions for data
+func findRepairs( data []byte ) []repairSuggestion {
+    if len(data) < 2 || data[0] != 0xff || data[1] != markerSOI {
+        return nil
+    }
+    w := &suggestionWalker{ data: append( []byte( nil ), data... ) }
+    d := w.data
+    complete := true
+    p := 2
+    for p < len(d) {
+        if ! w.isMarkerAt( p ) {
+            q := p + 1
+            for q < len(d) && ! w.isMarkerAt( q ) {
+                q++
+            }
+            if q == len(d) {
+                break                   // no more markers, handled as no EOI
+            }
+            w.suggest( p, mediumConfidence, q - p, nil, "%d bytes of garbage " +
+                       "at 0x%x before %s", q - p, p, markerName( d[q+1] ) )
+            p = q
+            continue
+        }
+        m := d[p+1]
+        switch {
+        case m == 0xff:                 // fill byte
+            p++
+            continue
+        case m == markerEOI:
+            if p + 2 < len(d) {
+                w.suggest( p + 2, lowConfidence, len(d) - p - 2, nil,
+                           "%d bytes of data after EOI at 0x%x", len(d) - p - 2,
+                           p )
+            }
+            return w.suggestions
+        case ! hasLength( m ):
+            p += 2
+            continue
+        case p + 4 > len(d):
+            complete = false
+            p = len(d)
+            continue
+        }
+        end := w.segmentEnd( m, p )
+        if end > len(d) {
+            complete = false
+            break
+        }
+        p = end
+        if m == markerSOS {
+            if p = w.scanEnd( p ); p == len(d) {
+                complete = false        // may be truncated
+            }
+        }
+    }
+    confidence := highConfidence
+    if ! complete {
+        confidence = mediumConfidence
+    }
+    w.suggest( len(data), confidence, 0, []byte{ 0xff, markerEOI },
+               "missing EOI marker at the end of the file" )
+    return w.suggestions
+}
+
+func fileSha256( data []byte ) string {
+    sum := sha256.Sum256( data )
+    return hex.EncodeToString( sum[:] )
+}
+
+// formatSuggestions prints the suggestions and records them in rep
+func formatSuggestions( suggestions []repairSuggestion, rep *fileReport ) {
+    if len(suggestions) == 0 {
+        fmt.Printf( "No repair suggestion\n" )
+        return
+    }
+    for _, s := range suggestions {
+        text := fmt.Sprintf( "Repair suggestion %d (%s confidence): %s\n",
+                             s.Id, s.Confidence, s.Description )
+        fmt.Printf( "%s", text )
+        rep.addMessage( infoSeverity, codeRepairSuggestion, text )
+    }
+}
+
+// saveSuggestions finds the repair suggestions for the file at path and saves
+// them as json in a new file at dest
+func saveSuggestions( dest, path string, data []byte,
+                      rep *fileReport ) error {
+    report := suggestionReport{ File: path, Size: len(data),
+                                Sha256: fileSha256( data ),
+                                Suggestions: findRepairs( data ) }
+    formatSuggestions( report.Suggestions, rep )
+    if report.Suggestions == nil {
+        report.Suggestions = []repairSuggestion{ }
+    }
+    content, err := json.MarshalIndent( &report, "", "  " )
+    if err == nil {
+        err = writeFile( dest, append( content, '\n' ), 0644 )
+    }
+    if err != nil {
+        return fmt.Errorf( "unable to save repair suggestions: %v\n", err )
+    }
+    fmt.Printf( "Saved %d repair suggestions as %s\n",
+                len(report.Suggestions), dest )
+    return nil
+}
+
+// loadSuggestions reads a suggestion report saved by -suggest
+func loadSuggestions( path string ) (*suggestionReport, error) {
+    content, err := os.ReadFile( path )
+    if err != nil {
+        return nil, err
+    }
+    dec := json.NewDecoder( bytes.NewReader( content ) )
+    dec.DisallowUnknownFields()
+    report := new( suggestionReport )
+    if err = dec.Decode( report ); err != nil {
+        return nil, fmt.Errorf( "invalid repair suggestions in %s: %v\n", path,
+                                err )
+    }
+    for _, s := range report.Suggestions {
+        if _, err = hex.DecodeString( s.Insert ); err != nil || s.Remove < 0 ||
+           s.Offset < 0 || s.Offset + s.Remove > report.Size {
+            return nil, fmt.Errorf( "invalid repair suggestion %d in %s\n",
+                                    s.Id, path )
+        }
+    }
+    return report, nil
+}
+
+var answers *bufio.Reader              // interactive answers, from stdin
+
+// askSuggestions asks whether to apply each suggestion and returns the
+// suggestions with their Apply field set accordingly
+func askSuggestions( suggestions []repairSuggestion ) []repairSuggestion {
+    if answers == nil {
+        answers = bufio.NewReader( os.Stdin )
+    }
+    for i := range suggestions {
+        s := &suggestions[i]
+        fmt.Printf( "Repair suggestion %d (%s confidence): %s - apply? y/n ",
+                    s.Id, s.Confidence, s.Description )
+        line, _ := answers.ReadString( '\n' )
+        answer := strings.ToLower( strings.TrimSpace( line ) )
+        s.Apply = answer == "y" || answer == "yes"
+    }
+    return suggestions
+}
+
+// applySuggestions returns data with the suggestions marked to be applied
+// made, or nil if none is applied. Suggestions must not overlap.
+func applySuggestions( data []byte, suggestions []repairSuggestion,
+                       rep *fileReport ) ([]byte, error) {
+    var applied []repairSuggestion
+    for _, s := range suggestions {
+        if s.Apply {
+            applied = append( applied, s )
+        }
+    }
+    if len(applied) == 0 {
+        return nil, nil
+    }
+    sort.SliceStable( applied, func( i, j int ) bool {
+        return applied[i].Offset < applied[j].Offset
+    } )
+    var b bytes.Buffer
+    last := 0
+    for _, s := range applied {
+        if s.Offset < last {
+            return nil, fmt.Errorf( "repair suggestion %d overlaps another " +
+                                    "one\n", s.Id )
+        }
+        insert, _ := hex.DecodeString( s.Insert )
+        b.Write( data[last:s.Offset] )
+        b.Write( insert )
+        last = s.Offset + s.Remove
+        text := fmt.Sprintf( "Applied repair suggestion %d: %s\n", s.Id,
+                             s.Description )
+        fmt.Printf( "%s", text )
+        rep.addMessage( warningSeverity, codeAppliedRepair, text )
+    }
+    b.Write( data[last:] )
+    return b.Bytes(), nil
+}
+
+// repairData returns data repaired according to the option
+// -apply-suggestions, or nil if no repair is made
+func (process *jpgArgs) repairData( data []byte,
+                                    rep *fileReport ) ([]byte, error) {
+    var suggestions []repairSuggestion
+    if process.applySuggestions == "ask" {
+        suggestions = askSuggestions( findRepairs( data ) )
+    } else {
+        report := process.suggestions
+        if report.Size != len(data) || report.Sha256 != fileSha256( data ) {
+            return nil, fmt.Errorf( "repair suggestions in %s were made for " +
+                                    "another file\n",
+                                    process.applySuggestions )
+        }
+        suggestions = report.Suggestions
+    }
+    return applySuggestions( data, suggestions, rep )
+}
@@ -0,0 +1,190 @@
+
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+
+    "github.com/jrm-1535/jpeg"
+)
+
+// Output naming templates: output paths may include placeholders between
+// braces, which are replaced for each file of a batch, so that the same option
+// can be used to extract data from many files. Metadata values come from the
+// Exif segment and are always sanitized, since they are not under the control
+// of the user.
+
+var metaTemplateTags = map[string]uint16{
+    "Make":                 0x010f,
+    "Model":                0x0110,
+    "Software":             0x0131,
+    "DateTime":             0x0132,
+    "Artist":               0x013b,
+    "Copyright":            0x8298,
+    "DateTimeOriginal":     0x9003,
+    "DateTimeDigitized":    0x9004,
+}
+
+// hasTemplate returns true if p includes placeholders
+func hasTemplate( p string ) bool {
+    return strings.ContainsRune( p, '{' )
+}
+
+type templateContext struct {
+    path            string      // input file
+    index           int         // position of the file in batch, from 1
+    tags            map[uint16]string   // Exif ascii values, read if needed
+}
+
+func (tc *templateContext) value( name string ) (string, error) {
+    base := filepath.Base( tc.path )
+    ext := filepath.Ext( base )
+    switch {
+    case name == "dir":
+        return filepath.Dir( tc.path ), nil
+    case name == "name":
+        return base, nil
+    case name == "basename":
+        return strings.TrimSuffix( base, ext ), nil
+    case name == "ext":
+        return strings.TrimPrefix( ext, "." ), nil
+    case name == "index":
+        return strconv.Itoa( tc.index ), nil
+    case strings.HasPrefix( name, "index:" ):
+        width, err := strconv.Atoi( name[6:] )
+        if err != nil || width < 1 || width > 12 {
+            return "", fmt.Errorf( "invalid index width in {%s}\n", name )
+        }
+        return fmt.Sprintf( "%0*d", width, tc.index ), nil
+    case strings.HasPrefix( name, "meta:" ):
+        tag, ok := metaTemplateTags[name[5:]]
+        if ! ok {
+            return "", fmt.Errorf( "unknown metadata field in {%s}\n", name )
+        }
+        if tc.tags == nil {
+            tc.tags = make( map[uint16]string )
+            if data, err := os.ReadFile( tc.path ); err == nil {
+                tc.tags = exifAsciiTags( data, scanLayout( data ) )
+            }
+        }
+        v := strings.TrimSpace( tc.tags[tag] )
+        if v == "" {
+            v = "unknown"
+        }
+        return sanitizeFileName( v ), nil
+    }
+    return "", fmt.Errorf( "unknown placeholder {%s}\n", name )
+}
+
+// expand returns the template t with all placeholders replaced
+func (tc *templateContext) expand( t string ) (string, error) {
+    var b strings.Builder
+    for {
+        start := strings.IndexByte( t, '{' )
+        if start == -1 {
+            b.WriteString( t )
+            return b.String(), nil
+        }
+        end := strings.IndexByte( t[start:], '}' )
+        if end == -1 {
+            return "", fmt.Errorf( "unterminated placeholder in %s\n", t )
+        }
+        v, err := tc.value( t[start+1:start+end] )
+        if err != nil {
+            return "", err
+        }
+        b.WriteString( t[:start] )
+        b.WriteString( v )
+        t = t[start+end+1:]
+    }
+}
+
+// validateTemplate checks the placeholders of t without any file
+func validateTemplate( t string ) error {
+    tc := &templateContext{ path: "x.jpg", index: 1,
+                            tags: make( map[uint16]string ) }
+    _, err := tc.expand( t )
+    return err
+}
+
+// templatePath expands an output path template for the file at path, sanitize
+// its file name if requested and creates its directory if needed. Paths
+// without placeholders are returned unchanged.
+func (tc *templateContext) templatePath( t string, sanitize bool ) (string,
+                                                                  error) {
+    if ! hasTemplate( t ) {
+        return t, nil
+    }
+    p, err := tc.expand( t )
+    if err != nil {
+        return "", err
+    }
+    p = outputPath( p, sanitize )
+    if dir := filepath.Dir( p ); dir != "." {
+        if err = os.MkdirAll( dir, 0755 ); err != nil {
+            return "", fmt.Errorf( "unable to create directory %s: %v\n",
+                                   dir, err )
+        }
+    }
+    return p, nil
+}
+
+// forFile returns the options to use for the file at path, at position index
+// in the batch, with all output path templates expanded.
+func (process *jpgArgs) forFile( path string, index int ) (*jpgArgs, error) {
+    if ! process.templates {
+        return process, nil
+    }
+    tc := &templateContext{ path: path, index: index }
+    p := *process
+    var err error
+    expand := func( t string ) string {
+        if err != nil {
+            return ""
+        }
+        var v string
+        v, err = tc.templatePath( t, process.sanitize )
+        return v
+    }
+    p.output = expand( p.output )
+    p.sPicture.path = expand( p.sPicture.path )
+    p.qerr = expand( p.qerr )
+    p.spliceCheck = expand( p.spliceCheck )
+    p.metaJson = expand( p.metaJson )
+    p.dumpMeta = expand( p.dumpMeta )
+    p.sC2pa = expand( p.sC2pa )
+    p.sIcc = expand( p.sIcc )
+    p.sDepth = expand( p.sDepth )
+    p.sChroma = expand( p.sChroma )
+    p.sQuant = expand( p.sQuant )
+    p.sHuff = expand( p.sHuff )
+    p.suggest = expand( p.suggest )
+    p.undo = expand( p.undo )
+    p.svActions = append( []jpeg.ThumbSpec{ }, process.svActions... )
+    for i := range p.svActions {
+        p.svActions[i].Path = expand( p.svActions[i].Path )
+    }
+    p.svEmbedded = append( []embeddedSpec{ }, process.svEmbedded... )
+    for i := range p.svEmbedded {
+        p.svEmbedded[i].path = expand( p.svEmbedded[i].path )
+    }
+    p.sJumbf = append( []embeddedSpec{ }, process.sJumbf... )
+    for i := range p.sJumbf {
+        p.sJumbf[i].path = expand( p.sJumbf[i].path )
+    }
+    p.sScan = append( []scanSpec{ }, process.sScan... )
+    for i := range p.sScan {
+        p.sScan[i].path = expand( p.sScan[i].path )
+    }
+    p.derivatives = append( []derivativeSpec{ }, process.derivatives... )
+    for i := range p.derivatives {
+        p.derivatives[i].Path = expand( p.derivatives[i].Path )
+    }
+    if err != nil {
+        return nil, fmt.Errorf( "output path template: %v", err )
+    }
+    return &p, nil
+}
@@ -0,0 +1,609 @@
+
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "math"
+    "os"
+    "path/filepath"
+)
+
+// Test set generator (jcheck gen-testset <dir>): a suite of small jpeg files
+// synthesized from scratch, covering the main features of the format and a
+// few broken variants, for use as test fixtures by jcheck and by anyone
+// testing a decoder. All files encode the same synthetic picture (gradients,
+// a disc and a checkerboard) at the same quality, so that decoders can be
+// compared. The coefficients are computed and entropy coded by jcheck itself
+// (see encoder.go and arithenc.go), and the files are decoded again to verify
+// that they hold the expected coefficients. A manifest, testset.json,
+// describes each file with its features and whether it is valid.
+
+const TESTSET_HELP =
+`jcheck gen-testset [-quality=<q>] <dir>
+
+    Generate a suite of small jpeg files covering baseline and progressive
+    Huffman coding, the common chroma subsamplings, restart markers, 12-bit
+    extended precision, arithmetic coding and broken variants, in <dir> (which
+    is created if needed), with a manifest testset.json describing each file.
+
+        -quality=<q>        IJG quality of the quantization tables (default 75)
+`
+
+const (
+    testsetWidth    = 48
+    testsetHeight   = 32
+)
+
+type testsetSpec struct {
+    name            string
+    description     string
+    marker          byte        // SOF marker
+    precision       int
+    width, height   int
+    sampling        [][2]int    // h, v for each component
+    restart         int         // restart interval in MCUs, 0 if none
+    conditioning    []byte      // DAC content, nil for the default
+    base            string      // for variants, name of the valid file
+    breaks          func( data []byte ) ([]byte, error) // for variants
+    valid           bool        // variant still valid, with a warning
+    pattern         picturePattern  // nil for testPattern
+    comment         string      // COM text, "" for the generator and name
+}
+
+// picturePattern returns the RGB color of a synthetic picture of size w x h at
+// x, y, with components from 0 to 1
+type picturePattern func( x, y, w, h int ) (r, g, b float64)
+
+type testsetEntry struct {
+    Name            string      `json:"name"`
+    Description     string      `json:"description"`
+    Valid           bool        `json:"valid"`
+    Frame           string      `json:"frame"`
+    Precision       int         `json:"precision"`
+    Width           int         `json:"width"`
+    Height          int         `json:"height"`
+    Sampling        string      `json:"sampling"`
+    Restart         int         `json:"restartInterval,omitempty"`
+}
+
+var (
+    sampling444     = [][2]int{ { 1, 1 }, { 1, 1 }, { 1, 1 } }
+    sampling422     = [][2]int{ { 2, 1 }, { 1, 1 }, { 1, 1 } }
+    sampling420     = [][2]int{ { 2, 2 }, { 1, 1 }, { 1, 1 } }
+    sampling440     = [][2]int{ { 1, 2 }, { 1, 1 }, { 1, 1 } }
+    sampling411     = [][2]int{ { 4, 1 }, { 1, 1 }, { 1, 1 } }
+    samplingGray    = [][2]int{ { 1, 1 } }
+)
+
+var testsetSpecs = []testsetSpec{
+    { name: "baseline-444.jpg", description: "baseline, 4:4:4",
+      marker: markerSOF0, precision: 8, sampling: sampling444 },
+    { name: "baseline-422.jpg", description: "baseline, 4:2:2",
+      marker: markerSOF0, precision: 8, sampling: sampling422 },
+    { name: "baseline-420.jpg", description: "baseline, 4:2:0",
+      marker: markerSOF0, precision: 8, sampling: sampling420 },
+    { name: "baseline-440.jpg", description: "baseline, 4:4:0",
+      marker: markerSOF0, precision: 8, sampling: sampling440 },
+    { name: "baseline-411.jpg", description: "baseline, 4:1:1",
+      marker: markerSOF0, precision: 8, sampling: sampling411 },
+    { name: "baseline-gray.jpg", description: "baseline, grayscale",
+      marker: markerSOF0, precision: 8, sampling: samplingGray },
+    { name: "baseline-odd-size.jpg",
+      description: "baseline, 4:2:0, dimensions not multiple of the MCU size",
+      marker: markerSOF0, precision: 8, width: 45, height: 29,
+      sampling: sampling420 },
+    { name: "restart-420.jpg",
+      description: "baseline, 4:2:0, restart interval of 2 MCUs",
+      marker: markerSOF0, precision: 8, sampling: sampling420, restart: 2 },
+    { name: "progressive-420.jpg",
+      description: "progressive, 4:2:0, spectral selection",
+      marker: markerSOF0 + 2, precision: 8, sampling: sampling420 },
+    { name: "progressive-restart-420.jpg",
+      description: "progressive, 4:2:0, spectral selection, restart " +
+                   "interval of 2 MCUs",
+      marker: markerSOF0 + 2, precision: 8, sampling: sampling420,
+      restart: 2 },
+    { name: "progressive-gray.jpg",
+      description: "progressive, grayscale, spectral selection",
+      marker: markerSOF0 + 2, precision: 8, sampling: samplingGray },
+    { name: "extended-12bit-gray.jpg",
+      description: "extended sequential, 12-bit, grayscale, 16-bit " +
+                   "quantization tables",
+      marker: markerSOF0 + 1, precision: 12, sampling: samplingGray },
+    { name: "extended-12bit-420.jpg",
+      description: "extended sequential, 12-bit, 4:2:0, 16-bit " +
+                   "quantization tables",
+      marker: markerSOF0 + 1, precision: 12, sampling: sampling420 },
+    { name: "arithmetic-420.jpg",
+      description: "arithmetic sequential, 4:2:0, default conditioning",
+      marker: markerSOF0 + 9, precision: 8, sampling: sampling420 },
+    { name: "arithmetic-restart-gray.jpg",
+      description: "arithmetic sequential, grayscale, restart interval of " +
+                   "3 MCUs",
+      marker: markerSOF0 + 9, precision: 8, sampling: samplingGray,
+      restart: 3 },
+    { name: "arithmetic-progressive-420.jpg",
+      description: "arithmetic progressive, 4:2:0, spectral selection",
+      marker: markerSOF0 + 10, precision: 8, sampling: sampling420 },
+    { name: "arithmetic-dac-420.jpg",
+      description: "arithmetic sequential, 4:2:0, DAC conditioning (L=1, " +
+                   "U=3 for DC, Kx=2 for AC)",
+      marker: markerSOF0 + 9, precision: 8, sampling: sampling420,
+      conditioning: []byte{ 0x00, 0x31, 0x01, 0x31, 0x10, 2, 0x11, 2 } },
+
+    { name: "trailing-data-420.jpg", base: "baseline-420.jpg",
+      description: "baseline, 4:2:0, data after the EOI marker (valid, " +
+                   "reported with a warning)", valid: true,
+      breaks: func( d []byte ) ([]byte, error) {
+          return append( d, []byte( "trailing data after EOI" )... ), nil
+      } },
+
+    { name: "broken-truncated.jpg", base: "baseline-420.jpg",
+      description: "truncated in the middle of the entropy-coded data",
+      breaks: func( d []byte ) ([]byte, error) {
+          s, err := testsetSegment( d, markerSOS )
+          if err != nil {
+              return nil, err
+          }
+          return d[:s.end() + ( s.ecsEnd - s.end() ) / 2], nil
+      } },
+    { name: "broken-no-eoi.jpg", base: "baseline-420.jpg",
+      description: "missing EOI marker",
+      breaks: func( d []byte ) ([]byte, error) {
+          return d[:len(d)-2], nil
+      } },
+    { name: "broken-bad-huffman.jpg", base: "baseline-420.jpg",
+      description: "invalid Huffman code (16 one bits) in the " +
+                   "entropy-coded data",
+      breaks: func( d []byte ) ([]byte, error) {
+          s, err := testsetSegment( d, markerSOS )
+          if err != nil {
+              return nil, err
+          }
+          p := s.end() + ( s.ecsEnd - s.end() ) / 2
+          var b bytes.Buffer
+          b.Write( d[:p] )
+          b.Write( []byte{ 0xff, 0x00, 0xff, 0x00, 0xff, 0x00 } )
+          b.Write( d[p+3:] )
+          return b.Bytes(), nil
+      } },
+    { name: "broken-missing-dht.jpg", base: "baseline-420.jpg",
+      description: "no Huffman table defined",
+      breaks: func( d []byte ) ([]byte, error) {
+          return testsetRemove( d, markerDHT ), nil
+      } },
+    { name: "broken-missing-dqt.jpg", base: "baseline-420.jpg",
+      description: "no quantization table defined",
+      breaks: func( d []byte ) ([]byte, error) {
+          return testsetRemove( d, markerDQT ), nil
+      } },
+    { name: "broken-bad-sof-length.jpg", base: "baseline-420.jpg",
+      description: "frame header length too large by 2",
+      breaks: func( d []byte ) ([]byte, error) {
+          s, err := testsetSegment( d, markerSOF0 )
+          if err != nil {
+              return nil, err
+          }
+          d[s.offset+3] += 2
+          return d, nil
+      } },
+    { name: "broken-bad-sampling.jpg", base: "baseline-420.jpg",
+      description: "horizontal sampling factor 0 for the second component",
+      breaks: func( d []byte ) ([]byte, error) {
+          s, err := testsetSegment( d, markerSOF0 )
+          if err != nil {
+              return nil, err
+          }
+          d[s.offset+4+6+3+1] &= 0x0f
+          return d, nil
+      } },
+    { name: "broken-restart-order.jpg", base: "restart-420.jpg",
+      description: "restart markers out of sequence (RST1 replaced by RST3)",
+      breaks: func( d []byte ) ([]byte, error) {
+          s, err := testsetSegment( d, markerRST0 + 1 )
+          if err != nil {
+              return nil, err
+          }
+          d[s.offset+1] = markerRST0 + 3
+          return d, nil
+      } },
+}
+
+// testsetSegment returns the first segment with marker in d
+func testsetSegment( d []byte, marker byte ) (*segment, error) {
+    l := scanLayout( d )
+    for i := range l.segments {
+        if l.segments[i].marker == marker {
+            return &l.segments[i], nil
+        }
+    }
+    return nil, fmt.Errorf( "no %s in generated file\n", markerName( marker ) )
+}
+
+// testsetRemove returns d without the segments with marker
+func testsetRemove( d []byte, marker byte ) []byte {
+    l := scanLayout( d )
+    var b bytes.Buffer
+    last := 0
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.marker == marker {
+            b.Write( d[last:s.offset] )
+            last = s.end()
+        }
+    }
+    b.Write( d[last:] )
+    return b.Bytes()
+}
+
+// testPattern returns the RGB color of the synthetic picture at x, y, with
+// components from 0 to 1
+func testPattern( x, y, w, h int ) (r, g, b float64) {
+    fx, fy := float64(x) / float64(w - 1), float64(y) / float64(h - 1)
+    r, g, b = fx, fy, 0.25
+    dx, dy := float64(x) - float64(w) * 0.6, float64(y) - float64(h) * 0.5
+    if dx * dx + dy * dy < float64(h * h) / 9 {
+        r, g, b = 0.9, 0.8, 0.1
+    }
+    if x < w / 4 && y < h / 2 && ( x / 4 + y / 4 ) % 2 == 0 {
+        r, g, b = 0.05, 0.05, 0.6
+    }
+    return
+}
+
+// componentSample returns the sample of component ci (0 for Y, 1 for Cb, 2
+// for Cr, or gray) at x, y in component coordinates, averaged over the
+// picture pixels it covers, from 0 to 1
+func componentSample( fh *frameHeader, pattern picturePattern,
+                      ci, x, y int ) float64 {
+    c := &fh.comps[ci]
+    sx, sy := fh.hMax / c.h, fh.vMax / c.v
+    var sum float64
+    n := 0
+    for py := y * sy; py < ( y + 1 ) * sy; py++ {
+        for px := x * sx; px < ( x + 1 ) * sx; px++ {
+            r, g, b := pattern( minInt( px, fh.width - 1 ),
+                                minInt( py, fh.height - 1 ),
+                                fh.width, fh.height )
+            switch ci {
+            case 0:
+                sum += 0.299 * r + 0.587 * g + 0.114 * b
+            case 1:
+                sum += -0.168736 * r - 0.331264 * g + 0.5 * b + 0.5
+            case 2:
+                sum += 0.5 * r - 0.418688 * g - 0.081312 * b + 0.5
+            }
+            n ++
+        }
+    }
+    return sum / float64(n)
+}
+
+// fillPattern sets the coefficients of img for the synthetic picture given by
+// pattern, quantized with tables in natural order. Samples beyond the
+// component dimensions repeat the last row or column.
+func (img *coefImage) fillPattern( pattern picturePattern,
+                                   tables [2][64]uint16 ) {
+    fh := img.frame
+    scale := float64(int(1) << fh.precision - 1)
+    shift := float64(int(1) << (fh.precision - 1))
+    for ci := range img.comps {
+        cc := &img.comps[ci]
+        c := &fh.comps[ci]
+        cw := ( fh.width * c.h + fh.hMax - 1 ) / fh.hMax
+        ch := ( fh.height * c.v + fh.vMax - 1 ) / fh.vMax
+        qt := &tables[c.tq]
+        var in, out [64]float64
+        for by := 0; by < cc.by; by++ {
+            for bx := 0; bx < cc.bx; bx++ {
+                for y := 0; y < 8; y++ {
+                    for x := 0; x < 8; x++ {
+                        v := componentSample( fh, pattern, ci,
+                                              minInt( bx * 8 + x, cw - 1 ),
+                                              minInt( by * 8 + y, ch - 1 ) )
+                        in[y*8+x] = math.Round( v * scale ) - shift
+                    }
+                }
+                portableFdct( &in, &out )
+                b := cc.at( bx, by )
+                for k := range b {
+                    b[k] = int32( math.Round( out[k] / float64(qt[k]) ) )
+                }
+            }
+        }
+    }
+}
+
+// flatHuffTable returns a DHT segment content defining a table in which all
+// symbols for the given precision have codes of the same length, for 12-bit
+// frames not covered by the tables of Annex K.
+func flatHuffTable( class, destination int, precision int ) []byte {
+    var symbols []byte
+    length := 5
+    if class == 0 {
+        for s := 0; s <= precision + 3; s++ {
+            symbols = append( symbols, byte(s) )
+        }
+    } else {
+        symbols = append( symbols, 0x00, 0xf0 )
+        for r := 0; r < 16; r++ {
+            for s := 1; s <= precision + 2; s++ {
+                symbols = append( symbols, byte( r << 4 | s ) )
+            }
+        }
+        length = 8
+    }
+    content := make( []byte, 17 )
+    content[0] = byte( class << 4 | destination )
+    content[length] = byte( len(symbols) )
+    return append( content, symbols... )
+}
+
+func segmentBytesOf( marker byte, content []byte ) []byte {
+    n := len(content) + 2
+    return append( []byte{ 0xff, marker, byte( n >> 8 ), byte(n) }, content... )
+}
+
+// generateTestFile returns the jpeg data of the valid file described by spec,
+// with its coefficients.
+func generateTestFile( spec *testsetSpec, quality int ) ([]byte, *coefImage,
+                                                         error) {
+    width, height := spec.width, spec.height
+    if width == 0 {
+        width, height = testsetWidth, testsetHeight
+    }
+    var out bytes.Buffer
+    out.Write( []byte{ 0xff, markerSOI } )
+    if spec.precision == 8 {
+        out.Write( segmentBytesOf( markerAPP0, []byte{ 'J', 'F', 'I', 'F', 0,
+                                        1, 2, 0, 0, 1, 0, 1, 0, 0 } ) )
+    }
+    comment := spec.comment
+    if comment == "" {
+        comment = "jcheck gen-testset " + spec.name
+    }
+    out.Write( segmentBytesOf( markerCOM, []byte( comment ) ) )
+    nTables := 1
+    if len(spec.sampling) > 1 {
+        nTables = 2
+    }
+    var tables [2][64]uint16
+    for t := 0; t < nTables; t++ {
+        std := &standardLuminanceQuant
+        if t == 1 {
+            std = &standardChrominanceQuant
+        }
+        q := scaledQuant( std, quality )
+        content := []byte{ byte(t) }
+        if spec.precision == 12 {
+            content[0] |= 0x10          // 16-bit values, 4 times larger
+        }
+        for k := 0; k < 64; k++ {
+            v := uint16( q[zigZag[k]] )
+            if spec.precision == 12 {
+                v *= 4
+                content = append( content, byte( v >> 8 ) )
+            }
+            content = append( content, byte(v) )
+            tables[t][zigZag[k]] = v
+        }
+        out.Write( segmentBytesOf( markerDQT, content ) )
+    }
+    sof := []byte{ byte(spec.precision), byte( height >> 8 ), byte(height),
+                   byte( width >> 8 ), byte(width), byte( len(spec.sampling) ) }
+    for i, hv := range spec.sampling {
+        sof = append( sof, byte( i + 1 ), byte( hv[0] << 4 | hv[1] ),
+                      byte( minInt( i, 1 ) ) )
+    }
+    sofSegment := segmentBytesOf( spec.marker, sof )
+    fh, err := parseFrameHeader( &segment{ marker: spec.marker,
+                                           length: len(sof) + 2 }, sofSegment )
+    if err != nil {
+        return nil, nil, err
+    }
+    out.Write( sofSegment )
+    img := newCoefImage( fh )
+    pattern := spec.pattern
+    if pattern == nil {
+        pattern = testPattern
+    }
+    img.fillPattern( pattern, tables )
+
+    var ct codingTables
+    if ! isArithmetic( spec.marker ) {
+        for t := 0; t < nTables; t++ {
+            for class := 0; class < 2; class++ {
+                var content []byte
+                if spec.precision == 8 {
+                    k := &annexKHuffTables[2 * class + t]
+                    content = append( []byte{ byte( class << 4 | t ) },
+                                      k.counts[:]... )
+                    content = append( content, k.symbols... )
+                } else {
+                    content = flatHuffTable( class, t, spec.precision )
+                }
+                if err = ct.defineHuffman( content ); err != nil {
+                    return nil, nil, err
+                }
+                out.Write( segmentBytesOf( markerDHT, content ) )
+            }
+        }
+    }
+    if spec.restart > 0 {
+        ct.restart = spec.restart
+        out.Write( segmentBytesOf( markerDRI, []byte{ byte( spec.restart >> 8 ),
+                                                      byte( spec.restart ) } ) )
+    }
+    if spec.conditioning != nil {
+        if err = ct.defineConditioning( spec.conditioning ); err != nil {
+            return nil, nil, err
+        }
+        out.Write( segmentBytesOf( markerDAC, spec.conditioning ) )
+    }
+    // scans: component indexes, spectral selection
+    type scan struct {
+        comps       []int
+        ss, se      int
+    }
+    all := make( []int, len(spec.sampling) )
+    for i := range all {
+        all[i] = i
+    }
+    scans := []scan{ { all, 0, 63 } }
+    if spec.marker == markerSOF0 + 2 || spec.marker == markerSOF0 + 10 {
+        scans = []scan{ { all, 0, 0 } }
+        for _, ci := range all {
+            scans = append( scans, scan{ []int{ ci }, 1, 5 },
+                            scan{ []int{ ci }, 6, 63 } )
+        }
+    }
+    for _, sc := range scans {
+        sos := []byte{ byte( len(sc.comps) ) }
+        for _, ci := range sc.comps {
+            t := byte( minInt( ci, 1 ) )
+            sos = append( sos, byte( ci + 1 ), t << 4 | t )
+        }
+        sos = append( sos, byte(sc.ss), byte(sc.se), 0 )
+        out.Write( segmentBytesOf( markerSOS, sos ) )
+        if isArithmetic( spec.marker ) {
+            err = img.encodeArithmeticScan( &out, sos, &ct )
+        } else {
+            err = img.encodeScan( &out, sos, &ct )
+        }
+        if err != nil {
+            return nil, nil, err
+        }
+    }
+    out.Write( []byte{ 0xff, markerEOI } )
+    return out.Bytes(), img, nil
+}
+
+// verifyTestFile decodes the coefficients of a generated file and checks that
+// they are those of img
+func verifyTestFile( data []byte, img *coefImage ) error {
+    check, err := decodeCoefficients( data, scanLayout( data ) )
+    if err != nil {
+        return err
+    }
+    if len(check.issues) > 0 {
+        return fmt.Errorf( "%s\n", check.issues[0] )
+    }
+    for ci := range img.comps {
+        for i := range img.comps[ci].blocks {
+            if check.comps[ci].blocks[i] != img.comps[ci].blocks[i] {
+                return fmt.Errorf( "block %d of component %d is not coded " +
+                                   "as expected\n", i, ci )
+            }
+        }
+    }
+    return nil
+}
+
+func samplingName( sampling [][2]int ) string {
+    name := ""
+    for i, hv := range sampling {
+        if i > 0 {
+            name += ","
+        }
+        name += fmt.Sprintf( "%dx%d", hv[0], hv[1] )
+    }
+    return name
+}
+
+func genTestset( args []string ) int {
+    flags := flag.NewFlagSet( "gen-testset", flag.ContinueOnError )
+    flags.Usage = func( ) {
+        fmt.Fprintf( flags.Output(), TESTSET_HELP )
+    }
+    quality := flags.Int( "quality", 75, "IJG quality of quantization tables" )
+    if err := flags.Parse( args ); err != nil {
+        return 2
+    }
+    if flags.NArg() != 1 || *quality < 1 || *quality > 100 {
+        flags.Usage()
+        return 2
+    }
+    dir := flags.Arg( 0 )
+    if err := os.MkdirAll( dir, 0755 ); err != nil {
+        fmt.Printf( "jpegcheck: gen-testset: %v\n", err )
+        return 1
+    }
+    generated := make( map[string][]byte )
+    var manifest []testsetEntry
+    for i := range testsetSpecs {
+        spec := &testsetSpecs[i]
+        var data []byte
+        if spec.breaks != nil {
+            base := testsetSpecs[0]
+            for _, s := range testsetSpecs {
+                if s.name == spec.base {
+                    base = s
+                }
+            }
+            var err error
+            data, err = spec.breaks( append( []byte( nil ),
+                                             generated[spec.base]... ) )
+            if err != nil {
+                fmt.Printf( "jpegcheck: gen-testset: %s: %v", spec.name, err )
+                return 1
+            }
+            spec.marker, spec.precision = base.marker, base.precision
+            spec.sampling, spec.restart = base.sampling, base.restart
+            spec.width, spec.height = base.width, base.height
+        } else {
+            var img *coefImage
+            var err error
+            data, img, err = generateTestFile( spec, *quality )
+            if err == nil {
+                err = verifyTestFile( data, img )
+            }
+            if err != nil {
+                fmt.Printf( "jpegcheck: gen-testset: %s: %v", spec.name, err )
+                return 1
+            }
+            generated[spec.name] = data
+        }
+        path := filepath.Join( dir, spec.name )
+        if err := os.WriteFile( path, data, 0644 ); err != nil {
+            fmt.Printf( "jpegcheck: gen-testset: %v\n", err )
+            return 1
+        }
+        width, height := spec.width, spec.height
+        if width == 0 {
+            width, height = testsetWidth, testsetHeight
+        }
+        manifest = append( manifest, testsetEntry{ Name: spec.name,
+                                Description: spec.description,
+                                Valid: spec.breaks == nil || spec.valid,
+                                Frame: markerName( spec.marker ),
+                                Precision: spec.precision,
+                                Width: width, Height: height,
+                                Sampling: samplingName( spec.sampling ),
+                                Restart: spec.restart } )
+    }
+    var b bytes.Buffer
+    enc := json.NewEncoder( &b )
+    enc.SetIndent( "", "  " )
+    if err := enc.Encode( manifest ); err != nil {
+        fmt.Printf( "jpegcheck: gen-testset: %v\n", err )
+        return 1
+    }
+    if err := os.WriteFile( filepath.Join( dir, "testset.json" ), b.Bytes(),
+                            0644 ); err != nil {
+        fmt.Printf( "jpegcheck: gen-testset: %v\n", err )
+        return 1
+    }
+    fmt.Printf( "jpegcheck: %d files written in %s with testset.json\n",
+                len(manifest), dir )
+    return 0
+}
+
+func minInt( a, b int ) int {
+    if a < b {
+        return a
+    }
+    return b
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// parseCheckerArgs returns the arguments of jcheck parsed from args, as given
+// on the command line, or the error returned by getArgs
+func parseCheckerArgs( args ...string ) (*jpgArgs, error) {
+    osArgs, commandLine := os.Args, flag.CommandLine
+    defer func( ) {
+        os.Args, flag.CommandLine = osArgs, commandLine
+    }()
+    os.Args = append( []string{ "jpegcheck" }, args... )
+    flag.CommandLine = flag.NewFlagSet( "jpegcheck", flag.ContinueOnError )
+    return getArgs()
+}
+
+// checkerArgs returns the arguments of jcheck parsed from args, as given on
+// the command line
+func checkerArgs( t *testing.T, args ...string ) *jpgArgs {
+    t.Helper()
+    process, err := parseCheckerArgs( args... )
+    if err != nil {
+        t.Fatalf( "%v: %v", args, err )
+    }
+    return process
+}
+
+// TestTestsetManifest checks each file of the generated test set as jcheck
+// does by default, and compares the outcome with its validity in the manifest
+func TestTestsetManifest( t *testing.T ) {
+    dir := t.TempDir()
+    if genTestset( []string{ dir } ) != 0 {
+        t.Fatalf( "test set not generated" )
+    }
+    b, err := os.ReadFile( filepath.Join( dir, "testset.json" ) )
+    if err != nil {
+        t.Fatal( err )
+    }
+    var manifest []testsetEntry
+    if err = json.Unmarshal( b, &manifest ); err != nil {
+        t.Fatal( err )
+    }
+    if len(manifest) != len(testsetSpecs) {
+        t.Fatalf( "%d files in manifest, expected %d", len(manifest),
+                  len(testsetSpecs) )
+    }
+    for _, e := range manifest {
+        t.Run( e.Name, func( t *testing.T ) {
+            path := filepath.Join( dir, e.Name )
+            failed := processBatch( checkerArgs( t, "-q", path ) ) > 0
+            if failed == e.Valid {
+                t.Errorf( "valid %t in manifest, but check failed %t",
+                          e.Valid, failed )
+            }
+        } )
+    }
+}
+
+func TestTrailingDataWarning( t *testing.T ) {
+    data := testsetData( t, "baseline-420.jpg" )
+    data = append( data, "trailing"... )
+    rep := &fileReport{ }
+    formatTrailingData( scanLayout( data ), rep )
+    if len(rep.messages) != 1 || rep.messages[0].code != codeTrailingData ||
+       rep.messages[0].severity != warningSeverity {
+        t.Errorf( "trailing data not reported as a warning: %v", rep.messages )
+    }
+}
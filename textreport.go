@@ -0,0 +1,63 @@
+
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "os"
+)
+
+// Text report: the outcome of each file on one line, followed by its messages
+// indented with their severity, in a file that stays readable when the
+// console output of a long batch is not kept.
+
+type textReport struct {
+    f               *os.File
+    w               *bufio.Writer
+}
+
+func newTextReport( path string, process *jpgArgs ) (*textReport, error) {
+    f, err := os.OpenFile( path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644 )
+    if err != nil {
+        return nil, fmt.Errorf( "unable to create text report %s: %v\n",
+                                path, err )
+    }
+    tr := &textReport{ f: f, w: bufio.NewWriter( f ) }
+    fmt.Fprintf( tr.w, "jcheck %s report\n", VERSION )
+    if now, ok := process.outputTime(); ok {
+        fmt.Fprintf( tr.w, "date: %s\n", now.Format( "2006-01-02 15:04:05" ) )
+    }
+    return tr, nil
+}
+
+func (tr *textReport) name( ) string {
+    return "text report"
+}
+
+func (tr *textReport) add( rep *fileReport ) error {
+    fmt.Fprintf( tr.w, "\n%d %s: %s (%d bytes)\n", rep.index, rep.path,
+                 xmlStatus( rep ), rep.size )
+    for _, m := range rep.messages {
+        where := ""
+        if m.frame >= 0 {
+            where = fmt.Sprintf( " frame %d", m.frame )
+        }
+        if m.offset >= 0 {
+            where += fmt.Sprintf( " @0x%x", m.offset )
+        }
+        fmt.Fprintf( tr.w, "  [%s]%s %s\n", m.severity, where, m.text )
+    }
+    if rep.output != "" {
+        fmt.Fprintf( tr.w, "  output %s (%d bytes)\n", rep.output,
+                     rep.outputSize )
+    }
+    return nil
+}
+
+func (tr *textReport) close( ) error {
+    if err := tr.w.Flush(); err != nil {
+        tr.f.Close()
+        return err
+    }
+    return tr.f.Close()
+}
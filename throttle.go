@@ -0,0 +1,165 @@
+
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "os"
+    "sync"
+    "time"
+)
+
+// Output throttling (-max-write-mbps, -max-open-files): when a batch writes
+// many outputs to a network share, writes are limited to a maximum rate and
+// the number of files open at the same time by the pipeline (files read in
+// advance, input files and written outputs) is limited. All outputs are
+// written through writeFile or a throttled writer, which waits before writing
+// once the rate is exceeded: as the check stage is then delayed, the read
+// stage stops reading ahead (see pipeline.go), so that no more memory or file
+// handles are used while waiting. Copies written by the jpeg library (-o) are
+// accounted for once written, waiting until they are within the rate. Report
+// sinks, which stay open during the whole batch, are not counted.
+
+const throttleChunk = 256 << 10         // bytes written at once when throttled
+
+type ioThrottle struct {
+    rate            float64         // bytes per second, 0 if unlimited
+    slots           chan struct{}   // open files, nil if unlimited
+    mu              sync.Mutex
+    next            time.Time       // when the next write may start
+}
+
+// throttle is shared by all stages of the pipeline
+var throttle = &ioThrottle{ }
+
+// setThrottle sets the maximum write rate in megabytes per second and the
+// maximum number of open files, 0 meaning unlimited
+func setThrottle( mbps float64, files int ) error {
+    if mbps < 0 {
+        return fmt.Errorf( "invalid write rate %g (MB/s)\n", mbps )
+    }
+    if files < 0 {
+        return fmt.Errorf( "invalid number of open files %d\n", files )
+    }
+    throttle = &ioThrottle{ rate: mbps * 1000000 }
+    if files > 0 {
+        throttle.slots = make( chan struct{}, files )
+    }
+    return nil
+}
+
+// open waits until a file can be opened; close must be called when it is
+// closed
+func (t *ioThrottle) open( ) {
+    if t.slots != nil {
+        t.slots <- struct{}{}
+    }
+}
+
+func (t *ioThrottle) close( ) {
+    if t.slots != nil {
+        <-t.slots
+    }
+}
+
+// reserve reserves the time needed to write n bytes at the maximum rate,
+// after the previous reservations, and returns when it starts and ends
+func (t *ioThrottle) reserve( n int ) (start, end time.Time) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    now := time.Now()
+    if t.next.Before( now ) {
+        t.next = now
+    }
+    start = t.next
+    t.next = t.next.Add( time.Duration( float64(n) / t.rate *
+                                        float64(time.Second) ) )
+    return start, t.next
+}
+
+// wait waits until n bytes can be written without exceeding the rate
+func (t *ioThrottle) wait( n int ) {
+    if t.rate == 0 || n == 0 {
+        return
+    }
+    start, _ := t.reserve( n )
+    time.Sleep( time.Until( start ) )
+}
+
+// account records n bytes already written by other means and waits until
+// they are within the rate
+func (t *ioThrottle) account( n int ) {
+    if t.rate == 0 || n == 0 {
+        return
+    }
+    _, end := t.reserve( n )
+    time.Sleep( time.Until( end ) )
+}
+
+type throttledWriter struct {
+    w               io.Writer
+}
+
+func (tw throttledWriter) Write( p []byte ) (n int, err error) {
+    for len(p) > 0 {
+        c := len(p)
+        if c > throttleChunk {
+            c = throttleChunk
+        }
+        throttle.wait( c )
+        var m int
+        m, err = tw.w.Write( p[:c] )
+        n += m
+        if err != nil {
+            return
+        }
+        p = p[c:]
+    }
+    return
+}
+
+// writeFile writes data to the file at path as os.WriteFile, within the
+// limits of the throttle
+func writeFile( path string, data []byte, perm os.FileMode ) error {
+    throttle.open()
+    defer throttle.close()
+    f, err := os.OpenFile( path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm )
+    if err != nil {
+        return err
+    }
+    _, err = throttledWriter{ f }.Write( data )
+    if cerr := f.Close(); err == nil {
+        err = cerr
+    }
+    return err
+}
+
+// readFile reads the file at path as os.ReadFile, within the limit of open
+// files
+func readFile( path string ) ([]byte, error) {
+    throttle.open()
+    defer throttle.close()
+    return os.ReadFile( path )
+}
+
+// createFile creates the file at path for writing through a buffered and
+// throttled writer. The returned function flushes the writer, closes the file
+// and releases it.
+func createFile( path string ) (*bufio.Writer, func( ) error, error) {
+    throttle.open()
+    f, err := os.Create( path )
+    if err != nil {
+        throttle.close()
+        return nil, nil, err
+    }
+    w := bufio.NewWriter( throttledWriter{ f } )
+    return w, func( ) error {
+        defer throttle.close()
+        err := w.Flush()
+        if cerr := f.Close(); err == nil {
+            err = cerr
+        }
+        return err
+    }, nil
+}
@@ -0,0 +1,523 @@
+
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "image"
+    stdjpeg "image/jpeg"
+    "math"
+    "os"
+    "strings"
+)
+
+// Thumbnail privacy (-thumb-privacy): editors that crop or redact a picture
+// often rewrite the main image but keep the embedded thumbnails and previews,
+// which then still show the original content. Each embedded rendition is
+// compared with the main picture resampled to the rendition size, both
+// stretched and letterboxed, on luminance: a rendition differing on average,
+// or locally in one tile (a redacted area), is reported as a warning.
+// With -thumbs=strip or -thumbs=regen, all embedded renditions of the copy
+// written with -o are removed, or regenerated from its main picture.
+
+const (
+    thumbMeanLimit      = 20.0  // mean absolute luminance difference
+    thumbTileLimit      = 60.0  // mean absolute difference in a tile
+    thumbTiles          = 8     // tiles per side, at most
+    thumbAspectLimit    = 0.05  // relative aspect ratio difference
+    thumbQuality        = 85    // regenerated jpeg thumbnails
+)
+
+var thumbsModes = []string{ "strip", "regen" }
+
+// isThumbsMode returns true if mode is a valid -thumbs mode
+func isThumbsMode( mode string ) bool {
+    for _, m := range thumbsModes {
+        if m == mode {
+            return true
+        }
+    }
+    return false
+}
+
+// resample returns the area average of img in a w x h picture
+func resample( img image.Image, w, h int ) *image.RGBA {
+    b := img.Bounds()
+    sums := make( []uint64, 4 * w * h )
+    for y := b.Min.Y; y < b.Max.Y; y++ {
+        dy := ( y - b.Min.Y ) * h / b.Dy()
+        for x := b.Min.X; x < b.Max.X; x++ {
+            dx := ( x - b.Min.X ) * w / b.Dx()
+            r, g, bl, _ := img.At( x, y ).RGBA()
+            p := 4 * ( dy * w + dx )
+            sums[p] += uint64(r >> 8)
+            sums[p+1] += uint64(g >> 8)
+            sums[p+2] += uint64(bl >> 8)
+            sums[p+3] ++
+        }
+    }
+    res := image.NewRGBA( image.Rect( 0, 0, w, h ) )
+    for i := 0; i < w * h; i++ {
+        if n := sums[4*i+3]; n > 0 {
+            res.Pix[4*i] = uint8( ( sums[4*i] + n / 2 ) / n )
+            res.Pix[4*i+1] = uint8( ( sums[4*i+1] + n / 2 ) / n )
+            res.Pix[4*i+2] = uint8( ( sums[4*i+2] + n / 2 ) / n )
+        }
+        res.Pix[4*i+3] = 255
+    }
+    return res
+}
+
+// letterbox returns the rectangle taken by a picture of size pw x ph fitted
+// in a w x h picture, keeping its aspect ratio
+func letterbox( pw, ph, w, h int ) image.Rectangle {
+    fw, fh := w, h
+    if pw * h > ph * w {
+        fh = int( float64(w) * float64(ph) / float64(pw) + 0.5 )
+    } else {
+        fw = int( float64(h) * float64(pw) / float64(ph) + 0.5 )
+    }
+    if fw < 1 {
+        fw = 1
+    }
+    if fh < 1 {
+        fh = 1
+    }
+    x0, y0 := ( w - fw ) / 2, ( h - fh ) / 2
+    return image.Rect( x0, y0, x0 + fw, y0 + fh )
+}
+
+// aspectDiffers returns true if the aspect ratios of pw x ph and w x h
+// differ by more than thumbAspectLimit
+func aspectDiffers( pw, ph, w, h int ) bool {
+    a := float64(pw) * float64(h) / ( float64(ph) * float64(w) )
+    return math.Abs( a - 1 ) > thumbAspectLimit
+}
+
+// rendition returns the main picture resampled to w x h, letterboxed on black
+// if the aspect ratios differ, as a regenerated thumbnail
+func rendition( main image.Image, w, h int ) *image.RGBA {
+    b := main.Bounds()
+    if ! aspectDiffers( b.Dx(), b.Dy(), w, h ) {
+        return resample( main, w, h )
+    }
+    r := letterbox( b.Dx(), b.Dy(), w, h )
+    small := resample( main, r.Dx(), r.Dy() )
+    res := image.NewRGBA( image.Rect( 0, 0, w, h ) )
+    for i := 3; i < len(res.Pix); i += 4 {
+        res.Pix[i] = 255
+    }
+    for y := 0; y < r.Dy(); y++ {
+        copy( res.Pix[res.PixOffset( r.Min.X, r.Min.Y + y ):],
+              small.Pix[small.PixOffset( 0, y ):small.PixOffset( r.Dx(), y )] )
+    }
+    return res
+}
+
+func luma( r, g, b uint8 ) float64 {
+    return 0.299 * float64(r) + 0.587 * float64(g) + 0.114 * float64(b)
+}
+
+// lumaDifference returns the mean absolute luminance difference between the
+// pictures a and b of the same size, and the largest mean difference in a
+// tile
+func lumaDifference( a image.Image, b *image.RGBA ) (mean, tile float64) {
+    w, h := b.Rect.Dx(), b.Rect.Dy()
+    nx, ny := thumbTiles, thumbTiles
+    if w < nx {
+        nx = w
+    }
+    if h < ny {
+        ny = h
+    }
+    sums := make( []float64, nx * ny )
+    counts := make( []int, nx * ny )
+    ab := a.Bounds()
+    var total float64
+    for y := 0; y < h; y++ {
+        for x := 0; x < w; x++ {
+            r, g, bl, _ := a.At( ab.Min.X + x, ab.Min.Y + y ).RGBA()
+            p := b.PixOffset( x, y )
+            d := math.Abs( luma( uint8(r >> 8), uint8(g >> 8), uint8(bl >> 8) ) -
+                           luma( b.Pix[p], b.Pix[p+1], b.Pix[p+2] ) )
+            t := ( y * ny / h ) * nx + x * nx / w
+            sums[t] += d
+            counts[t] ++
+            total += d
+        }
+    }
+    for t := range sums {
+        if counts[t] > 0 && sums[t] / float64(counts[t]) > tile {
+            tile = sums[t] / float64(counts[t])
+        }
+    }
+    return total / float64(w * h), tile
+}
+
+type thumbComparison struct {
+    ei              *embeddedImage
+    mean, tile      float64
+    letterboxed     bool
+    err             error
+}
+
+func (tc *thumbComparison) mismatch( ) bool {
+    return tc.err == nil &&
+           ( tc.mean > thumbMeanLimit || tc.tile > thumbTileLimit )
+}
+
+// compareRendition compares an embedded rendition with the main picture,
+// stretched and letterboxed, keeping the closest match
+func compareRendition( main image.Image, ei *embeddedImage ) *thumbComparison {
+    tc := &thumbComparison{ ei: ei }
+    pic, err := ei.picture()
+    if err != nil {
+        tc.err = err
+        return tc
+    }
+    pb, mb := pic.Bounds(), main.Bounds()
+    w, h := pb.Dx(), pb.Dy()
+    if w == 0 || h == 0 {
+        tc.err = fmt.Errorf( "empty picture\n" )
+        return tc
+    }
+    tc.mean, tc.tile = lumaDifference( pic, resample( main, w, h ) )
+    if aspectDiffers( mb.Dx(), mb.Dy(), w, h ) {
+        mean, tile := lumaDifference( pic, rendition( main, w, h ) )
+        if mean < tc.mean {
+            tc.mean, tc.tile, tc.letterboxed = mean, tile, true
+        }
+    }
+    return tc
+}
+
+// isRendition returns true if an embedded image is a rendition of the main
+// picture: depth maps and the MPF primary image (the main picture) are not.
+func (ei *embeddedImage) isRendition( ) bool {
+    return ei.data != nil && ei.offset != 0 &&
+           ! strings.HasPrefix( ei.id, "depth" )
+}
+
+// formatThumbPrivacy compares all embedded renditions of the picture with the
+// main picture and reports those that differ as warnings
+func formatThumbPrivacy( data []byte, l *fileLayout, rep *fileReport ) {
+    var renditions []*embeddedImage
+    for _, ei := range findEmbeddedImages( data, l ) {
+        if ei.isRendition() {
+            renditions = append( renditions, ei )
+        }
+    }
+    if len(renditions) == 0 {
+        fmt.Printf( "Thumbnail privacy: no embedded rendition\n" )
+        return
+    }
+    main, err := stdjpeg.Decode( bytes.NewReader( data ) )
+    if err != nil {
+        fmt.Printf( "Thumbnail privacy: unable to decode the main picture: " +
+                    "%v\n", err )
+        rep.addMessage( infoSeverity, codeRendition,
+                        "thumbnail privacy not checked" )
+        return
+    }
+    fmt.Printf( "Thumbnail privacy: %d embedded rendition(s) compared with " +
+                "the main picture\n", len(renditions) )
+    var differ []string
+    for _, ei := range renditions {
+        tc := compareRendition( main, ei )
+        b := fmt.Sprintf( "  %-7s %-32s", ei.id, ei.source )
+        switch {
+        case tc.err != nil:
+            fmt.Printf( "%s not compared: %s\n", b,
+                        strings.TrimSpace( tc.err.Error() ) )
+            continue
+        case tc.mismatch():
+            fmt.Printf( "%s DIFFERS", b )
+            differ = append( differ, ei.id )
+        default:
+            fmt.Printf( "%s matches", b )
+        }
+        fit := ""
+        if tc.letterboxed {
+            fit = ", letterboxed"
+        }
+        fmt.Printf( " (mean difference %.1f, largest in a tile %.1f%s)\n",
+                    tc.mean, tc.tile, fit )
+    }
+    if len(differ) > 0 {
+        fmt.Printf( "  Embedded renditions %s may show content removed from " +
+                    "the main picture, use -thumbs=strip or -thumbs=regen\n",
+                    strings.Join( differ, ", " ) )
+        rep.addMessage( warningSeverity, codeRendition, fmt.Sprintf(
+                        "embedded rendition(s) %s differ from the main " +
+                        "picture", strings.Join( differ, ", " ) ) )
+    }
+}
+
+// encodeThumbnail returns the jpeg encoding of the main picture at size w x h
+func encodeThumbnail( main image.Image, w, h int ) ([]byte, error) {
+    var b bytes.Buffer
+    err := stdjpeg.Encode( &b, rendition( main, w, h ),
+                           &stdjpeg.Options{ Quality: thumbQuality } )
+    if err != nil {
+        return nil, fmt.Errorf( "unable to encode thumbnail: %v\n", err )
+    }
+    return b.Bytes(), nil
+}
+
+// rgbSamples returns the 8-bit RGB samples of the main picture at size w x h
+func rgbSamples( main image.Image, w, h int ) []byte {
+    pic := rendition( main, w, h )
+    samples := make( []byte, 0, 3 * w * h )
+    for i := 0; i < len(pic.Pix); i += 4 {
+        samples = append( samples, pic.Pix[i:i+3]... )
+    }
+    return samples
+}
+
+// exifRendition strips or regenerates the IFD1 thumbnail in the TIFF data of
+// an Exif segment. It returns the new TIFF data, or nil if there is no
+// thumbnail. A stripped thumbnail is unlinked from IFD0 and its bytes are
+// cleared, or cut if it ends the TIFF data. A regenerated jpeg thumbnail is
+// written in place of the old one if it ends the TIFF data, after it
+// otherwise.
+func exifRendition( tiff []byte, mode string, main image.Image,
+                    tiffStart int ) ([]byte, error) {
+    tiff = append( []byte( nil ), tiff... )
+    t, err := newTiffReader( tiff )
+    if err != nil {
+        return nil, nil
+    }
+    entries0, next, err := t.readIfd( t.first )
+    if err != nil || next == 0 {
+        return nil, nil
+    }
+    entries, _, err := t.readIfd( next )
+    if err != nil {
+        return nil, nil
+    }
+    if ei := tiffThumbnail( t, entries, tiffStart ); ei != nil {
+        var samples []byte
+        if mode == "regen" {
+            samples = rgbSamples( main, ei.width, ei.height )
+        }
+        var offsets, counts []uint32
+        for i := range entries {
+            switch entries[i].tag {
+            case tagStripOffsets:
+                offsets, _ = t.uint32Values( &entries[i] )
+            case tagStripByteCounts:
+                counts, _ = t.uint32Values( &entries[i] )
+            }
+        }
+        for i, o := range offsets {
+            strip := tiff[o:o+counts[i]]
+            n := copy( strip, samples )
+            samples = samples[n:]
+            for j := n; j < len(strip); j++ {
+                strip[j] = 0
+            }
+        }
+        if mode == "strip" {
+            t.order.PutUint32( tiff[int(t.first) + 2 + 12 * len(entries0):], 0 )
+        }
+        return tiff, nil
+    }
+
+    var offsetEntry, lengthEntry *ifdEntry
+    for i := range entries {
+        switch entries[i].tag {
+        case tagJPEGInterchangeFormat:
+            offsetEntry = &entries[i]
+        case tagJPEGInterchangeFormatLength:
+            lengthEntry = &entries[i]
+        }
+    }
+    if offsetEntry == nil || lengthEntry == nil {
+        return nil, nil
+    }
+    offset := int(t.uint32Value( offsetEntry ))
+    length := int(t.uint32Value( lengthEntry ))
+    if length == 0 || offset + length > len(tiff) {
+        return nil, nil
+    }
+    ei := &embeddedImage{ data: tiff[offset:offset+length] }
+    ei.setJpegInfo()
+    for i := offset; i < offset + length; i++ {
+        tiff[i] = 0
+    }
+    atEnd := offset + length == len(tiff)
+    if mode == "strip" {
+        t.order.PutUint32( tiff[int(t.first) + 2 + 12 * len(entries0):], 0 )
+        if atEnd {
+            tiff = tiff[:offset]
+        }
+        return tiff, nil
+    }
+    w, h := ei.width, ei.height
+    if w == 0 || h == 0 {
+        r := letterbox( main.Bounds().Dx(), main.Bounds().Dy(), 160, 160 )
+        w, h = r.Dx(), r.Dy()
+    }
+    thumb, err := encodeThumbnail( main, w, h )
+    if err != nil {
+        return nil, err
+    }
+    if ! atEnd {
+        offset = len(tiff)
+    }
+    for _, e := range []*ifdEntry{ offsetEntry, lengthEntry } {
+        v := offset
+        if e == lengthEntry {
+            v = len(thumb)
+        }
+        switch {
+        case e.typ == tiffLong:
+            t.order.PutUint32( e.value, uint32(v) )
+        case e.typ == tiffShort && v <= 0xffff:
+            t.order.PutUint16( e.value, uint16(v) )
+        default:
+            return nil, fmt.Errorf( "Exif thumbnail offset or length cannot " +
+                                    "be updated\n" )
+        }
+    }
+    return append( tiff[:offset], thumb... ), nil
+}
+
+// appendSegment appends an APPn segment with the given payload to b
+func appendSegment( b *bytes.Buffer, marker byte, payload []byte ) error {
+    if 2 + len(payload) > 0xffff {
+        return fmt.Errorf( "%s payload too large for a segment\n",
+                           markerName( marker ) )
+    }
+    b.Write( []byte{ 0xff, marker } )
+    binary.Write( b, binary.BigEndian, uint16(2 + len(payload)) )
+    b.Write( payload )
+    return nil
+}
+
+// rewriteRenditions strips or regenerates, according to mode, all embedded
+// renditions in the file at output: JFIF and JFXX thumbnails, the Exif
+// thumbnail, and MPF and FlashPix images, which are always removed since they
+// can be much larger than a thumbnail. It returns the changes made. Previews
+// in maker notes are not modified, which is reported as a change not made.
+func rewriteRenditions( output, mode string ) (changes []string, err error) {
+    data, err := os.ReadFile( output )
+    if err != nil {
+        return nil, fmt.Errorf( "thumbs: %v\n", err )
+    }
+    var main image.Image
+    if mode == "regen" {
+        if main, err = stdjpeg.Decode( bytes.NewReader( data ) ); err != nil {
+            return nil, fmt.Errorf( "thumbs: unable to decode the main " +
+                                    "picture: %v\n", err )
+        }
+    }
+    done := map[string]string{ "strip": "removed", "regen": "regenerated" }[mode]
+    l := scanLayout( data )
+    fpxr := len(fpxrImages( data, l )) > 0
+    var b bytes.Buffer
+    last, mpf := 0, false
+    for i := range l.segments {
+        s := &l.segments[i]
+        if s.marker == markerEOI {
+            break
+        }
+        if s.marker < markerAPP0 || s.marker > markerAPP0 + 2 {
+            continue
+        }
+        d := s.data( data )
+        var payload []byte      // new payload, nil if unchanged
+        drop := false
+        switch {
+        case s.marker == markerAPP0 && bytes.HasPrefix( d, []byte( "JFIF\x00" ) ):
+            if len(d) < 14 || int(d[12]) * int(d[13]) == 0 {
+                continue
+            }
+            payload = append( []byte( nil ), d[:12]... )
+            if mode == "strip" {
+                payload = append( payload, 0, 0 )
+            } else {
+                payload = append( payload, d[12], d[13] )
+                payload = append( payload, rgbSamples( main, int(d[12]),
+                                                       int(d[13]) )... )
+            }
+            changes = append( changes, "JFIF thumbnail " + done )
+        case s.marker == markerAPP0 && bytes.HasPrefix( d, []byte( "JFXX\x00" ) ):
+            images := jfifImages( data, s )
+            if mode == "strip" || len(images) == 0 || images[0].width == 0 {
+                drop = true
+                changes = append( changes, "JFXX thumbnail removed" )
+                break
+            }
+            ei := images[0]
+            payload = append( []byte( nil ), d[:5]... )
+            if d[5] == 0x10 {
+                thumb, err := encodeThumbnail( main, ei.width, ei.height )
+                if err != nil {
+                    return nil, fmt.Errorf( "thumbs: %v", err )
+                }
+                payload = append( append( payload, 0x10 ), thumb... )
+            } else {            // palette thumbnails are regenerated as RGB
+                payload = append( payload, 0x13, byte(ei.width),
+                                  byte(ei.height) )
+                payload = append( payload, rgbSamples( main, ei.width,
+                                                       ei.height )... )
+            }
+            changes = append( changes, "JFXX thumbnail " + done )
+        case s.marker == markerAPP0 + 1:
+            tiff := exifTiffData( d )
+            if tiff == nil {
+                continue
+            }
+            nt, err := exifRendition( tiff, mode, main,
+                                      s.offset + 4 + len(exifHeader) )
+            if err != nil {
+                return nil, fmt.Errorf( "thumbs: %v", err )
+            }
+            if nt == nil {
+                continue
+            }
+            payload = append( append( []byte( nil ), exifHeader... ), nt... )
+            changes = append( changes, "Exif thumbnail " + done )
+        case s.marker == markerAPP0 + 2 && bytes.HasPrefix( d, []byte( "MPF\x00" ) ):
+            drop, mpf = true, true
+            changes = append( changes, "MPF index removed" )
+        case fpxr && s.marker == markerAPP0 + 2 &&
+             bytes.HasPrefix( d, []byte( "FPXR\x00" ) ):
+            drop = true
+        default:
+            continue
+        }
+        b.Write( data[last:s.offset] )
+        last = s.end()
+        if ! drop {
+            if err = appendSegment( &b, s.marker, payload ); err != nil {
+                return nil, fmt.Errorf( "thumbs: %v", err )
+            }
+        }
+    }
+    if fpxr {
+        changes = append( changes, "FlashPix images removed" )
+    }
+    end := len(data)
+    if mpf && l.trailing.length > 0 {       // MPF images follow the EOI
+        end = l.trailing.offset
+        changes = append( changes, "MPF images removed" )
+    }
+    b.Write( data[last:end] )
+    for i := range l.segments {
+        if l.segments[i].marker == markerAPP0 + 1 &&
+           len(makerNoteImages( data, &l.segments[i] )) > 0 {
+            changes = append( changes, "maker note preview NOT modified, " +
+                              "remove the maker note with -rmeta=1:5" )
+        }
+    }
+    if len(changes) == 0 {
+        return []string{ "no embedded rendition" }, nil
+    }
+    if err = writeFile( output, b.Bytes(), 0644 ); err != nil {
+        return nil, fmt.Errorf( "thumbs: %v\n", err )
+    }
+    return changes, nil
+}
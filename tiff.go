@@ -0,0 +1,262 @@
+
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+)
+
+// Minimal TIFF structure reader, used to inspect the IFDs of an Exif APP1
+// segment independently of the library, for checks that must be done before
+// or beside the analysis.
+
+const (
+    tiffByte        = 1
+    tiffAscii       = 2
+    tiffShort       = 3
+    tiffLong        = 4
+    tiffRational    = 5
+    tiffSByte       = 6
+    tiffUndefined   = 7
+    tiffSShort      = 8
+    tiffSLong       = 9
+    tiffSRational   = 10
+    tiffFloat       = 11
+    tiffDouble      = 12
+    tiffIfd         = 13
+)
+
+var tiffTypeSizes = [...]int{ 0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8, 4 }
+
+const (
+    tagJPEGInterchangeFormat        = 0x0201
+    tagJPEGInterchangeFormatLength  = 0x0202
+    tagOrientation                  = 0x0112
+    tagSubIfds                      = 0x014a
+    tagExifIfd                      = 0x8769
+    tagGpsIfd                       = 0x8825
+    tagInteropIfd                   = 0xa005
+)
+
+var exifHeader = []byte( "Exif\x00\x00" )
+
+type tiffReader struct {
+    data            []byte      // from the TIFF header
+    order           binary.ByteOrder
+    first           uint32      // offset of IFD0
+}
+
+func newTiffReader( data []byte ) (*tiffReader, error) {
+    if len(data) < 8 {
+        return nil, fmt.Errorf( "TIFF header is too short\n" )
+    }
+    t := &tiffReader{ data: data }
+    switch {
+    case bytes.Equal( data[0:4], []byte{ 'I', 'I', 42, 0 } ):
+        t.order = binary.LittleEndian
+    case bytes.Equal( data[0:4], []byte{ 'M', 'M', 0, 42 } ):
+        t.order = binary.BigEndian
+    default:
+        return nil, fmt.Errorf( "invalid TIFF header\n" )
+    }
+    t.first = t.order.Uint32( data[4:8] )
+    return t, nil
+}
+
+type ifdEntry struct {
+    tag, typ        uint16
+    count           uint32
+    value           []byte      // raw value field (4 bytes)
+    position        int         // entry offset in TIFF data
+}
+
+// size returns the size of the entry values, or -1 if the type is unknown
+func (e *ifdEntry) size( ) int {
+    if int(e.typ) >= len(tiffTypeSizes) || e.typ == 0 {
+        return -1
+    }
+    return tiffTypeSizes[e.typ] * int(e.count)
+}
+
+// uint32Value returns the first value of an entry of type short or long
+func (t *tiffReader) uint32Value( e *ifdEntry ) uint32 {
+    switch e.typ {
+    case tiffShort, tiffSShort:
+        if v := paddedValue( e ); v != nil {
+            return uint32( t.order.Uint16( v ) )
+        }
+        return uint32( t.order.Uint16( e.value ) )
+    }
+    return t.order.Uint32( e.value )
+}
+
+// uint32Values returns all values of an entry of type short or long
+func (t *tiffReader) uint32Values( e *ifdEntry ) ([]uint32, error) {
+    if e.typ != tiffShort && e.typ != tiffLong {
+        return nil, fmt.Errorf( "tag 0x%04x is not short or long\n", e.tag )
+    }
+    v, err := t.valueData( e )
+    if err != nil {
+        return nil, err
+    }
+    values := make( []uint32, e.count )
+    for i := range values {
+        if e.typ == tiffShort {
+            values[i] = uint32( t.order.Uint16( v[2*i:] ) )
+        } else {
+            values[i] = t.order.Uint32( v[4*i:] )
+        }
+    }
+    return values, nil
+}
+
+// valueData returns the values of an entry, either in the entry itself or at
+// the offset given by the entry.
+func (t *tiffReader) valueData( e *ifdEntry ) ([]byte, error) {
+    size := e.size()
+    if size < 0 {
+        return nil, fmt.Errorf( "unknown type %d for tag 0x%04x\n", e.typ, e.tag )
+    }
+    if size <= 4 {
+        if v := paddedValue( e ); v != nil {
+            return v, nil
+        }
+        return e.value[:size], nil
+    }
+    offset := t.order.Uint32( e.value )
+    if uint64(offset) + uint64(size) > uint64(len(t.data)) {
+        return nil, fmt.Errorf( "tag 0x%04x values beyond end of data\n", e.tag )
+    }
+    return t.data[offset:offset+uint32(size)], nil
+}
+
+// readIfd returns the entries of the IFD at offset and the offset of the next
+// IFD in the chain (0 if none).
+func (t *tiffReader) readIfd( offset uint32 ) (entries []ifdEntry,
+                                                next uint32, err error) {
+    if uint64(offset) + 2 > uint64(len(t.data)) {
+        return nil, 0, fmt.Errorf( "IFD offset 0x%x beyond end of data\n", offset )
+    }
+    n := int( t.order.Uint16( t.data[offset:] ) )
+    start := int(offset) + 2
+    if start + n * 12 + 4 > len(t.data) {
+        if ! lenientQuirks[quirkIfdCount] || n < 2 ||
+           start + ( n - 1 ) * 12 + 4 > len(t.data) {
+            return nil, 0, fmt.Errorf( "IFD @0x%x with %d entries goes " +
+                                       "beyond end of data\n", offset, n )
+        }
+        quirkApplied( quirkIfdCount, "IFD @0x%x declares %d entries instead " +
+                      "of %d", offset, n, n - 1 )
+        n --
+    }
+    entries = make( []ifdEntry, n )
+    for i := 0; i < n; i++ {
+        p := start + i * 12
+        entries[i] = ifdEntry{ tag: t.order.Uint16( t.data[p:] ),
+                               typ: t.order.Uint16( t.data[p+2:] ),
+                               count: t.order.Uint32( t.data[p+4:] ),
+                               value: t.data[p+8:p+12], position: p }
+    }
+    next = t.order.Uint32( t.data[start + n * 12:] )
+    entries, next = t.fixIfdCount( offset, entries, next )
+    return
+}
+
+// exifTiffData returns the TIFF data embedded in an Exif APP1 segment content,
+// or nil if the content is not Exif.
+func exifTiffData( content []byte ) []byte {
+    if bytes.HasPrefix( content, exifHeader ) {
+        return content[len(exifHeader):]
+    }
+    return nil
+}
+
+// asciiValue returns the value of an entry of type ascii, without the
+// terminating NUL characters
+func (t *tiffReader) asciiValue( e *ifdEntry ) (string, error) {
+    if e.typ != tiffAscii {
+        return "", fmt.Errorf( "tag 0x%04x is not ascii\n", e.tag )
+    }
+    v, err := t.valueData( e )
+    if err != nil {
+        return "", err
+    }
+    return string( bytes.TrimRight( v, "\x00" ) ), nil
+}
+
+// exifAsciiTags returns the ascii values found in IFD0 and in the Exif IFD of
+// the first Exif APP1 segment in data, indexed by tag.
+func exifAsciiTags( data []byte, l *fileLayout ) map[uint16]string {
+    values := make( map[uint16]string )
+    for _, s := range l.segments {
+        if s.marker != markerAPP0 + 1 {
+            continue
+        }
+        tiff := exifTiffData( s.data( data ) )
+        if tiff == nil {
+            continue
+        }
+        t, err := newTiffReader( tiff )
+        if err != nil {
+            return values
+        }
+        ifds := []uint32{ t.first }
+        for i := 0; i < len(ifds) && i < 2; i++ {
+            entries, _, err := t.readIfd( ifds[i] )
+            if err != nil {
+                break
+            }
+            for j := range entries {
+                e := &entries[j]
+                if e.tag == tagExifIfd && i == 0 {
+                    ifds = append( ifds, t.uint32Value( e ) )
+                }
+                if v, err := t.asciiValue( e ); err == nil {
+                    values[e.tag] = v
+                }
+            }
+        }
+        break
+    }
+    return values
+}
+
+// exifOrientation returns the orientation (1 to 8) given in IFD0 of the first
+// Exif APP1 segment in data, or 1 if it is absent or invalid.
+func exifOrientation( data []byte, l *fileLayout ) int {
+    o, _ := exifOrientationTag( data, l )
+    return o
+}
+
+// exifOrientationTag returns the orientation given in IFD0 of the first Exif
+// APP1 segment in data and true, or 1 and false if it is absent or invalid.
+func exifOrientationTag( data []byte, l *fileLayout ) (int, bool) {
+    for _, s := range l.segments {
+        if s.marker != markerAPP0 + 1 {
+            continue
+        }
+        tiff := exifTiffData( s.data( data ) )
+        if tiff == nil {
+            continue
+        }
+        t, err := newTiffReader( tiff )
+        if err != nil {
+            return 1, false
+        }
+        entries, _, err := t.readIfd( t.first )
+        if err != nil {
+            return 1, false
+        }
+        for i := range entries {
+            e := &entries[i]
+            if e.tag == tagOrientation && e.typ == tiffShort {
+                if o := int( t.uint32Value( e ) ); o >= 1 && o <= 8 {
+                    return o, true
+                }
+            }
+        }
+        return 1, false
+    }
+    return 1, false
+}
@@ -0,0 +1,94 @@
+
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "image"
+    "image/color"
+    stdjpeg "image/jpeg"
+    "image/png"
+    "path/filepath"
+    "strings"
+)
+
+// Transcoding of extracted images: embedded images are saved as stored, or
+// as binary PPM files if uncompressed, unless the output path has the
+// extension .png or .webp, or a format is forced with -thumb-format so that a
+// gallery gets a uniform format whatever the embedded formats are. Transcoded
+// images are saved losslessly from their decoded samples.
+
+var transcodeFormats = []string{ "png", "webp" }
+
+// isTranscodeFormat returns true if format is a supported output format
+func isTranscodeFormat( format string ) bool {
+    for _, f := range transcodeFormats {
+        if f == format {
+            return true
+        }
+    }
+    return false
+}
+
+// outputFormat returns the format an image saved at path must be transcoded
+// to, or "" if the image must be saved as stored
+func outputFormat( path, forced string ) string {
+    if forced != "" {
+        return forced
+    }
+    ext := strings.ToLower( strings.TrimPrefix( filepath.Ext( path ), "." ) )
+    if isTranscodeFormat( ext ) {
+        return ext
+    }
+    return ""
+}
+
+// picture returns the decoded samples of an embedded image
+func (ei *embeddedImage) picture( ) (image.Image, error) {
+    switch ei.format {
+    case "RGB", "palette":
+        img := image.NewNRGBA( image.Rect( 0, 0, ei.width, ei.height ) )
+        samples, palette := ei.data, []byte( nil )
+        if ei.format == "palette" {
+            palette, samples = ei.data[:768], ei.data[768:]
+        }
+        for i := 0; i < ei.width * ei.height; i++ {
+            var rgb []byte
+            if palette != nil {
+                p := int(samples[i])
+                rgb = palette[3*p:3*p+3]
+            } else {
+                rgb = samples[3*i:3*i+3]
+            }
+            img.SetNRGBA( i % ei.width, i / ei.width,
+                          color.NRGBA{ rgb[0], rgb[1], rgb[2], 255 } )
+        }
+        return img, nil
+    case "PNG":
+        return png.Decode( bytes.NewReader( ei.data ) )
+    }
+    if strings.HasPrefix( ei.format, "JPEG" ) {
+        return stdjpeg.Decode( bytes.NewReader( ei.data ) )
+    }
+    return nil, fmt.Errorf( "cannot decode %s data\n", ei.format )
+}
+
+// transcode returns the embedded image encoded in format
+func (ei *embeddedImage) transcode( format string ) ([]byte, error) {
+    img, err := ei.picture()
+    if err != nil {
+        return nil, fmt.Errorf( "unable to decode embedded image %s: %v\n",
+                                ei.id, strings.TrimSpace( err.Error() ) )
+    }
+    switch format {
+    case "png":
+        var b bytes.Buffer
+        if err = png.Encode( &b, img ); err != nil {
+            return nil, fmt.Errorf( "unable to encode PNG: %v\n", err )
+        }
+        return b.Bytes(), nil
+    case "webp":
+        return encodeWebp( img )
+    }
+    return nil, fmt.Errorf( "unsupported output format %s\n", format )
+}
@@ -0,0 +1,398 @@
+
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/binary"
+    "flag"
+    "fmt"
+    "math"
+    "os"
+    "path/filepath"
+)
+
+// Undo patches (-undo=<path> and jcheck undo <patch> <file>): when a copy is
+// written with -o, a binary journal can be saved, which restores the original
+// file exactly from the modified copy. This allows mass edits that can be
+// reverted later without keeping a full backup of every file: the patch only
+// holds the original bytes of the regions that differ.
+//
+// Both files are cut into chunks (segments, entropy-coded data and any other
+// bytes), which are paired with a longest common subsequence, so that removed,
+// inserted or moved segments do not invalidate the rest of the file. Each run
+// of unpaired chunks gives a record, trimmed of the bytes common to both ends.
+//
+// The patch format is:
+//   "JCUNDO1\n"
+//   original size (8 bytes, big endian) and sha256 (32 bytes)
+//   modified size (8 bytes) and sha256 (32 bytes)
+//   number of records (4 bytes)
+//   records, in increasing offset order, made of the offset in the modified
+//   file (8 bytes), the number of bytes replaced in the modified file (8
+//   bytes), the number of original bytes (8 bytes) and the original bytes.
+
+const UNDO_HELP =
+`jcheck undo [-o=<path>] <patch> <file>
+
+    Restore the original file from <file>, a copy written with -o, and the
+    patch saved with -undo when the copy was written. The copy must not have
+    been modified since (same size and sha256). The original is written at
+    <path>, or replaces <file> if -o is not given. The restored file is
+    verified to be identical to the original (same size and sha256).
+
+        -o=<path>           path of the restored file
+`
+
+const (
+    undoMagic       = "JCUNDO1\n"
+    undoMaxPairs    = 1 << 22       // LCS matrix size limit
+)
+
+type undoRecord struct {
+    offset          int     // in modified file
+    length          int     // bytes replaced in modified file
+    original        []byte  // bytes restored
+}
+
+type undoPatch struct {
+    originalSize    int
+    originalSum     [sha256.Size]byte
+    modifiedSize    int
+    modifiedSum     [sha256.Size]byte
+    records         []undoRecord
+}
+
+// undoChunks cuts data into segments, entropy-coded data and other bytes
+func undoChunks( data []byte ) [][]byte {
+    var chunks [][]byte
+    last := 0
+    cut := func( end int ) {
+        if end > len(data) {
+            end = len(data)
+        }
+        if end > last {
+            chunks = append( chunks, data[last:end] )
+            last = end
+        }
+    }
+    l := scanLayout( data )
+    for i := range l.segments {
+        s := &l.segments[i]
+        cut( s.offset )
+        cut( s.end() )
+        cut( s.ecsEnd )
+    }
+    cut( len(data) )
+    return chunks
+}
+
+// pairChunks returns for each chunk of a the index of the chunk of b it is
+// paired with, or -1, according to the longest common subsequence of chunks.
+// Identical chunks at both ends are paired first, and the middle chunks are
+// left unpaired if they are too numerous.
+func pairChunks( a, b [][]byte ) []int {
+    pairs := make( []int, len(a) )
+    for i := range pairs {
+        pairs[i] = -1
+    }
+    start := 0
+    for start < len(a) && start < len(b) && bytes.Equal( a[start], b[start] ) {
+        pairs[start] = start
+        start ++
+    }
+    ea, eb := len(a), len(b)
+    for ea > start && eb > start && bytes.Equal( a[ea-1], b[eb-1] ) {
+        ea --
+        eb --
+        pairs[ea] = eb
+    }
+    n, m := ea - start, eb - start
+    if n == 0 || m == 0 || n * m > undoMaxPairs {
+        return pairs
+    }
+    ids := make( map[string]int )       // same id for identical chunks
+    id := func( c []byte ) int {
+        v, ok := ids[string(c)]
+        if ! ok {
+            v = len(ids)
+            ids[string(c)] = v
+        }
+        return v
+    }
+    ia, ib := make( []int, n ), make( []int, m )
+    for i := range ia {
+        ia[i] = id( a[start+i] )
+    }
+    for j := range ib {
+        ib[j] = id( b[start+j] )
+    }
+    lcs := make( []int32, (n+1) * (m+1) )  // suffix lengths
+    for i := n-1; i >= 0; i-- {
+        for j := m-1; j >= 0; j-- {
+            k := i * (m+1) + j
+            switch {
+            case ia[i] == ib[j]:
+                lcs[k] = lcs[k + m + 2] + 1
+            case lcs[k + m + 1] >= lcs[k + 1]:
+                lcs[k] = lcs[k + m + 1]
+            default:
+                lcs[k] = lcs[k + 1]
+            }
+        }
+    }
+    for i, j := 0, 0; i < n && j < m; {
+        k := i * (m+1) + j
+        switch {
+        case ia[i] == ib[j]:
+            pairs[start+i] = start + j
+            i ++
+            j ++
+        case lcs[k + m + 1] >= lcs[k + 1]:
+            i ++
+        default:
+            j ++
+        }
+    }
+    return pairs
+}
+
+// makeUndoPatch returns the patch restoring original from modified
+func makeUndoPatch( original, modified []byte ) *undoPatch {
+    p := &undoPatch{ originalSize: len(original),
+                     originalSum: sha256.Sum256( original ),
+                     modifiedSize: len(modified),
+                     modifiedSum: sha256.Sum256( modified ) }
+    oc, mc := undoChunks( original ), undoChunks( modified )
+    pairs := pairChunks( mc, oc )
+    var mOffsets, oOffsets []int        // chunk offsets, with the end
+    for o, i := 0, 0; i <= len(mc); i++ {
+        mOffsets = append( mOffsets, o )
+        if i < len(mc) {
+            o += len(mc[i])
+        }
+    }
+    for o, i := 0, 0; i <= len(oc); i++ {
+        oOffsets = append( oOffsets, o )
+        if i < len(oc) {
+            o += len(oc[i])
+        }
+    }
+    record := func( ms, me, ob, oe int ) {  // modified and original ranges
+        for ms < me && ob < oe && modified[ms] == original[ob] {
+            ms ++
+            ob ++
+        }
+        for me > ms && oe > ob && modified[me-1] == original[oe-1] {
+            me --
+            oe --
+        }
+        if ms == me && ob == oe {
+            return
+        }
+        p.records = append( p.records, undoRecord{ offset: ms,
+                            length: me - ms, original: original[ob:oe] } )
+    }
+    mi, oi := 0, 0                      // next unpaired chunks
+    for i := 0; i <= len(mc); i++ {
+        j := len(oc)
+        if i < len(mc) {
+            if j = pairs[i]; j < 0 {
+                continue
+            }
+        }
+        record( mOffsets[mi], mOffsets[i], oOffsets[oi], oOffsets[j] )
+        mi, oi = i + 1, j + 1
+    }
+    return p
+}
+
+func (p *undoPatch) bytes( ) []byte {
+    var b bytes.Buffer
+    put := func( v uint64 ) {
+        var buf [8]byte
+        binary.BigEndian.PutUint64( buf[:], v )
+        b.Write( buf[:] )
+    }
+    b.WriteString( undoMagic )
+    put( uint64(p.originalSize) )
+    b.Write( p.originalSum[:] )
+    put( uint64(p.modifiedSize) )
+    b.Write( p.modifiedSum[:] )
+    var n [4]byte
+    binary.BigEndian.PutUint32( n[:], uint32(len(p.records)) )
+    b.Write( n[:] )
+    for _, r := range p.records {
+        put( uint64(r.offset) )
+        put( uint64(r.length) )
+        put( uint64(len(r.original)) )
+        b.Write( r.original )
+    }
+    return b.Bytes()
+}
+
+// parseUndoPatch returns the patch in data
+func parseUndoPatch( data []byte ) (*undoPatch, error) {
+    if ! bytes.HasPrefix( data, []byte(undoMagic) ) {
+        return nil, fmt.Errorf( "not an undo patch\n" )
+    }
+    rem := data[len(undoMagic):]
+    header := 2 * ( 8 + sha256.Size ) + 4
+    if len(rem) < header {
+        return nil, fmt.Errorf( "truncated undo patch\n" )
+    }
+    get := func( ) int {            // length checked by caller
+        v := binary.BigEndian.Uint64( rem )
+        rem = rem[8:]
+        if v > math.MaxInt32 {
+            return -1
+        }
+        return int(v)
+    }
+    p := new( undoPatch )
+    p.originalSize = get()
+    copy( p.originalSum[:], rem )
+    rem = rem[sha256.Size:]
+    p.modifiedSize = get()
+    copy( p.modifiedSum[:], rem )
+    rem = rem[sha256.Size:]
+    if p.originalSize < 0 || p.modifiedSize < 0 {
+        return nil, fmt.Errorf( "invalid undo patch sizes\n" )
+    }
+    n := int(binary.BigEndian.Uint32( rem ))
+    rem = rem[4:]
+    end := 0
+    for i := 0; i < n; i++ {
+        if len(rem) < 24 {
+            return nil, fmt.Errorf( "truncated undo patch\n" )
+        }
+        var r undoRecord
+        r.offset, r.length = get(), get()
+        size := get()
+        if r.offset < end || r.length < 0 || size < 0 || len(rem) < size ||
+           r.offset + r.length > p.modifiedSize {
+            return nil, fmt.Errorf( "invalid undo record %d\n", i )
+        }
+        r.original, rem = rem[:size], rem[size:]
+        end = r.offset + r.length
+        p.records = append( p.records, r )
+    }
+    if len(rem) != 0 {
+        return nil, fmt.Errorf( "%d extra bytes after undo records\n",
+                                len(rem) )
+    }
+    return p, nil
+}
+
+// apply returns the original data restored from modified
+func (p *undoPatch) apply( modified []byte ) ([]byte, error) {
+    if len(modified) != p.modifiedSize ||
+       sha256.Sum256( modified ) != p.modifiedSum {
+        return nil, fmt.Errorf( "file does not match the patch (modified " +
+                                "since the patch was made?)\n" )
+    }
+    out := make( []byte, 0, p.originalSize )
+    last := 0
+    for _, r := range p.records {
+        out = append( out, modified[last:r.offset]... )
+        out = append( out, r.original... )
+        last = r.offset + r.length
+    }
+    out = append( out, modified[last:]... )
+    if len(out) != p.originalSize || sha256.Sum256( out ) != p.originalSum {
+        return nil, fmt.Errorf( "restored file does not match the original\n" )
+    }
+    return out, nil
+}
+
+// saveUndoPatch saves at undoPath the patch restoring the file at path from
+// its modified copy at output, and returns a description of the patch
+func saveUndoPatch( path, output, undoPath string ) (string, error) {
+    original, err := os.ReadFile( path )
+    if err != nil {
+        return "", err
+    }
+    modified, err := os.ReadFile( output )
+    if err != nil {
+        return "", err
+    }
+    p := makeUndoPatch( original, modified )
+    if _, err = p.apply( modified ); err != nil {  // should not happen
+        return "", fmt.Errorf( "undo: %v", err )
+    }
+    b := p.bytes()
+    if err = writeFile( undoPath, b, 0644 ); err != nil {
+        return "", err
+    }
+    restored := 0
+    for _, r := range p.records {
+        restored += len(r.original)
+    }
+    return fmt.Sprintf( "undo: patch of %d bytes saved as %s (%d records, %d " +
+                        "original bytes)", len(b), undoPath, len(p.records),
+                        restored ), nil
+}
+
+func undo( args []string ) int {
+    flags := flag.NewFlagSet( "undo", flag.ContinueOnError )
+    flags.Usage = func( ) {
+        fmt.Fprintf( flags.Output(), UNDO_HELP )
+    }
+    output := flags.String( "o", "", "path of the restored file" )
+    if err := flags.Parse( args ); err != nil {
+        return 2
+    }
+    var operands []string
+    for flags.NArg() > 0 {              // options may follow operands
+        operands = append( operands, flags.Arg( 0 ) )
+        if err := flags.Parse( flags.Args()[1:] ); err != nil {
+            return 2
+        }
+    }
+    if len(operands) != 2 {
+        flags.Usage()
+        return 2
+    }
+    patchPath, path := operands[0], operands[1]
+    if *output == "" {
+        *output = path
+    }
+    var p *undoPatch
+    data, err := os.ReadFile( patchPath )
+    if err == nil {
+        p, err = parseUndoPatch( data )
+    }
+    if err != nil {
+        fmt.Printf( "jpegcheck: undo: %s: %v", patchPath, err )
+        return 1
+    }
+    var original []byte
+    data, err = os.ReadFile( path )
+    if err == nil {
+        original, err = p.apply( data )
+    }
+    if err != nil {
+        fmt.Printf( "jpegcheck: undo: %s: %v", path, err )
+        return 1
+    }
+    tmp, err := os.CreateTemp( filepath.Dir( *output ), ".jcheck-undo-*" )
+    if err == nil {
+        _, err = tmp.Write( original )
+        if cerr := tmp.Close(); err == nil {
+            err = cerr
+        }
+        if err == nil {
+            err = os.Rename( tmp.Name(), *output )
+        }
+        if err != nil {
+            os.Remove( tmp.Name() )
+        }
+    }
+    if err != nil {
+        fmt.Printf( "jpegcheck: undo: %v\n", err )
+        return 1
+    }
+    fmt.Printf( "jpegcheck: %s restored as %s (%d bytes, %d records)\n",
+                path, *output, len(original), len(p.records) )
+    return 0
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+    "bytes"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestUndoPatch( t *testing.T ) {
+    original := []byte( "\xff\xd8 some segment, another segment \xff\xd9" )
+    tests := []struct {
+        name        string
+        modified    []byte
+    }{
+        { "same", original },
+        { "changed", bytes.Replace( original, []byte( "some" ),
+                                    []byte( "SOME" ), 1 ) },
+        { "removed", bytes.Replace( original, []byte( " another segment" ),
+                                    nil, 1 ) },
+        { "inserted", bytes.Replace( original, []byte( "," ),
+                                     []byte( ", inserted segment," ), 1 ) },
+        { "empty", []byte{ } },
+    }
+    for _, tc := range tests {
+        t.Run( tc.name, func( t *testing.T ) {
+            p, err := parseUndoPatch(
+                            makeUndoPatch( original, tc.modified ).bytes() )
+            if err != nil {
+                t.Fatal( err )
+            }
+            restored, err := p.apply( tc.modified )
+            if err != nil {
+                t.Fatal( err )
+            }
+            if ! bytes.Equal( restored, original ) {
+                t.Errorf( "restored %q, expected %q", restored, original )
+            }
+            other := append( append( []byte( nil ), tc.modified... ), 'x' )
+            if _, err = p.apply( other ); err == nil {
+                t.Errorf( "patch applied to another file" )
+            }
+        } )
+    }
+}
+
+// TestUndoRoundTrip checks that the patch saved with -undo restores the
+// original file from the copy written with -o
+func TestUndoRoundTrip( t *testing.T ) {
+    tests := []struct {
+        name    string
+        args    []string
+    }{
+        { "tidyup", []string{ "-tidyup" } },
+        { "strip-gps", []string{ "-strip-gps" } },
+        { "rmeta tags", []string{ "-rmeta=1:3:GPSLatitude" } },
+        { "setmeta", []string{ "-setmeta=Software=X,Artist=somebody" } },
+        { "sign", []string{ "-tidyup", "-sign=key" } },
+    }
+    data := withExif( testsetData( t, "baseline-420.jpg" ), gpsTiff() )
+    for _, tc := range tests {
+        t.Run( tc.name, func( t *testing.T ) {
+            dir := t.TempDir()
+            path := filepath.Join( dir, "in.jpg" )
+            key := filepath.Join( dir, "key" )
+            out := filepath.Join( dir, "out.jpg" )
+            patch := filepath.Join( dir, "out.undo" )
+            restored := filepath.Join( dir, "restored.jpg" )
+            if err := os.WriteFile( path, data, 0644 ); err != nil {
+                t.Fatal( err )
+            }
+            if err := os.WriteFile( key, []byte( "0123456789abcdef" ),
+                                    0600 ); err != nil {
+                t.Fatal( err )
+            }
+            args := []string{ "-q", "-o=" + out, "-undo=" + patch }
+            for _, a := range tc.args {
+                args = append( args, strings.Replace( a, "=key", "=" + key,
+                                                      1 ) )
+            }
+            if n := processBatch( checkerArgs( t, append( args,
+                                                  path )... ) ); n != 0 {
+                t.Fatalf( "%d files failed", n )
+            }
+            modified, err := os.ReadFile( out )
+            if err != nil {
+                t.Fatal( err )
+            }
+            if bytes.Equal( modified, data ) {
+                t.Fatalf( "copy is not modified" )
+            }
+            if undo( []string{ "-o=" + restored, patch, out } ) != 0 {
+                t.Fatalf( "undo failed" )
+            }
+            back, err := os.ReadFile( restored )
+            if err != nil {
+                t.Fatal( err )
+            }
+            if ! bytes.Equal( back, data ) {
+                t.Errorf( "restored file differs from the original" )
+            }
+            modified[len(modified)/2] ^= 0xff
+            if err = os.WriteFile( out, modified, 0644 ); err != nil {
+                t.Fatal( err )
+            }
+            if undo( []string{ "-o=" + restored, patch, out } ) == 0 {
+                t.Errorf( "undo applied to a modified copy" )
+            }
+        } )
+    }
+}
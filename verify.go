@@ -0,0 +1,110 @@
+
+package main
+
+import (
+    "fmt"
+    "strings"
+)
+
+// Scan verification (-verify-scan): all scans of the first frame are entropy
+// decoded to check that the compressed picture is intact, without
+// dequantization, IDCT or color conversion. Invalid Huffman codes, coefficient
+// index overruns, entropy-coded data too short or too long for the number of
+// MCUs it must contain and out of sequence RSTn markers are reported as errors.
+// Arithmetic coded data can legally end before all decisions are decoded, so
+// only invalid codes and RSTn markers are checked for arithmetic coded frames.
+
+// verifyScans reports whether the entropy-coded data of the first frame is
+// intact, and returns an error if not.
+func verifyScans( data []byte, l *fileLayout, rep *fileReport ) error {
+    for _, s := range l.segments {
+        if ! isSOF( s.marker ) {
+            continue
+        }
+        if s.marker > markerSOF0 + 2 && s.marker != markerSOF0 + 9 &&
+           s.marker != markerSOF0 + 10 {
+            text := fmt.Sprintf( "scan verification is not available for %s " +
+                                 "frames", markerName( s.marker ) )
+            fmt.Printf( "Warning: %s\n", text )
+            rep.addMessage( warningSeverity, codeScanVerification, text )
+            return nil
+        }
+        break
+    }
+    img, issues := scanIssues( data, l )
+    if len(issues) == 0 {
+        codes := fmt.Sprintf( "%d Huffman codes", img.codes )
+        if isArithmetic( img.frame.marker ) {
+            codes = "arithmetic coding"
+        }
+        fmt.Printf( "Scan verification: %d scan(s), %d RSTn marker(s), " +
+                    "%s: entropy-coded data is intact\n", img.nScans,
+                    img.restarts, codes )
+        return nil
+    }
+    fmt.Printf( "Scan verification: entropy-coded data is not intact\n" )
+    for _, issue := range issues {
+        text := "Scan error: " + strings.TrimSuffix( issue, "\n" )
+        fmt.Printf( "  %s\n", text )
+        rep.addMessage( errorSeverity, codeScanVerification, text )
+    }
+    return codedError{ fmt.Errorf( "invalid entropy-coded data: %s",
+                                   issues[0] ), codeScanVerification }
+}
+
+// scanIssues decodes all scans of the first frame and returns the decoded
+// coefficients with the problems found in the entropy-coded data, if any
+func scanIssues( data []byte, l *fileLayout ) (img *coefImage,
+                                                issues []string) {
+    img, err := decodeCoefficients( data, l )
+    if img != nil {
+        issues = img.issues
+    }
+    if err != nil {
+        issues = append( issues, err.Error() )
+    } else {
+        if ! hasEOI( l ) {
+            issues = append( issues, "missing EOI, the compressed picture " +
+                                     "may be truncated\n" )
+        }
+        for ci := range img.comps {
+            if r := incompleteCoefficients( &img.comps[ci] ); r != "" {
+                issues = append( issues, fmt.Sprintf( "component %d: " +
+                                 "coefficients %s not entirely decoded\n",
+                                 img.frame.comps[ci].id, r ) )
+            }
+        }
+    }
+    return
+}
+
+// hasEOI returns true if the first image in the layout ends with EOI
+func hasEOI( l *fileLayout ) bool {
+    for _, s := range l.segments {
+        if s.marker == markerEOI {
+            return true
+        }
+    }
+    return false
+}
+
+// incompleteCoefficients returns the ranges of coefficients (in zigzag order)
+// not entirely decoded by the scans, as in "1-5,9-63", or "" if none
+func incompleteCoefficients( cc *compCoefs ) string {
+    var ranges []string
+    for k := 0; k < 64; k++ {
+        if cc.complete[k] {
+            continue
+        }
+        first := k
+        for k < 63 && ! cc.complete[k+1] {
+            k++
+        }
+        if first == k {
+            ranges = append( ranges, fmt.Sprintf( "%d", k ) )
+        } else {
+            ranges = append( ranges, fmt.Sprintf( "%d-%d", first, k ) )
+        }
+    }
+    return strings.Join( ranges, "," )
+}
@@ -0,0 +1,127 @@
+
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "image"
+    "image/color"
+)
+
+// Minimal lossless WebP (VP8L) writer: no transform, no color cache and no
+// backward references, with fixed 8-bit prefix codes for the green, red and
+// blue literals and single symbol codes for alpha and distances. The result
+// is about 3 bytes per pixel, which is acceptable for thumbnails and depth
+// maps, and can be decoded by any WebP decoder.
+
+const webpMaxDimension = 1 << 14
+
+// webpBitWriter writes bits LSB first, as required by VP8L
+type webpBitWriter struct {
+    buf             bytes.Buffer
+    acc             uint64
+    n               uint
+}
+
+func (w *webpBitWriter) write( value uint32, nBits uint ) {
+    w.acc |= uint64(value) << w.n
+    w.n += nBits
+    for w.n >= 8 {
+        w.buf.WriteByte( byte(w.acc) )
+        w.acc >>= 8
+        w.n -= 8
+    }
+}
+
+func (w *webpBitWriter) flush( ) []byte {
+    if w.n > 0 {
+        w.buf.WriteByte( byte(w.acc) )
+        w.acc, w.n = 0, 0
+    }
+    return w.buf.Bytes()
+}
+
+// writeFixedCode writes a normal prefix code where the first 256 symbols have
+// length 8 and the others (up to nSymbols) are unused. Code lengths are coded
+// with a code length code where symbols 0 and 8 both have length 1.
+func (w *webpBitWriter) writeFixedCode( nSymbols int ) {
+    w.write( 0, 1 )                     // normal code
+    // code length code order: 17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8...
+    w.write( 12 - 4, 4 )                // 12 code length code lengths
+    for _, l := range []uint32{ 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 1 } {
+        w.write( l, 3 )
+    }
+    w.write( 0, 1 )                     // max_symbol is the alphabet size
+    for s := 0; s < nSymbols; s++ {
+        if s < 256 {
+            w.write( 1, 1 )             // code of length 8 (symbol 8)
+        } else {
+            w.write( 0, 1 )             // unused (symbol 0)
+        }
+    }
+}
+
+// writeSimpleCode writes a prefix code with a single 8-bit symbol
+func (w *webpBitWriter) writeSimpleCode( symbol uint32 ) {
+    w.write( 1, 1 )                     // simple code
+    w.write( 0, 1 )                     // 1 symbol
+    w.write( 1, 1 )                     // 8-bit symbol
+    w.write( symbol, 8 )
+}
+
+// reverse8 returns the 8-bit canonical code of a literal, bit reversed since
+// prefix codes are read one bit at a time from the LSB first stream
+func reverse8( v uint8 ) uint32 {
+    var r uint32
+    for i := 0; i < 8; i++ {
+        r = r << 1 | uint32( v >> i & 1 )
+    }
+    return r
+}
+
+// encodeWebp returns a lossless WebP file for img, ignoring any alpha channel
+func encodeWebp( img image.Image ) ([]byte, error) {
+    b := img.Bounds()
+    width, height := b.Dx(), b.Dy()
+    if width < 1 || height < 1 || width > webpMaxDimension ||
+       height > webpMaxDimension {
+        return nil, fmt.Errorf( "invalid size %dx%d for WebP\n", width, height )
+    }
+    w := new( webpBitWriter )
+    w.write( 0x2f, 8 )                  // VP8L signature
+    w.write( uint32(width - 1), 14 )
+    w.write( uint32(height - 1), 14 )
+    w.write( 0, 1 )                     // alpha is not used
+    w.write( 0, 3 )                     // version
+    w.write( 0, 1 )                     // no transform
+    w.write( 0, 1 )                     // no color cache
+    w.write( 0, 1 )                     // no meta prefix codes
+    w.writeFixedCode( 256 + 24 )        // green, with length prefix codes
+    w.writeFixedCode( 256 )             // red
+    w.writeFixedCode( 256 )             // blue
+    w.writeSimpleCode( 255 )            // alpha, always opaque
+    w.writeSimpleCode( 0 )              // distance, unused
+    for y := b.Min.Y; y < b.Max.Y; y++ {
+        for x := b.Min.X; x < b.Max.X; x++ {
+            c := color.NRGBAModel.Convert( img.At( x, y ) ).(color.NRGBA)
+            w.write( reverse8( c.G ), 8 )
+            w.write( reverse8( c.R ), 8 )
+            w.write( reverse8( c.B ), 8 )
+        }
+    }
+    payload := w.flush()
+
+    var out bytes.Buffer
+    size := len(payload)
+    padded := size + size & 1
+    out.WriteString( "RIFF" )
+    binary.Write( &out, binary.LittleEndian, uint32( 4 + 8 + padded ) )
+    out.WriteString( "WEBPVP8L" )
+    binary.Write( &out, binary.LittleEndian, uint32(size) )
+    out.Write( payload )
+    if size & 1 != 0 {
+        out.WriteByte( 0 )
+    }
+    return out.Bytes(), nil
+}
@@ -0,0 +1,175 @@
+
+package main
+
+import (
+    "encoding/xml"
+    "fmt"
+    "os"
+    "strconv"
+    "time"
+)
+
+// XML report closely modeled on the JHOVE audit output, which is the format
+// expected by many preservation repositories: a root jhove element with one
+// repInfo element per file checked.
+
+const jhoveNamespace = "http://schema.openpreservation.org/ois/xml/ns/jhove"
+
+type xmlMessage struct {
+    Severity        string      `xml:"severity,attr"`
+    Id              string      `xml:"id,attr"`
+    Offset          string      `xml:"offset,attr,omitempty"`
+    Frame           string      `xml:"frame,attr,omitempty"`
+    SubMessage      string      `xml:"subMessage,attr,omitempty"`
+    Text            string      `xml:",chardata"`
+}
+
+type xmlValue struct {
+    Name            string      `xml:"name"`
+    Value           string      `xml:"values>value"`
+}
+
+type xmlFrame struct {
+    Name            string      `xml:"name"`
+    Properties      []xmlValue  `xml:"values>property"`
+}
+
+type xmlMessages struct {
+    Messages        []xmlMessage `xml:"message"`
+}
+
+type xmlProperties struct {
+    Frames          []xmlFrame  `xml:"property"`
+}
+
+type xmlRepInfo struct {
+    XMLName         xml.Name    `xml:"repInfo"`
+    URI             string      `xml:"uri,attr"`
+    Module          string      `xml:"reportingModule"`
+    LastModified    string      `xml:"lastModified,omitempty"`
+    Size            int64       `xml:"size"`
+    Format          string      `xml:"format"`
+    Status          string      `xml:"status"`
+    Messages        *xmlMessages `xml:"messages,omitempty"`
+    MimeType        string      `xml:"mimeType,omitempty"`
+    Properties      *xmlProperties `xml:"properties,omitempty"`
+}
+
+type xmlReport struct {
+    f               *os.File
+    enc             *xml.Encoder
+}
+
+func newXmlReport( path string, process *jpgArgs ) (*xmlReport, error) {
+    f, err := os.OpenFile( path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644 )
+    if err != nil {
+        return nil, fmt.Errorf( "unable to create xml report %s: %v\n", path, err )
+    }
+    xr := &xmlReport{ f: f, enc: xml.NewEncoder( f ) }
+    xr.enc.Indent( "", "  " )
+    fmt.Fprintf( f, "%s", xml.Header )
+    now, dated := process.outputTime()
+    start := xml.StartElement{ Name: xml.Name{ Local: "jhove" },
+                               Attr: []xml.Attr{
+                    { Name: xml.Name{ Local: "xmlns" }, Value: jhoveNamespace },
+                    { Name: xml.Name{ Local: "name" }, Value: "jcheck" },
+                    { Name: xml.Name{ Local: "release" }, Value: VERSION } } }
+    if dated {
+        start.Attr = append( start.Attr, xml.Attr{
+                                Name: xml.Name{ Local: "date" },
+                                Value: now.Format( "2006-01-02" ) } )
+    }
+    xr.enc.EncodeToken( start )
+    if dated {
+        xr.enc.EncodeElement( now.Format( time.RFC3339 ),
+                              xml.StartElement{ Name: xml.Name{ Local: "date" } } )
+    }
+    return xr, nil
+}
+
+func xmlStatus( rep *fileReport ) string {
+    switch {
+    case ! rep.analysed && rep.failed:  return "Not well-formed (previous run)"
+    case ! rep.analysed:                return "Well-Formed and valid (previous run)"
+    case ! rep.complete:                return "Not well-formed"
+    case rep.failed:                    return "Well-Formed, but not valid"
+    }
+    return "Well-Formed and valid"
+}
+
+func (xr *xmlReport) name( ) string {
+    return "xml report"
+}
+
+func (xr *xmlReport) add( rep *fileReport ) error {
+    ri := xmlRepInfo{ URI: rep.path, Size: rep.size, Format: "JPEG",
+                      Module: "jcheck " + VERSION, Status: xmlStatus( rep ) }
+    if ! rep.modified.IsZero() {
+        ri.LastModified = rep.modified.Format( time.RFC3339 )
+    }
+    if rep.complete {
+        ri.MimeType = "image/jpeg"
+    }
+    if len(rep.messages) > 0 {
+        ri.Messages = new( xmlMessages )
+    }
+    for _, m := range rep.messages {
+        xm := xmlMessage{ Severity: m.severity.String(), Id: m.code,
+                          Text: m.text }
+        if m.offset >= 0 {
+            xm.Offset = strconv.FormatInt( m.offset, 10 )
+        }
+        if m.cite != nil {
+            xm.SubMessage = "see " + m.cite.String()
+        }
+        if m.frame >= 0 {
+            xm.Frame = strconv.Itoa( m.frame )
+        }
+        ri.Messages.Messages = append( ri.Messages.Messages, xm )
+    }
+    if len(rep.frames) > 0 || len(rep.structure) > 0 {
+        ri.Properties = new( xmlProperties )
+    }
+    for i, fi := range rep.frames {
+        ri.Properties.Frames = append( ri.Properties.Frames, xmlFrame{
+            Name: fmt.Sprintf( "Frame%d", i ),
+            Properties: []xmlValue{
+                { "EncodingMode", encodingModeName( fi.Mode ) },
+                { "EntropyCoding", entropyCodingName( fi.Entropy ) },
+                { "SamplePrecision", fmt.Sprintf( "%d", fi.SampleSize ) },
+                { "ImageWidth", fmt.Sprintf( "%d", fi.Width ) },
+                { "ImageHeight", fmt.Sprintf( "%d", fi.Height ) },
+                { "NumberOfComponents",
+                  fmt.Sprintf( "%d", len(fi.Components) ) } } } )
+    }
+    for i, f := range rep.structure {   // frames unknown to the library
+        if i >= len(ri.Properties.Frames) {
+            ri.Properties.Frames = append( ri.Properties.Frames, xmlFrame{
+                Name: fmt.Sprintf( "Frame%d", i ),
+                Properties: []xmlValue{
+                    { "EncodingMode", f.encodingMode() },
+                    { "EntropyCoding", f.entropyCoding() },
+                    { "SamplePrecision", fmt.Sprintf( "%d", f.precision ) },
+                    { "ImageWidth", fmt.Sprintf( "%d", f.width ) },
+                    { "ImageHeight", fmt.Sprintf( "%d", f.height ) },
+                    { "NumberOfComponents",
+                      fmt.Sprintf( "%d", len(f.components) ) } } } )
+        }
+        fr := &ri.Properties.Frames[i]
+        fr.Properties = append( fr.Properties,
+            xmlValue{ "Marker", markerName( f.marker ) },
+            xmlValue{ "Offset", fmt.Sprintf( "%d", f.offset ) },
+            xmlValue{ "NumberOfScans", fmt.Sprintf( "%d", f.scans ) } )
+    }
+    return xr.enc.Encode( &ri )
+}
+
+func (xr *xmlReport) close( ) error {
+    xr.enc.EncodeToken( xml.EndElement{ Name: xml.Name{ Local: "jhove" } } )
+    if err := xr.enc.Flush(); err != nil {
+        xr.f.Close()
+        return err
+    }
+    fmt.Fprintf( xr.f, "\n" )
+    return xr.f.Close()
+}
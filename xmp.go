@@ -0,0 +1,356 @@
+
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+)
+
+// XMP packets: the main packet is stored in an APP1 segment after the XMP
+// namespace header. Packets larger than a segment are split into a main packet
+// and an extended packet, stored in APP1 segments with the extension header,
+// the GUID of the extended packet, its full length and the offset of the
+// part in the segment.
+
+var xmpExtensionHeader = []byte( "http://ns.adobe.com/xmp/extension/\x00" )
+
+type xmpPacket struct {
+    offset          int         // file offset of the first segment
+    data            []byte
+    extended        bool
+}
+
+// xmpPackets returns the main XMP packet and the extended packets found before
+// the image data, in the order of their first segment
+func xmpPackets( data []byte, l *fileLayout ) (packets []*xmpPacket) {
+    extended := make( map[string]*xmpPacket )
+    for i := range l.segments {
+        s := &l.segments[i]
+        if isImageDataMarker( s.marker ) || s.marker == markerEOI {
+            break
+        }
+        if s.marker != markerAPP0 + 1 {
+            continue
+        }
+        d := s.data( data )
+        switch {
+        case bytes.HasPrefix( d, xmpHeader ):
+            packets = append( packets, &xmpPacket{ offset: s.offset,
+                                                   data: d[len(xmpHeader):] } )
+        case bytes.HasPrefix( d, xmpExtensionHeader ) &&
+             len(d) >= len(xmpExtensionHeader) + 40:
+            d = d[len(xmpExtensionHeader):]
+            guid := string( d[:32] )
+            size := binary.BigEndian.Uint32( d[32:] )
+            offset := binary.BigEndian.Uint32( d[36:] )
+            part := d[40:]
+            p, ok := extended[guid]
+            if ! ok {
+                if size > 1 << 28 {     // ignore unreasonable sizes
+                    continue
+                }
+                p = &xmpPacket{ offset: s.offset, extended: true,
+                                data: make( []byte, size ) }
+                extended[guid] = p
+                packets = append( packets, p )
+            }
+            if uint64(offset) + uint64(len(part)) <= uint64(len(p.data)) {
+                copy( p.data[offset:], part )
+            }
+        }
+    }
+    return
+}
+
+// xmpResource holds the simple properties of an XMP resource, given either as
+// attributes or as elements with a text value, by namespace URI and local name
+// separated by a space.
+type xmpResource map[string]string
+
+// xmpResources returns the resources of a packet with simple properties, in
+// document order. Nested resources, such as items of a list, are returned as
+// separate resources.
+func xmpResources( packet []byte ) (resources []xmpResource) {
+    dec := xml.NewDecoder( bytes.NewReader( packet ) )
+    dec.Strict = false
+    type level struct {
+        props       xmpResource
+        text        strings.Builder
+        name        xml.Name
+        children    bool
+    }
+    var stack []*level
+    for {
+        tok, err := dec.Token()
+        if err != nil {                 // io.EOF or invalid packet
+            break
+        }
+        switch t := tok.(type) {
+        case xml.StartElement:
+            if len(stack) > 0 {
+                stack[len(stack)-1].children = true
+            }
+            lv := &level{ props: make( xmpResource ), name: t.Name }
+            for _, a := range t.Attr {
+                if a.Name.Space == "xmlns" || a.Name.Local == "xmlns" {
+                    continue
+                }
+                lv.props[a.Name.Space + " " + a.Name.Local] = a.Value
+            }
+            stack = append( stack, lv )
+        case xml.CharData:
+            if len(stack) > 0 {
+                stack[len(stack)-1].text.Write( t )
+            }
+        case xml.EndElement:
+            if len(stack) == 0 {
+                continue
+            }
+            lv := stack[len(stack)-1]
+            stack = stack[:len(stack)-1]
+            if len(lv.props) > 0 {
+                resources = append( resources, lv.props )
+            }
+            if ! lv.children && len(stack) > 0 {
+                text := strings.TrimSpace( lv.text.String() )
+                if text != "" {
+                    parent := stack[len(stack)-1].props
+                    parent[lv.name.Space + " " + lv.name.Local] = text
+                }
+            }
+        }
+    }
+    return
+}
+
+const rdfNamespace = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+
+// usual prefixes, for namespaces used without declaration
+var xmpPrefixes = map[string]string{
+    rdfNamespace:                                   "rdf",
+    "http://www.w3.org/XML/1998/namespace":         "xml",
+    "adobe:ns:meta/":                               "x",
+    "http://ns.adobe.com/xap/1.0/":                 "xmp",
+    "http://ns.adobe.com/xap/1.0/mm/":              "xmpMM",
+    "http://ns.adobe.com/xap/1.0/rights/":          "xmpRights",
+    "http://ns.adobe.com/xap/1.0/sType/ResourceEvent#": "stEvt",
+    "http://ns.adobe.com/xap/1.0/sType/ResourceRef#":   "stRef",
+    "http://purl.org/dc/elements/1.1/":             "dc",
+    "http://ns.adobe.com/photoshop/1.0/":           "photoshop",
+    "http://ns.adobe.com/tiff/1.0/":                "tiff",
+    "http://ns.adobe.com/exif/1.0/":                "exif",
+    "http://ns.adobe.com/camera-raw-settings/1.0/": "crs",
+    "http://iptc.org/std/Iptc4xmpCore/1.0/xmlns/":  "Iptc4xmpCore",
+}
+
+// xmpProperty is a property of an XMP packet, with its path made of
+// namespace prefixes and local names, array indexes or languages between
+// brackets and struct fields after '/', such as dc:title[x-default] or
+// xmpMM:History[2]/stEvt:action
+type xmpProperty struct {
+    path            string
+    value           string
+}
+
+// xmpProperties returns the properties of an XMP packet in document order,
+// decoding the RDF/XML syntax: properties given as attributes or elements,
+// arrays (rdf:Seq, rdf:Bag and rdf:Alt items), structs (nested rdf:Description
+// or rdf:parseType="Resource") and references (rdf:resource). Namespaces are
+// named by the prefixes declared in the packet.
+func xmpProperties( packet []byte ) (props []xmpProperty) {
+    dec := xml.NewDecoder( bytes.NewReader( packet ) )
+    dec.Strict = false
+    prefixes := make( map[string]string )
+    qname := func( n xml.Name ) string {
+        if p, ok := prefixes[n.Space]; ok {
+            return p + ":" + n.Local
+        }
+        if p, ok := xmpPrefixes[n.Space]; ok {
+            return p + ":" + n.Local
+        }
+        if n.Space == "" {
+            return n.Local
+        }
+        return "{" + n.Space + "}" + n.Local
+    }
+    join := func( path, name string ) string {
+        if path == "" {
+            return name
+        }
+        return path + "/" + name
+    }
+    type level struct {
+        path        string      // of the property, "" outside properties
+        items       int         // rdf:li counter, for arrays
+        text        strings.Builder
+        children    bool
+        value       bool        // value given by rdf:resource or attributes
+        transparent bool        // rdf or x element, not a property
+    }
+    var stack []*level
+    for {
+        tok, err := dec.Token()
+        if err != nil {                 // io.EOF or invalid packet
+            break
+        }
+        switch t := tok.(type) {
+        case xml.StartElement:
+            for _, a := range t.Attr {
+                if a.Name.Space == "xmlns" {
+                    prefixes[a.Value] = a.Name.Local
+                }
+            }
+            path := ""
+            var parent *level
+            if len(stack) > 0 {
+                parent = stack[len(stack)-1]
+                parent.children = true
+                path = parent.path
+            }
+            switch {
+            case t.Name.Space == rdfNamespace && t.Name.Local == "li":
+                if parent != nil {
+                    parent.items ++
+                    index := fmt.Sprintf( "%d", parent.items )
+                    for _, a := range t.Attr {
+                        if a.Name.Local == "lang" {
+                            index = a.Value
+                        }
+                    }
+                    path += "[" + index + "]"
+                }
+            case t.Name.Space == rdfNamespace || t.Name.Space == "adobe:ns:meta/":
+                // rdf:RDF, rdf:Description, rdf:Seq... and x:xmpmeta are
+                // transparent: their content belongs to the enclosing property
+            default:
+                path = join( path, qname( t.Name ) )
+            }
+            lv := &level{ path: path, transparent: path == "" ||
+                          ( t.Name.Space == rdfNamespace &&
+                            t.Name.Local != "li" ) ||
+                          t.Name.Space == "adobe:ns:meta/" }
+            for _, a := range t.Attr {
+                switch {
+                case a.Name.Space == "xmlns" || a.Name.Local == "xmlns":
+                case a.Name.Space == rdfNamespace && a.Name.Local == "resource":
+                    props = append( props, xmpProperty{ path, a.Value } )
+                    lv.value = true
+                case a.Name.Space == rdfNamespace ||
+                     a.Name.Space == "http://www.w3.org/XML/1998/namespace" ||
+                     a.Name.Local == "lang":
+                    // rdf:about, rdf:parseType, xml:lang...
+                default:
+                    props = append( props, xmpProperty{
+                                            join( path, qname( a.Name ) ),
+                                            a.Value } )
+                    lv.value = true
+                }
+            }
+            stack = append( stack, lv )
+        case xml.CharData:
+            if len(stack) > 0 {
+                stack[len(stack)-1].text.Write( t )
+            }
+        case xml.EndElement:
+            if len(stack) == 0 {
+                continue
+            }
+            lv := stack[len(stack)-1]
+            stack = stack[:len(stack)-1]
+            if lv.children || lv.value || lv.transparent {
+                continue
+            }
+            props = append( props, xmpProperty{ lv.path,
+                                    strings.TrimSpace( lv.text.String() ) } )
+        }
+    }
+    return
+}
+
+// formatXmpMetadata prints the properties of all XMP packets in data
+func formatXmpMetadata( w io.Writer, data []byte ) {
+    packets := xmpPackets( data, scanLayout( data ) )
+    if len(packets) == 0 {
+        return
+    }
+    fmt.Fprintf( w, "------ XMP Metadata:\n" )
+    for _, p := range packets {
+        kind := "Main packet"
+        if p.extended {
+            kind = "Extended packet"
+        }
+        fmt.Fprintf( w, "\n--- %s (APP1 @0x%04x)\n", kind, p.offset )
+        for _, prop := range xmpProperties( p.data ) {
+            fmt.Fprintf( w, "  %s:\n", prop.path )
+            for _, l := range strings.Split( prop.value, "\n" ) {
+                fmt.Fprintf( w, "    %s\n", strings.TrimSpace( l ) )
+            }
+            fmt.Fprintf( w, "\n" )
+        }
+    }
+    fmt.Fprintf( w, "------\n" )
+}
+
+// isXmpSegment returns true if s is an APP1 segment of a main or extended XMP
+// packet
+func isXmpSegment( data []byte, s *segment ) bool {
+    d := s.data( data )
+    return s.marker == markerAPP0 + 1 && ( bytes.HasPrefix( d, xmpHeader ) ||
+           bytes.HasPrefix( d, xmpExtensionHeader ) )
+}
+
+// xmpCopy puts back the XMP segments, main and extended, of the original data
+// orig in the copy at output if it has none, unless remove is true, since the
+// library does not keep them when writing. The segments are inserted after the
+// JFIF and Exif segments. It returns a description of the change, or "" if
+// nothing was done.
+func xmpCopy( orig []byte, output string, remove bool ) (string, error) {
+    ol := scanLayout( orig )
+    var segs [][]byte
+    for i := range ol.segments {
+        s := &ol.segments[i]
+        if isImageDataMarker( s.marker ) || s.marker == markerEOI {
+            break
+        }
+        if isXmpSegment( orig, s ) {
+            segs = append( segs, orig[s.offset:s.end()] )
+        }
+    }
+    if segs == nil || remove {
+        return "", nil
+    }
+    data, err := os.ReadFile( output )
+    if err != nil {
+        return "", fmt.Errorf( "xmp: %v\n", err )
+    }
+    l := scanLayout( data )
+    insertAt := 2                       // after SOI, JFIF and Exif
+    for i := range l.segments {
+        s := &l.segments[i]
+        if isImageDataMarker( s.marker ) || s.marker == markerEOI {
+            break
+        }
+        if isXmpSegment( data, s ) {
+            return "", nil
+        }
+        if s.marker == markerAPP0 || s.marker == markerAPP0 + 1 {
+            insertAt = s.end()
+        }
+    }
+    var b bytes.Buffer
+    b.Write( data[:insertAt] )
+    for _, seg := range segs {
+        b.Write( seg )
+    }
+    b.Write( data[insertAt:] )
+    if err = writeFile( output, b.Bytes(), 0644 ); err != nil {
+        return "", fmt.Errorf( "xmp: %v\n", err )
+    }
+    return fmt.Sprintf( "xmp: %d APP1 segment(s) of the original put back in " +
+                        "the copy", len(segs) ), nil
+}
@@ -0,0 +1,128 @@
+
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "strings"
+)
+
+// JPEG XT (ISO/IEC 18477) extension layers: a JPEG XT file is a legacy JPEG
+// file (the base layer) with additional codestreams and their merging
+// specification stored as boxes in APP11 segments, using the same packets as
+// JUMBF. Residual codestreams extend the base layer to HDR, lossless or
+// higher bit depths, refinement codestreams add precision to the base or
+// residual layers, and alpha codestreams add an opacity channel. Only the
+// base layer is decoded, which is reported since the result is not what the
+// file was designed to show.
+
+var xtBoxNames = map[string]string {
+    "ftyp": "file type",
+    "SPEC": "merging specification",
+    "ASPC": "alpha merging specification",
+    "RESI": "residual codestream",
+    "FINE": "refinement codestream",
+    "RFIN": "residual refinement codestream",
+    "ALFA": "alpha codestream",
+    "AFIN": "alpha refinement codestream",
+    "LCHK": "legacy checksum",
+    "OCON": "output conversion",
+    "DCTR": "DCT transformation",
+    "TONE": "tone mapping lookup table",
+    "FTON": "floating point tone mapping",
+    "CURV": "parametric tone mapping curve",
+    "MTRX": "linear transformation",
+    "FTRX": "floating point transformation",
+}
+
+// layers that the base layer decoding ignores
+var xtLayers = map[string]string {
+    "RESI": "residual for HDR, lossless or extended precision",
+    "FINE": "refinement",
+    "RFIN": "residual refinement",
+    "ALFA": "alpha channel",
+    "AFIN": "alpha refinement",
+}
+
+// isXtSuperbox returns true for boxes containing other boxes
+func isXtSuperbox( typ string ) bool {
+    return typ == "SPEC" || typ == "ASPC"
+}
+
+// xtCodestream describes the frame of a codestream stored in a data box
+func xtCodestream( payload []byte ) string {
+    l := scanLayout( payload )
+    for i := range l.segments {
+        s := &l.segments[i]
+        if isSOF( s.marker ) {
+            if fh, err := parseFrameHeader( s, payload ); err == nil {
+                return fmt.Sprintf( "%s, %dx%d, %d-bit, %d component(s)",
+                                    markerName( s.marker ), fh.width,
+                                    fh.height, fh.precision, len(fh.comps) )
+            }
+            return markerName( s.marker )
+        }
+    }
+    return "no frame header"
+}
+
+func xtFileType( payload []byte ) string {
+    if len(payload) < 8 {
+        return "invalid"
+    }
+    brands := []string{ }
+    for b := payload[8:]; len(b) >= 4; b = b[4:] {
+        brands = append( brands, strings.TrimSpace( string( b[:4] ) ) )
+    }
+    return fmt.Sprintf( "brand %s, version %d, compatible %s",
+                        strings.TrimSpace( string( payload[:4] ) ),
+                        binary.BigEndian.Uint32( payload[4:] ),
+                        strings.Join( brands, " " ) )
+}
+
+// formatJpegXt reports the JPEG XT boxes found in APP11 segments, if any, and
+// warns that their layers are not decoded.
+func formatJpegXt( data []byte, l *fileLayout, rep *fileReport ) {
+    top, _ := jumbfTree( data, l )
+    var boxes []*jumbfBox
+    for _, t := range top {
+        if _, ok := xtBoxNames[t.box.typ]; ok {
+            boxes = append( boxes, t.box )
+        }
+    }
+    if len(boxes) == 0 {
+        return
+    }
+    fmt.Printf( "JPEG XT: %d extension box(es) in APP11\n", len(boxes) )
+    var layers []string
+    seen := make( map[string]bool )
+    for _, b := range boxes {
+        fmt.Printf( "  %s (%s), %d bytes", b.typ, xtBoxNames[b.typ],
+                    len(b.payload) )
+        switch {
+        case b.typ == "ftyp":
+            fmt.Printf( ": %s", xtFileType( b.payload ) )
+        case isXtSuperbox( b.typ ):
+            children, _ := parseJumbfBoxes( b.payload, 0 )
+            var types []string
+            for _, c := range children {
+                types = append( types, c.typ )
+            }
+            fmt.Printf( ": %s", strings.Join( types, " " ) )
+        case xtLayers[b.typ] != "":
+            fmt.Printf( ": %s", xtCodestream( b.payload ) )
+            if ! seen[b.typ] {
+                layers = append( layers, xtLayers[b.typ] )
+                seen[b.typ] = true
+            }
+        }
+        fmt.Printf( "\n" )
+    }
+    if len(layers) > 0 {
+        text := fmt.Sprintf( "JPEG XT extension layers are not decoded, " +
+                             "only the legacy base layer is: %s",
+                             strings.Join( layers, "; " ) )
+        fmt.Printf( "  Warning: %s\n", text )
+        rep.addMessage( warningSeverity, codeJpegXt, text )
+    }
+}